@@ -0,0 +1,165 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/kek/slop-shop/ollama"
+	"github.com/kek/slop-shop/styles"
+	"github.com/kek/slop-shop/tools"
+	"github.com/kek/slop-shop/tui"
+)
+
+// maxSteps is the most turns a batch run with tools takes, set by -max-steps.
+// With more than one, tool results go back to the model until it gives a
+// FINAL_ANSWER.
+var maxSteps = 1
+
+// finishReminder is sent when the model neither called a tool nor finished
+const finishReminder = "You did not call any tools or give a FINAL_ANSWER. If the task is done, end your reply with FINAL_ANSWER: <summary> and CHANGED_FILES: <paths, or none>; otherwise continue with tool calls."
+
+// runOutcome is how a run with tools ended: "complete" with the model's final
+// answer, or "incomplete" when -max-steps ran out before one
+type runOutcome struct {
+	Status string `json:"status"`
+	tools.FinalAnswer
+	Steps int `json:"steps"`
+}
+
+// streamTurn sends a prompt, streaming the response to the display, and returns
+// the response without the error message shown in its place
+func streamTurn(client *ollama.Client, history []int, prompt, context string, toolsEnabled bool) (string, ollama.Stats, []int, error) {
+	robot := styles.PromptStyle.Render("🤖 ")
+	fmt.Fprint(chatter(), robot)
+
+	// Channel for streaming response chunks
+	streamChannel := make(chan string, 100)
+	var response strings.Builder
+	var stats ollama.Stats
+	var newHistory []int
+	var err error
+
+	go func() {
+		_, stats, newHistory, err = client.Continue(history, prompt, context, toolsEnabled, func(chunk string) {
+			streamChannel <- chunk
+		})
+		if err != nil {
+			// Send error message to channel instead of silently failing
+			streamChannel <- fmt.Sprintf("\n❌ Error: %v\n", err)
+		}
+		close(streamChannel)
+	}()
+
+	// The response is wrapped to the terminal, or to -wrap, as the REPL wraps it
+	out := display()
+	width := styles.WrapWidth(terminalWidth(out))
+	wrapper := tui.NewWrapWriter(out, width, styles.Indent())
+	if width > 0 || styles.Indent() != "" {
+		out = wrapper
+	}
+
+	// Big contexts can take a minute to evaluate before the first token
+	stopWaiting := startWaiting(display(), client.Model, robot, !quiet && isTerminal(display()))
+	for chunk := range streamChannel {
+		stopWaiting()
+		fmt.Fprint(out, chunk)
+		response.WriteString(chunk)
+	}
+	stopWaiting()
+	wrapper.Flush()
+
+	fmt.Fprintln(display())
+	if stats.Cached {
+		fmt.Fprintln(chatter(), styles.InfoStyle.Render("Answered from the response cache; leave out -cache to ask the model again"))
+	}
+
+	if err != nil {
+		return strings.TrimSuffix(response.String(), fmt.Sprintf("\n❌ Error: %v\n", err)), stats, newHistory, err
+	}
+	return response.String(), stats, newHistory, nil
+}
+
+// runSteps runs the tool calls in the record's response and, while -max-steps
+// allows, sends their results back to the model until it gives a FINAL_ANSWER.
+// It returns the results of the last step, which decide the exit code.
+func runSteps(client *ollama.Client, record *batchRecord, repoPath string) []tools.ToolResult {
+	response := record.Response
+	for step := 1; ; step++ {
+		calls := tools.ParseToolCalls(response)
+		record.ToolCalls = append(record.ToolCalls, calls...)
+		var results []tools.ToolResult
+		if len(calls) > 0 || step == 1 {
+			// The calls recorded are the calls run; without any, the first step
+			// only reports that the response had none
+			results = tools.ExecuteCalls(calls, repoPath, client)
+			record.ToolResults = append(record.ToolResults, results...)
+		}
+
+		// A final answer given alongside calls the guardrails rejected is
+		// premature while there are steps left to correct them
+		if answer, ok := tools.ParseFinalAnswer(response); ok && (!rejected(results) || step >= maxSteps) {
+			record.Outcome = &runOutcome{Status: "complete", FinalAnswer: answer, Steps: step}
+			return results
+		}
+		if maxSteps <= 1 || record.err != nil || wasInterrupted() {
+			return results
+		}
+		if step >= maxSteps {
+			record.Outcome = &runOutcome{Status: "incomplete", Steps: step}
+			return results
+		}
+
+		prompt := finishReminder
+		if len(results) > 0 {
+			prompt = tools.FormatResults(results)
+		}
+		fmt.Fprintln(chatter(), styles.InfoStyle.Render(fmt.Sprintf("\nStep %d of at most %d", step+1, maxSteps)))
+
+		var stats ollama.Stats
+		var err error
+		response, stats, record.history, err = streamTurn(client, record.history, prompt, "", false)
+		record.Response += "\n\n" + response
+		record.Stats = addStats(record.Stats, stats)
+		if err != nil {
+			record.err, record.Error = err, err.Error()
+		}
+	}
+}
+
+// rejected reports whether the guardrails stopped any of the tool calls
+func rejected(results []tools.ToolResult) bool {
+	for _, result := range results {
+		if result.Rejected {
+			return true
+		}
+	}
+	return false
+}
+
+// addStats adds up the token counts and timings of two turns
+func addStats(a, b ollama.Stats) ollama.Stats {
+	return ollama.Stats{
+		PromptTokens:       a.PromptTokens + b.PromptTokens,
+		ResponseTokens:     a.ResponseTokens + b.ResponseTokens,
+		TotalDuration:      a.TotalDuration + b.TotalDuration,
+		LoadDuration:       a.LoadDuration + b.LoadDuration,
+		PromptEvalDuration: a.PromptEvalDuration + b.PromptEvalDuration,
+		EvalDuration:       a.EvalDuration + b.EvalDuration,
+		Cached:             a.Cached && b.Cached,
+	}
+}
+
+// printOutcome shows the model's final answer, or that it never gave one
+func printOutcome(outcome *runOutcome) {
+	if outcome == nil {
+		return
+	}
+	if outcome.Status != "complete" {
+		fmt.Fprintln(chatter(), styles.WarningStyle.Render(fmt.Sprintf("\n⚠️  No FINAL_ANSWER after %d steps", outcome.Steps)))
+		return
+	}
+	fmt.Fprintln(chatter(), styles.SuccessStyle.Render(fmt.Sprintf("\n🏁 Done after step %d: %s", outcome.Steps, outcome.Summary)))
+	if len(outcome.ChangedFiles) > 0 {
+		fmt.Fprintln(chatter(), styles.InfoStyle.Render("Changed files: "+strings.Join(outcome.ChangedFiles, ", ")))
+	}
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/kek/slop-shop/styles"
+	"github.com/kek/slop-shop/tools"
+)
+
+// approvalInput is where the approver reads the user's answers
+var approvalInput io.Reader = os.Stdin
+
+// newApprover returns an approver that shows a tool call that runs a command
+// or writes files and asks whether to run it, and for how long to remember
+// the answer. Without a terminal to ask on, calls not covered by an approval
+// rule are refused.
+func newApprover(interactive bool) tools.Approver {
+	input := bufio.NewReader(approvalInput)
+	return func(call tools.ToolCall, subject string) (tools.Approval, error) {
+		if !interactive {
+			return tools.Deny, fmt.Errorf("%s needs approval and there is no terminal to ask on", call.Name)
+		}
+
+		out := display()
+		fmt.Fprintln(out, styles.WarningStyle.Render(fmt.Sprintf("\n🔐 %s wants to run: %s", call.Name, subject)))
+		for {
+			fmt.Fprint(out, styles.PromptStyle.Render("[y]es once, yes for this [s]ession, any "+call.Name+" for this [t]ool, [a]lways, [n]o? "))
+			answer, err := input.ReadString('\n')
+			if err != nil && answer == "" {
+				return tools.Deny, fmt.Errorf("%s was not approved: no answer", call.Name)
+			}
+			switch strings.ToLower(strings.TrimSpace(answer)) {
+			case "y", "yes":
+				return tools.AllowOnce, nil
+			case "s", "session":
+				return tools.AllowSession, nil
+			case "t", "tool":
+				return tools.AllowTool, nil
+			case "a", "always":
+				return tools.AllowAlways, nil
+			case "n", "no":
+				return tools.Deny, nil
+			}
+		}
+	}
+}
@@ -0,0 +1,357 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/kek/slop-shop/ollama"
+	"github.com/kek/slop-shop/styles"
+	"github.com/kek/slop-shop/tools"
+	"github.com/kek/slop-shop/tui"
+)
+
+// batchRecord is the structured result of a batch run, written by -output json
+type batchRecord struct {
+	Session     string             `json:"session,omitempty"`
+	Title       string             `json:"title,omitempty"`
+	Prompt      string             `json:"prompt"`
+	Model       string             `json:"model"`
+	URL         string             `json:"url"`
+	System      string             `json:"system,omitempty"`
+	Response    string             `json:"response"`
+	Error       string             `json:"error,omitempty"`
+	ToolCalls   []tools.ToolCall   `json:"tool_calls,omitempty"`
+	ToolResults []tools.ToolResult `json:"tool_results,omitempty"`
+	ToolSummary *tools.Summary     `json:"tool_summary,omitempty"`
+	Workspace   string             `json:"workspace_diff,omitempty"`
+	Speculative string             `json:"speculative_diff,omitempty"`
+	Outcome     *runOutcome        `json:"outcome,omitempty"`
+	Stats       ollama.Stats       `json:"stats"`
+	StartedAt   time.Time          `json:"started_at"`
+	Duration    time.Duration      `json:"duration"`
+	ExitCode    int                `json:"exit_code"`
+
+	history []int // Ollama conversation state after the response
+	err     error // Error from the model or the tool calls, classified by batchError
+}
+
+var (
+	// outputFormat is the batch output format: "text" or "json"
+	outputFormat = "text"
+
+	// displayWriter receives the banner, streamed response and tool progress. It
+	// is stderr when the JSON record is written to stdout and nil for os.Stdout.
+	displayWriter io.Writer
+
+	// responseFile and patchFile are the paths set by -out and -patch-out; a
+	// patchFile of "-" writes the patch to stdout
+	responseFile string
+	patchFile    string
+
+	// quiet suppresses everything but the model's response
+	quiet bool
+
+	// responseOnly is set when stdout is not a terminal: batch runs then show
+	// their banner, progress and streamed response on stderr and write only the
+	// final response to stdout
+	responseOnly bool
+
+	// sessionName is the conversation continued with -session, if any
+	sessionName string
+
+	// previewOnly prints what each batch run would send instead of sending it
+	previewOnly bool
+
+	// historyPath is the database runs are recorded in, or "" with -no-history
+	historyPath string
+
+	// commandName is the subcommand being run, recorded with each conversation
+	commandName = "ask"
+)
+
+// display returns the writer for decorative output, looking up os.Stdout on
+// each call so redirections of stdout are respected
+func display() io.Writer {
+	if displayWriter != nil {
+		return displayWriter
+	}
+	return os.Stdout
+}
+
+// setOutputFormat selects text or JSON batch output and routes decorative output accordingly
+func setOutputFormat(format string) error {
+	switch format {
+	case "text":
+		displayWriter = nil
+	case "json":
+		displayWriter = os.Stderr
+	default:
+		return fmt.Errorf("unknown output format %q (use text or json)", format)
+	}
+	outputFormat = format
+	tools.SetProgressOutput(displayWriter)
+	return nil
+}
+
+// chatter returns the writer for the banner, counts and status messages, which
+// -quiet discards
+func chatter() io.Writer {
+	if quiet {
+		return io.Discard
+	}
+	return display()
+}
+
+// setQuiet enables or disables quiet mode, which also silences tool progress
+func setQuiet(enabled bool) {
+	quiet = enabled
+	if enabled {
+		tools.SetProgressOutput(io.Discard)
+	} else {
+		tools.SetProgressOutput(displayWriter)
+	}
+}
+
+// setOutputFiles sets the files the response and the generated patch are saved to.
+// Writing the patch to stdout moves decorative output to stderr.
+func setOutputFiles(response, patch string) error {
+	responseFile = response
+	patchFile = patch
+	if patch == "-" {
+		if outputFormat == "json" {
+			return fmt.Errorf("-patch-out - cannot be combined with -output json, which also writes to stdout")
+		}
+		displayWriter = os.Stderr
+		tools.SetProgressOutput(displayWriter)
+	}
+	return nil
+}
+
+// setResponseOnly enables or disables writing only the response of a batch run
+// to stdout. Text output redirected to a file or pipe enables it, unless the
+// patch is written to stdout instead.
+func setResponseOnly(stdout io.Writer) {
+	responseOnly = outputFormat == "text" && patchFile != "-" && !isTerminal(stdout)
+}
+
+// moveDisplay moves decorative output to stderr while only the response is
+// written to stdout, and returns the function that moves it back
+func moveDisplay() func() {
+	if !responseOnly {
+		return func() {}
+	}
+	previous := displayWriter
+	displayWriter = os.Stderr
+	tools.SetProgressOutput(displayWriter)
+	return func() {
+		displayWriter = previous
+		tools.SetProgressOutput(previous)
+	}
+}
+
+// runBatch handles the single-prompt mode without Bubble Tea and returns the
+// model's response. The error carries the exit code for model and tool failures.
+func runBatch(prompt, context, ollamaURL, model, system string, temperature, topP float64, toolsEnabled bool, repoPath string) (string, error) {
+	if !previewOnly {
+		defer moveDisplay()()
+	}
+
+	client := ollama.NewClient(ollamaURL, model, temperature, topP)
+	client.System = system
+
+	var sess *session
+	var history []int
+	if sessionName != "" {
+		var err error
+		if sess, err = loadSession(sessionName); err != nil {
+			return "", err
+		}
+		history, context = sess.prepare(model, context)
+	}
+
+	if previewOnly {
+		fmt.Print(tui.RenderPreview(model, system, prompt, context, toolsEnabled, true))
+		if history != nil {
+			fmt.Printf("\nSession %s continues from Ollama's saved state of %d tokens, which is not shown.\n", sess.Name, len(history))
+		}
+		return "", nil
+	}
+
+	if err := checkContextWindow(client, prompt, context, len(history), toolsEnabled); err != nil {
+		return "", err
+	}
+
+	record := executeBatch(client, prompt, context, history, toolsEnabled, repoPath)
+
+	if record.Error == "" {
+		nameConversation(&record, sess)
+	}
+	if sess != nil && record.Error == "" {
+		record.Session = sess.Name
+		sess.addTurn(model, prompt, record.Response, record.history)
+		if err := sess.save(); err != nil {
+			fmt.Fprintln(os.Stderr, styles.ErrorStyle.Render(fmt.Sprintf("❌ %v", err)))
+		}
+	}
+
+	// An interrupted run is recorded with what arrived before it was stopped
+	if record.Error == "" || record.ExitCode == exitInterrupted {
+		if err := recordHistory(record, sessionName, repoPath); err != nil {
+			fmt.Fprintln(os.Stderr, styles.ErrorStyle.Render(fmt.Sprintf("❌ %v", err)))
+		} else if record.ExitCode == exitInterrupted && historyPath != "" {
+			fmt.Fprintln(chatter(), styles.InfoStyle.Render("The partial response was recorded in the history"))
+		}
+	}
+
+	if err := saveOutputs(record); err != nil {
+		fmt.Fprintln(os.Stderr, styles.ErrorStyle.Render(fmt.Sprintf("❌ %v", err)))
+	}
+
+	if outputFormat == "json" {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(record); err != nil {
+			fmt.Fprintf(os.Stderr, "Error writing JSON output: %v\n", err)
+		}
+	}
+	if responseOnly && strings.TrimSpace(record.Response) != "" {
+		fmt.Fprintln(os.Stdout, strings.TrimSpace(record.Response))
+	}
+	if record.ExitCode != exitInterrupted {
+		pageResponse(model, record.Response)
+	}
+
+	return record.Response, record.err
+}
+
+// executeBatch sends the prompt, streams the response to the display and runs any
+// tool calls. A non-nil history continues an earlier conversation.
+func executeBatch(client *ollama.Client, prompt, context string, history []int, toolsEnabled bool, repoPath string) batchRecord {
+	record := batchRecord{
+		Prompt:    prompt,
+		Model:     client.Model,
+		URL:       client.URL,
+		System:    client.System,
+		StartedAt: time.Now(),
+	}
+
+	fmt.Fprintln(chatter(), styles.TitleStyle.Render("🚀 Slop Shop - AI-Powered Code Analysis"))
+	fmt.Fprintln(chatter(), styles.InfoStyle.Render(fmt.Sprintf("Reading repository at: %s", repoPath)))
+	fmt.Fprintln(chatter(), styles.InfoStyle.Render(fmt.Sprintf("Using model: %s", client.Model)))
+	fmt.Fprintln(chatter(), styles.InfoStyle.Render(fmt.Sprintf("Prompt: %s", prompt)))
+	fmt.Fprintln(chatter(), styles.InfoStyle.Render(fmt.Sprintf("Ollama URL: %s", client.URL)))
+
+	if history != nil {
+		fmt.Fprintln(chatter(), styles.InfoStyle.Render("Continuing the session; the repository context was sent in an earlier turn"))
+	} else if context != "" {
+		fmt.Fprintln(chatter(), styles.SuccessStyle.Render(fmt.Sprintf("Found %d files", strings.Count(context, "File:"))))
+		fmt.Fprintln(chatter(), styles.InfoStyle.Render(fmt.Sprintf("Total context size: %d characters", len(context))))
+	} else {
+		fmt.Fprintln(chatter(), styles.InfoStyle.Render("Starting with empty context (no repository files loaded)"))
+	}
+
+	var err error
+	record.Response, record.Stats, record.history, err = streamTurn(client, history, prompt, context, toolsEnabled)
+	if err != nil {
+		record.err, record.Error = err, err.Error()
+	}
+
+	// Tool results only count towards the exit code in the step that finished the task
+	classified := record.ToolResults
+	if toolsEnabled {
+		snapshot, err := takeSnapshot(repoPath)
+		if err != nil {
+			fmt.Fprintln(chatter(), styles.WarningStyle.Render(fmt.Sprintf("⚠️  Changes to the workspace will not be shown: %v", err)))
+		}
+		classified = runSteps(client, &record, repoPath)
+		tools.CloseShell()
+		if len(record.ToolResults) > 0 {
+			summary := tools.SummarizeResults(record.ToolResults)
+			record.ToolSummary = &summary
+			fmt.Fprint(chatter(), "\n"+summary.String())
+			if speculative {
+				if record.Speculative, err = settleOverlay(repoPath); err != nil {
+					fmt.Fprintln(os.Stderr, styles.ErrorStyle.Render(fmt.Sprintf("❌ %v", err)))
+				}
+			}
+			if snapshot != nil {
+				if record.Workspace, err = reviewWorkspace(snapshot, prompt); err != nil {
+					fmt.Fprintln(os.Stderr, styles.ErrorStyle.Render(fmt.Sprintf("❌ %v", err)))
+				}
+			}
+		}
+		printOutcome(record.Outcome)
+	}
+
+	if record.err == nil && record.Outcome != nil && record.Outcome.Status == "incomplete" {
+		record.err = &exitError{exitIncomplete, fmt.Errorf("the model did not give a FINAL_ANSWER within %d steps", record.Outcome.Steps)}
+	} else {
+		record.err = batchError(record.err, classified)
+	}
+	record.ExitCode = exitCode(record.err)
+	record.Duration = time.Since(record.StartedAt)
+	return record
+}
+
+// saveOutputs writes the response and the patch to the files set by -out and -patch-out
+func saveOutputs(record batchRecord) error {
+	if responseFile != "" {
+		if err := os.WriteFile(responseFile, []byte(record.Response), 0644); err != nil {
+			return fmt.Errorf("error writing response: %v", err)
+		}
+		fmt.Fprintln(chatter(), styles.SuccessStyle.Render(fmt.Sprintf("Response saved to %s", responseFile)))
+	}
+
+	if patchFile == "" {
+		return nil
+	}
+	diffs := collectDiffs(record)
+	if len(diffs) == 0 {
+		fmt.Fprintln(chatter(), styles.WarningStyle.Render("No diffs in the response; nothing to write to the patch file"))
+		return nil
+	}
+	return writePatch(strings.Join(diffs, ""))
+}
+
+// writePatch writes a patch to the file set by -patch-out, or to stdout for "-"
+func writePatch(patch string) error {
+	if patchFile == "-" {
+		_, err := fmt.Fprint(os.Stdout, patch)
+		return err
+	}
+	if err := os.WriteFile(patchFile, []byte(patch), 0644); err != nil {
+		return fmt.Errorf("error writing patch: %v", err)
+	}
+	fmt.Fprintln(chatter(), styles.SuccessStyle.Render(fmt.Sprintf("Patch saved to %s", patchFile)))
+	return nil
+}
+
+// collectDiffs gathers the diffs in the response and those produced by GENERATE_DIFF,
+// or the speculative changes of the run, each ending in a newline so they can
+// be concatenated into one patch
+func collectDiffs(record batchRecord) []string {
+	// The speculative changes already hold every diff the tools applied
+	if record.Speculative != "" {
+		return []string{record.Speculative}
+	}
+	diffs := tools.ExtractDiffs(record.Response)
+	for _, result := range record.ToolResults {
+		if result.Tool != "GENERATE_DIFF" || !result.Success {
+			continue
+		}
+		if diff, ok := strings.CutPrefix(result.Output, "Generated diff:\n\n"); ok {
+			diffs = append(diffs, diff)
+		}
+	}
+
+	for i, diff := range diffs {
+		if !strings.HasSuffix(diff, "\n") {
+			diffs[i] = diff + "\n"
+		}
+	}
+	return diffs
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/kek/slop-shop/config"
+	"github.com/kek/slop-shop/ollama"
+	"github.com/kek/slop-shop/styles"
+)
+
+// benchRun is the outcome of one prompt sent to one model
+type benchRun struct {
+	latency    time.Duration // Time until the response was complete
+	firstToken time.Duration // Time until the first chunk arrived
+	stats      ollama.Stats
+	length     int // Response length in bytes
+	err        error
+}
+
+// benchRow aggregates the runs of one prompt against one model; durations
+// and counts are averages over the successful runs
+type benchRow struct {
+	prompt, model   string
+	runs, failures  int
+	latency         time.Duration
+	firstToken      time.Duration
+	tokensPerSecond float64
+	tokens, length  int
+}
+
+// runBench sends each prompt to each model and compares latency, speed and
+// response length
+func runBench(args []string) error {
+	fs := newFlagSet("bench")
+	opts := addCommonFlags(fs)
+	models := fs.String("models", "", "Comma-separated models to compare (default: the configured model)")
+	promptsFile := fs.String("prompts", "", "YAML file with the prompts, in the format of -playbook (default: the remaining arguments)")
+	runs := fs.Int("runs", 1, "Times each prompt is sent to each model")
+	format := fs.String("format", "table", "Result format: table or csv")
+	fs.Parse(args)
+
+	if *format != "table" && *format != "csv" {
+		return fmt.Errorf("unknown format %q (use table or csv)", *format)
+	}
+	if *runs < 1 {
+		return fmt.Errorf("-runs must be at least 1")
+	}
+
+	var steps []chainStep
+	if *promptsFile != "" {
+		var err error
+		if steps, err = loadPlaybook(*promptsFile); err != nil {
+			return err
+		}
+	} else if prompt := strings.Join(fs.Args(), " "); strings.TrimSpace(prompt) != "" {
+		steps = []chainStep{{Prompt: prompt}}
+	} else {
+		return fmt.Errorf("no prompts given; use -prompts or pass a prompt")
+	}
+
+	settings, err := setup(fs, opts)
+	if err != nil {
+		return err
+	}
+	// Cached responses would measure the disk, not the model
+	ollama.SetCache("", 0)
+	modelNames := config.SplitList(*models)
+	if len(modelNames) == 0 {
+		modelNames = []string{settings.Model}
+	}
+
+	context, err := loadContext(opts, settings)
+	if err != nil {
+		return err
+	}
+
+	results := make(map[[2]int][]benchRun)
+	var lastErr error
+	for run := 1; run <= *runs; run++ {
+		for p, step := range steps {
+			for m, model := range modelNames {
+				fmt.Fprintln(chatter(), styles.InfoStyle.Render(fmt.Sprintf("⏱️  %s · %s (run %d/%d)", model, stepName(step, p), run, *runs)))
+
+				client := ollama.NewClient(settings.URL, model, settings.Temperature, settings.TopP)
+				client.System = settings.System
+				result := benchPrompt(client, step.Prompt, context)
+				if result.err != nil {
+					lastErr = result.err
+					fmt.Fprintln(chatter(), styles.ErrorStyle.Render(fmt.Sprintf("❌ %v", result.err)))
+				}
+				results[[2]int{p, m}] = append(results[[2]int{p, m}], result)
+			}
+		}
+	}
+
+	var rows []benchRow
+	failed := true
+	for p, step := range steps {
+		for m, model := range modelNames {
+			row := summarizeBench(stepName(step, p), model, results[[2]int{p, m}])
+			if row.failures < row.runs {
+				failed = false
+			}
+			rows = append(rows, row)
+		}
+	}
+
+	fmt.Fprintln(chatter())
+	if *format == "csv" {
+		err = writeBenchCSV(display(), rows)
+	} else {
+		err = writeBenchTable(display(), rows)
+	}
+	if err != nil {
+		return err
+	}
+	if failed {
+		return batchError(lastErr, nil)
+	}
+	return nil
+}
+
+// stepName labels a prompt in the results by its name, or by its start
+func stepName(step chainStep, i int) string {
+	if step.Name != "" {
+		return step.Name
+	}
+	prompt := strings.Join(strings.Fields(step.Prompt), " ")
+	if len(prompt) > 40 {
+		prompt = prompt[:37] + "..."
+	}
+	return fmt.Sprintf("%d: %s", i+1, prompt)
+}
+
+// benchPrompt sends one prompt without tools and measures the response
+func benchPrompt(client *ollama.Client, prompt, context string) benchRun {
+	var result benchRun
+	start := time.Now()
+	response, stats, err := client.GenerateWithStats(prompt, context, false, func(chunk string) {
+		if result.firstToken == 0 {
+			result.firstToken = time.Since(start)
+		}
+	})
+	result.latency = time.Since(start)
+	result.stats = stats
+	result.length = len(response)
+	result.err = err
+	return result
+}
+
+// summarizeBench averages the successful runs of one prompt against one model
+func summarizeBench(prompt, model string, runs []benchRun) benchRow {
+	row := benchRow{prompt: prompt, model: model, runs: len(runs)}
+	var speed float64
+	for _, run := range runs {
+		if run.err != nil {
+			row.failures++
+			continue
+		}
+		row.latency += run.latency
+		row.firstToken += run.firstToken
+		row.tokens += run.stats.ResponseTokens
+		row.length += run.length
+		speed += run.stats.TokensPerSecond()
+	}
+
+	if ok := row.runs - row.failures; ok > 0 {
+		row.latency /= time.Duration(ok)
+		row.firstToken /= time.Duration(ok)
+		row.tokens /= ok
+		row.length /= ok
+		row.tokensPerSecond = speed / float64(ok)
+	}
+	return row
+}
+
+// writeBenchTable prints the results as an aligned table
+func writeBenchTable(w io.Writer, rows []benchRow) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "PROMPT\tMODEL\tRUNS\tLATENCY\tFIRST TOKEN\tTOKENS/S\tTOKENS\tLENGTH\tFAILED")
+	for _, row := range rows {
+		fmt.Fprintf(tw, "%s\t%s\t%d\t%s\t%s\t%.1f\t%d\t%d\t%d\n",
+			row.prompt, row.model, row.runs,
+			row.latency.Round(time.Millisecond), row.firstToken.Round(time.Millisecond),
+			row.tokensPerSecond, row.tokens, row.length, row.failures)
+	}
+	return tw.Flush()
+}
+
+// writeBenchCSV writes the results as CSV with durations in milliseconds
+func writeBenchCSV(w io.Writer, rows []benchRow) error {
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"prompt", "model", "runs", "failures", "latency_ms", "first_token_ms", "tokens_per_second", "response_tokens", "response_bytes"})
+	for _, row := range rows {
+		cw.Write([]string{
+			row.prompt,
+			row.model,
+			strconv.Itoa(row.runs),
+			strconv.Itoa(row.failures),
+			strconv.FormatInt(row.latency.Milliseconds(), 10),
+			strconv.FormatInt(row.firstToken.Milliseconds(), 10),
+			strconv.FormatFloat(row.tokensPerSecond, 'f', 1, 64),
+			strconv.Itoa(row.tokens),
+			strconv.Itoa(row.length),
+		})
+	}
+	cw.Flush()
+	return cw.Error()
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/kek/slop-shop/config"
+	"github.com/kek/slop-shop/styles"
+	"gopkg.in/yaml.v3"
+)
+
+// chainStep is one prompt of a prompt chain
+type chainStep struct {
+	Name   string `yaml:"name"`
+	Prompt string `yaml:"prompt"`
+	Tools  *bool  `yaml:"tools"` // Overrides the tools setting for this step
+}
+
+// playbook is a prompt chain read from a YAML file
+type playbook struct {
+	Steps []chainStep `yaml:"steps"`
+}
+
+// promptFlags collects repeated -prompt flags
+type promptFlags []string
+
+func (p *promptFlags) String() string {
+	return strings.Join(*p, " | ")
+}
+
+func (p *promptFlags) Set(value string) error {
+	*p = append(*p, value)
+	return nil
+}
+
+// loadPlaybook reads the steps of a YAML playbook
+func loadPlaybook(path string) ([]chainStep, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading playbook: %v", err)
+	}
+
+	var pb playbook
+	if err := yaml.Unmarshal(data, &pb); err != nil {
+		return nil, fmt.Errorf("error parsing playbook %s: %v", path, err)
+	}
+	if len(pb.Steps) == 0 {
+		return nil, fmt.Errorf("playbook %s has no steps", path)
+	}
+	for i, step := range pb.Steps {
+		if strings.TrimSpace(step.Prompt) == "" {
+			return nil, fmt.Errorf("step %d of playbook %s has no prompt", i+1, path)
+		}
+	}
+	return pb.Steps, nil
+}
+
+// runChain runs the steps in order. Each step sees the repository context
+// followed by the responses of the steps before it. The chain stops at the
+// first step that fails or returns no response.
+func runChain(steps []chainStep, context string, settings *config.Settings, repoPath string) error {
+	defer moveDisplay()()
+	// Only the last response is paged, so the chain does not stop at each step
+	pageLast := paging
+	paging = false
+	defer func() { paging = pageLast }()
+
+	var previous strings.Builder
+	var last string
+	for i, step := range steps {
+		name := step.Name
+		if name == "" {
+			name = fmt.Sprintf("step %d", i+1)
+		}
+		fmt.Fprintln(chatter(), styles.HeaderStyle.Render(fmt.Sprintf("⛓️  Step %d/%d: %s", i+1, len(steps), name)))
+
+		toolsEnabled := settings.Tools
+		if step.Tools != nil {
+			toolsEnabled = *step.Tools
+		}
+
+		stepContext := context
+		if previous.Len() > 0 {
+			stepContext += "\n\nResponses of the previous steps:\n" + strings.Repeat("-", 50) + "\n" + previous.String()
+		}
+
+		response, err := runBatch(step.Prompt, stepContext, settings.URL, settings.Model, settings.System, settings.Temperature, settings.TopP, toolsEnabled, repoPath)
+		if err != nil {
+			return err
+		}
+		if previewOnly {
+			continue
+		}
+		if strings.TrimSpace(response) == "" {
+			return fmt.Errorf("%s returned no response; stopping the chain", name)
+		}
+		previous.WriteString(fmt.Sprintf("%s (%s):\n%s\n\n", name, step.Prompt, strings.TrimSpace(response)))
+		last = response
+	}
+
+	paging = pageLast
+	pageResponse(settings.Model, last)
+	return nil
+}
@@ -0,0 +1,521 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/kek/slop-shop/config"
+	"github.com/kek/slop-shop/repo"
+	"github.com/kek/slop-shop/tools"
+	"github.com/kek/slop-shop/tui"
+)
+
+// command is a slop-shop subcommand
+type command struct {
+	name    string
+	usage   string
+	summary string
+	run     func(args []string) error
+}
+
+// commands lists the subcommands in the order they are shown in the usage text.
+// It is filled in init because printUsage refers back to it.
+var commands []command
+
+func init() {
+	commands = []command{
+		{"ask", "ask [flags] <prompt>", "Send a single prompt with the repository as context", runAsk},
+		{"chat", "chat [flags]", "Start the interactive REPL", runChat},
+		{"review", "review [flags]", "Review the changes since a base revision", runReview},
+		{"lint", "lint [flags] [language...]", "Run the configured linters and report their findings as text, SARIF or HTML", runLint},
+		{"commit", "commit [flags]", "Write a commit message for the staged changes", runCommit},
+		{"explain", "explain [flags]", "Write an architecture overview of the repository for new contributors", runExplain},
+		{"explain-error", "explain-error [flags] < error", "Find the lines an error piped to standard input refers to and ask for a diagnosis and a fix", runExplainError},
+		{"bench", "bench [flags] [prompt]", "Compare the latency and speed of models on a set of prompts", runBench},
+		{"serve", "serve [flags]", "Serve an HTTP API for asking questions and running tasks", runServe},
+		{"docs", "docs [flags] [package dir...]", "Write package doc comments or READMEs from the code outline", runDocs},
+		{"index", "index [flags] [symbol]", "Build the symbol index, or look up a symbol", runIndex},
+		{"embed", "embed [flags]", "Build or refresh the embedding index used by ask -retrieve", runEmbed},
+		{"tools", "tools [flags]", "List the tools available to the model", runTools},
+		{"hooks", "hooks [install|uninstall|status]", "Install git hooks that write commit messages and review changes before a push", runHooks},
+		{"trust", "trust [-revoke] [-repo PATH]", "Let the repository's plugins and template commands run, or stop them with -revoke", runTrust},
+		{"init", "init [-force]", "Write a starter .slopshop.toml and .slopshopignore for the repository and check Ollama", runInit},
+		{"history", "history [list|show ID|delete ID|search QUERY|export|import FILE|replay ID|FILE]", "List, search, export, import and replay recorded conversations", runHistory},
+		{"usage", "usage [-days N]", "Show the tokens used by day, model and command", runUsage},
+		{"config", "config show [flags]", "Print the effective configuration", runConfig},
+		{"doctor", "doctor [flags]", "Check the Ollama server, model, terminal and configuration", runDoctor},
+		{"version", "version", "Print the version and build information", runVersion},
+	}
+}
+
+// findCommand returns the subcommand with the given name
+func findCommand(name string) (command, bool) {
+	for _, cmd := range commands {
+		if cmd.name == name {
+			return cmd, true
+		}
+	}
+	return command{}, false
+}
+
+// printUsage lists the subcommands on stderr
+func printUsage() {
+	fmt.Fprintln(os.Stderr, "Usage: slop-shop <command> [flags]")
+	fmt.Fprintln(os.Stderr)
+	fmt.Fprintln(os.Stderr, "Commands:")
+	for _, cmd := range commands {
+		fmt.Fprintf(os.Stderr, "  %-24s %s\n", cmd.usage, cmd.summary)
+	}
+	fmt.Fprintln(os.Stderr)
+	fmt.Fprintln(os.Stderr, `Run "slop-shop <command> -h" for the flags of a command.`)
+}
+
+// newFlagSet creates the flag set of a subcommand with a usage line
+func newFlagSet(name string) *flag.FlagSet {
+	fs := flag.NewFlagSet("slop-shop "+name, flag.ExitOnError)
+	if cmd, ok := findCommand(name); ok {
+		fs.Usage = func() {
+			fmt.Fprintf(os.Stderr, "Usage: slop-shop %s\n\n%s\n\nFlags:\n", cmd.usage, cmd.summary)
+			fs.PrintDefaults()
+		}
+	}
+	return fs
+}
+
+// runAsk sends a single prompt, given with -prompt, as arguments or built from
+// a template. Several -prompt flags or a -playbook run a prompt chain. Input
+// piped to the command is added to the context.
+func runAsk(args []string) error {
+	fs := newFlagSet("ask")
+	opts := addCommonFlags(fs)
+	var prompts promptFlags
+	fs.Var(&prompts, "prompt", `Prompt to send to the model (default: the remaining arguments; "-" reads it from standard input). Repeat it to run the prompts as a chain`)
+	playbookFile := fs.String("playbook", "", "YAML file with a chain of prompts to run in order")
+	templateName := fs.String("template", "", "Build the prompt from a named template; the prompt becomes its {{.Input}}")
+	file := fs.String("file", "", "File whose contents templates can use as {{.File}}")
+	expand := fs.Bool("expand", false, `Execute the prompt as a template, so {{exec "go vet ./..."}} puts a command's output in it`)
+	vars := varFlags{}
+	fs.Var(vars, "var", "Template variable as name=value, used as {{.Var \"name\"}} (repeatable)")
+	watch := fs.Bool("watch", false, "Run the prompt again whenever repository files change")
+	debounce := fs.Duration("debounce", time.Second, "With -watch, wait until files have not changed for this long")
+	repos := fs.String("repos", "", "Comma-separated repositories to send the prompt to, each with its own contents as context; tools are not run")
+	parallel := fs.Int("parallel", 4, "With -repos, the number of repositories asked at the same time")
+	retrieve := fs.Int("retrieve", 0, "Send only the N chunks of the embedding index most similar to the prompt as context (build it with embed)")
+	issues := fs.String("issue", "", "Comma-separated GitHub or Gitea issues or pull requests to add to the context: numbers on the origin remote's forge, owner/repo#number or addresses")
+	promptIssues := fs.Bool("issues", false, "Add the issues and pull requests the prompt references, such as #42 or their addresses, to the context")
+	mode := fs.String("mode", "answer", "answer, or patch to get only a unified diff that applies cleanly, written to stdout for git apply")
+	fs.Parse(args)
+
+	var steps []chainStep
+	switch {
+	case *playbookFile != "":
+		if len(prompts) > 0 || *templateName != "" {
+			return fmt.Errorf("-playbook cannot be combined with -prompt or -template")
+		}
+		var err error
+		if steps, err = loadPlaybook(*playbookFile); err != nil {
+			return err
+		}
+	case len(prompts) > 1:
+		if *templateName != "" {
+			return fmt.Errorf("-template cannot be combined with several prompts")
+		}
+		for _, prompt := range prompts {
+			steps = append(steps, chainStep{Prompt: prompt})
+		}
+	}
+
+	prompt := strings.Join(fs.Args(), " ")
+	if len(prompts) == 1 {
+		prompt = prompts[0]
+	}
+	if steps == nil && *templateName == "" && strings.TrimSpace(prompt) == "" {
+		return fmt.Errorf("no prompt given")
+	}
+
+	switch *mode {
+	case "answer":
+	case "patch":
+		switch {
+		case steps != nil:
+			return fmt.Errorf("-mode patch cannot be combined with a chain of prompts")
+		case *repos != "":
+			return fmt.Errorf("-mode patch cannot be combined with -repos")
+		case opts.output == "json":
+			return fmt.Errorf("-mode patch cannot be combined with -output json")
+		case opts.session != "":
+			return fmt.Errorf("-mode patch cannot be combined with -session")
+		}
+	default:
+		return fmt.Errorf("unknown mode %q (use answer or patch)", *mode)
+	}
+
+	settings, err := setup(fs, opts)
+	if err != nil {
+		return err
+	}
+	if *mode == "patch" {
+		// Keep stdout for the patch
+		displayWriter = os.Stderr
+		tools.SetProgressOutput(displayWriter)
+	}
+
+	if *templateName != "" || *expand {
+		data := &templateData{repoPath: opts.repoPath, vars: vars, expand: *expand, Input: prompt, FileName: *file}
+		if *file != "" {
+			contents, err := os.ReadFile(*file)
+			if err != nil {
+				return fmt.Errorf("error reading %s: %v", *file, err)
+			}
+			data.File = string(contents)
+		}
+		if *templateName != "" {
+			prompt, err = renderTemplate(*templateName, data)
+		} else {
+			// With -expand the prompts themselves are the templates
+			for i := 0; i < len(steps) && err == nil; i++ {
+				steps[i].Prompt, err = executeTemplate("prompt", steps[i].Prompt, data, nil)
+			}
+			if err == nil {
+				prompt, err = executeTemplate("prompt", prompt, data, nil)
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+	// Standard input can only be read once, so watch mode reuses it for every run
+	var stdinContext string
+	if steps != nil {
+		steps[0].Prompt, stdinContext, err = applyStdin(steps[0].Prompt, "")
+	} else {
+		prompt, stdinContext, err = applyStdin(prompt, "")
+	}
+	if err != nil {
+		return err
+	}
+	if *issues != "" || *promptIssues {
+		query := prompt
+		if steps != nil {
+			query = steps[0].Prompt
+		}
+		// Fetched once here, as the context of every -watch run includes them
+		if opts.issueText, err = issueContext(config.SplitList(*issues), query, *promptIssues, opts.repoPath); err != nil {
+			return err
+		}
+	}
+
+	if *repos != "" {
+		switch {
+		case steps != nil:
+			return fmt.Errorf("-repos cannot be combined with a chain of prompts")
+		case *watch:
+			return fmt.Errorf("-repos cannot be combined with -watch")
+		case sessionName != "":
+			return fmt.Errorf("-repos cannot be combined with -session")
+		case settings.Tools:
+			return fmt.Errorf("-repos does not run tools; leave out -tools")
+		}
+		return runRepos(prompt, stdinContext+opts.issueText, config.SplitList(*repos), settings, *parallel)
+	}
+
+	if *retrieve > 0 && (opts.attach != "" || opts.emptyContext || opts.outline) {
+		return fmt.Errorf("-retrieve cannot be combined with -attach, -empty-context or -outline")
+	}
+
+	run := func() error {
+		var context string
+		if *retrieve > 0 {
+			query := prompt
+			if steps != nil {
+				query = steps[0].Prompt
+			}
+			context, err = retrieveContext(query, *retrieve, opts.repoPath, settings)
+			context = opts.issueText + context
+		} else {
+			context, err = loadContext(opts, settings)
+		}
+		if err != nil {
+			return err
+		}
+		context = stdinContext + context
+
+		if steps != nil {
+			return runChain(steps, context, settings, opts.repoPath)
+		}
+		if *mode == "patch" {
+			return runPatchMode(prompt, context, settings, opts.repoPath)
+		}
+		_, err = runBatch(prompt, context, settings.URL, settings.Model, settings.System, settings.Temperature, settings.TopP, settings.Tools, opts.repoPath)
+		return err
+	}
+	if *watch {
+		return watchRepository(opts.repoPath, settings.Exclude, *debounce, nil, run)
+	}
+	return run()
+}
+
+// readPipedInput returns the data piped into standard input, or "" when stdin is a terminal
+var readPipedInput = func() (string, error) {
+	info, err := os.Stdin.Stat()
+	if err != nil || info.Mode()&os.ModeCharDevice != 0 {
+		return "", nil
+	}
+
+	data, err := io.ReadAll(os.Stdin)
+	if err != nil {
+		return "", fmt.Errorf("error reading standard input: %v", err)
+	}
+	return string(data), nil
+}
+
+// applyStdin reads piped input and uses it as the prompt when prompt is "-",
+// or adds it to the front of the context otherwise
+func applyStdin(prompt, context string) (string, string, error) {
+	input, err := readPipedInput()
+	if err != nil {
+		return "", "", err
+	}
+
+	if prompt == "-" {
+		if strings.TrimSpace(input) == "" {
+			return "", "", fmt.Errorf("-prompt is \"-\" but nothing was piped to standard input")
+		}
+		return strings.TrimSpace(input), context, nil
+	}
+
+	if strings.TrimSpace(input) != "" {
+		stdinContext := "Standard input:\n" + strings.Repeat("-", 50) + "\n" + input + "\n\n"
+		context = stdinContext + context
+	}
+	return prompt, context, nil
+}
+
+// checkREPLFlags rejects the flags of batch runs the REPL cannot honor
+func checkREPLFlags(opts *options) error {
+	if opts.speculative {
+		return fmt.Errorf("-speculative only applies to batch runs; the REPL writes files as it goes")
+	}
+	if opts.confirm {
+		return fmt.Errorf("-confirm only applies to batch runs; the REPL cannot ask for approval on the terminal it draws on")
+	}
+	return nil
+}
+
+// runChat starts the interactive REPL
+func runChat(args []string) error {
+	fs := newFlagSet("chat")
+	opts := addCommonFlags(fs)
+	fs.Parse(args)
+
+	if err := checkREPLFlags(opts); err != nil {
+		return err
+	}
+	settings, err := setup(fs, opts)
+	if err != nil {
+		return err
+	}
+	// Nothing may read the terminal the REPL draws on
+	tools.SetConflictResolver(nil)
+	context, err := loadChatContext(opts, settings)
+	if err != nil {
+		return err
+	}
+
+	// Other repositories are read for /repo without drawing over the REPL
+	showProgress = false
+	tui.SetContextLoader(func(path string) (string, error) {
+		return repoContext(opts, settings, path)
+	})
+
+	tui.StartChat(settings.URL, settings.Model, settings.System, context, settings.Temperature, settings.TopP, settings.Tools, opts.debug != "")
+	return nil
+}
+
+// repoContext reads the working tree of another repository as loadContext
+// reads the first one, excluding the patterns of its ignore file as well
+func repoContext(opts *options, settings *config.Settings, path string) (string, error) {
+	other := *opts
+	other.repoPath, other.rev, other.attach, other.emptyContext = path, "", "", false
+	ignore, err := config.LoadIgnore(path)
+	if err != nil {
+		return "", err
+	}
+	otherSettings := *settings
+	otherSettings.Exclude = append(slices.Clone(settings.Exclude), ignore...)
+	return loadContext(&other, &otherSettings)
+}
+
+// commitPrompt asks the model for a commit message
+const commitPrompt = "Write a git commit message for the following staged changes. Use a short summary line in the imperative mood, " +
+	"a blank line, and a body explaining what changed and why. Output only the commit message."
+
+// runCommit writes a commit message for the staged changes and optionally commits with it
+func runCommit(args []string) error {
+	fs := newFlagSet("commit")
+	opts := addCommonFlags(fs)
+	apply := fs.Bool("apply", false, "Commit the staged changes with the generated message")
+	fs.Parse(args)
+
+	settings, err := setup(fs, opts)
+	if err != nil {
+		return err
+	}
+
+	diff, err := gitOutput(opts.repoPath, "diff", "--cached")
+	if err != nil {
+		return err
+	}
+	if strings.TrimSpace(diff) == "" {
+		return fmt.Errorf("no staged changes")
+	}
+
+	message, err := runBatch(commitPrompt, "Staged changes:\n\n"+diff, settings.URL, settings.Model, settings.System, settings.Temperature, settings.TopP, false, opts.repoPath)
+	if err != nil {
+		return err
+	}
+	message = strings.TrimSpace(message)
+	if !*apply {
+		return nil
+	}
+	if message == "" {
+		return fmt.Errorf("the model returned an empty commit message")
+	}
+
+	cmd := exec.Command("git", "commit", "-F", "-")
+	cmd.Dir = opts.repoPath
+	cmd.Stdin = strings.NewReader(message + "\n")
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	return cmd.Run()
+}
+
+// runIndex builds the Go symbol index and prints its size, or the definitions
+// and references of the symbols given as arguments
+func runIndex(args []string) error {
+	fs := newFlagSet("index")
+	opts := addCommonFlags(fs)
+	fs.Parse(args)
+
+	_, settings, err := resolveSettings(fs, opts)
+	if err != nil {
+		return err
+	}
+
+	start := time.Now()
+	index := repo.NewIndex(opts.repoPath, settings.Exclude)
+	if err := index.Update(); err != nil {
+		return fmt.Errorf("error indexing repository: %v", err)
+	}
+
+	if fs.NArg() == 0 {
+		files, symbols := index.Stats()
+		fmt.Printf("Indexed %d source files with %d symbols in %s\n", files, symbols, time.Since(start).Round(time.Millisecond))
+		return nil
+	}
+
+	for _, name := range fs.Args() {
+		definitions, references := index.Lookup(name)
+		fmt.Printf("%s: %d definitions, %d references\n", name, len(definitions), len(references))
+		for _, symbol := range definitions {
+			fmt.Printf("  %s:%d: [%s] %s\n", symbol.File, symbol.Line, symbol.Kind, symbol.Text)
+		}
+		for _, ref := range references {
+			fmt.Printf("  %s:%d: %s\n", ref.File, ref.Line, ref.Text)
+		}
+	}
+	return nil
+}
+
+// runTools lists the built-in and custom tools and whether the tool policy allows them
+func runTools(args []string) error {
+	fs := newFlagSet("tools")
+	opts := addCommonFlags(fs)
+	fs.Parse(args)
+
+	settings, err := setup(fs, opts)
+	if err != nil {
+		return err
+	}
+
+	if !settings.Tools {
+		fmt.Println("Tools are disabled; enable them with -tools or tool_policy.enabled")
+		fmt.Println()
+	}
+	for _, tool := range tools.ListTools() {
+		var notes []string
+		if tool.Custom {
+			notes = append(notes, "custom")
+		}
+		if tool.ReadOnly {
+			notes = append(notes, "read-only")
+		}
+		if !tool.Allowed {
+			notes = append(notes, "blocked by policy")
+		}
+
+		line := fmt.Sprintf("%-14s %s", tool.Name, tool.Description)
+		if len(notes) > 0 {
+			line += " (" + strings.Join(notes, ", ") + ")"
+		}
+		fmt.Println(line)
+	}
+	return nil
+}
+
+// runConfig prints the effective configuration for the given flags
+func runConfig(args []string) error {
+	if len(args) == 0 || args[0] != "show" {
+		return fmt.Errorf("usage: slop-shop config show [flags]")
+	}
+
+	fs := newFlagSet("config")
+	opts := addCommonFlags(fs)
+	fs.Parse(args[1:])
+
+	_, settings, err := resolveSettings(fs, opts)
+	if err != nil {
+		return err
+	}
+	printConfig(settings, opts.repoPath)
+	return nil
+}
+
+// runVersion prints the version and build information
+func runVersion(args []string) error {
+	fmt.Println(versionString())
+	return nil
+}
+
+// printConfig prints the configuration files that were considered and the effective settings
+func printConfig(settings *config.Settings, repoPath string) {
+	for _, path := range []string{config.UserConfigPath(), config.RepoConfigPath(repoPath), config.IgnorePath(repoPath)} {
+		status := "not found"
+		if _, err := os.Stat(path); err == nil {
+			status = "loaded"
+		}
+		fmt.Printf("# %s (%s)\n", path, status)
+	}
+	fmt.Println()
+	fmt.Print(settings.String())
+}
+
+// gitOutput runs a git command in repoPath and returns its output
+func gitOutput(repoPath string, args ...string) (string, error) {
+	cmd := exec.Command("git", args...)
+	cmd.Dir = repoPath
+	output, err := cmd.Output()
+	if err != nil {
+		if exitErr, ok := err.(*exec.ExitError); ok && len(exitErr.Stderr) > 0 {
+			return "", fmt.Errorf("git %s: %s", strings.Join(args, " "), strings.TrimSpace(string(exitErr.Stderr)))
+		}
+		return "", fmt.Errorf("git %s: %v", strings.Join(args, " "), err)
+	}
+	return string(output), nil
+}
@@ -0,0 +1,485 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"github.com/kek/slop-shop/ollama"
+	"github.com/kek/slop-shop/repo"
+	"github.com/kek/slop-shop/styles"
+	"github.com/kek/slop-shop/tools"
+)
+
+// RepoConfigName is the name of the repository-local configuration file
+const RepoConfigName = ".slopshop.toml"
+
+// RepoConfigPath returns the path of the repository-local configuration file
+func RepoConfigPath(repoPath string) string {
+	return filepath.Join(repoPath, RepoConfigName)
+}
+
+// IgnoreFileName is the name of the repository file with extra exclude patterns
+const IgnoreFileName = ".slopshopignore"
+
+// IgnorePath returns the path of the repository's ignore file
+func IgnorePath(repoPath string) string {
+	return filepath.Join(repoPath, IgnoreFileName)
+}
+
+// LoadIgnore reads the exclude patterns in the repository's ignore file, one
+// per line. Blank lines and lines starting with # are skipped; a missing file
+// has no patterns.
+func LoadIgnore(repoPath string) ([]string, error) {
+	data, err := os.ReadFile(IgnorePath(repoPath))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading %s: %v", IgnorePath(repoPath), err)
+	}
+
+	var patterns []string
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line != "" && !strings.HasPrefix(line, "#") {
+			patterns = append(patterns, line)
+		}
+	}
+	return patterns, nil
+}
+
+// AddIgnorePatterns appends the patterns that are not in the repository's
+// ignore file yet, creating it if needed, and returns how many were added
+func AddIgnorePatterns(repoPath string, patterns []string) (int, error) {
+	path := IgnorePath(repoPath)
+	data, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return 0, fmt.Errorf("error reading %s: %v", path, err)
+	}
+	existing, err := LoadIgnore(repoPath)
+	if err != nil {
+		return 0, err
+	}
+	known := make(map[string]bool, len(existing))
+	for _, pattern := range existing {
+		known[pattern] = true
+	}
+
+	var buf strings.Builder
+	added := 0
+	for _, pattern := range patterns {
+		if known[pattern] {
+			continue
+		}
+		known[pattern] = true
+		if added == 0 && len(data) > 0 && !strings.HasSuffix(string(data), "\n") {
+			buf.WriteString("\n")
+		}
+		buf.WriteString(pattern + "\n")
+		added++
+	}
+	if added == 0 {
+		return 0, nil
+	}
+
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return 0, fmt.Errorf("error opening %s: %v", path, err)
+	}
+	defer file.Close()
+	if _, err := file.WriteString(buf.String()); err != nil {
+		return 0, fmt.Errorf("error writing %s: %v", path, err)
+	}
+	return added, nil
+}
+
+// Config represents the settings read from configuration files
+type Config struct {
+	Model       string     `toml:"model"`
+	URL         string     `toml:"url"`
+	Preset      string     `toml:"preset"`
+	Temperature *float64   `toml:"temperature"`
+	TopP        *float64   `toml:"top_p"`
+	Exclude     []string   `toml:"exclude"`
+	Theme       string     `toml:"theme"`
+	System      string     `toml:"system"`
+	ToolPolicy  ToolPolicy `toml:"tool_policy"`
+	Profile     string     `toml:"profile"` // Profile used when -profile is not given
+
+	Profiles map[string]Profile `toml:"profiles"`
+
+	Tools  []tools.CustomTool            `toml:"tools"`
+	Lint   map[string]tools.LintCommands `toml:"lint"`
+	Output tools.OutputLimits            `toml:"output"`
+	Env    tools.EnvConfig               `toml:"env"`
+
+	Context          repo.ContextLimit `toml:"context"`
+	ContextProviders []string          `toml:"context_providers"` // Where the context comes from, in order
+	Render           styles.Rendering  `toml:"render"`
+	EmptyResponse    ollama.EmptyRetry `toml:"empty_response"`
+
+	files []configFile // Files that were loaded, in order of increasing precedence
+}
+
+// ToolPolicy controls whether tools are enabled and which of them may run
+type ToolPolicy struct {
+	Enabled *bool    `toml:"enabled"`
+	Allow   []string `toml:"allow"` // Only these tools may run, when non-empty
+	Deny    []string `toml:"deny"`  // These tools never run
+
+	// Instructions is when the tool instructions are sent: always, auto or system
+	Instructions string `toml:"instructions"`
+}
+
+// Profile bundles run settings that are selected together with -profile, such
+// as the server and model of one machine
+type Profile struct {
+	Model       string     `toml:"model"`
+	URL         string     `toml:"url"`
+	Preset      string     `toml:"preset"`
+	Temperature *float64   `toml:"temperature"`
+	TopP        *float64   `toml:"top_p"`
+	System      string     `toml:"system"`
+	ToolPolicy  ToolPolicy `toml:"tool_policy"`
+}
+
+// configFile is a configuration file that was found and parsed
+type configFile struct {
+	path string
+	cfg  *Config
+}
+
+// UserConfigPath returns the path of the per-user configuration file
+func UserConfigPath() string {
+	if dir := os.Getenv("XDG_CONFIG_HOME"); dir != "" {
+		return filepath.Join(dir, "slop-shop", "config.toml")
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, ".config", "slop-shop", "config.toml")
+}
+
+// TemplateDirs returns the directories searched for prompt templates, in order
+// of precedence: .slopshop/templates in the repository, then the templates
+// directory next to the user configuration file
+func TemplateDirs(repoPath string) []string {
+	dirs := []string{filepath.Join(repoPath, ".slopshop", "templates")}
+	if path := UserConfigPath(); path != "" {
+		dirs = append(dirs, filepath.Join(filepath.Dir(path), "templates"))
+	}
+	return dirs
+}
+
+// UserPluginDir returns the directory of the user's own plugins, next to the
+// user configuration file
+func UserPluginDir() string {
+	if path := UserConfigPath(); path != "" {
+		return filepath.Join(filepath.Dir(path), "plugins")
+	}
+	return ""
+}
+
+// RepoPluginDir returns the directory of a repository's plugins, which only
+// run once the user trusts the repository
+func RepoPluginDir(repoPath string) string {
+	return filepath.Join(repoPath, ".slopshop", "plugins")
+}
+
+// TrustedPath returns the path of the list of repositories the user trusts to
+// run their plugins, next to the user configuration file
+func TrustedPath() string {
+	if path := UserConfigPath(); path != "" {
+		return filepath.Join(filepath.Dir(path), "trusted")
+	}
+	return ""
+}
+
+// trustKey is the absolute path, with symbolic links resolved, a repository is
+// listed under in the trusted file
+func trustKey(repoPath string) (string, error) {
+	abs, err := filepath.Abs(repoPath)
+	if err != nil {
+		return "", err
+	}
+	if resolved, err := filepath.EvalSymlinks(abs); err == nil {
+		abs = resolved
+	}
+	return abs, nil
+}
+
+// trustedRepos reads the trusted file, one repository path per line
+func trustedRepos() ([]string, error) {
+	data, err := os.ReadFile(TrustedPath())
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading trusted repositories: %v", err)
+	}
+	var repos []string
+	for _, line := range strings.Split(string(data), "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			repos = append(repos, line)
+		}
+	}
+	return repos, nil
+}
+
+// IsTrusted reports whether the user trusts the repository at repoPath
+func IsTrusted(repoPath string) bool {
+	key, err := trustKey(repoPath)
+	if err != nil || TrustedPath() == "" {
+		return false
+	}
+	repos, err := trustedRepos()
+	return err == nil && slices.Contains(repos, key)
+}
+
+// SetTrusted adds the repository at repoPath to the trusted file, or removes it
+func SetTrusted(repoPath string, trusted bool) error {
+	path := TrustedPath()
+	if path == "" {
+		return fmt.Errorf("no user configuration directory to keep trusted repositories in")
+	}
+	key, err := trustKey(repoPath)
+	if err != nil {
+		return err
+	}
+	repos, err := trustedRepos()
+	if err != nil {
+		return err
+	}
+	repos = slices.DeleteFunc(repos, func(repo string) bool { return repo == key })
+	if trusted {
+		repos = append(repos, key)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("error creating %s: %v", filepath.Dir(path), err)
+	}
+	var data string
+	for _, repo := range repos {
+		data += repo + "\n"
+	}
+	if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+		return fmt.Errorf("error writing trusted repositories: %v", err)
+	}
+	return nil
+}
+
+// SessionDir returns the directory batch sessions are saved in, next to the
+// user configuration file
+func SessionDir() string {
+	if path := UserConfigPath(); path != "" {
+		return filepath.Join(filepath.Dir(path), "sessions")
+	}
+	return ""
+}
+
+// ApprovalsPath returns the path of the tool calls approved for every
+// session, next to the user configuration file
+func ApprovalsPath() string {
+	if path := UserConfigPath(); path != "" {
+		return filepath.Join(filepath.Dir(path), "approvals.json")
+	}
+	return ""
+}
+
+// UsagePath returns the path of the token usage ledger, next to the user
+// configuration file
+func UsagePath() string {
+	if path := UserConfigPath(); path != "" {
+		return filepath.Join(filepath.Dir(path), "usage.jsonl")
+	}
+	return ""
+}
+
+// HistoryPath returns the path of the conversation history database in
+// $XDG_DATA_HOME/slop-shop, or ~/.local/share/slop-shop
+func HistoryPath() string {
+	if dir := os.Getenv("XDG_DATA_HOME"); dir != "" {
+		return filepath.Join(dir, "slop-shop", "history.db")
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, ".local", "share", "slop-shop", "history.db")
+}
+
+// ChatsDir returns the directory REPL conversations are saved in, next to the
+// history database
+func ChatsDir() string {
+	if path := HistoryPath(); path != "" {
+		return filepath.Join(filepath.Dir(path), "chats")
+	}
+	return ""
+}
+
+// CacheDir returns the directory cached responses are kept in:
+// $XDG_CACHE_HOME/slop-shop/responses, or ~/.cache/slop-shop/responses
+func CacheDir() string {
+	if dir := os.Getenv("XDG_CACHE_HOME"); dir != "" {
+		return filepath.Join(dir, "slop-shop", "responses")
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, ".cache", "slop-shop", "responses")
+}
+
+// EmbeddingsDir returns the directory embedding indexes are kept in:
+// $XDG_CACHE_HOME/slop-shop/embeddings, or ~/.cache/slop-shop/embeddings
+func EmbeddingsDir() string {
+	if dir := os.Getenv("XDG_CACHE_HOME"); dir != "" {
+		return filepath.Join(dir, "slop-shop", "embeddings")
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, ".cache", "slop-shop", "embeddings")
+}
+
+// DebugLogPath returns the path debug output is written to, outside any
+// repository: $XDG_STATE_HOME/slop-shop/debug.log, or ~/.local/state/slop-shop/debug.log
+func DebugLogPath() string {
+	if dir := os.Getenv("XDG_STATE_HOME"); dir != "" {
+		return filepath.Join(dir, "slop-shop", "debug.log")
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, ".local", "state", "slop-shop", "debug.log")
+}
+
+// Load reads the user configuration and the repository-local configuration in
+// repoPath. Settings in the repository file take precedence; custom tools are
+// merged by name. Run settings such as the model are applied with Apply.
+func Load(repoPath string) (*Config, error) {
+	cfg := &Config{}
+
+	paths := []string{UserConfigPath(), RepoConfigPath(repoPath)}
+	for _, path := range paths {
+		if path == "" {
+			continue
+		}
+
+		fileCfg, err := loadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		if fileCfg == nil {
+			continue
+		}
+
+		cfg.merge(fileCfg)
+		cfg.files = append(cfg.files, configFile{path: path, cfg: fileCfg})
+	}
+
+	return cfg, nil
+}
+
+// loadFile parses a single configuration file, returning nil if it does not exist
+func loadFile(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading config %s: %v", path, err)
+	}
+
+	var cfg Config
+	if err := toml.Unmarshal(data, &cfg); err != nil {
+		return nil, fmt.Errorf("error parsing config %s: %v", path, err)
+	}
+	return &cfg, nil
+}
+
+// merge overlays other onto c
+func (c *Config) merge(other *Config) {
+	if other.Profile != "" {
+		c.Profile = other.Profile
+	}
+	for name, profile := range other.Profiles {
+		if c.Profiles == nil {
+			c.Profiles = make(map[string]Profile)
+		}
+		c.Profiles[name] = profile
+	}
+
+	for language, commands := range other.Lint {
+		if c.Lint == nil {
+			c.Lint = make(map[string]tools.LintCommands)
+		}
+		c.Lint[language] = commands
+	}
+
+	if other.Output.MaxBytes != 0 {
+		c.Output.MaxBytes = other.Output.MaxBytes
+	}
+	for tool, limit := range other.Output.Tools {
+		if c.Output.Tools == nil {
+			c.Output.Tools = make(map[string]int)
+		}
+		c.Output.Tools[tool] = limit
+	}
+	if other.Output.Summarize {
+		c.Output.Summarize = true
+	}
+
+	if other.Context.MaxChars != 0 {
+		c.Context.MaxChars = other.Context.MaxChars
+	}
+	if other.Context.Priority != "" {
+		c.Context.Priority = other.Context.Priority
+	}
+	if other.Context.Generated != "" {
+		c.Context.Generated = other.Context.Generated
+	}
+	if len(other.ContextProviders) > 0 {
+		c.ContextProviders = other.ContextProviders
+	}
+
+	if other.Render.Width != "" {
+		c.Render.Width = other.Render.Width
+	}
+	if other.Render.Indent != 0 {
+		c.Render.Indent = other.Render.Indent
+	}
+
+	if other.EmptyResponse.Retries != nil {
+		c.EmptyResponse.Retries = other.EmptyResponse.Retries
+	}
+	if other.EmptyResponse.TemperatureStep != nil {
+		c.EmptyResponse.TemperatureStep = other.EmptyResponse.TemperatureStep
+	}
+
+	c.Env.Allow = append(c.Env.Allow, other.Env.Allow...)
+	if other.Env.Inherit {
+		c.Env.Inherit = true
+	}
+
+	for _, tool := range other.Tools {
+		replaced := false
+		for i := range c.Tools {
+			if c.Tools[i].Name == tool.Name {
+				c.Tools[i] = tool
+				replaced = true
+				break
+			}
+		}
+		if !replaced {
+			c.Tools = append(c.Tools, tool)
+		}
+	}
+}
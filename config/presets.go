@@ -0,0 +1,72 @@
+package config
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Preset is a bundle of generation options for a kind of task, so the
+// temperature and top_p do not have to be chosen by hand
+type Preset struct {
+	Name        string
+	Description string
+	Temperature float64
+	TopP        float64
+}
+
+// Presets lists the built-in presets, from the most to the least predictable
+var Presets = []Preset{
+	{"precise", "code changes, reviews and factual answers", 0.1, 0.5},
+	{"balanced", "everyday questions about the code", 0.7, 0.9},
+	{"creative", "brainstorming, naming and writing", 1.1, 0.95},
+}
+
+// FindPreset returns the built-in preset with the given name
+func FindPreset(name string) (Preset, error) {
+	names := make([]string, len(Presets))
+	for i, preset := range Presets {
+		if preset.Name == strings.ToLower(strings.TrimSpace(name)) {
+			return preset, nil
+		}
+		names[i] = preset.Name
+	}
+	return Preset{}, fmt.Errorf("unknown preset %q (available: %s)", name, strings.Join(names, ", "))
+}
+
+// MatchPreset returns the name of the preset with the given options, or
+// "custom" when none has them
+func MatchPreset(temperature, topP float64) string {
+	for _, preset := range Presets {
+		if preset.Temperature == temperature && preset.TopP == topP {
+			return preset.Name
+		}
+	}
+	return "custom"
+}
+
+// applyPreset chooses a preset and sets its options, recording where it was
+// chosen. An unknown preset is kept, so CheckPreset reports it, and
+// leaves the options as they were.
+func (s *Settings) applyPreset(name, source string) error {
+	s.Preset = name
+	s.record("preset", source)
+	preset, err := FindPreset(name)
+	if err != nil {
+		return fmt.Errorf("%v from %s", err, source)
+	}
+	s.Temperature, s.TopP = preset.Temperature, preset.TopP
+	s.record("temperature", source)
+	s.record("top_p", source)
+	return nil
+}
+
+// CheckPreset reports a preset chosen in the configuration that does not exist
+func (s *Settings) CheckPreset() error {
+	if s.Preset == "" {
+		return nil
+	}
+	if _, err := FindPreset(s.Preset); err != nil {
+		return fmt.Errorf("%v from %s", err, s.Source("preset"))
+	}
+	return nil
+}
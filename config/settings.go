@@ -0,0 +1,320 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/kek/slop-shop/styles"
+)
+
+// EnvPrefix is the prefix of environment variables that override settings,
+// e.g. SLOP_SHOP_MODEL or SLOP_SHOP_TOP_P
+const EnvPrefix = "SLOP_SHOP_"
+
+// SettingKeys lists the run settings in display order
+var SettingKeys = []string{"model", "url", "preset", "temperature", "top_p", "exclude", "tools", "allow_tools", "deny_tools", "tool_instructions", "theme", "system"}
+
+// Settings are the effective run settings after applying, in order of
+// increasing precedence, the defaults, the user config, the repository config,
+// environment variables and command-line flags
+type Settings struct {
+	Model       string
+	URL         string
+	Preset      string // Preset the temperature and top_p were chosen with, or ""
+	Temperature float64
+	TopP        float64
+	Exclude     []string
+	Tools       bool
+	AllowTools  []string
+	DenyTools   []string
+	Theme       string
+	System      string // System prompt sent with every request
+
+	// ToolInstructions is when the tool instructions are sent: with every
+	// prompt, only with prompts that look like they need tools, or once in the
+	// system prompt
+	ToolInstructions string
+
+	sources map[string]string // Where each setting came from, by key
+}
+
+// DefaultSettings returns the settings used when nothing is configured
+func DefaultSettings() Settings {
+	return Settings{
+		Model:       "qwen3:latest",
+		URL:         "http://localhost:11434",
+		Temperature: 0.7,
+		TopP:        0.9,
+		Exclude:     []string{".git", ".jj", "node_modules", "vendor", "*.exe", "*.dll", "*.so", "*.dylib", "*.bin", ".crush"},
+		Theme:       styles.DefaultTheme,
+
+		ToolInstructions: "always",
+	}
+}
+
+// Apply overlays the run settings from the loaded configuration files
+func (c *Config) Apply(s *Settings) {
+	for _, file := range c.files {
+		fc := file.cfg
+		if fc.Model != "" {
+			s.record("model", file.path)
+			s.Model = fc.Model
+		}
+		if fc.URL != "" {
+			s.record("url", file.path)
+			s.URL = fc.URL
+		}
+		if fc.Preset != "" {
+			s.applyPreset(fc.Preset, file.path)
+		}
+		if fc.Temperature != nil {
+			s.record("temperature", file.path)
+			s.Temperature = *fc.Temperature
+		}
+		if fc.TopP != nil {
+			s.record("top_p", file.path)
+			s.TopP = *fc.TopP
+		}
+		if fc.Exclude != nil {
+			s.record("exclude", file.path)
+			s.Exclude = fc.Exclude
+		}
+		if fc.Theme != "" {
+			s.record("theme", file.path)
+			s.Theme = fc.Theme
+		}
+		if fc.System != "" {
+			s.record("system", file.path)
+			s.System = fc.System
+		}
+		if fc.ToolPolicy.Enabled != nil {
+			s.record("tools", file.path)
+			s.Tools = *fc.ToolPolicy.Enabled
+		}
+		if fc.ToolPolicy.Allow != nil {
+			s.record("allow_tools", file.path)
+			s.AllowTools = fc.ToolPolicy.Allow
+		}
+		if fc.ToolPolicy.Deny != nil {
+			s.record("deny_tools", file.path)
+			s.DenyTools = fc.ToolPolicy.Deny
+		}
+		if fc.ToolPolicy.Instructions != "" {
+			s.record("tool_instructions", file.path)
+			s.ToolInstructions = fc.ToolPolicy.Instructions
+		}
+	}
+}
+
+// ApplyProfile overlays the run settings of the named profile, or of the
+// profile selected in the configuration files when name is empty
+func (c *Config) ApplyProfile(s *Settings, name string) error {
+	if name == "" {
+		name = c.Profile
+	}
+	if name == "" {
+		return nil
+	}
+
+	p, ok := c.Profiles[name]
+	if !ok {
+		names := make([]string, 0, len(c.Profiles))
+		for profile := range c.Profiles {
+			names = append(names, profile)
+		}
+		sort.Strings(names)
+		if len(names) == 0 {
+			return fmt.Errorf("unknown profile %q: no profiles are configured", name)
+		}
+		return fmt.Errorf("unknown profile %q (available: %s)", name, strings.Join(names, ", "))
+	}
+
+	source := "profile " + name
+	if p.Model != "" {
+		s.record("model", source)
+		s.Model = p.Model
+	}
+	if p.URL != "" {
+		s.record("url", source)
+		s.URL = p.URL
+	}
+	if p.Preset != "" {
+		if err := s.applyPreset(p.Preset, source); err != nil {
+			return err
+		}
+	}
+	if p.Temperature != nil {
+		s.record("temperature", source)
+		s.Temperature = *p.Temperature
+	}
+	if p.TopP != nil {
+		s.record("top_p", source)
+		s.TopP = *p.TopP
+	}
+	if p.System != "" {
+		s.record("system", source)
+		s.System = p.System
+	}
+	if p.ToolPolicy.Enabled != nil {
+		s.record("tools", source)
+		s.Tools = *p.ToolPolicy.Enabled
+	}
+	if p.ToolPolicy.Allow != nil {
+		s.record("allow_tools", source)
+		s.AllowTools = p.ToolPolicy.Allow
+	}
+	if p.ToolPolicy.Deny != nil {
+		s.record("deny_tools", source)
+		s.DenyTools = p.ToolPolicy.Deny
+	}
+	if p.ToolPolicy.Instructions != "" {
+		s.record("tool_instructions", source)
+		s.ToolInstructions = p.ToolPolicy.Instructions
+	}
+	return nil
+}
+
+// ApplyEnv overlays settings from SLOP_SHOP_* environment variables
+func ApplyEnv(s *Settings) error {
+	for _, key := range SettingKeys {
+		name := EnvPrefix + strings.ToUpper(key)
+		if value, ok := os.LookupEnv(name); ok {
+			if err := s.Set(key, value, "env "+name); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Set parses value for the setting key and records where it came from
+func (s *Settings) Set(key, value, source string) error {
+	switch key {
+	case "model":
+		s.Model = value
+	case "url":
+		s.URL = value
+	case "preset":
+		return s.applyPreset(value, source)
+	case "temperature", "top_p":
+		number, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+		if err != nil {
+			return fmt.Errorf("invalid %s %q from %s: %v", key, value, source, err)
+		}
+		if key == "temperature" {
+			s.Temperature = number
+		} else {
+			s.TopP = number
+		}
+	case "exclude":
+		s.Exclude = SplitList(value)
+	case "tools":
+		enabled, err := strconv.ParseBool(strings.TrimSpace(value))
+		if err != nil {
+			return fmt.Errorf("invalid %s %q from %s: %v", key, value, source, err)
+		}
+		s.Tools = enabled
+	case "allow_tools":
+		s.AllowTools = SplitList(value)
+	case "deny_tools":
+		s.DenyTools = SplitList(value)
+	case "tool_instructions":
+		s.ToolInstructions = value
+	case "theme":
+		s.Theme = value
+	case "system":
+		s.System = value
+	default:
+		return fmt.Errorf("unknown setting %q", key)
+	}
+
+	s.record(key, source)
+	return nil
+}
+
+// Get returns the value of a setting formatted as text
+func (s *Settings) Get(key string) string {
+	switch key {
+	case "model":
+		return s.Model
+	case "url":
+		return s.URL
+	case "preset":
+		return s.Preset
+	case "temperature":
+		return strconv.FormatFloat(s.Temperature, 'g', -1, 64)
+	case "top_p":
+		return strconv.FormatFloat(s.TopP, 'g', -1, 64)
+	case "exclude":
+		return strings.Join(s.Exclude, ",")
+	case "tools":
+		return strconv.FormatBool(s.Tools)
+	case "allow_tools":
+		return strings.Join(s.AllowTools, ",")
+	case "deny_tools":
+		return strings.Join(s.DenyTools, ",")
+	case "tool_instructions":
+		return s.ToolInstructions
+	case "theme":
+		return s.Theme
+	case "system":
+		return s.System
+	}
+	return ""
+}
+
+// Source returns where a setting came from: "default", a config file path, an
+// environment variable or a flag
+func (s *Settings) Source(key string) string {
+	if source, ok := s.sources[key]; ok {
+		return source
+	}
+	return "default"
+}
+
+// record notes the source of a setting
+func (s *Settings) record(key, source string) {
+	if s.sources == nil {
+		s.sources = make(map[string]string)
+	}
+	s.sources[key] = source
+}
+
+// String renders the effective settings with the source of each one
+func (s *Settings) String() string {
+	width := 0
+	for _, key := range SettingKeys {
+		if len(key) > width {
+			width = len(key)
+		}
+	}
+
+	var buf strings.Builder
+	for _, key := range SettingKeys {
+		buf.WriteString(fmt.Sprintf("%-*s = %-30s # %s\n", width, key, displayValue(s.Get(key)), s.Source(key)))
+	}
+	return buf.String()
+}
+
+// displayValue shortens a setting for display on one line
+func displayValue(value string) string {
+	value = strings.ReplaceAll(value, "\n", `\n`)
+	if len(value) > 60 {
+		value = value[:57] + "..."
+	}
+	return value
+}
+
+// SplitList splits a comma-separated value, trimming spaces and dropping empty entries
+func SplitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
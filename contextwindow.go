@@ -0,0 +1,55 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/kek/slop-shop/ollama"
+	"github.com/kek/slop-shop/tui"
+)
+
+// minContextWindow is a context window every model has, so smaller requests
+// are sent without asking Ollama for the model's window
+const minContextWindow = 2048
+
+// checkContextWindow refuses a request whose estimated size exceeds the
+// model's context window, which Ollama would otherwise silently truncate. The
+// error breaks the request down by part and suggests how to make it fit.
+// historyTokens is the size of a continued conversation's saved state. When
+// the window cannot be determined the request is let through.
+func checkContextWindow(client *ollama.Client, prompt, context string, historyTokens int, toolsEnabled bool) error {
+	estimate := ollama.EstimateTokens(ollama.BuildSystem(client.System, toolsEnabled)) + ollama.EstimateTokens(ollama.BuildPrompt(prompt, context, toolsEnabled)) + historyTokens
+	if estimate <= minContextWindow {
+		return nil
+	}
+	window, limit, err := client.ContextWindow()
+	if err != nil || estimate <= window {
+		return nil
+	}
+
+	var buf strings.Builder
+	fmt.Fprintf(&buf, "the request is about %d tokens but %s has a context window of %d tokens; Ollama would drop the start of the prompt\n\n", estimate, client.Model, window)
+	buf.WriteString(tui.RenderPreview(client.Model, client.System, prompt, context, toolsEnabled, false))
+	if historyTokens > 0 {
+		fmt.Fprintf(&buf, "The session's saved conversation adds %d tokens.\n", historyTokens)
+	}
+
+	buf.WriteString("\nTo make it fit:\n")
+	buf.WriteString("  - send only the chunks related to the prompt with -retrieve N (build the index with slop-shop embed)\n")
+	buf.WriteString("  - send declarations instead of whole source files with -outline\n")
+	buf.WriteString("  - leave out the largest files with -exclude or .slopshopignore, or name the files to send with -attach\n")
+	switch {
+	case limit >= estimate:
+		fmt.Fprintf(&buf, "  - raise the context window with -num-ctx %d (%s supports up to %d tokens)\n", roundUpContext(estimate), client.Model, limit)
+	case limit > 0:
+		fmt.Fprintf(&buf, "  - %s supports at most %d tokens, so a larger -num-ctx will not help; use a model with a longer context\n", client.Model, limit)
+	default:
+		fmt.Fprintf(&buf, "  - raise the context window with -num-ctx %d, if the model supports it\n", roundUpContext(estimate))
+	}
+	return fmt.Errorf("%s", strings.TrimSuffix(buf.String(), "\n"))
+}
+
+// roundUpContext rounds a token count up to the next multiple of 1024, leaving room for the answer
+func roundUpContext(tokens int) int {
+	return (tokens*5/4 + 1023) / 1024 * 1024
+}
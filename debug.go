@@ -0,0 +1,57 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/kek/slop-shop/config"
+	"github.com/kek/slop-shop/debuglog"
+)
+
+// debugFlag is the -debug flag. Given alone it enables debug output for every
+// component; -debug=tui,ollama enables it for those components only.
+type debugFlag string
+
+func (f *debugFlag) String() string {
+	return string(*f)
+}
+
+func (f *debugFlag) Set(value string) error {
+	switch value {
+	case "true":
+		value = "all"
+	case "false":
+		value = ""
+	}
+	*f = debugFlag(value)
+	return nil
+}
+
+// IsBoolFlag lets -debug be given without a value
+func (f *debugFlag) IsBoolFlag() bool {
+	return true
+}
+
+// setDebug enables debug output for the components in the -debug flag. It goes
+// to the clients of the UNIX socket at socket when one is given, and otherwise
+// to config.DebugLogPath, so nothing is written into the repository.
+func setDebug(components debugFlag, socket string) error {
+	debuglog.Close()
+	if components == "" {
+		if socket != "" {
+			return fmt.Errorf("-debug-socket needs -debug")
+		}
+		return nil
+	}
+	if err := debuglog.Enable(config.SplitList(string(components))); err != nil {
+		return err
+	}
+
+	if socket != "" {
+		return debuglog.Listen(socket)
+	}
+	path := config.DebugLogPath()
+	if path == "" {
+		return fmt.Errorf("cannot find a directory for the debug log; use -debug-socket")
+	}
+	return debuglog.OpenFile(path)
+}
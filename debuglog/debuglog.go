@@ -0,0 +1,141 @@
+// Package debuglog writes debug output for selected components of slop-shop to
+// a file or to the clients of a UNIX socket. It is safe for concurrent use.
+package debuglog
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Components lists the parts of slop-shop that write debug output
+var Components = []string{"tui", "ollama", "tools"}
+
+var (
+	mu       sync.Mutex
+	enabled  map[string]bool
+	output   io.Writer    // Log file, if any
+	clients  []net.Conn   // Connections to the socket, if listening
+	listener net.Listener // Socket accepting clients, if listening
+)
+
+// Enable turns on debug output for the named components; "all" names every
+// component. An empty list turns debug output off.
+func Enable(components []string) error {
+	selected := make(map[string]bool)
+	for _, component := range components {
+		switch {
+		case component == "all":
+			for _, name := range Components {
+				selected[name] = true
+			}
+		case slices.Contains(Components, component):
+			selected[component] = true
+		default:
+			return fmt.Errorf("unknown debug component %q (available: all, %s)", component, strings.Join(Components, ", "))
+		}
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	enabled = selected
+	return nil
+}
+
+// Enabled reports whether debug output is on for component
+func Enabled(component string) bool {
+	mu.Lock()
+	defer mu.Unlock()
+	return enabled[component]
+}
+
+// OpenFile appends debug output to the file at path, creating it and its
+// directory if needed
+func OpenFile(path string) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return fmt.Errorf("error creating debug log directory: %v", err)
+	}
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("error opening debug log: %v", err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	output = f
+	return nil
+}
+
+// Listen serves debug output on a UNIX socket at path, so it can be followed
+// from another terminal, e.g. with nc -U path. Every connected client gets
+// the lines written while it is connected.
+func Listen(path string) error {
+	os.Remove(path) // A socket left behind by an earlier run
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return fmt.Errorf("error listening on debug socket: %v", err)
+	}
+
+	mu.Lock()
+	listener = l
+	mu.Unlock()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			mu.Lock()
+			clients = append(clients, conn)
+			mu.Unlock()
+		}
+	}()
+	return nil
+}
+
+// Close stops debug output, closing the log file and the socket
+func Close() {
+	mu.Lock()
+	defer mu.Unlock()
+	if closer, ok := output.(io.Closer); ok {
+		closer.Close()
+	}
+	if listener != nil {
+		listener.Close()
+	}
+	for _, conn := range clients {
+		conn.Close()
+	}
+	enabled, output, clients, listener = nil, nil, nil, nil
+}
+
+// Logf writes a timestamped line of debug output for component, if it is enabled
+func Logf(component, format string, args ...any) {
+	mu.Lock()
+	defer mu.Unlock()
+	if !enabled[component] {
+		return
+	}
+
+	line := fmt.Sprintf("%s [%s] %s\n", time.Now().Format("15:04:05.000"), component, strings.TrimRight(fmt.Sprintf(format, args...), "\n"))
+	if output != nil {
+		io.WriteString(output, line)
+	}
+	// Drop clients that have gone away or stopped reading
+	connected := clients[:0]
+	for _, conn := range clients {
+		conn.SetWriteDeadline(time.Now().Add(100 * time.Millisecond))
+		if _, err := io.WriteString(conn, line); err != nil {
+			conn.Close()
+			continue
+		}
+		connected = append(connected, conn)
+	}
+	clients = connected
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"go/parser"
+	"go/token"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/kek/slop-shop/ollama"
+	"github.com/kek/slop-shop/repo"
+	"github.com/kek/slop-shop/styles"
+	"github.com/kek/slop-shop/tools"
+)
+
+// runDocs writes package documentation comments, or package READMEs, from the
+// outline of each package. The changes are shown as a diff and applied once
+// approved.
+func runDocs(args []string) error {
+	fs := newFlagSet("docs")
+	opts := addCommonFlags(fs)
+	readme := fs.Bool("readme", false, "Write a README.md for each package instead of its package comment")
+	yes := fs.Bool("yes", false, "Apply the changes without asking")
+	fs.Parse(args)
+
+	settings, err := setup(fs, opts)
+	if err != nil {
+		return err
+	}
+
+	index := repo.NewIndex(opts.repoPath, settings.Exclude)
+	if err := index.Update(); err != nil {
+		return fmt.Errorf("error indexing repository: %v", err)
+	}
+	packages := selectPackages(index.Packages(), fs.Args())
+	if len(packages) == 0 {
+		return fmt.Errorf("no Go packages to document")
+	}
+
+	client := ollama.NewClient(settings.URL, settings.Model, settings.Temperature, settings.TopP)
+	client.System = settings.System
+
+	var patch strings.Builder
+	for _, pkg := range packages {
+		fmt.Fprintln(chatter(), styles.InfoStyle.Render(fmt.Sprintf("📝 Documenting %s (%s)", pkg.Name, pkg.Dir)))
+		diff, err := documentPackage(client, pkg, opts.repoPath, *readme)
+		if err != nil {
+			return fmt.Errorf("error documenting %s: %v", pkg.Dir, err)
+		}
+		patch.WriteString(diff)
+	}
+
+	if patch.Len() == 0 {
+		fmt.Fprintln(chatter(), styles.SuccessStyle.Render("Documentation is up to date"))
+		return nil
+	}
+	return reviewPatch(patch.String(), opts.repoPath, *yes)
+}
+
+// selectPackages keeps the packages in the given directories, or all of them when none are given
+func selectPackages(packages []repo.Package, dirs []string) []repo.Package {
+	if len(dirs) == 0 {
+		return packages
+	}
+	wanted := make(map[string]bool)
+	for _, dir := range dirs {
+		wanted[path.Clean(filepath.ToSlash(dir))] = true
+	}
+
+	var selected []repo.Package
+	for _, pkg := range packages {
+		if wanted[pkg.Dir] {
+			selected = append(selected, pkg)
+		}
+	}
+	return selected
+}
+
+// documentPackage asks the model for the documentation of a package and
+// returns the diff that puts it in place
+func documentPackage(client *ollama.Client, pkg repo.Package, repoPath string, readme bool) (string, error) {
+	context := pkg.Outline()
+	if pkg.Doc != "" {
+		context += "\nCurrent package comment:\n" + pkg.Doc
+	}
+
+	if readme {
+		target := path.Join(pkg.Dir, "README.md")
+		current, _ := os.ReadFile(filepath.Join(repoPath, filepath.FromSlash(target)))
+		if len(current) > 0 {
+			context += "\nCurrent README.md:\n" + string(current)
+		}
+		prompt := fmt.Sprintf("Write a README.md for the Go package %s described by the outline. Give a title, an overview of what "+
+			"the package is for and a short description of its main types and functions. Output only the Markdown.", pkg.Name)
+		text, err := client.Generate(prompt, context, false, nil)
+		if err != nil {
+			return "", err
+		}
+		return tools.UnifiedDiff(target, string(current), cleanGenerated(text)+"\n"), nil
+	}
+
+	subject := "Package " + pkg.Name
+	if pkg.Name == "main" {
+		subject = "the name of the command"
+	}
+	prompt := fmt.Sprintf("Write the package documentation comment for the Go package %s described by the outline. Start with %q, "+
+		"say what the package is for and mention its main types and functions in one to three short paragraphs. "+
+		"Output only the comment text, without comment markers or code fences.", pkg.Name, subject)
+	text, err := client.Generate(prompt, context, false, nil)
+	if err != nil {
+		return "", err
+	}
+
+	target := pkg.DocFile
+	if target == "" {
+		target = path.Join(pkg.Dir, "doc.go")
+	}
+	current, err := os.ReadFile(filepath.Join(repoPath, filepath.FromSlash(target)))
+	if err != nil && !os.IsNotExist(err) {
+		return "", err
+	}
+	updated, err := replacePackageComment(string(current), pkg.Name, formatDocComment(cleanGenerated(text)))
+	if err != nil {
+		return "", fmt.Errorf("%s: %v", target, err)
+	}
+	return tools.UnifiedDiff(target, string(current), updated), nil
+}
+
+// cleanGenerated strips code fences and surrounding space from generated text
+func cleanGenerated(text string) string {
+	text = strings.TrimSpace(text)
+	if strings.HasPrefix(text, "```") {
+		if newline := strings.Index(text, "\n"); newline >= 0 {
+			text = text[newline+1:]
+		}
+		text = strings.TrimSuffix(strings.TrimSpace(text), "```")
+	}
+	return strings.TrimSpace(text)
+}
+
+// formatDocComment turns text into // comment lines
+func formatDocComment(text string) string {
+	var lines []string
+	for _, line := range strings.Split(text, "\n") {
+		line = strings.TrimRight(strings.TrimPrefix(strings.TrimPrefix(line, "//"), " "), " \t")
+		if line == "" {
+			lines = append(lines, "//")
+		} else {
+			lines = append(lines, "// "+line)
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// replacePackageComment returns src with its package comment replaced by
+// comment, adding one if there is none. An empty src becomes a doc.go file.
+func replacePackageComment(src, pkgName, comment string) (string, error) {
+	if src == "" {
+		return comment + "\npackage " + pkgName + "\n", nil
+	}
+
+	fset := token.NewFileSet()
+	parsed, err := parser.ParseFile(fset, "", src, parser.PackageClauseOnly|parser.ParseComments)
+	if err != nil {
+		return "", err
+	}
+	if parsed.Doc != nil {
+		start := fset.Position(parsed.Doc.Pos()).Offset
+		end := fset.Position(parsed.Doc.End()).Offset
+		return src[:start] + comment + src[end:], nil
+	}
+	offset := fset.Position(parsed.Package).Offset
+	return src[:offset] + comment + "\n" + src[offset:], nil
+}
+
+// reviewPatch shows a patch, saves it with -patch-out and applies it once the
+// user approves, or right away with yes
+func reviewPatch(patch, repoPath string, yes bool) error {
+	printDiff(display(), patch)
+
+	if patchFile != "" {
+		if err := writePatch(patch); err != nil {
+			return err
+		}
+	}
+
+	if !yes && !confirm("Apply these changes?") {
+		fmt.Fprintln(chatter(), styles.WarningStyle.Render("Changes not applied"))
+		return nil
+	}
+	if err := tools.ApplyPatch(patch, repoPath); err != nil {
+		return err
+	}
+	fmt.Fprintln(chatter(), styles.SuccessStyle.Render("✅ Changes applied"))
+	return nil
+}
+
+// confirm asks a yes/no question on the terminal. It returns false when
+// standard input is not a terminal.
+func confirm(question string) bool {
+	if !stdinIsTerminal() {
+		return false
+	}
+	fmt.Fprint(display(), styles.PromptStyle.Render(question+" [y/N] "))
+	answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	return answer == "y" || answer == "yes"
+}
+
+// printDiff writes a unified diff with added, removed and hunk lines colored
+func printDiff(w io.Writer, diff string) {
+	for _, line := range strings.Split(strings.TrimSuffix(diff, "\n"), "\n") {
+		style := styles.MutedStyle
+		switch {
+		case strings.HasPrefix(line, "+"):
+			style = styles.SuccessStyle
+		case strings.HasPrefix(line, "-"):
+			style = styles.ErrorStyle
+		case strings.HasPrefix(line, "@@"):
+			style = styles.InfoStyle
+		}
+		fmt.Fprintln(w, style.Render(line))
+	}
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/kek/slop-shop/config"
+	"github.com/kek/slop-shop/ollama"
+	"github.com/kek/slop-shop/styles"
+	"github.com/kek/slop-shop/tools"
+	"github.com/muesli/termenv"
+)
+
+// checkResult is the outcome of one doctor check
+type checkResult struct {
+	name     string
+	ok       bool
+	optional bool // A failed optional check is a warning and does not fail the command
+	detail   string
+	fix      string // How to resolve a failed check
+}
+
+// runDoctor checks the configuration, the Ollama server and model, the terminal
+// and the external commands, and prints a fix for each problem
+func runDoctor(args []string) error {
+	fs := newFlagSet("doctor")
+	opts := addCommonFlags(fs)
+	fs.Parse(args)
+
+	fmt.Println(versionString())
+	fmt.Println()
+
+	results := doctorChecks(fs, opts)
+	failed := 0
+	for _, result := range results {
+		switch {
+		case result.ok:
+			fmt.Println(styles.SuccessStyle.Render(fmt.Sprintf("✅ %s: %s", result.name, result.detail)))
+			continue
+		case result.optional:
+			fmt.Println(styles.WarningStyle.Render(fmt.Sprintf("⚠️  %s: %s", result.name, result.detail)))
+		default:
+			failed++
+			fmt.Println(styles.ErrorStyle.Render(fmt.Sprintf("❌ %s: %s", result.name, result.detail)))
+		}
+		if result.fix != "" {
+			fmt.Println(styles.MutedStyle.Render("   fix: " + result.fix))
+		}
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d of %d checks failed", failed, len(results))
+	}
+	return nil
+}
+
+// doctorChecks runs the checks in order. Only the configuration is checked when
+// it cannot be loaded, since the Ollama URL and model are then unknown.
+func doctorChecks(fs *flag.FlagSet, opts *options) []checkResult {
+	cfg, settings, err := resolveSettings(fs, opts)
+	if err != nil {
+		return []checkResult{{
+			name:   "config",
+			detail: err.Error(),
+			fix:    fmt.Sprintf("correct %s or %s", config.UserConfigPath(), config.RepoConfigPath(opts.repoPath)),
+		}}
+	}
+
+	results := []checkResult{checkConfig(cfg, settings, opts.repoPath)}
+	client := ollama.NewClient(settings.URL, settings.Model, settings.Temperature, settings.TopP)
+	results = append(results, checkOllama(client)...)
+	results = append(results, checkTerminal())
+	results = append(results, checkCommand("git", "review, commit and templates that use git", "install git from https://git-scm.com", false))
+	results = append(results, checkCommand("rg", "CODE_SEARCH and SEARCH_FILES", "install ripgrep from https://github.com/BurntSushi/ripgrep; a slower built-in search is used without it", true))
+	return results
+}
+
+// checkConfig validates the settings that are only checked when they are used
+func checkConfig(cfg *config.Config, settings *config.Settings, repoPath string) checkResult {
+	result := checkResult{name: "config"}
+
+	var problems []string
+	if err := styles.SetTheme(settings.Theme); err != nil {
+		problems = append(problems, err.Error())
+	}
+	if err := tools.RegisterCustomTools(cfg.Tools); err != nil {
+		problems = append(problems, fmt.Sprintf("custom tools: %v", err))
+	}
+
+	known := make(map[string]bool)
+	for _, tool := range tools.ListTools() {
+		known[tool.Name] = true
+	}
+	for _, name := range append(append([]string{}, settings.AllowTools...), settings.DenyTools...) {
+		if !known[strings.ToUpper(name)] {
+			problems = append(problems, fmt.Sprintf("unknown tool %s in the tool policy", name))
+		}
+	}
+
+	if len(problems) > 0 {
+		result.detail = strings.Join(problems, "; ")
+		result.fix = fmt.Sprintf("correct %s or %s; \"slop-shop tools\" lists the tool names", config.UserConfigPath(), config.RepoConfigPath(repoPath))
+		return result
+	}
+
+	var loaded []string
+	for _, path := range []string{config.UserConfigPath(), config.RepoConfigPath(repoPath)} {
+		if _, err := os.Stat(path); err == nil {
+			loaded = append(loaded, path)
+		}
+	}
+	result.ok = true
+	result.detail = "valid (defaults only)"
+	if len(loaded) > 0 {
+		result.detail = "valid (" + strings.Join(loaded, ", ") + ")"
+	}
+	return result
+}
+
+// checkOllama checks that the server answers and that the model is installed
+func checkOllama(client *ollama.Client) []checkResult {
+	models, err := client.ListModels()
+	if err != nil {
+		return []checkResult{{
+			name:   "ollama",
+			detail: fmt.Sprintf("cannot reach %s: %v", client.URL, err),
+			fix:    "start Ollama with \"ollama serve\", or point -url or SLOP_SHOP_URL at the server",
+		}}
+	}
+
+	results := []checkResult{{name: "ollama", ok: true, detail: fmt.Sprintf("%s is running with %d models", client.URL, len(models))}}
+	for _, name := range models {
+		if name == client.Model || name == client.Model+":latest" {
+			return append(results, checkResult{name: "model", ok: true, detail: name + " is installed"})
+		}
+	}
+	return append(results, checkResult{
+		name:   "model",
+		detail: client.Model + " is not installed",
+		fix:    fmt.Sprintf("run \"ollama pull %s\", or choose an installed model with -model", client.Model),
+	})
+}
+
+// checkTerminal reports whether output goes to a terminal and how many colors it supports
+func checkTerminal() checkResult {
+	info, err := os.Stdout.Stat()
+	if err != nil || info.Mode()&os.ModeCharDevice == 0 {
+		return checkResult{name: "terminal", ok: true, detail: "output is not a terminal; colors are disabled"}
+	}
+
+	colors := map[termenv.Profile]string{
+		termenv.Ascii:     "no colors",
+		termenv.ANSI:      "16 colors",
+		termenv.ANSI256:   "256 colors",
+		termenv.TrueColor: "true color",
+	}[styles.DetectColor()]
+	detail := fmt.Sprintf("TERM=%s, %s", os.Getenv("TERM"), colors)
+	if os.Getenv("NO_COLOR") != "" {
+		detail += ", NO_COLOR is set"
+	}
+
+	if os.Getenv("TERM") == "dumb" {
+		return checkResult{name: "terminal", optional: true, detail: detail, fix: "set TERM to your terminal type, e.g. xterm-256color, for the chat REPL"}
+	}
+	return checkResult{name: "terminal", ok: true, detail: detail}
+}
+
+// checkCommand checks that an external command is on the PATH
+func checkCommand(name, usedBy, fix string, optional bool) checkResult {
+	path, err := exec.LookPath(name)
+	if err != nil {
+		return checkResult{name: name, optional: optional, detail: "not found on PATH; needed by " + usedBy, fix: fix}
+	}
+	return checkResult{name: name, ok: true, detail: path}
+}
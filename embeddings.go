@@ -0,0 +1,345 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/kek/slop-shop/config"
+	"github.com/kek/slop-shop/ollama"
+	"github.com/kek/slop-shop/repo"
+	"github.com/kek/slop-shop/styles"
+)
+
+// chunkLines is how many lines of a file go into one embedded chunk
+const chunkLines = 40
+
+// embedBatch is how many chunks are sent in one embedding request
+const embedBatch = 32
+
+// embeddingIndex holds the embedded chunks of a repository's files. Each file
+// is stored with the hash of its contents, so a refresh only embeds the chunks
+// of files that were added or changed.
+type embeddingIndex struct {
+	Model string                   `json:"model"`
+	Files map[string]*embeddedFile `json:"files"`
+
+	path string
+}
+
+// embeddedFile is the hash and chunks of one indexed file
+type embeddedFile struct {
+	Hash   string          `json:"hash"`
+	Chunks []embeddedChunk `json:"chunks"`
+}
+
+// embeddedChunk is a range of lines of a file and its embedding
+type embeddedChunk struct {
+	Start  int       `json:"start"` // First line, counted from 1
+	End    int       `json:"end"`   // Last line
+	Vector []float32 `json:"vector"`
+}
+
+// chunkMatch is a chunk found by a search and its similarity to the query
+type chunkMatch struct {
+	File  string
+	Start int
+	End   int
+	Score float64
+}
+
+// refreshStats counts what a refresh of the embedding index did
+type refreshStats struct {
+	Embedded  int // Files embedded because they were new or changed
+	Chunks    int // Chunks embedded
+	Removed   int // Files dropped because they no longer exist
+	Unchanged int
+}
+
+// embeddingIndexPath returns where the embedding index of a repository is stored
+func embeddingIndexPath(repoPath string) (string, error) {
+	dir := config.EmbeddingsDir()
+	if dir == "" {
+		return "", fmt.Errorf("no cache directory for the embedding index")
+	}
+	abs, err := filepath.Abs(repoPath)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256([]byte(abs))
+	return filepath.Join(dir, hex.EncodeToString(sum[:8])+".json"), nil
+}
+
+// loadEmbeddingIndex reads the embedding index of a repository. It reports
+// whether the index exists; a missing index is returned empty.
+func loadEmbeddingIndex(repoPath string) (*embeddingIndex, bool, error) {
+	path, err := embeddingIndexPath(repoPath)
+	if err != nil {
+		return nil, false, err
+	}
+	index := &embeddingIndex{Files: make(map[string]*embeddedFile), path: path}
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return index, false, nil
+	}
+	if err != nil {
+		return nil, false, fmt.Errorf("error reading embedding index: %v", err)
+	}
+	if err := json.Unmarshal(data, index); err != nil {
+		return nil, false, fmt.Errorf("error decoding embedding index %s: %v", path, err)
+	}
+	if index.Files == nil {
+		index.Files = make(map[string]*embeddedFile)
+	}
+	return index, true, nil
+}
+
+// save writes the index, replacing the previous one atomically
+func (index *embeddingIndex) save() error {
+	data, err := json.Marshal(index)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(index.path), 0755); err != nil {
+		return fmt.Errorf("error creating %s: %v", filepath.Dir(index.path), err)
+	}
+	tmp := index.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return fmt.Errorf("error writing embedding index: %v", err)
+	}
+	return os.Rename(tmp, index.path)
+}
+
+// refresh brings the index in line with the files: files whose hash changed
+// are chunked and embedded again, files that are gone are dropped and the rest
+// is kept. Changing the embedding model re-embeds everything.
+func (index *embeddingIndex) refresh(files []repo.FileInfo, model string, embed func([]string) ([][]float32, error)) (refreshStats, error) {
+	var stats refreshStats
+	if index.Model != model {
+		index.Model = model
+		index.Files = make(map[string]*embeddedFile)
+	}
+
+	seen := make(map[string]bool)
+	type pending struct {
+		file  string
+		chunk int
+		text  string
+	}
+	var queue []pending
+	changed := make(map[string]*embeddedFile)
+	for _, file := range files {
+		path := filepath.ToSlash(file.Path)
+		seen[path] = true
+		sum := sha256.Sum256([]byte(file.Content))
+		hash := hex.EncodeToString(sum[:])
+		if existing, ok := index.Files[path]; ok && existing.Hash == hash {
+			stats.Unchanged++
+			continue
+		}
+
+		entry := &embeddedFile{Hash: hash}
+		for _, chunk := range chunkFile(file.Content) {
+			queue = append(queue, pending{path, len(entry.Chunks), chunkText(path, chunk.Start, chunk.End, file.Content)})
+			entry.Chunks = append(entry.Chunks, chunk)
+		}
+		changed[path] = entry
+	}
+
+	for start := 0; start < len(queue); start += embedBatch {
+		end := min(start+embedBatch, len(queue))
+		texts := make([]string, 0, end-start)
+		for _, item := range queue[start:end] {
+			texts = append(texts, item.text)
+		}
+		vectors, err := embed(texts)
+		if err != nil {
+			return stats, err
+		}
+		for i, item := range queue[start:end] {
+			changed[item.file].Chunks[item.chunk].Vector = vectors[i]
+		}
+	}
+
+	for path, entry := range changed {
+		index.Files[path] = entry
+		stats.Embedded++
+		stats.Chunks += len(entry.Chunks)
+	}
+	for path := range index.Files {
+		if !seen[path] {
+			delete(index.Files, path)
+			stats.Removed++
+		}
+	}
+	return stats, nil
+}
+
+// chunkFile splits a file into chunks of chunkLines lines, without vectors
+func chunkFile(content string) []embeddedChunk {
+	lines := strings.Count(strings.TrimSuffix(content, "\n"), "\n") + 1
+	if strings.TrimSpace(content) == "" {
+		return nil
+	}
+	var chunks []embeddedChunk
+	for start := 1; start <= lines; start += chunkLines {
+		chunks = append(chunks, embeddedChunk{Start: start, End: min(start+chunkLines-1, lines)})
+	}
+	return chunks
+}
+
+// chunkText returns the text embedded for a chunk: its lines headed by the file path
+func chunkText(path string, start, end int, content string) string {
+	lines := strings.Split(content, "\n")
+	return path + "\n" + strings.Join(lines[start-1:min(end, len(lines))], "\n")
+}
+
+// search returns the n chunks most similar to the query vector, best first
+func (index *embeddingIndex) search(query []float32, n int) []chunkMatch {
+	var matches []chunkMatch
+	for path, file := range index.Files {
+		for _, chunk := range file.Chunks {
+			matches = append(matches, chunkMatch{File: path, Start: chunk.Start, End: chunk.End, Score: cosine(query, chunk.Vector)})
+		}
+	}
+	sort.Slice(matches, func(i, j int) bool {
+		if matches[i].Score != matches[j].Score {
+			return matches[i].Score > matches[j].Score
+		}
+		if matches[i].File != matches[j].File {
+			return matches[i].File < matches[j].File
+		}
+		return matches[i].Start < matches[j].Start
+	})
+	if len(matches) > n {
+		matches = matches[:n]
+	}
+	return matches
+}
+
+// cosine returns the cosine similarity of two vectors, or 0 if they differ in length
+func cosine(a, b []float32) float64 {
+	if len(a) != len(b) || len(a) == 0 {
+		return 0
+	}
+	var dot, normA, normB float64
+	for i := range a {
+		dot += float64(a[i]) * float64(b[i])
+		normA += float64(a[i]) * float64(a[i])
+		normB += float64(b[i]) * float64(b[i])
+	}
+	if normA == 0 || normB == 0 {
+		return 0
+	}
+	return dot / (math.Sqrt(normA) * math.Sqrt(normB))
+}
+
+// readIndexedFiles reads the repository files the embedding index covers
+func readIndexedFiles(repoPath string, settings *config.Settings) ([]repo.FileInfo, error) {
+	files, err := readRepository(repoPath, settings.Exclude)
+	if err != nil {
+		return nil, fmt.Errorf("error reading repository: %v", err)
+	}
+	return files, nil
+}
+
+// refreshEmbeddingIndex updates and saves the embedding index of a repository,
+// embedding only the files that changed since it was last refreshed
+func refreshEmbeddingIndex(index *embeddingIndex, files []repo.FileInfo, model string, settings *config.Settings) (refreshStats, error) {
+	client := ollama.NewClient(settings.URL, settings.Model, settings.Temperature, settings.TopP)
+	stats, err := index.refresh(files, model, func(texts []string) ([][]float32, error) {
+		return client.Embed(model, texts)
+	})
+	if err != nil {
+		return stats, fmt.Errorf("error embedding with %s: %v", model, err)
+	}
+	if stats.Embedded > 0 || stats.Removed > 0 {
+		if err := index.save(); err != nil {
+			return stats, err
+		}
+	}
+	return stats, nil
+}
+
+// runEmbed builds or refreshes the embedding index used by ask -retrieve
+func runEmbed(args []string) error {
+	fs := newFlagSet("embed")
+	opts := addCommonFlags(fs)
+	model := fs.String("embed-model", "nomic-embed-text", "Ollama embedding model; changing it re-embeds the whole repository")
+	fs.Parse(args)
+
+	_, settings, err := resolveSettings(fs, opts)
+	if err != nil {
+		return err
+	}
+
+	start := time.Now()
+	index, _, err := loadEmbeddingIndex(opts.repoPath)
+	if err != nil {
+		return err
+	}
+	files, err := readIndexedFiles(opts.repoPath, settings)
+	if err != nil {
+		return err
+	}
+	stats, err := refreshEmbeddingIndex(index, files, *model, settings)
+	if err != nil {
+		return batchError(err, nil)
+	}
+
+	fmt.Println(styles.SuccessStyle.Render(fmt.Sprintf("✅ Embedded %d changed files (%d chunks) with %s, removed %d, %d unchanged in %s",
+		stats.Embedded, stats.Chunks, index.Model, stats.Removed, stats.Unchanged, time.Since(start).Round(time.Millisecond))))
+	return nil
+}
+
+// retrieveContext refreshes the embedding index of the repository and returns
+// the n chunks most similar to the prompt as context. The index has to have
+// been built with the embed command.
+func retrieveContext(prompt string, n int, repoPath string, settings *config.Settings) (string, error) {
+	index, exists, err := loadEmbeddingIndex(repoPath)
+	if err != nil {
+		return "", err
+	}
+	if !exists {
+		return "", fmt.Errorf("no embedding index for %s; run slop-shop embed first", repoPath)
+	}
+
+	files, err := readIndexedFiles(repoPath, settings)
+	if err != nil {
+		return "", err
+	}
+	stats, err := refreshEmbeddingIndex(index, files, index.Model, settings)
+	if err != nil {
+		return "", batchError(err, nil)
+	}
+	if stats.Embedded > 0 || stats.Removed > 0 {
+		fmt.Fprintln(chatter(), styles.InfoStyle.Render(fmt.Sprintf("Updated the embedding index: %d changed files, %d removed", stats.Embedded, stats.Removed)))
+	}
+
+	client := ollama.NewClient(settings.URL, settings.Model, settings.Temperature, settings.TopP)
+	vectors, err := client.Embed(index.Model, []string{prompt})
+	if err != nil {
+		return "", batchError(fmt.Errorf("error embedding the prompt with %s: %v", index.Model, err), nil)
+	}
+
+	contents := make(map[string]string, len(files))
+	for _, file := range files {
+		contents[filepath.ToSlash(file.Path)] = file.Content
+	}
+	var chunks []repo.FileInfo
+	for _, match := range index.search(vectors[0], n) {
+		lines := strings.Split(contents[match.File], "\n")
+		text := strings.Join(lines[match.Start-1:min(match.End, len(lines))], "\n")
+		chunks = append(chunks, repo.FileInfo{Path: fmt.Sprintf("%s:%d-%d", match.File, match.Start, match.End), Content: text, Size: int64(len(text))})
+	}
+	fmt.Fprintln(chatter(), styles.InfoStyle.Render(fmt.Sprintf("Retrieved %d chunks from %d indexed files", len(chunks), len(index.Files))))
+	return repo.CreateContext(chunks), nil
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/kek/slop-shop/ollama"
+	"github.com/kek/slop-shop/tools"
+)
+
+// Exit codes of the slop-shop command, so scripts can tell failures apart
+const (
+	exitOK           = 0
+	exitFailure      = 1   // Invalid flags, configuration or other errors
+	exitUsage        = 2   // Unknown or missing command
+	exitConnection   = 3   // The Ollama server could not be reached
+	exitModel        = 4   // Ollama returned an error, e.g. for an unknown model
+	exitToolFailed   = 5   // A tool call failed
+	exitPolicyDenied = 6   // The tool policy blocked a tool call
+	exitFindings     = 7   // review -fail-on found a problem of that severity
+	exitIncomplete   = 8   // -max-steps ran out before the model gave a FINAL_ANSWER
+	exitInterrupted  = 130 // Stopped by Ctrl+C or SIGTERM, as shells report it
+)
+
+// exitError is an error that ends the command with a specific exit code
+type exitError struct {
+	code int
+	err  error
+}
+
+func (e *exitError) Error() string {
+	return e.err.Error()
+}
+
+func (e *exitError) Unwrap() error {
+	return e.err
+}
+
+// exitCode returns the exit code for an error returned by a command
+func exitCode(err error) int {
+	if err == nil {
+		return exitOK
+	}
+	var exitErr *exitError
+	if errors.As(err, &exitErr) {
+		return exitErr.code
+	}
+	return exitFailure
+}
+
+// batchError classifies the outcome of a batch run, or returns nil when the
+// model answered and every tool call succeeded. Model errors take precedence
+// over tool errors, and policy denials over other tool failures.
+func batchError(err error, results []tools.ToolResult) error {
+	if wasInterrupted() || errors.Is(err, ollama.ErrInterrupted) {
+		if err == nil {
+			err = ollama.ErrInterrupted
+		}
+		return &exitError{exitInterrupted, err}
+	}
+	if err != nil {
+		var connErr *ollama.ConnectionError
+		if errors.As(err, &connErr) {
+			return &exitError{exitConnection, err}
+		}
+		return &exitError{exitModel, err}
+	}
+
+	denied, failed := 0, 0
+	for _, result := range results {
+		switch {
+		case result.Denied:
+			denied++
+		case !result.Success:
+			failed++
+		}
+	}
+	if denied > 0 {
+		return &exitError{exitPolicyDenied, fmt.Errorf("%d tool calls blocked by the tool policy", denied)}
+	}
+	if failed > 0 {
+		return &exitError{exitToolFailed, fmt.Errorf("%d of %d tool calls failed", failed, len(results))}
+	}
+	return nil
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/kek/slop-shop/ollama"
+	"github.com/kek/slop-shop/repo"
+)
+
+// explainPrompt asks for an onboarding overview of the repository
+const explainPrompt = "Write an architecture overview of this repository in Markdown for new contributors. Use these sections: " +
+	"Overview (what the project does), Modules (each package or directory and its responsibility), " +
+	"Entry Points (main functions, commands, servers or exported APIs), Data Flow (how a typical request or run moves through the code), " +
+	"Key Types (the central types and what they model) and Where to Start (files to read first). " +
+	"Refer to real file paths and names. Output only the Markdown."
+
+// runExplain writes an architecture overview of the repository, summarizing it
+// first when it is too large for one prompt
+func runExplain(args []string) error {
+	fs := newFlagSet("explain")
+	opts := addCommonFlags(fs)
+	limit := fs.Int("chunk-size", 100000, "Largest context in bytes sent in one request; larger repositories are summarized in parts first")
+	fs.Parse(args)
+
+	settings, err := setup(fs, opts)
+	if err != nil {
+		return err
+	}
+
+	files, err := readRepository(opts.repoPath, settings.Exclude)
+	if err != nil {
+		return fmt.Errorf("error reading repository: %v", err)
+	}
+	if files, err = condenseFiles(files); err != nil {
+		return err
+	}
+	if len(files) == 0 {
+		return fmt.Errorf("no files to explain in %s", opts.repoPath)
+	}
+
+	client := ollama.NewClient(settings.URL, settings.Model, settings.Temperature, settings.TopP)
+	client.System = settings.System
+	context, err := condenseRepository(client, files, *limit)
+	if err != nil {
+		return err
+	}
+	context = packageOverview(opts.repoPath, settings.Exclude) + context
+
+	_, err = runBatch(explainPrompt, context, settings.URL, settings.Model, settings.System, settings.Temperature, settings.TopP, false, opts.repoPath)
+	return err
+}
+
+// packageOverview lists the Go packages with their documentation, or "" when
+// the repository has none
+func packageOverview(repoPath string, exclude []string) string {
+	index := repo.NewIndex(repoPath, exclude)
+	if err := index.Update(); err != nil {
+		return ""
+	}
+	packages := index.Packages()
+	if len(packages) == 0 {
+		return ""
+	}
+
+	var buf strings.Builder
+	buf.WriteString("Go packages:\n")
+	for _, pkg := range packages {
+		doc := strings.TrimSpace(strings.SplitN(pkg.Doc, "\n\n", 2)[0])
+		buf.WriteString(fmt.Sprintf("- %s (%s): %d files, %d symbols", pkg.Name, pkg.Dir, len(pkg.Files), len(pkg.Symbols)))
+		if doc != "" {
+			buf.WriteString(" - " + strings.ReplaceAll(doc, "\n", " "))
+		}
+		buf.WriteString("\n")
+	}
+	return buf.String() + "\n"
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/kek/slop-shop/repo"
+	"github.com/kek/slop-shop/styles"
+)
+
+// explainErrorPrompt asks for a diagnosis of an error and a patch fixing it
+const explainErrorPrompt = "The error output below comes from building, running or testing this repository, and is followed by " +
+	"the source lines it refers to, numbered, with the referenced lines marked with >. Explain what causes the error and which " +
+	"lines are responsible, in a few sentences. Then give the fix as a unified diff against the repository's files, with paths " +
+	"relative to its root, in a ```diff block. If the excerpts are not enough to be sure, say what else you would need to see."
+
+// errorContextLines is how many lines around a referenced line are sent
+const errorContextLines = 15
+
+// maxErrorLocations caps the locations in an error that are sent, so a build
+// failing in hundreds of places still fits in a prompt
+const maxErrorLocations = 20
+
+// maxErrorOutput caps the error output sent, keeping its start, where
+// compilers and test runners report the first failure
+const maxErrorOutput = 20000
+
+// errorLocation is a line of a repository file referenced by an error
+type errorLocation struct {
+	File string // Path relative to the repository
+	Line int
+}
+
+// locationPatterns find file and line references in the output of common
+// compilers, test runners and stack traces: Python's `File "x.py", line 3`,
+// `x.ts(3,5)`, and the `x.go:3:5` form almost everything else uses
+var locationPatterns = []*regexp.Regexp{
+	regexp.MustCompile(`File "([^"]+)", line (\d+)`),
+	regexp.MustCompile(`([\w./\\@+-]*\w\.\w+)\((\d+),\d+\)`),
+	regexp.MustCompile(`([\w./\\@+-]*\w\.\w+):(\d+)`),
+}
+
+// runExplainError reads a compiler or test error from standard input and asks
+// the model what causes it and how to fix it, with the lines it refers to
+func runExplainError(args []string) error {
+	fs := newFlagSet("explain-error")
+	opts := addCommonFlags(fs)
+	fs.Parse(args)
+
+	input, err := readPipedInput()
+	if err != nil {
+		return err
+	}
+	if strings.TrimSpace(input) == "" {
+		return fmt.Errorf("pipe the error to explain into standard input, e.g. go test ./... 2>&1 | slop-shop explain-error")
+	}
+
+	settings, err := setup(fs, opts)
+	if err != nil {
+		return err
+	}
+	files, err := readRepository(opts.repoPath, settings.Exclude)
+	if err != nil {
+		return fmt.Errorf("error reading repository: %v", err)
+	}
+
+	locations := locateErrors(input, opts.repoPath, files)
+	if len(locations) == 0 {
+		fmt.Fprintln(chatter(), styles.WarningStyle.Render("The error does not refer to any file in the repository; sending the error alone"))
+	}
+	context := errorContext(input, locations, files)
+
+	_, err = runBatch(explainErrorPrompt, context, settings.URL, settings.Model, settings.System, settings.Temperature, settings.TopP, settings.Tools, opts.repoPath)
+	return err
+}
+
+// locateErrors returns the repository lines the error output refers to, in
+// the order they first appear. A path is matched against the repository's
+// files as given, relative to the repository when it is absolute, or by its
+// end, since test runners often print only the file's name.
+func locateErrors(output, repoPath string, files []repo.FileInfo) []errorLocation {
+	root, _ := filepath.Abs(repoPath)
+	var locations []errorLocation
+	seen := make(map[errorLocation]bool)
+	for _, line := range strings.Split(output, "\n") {
+		for _, match := range matchLocations(line) {
+			for _, file := range resolveErrorPath(match.File, root, files) {
+				location := errorLocation{File: file, Line: match.Line}
+				if seen[location] {
+					continue
+				}
+				seen[location] = true
+				locations = append(locations, location)
+				if len(locations) == maxErrorLocations {
+					return locations
+				}
+			}
+		}
+	}
+	return locations
+}
+
+// matchLocations returns the file and line references in one line of output.
+// A reference matched by an earlier pattern is not matched again by a later,
+// looser one.
+func matchLocations(line string) []errorLocation {
+	var matches []errorLocation
+	for _, pattern := range locationPatterns {
+		for _, m := range pattern.FindAllStringSubmatchIndex(line, -1) {
+			number, err := strconv.Atoi(line[m[4]:m[5]])
+			if err != nil || number == 0 {
+				continue
+			}
+			matches = append(matches, errorLocation{File: line[m[2]:m[3]], Line: number})
+			line = line[:m[0]] + strings.Repeat(" ", m[1]-m[0]) + line[m[1]:]
+		}
+	}
+	return matches
+}
+
+// resolveErrorPath returns the repository files a path in an error refers to
+func resolveErrorPath(path, root string, files []repo.FileInfo) []string {
+	path = filepath.ToSlash(filepath.Clean(filepath.FromSlash(path)))
+	if filepath.IsAbs(filepath.FromSlash(path)) {
+		rel, err := filepath.Rel(root, filepath.FromSlash(path))
+		if err != nil || strings.HasPrefix(rel, "..") {
+			return nil
+		}
+		path = filepath.ToSlash(rel)
+	}
+	path = strings.TrimPrefix(path, "./")
+
+	var found []string
+	for _, file := range files {
+		name := filepath.ToSlash(file.Path)
+		if name == path {
+			return []string{name}
+		}
+		if strings.HasSuffix(name, "/"+path) {
+			found = append(found, name)
+		}
+	}
+	return found
+}
+
+// errorContext returns the error output followed by the lines around each
+// location, numbered, with the referenced lines marked
+func errorContext(output string, locations []errorLocation, files []repo.FileInfo) string {
+	var context strings.Builder
+	if len(output) > maxErrorOutput {
+		output = output[:maxErrorOutput] + "\n[error output truncated]"
+	}
+	context.WriteString("Error output:\n" + strings.Repeat("-", 50) + "\n" + strings.TrimRight(output, "\n") + "\n\n")
+
+	// Group the locations by file, in the order the files first appear
+	var order []string
+	marked := make(map[string][]int)
+	for _, location := range locations {
+		if _, ok := marked[location.File]; !ok {
+			order = append(order, location.File)
+		}
+		marked[location.File] = append(marked[location.File], location.Line)
+	}
+
+	for _, name := range order {
+		index := slices.IndexFunc(files, func(f repo.FileInfo) bool { return filepath.ToSlash(f.Path) == name })
+		if index < 0 {
+			continue
+		}
+		lines := strings.Split(strings.TrimSuffix(files[index].Content, "\n"), "\n")
+		context.WriteString(fmt.Sprintf("File: %s\n%s\n", name, strings.Repeat("-", 50)))
+		context.WriteString(excerpt(lines, marked[name]))
+		context.WriteString("\n")
+	}
+	return context.String()
+}
+
+// excerpt returns the lines within errorContextLines of the marked ones,
+// numbered from 1, with "..." between ranges that are apart
+func excerpt(lines []string, marked []int) string {
+	show := make([]bool, len(lines))
+	mark := make(map[int]bool)
+	for _, line := range marked {
+		mark[line] = true
+		for i := max(line-errorContextLines, 1); i <= min(line+errorContextLines, len(lines)); i++ {
+			show[i-1] = true
+		}
+	}
+
+	var buf strings.Builder
+	width := len(strconv.Itoa(len(lines)))
+	gap := false
+	for i, line := range lines {
+		if !show[i] {
+			gap = true
+			continue
+		}
+		if gap && buf.Len() > 0 {
+			buf.WriteString("...\n")
+		}
+		gap = false
+		prefix := " "
+		if mark[i+1] {
+			prefix = ">"
+		}
+		buf.WriteString(fmt.Sprintf("%s%*d| %s\n", prefix, width, i+1, line))
+	}
+	return buf.String()
+}
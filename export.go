@@ -0,0 +1,171 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/kek/slop-shop/store"
+)
+
+// shareGPTTurn is one message of a ShareGPT conversation
+type shareGPTTurn struct {
+	From  string `json:"from"` // "system", "human" or "gpt"
+	Value string `json:"value"`
+}
+
+// shareGPTConversation is one line of a ShareGPT JSONL dataset
+type shareGPTConversation struct {
+	ID            string         `json:"id"`
+	Title         string         `json:"title,omitempty"`
+	Conversations []shareGPTTurn `json:"conversations"`
+}
+
+// openAIMessage is one message of an OpenAI chat fine-tuning example
+type openAIMessage struct {
+	Role    string `json:"role"` // "system", "user" or "assistant"
+	Content string `json:"content"`
+}
+
+// openAIConversation is one line of an OpenAI chat JSONL dataset
+type openAIConversation struct {
+	Messages []openAIMessage `json:"messages"`
+}
+
+// runExport writes recorded conversations as a JSONL fine-tuning dataset
+func runExport(db *store.Store, args []string) error {
+	fs := flag.NewFlagSet("slop-shop history export", flag.ExitOnError)
+	format := fs.String("format", "sharegpt", "Dataset format: sharegpt or openai")
+	out := fs.String("out", "", "File to write the dataset to (default: standard output)")
+	model := fs.String("model", "", "Only export conversations with this model")
+	command := fs.String("command", "", "Only export conversations of this command, e.g. ask")
+	successful := fs.Bool("successful", false, "Leave out conversations with a failed tool call")
+	fs.Parse(args)
+
+	if *format != "sharegpt" && *format != "openai" {
+		return fmt.Errorf("unknown export format %q (use sharegpt or openai)", *format)
+	}
+
+	var ids []int64
+	if fs.NArg() > 0 {
+		for _, arg := range fs.Args() {
+			id, err := strconv.ParseInt(arg, 10, 64)
+			if err != nil {
+				return fmt.Errorf("invalid conversation ID %q", arg)
+			}
+			ids = append(ids, id)
+		}
+	} else {
+		conversations, err := db.List(math.MaxInt32)
+		if err != nil {
+			return err
+		}
+		// Oldest first, so a dataset grows at the end as conversations are added
+		for i := len(conversations) - 1; i >= 0; i-- {
+			ids = append(ids, conversations[i].ID)
+		}
+	}
+
+	var conversations []*store.Conversation
+	for _, id := range ids {
+		c, err := db.Get(id)
+		if err != nil {
+			return err
+		}
+		if (*model != "" && c.Model != *model) || (*command != "" && c.Command != *command) || (*successful && hasFailedToolCall(c)) {
+			continue
+		}
+		conversations = append(conversations, c)
+	}
+
+	w := io.Writer(os.Stdout)
+	if *out != "" {
+		file, err := os.Create(*out)
+		if err != nil {
+			return fmt.Errorf("error creating %s: %v", *out, err)
+		}
+		defer file.Close()
+		w = file
+	}
+	count, err := writeDataset(w, conversations, *format)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "Exported %d conversations\n", count)
+	return nil
+}
+
+// hasFailedToolCall reports whether a tool call of the conversation failed
+func hasFailedToolCall(c *store.Conversation) bool {
+	for _, call := range c.ToolCalls {
+		if !call.Success {
+			return true
+		}
+	}
+	return false
+}
+
+// writeDataset writes one JSON line per conversation and returns how many it
+// wrote. Conversations without a response are left out.
+func writeDataset(w io.Writer, conversations []*store.Conversation, format string) (int, error) {
+	encoder := json.NewEncoder(w)
+	count := 0
+	for _, c := range conversations {
+		var line any
+		if format == "openai" {
+			line = openAIExample(c)
+		} else {
+			line = shareGPTExample(c)
+		}
+		if line == nil {
+			continue
+		}
+		if err := encoder.Encode(line); err != nil {
+			return count, fmt.Errorf("error writing dataset: %v", err)
+		}
+		count++
+	}
+	return count, nil
+}
+
+// shareGPTExample converts a conversation to ShareGPT, or nil when it has no response
+func shareGPTExample(c *store.Conversation) any {
+	example := shareGPTConversation{ID: fmt.Sprintf("slop-shop-%d", c.ID), Title: c.Title}
+	answered := false
+	for _, m := range c.Messages {
+		from := "human"
+		switch m.Role {
+		case "assistant":
+			from = "gpt"
+			answered = answered || strings.TrimSpace(m.Content) != ""
+		case "system":
+			from = "system"
+		}
+		example.Conversations = append(example.Conversations, shareGPTTurn{From: from, Value: m.Content})
+	}
+	if !answered {
+		return nil
+	}
+	return example
+}
+
+// openAIExample converts a conversation to the OpenAI chat format, or nil when it has no response
+func openAIExample(c *store.Conversation) any {
+	var example openAIConversation
+	answered := false
+	for _, m := range c.Messages {
+		if m.Role == "assistant" {
+			answered = answered || strings.TrimSpace(m.Content) != ""
+		}
+		example.Messages = append(example.Messages, openAIMessage{Role: m.Role, Content: m.Content})
+	}
+	if !answered {
+		return nil
+	}
+	return example
+}
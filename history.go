@@ -0,0 +1,197 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/kek/slop-shop/config"
+	"github.com/kek/slop-shop/store"
+	"github.com/kek/slop-shop/styles"
+)
+
+// recordHistory adds a run to the history database: the prompt, the response,
+// the tool calls and the diffs that were applied. Runs of a named session are
+// added to the same conversation.
+func recordHistory(record batchRecord, session, repoPath string) error {
+	if historyPath == "" {
+		return nil
+	}
+	db, err := store.Open(historyPath)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	id, err := db.StartConversation(session, commandName, record.Model, repoPath)
+	if err != nil {
+		return err
+	}
+	if record.Title != "" {
+		if err := db.SetTitle(id, record.Title); err != nil {
+			return err
+		}
+	}
+	if err := db.AddMessage(id, "user", record.Prompt); err != nil {
+		return err
+	}
+	if err := db.AddMessage(id, "assistant", record.Response); err != nil {
+		return err
+	}
+
+	for i, result := range record.ToolResults {
+		call := store.ToolCall{Tool: result.Tool, Args: result.Args, Output: result.Output, Success: result.Success}
+		if err := db.AddToolCall(id, call); err != nil {
+			return err
+		}
+		// Results are in the order of the calls, which hold the diff text
+		if result.Tool == "APPLY_DIFF" && result.Success && i < len(record.ToolCalls) && record.ToolCalls[i].Name == "APPLY_DIFF" {
+			if err := db.AddPatch(id, store.Patch{Diff: record.ToolCalls[i].Body, Files: result.FilesChanged}); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// runHistory lists, shows, deletes and searches recorded conversations
+func runHistory(args []string) error {
+	fs := newFlagSet("history")
+	limit := fs.Int("n", 20, "Number of conversations or search results to show")
+	fs.Parse(args)
+
+	path := config.HistoryPath()
+	if path == "" {
+		return fmt.Errorf("cannot locate the history database")
+	}
+	db, err := store.Open(path)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	action, rest := "list", []string(nil)
+	if fs.NArg() > 0 {
+		action, rest = fs.Arg(0), fs.Args()[1:]
+	}
+
+	switch action {
+	case "list":
+		conversations, err := db.List(*limit)
+		if err != nil {
+			return err
+		}
+		if len(conversations) == 0 {
+			fmt.Printf("No conversations recorded in %s\n", path)
+			return nil
+		}
+		tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(tw, "ID\tUPDATED\tCOMMAND\tMODEL\tSESSION\tTITLE\tREPOSITORY")
+		for _, c := range conversations {
+			fmt.Fprintf(tw, "%d\t%s\t%s\t%s\t%s\t%s\t%s\n", c.ID, c.Updated.Local().Format("2006-01-02 15:04"), c.Command, c.Model, c.Name, c.Title, c.Repo)
+		}
+		return tw.Flush()
+
+	case "show":
+		id, err := conversationID(rest)
+		if err != nil {
+			return err
+		}
+		c, err := db.Get(id)
+		if err != nil {
+			return err
+		}
+		printConversation(c)
+		return nil
+
+	case "delete":
+		id, err := conversationID(rest)
+		if err != nil {
+			return err
+		}
+		if err := db.Delete(id); err != nil {
+			return err
+		}
+		fmt.Printf("Deleted conversation %d\n", id)
+		return nil
+
+	case "search":
+		query := strings.Join(rest, " ")
+		hits, err := db.Search(query, *limit)
+		if err != nil {
+			return err
+		}
+		if len(hits) == 0 {
+			fmt.Printf("No messages match %q\n", query)
+			return nil
+		}
+		for _, hit := range hits {
+			label := fmt.Sprintf("#%d", hit.ConversationID)
+			if hit.Name != "" {
+				label += " (" + hit.Name + ")"
+			}
+			fmt.Println(styles.HeaderStyle.Render(fmt.Sprintf("%s %s %s", label, hit.Created.Local().Format("2006-01-02 15:04"), hit.Role)))
+			fmt.Println(strings.Join(strings.Fields(hit.Snippet), " "))
+			fmt.Println()
+		}
+		return nil
+
+	case "export":
+		return runExport(db, rest)
+
+	case "import":
+		return runImport(db, rest)
+
+	case "replay":
+		return runReplay(db, rest)
+	}
+	return fmt.Errorf("unknown history action %q (use list, show ID, delete ID, search QUERY, export, import FILE or replay)", action)
+}
+
+// conversationID parses the conversation ID argument of show and delete
+func conversationID(args []string) (int64, error) {
+	if len(args) != 1 {
+		return 0, fmt.Errorf("expected one conversation ID")
+	}
+	id, err := strconv.ParseInt(args[0], 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid conversation ID %q", args[0])
+	}
+	return id, nil
+}
+
+// printConversation prints the messages, tool calls and patches of a conversation
+func printConversation(c *store.Conversation) {
+	title := fmt.Sprintf("Conversation %d: %s with %s", c.ID, c.Command, c.Model)
+	if c.Name != "" {
+		title += ", session " + c.Name
+	}
+	fmt.Println(styles.TitleStyle.Render(title))
+	if c.Title != "" {
+		fmt.Println(styles.HeaderStyle.Render(c.Title))
+	}
+	fmt.Println(styles.MutedStyle.Render(fmt.Sprintf("%s, %s", c.Repo, c.Created.Local().Format("2006-01-02 15:04"))))
+	fmt.Println()
+
+	for _, m := range c.Messages {
+		if m.Role == "user" {
+			fmt.Println(styles.UserStyle.Render("User: " + m.Content))
+		} else {
+			fmt.Println(m.Content)
+		}
+		fmt.Println()
+	}
+	for _, t := range c.ToolCalls {
+		status := "✅"
+		if !t.Success {
+			status = "❌"
+		}
+		fmt.Println(styles.InfoStyle.Render(fmt.Sprintf("%s %s %s", status, t.Tool, t.Args)))
+	}
+	for _, p := range c.Patches {
+		fmt.Println(styles.HeaderStyle.Render("Applied patch: " + strings.Join(p.Files, ", ")))
+		fmt.Println(p.Diff)
+	}
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/kek/slop-shop/config"
+	"github.com/kek/slop-shop/styles"
+)
+
+// hookMarker identifies the git hooks written by "hooks install"
+const hookMarker = "# Installed by slop-shop hooks install"
+
+// hookNames lists the git hooks slop-shop can install
+var hookNames = []string{"prepare-commit-msg", "pre-push"}
+
+// hookBackupSuffix is added to a hook that -force replaces, so uninstall can restore it
+const hookBackupSuffix = ".slop-shop-backup"
+
+// runHooks installs, removes or reports the slop-shop git hooks of a repository
+func runHooks(args []string) error {
+	fs := newFlagSet("hooks")
+	repoPath := fs.String("repo", ".", "Path to the repository")
+	force := fs.Bool("force", false, "Replace existing hooks that were not installed by slop-shop; they are restored by uninstall")
+	failOn := fs.String("fail-on", "error", "Block a push when the review finds a problem of this severity or worse: error, warning, info or none")
+	only := fs.String("only", "", "Comma-separated hooks to install or remove (default: "+strings.Join(hookNames, ",")+")")
+	fs.Parse(args)
+
+	if _, ok := reviewSeverities[*failOn]; !ok && *failOn != "none" {
+		return fmt.Errorf("unknown severity %q for -fail-on (use error, warning, info or none)", *failOn)
+	}
+	names := hookNames
+	if *only != "" {
+		names = config.SplitList(*only)
+		for _, name := range names {
+			if hookScript(name, "", "") == "" {
+				return fmt.Errorf("unknown hook %q (use %s)", name, strings.Join(hookNames, " or "))
+			}
+		}
+	}
+
+	dir, err := hooksDir(*repoPath)
+	if err != nil {
+		return err
+	}
+
+	action := "status"
+	if fs.NArg() > 0 {
+		action = fs.Arg(0)
+	}
+	switch action {
+	case "install":
+		binary, err := os.Executable()
+		if err != nil {
+			binary = "slop-shop"
+		}
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return fmt.Errorf("error creating %s: %v", dir, err)
+		}
+		for _, name := range names {
+			if err := installHook(filepath.Join(dir, name), hookScript(name, binary, *failOn), *force); err != nil {
+				return err
+			}
+			fmt.Println(styles.SuccessStyle.Render(fmt.Sprintf("✅ Installed %s", name)))
+		}
+		return nil
+
+	case "uninstall":
+		for _, name := range names {
+			restored, err := uninstallHook(filepath.Join(dir, name))
+			if err != nil {
+				return err
+			}
+			if restored {
+				fmt.Println(styles.SuccessStyle.Render(fmt.Sprintf("✅ Removed %s and restored the previous hook", name)))
+			} else {
+				fmt.Println(styles.SuccessStyle.Render(fmt.Sprintf("✅ Removed %s", name)))
+			}
+		}
+		return nil
+
+	case "status":
+		for _, name := range names {
+			fmt.Printf("%-20s %s\n", name, hookStatus(filepath.Join(dir, name)))
+		}
+		return nil
+
+	default:
+		return fmt.Errorf("unknown hooks action %q (use install, uninstall or status)", action)
+	}
+}
+
+// hooksDir returns the hooks directory of a repository, honoring core.hooksPath
+func hooksDir(repoPath string) (string, error) {
+	output, err := gitOutput(repoPath, "rev-parse", "--git-path", "hooks")
+	if err != nil {
+		return "", err
+	}
+	dir := strings.TrimSpace(output)
+	if !filepath.IsAbs(dir) {
+		dir = filepath.Join(repoPath, dir)
+	}
+	return dir, nil
+}
+
+// hookScript returns the script of a hook that runs the slop-shop binary, or ""
+// for an unknown hook. failOn sets the review severity that blocks a push.
+func hookScript(name, binary, failOn string) string {
+	bin := "'" + strings.ReplaceAll(binary, "'", `'\''`) + "'"
+	switch name {
+	case "prepare-commit-msg":
+		return `#!/bin/sh
+` + hookMarker + `
+# Writes a commit message for the staged changes when none was given with -m,
+# a template, a merge or an amend. Failures never stop the commit.
+[ -z "$2" ] || exit 0
+message=$(mktemp) || exit 0
+if ` + bin + ` commit -quiet -no-color -no-history -out "$message" </dev/null >/dev/null; then
+	cat "$1" >>"$message" && cp "$message" "$1"
+fi
+rm -f "$message"
+exit 0
+`
+	case "pre-push":
+		return fmt.Sprintf(`#!/bin/sh
+`+hookMarker+`
+# Reviews the commits being pushed, not the working tree, and blocks the push
+# when the review finds a problem of severity %[1]s or worse.
+# "git push --no-verify" skips the review.
+zero=$(git hash-object --stdin </dev/null | tr '0-9a-f' '0')
+while read -r local_ref local_sha remote_ref remote_sha; do
+	[ "$local_sha" = "$zero" ] && continue
+	base=$remote_sha
+	if [ "$base" = "$zero" ]; then
+		base=$(git rev-parse -q --verify origin/HEAD) || continue
+	fi
+	%[2]s review -no-color -no-history -base "$base" -head "$local_sha" -fail-on %[1]s </dev/null
+	status=$?
+	if [ $status -eq %[3]d ]; then
+		echo "slop-shop: push blocked by the review findings above" >&2
+		exit 1
+	elif [ $status -ne 0 ]; then
+		echo "slop-shop: the review failed with exit code $status; pushing anyway" >&2
+	fi
+done
+exit 0
+`, failOn, bin, exitFindings)
+	}
+	return ""
+}
+
+// installHook writes a hook script. A hook slop-shop did not install is kept
+// unless force is set, in which case it is moved aside for uninstall to restore.
+func installHook(path, script string, force bool) error {
+	existing, err := os.ReadFile(path)
+	if err == nil && !bytes.Contains(existing, []byte(hookMarker)) {
+		if !force {
+			return fmt.Errorf("%s already exists and was not installed by slop-shop (use -force to replace it)", path)
+		}
+		if err := os.Rename(path, path+hookBackupSuffix); err != nil {
+			return fmt.Errorf("error backing up %s: %v", path, err)
+		}
+	}
+	if err := os.WriteFile(path, []byte(script), 0755); err != nil {
+		return fmt.Errorf("error writing %s: %v", path, err)
+	}
+	return nil
+}
+
+// uninstallHook removes a hook installed by slop-shop and restores the hook it
+// replaced, if any. It reports whether a hook was restored.
+func uninstallHook(path string) (bool, error) {
+	existing, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if !bytes.Contains(existing, []byte(hookMarker)) {
+		return false, fmt.Errorf("%s was not installed by slop-shop; leaving it", path)
+	}
+	if err := os.Remove(path); err != nil {
+		return false, err
+	}
+
+	if _, err := os.Stat(path + hookBackupSuffix); err != nil {
+		return false, nil
+	}
+	if err := os.Rename(path+hookBackupSuffix, path); err != nil {
+		return false, fmt.Errorf("error restoring %s: %v", path, err)
+	}
+	return true, nil
+}
+
+// hookStatus describes whether a hook is installed
+func hookStatus(path string) string {
+	existing, err := os.ReadFile(path)
+	switch {
+	case err != nil:
+		return "not installed"
+	case bytes.Contains(existing, []byte(hookMarker)):
+		return "installed"
+	default:
+		return "another hook is installed"
+	}
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/kek/slop-shop/repo"
+)
+
+// excerptContext is the number of lines quoted before and after the line of a
+// finding in the HTML report
+const excerptContext = 3
+
+// syntax is what the HTML report highlights in the excerpts of a language.
+// Lines are highlighted one at a time, so comments and strings that span lines
+// are only recognized on their first line.
+type syntax struct {
+	comment  string // Starts a comment that runs to the end of the line
+	quotes   string // Characters that open and close a string
+	keywords map[string]bool
+}
+
+// words turns a space-separated list into a set
+func words(list string) map[string]bool {
+	set := map[string]bool{}
+	for _, word := range strings.Fields(list) {
+		set[word] = true
+	}
+	return set
+}
+
+var (
+	scriptKeywords = "async await break case catch class const continue default delete do else export extends false finally for function if import in instanceof let new null return static super switch this throw true try typeof undefined var void while yield"
+
+	// syntaxes are keyed by the languages of repo.SourceLanguage and a few more
+	syntaxes = map[string]syntax{
+		"go":         {"//", "\"'`", words("break case chan const continue default defer else fallthrough false for func go goto if import interface map nil package range return select struct switch true type var")},
+		"python":     {"#", "\"'", words("False None True and as assert async await break class continue def del elif else except finally for from global if import in is lambda nonlocal not or pass raise return try while with yield")},
+		"javascript": {"//", "\"'`", words(scriptKeywords)},
+		"typescript": {"//", "\"'`", words(scriptKeywords + " abstract any as boolean declare enum implements interface keyof namespace number private protected public readonly string type")},
+		"rust":       {"//", "\"", words("as async await break const continue crate dyn else enum extern false fn for if impl in let loop match mod move mut pub ref return self Self static struct super trait true type unsafe use where while")},
+		"java":       {"//", "\"'", words("abstract boolean break byte case catch char class const continue default do double else enum extends final finally float for if implements import instanceof int interface long new null package private protected public return short static super switch this throw throws true false try void volatile while")},
+		"shell":      {"#", "\"'", words("case do done elif else esac export fi for function if in local return then until while")},
+		"config":     {"#", "\"'", words("true false null")},
+	}
+
+	// syntaxExtensions maps the extensions of files other than source files
+	syntaxExtensions = map[string]string{
+		".sh": "shell", ".bash": "shell", ".zsh": "shell",
+		".toml": "config", ".yaml": "config", ".yml": "config",
+	}
+)
+
+// syntaxFor returns how to highlight a file, and false for files in a
+// language the report does not know
+func syntaxFor(file string) (syntax, bool) {
+	language := repo.SourceLanguage(file)
+	if language == "" {
+		language = syntaxExtensions[path.Ext(file)]
+	}
+	s, ok := syntaxes[language]
+	return s, ok
+}
+
+// highlightLine escapes a line of code and marks its comments, strings,
+// numbers and keywords with the classes the report's style sheet colors
+func highlightLine(line string, s syntax) template.HTML {
+	var out strings.Builder
+	span := func(class, text string) {
+		fmt.Fprintf(&out, `<span class="%s">%s</span>`, class, template.HTMLEscapeString(text))
+	}
+	runes := []rune(line)
+	for i := 0; i < len(runes); {
+		r := runes[i]
+		switch {
+		case s.comment != "" && strings.HasPrefix(string(runes[i:]), s.comment):
+			span("comment", string(runes[i:]))
+			return template.HTML(out.String())
+		case strings.ContainsRune(s.quotes, r):
+			end := i + 1
+			for end < len(runes) && runes[end] != r {
+				if runes[end] == '\\' && r != '`' {
+					end++
+				}
+				end++
+			}
+			end = min(end+1, len(runes))
+			span("string", string(runes[i:end]))
+			i = end
+		case unicode.IsDigit(r):
+			end := i
+			for end < len(runes) && (unicode.IsLetter(runes[end]) || unicode.IsDigit(runes[end]) || runes[end] == '.' || runes[end] == '_') {
+				end++
+			}
+			span("number", string(runes[i:end]))
+			i = end
+		case unicode.IsLetter(r) || r == '_':
+			end := i
+			for end < len(runes) && (unicode.IsLetter(runes[end]) || unicode.IsDigit(runes[end]) || runes[end] == '_') {
+				end++
+			}
+			if word := string(runes[i:end]); s.keywords[word] {
+				span("keyword", word)
+			} else {
+				out.WriteString(template.HTMLEscapeString(word))
+			}
+			i = end
+		default:
+			out.WriteString(template.HTMLEscapeString(string(r)))
+			i++
+		}
+	}
+	return template.HTML(out.String())
+}
+
+// excerptLine is a line of code quoted in the HTML report
+type excerptLine struct {
+	Number int
+	Code   template.HTML
+	Marked bool // The line the finding is about
+}
+
+// codeExcerpt quotes the lines around line from a file, or returns nil when the
+// file cannot be read, is binary or is shorter than that
+func codeExcerpt(lines []string, file string, line int) []excerptLine {
+	if line < 1 || line > len(lines) {
+		return nil
+	}
+	s, known := syntaxFor(file)
+	var quoted []excerptLine
+	for n := max(line-excerptContext, 1); n <= min(line+excerptContext, len(lines)); n++ {
+		code := template.HTML(template.HTMLEscapeString(lines[n-1]))
+		if known {
+			code = highlightLine(lines[n-1], s)
+		}
+		quoted = append(quoted, excerptLine{Number: n, Code: code, Marked: n == line})
+	}
+	return quoted
+}
+
+// htmlFinding is a finding as the HTML report shows it
+type htmlFinding struct {
+	reviewFinding
+	Location string
+	Excerpt  []excerptLine
+}
+
+// htmlFile is a file and the findings about it
+type htmlFile struct {
+	Path     string
+	Findings []htmlFinding
+}
+
+// htmlReport is the data the report template is executed with
+type htmlReport struct {
+	Title     string
+	Generated string
+	Counts    map[string]int
+	Total     int
+	Files     []htmlFile
+}
+
+// writeHTML writes the findings as a standalone HTML page, grouped by file,
+// quoting the lines they are about from the files in repoPath
+func writeHTML(w io.Writer, findings []reviewFinding, repoPath string) error {
+	report := htmlReport{
+		Title:     "slop-shop " + commandName,
+		Generated: time.Now().Format("2006-01-02 15:04"),
+		Counts:    map[string]int{},
+		Total:     len(findings),
+	}
+	contents := map[string][]string{}
+	for _, finding := range findings {
+		report.Counts[finding.Severity]++
+		if len(report.Files) == 0 || report.Files[len(report.Files)-1].Path != finding.File {
+			report.Files = append(report.Files, htmlFile{Path: finding.File})
+		}
+		lines, read := contents[finding.File]
+		if !read && finding.File != "" {
+			if data, err := os.ReadFile(filepath.Join(repoPath, filepath.FromSlash(finding.File))); err == nil && !bytes.ContainsRune(data, 0) {
+				lines = strings.Split(strings.TrimSuffix(strings.ReplaceAll(string(data), "\r\n", "\n"), "\n"), "\n")
+			}
+			contents[finding.File] = lines
+		}
+		file := &report.Files[len(report.Files)-1]
+		file.Findings = append(file.Findings, htmlFinding{
+			reviewFinding: finding,
+			Location:      finding.location(),
+			Excerpt:       codeExcerpt(lines, finding.File, finding.Line),
+		})
+	}
+	return htmlTemplate.Execute(w, report)
+}
+
+var htmlTemplate = template.Must(template.New("report").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>{{.Title}}</title>
+<style>
+body { font-family: -apple-system, "Segoe UI", Helvetica, Arial, sans-serif; margin: 2em auto; max-width: 60em; padding: 0 1em; color: #1f2328; }
+h1 { font-size: 1.6em; margin-bottom: 0.2em; }
+h2 { font-size: 1.1em; font-family: ui-monospace, Menlo, Consolas, monospace; border-bottom: 1px solid #d0d7de; padding-bottom: 0.3em; margin-top: 2em; }
+.summary { color: #59636e; }
+.finding { margin: 1em 0; }
+.finding p { margin: 0.3em 0; white-space: pre-wrap; }
+.badge { display: inline-block; padding: 0.1em 0.5em; border-radius: 1em; font-size: 0.8em; font-weight: 600; color: #fff; }
+.error { background: #cf222e; } .warning { background: #9a6700; } .info { background: #0969da; }
+.location { font-family: ui-monospace, Menlo, Consolas, monospace; font-size: 0.9em; color: #59636e; }
+.source { font-size: 0.85em; color: #59636e; }
+pre { background: #f6f8fa; border: 1px solid #d0d7de; border-radius: 6px; padding: 0.5em 0; overflow-x: auto; font-size: 0.85em; line-height: 1.45; }
+pre div { padding: 0 1em; } pre div.marked { background: #fff8c5; }
+pre .number-col { display: inline-block; min-width: 3em; color: #8c959f; user-select: none; }
+.comment { color: #6e7781; font-style: italic; } .string { color: #0a3069; } .number { color: #0550ae; } .keyword { color: #cf222e; }
+</style>
+</head>
+<body>
+<h1>{{.Title}}</h1>
+<p class="summary">{{if .Total}}{{.Total}} finding{{if ne .Total 1}}s{{end}}{{range $severity, $count := .Counts}} · {{$count}} {{$severity}}{{end}}{{else}}No findings{{end}} · {{.Generated}}</p>
+{{range .Files}}
+<h2>{{if .Path}}{{.Path}}{{else}}(no file){{end}}</h2>
+{{range .Findings}}
+<div class="finding">
+<span class="badge {{.Severity}}">{{.Severity}}</span> <span class="location">{{.Location}}</span>{{if .Source}} <span class="source">{{.Source}}</span>{{end}}
+<p>{{.Comment}}</p>
+{{if .Excerpt}}<pre>{{range .Excerpt}}<div{{if .Marked}} class="marked"{{end}}><span class="number-col">{{.Number}}</span>{{.Code}}</div>{{end}}</pre>{{end}}
+</div>
+{{end}}
+{{end}}
+</body>
+</html>
+`))
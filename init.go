@@ -0,0 +1,249 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/kek/slop-shop/config"
+	"github.com/kek/slop-shop/ollama"
+	"github.com/kek/slop-shop/repo"
+	"github.com/kek/slop-shop/styles"
+)
+
+// largeFileSize is the size above which init suggests ignoring a single file
+const largeFileSize = 100 * 1024
+
+// languageExtensions maps file extensions to the language init reports
+var languageExtensions = map[string]string{
+	".go": "Go", ".py": "Python", ".js": "JavaScript", ".jsx": "JavaScript", ".mjs": "JavaScript",
+	".ts": "TypeScript", ".tsx": "TypeScript", ".rs": "Rust", ".java": "Java", ".kt": "Kotlin",
+	".rb": "Ruby", ".php": "PHP", ".c": "C", ".h": "C", ".cc": "C++", ".cpp": "C++", ".hpp": "C++",
+	".cs": "C#", ".swift": "Swift", ".scala": "Scala", ".ex": "Elixir", ".exs": "Elixir",
+	".hs": "Haskell", ".lua": "Lua", ".sh": "Shell",
+}
+
+// ignoreCandidates are build output, dependency and tool directories worth
+// leaving out of the context when they exist
+var ignoreCandidates = []string{
+	"dist/", "build/", "target/", "out/", "bin/", "coverage/", ".next/", ".nuxt/",
+	"__pycache__", ".venv/", "venv/", ".tox/", ".mypy_cache/", ".pytest_cache/",
+	".gradle/", ".idea/", ".vscode/", "package-lock.json", "yarn.lock", "pnpm-lock.yaml",
+	"Cargo.lock", "poetry.lock", "go.sum",
+}
+
+// repoSurvey is what init learns about a repository
+type repoSurvey struct {
+	files     int
+	bytes     int64
+	languages []string // Most common first
+	ignore    []string // Suggested patterns for .slopshopignore
+}
+
+// runInit inspects the repository, writes a starter .slopshop.toml and
+// .slopshopignore and checks that Ollama can be reached
+func runInit(args []string) error {
+	fs := newFlagSet("init")
+	opts := addCommonFlags(fs)
+	force := fs.Bool("force", false, "Overwrite existing configuration files")
+	fs.Parse(args)
+
+	settings, err := setup(fs, opts)
+	if err != nil {
+		return err
+	}
+
+	survey, err := surveyRepository(opts.repoPath, settings.Exclude)
+	if err != nil {
+		return err
+	}
+	languages := "no known languages"
+	if len(survey.languages) > 0 {
+		languages = strings.Join(survey.languages, ", ")
+	}
+	fmt.Println(styles.InfoStyle.Render(fmt.Sprintf("📂 %s: %d files, %s, %s", opts.repoPath, survey.files, formatSize(survey.bytes), languages)))
+
+	files := []struct {
+		path     string
+		contents string
+	}{
+		{config.RepoConfigPath(opts.repoPath), starterConfig(settings, survey)},
+		{config.IgnorePath(opts.repoPath), starterIgnore(survey)},
+	}
+	for _, file := range files {
+		if _, err := os.Stat(file.path); err == nil && !*force {
+			fmt.Println(styles.WarningStyle.Render(fmt.Sprintf("⚠️  %s exists; keeping it (use -force to overwrite)", file.path)))
+			continue
+		}
+		if err := os.WriteFile(file.path, []byte(file.contents), 0644); err != nil {
+			return fmt.Errorf("error writing %s: %v", file.path, err)
+		}
+		fmt.Println(styles.SuccessStyle.Render(fmt.Sprintf("✅ Wrote %s", file.path)))
+	}
+
+	client := ollama.NewClient(settings.URL, settings.Model, settings.Temperature, settings.TopP)
+	failed := false
+	for _, result := range checkOllama(client) {
+		if result.ok {
+			fmt.Println(styles.SuccessStyle.Render(fmt.Sprintf("✅ %s: %s", result.name, result.detail)))
+			continue
+		}
+		failed = true
+		fmt.Println(styles.ErrorStyle.Render(fmt.Sprintf("❌ %s: %s", result.name, result.detail)))
+		fmt.Println(styles.MutedStyle.Render("   fix: " + result.fix))
+	}
+	if failed {
+		return &exitError{code: exitConnection, err: fmt.Errorf("the configuration was written, but Ollama is not ready")}
+	}
+	return nil
+}
+
+// surveyRepository counts the files and languages of a repository and
+// suggests ignore patterns for build output, lock files, large files and the
+// entries of .gitignore
+func surveyRepository(repoPath string, exclude []string) (*repoSurvey, error) {
+	survey := &repoSurvey{}
+	counts := map[string]int{}
+	suggested := map[string]bool{}
+	suggest := func(pattern string) {
+		if !suggested[pattern] && !repo.ShouldExclude(pattern, exclude) {
+			suggested[pattern] = true
+			survey.ignore = append(survey.ignore, pattern)
+		}
+	}
+
+	for _, pattern := range gitignorePatterns(repoPath) {
+		suggest(pattern)
+	}
+
+	err := filepath.WalkDir(repoPath, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		relPath, err := filepath.Rel(repoPath, path)
+		if err != nil || relPath == "." {
+			return err
+		}
+		if repo.ShouldExclude(relPath, exclude) {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		for _, candidate := range ignoreCandidates {
+			if strings.TrimSuffix(candidate, "/") != d.Name() {
+				continue
+			}
+			if d.IsDir() {
+				suggest(filepath.ToSlash(relPath) + "/")
+				return filepath.SkipDir
+			}
+			suggest(filepath.ToSlash(relPath))
+			return nil
+		}
+		if d.IsDir() {
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		survey.files++
+		survey.bytes += info.Size()
+		if language, ok := languageExtensions[strings.ToLower(filepath.Ext(d.Name()))]; ok {
+			counts[language]++
+		}
+		if info.Size() > largeFileSize {
+			suggest(filepath.ToSlash(relPath))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error scanning %s: %v", repoPath, err)
+	}
+
+	for language := range counts {
+		survey.languages = append(survey.languages, language)
+	}
+	sort.Slice(survey.languages, func(i, j int) bool {
+		a, b := survey.languages[i], survey.languages[j]
+		return counts[a] > counts[b] || counts[a] == counts[b] && a < b
+	})
+	return survey, nil
+}
+
+// gitignorePatterns converts the simple entries of the repository's .gitignore
+// to exclude patterns. Negations and globs that exclude patterns cannot
+// express are skipped.
+func gitignorePatterns(repoPath string) []string {
+	file, err := os.Open(filepath.Join(repoPath, ".gitignore"))
+	if err != nil {
+		return nil
+	}
+	defer file.Close()
+
+	var patterns []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, "!") {
+			continue
+		}
+		line = strings.TrimPrefix(line, "/")
+		if strings.HasPrefix(line, "*.") && !strings.ContainsAny(line[2:], "*?[") {
+			// A path fragment such as ".log" matches the files with that extension
+			line = line[1:]
+		}
+		if line == "" || strings.ContainsAny(strings.TrimSuffix(line, "*"), "*?[") {
+			continue
+		}
+		patterns = append(patterns, line)
+	}
+	return patterns
+}
+
+// starterConfig renders the .slopshop.toml written by init
+func starterConfig(settings *config.Settings, survey *repoSurvey) string {
+	var buf strings.Builder
+	buf.WriteString("# Slop Shop settings for this repository, written by \"slop-shop init\".\n")
+	buf.WriteString("# They override the user configuration; flags and SLOP_SHOP_* variables override both.\n\n")
+	fmt.Fprintf(&buf, "model = %q\n", settings.Model)
+	fmt.Fprintf(&buf, "url = %q\n", settings.URL)
+
+	description := "this repository"
+	if len(survey.languages) > 0 {
+		description = "this " + survey.languages[0] + " repository"
+	}
+	fmt.Fprintf(&buf, "\n# Sent with every request\nsystem = %q\n", "You are an expert on "+description+". Answer concisely and name the files you refer to.")
+
+	buf.WriteString("\n[tool_policy]\n# Let the model read files and run commands\nenabled = false\n# deny = [\"RUN_COMMAND\", \"SHELL\"]\n")
+	return buf.String()
+}
+
+// starterIgnore renders the .slopshopignore written by init
+func starterIgnore(survey *repoSurvey) string {
+	var buf strings.Builder
+	buf.WriteString("# Paths left out of the context sent to the model, in addition to the exclude\n")
+	buf.WriteString("# setting. One pattern per line: a path fragment, or a prefix ending in *.\n")
+	for _, pattern := range survey.ignore {
+		buf.WriteString(pattern + "\n")
+	}
+	return buf.String()
+}
+
+// formatSize renders a byte count for people
+func formatSize(bytes int64) string {
+	switch {
+	case bytes >= 1<<20:
+		return fmt.Sprintf("%.1f MB", float64(bytes)/(1<<20))
+	case bytes >= 1<<10:
+		return fmt.Sprintf("%.1f KB", float64(bytes)/(1<<10))
+	}
+	return fmt.Sprintf("%d bytes", bytes)
+}
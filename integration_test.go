@@ -230,12 +230,13 @@ LIST_DIR: .
 
 Let me execute these tools.`
 
-		result := tools.ExecuteTools(mockResponse, tempDir)
-		
+		results := tools.ExecuteTools(mockResponse, tempDir, nil)
+
 		// Verify that the tool execution system processes the response
-		if result == "" {
-			t.Error("Expected non-empty result from ExecuteTools")
+		if len(results) != 3 {
+			t.Errorf("Expected 3 results from ExecuteTools, got %d", len(results))
 		}
+		result := tools.FormatResults(results)
 
 		// Check that the result contains expected tool execution output
 		if !strings.Contains(result, "Tool Execution Results") {
@@ -256,8 +257,8 @@ Let me execute these tools.`
 
 READ_FILE: test.txt`
 
-		result := tools.ExecuteTools(mockResponse, tempDir)
-		
+		result := tools.FormatResults(tools.ExecuteTools(mockResponse, tempDir, nil))
+
 		// Verify that file reading was attempted
 		if !strings.Contains(result, "Tool Execution Results") {
 			t.Error("Expected tool execution results")
@@ -361,7 +362,7 @@ func TestEndToEndIntegration(t *testing.T) {
 		os.Stdout = w
 
 		// Run batch mode
-		runBatch("Test prompt", "", server.URL, "test-model", 0.7, 0.9, false, tempDir)
+		runBatch("Test prompt", "", server.URL, "test-model", "", 0.7, 0.9, false, tempDir)
 
 		// Restore stdout and read output
 		w.Close()
@@ -385,7 +386,7 @@ func TestEndToEndIntegration(t *testing.T) {
 		os.Stdout = w
 
 		// Run batch mode with repository context
-		runBatch("Test prompt", "test context", server.URL, "test-model", 0.7, 0.9, false, tempDir)
+		runBatch("Test prompt", "test context", server.URL, "test-model", "", 0.7, 0.9, false, tempDir)
 
 		// Restore stdout and read output
 		w.Close()
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/kek/slop-shop/config"
+)
+
+// maxIssueDiff is the most characters of a pull request's diff put in the context
+const maxIssueDiff = 50000
+
+// maxPromptIssues is the most references -issues follows in one prompt
+const maxPromptIssues = 5
+
+var (
+	// issueURL matches the web address of an issue or pull request on GitHub or Gitea
+	issueURL = regexp.MustCompile(`(https?://[^/\s]+)/([^/\s]+)/([^/\s]+)/(issues|pull|pulls)/(\d+)`)
+
+	// issueNumber matches a reference such as "#42" or "owner/repo#42"
+	issueNumber = regexp.MustCompile(`^(?:([\w.-]+)/([\w.-]+)#|#?)(\d+)$`)
+
+	// promptIssue matches the "#42" references in a prompt
+	promptIssue = regexp.MustCompile(`(?:^|[\s(])#(\d+)\b`)
+
+	// remoteURL matches the host and repository of an https or ssh git remote
+	remoteURL = regexp.MustCompile(`^(https?://|ssh://)?(?:[^@/]+@)?([^/:]+)(:\d+)?[:/]([^/]+)/([^/]+?)(?:\.git)?/?$`)
+
+	// issueClient fetches issues and pull requests from the forge
+	issueClient = &http.Client{Timeout: 30 * time.Second}
+)
+
+// issueRef identifies an issue or pull request on a forge
+type issueRef struct {
+	forge  string // "github" or "gitea"
+	api    string // Base URL of the forge's API
+	owner  string
+	repo   string
+	number int
+}
+
+func (r issueRef) String() string {
+	return fmt.Sprintf("%s/%s#%d", r.owner, r.repo, r.number)
+}
+
+// forgeAPI returns which forge a host runs and the base URL of its API.
+// github.com and hosts named like GitHub Enterprise are GitHub, others are
+// taken for Gitea or Forgejo; SLOP_SHOP_FORGE overrides the guess.
+func forgeAPI(base, host string) (string, string) {
+	forge := "gitea"
+	if strings.Contains(host, "github") {
+		forge = "github"
+	}
+	if override := os.Getenv(config.EnvPrefix + "FORGE"); override != "" {
+		forge = override
+	}
+	switch {
+	case forge == "github" && host == "github.com":
+		return forge, "https://api.github.com"
+	case forge == "github":
+		return forge, base + "/api/v3"
+	}
+	return forge, base + "/api/v1"
+}
+
+// parseIssueRef resolves a reference to an issue or pull request: its web
+// address, or a number with an optional owner/repo, which is looked up on
+// the forge of the repository's origin remote
+func parseIssueRef(ref, repoPath string) (issueRef, error) {
+	ref = strings.TrimSpace(ref)
+	if match := issueURL.FindStringSubmatch(ref); match != nil && match[0] == ref {
+		parsed, err := url.Parse(match[1])
+		if err != nil {
+			return issueRef{}, fmt.Errorf("invalid issue address %q: %v", ref, err)
+		}
+		number, _ := strconv.Atoi(match[5])
+		forge, api := forgeAPI(match[1], parsed.Hostname())
+		return issueRef{forge: forge, api: api, owner: match[2], repo: match[3], number: number}, nil
+	}
+
+	match := issueNumber.FindStringSubmatch(ref)
+	if match == nil {
+		return issueRef{}, fmt.Errorf("invalid issue reference %q (use a number, owner/repo#number or the issue's address)", ref)
+	}
+	remote, err := gitOutput(repoPath, "remote", "get-url", "origin")
+	if err != nil {
+		return issueRef{}, fmt.Errorf("cannot find the forge for issue %s: %v", ref, err)
+	}
+	origin := remoteURL.FindStringSubmatch(strings.TrimSpace(remote))
+	if origin == nil {
+		return issueRef{}, fmt.Errorf("cannot find the forge for issue %s: origin %q is not a GitHub or Gitea address", ref, strings.TrimSpace(remote))
+	}
+	// The port of an ssh remote is not the web server's
+	base := "https://" + origin[2]
+	if strings.HasPrefix(origin[1], "http") {
+		base = origin[1] + origin[2] + origin[3]
+	}
+	owner, name := origin[4], origin[5]
+	if match[1] != "" {
+		owner, name = match[1], match[2]
+	}
+	number, _ := strconv.Atoi(match[3])
+	forge, api := forgeAPI(base, origin[2])
+	return issueRef{forge: forge, api: api, owner: owner, repo: name, number: number}, nil
+}
+
+// promptIssueRefs returns the issue addresses and "#42" references in a prompt
+func promptIssueRefs(prompt string) []string {
+	var refs []string
+	seen := map[string]bool{}
+	add := func(ref string) {
+		if !seen[ref] && len(refs) < maxPromptIssues {
+			seen[ref] = true
+			refs = append(refs, ref)
+		}
+	}
+	for _, match := range issueURL.FindAllString(prompt, -1) {
+		add(match)
+	}
+	for _, match := range promptIssue.FindAllStringSubmatch(prompt, -1) {
+		add("#" + match[1])
+	}
+	return refs
+}
+
+// forgeIssue is the part of an issue or pull request, or a comment on one,
+// that GitHub and Gitea return alike
+type forgeIssue struct {
+	Title string `json:"title"`
+	Body  string `json:"body"`
+	State string `json:"state"`
+	URL   string `json:"html_url"`
+	User  struct {
+		Login string `json:"login"`
+	} `json:"user"`
+	PullRequest *json.RawMessage `json:"pull_request"`
+	CreatedAt   time.Time        `json:"created_at"`
+}
+
+// fetchIssue returns the title, body, comments and, for a pull request, the
+// diff of an issue as text for the context
+func fetchIssue(ref issueRef) (string, error) {
+	prefix := fmt.Sprintf("%s/repos/%s/%s", ref.api, url.PathEscape(ref.owner), url.PathEscape(ref.repo))
+	var issue forgeIssue
+	if err := getJSON(ref, fmt.Sprintf("%s/issues/%d", prefix, ref.number), &issue); err != nil {
+		return "", err
+	}
+	var comments []forgeIssue
+	if err := getJSON(ref, fmt.Sprintf("%s/issues/%d/comments?per_page=100", prefix, ref.number), &comments); err != nil {
+		return "", err
+	}
+
+	kind := "Issue"
+	if issue.PullRequest != nil && string(*issue.PullRequest) != "null" {
+		kind = "Pull request"
+	}
+	var buf strings.Builder
+	fmt.Fprintf(&buf, "%s %s: %s (%s, opened by %s)\n%s\n\n%s\n", kind, ref, issue.Title, issue.State, issue.User.Login, issue.URL, strings.TrimSpace(issue.Body))
+	for _, comment := range comments {
+		fmt.Fprintf(&buf, "\nComment by %s, %s:\n%s\n", comment.User.Login, comment.CreatedAt.Format("2006-01-02"), strings.TrimSpace(comment.Body))
+	}
+
+	if kind == "Pull request" {
+		diffURL := fmt.Sprintf("%s/pulls/%d.diff", prefix, ref.number)
+		accept := ""
+		if ref.forge == "github" {
+			diffURL, accept = fmt.Sprintf("%s/pulls/%d", prefix, ref.number), "application/vnd.github.diff"
+		}
+		diff, err := getForge(ref, diffURL, accept)
+		if err != nil {
+			return "", err
+		}
+		if len(diff) > maxIssueDiff {
+			diff = diff[:maxIssueDiff] + "\n[diff truncated]\n"
+		}
+		fmt.Fprintf(&buf, "\nDiff:\n%s", diff)
+	}
+	return buf.String(), nil
+}
+
+// getJSON fetches a forge API address and decodes the JSON response into v
+func getJSON(ref issueRef, address string, v any) error {
+	body, err := getForge(ref, address, "application/json")
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal([]byte(body), v); err != nil {
+		return fmt.Errorf("error parsing %s: %v", address, err)
+	}
+	return nil
+}
+
+// getForge fetches a forge API address, authenticating with GITHUB_TOKEN or
+// GH_TOKEN on GitHub and GITEA_TOKEN on Gitea when they are set
+func getForge(ref issueRef, address, accept string) (string, error) {
+	req, err := http.NewRequest(http.MethodGet, address, nil)
+	if err != nil {
+		return "", err
+	}
+	if accept != "" {
+		req.Header.Set("Accept", accept)
+	}
+	switch {
+	case ref.forge == "github" && os.Getenv("GITHUB_TOKEN") != "":
+		req.Header.Set("Authorization", "Bearer "+os.Getenv("GITHUB_TOKEN"))
+	case ref.forge == "github" && os.Getenv("GH_TOKEN") != "":
+		req.Header.Set("Authorization", "Bearer "+os.Getenv("GH_TOKEN"))
+	case ref.forge == "gitea" && os.Getenv("GITEA_TOKEN") != "":
+		req.Header.Set("Authorization", "token "+os.Getenv("GITEA_TOKEN"))
+	}
+
+	resp, err := issueClient.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("error fetching issue %s: %v", ref, err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", fmt.Errorf("error fetching issue %s: %v", ref, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("error fetching issue %s: HTTP %d: %s", ref, resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+	return string(body), nil
+}
+
+// issueContext fetches the issues and pull requests given by -issue and,
+// with -issues, those the prompt references, formatted as context sections
+func issueContext(refs []string, prompt string, fromPrompt bool, repoPath string) (string, error) {
+	if fromPrompt {
+		refs = append(refs, promptIssueRefs(prompt)...)
+	}
+	var buf strings.Builder
+	seen := map[issueRef]bool{}
+	for _, raw := range refs {
+		ref, err := parseIssueRef(raw, repoPath)
+		if err != nil {
+			return "", err
+		}
+		if seen[ref] {
+			continue
+		}
+		seen[ref] = true
+		text, err := fetchIssue(ref)
+		if err != nil {
+			return "", err
+		}
+		buf.WriteString(fmt.Sprintf("File: issue:%s (Size: %d bytes)\n", ref, len(text)))
+		buf.WriteString(strings.Repeat("-", 50) + "\n")
+		buf.WriteString(text)
+		buf.WriteString("\n\n")
+	}
+	return buf.String(), nil
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/kek/slop-shop/tools"
+)
+
+// runLint runs the configured linters for the given languages, or those
+// detected in the repository, and prints their diagnostics as findings in the
+// formats review uses, without asking the model
+func runLint(args []string) error {
+	fs := newFlagSet("lint")
+	opts := addCommonFlags(fs)
+	format := fs.String("format", "text", "Findings format: text, json, github for a pull request review payload, annotations for GitHub Actions, sarif, or html for a standalone report")
+	failOn := fs.String("fail-on", "none", "Exit with code 7 when there is a finding of this severity or worse: error, warning, info or none")
+	fs.Parse(args)
+
+	if !reviewFormats[*format] {
+		return fmt.Errorf("unknown lint format %q (use text, json, github, annotations, sarif or html)", *format)
+	}
+	threshold, ok := reviewSeverities[*failOn]
+	if !ok && *failOn != "none" {
+		return fmt.Errorf("unknown severity %q for -fail-on (use error, warning, info or none)", *failOn)
+	}
+
+	if _, err := setup(fs, opts); err != nil {
+		return err
+	}
+	// The linters' progress goes to stderr so stdout only has the findings
+	displayWriter = os.Stderr
+	tools.SetProgressOutput(chatter())
+
+	result := tools.RunTool(chatter(), tools.ToolCall{Name: "LINT", Args: strings.Join(fs.Args(), " ")}, opts.repoPath)
+	if result.Denied {
+		return &exitError{exitPolicyDenied, fmt.Errorf("LINT is blocked by the tool policy")}
+	}
+	if !result.Success && len(result.Diagnostics) == 0 {
+		return &exitError{exitToolFailed, fmt.Errorf("linting failed: %s", strings.TrimPrefix(strings.TrimSpace(result.Output), "Error: "))}
+	}
+
+	findings := lintFindings(result.Diagnostics)
+	if err := printFindings(*format, findings, opts.repoPath); err != nil {
+		return err
+	}
+
+	if *failOn != "none" {
+		for _, finding := range findings {
+			if reviewSeverities[finding.Severity] <= threshold {
+				return &exitError{code: exitFindings, err: fmt.Errorf("the linters found problems of severity %s or worse", *failOn)}
+			}
+		}
+	}
+	return nil
+}
+
+// lintFindings converts linter diagnostics to findings sorted by file and
+// line. Diagnostics are warnings, except the output of a linter that failed
+// without naming a file, which is an error.
+func lintFindings(diagnostics []tools.Diagnostic) []reviewFinding {
+	findings := make([]reviewFinding, 0, len(diagnostics))
+	for _, diagnostic := range diagnostics {
+		severity := "warning"
+		if diagnostic.File == "" {
+			severity = "error"
+		}
+		findings = append(findings, reviewFinding{
+			File:     filepath.ToSlash(diagnostic.File),
+			Line:     diagnostic.Line,
+			Column:   diagnostic.Column,
+			Severity: severity,
+			Comment:  diagnostic.Message,
+			Source:   diagnostic.Source,
+		})
+	}
+	sort.SliceStable(findings, func(i, j int) bool {
+		if findings[i].File != findings[j].File {
+			return findings[i].File < findings[j].File
+		}
+		return findings[i].Line < findings[j].Line
+	})
+	return findings
+}
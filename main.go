@@ -4,8 +4,13 @@ import (
 	"flag"
 	"fmt"
 	"log"
+	"os"
+	"slices"
+	"strconv"
 	"strings"
+	"time"
 
+	"github.com/kek/slop-shop/config"
 	"github.com/kek/slop-shop/ollama"
 	"github.com/kek/slop-shop/repo"
 	"github.com/kek/slop-shop/styles"
@@ -13,97 +18,571 @@ import (
 	"github.com/kek/slop-shop/tui"
 )
 
-func main() {
-	// Parse command line flags
-	model := flag.String("model", "qwen3:latest", "Ollama model to use")
-	prompt := flag.String("prompt", "", "Prompt to send to the model (required unless using REPL mode)")
-	repoPath := flag.String("repo", ".", "Path to repository (default: current directory)")
-	ollamaURL := flag.String("url", "http://localhost:11434", "Ollama API URL")
-	temperature := flag.Float64("temp", 0.7, "Temperature for model generation")
-	topP := flag.Float64("top-p", 0.9, "Top-p for model generation")
-	excludePatterns := flag.String("exclude", ".git,.jj,node_modules,vendor,*.exe,*.dll,*.so,*.dylib,*.bin,.crush", "Comma-separated patterns to exclude")
-	replMode := flag.Bool("repl", false, "Start interactive REPL mode with repository context")
-	toolsEnabled := flag.Bool("tools", false, "Enable tool execution for the LLM")
-	emptyContext := flag.Bool("empty-context", false, "Start with empty context (no repository files loaded)")
-	debugMode := flag.Bool("debug", false, "Enable debug logging to file")
-
-	flag.Parse()
-
-	// Set global debug flag
-	tui.SetGlobalDebug(*debugMode)
+// flagSettings maps command-line flags to the configuration settings they override
+var flagSettings = map[string]string{
+	"model":             "model",
+	"url":               "url",
+	"preset":            "preset",
+	"temp":              "temperature",
+	"top-p":             "top_p",
+	"exclude":           "exclude",
+	"tools":             "tools",
+	"allow-tools":       "allow_tools",
+	"deny-tools":        "deny_tools",
+	"tool-instructions": "tool_instructions",
+	"theme":             "theme",
+	"system":            "system",
+}
 
-	if *prompt == "" && !*replMode {
-		log.Fatal("Error: -prompt flag is required unless using -repl mode")
+// options holds the flags shared by the subcommands
+type options struct {
+	repoPath        string
+	emptyContext    bool
+	attach          string
+	rev             string
+	blame           int
+	outline         bool
+	debug           debugFlag
+	debugSocket     string
+	confirm         bool
+	speculative     bool
+	keepScratch     bool
+	patchFuzz       int
+	toolWorkers     int
+	maxToolOutput   int
+	summarizeOutput bool
+	allowEnv        string
+	inheritEnv      bool
+	shell           string
+	output          string
+	out             string
+	patchOut        string
+	quiet           bool
+	noColor         bool
+	systemFile      string
+	session         string
+	profile         string
+	preview         bool
+	noHistory       bool
+	cache           bool
+	noProgress      bool
+	noPager         bool
+	transcript      string
+	maxContext      string
+	contextPriority string
+	generated       string
+	providers       string
+	issueText       string // Issues and pull requests ask fetched, included by the issues provider
+	numCtx          int
+	titleModel      string
+	cacheTTL        time.Duration
+	maxSteps        int
+	wrap            string
+	indent          int
+	emptyRetries    int
+}
+
+// addCommonFlags registers the settings and tool flags shared by the subcommands on fs
+func addCommonFlags(fs *flag.FlagSet) *options {
+	defaults := config.DefaultSettings()
+	opts := &options{}
+
+	fs.String("model", defaults.Model, "Ollama model to use")
+	fs.StringVar(&opts.repoPath, "repo", ".", "Path to repository (default: current directory)")
+	fs.String("url", defaults.URL, "Ollama API URL")
+	fs.String("preset", "", "Generation options for a kind of task: "+presetNames()+"; -temp and -top-p still override them")
+	fs.Float64("temp", defaults.Temperature, "Temperature for model generation")
+	fs.Float64("top-p", defaults.TopP, "Top-p for model generation")
+	fs.String("exclude", strings.Join(defaults.Exclude, ","), "Comma-separated patterns to exclude")
+	fs.Bool("tools", defaults.Tools, "Enable tool execution for the LLM")
+	fs.String("allow-tools", "", "Comma-separated tools the LLM may use (default: all)")
+	fs.String("deny-tools", "", "Comma-separated tools the LLM may not use")
+	fs.String("tool-instructions", defaults.ToolInstructions, "When tool instructions are sent: always, auto (only with prompts that look like they need tools) or system (once, in the system prompt)")
+	fs.String("theme", defaults.Theme, "Color theme: "+strings.Join(styles.ThemeNames(), ", "))
+	fs.String("system", defaults.System, "System prompt with persona or format instructions, sent separately from the question")
+	fs.StringVar(&opts.systemFile, "system-file", "", "Read the system prompt from a file")
+	fs.BoolVar(&opts.emptyContext, "empty-context", false, "Start with empty context (no repository files loaded)")
+	fs.StringVar(&opts.attach, "attach", "", "Comma-separated files to send as the only context, without reading the rest of the repository")
+	fs.StringVar(&opts.rev, "rev", "", "Build the context from this commit, branch or tag instead of the working tree, without checking it out")
+	fs.IntVar(&opts.blame, "blame", 0, "Annotate each file with the lines its N most recent commits changed, with their authors, dates and messages (git blame)")
+	fs.StringVar(&opts.maxContext, "max-context", "", `Most characters of repository context sent, or tokens with a "t" suffix, e.g. 120000 or 30000t; files are dropped to fit`)
+	fs.StringVar(&opts.contextPriority, "context-priority", "", "Which files -max-context keeps: "+strings.Join(repo.Priorities, ", ")+" (default: small)")
+	fs.StringVar(&opts.providers, "context-providers", "", "Comma-separated sources of the context, in order: "+strings.Join(providerNames(), ", ")+" (default: "+strings.Join(defaultContextProviders, ",")+")")
+	fs.StringVar(&opts.generated, "generated", "", "What to do with generated, minified and vendored files, lockfiles and duplicate files: "+strings.Join(repo.GeneratedModes, ", ")+" (default: placeholder)")
+	fs.BoolVar(&opts.outline, "outline", false, "Send the declarations of Go, Python, JavaScript, TypeScript, Rust and Java files instead of their full contents")
+	fs.Var(&opts.debug, "debug", "Write debug output to "+config.DebugLogPath()+"; -debug=tui,ollama,tools limits it to those components")
+	fs.StringVar(&opts.debugSocket, "debug-socket", "", "Serve the -debug output on this UNIX socket instead of the log file, to follow it from another terminal with nc -U")
+	fs.IntVar(&opts.patchFuzz, "patch-fuzz", 2, "Number of context lines a diff hunk may ignore when it is applied")
+	fs.IntVar(&opts.toolWorkers, "tool-workers", 4, "Maximum number of read-only tool calls (READ_FILE, LIST_DIR, SEARCH_FILES, CODE_SEARCH, FIND_SYMBOL) run concurrently")
+	fs.IntVar(&opts.maxToolOutput, "max-tool-output", 0, "Maximum bytes of tool output fed back to the model (default: 32000 or the configured limit; -1 for no limit)")
+	fs.IntVar(&opts.maxSteps, "max-steps", 1, "Send tool results back to the model for up to N turns, until it ends with a FINAL_ANSWER (1 runs the tools once and stops)")
+	fs.BoolVar(&opts.summarizeOutput, "summarize-output", false, "Summarize oversized tool output with the model instead of truncating it")
+	fs.StringVar(&opts.allowEnv, "allow-env", "", "Comma-separated environment variables passed to tool commands in addition to the defaults")
+	fs.BoolVar(&opts.confirm, "confirm", false, "Ask before each tool call that runs a command or writes files, remembering approvals for the session or for good")
+	fs.BoolVar(&opts.speculative, "speculative", false, "Keep the changes of APPLY_DIFF and CREATE_FILE in memory, run commands in a copy of the repository that has them, and write them only once approved at the end of the run")
+	fs.BoolVar(&opts.keepScratch, "keep-scratch", false, "Keep the session's scratch directory, where tools put build outputs and downloads ($"+tools.ScratchEnv+"), instead of removing it on exit")
+	fs.BoolVar(&opts.inheritEnv, "inherit-env", false, "Pass the full environment, including credentials, to tool commands")
+	fs.StringVar(&opts.output, "output", "text", "Batch output format: text, or json for a structured record on stdout with progress on stderr")
+	fs.StringVar(&opts.out, "out", "", "Save the model's response to this file")
+	fs.StringVar(&opts.transcript, "transcript", "", "Append every prompt, streamed response and tool result to this Markdown file as it happens")
+	fs.StringVar(&opts.patchOut, "patch-out", "", `Save the diffs in the response to this patch file ("-" writes the patch to stdout)`)
+	fs.StringVar(&opts.profile, "profile", "", "Use the named profile from the configuration (also "+config.EnvPrefix+"PROFILE)")
+	fs.BoolVar(&opts.preview, "preview", false, "Print what would be sent to the model, with estimated token counts, instead of sending it")
+	fs.BoolVar(&opts.noHistory, "no-history", false, "Do not record the conversation in the history database")
+	fs.IntVar(&opts.numCtx, "num-ctx", 0, "Context window in tokens requested from Ollama (default: the model's num_ctx parameter, or 4096)")
+	fs.StringVar(&opts.titleModel, "title-model", "", `Model that names sessions and recorded conversations after their first turn, e.g. a small fast one (default: -model; "none" disables titles)`)
+	fs.IntVar(&opts.emptyRetries, "empty-retries", 2, "Ask again, each time slightly warmer, up to N times when the model returns an empty response (default: 2, or the configured number; 0 fails at once)")
+	fs.BoolVar(&opts.cache, "cache", false, "Answer a request the model already answered from the response cache instead of asking again")
+	fs.DurationVar(&opts.cacheTTL, "cache-ttl", 24*time.Hour, "How long identical requests are answered from the response cache")
+	fs.StringVar(&opts.session, "session", "", "Continue the named conversation across batch runs, creating it if needed")
+	fs.BoolVar(&opts.quiet, "quiet", false, "Print only the model's response, without the banner, file counts and tool progress")
+	fs.BoolVar(&opts.noProgress, "no-progress", false, "Do not show the progress of the repository scan")
+	fs.BoolVar(&opts.noPager, "no-pager", false, "Do not open a response taller than the terminal in the pager")
+	fs.StringVar(&opts.wrap, "wrap", "", `Columns responses are wrapped to: "auto" for the terminal's width, "off", or a number (default: auto, or the configured width)`)
+	fs.IntVar(&opts.indent, "indent", 0, "Spaces before each line of a response (default: 0, or the configured indent)")
+	fs.BoolVar(&opts.noColor, "no-color", false, "Disable colors and text styling (also enabled by the NO_COLOR environment variable)")
+	fs.StringVar(&opts.shell, "shell", "", "Shell used to run tool commands: sh, bash, zsh, cmd, powershell or pwsh (default: platform shell)")
+
+	return opts
+}
+
+// presetNames lists the built-in presets for the -preset usage text
+func presetNames() string {
+	names := make([]string, len(config.Presets))
+	for i, preset := range config.Presets {
+		names[i] = fmt.Sprintf("%s (%s)", preset.Name, preset.Description)
 	}
+	return strings.Join(names, ", ")
+}
 
-	// Parse exclude patterns
-	excludeList := strings.Split(*excludePatterns, ",")
-	for i, pattern := range excludeList {
-		excludeList[i] = strings.TrimSpace(pattern)
+// resolveSettings loads the configuration files and resolves the effective
+// settings for a parsed flag set: flags > env > repo config > user config
+func resolveSettings(fs *flag.FlagSet, opts *options) (*config.Config, *config.Settings, error) {
+	cfg, err := config.Load(opts.repoPath)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error loading configuration: %v", err)
 	}
 
-	// Read repository contents (unless empty context is requested)
-	var context string
-	if *emptyContext {
-		context = ""
-	} else {
-		files, err := repo.ReadRepository(*repoPath, excludeList)
+	settings := config.DefaultSettings()
+	cfg.Apply(&settings)
+	profile := opts.profile
+	if profile == "" {
+		profile = os.Getenv(config.EnvPrefix + "PROFILE")
+	}
+	if err := cfg.ApplyProfile(&settings, profile); err != nil {
+		return nil, nil, err
+	}
+	if err := config.ApplyEnv(&settings); err != nil {
+		return nil, nil, err
+	}
+
+	var flagErr error
+	fs.Visit(func(f *flag.Flag) {
+		if key, ok := flagSettings[f.Name]; ok && flagErr == nil {
+			flagErr = settings.Set(key, f.Value.String(), "flag -"+f.Name)
+		}
+	})
+	if flagErr != nil {
+		return nil, nil, flagErr
+	}
+	if err := settings.CheckPreset(); err != nil {
+		return nil, nil, err
+	}
+
+	if opts.systemFile != "" {
+		if settings.Source("system") == "flag -system" {
+			return nil, nil, fmt.Errorf("-system and -system-file cannot be used together")
+		}
+		data, err := os.ReadFile(opts.systemFile)
 		if err != nil {
-			log.Fatalf("Error reading repository: %v", err)
+			return nil, nil, fmt.Errorf("error reading system prompt: %v", err)
 		}
+		settings.Set("system", strings.TrimSpace(string(data)), "flag -system-file")
+	}
 
-		// Create context from repository contents
-		context = repo.CreateContext(files)
+	// The ignore file adds to the exclude patterns wherever they came from
+	ignore, err := config.LoadIgnore(opts.repoPath)
+	if err != nil {
+		return nil, nil, err
 	}
+	settings.Exclude = append(settings.Exclude, ignore...)
 
-	// Handle chat mode or batch mode
-	if *replMode {
-		tui.StartChat(*ollamaURL, *model, context, *temperature, *topP, *toolsEnabled, *debugMode)
+	return cfg, &settings, nil
+}
+
+// setup resolves the settings for a parsed flag set and applies them to the
+// styles and tools packages
+func setup(fs *flag.FlagSet, opts *options) (*config.Settings, error) {
+	cfg, settings, err := resolveSettings(fs, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := setDebug(opts.debug, opts.debugSocket); err != nil {
+		return nil, err
+	}
+	tui.SetRepoPath(opts.repoPath)
+	tui.SetSaveDir(config.ChatsDir())
+	if err := setOutputFormat(opts.output); err != nil {
+		return nil, err
+	}
+	if err := setOutputFiles(opts.out, opts.patchOut); err != nil {
+		return nil, err
+	}
+	setResponseOnly(os.Stdout)
+	setPaging(!opts.noPager, os.Stdout)
+	if err := setTranscript(opts.transcript); err != nil {
+		return nil, err
+	}
+	// Output files written into the repository are not read back as context
+	for _, path := range []string{opts.transcript, opts.out, opts.patchOut} {
+		if path != "" && path != "-" {
+			repo.AddArtifact(path)
+		}
+	}
+	if err := setContextLimit(cfg.Context, opts.maxContext, opts.contextPriority, opts.generated); err != nil {
+		return nil, err
+	}
+	if err := setContextProviders(cfg.ContextProviders, opts.providers); err != nil {
+		return nil, err
+	}
+	if err := setRendering(fs, cfg.Render, opts.wrap, opts.indent); err != nil {
+		return nil, err
+	}
+	setQuiet(opts.quiet)
+	showProgress = !opts.noProgress && !opts.quiet && isTerminal(os.Stderr)
+	sessionName = opts.session
+	previewOnly = opts.preview
+	if opts.maxSteps < 1 {
+		return nil, fmt.Errorf("-max-steps must be at least 1")
+	}
+	maxSteps = opts.maxSteps
+	historyPath = ""
+	if !opts.noHistory {
+		historyPath = config.HistoryPath()
+	}
+	ollama.SetNumCtx(opts.numCtx)
+	if err := setEmptyRetry(fs, cfg.EmptyResponse, opts.emptyRetries); err != nil {
+		return nil, err
+	}
+	switch opts.titleModel {
+	case "":
+		titleModel = settings.Model
+	case "none":
+		titleModel = ""
+	default:
+		titleModel = opts.titleModel
+	}
+	if opts.cache {
+		ollama.SetCache(config.CacheDir(), opts.cacheTTL)
 	} else {
-		runBatch(*prompt, context, *ollamaURL, *model, *temperature, *topP, *toolsEnabled, *repoPath)
+		ollama.SetCache("", 0)
+	}
+	if err := styles.SetTheme(settings.Theme); err != nil {
+		return nil, err
+	}
+	styles.DetectColor()
+	if opts.noColor || os.Getenv("NO_COLOR") != "" {
+		styles.DisableColor()
+	}
+	tools.SetPatchFuzz(opts.patchFuzz)
+	tools.SetToolWorkers(opts.toolWorkers)
+	if err := tools.SetShell(opts.shell); err != nil {
+		return nil, err
+	}
+
+	// Register user-defined tools, and plugin tools when tools are enabled, and apply tool settings
+	defined := append([]tools.CustomTool{}, cfg.Tools...)
+	if settings.Tools {
+		defined = append(defined, pluginTools(discoverPlugins(opts.repoPath))...)
+	}
+	if err := tools.RegisterCustomTools(defined); err != nil {
+		return nil, fmt.Errorf("error in custom tool configuration: %v", err)
+	}
+	ollama.SetCustomToolInstructions(tools.CustomToolInstructions())
+	tools.SetToolPolicy(settings.AllowTools, settings.DenyTools)
+	tools.SetCommandsEnabled(settings.Tools)
+	if err := ollama.SetToolInstructions(settings.ToolInstructions); err != nil {
+		return nil, err
+	}
+	if err := tools.LoadApprovals(config.ApprovalsPath()); err != nil {
+		return nil, err
 	}
+	setSpeculative(opts.speculative)
+	keepScratch = opts.keepScratch
+	tools.SetApprover(nil)
+	if opts.confirm {
+		tools.SetApprover(newApprover(stdinIsTerminal()))
+	}
+	tools.SetLintCommands(cfg.Lint)
+	limits := cfg.Output
+	if opts.maxToolOutput != 0 {
+		limits.MaxBytes = opts.maxToolOutput
+	}
+	limits.Summarize = limits.Summarize || opts.summarizeOutput
+	tools.SetOutputLimits(limits)
+	tools.SetEnvConfig(tools.EnvConfig{
+		Allow:   append(slices.Clone(cfg.Env.Allow), config.SplitList(opts.allowEnv)...),
+		Inherit: cfg.Env.Inherit || opts.inheritEnv,
+	})
+	tools.SetExcludePatterns(settings.Exclude)
+	workspaceExclude = settings.Exclude
+	if stdinIsTerminal() && outputFormat == "text" {
+		tools.SetConflictResolver(newConflictResolver(settings))
+	} else {
+		tools.SetConflictResolver(nil)
+	}
+
+	return settings, nil
 }
 
-// runBatch handles the single-prompt mode without Bubble Tea
-func runBatch(prompt, context, ollamaURL, model string, temperature, topP float64, toolsEnabled bool, repoPath string) {
-	fmt.Println(styles.TitleStyle.Render("🚀 Slop Shop - AI-Powered Code Analysis"))
-	fmt.Println(styles.InfoStyle.Render(fmt.Sprintf("Reading repository at: %s", repoPath)))
-	fmt.Println(styles.InfoStyle.Render(fmt.Sprintf("Using model: %s", model)))
-	fmt.Println(styles.InfoStyle.Render(fmt.Sprintf("Prompt: %s", prompt)))
-	fmt.Println(styles.InfoStyle.Render(fmt.Sprintf("Ollama URL: %s", ollamaURL)))
+// loadContext builds the context from the configured providers, leaving out
+// the repository contents when an empty context is requested
+func loadContext(opts *options, settings *config.Settings) (string, error) {
+	if opts.emptyContext {
+		if opts.attach != "" {
+			return "", fmt.Errorf("-attach cannot be combined with -empty-context")
+		}
+		if opts.rev != "" {
+			return "", fmt.Errorf("-rev cannot be combined with -empty-context")
+		}
+	}
+	return assembleContext(runProviders(opts, settings), contextLimit.MaxChars)
+}
 
-	if context != "" {
-		fmt.Println(styles.SuccessStyle.Render(fmt.Sprintf("Found %d files", strings.Count(context, "File:"))))
-		fmt.Println(styles.InfoStyle.Render(fmt.Sprintf("Total context size: %d characters", len(context))))
-	} else {
-		fmt.Println(styles.InfoStyle.Render("Starting with empty context (no repository files loaded)"))
+// filesContext reads the repository files within limit: those of -rev, the
+// files given with -attach, or else the working tree
+func filesContext(opts *options, settings *config.Settings, limit repo.ContextLimit) (string, error) {
+	if opts.rev != "" {
+		return revisionContext(opts, settings, limit)
+	}
+	if opts.attach != "" {
+		files, err := repo.ReadFiles(opts.repoPath, config.SplitList(opts.attach))
+		if err != nil {
+			return "", err
+		}
+		if files, err = repo.BlameFiles(opts.repoPath, "", files, opts.blame); err != nil {
+			return "", err
+		}
+		if files, err = limitContext(opts.repoPath, files, limit); err != nil {
+			return "", err
+		}
+		return repo.CreateContext(files), nil
 	}
 
-	fmt.Print(styles.PromptStyle.Render("🤖 "))
+	files, err := readRepository(opts.repoPath, settings.Exclude)
+	if err != nil {
+		return "", fmt.Errorf("error reading repository: %v", err)
+	}
+	if files, err = condenseFiles(files); err != nil {
+		return "", err
+	}
+	if opts.outline {
+		if files, err = repo.OutlineFiles(opts.repoPath, files, settings.Exclude); err != nil {
+			return "", fmt.Errorf("error outlining repository: %v", err)
+		}
+	}
+	if files, err = repo.BlameFiles(opts.repoPath, "", files, opts.blame); err != nil {
+		return "", err
+	}
+	if files, err = limitContext(opts.repoPath, files, limit); err != nil {
+		return "", err
+	}
+	return repo.CreateContext(files), nil
+}
 
-	// Channel for streaming response chunks
-	streamChannel := make(chan string, 100)
-	var response strings.Builder
+// contextLimit caps the repository context loadContext builds
+var contextLimit repo.ContextLimit
 
-	go func() {
-		_, err := ollama.SendToOllamaWithCallback(ollamaURL, model, prompt, context, temperature, topP, toolsEnabled, func(chunk string) {
-			streamChannel <- chunk
-		})
+// setContextLimit sets the context limit from the configuration, overridden by
+// the -max-context, -context-priority and -generated flags when they are given
+func setContextLimit(configured repo.ContextLimit, maxContext, priority, generated string) error {
+	contextLimit = configured
+	if maxContext != "" {
+		chars, err := parseContextSize(maxContext)
 		if err != nil {
-			// Send error message to channel instead of silently failing
-			streamChannel <- fmt.Sprintf("\n❌ Error: %v\n", err)
+			return err
+		}
+		contextLimit.MaxChars = chars
+	}
+	if priority != "" {
+		contextLimit.Priority = priority
+	}
+	if contextLimit.Priority != "" && !slices.Contains(repo.Priorities, contextLimit.Priority) {
+		return fmt.Errorf("unknown context priority %q (available: %s)", contextLimit.Priority, strings.Join(repo.Priorities, ", "))
+	}
+	if generated != "" {
+		contextLimit.Generated = generated
+	}
+	if contextLimit.Generated != "" && !slices.Contains(repo.GeneratedModes, contextLimit.Generated) {
+		return fmt.Errorf("unknown mode %q for generated files (available: %s)", contextLimit.Generated, strings.Join(repo.GeneratedModes, ", "))
+	}
+	return nil
+}
+
+// setRendering lays out responses as configured, with -wrap and -indent
+// overriding the configuration when they are given
+func setRendering(fs *flag.FlagSet, configured styles.Rendering, wrap string, indent int) error {
+	rendering := configured
+	if wrap != "" {
+		rendering.Width = wrap
+	}
+	fs.Visit(func(f *flag.Flag) {
+		if f.Name == "indent" {
+			rendering.Indent = indent
 		}
-		close(streamChannel)
-	}()
+	})
+	return styles.SetRendering(rendering)
+}
+
+// setEmptyRetry sets how empty responses are retried as configured, with
+// -empty-retries overriding the configuration when it is given
+func setEmptyRetry(fs *flag.FlagSet, configured ollama.EmptyRetry, retries int) error {
+	retry := configured
+	fs.Visit(func(f *flag.Flag) {
+		if f.Name == "empty-retries" {
+			retry.Retries = &retries
+		}
+	})
+	return ollama.SetEmptyRetry(retry)
+}
+
+// parseContextSize parses a -max-context value: a number of characters, or of
+// tokens with a "t" suffix, counted as ollama.EstimateTokens does at four
+// characters each
+func parseContextSize(value string) (int, error) {
+	number, perUnit := strings.TrimSpace(value), 1
+	if strings.HasSuffix(number, "t") {
+		number, perUnit = strings.TrimSuffix(number, "t"), 4
+	}
+	n, err := strconv.Atoi(number)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid -max-context %q: want a number of characters, or tokens with a \"t\" suffix", value)
+	}
+	return n * perUnit, nil
+}
 
-	for chunk := range streamChannel {
-		fmt.Print(chunk)
-		response.WriteString(chunk)
+// condenseFiles replaces generated, vendored and duplicate files with a
+// placeholder, or leaves them out, as -generated says, and lists them on stderr
+func condenseFiles(files []repo.FileInfo) ([]repo.FileInfo, error) {
+	kept, condensed, err := repo.CondenseFiles(files, contextLimit.Generated)
+	if err != nil {
+		return nil, err
 	}
+	if len(condensed) > 0 && !quiet {
+		verb := "Replaced"
+		if contextLimit.Generated == "exclude" {
+			verb = "Left out"
+		}
+		fmt.Fprintln(os.Stderr, styles.InfoStyle.Render(fmt.Sprintf("🧹 %s %d generated, vendored or duplicate files: %s", verb, len(condensed), strings.Join(condensed, ", "))))
+	}
+	return kept, nil
+}
 
-	fmt.Println()
+// limitContext drops the files that do not fit in limit and reports each of them on stderr
+func limitContext(repoPath string, files []repo.FileInfo, limit repo.ContextLimit) ([]repo.FileInfo, error) {
+	kept, dropped, err := repo.LimitContext(repoPath, files, limit)
+	if err != nil {
+		return nil, err
+	}
+	if len(dropped) > 0 {
+		fmt.Fprintln(os.Stderr, styles.WarningStyle.Render(fmt.Sprintf("✂️  Dropped %d of %d files to fit the context limit of %d characters: %s",
+			len(dropped), len(files), limit.MaxChars, strings.Join(dropped, ", "))))
+	}
+	return kept, nil
+}
 
-	if toolsEnabled {
-		tools.ExecuteTools(response.String(), repoPath)
+func main() {
+	args := os.Args[1:]
+	if len(args) == 0 {
+		printUsage()
+		os.Exit(exitUsage)
 	}
-}
\ No newline at end of file
+
+	if args[0] == "-version" || args[0] == "--version" {
+		fmt.Println(versionString())
+		return
+	}
+
+	handleInterrupts()
+
+	// Flags without a subcommand select ask or chat, as before subcommands existed
+	if strings.HasPrefix(args[0], "-") {
+		if err := runLegacy(args); err != nil {
+			fail(err)
+		}
+		closeScratch()
+		return
+	}
+
+	cmd, ok := findCommand(args[0])
+	if !ok {
+		// Plugins are only asked for their commands when no built-in one matches
+		registerPluginCommands(discoverPlugins("."))
+		cmd, ok = findCommand(args[0])
+	}
+	if !ok {
+		fmt.Fprintf(os.Stderr, "Unknown command %q\n\n", args[0])
+		printUsage()
+		os.Exit(exitUsage)
+	}
+	commandName = cmd.name
+	ollama.SetUsageHook(recordUsage(cmd.name))
+	if err := cmd.run(args[1:]); err != nil {
+		fail(err)
+	}
+	closeScratch()
+}
+
+// fail reports an error and exits with the code that matches it
+func fail(err error) {
+	closeScratch()
+	log.Printf("Error: %v", err)
+	os.Exit(exitCode(err))
+}
+
+// runLegacy handles the flat flag set: -prompt runs ask and -repl runs chat
+func runLegacy(args []string) error {
+	fs := flag.NewFlagSet("slop-shop", flag.ExitOnError)
+	opts := addCommonFlags(fs)
+	prompt := fs.String("prompt", "", "Prompt to send to the model (required unless using REPL mode)")
+	replMode := fs.Bool("repl", false, "Start interactive REPL mode with repository context")
+	fs.Parse(args)
+
+	if *prompt == "" && !*replMode {
+		return fmt.Errorf("-prompt flag is required unless using -repl mode")
+	}
+	if *replMode {
+		commandName = "chat"
+		if err := checkREPLFlags(opts); err != nil {
+			return err
+		}
+	}
+	ollama.SetUsageHook(recordUsage(commandName))
+
+	settings, err := setup(fs, opts)
+	if err != nil {
+		return err
+	}
+	var context string
+	if *replMode {
+		tools.SetConflictResolver(nil)
+		context, err = loadChatContext(opts, settings)
+	} else {
+		context, err = loadContext(opts, settings)
+	}
+	if err != nil {
+		return err
+	}
+
+	if *replMode {
+		tui.StartChat(settings.URL, settings.Model, settings.System, context, settings.Temperature, settings.TopP, settings.Tools, opts.debug != "")
+		return nil
+	}
+	*prompt, context, err = applyStdin(*prompt, context)
+	if err != nil {
+		return err
+	}
+	_, err = runBatch(*prompt, context, settings.URL, settings.Model, settings.System, settings.Temperature, settings.TopP, settings.Tools, opts.repoPath)
+	return err
+}
@@ -1,11 +1,42 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
 	"testing"
+	"time"
+
+	"github.com/charmbracelet/lipgloss"
+	"github.com/kek/slop-shop/config"
+	"github.com/kek/slop-shop/ollama"
+	"github.com/kek/slop-shop/repo"
+	"github.com/kek/slop-shop/store"
+	"github.com/kek/slop-shop/styles"
+	"github.com/kek/slop-shop/tools"
+	"github.com/kek/slop-shop/tui"
+	"github.com/muesli/termenv"
 )
 
+// TestMain removes the scratch directory the tool calls of the tests share
+func TestMain(m *testing.M) {
+	code := m.Run()
+	tools.CloseScratch(false)
+	os.Exit(code)
+}
+
 func TestMainFunctionFlags(t *testing.T) {
 	// Save original command line arguments
 	originalArgs := os.Args
@@ -80,11 +111,11 @@ func TestRunBatchFunction(t *testing.T) {
 	// This is a basic smoke test
 
 	// Test with empty context
-	runBatch("test prompt", "", "http://localhost:11434", "test-model", 0.7, 0.9, false, ".")
+	runBatch("test prompt", "", "http://localhost:11434", "test-model", "", 0.7, 0.9, false, ".")
 
 	// Test with some context
 	context := "File: test.go\n---\npackage main\n"
-	runBatch("test prompt", context, "http://localhost:11434", "test-model", 0.7, 0.9, false, ".")
+	runBatch("test prompt", context, "http://localhost:11434", "test-model", "", 0.7, 0.9, false, ".")
 
 	// If we get here without panicking, the test passes
 }
@@ -118,3 +149,3257 @@ func TestFlagValidation(t *testing.T) {
 		}
 	}
 }
+
+func TestSettingsPrecedence(t *testing.T) {
+	userDir := t.TempDir()
+	repoDir := t.TempDir()
+	t.Setenv("XDG_CONFIG_HOME", userDir)
+
+	userConfig := "model = \"user-model\"\nurl = \"http://user:11434\"\ntemperature = 0.2\ntheme = \"light\"\n"
+	if err := os.MkdirAll(filepath.Join(userDir, "slop-shop"), 0755); err != nil {
+		t.Fatalf("Failed to create config directory: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(userDir, "slop-shop", "config.toml"), []byte(userConfig), 0644); err != nil {
+		t.Fatalf("Failed to write user config: %v", err)
+	}
+	repoConfig := "model = \"repo-model\"\ntemperature = 0.3\n\n[tool_policy]\nenabled = true\ndeny = [\"SHELL\"]\n"
+	if err := os.WriteFile(config.RepoConfigPath(repoDir), []byte(repoConfig), 0644); err != nil {
+		t.Fatalf("Failed to write repo config: %v", err)
+	}
+	t.Setenv("SLOP_SHOP_TEMPERATURE", "0.4")
+	t.Setenv("SLOP_SHOP_MODEL", "env-model")
+
+	cfg, err := config.Load(repoDir)
+	if err != nil {
+		t.Fatalf("Failed to load config: %v", err)
+	}
+	settings := config.DefaultSettings()
+	cfg.Apply(&settings)
+	if err := config.ApplyEnv(&settings); err != nil {
+		t.Fatalf("Failed to apply environment: %v", err)
+	}
+	if err := settings.Set("model", "flag-model", "flag -model"); err != nil {
+		t.Fatalf("Failed to apply flag: %v", err)
+	}
+
+	expected := map[string]string{
+		"model":       "flag-model",
+		"url":         "http://user:11434",
+		"temperature": "0.4",
+		"top_p":       "0.9",
+		"tools":       "true",
+		"deny_tools":  "SHELL",
+		"theme":       "light",
+	}
+	for key, value := range expected {
+		if got := settings.Get(key); got != value {
+			t.Errorf("Expected %s = %q, got %q (from %s)", key, value, got, settings.Source(key))
+		}
+	}
+
+	if source := settings.Source("tools"); source != config.RepoConfigPath(repoDir) {
+		t.Errorf("Expected tools to come from the repo config, got %s", source)
+	}
+	if source := settings.Source("url"); !strings.HasSuffix(source, filepath.Join("slop-shop", "config.toml")) {
+		t.Errorf("Expected url to come from the user config, got %s", source)
+	}
+	if !strings.Contains(settings.String(), "env SLOP_SHOP_TEMPERATURE") {
+		t.Errorf("Expected sources in the settings listing, got:\n%s", settings.String())
+	}
+
+	if err := settings.Set("top_p", "high", "flag -top-p"); err == nil {
+		t.Error("Expected invalid number to be rejected")
+	}
+}
+
+func TestProfiles(t *testing.T) {
+	userDir := t.TempDir()
+	repoDir := t.TempDir()
+	t.Setenv("XDG_CONFIG_HOME", userDir)
+	t.Setenv("SLOP_SHOP_PROFILE", "")
+
+	userConfig := `model = "user-model"
+profile = "home"
+
+[profiles.home]
+url = "http://localhost:11434"
+
+[profiles.gpu-box]
+url = "http://gpu-box:11434"
+model = "qwen3:32b"
+temperature = 0.1
+
+[profiles.gpu-box.tool_policy]
+enabled = true
+deny = ["SHELL"]
+`
+	os.MkdirAll(filepath.Join(userDir, "slop-shop"), 0755)
+	if err := os.WriteFile(filepath.Join(userDir, "slop-shop", "config.toml"), []byte(userConfig), 0644); err != nil {
+		t.Fatalf("Failed to write user config: %v", err)
+	}
+
+	resolve := func(args ...string) (*config.Settings, error) {
+		fs := flag.NewFlagSet("test", flag.ContinueOnError)
+		opts := addCommonFlags(fs)
+		fs.Parse(append([]string{"-repo", repoDir}, args...))
+		_, settings, err := resolveSettings(fs, opts)
+		return settings, err
+	}
+
+	settings, err := resolve()
+	if err != nil {
+		t.Fatalf("Failed to resolve settings: %v", err)
+	}
+	if settings.URL != "http://localhost:11434" || settings.Source("url") != "profile home" || settings.Model != "user-model" {
+		t.Errorf("Expected the default profile to apply, got url %s from %s", settings.URL, settings.Source("url"))
+	}
+
+	settings, err = resolve("-profile", "gpu-box", "-temp", "0.5")
+	if err != nil {
+		t.Fatalf("Failed to resolve settings: %v", err)
+	}
+	if settings.URL != "http://gpu-box:11434" || settings.Model != "qwen3:32b" || !settings.Tools || settings.Get("deny_tools") != "SHELL" {
+		t.Errorf("Expected the gpu-box profile to apply, got:\n%s", settings)
+	}
+	if settings.Temperature != 0.5 {
+		t.Errorf("Expected flags to take precedence over the profile, got temperature %v", settings.Temperature)
+	}
+
+	t.Setenv("SLOP_SHOP_PROFILE", "work")
+	if _, err := resolve(); err == nil || !strings.Contains(err.Error(), "gpu-box, home") {
+		t.Errorf("Expected an unknown profile to list the available ones, got %v", err)
+	}
+}
+
+func TestSubcommands(t *testing.T) {
+	for _, name := range []string{"ask", "chat", "review", "commit", "index", "tools", "config", "doctor", "version"} {
+		if _, ok := findCommand(name); !ok {
+			t.Errorf("Expected subcommand %s to exist", name)
+		}
+	}
+	if _, ok := findCommand("unknown"); ok {
+		t.Error("Expected unknown subcommand to be rejected")
+	}
+
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+	defer ollama.SetCache("", 0)
+	defer func() { titleModel, historyPath = "", "" }()
+	if err := runAsk([]string{"-repo", t.TempDir()}); err == nil || !strings.Contains(err.Error(), "no prompt") {
+		t.Errorf("Expected ask without a prompt to fail, got %v", err)
+	}
+	if err := runConfig(nil); err == nil {
+		t.Error("Expected config without show to fail")
+	}
+	// The REPL owns the terminal, so nothing may prompt on it
+	if err := runChat([]string{"-confirm"}); err == nil || !strings.Contains(err.Error(), "-confirm only applies to batch runs") {
+		t.Errorf("Expected chat -confirm to be rejected, got %v", err)
+	}
+	if err := runLegacy([]string{"-repl", "-confirm"}); err == nil || !strings.Contains(err.Error(), "-confirm only applies to batch runs") {
+		t.Errorf("Expected -repl -confirm to be rejected, got %v", err)
+	}
+
+	repoDir := t.TempDir()
+	if _, err := gitOutput(repoDir, "init", "-q"); err != nil {
+		t.Skipf("git is not available: %v", err)
+	}
+	if err := runCommit([]string{"-repo", repoDir}); err == nil || !strings.Contains(err.Error(), "no staged changes") {
+		t.Errorf("Expected commit without staged changes to fail, got %v", err)
+	}
+}
+
+func TestApplyStdin(t *testing.T) {
+	saved := readPipedInput
+	defer func() { readPipedInput = saved }()
+
+	readPipedInput = func() (string, error) { return "diff --git a/x b/x\n", nil }
+	prompt, context, err := applyStdin("review this", "Repository Contents:\n")
+	if err != nil || prompt != "review this" {
+		t.Fatalf("Expected prompt to be kept, got %q (err: %v)", prompt, err)
+	}
+	if !strings.HasPrefix(context, "Standard input:\n") || !strings.Contains(context, "diff --git a/x b/x") || !strings.HasSuffix(context, "Repository Contents:\n") {
+		t.Errorf("Expected piped input before the repository context, got %q", context)
+	}
+
+	readPipedInput = func() (string, error) { return "explain the build\n", nil }
+	prompt, context, err = applyStdin("-", "")
+	if err != nil || prompt != "explain the build" || context != "" {
+		t.Errorf("Expected stdin to become the prompt, got %q / %q (err: %v)", prompt, context, err)
+	}
+
+	readPipedInput = func() (string, error) { return "", nil }
+	if _, _, err := applyStdin("-", ""); err == nil {
+		t.Error("Expected \"-\" without piped input to fail")
+	}
+	if prompt, context, _ := applyStdin("plain", "ctx"); prompt != "plain" || context != "ctx" {
+		t.Errorf("Expected nothing to change without piped input, got %q / %q", prompt, context)
+	}
+}
+
+func TestExecuteBatchRecord(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, `{"response":"Listing files.\nLIST_DIR: .\n","done":false}`)
+		fmt.Fprintln(w, `{"response":"","done":true,"prompt_eval_count":12,"eval_count":5,"eval_duration":1000000000}`)
+	}))
+	defer server.Close()
+
+	defer func() { displayWriter = nil; tools.SetProgressOutput(nil) }()
+	displayWriter = io.Discard
+	tools.SetProgressOutput(io.Discard)
+
+	client := ollama.NewClient(server.URL, "test-model", 0.7, 0.9)
+	record := executeBatch(client, "list the files", "", nil, true, t.TempDir())
+
+	if record.Response != "Listing files.\nLIST_DIR: .\n" || record.Error != "" {
+		t.Errorf("Unexpected response %q (error %q)", record.Response, record.Error)
+	}
+	if record.Stats.PromptTokens != 12 || record.Stats.ResponseTokens != 5 || record.Stats.TokensPerSecond() != 5 {
+		t.Errorf("Unexpected stats: %+v", record.Stats)
+	}
+	if len(record.ToolCalls) != 1 || len(record.ToolResults) != 1 || record.ToolSummary == nil || record.ToolSummary.Runs != 1 {
+		t.Errorf("Expected one tool call with its result and summary, got %+v", record)
+	}
+
+	data, err := json.Marshal(record)
+	if err != nil {
+		t.Fatalf("Failed to encode record: %v", err)
+	}
+	for _, field := range []string{`"prompt":"list the files"`, `"tool_calls"`, `"tool_results"`, `"response_tokens":5`} {
+		if !strings.Contains(string(data), field) {
+			t.Errorf("Expected %s in JSON record, got %s", field, data)
+		}
+	}
+
+	if err := setOutputFormat("xml"); err == nil {
+		t.Error("Expected unknown output format to be rejected")
+	}
+}
+
+func TestExecuteBatchSteps(t *testing.T) {
+	var prompts []string
+	finish := true
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var request ollama.Request
+		json.NewDecoder(r.Body).Decode(&request)
+		prompts = append(prompts, request.Prompt)
+		response := "Listing files.\nLIST_DIR: .\n"
+		if finish && len(prompts) == 2 {
+			response = "The repository is empty.\n\nFINAL_ANSWER: Nothing to change\nCHANGED_FILES: none\n"
+		}
+		fmt.Fprintf(w, `{"response":%q,"done":false}`+"\n", response)
+		fmt.Fprintln(w, `{"response":"","done":true,"context":[1,2,3],"eval_count":5}`)
+	}))
+	defer server.Close()
+
+	defer func() { displayWriter = nil; tools.SetProgressOutput(nil); maxSteps = 1 }()
+	displayWriter = io.Discard
+	tools.SetProgressOutput(io.Discard)
+	maxSteps = 3
+
+	client := ollama.NewClient(server.URL, "test-model", 0.7, 0.9)
+	record := executeBatch(client, "list the files", "", nil, true, t.TempDir())
+	if len(prompts) != 2 || !strings.Contains(prompts[1], "Tool Execution Results") {
+		t.Fatalf("Expected the tool results to be sent back once, got prompts %q", prompts)
+	}
+	if record.Outcome == nil || record.Outcome.Status != "complete" || record.Outcome.Summary != "Nothing to change" || record.Outcome.Steps != 2 {
+		t.Errorf("Unexpected outcome %+v", record.Outcome)
+	}
+	if record.ExitCode != exitOK || record.Stats.ResponseTokens != 10 || !strings.Contains(record.Response, "FINAL_ANSWER") {
+		t.Errorf("Unexpected record: exit code %d, stats %+v, response %q", record.ExitCode, record.Stats, record.Response)
+	}
+	if len(record.ToolCalls) != 1 || len(record.ToolResults) != 1 || record.ToolResults[0].Tool != record.ToolCalls[0].Name {
+		t.Errorf("Expected one result for each recorded call, got calls %+v and results %+v", record.ToolCalls, record.ToolResults)
+	}
+
+	prompts, finish = nil, false
+	record = executeBatch(client, "list the files", "", nil, true, t.TempDir())
+	if len(prompts) != 3 || record.Outcome == nil || record.Outcome.Status != "incomplete" || record.ExitCode != exitIncomplete {
+		t.Errorf("Expected the run to stop after 3 steps with exit code %d, got %d prompts, outcome %+v and exit code %d", exitIncomplete, len(prompts), record.Outcome, record.ExitCode)
+	}
+}
+
+func TestGuardrailCorrections(t *testing.T) {
+	repoPath := t.TempDir()
+	os.MkdirAll(filepath.Join(repoPath, "cmd"), 0755)
+	os.WriteFile(filepath.Join(repoPath, "cmd", "main.go"), []byte("package main\n"), 0644)
+
+	var prompts []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var request ollama.Request
+		json.NewDecoder(r.Body).Decode(&request)
+		prompts = append(prompts, request.Prompt)
+		response := "READ_FILE: main.go\n\nFINAL_ANSWER: Read it\nCHANGED_FILES: none\n"
+		if len(prompts) == 2 {
+			response = "READ_FILE: cmd/main.go\n\nFINAL_ANSWER: Read it\nCHANGED_FILES: none\n"
+		}
+		fmt.Fprintf(w, `{"response":%q,"done":false}`+"\n", response)
+		fmt.Fprintln(w, `{"response":"","done":true,"context":[1,2,3],"eval_count":5}`)
+	}))
+	defer server.Close()
+
+	defer func() { displayWriter = nil; tools.SetProgressOutput(nil); maxSteps = 1 }()
+	displayWriter = io.Discard
+	tools.SetProgressOutput(io.Discard)
+	maxSteps = 3
+
+	// The final answer does not end the run while the model has a call to correct
+	client := ollama.NewClient(server.URL, "test-model", 0.7, 0.9)
+	record := executeBatch(client, "read main", "", nil, true, repoPath)
+	if len(prompts) != 2 || !strings.Contains(prompts[1], "READ_FILE was not run: the file main.go does not exist. Did you mean cmd/main.go?") {
+		t.Fatalf("Expected the correction to be sent back, got prompts %q", prompts)
+	}
+	if record.Outcome == nil || record.Outcome.Status != "complete" || record.Outcome.Steps != 2 || record.ExitCode != exitOK {
+		t.Errorf("Expected the corrected run to complete, got outcome %+v and exit code %d", record.Outcome, record.ExitCode)
+	}
+	if len(record.ToolResults) != 2 || !record.ToolResults[0].Rejected || !record.ToolResults[1].Success {
+		t.Errorf("Expected a rejected call and its correction, got %+v", record.ToolResults)
+	}
+}
+
+func TestSaveOutputs(t *testing.T) {
+	dir := t.TempDir()
+	defer func() { responseFile, patchFile, displayWriter = "", "", nil }()
+	displayWriter = io.Discard
+
+	record := batchRecord{
+		Response: "Change a.txt:\n```diff\n--- a/a.txt\n+++ b/a.txt\n@@ -1 +1 @@\n-old\n+new\n```\n",
+		ToolResults: []tools.ToolResult{{
+			Tool:    "GENERATE_DIFF",
+			Success: true,
+			Output:  "Generated diff:\n\n--- a/b.txt\n+++ b/b.txt\n@@ -1 +1 @@\n-x\n+y",
+		}},
+	}
+
+	responseFile = filepath.Join(dir, "response.md")
+	patchFile = filepath.Join(dir, "changes.patch")
+	if err := saveOutputs(record); err != nil {
+		t.Fatalf("saveOutputs failed: %v", err)
+	}
+
+	response, err := os.ReadFile(responseFile)
+	if err != nil || string(response) != record.Response {
+		t.Errorf("Expected response file to hold the response, got %q (%v)", response, err)
+	}
+
+	patch, err := os.ReadFile(patchFile)
+	if err != nil {
+		t.Fatalf("Failed to read patch: %v", err)
+	}
+	expected := "--- a/a.txt\n+++ b/a.txt\n@@ -1 +1 @@\n-old\n+new\n--- a/b.txt\n+++ b/b.txt\n@@ -1 +1 @@\n-x\n+y\n"
+	if string(patch) != expected {
+		t.Errorf("Unexpected patch:\n%s", patch)
+	}
+}
+
+func TestQuietBatchPrintsOnlyResponse(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, `{"response":"Just the answer","done":false}`)
+		fmt.Fprintln(w, `{"response":"","done":true}`)
+	}))
+	defer server.Close()
+
+	var output strings.Builder
+	defer func() { displayWriter = nil; setQuiet(false) }()
+	displayWriter = &output
+	setQuiet(true)
+
+	client := ollama.NewClient(server.URL, "test-model", 0.7, 0.9)
+	executeBatch(client, "question", "File: a.go\n", nil, false, t.TempDir())
+
+	if output.String() != "Just the answer\n" {
+		t.Errorf("Expected only the response in quiet mode, got %q", output.String())
+	}
+}
+
+func TestRedirectedStdoutGetsOnlyResponse(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, `{"response":"\n# Answer\n\nUse a map.","done":false}`)
+		fmt.Fprintln(w, `{"response":"","done":true}`)
+	}))
+	defer server.Close()
+
+	setResponseOnly(&strings.Builder{})
+	defer func() { responseOnly = false }()
+	if !responseOnly {
+		t.Fatal("Expected only the response on a stdout that is not a terminal")
+	}
+
+	stdout, stderr := os.Stdout, os.Stderr
+	outR, outW, _ := os.Pipe()
+	errR, errW, _ := os.Pipe()
+	os.Stdout, os.Stderr = outW, errW
+	_, err := runBatch("question", "File: a.go\n", server.URL, "test-model", "", 0.7, 0.9, false, t.TempDir())
+	os.Stdout, os.Stderr = stdout, stderr
+	outW.Close()
+	errW.Close()
+	out, _ := io.ReadAll(outR)
+	progress, _ := io.ReadAll(errR)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(out) != "# Answer\n\nUse a map.\n" {
+		t.Errorf("Expected only the response on stdout, got %q", out)
+	}
+	if !strings.Contains(string(progress), "Slop Shop") || !strings.Contains(string(progress), "Use a map.") {
+		t.Errorf("Expected the banner and streamed response on stderr, got %q", progress)
+	}
+	if displayWriter != nil {
+		t.Error("Expected the display to be moved back after the run")
+	}
+
+	patchFile = "-"
+	defer func() { patchFile = "" }()
+	if setResponseOnly(&strings.Builder{}); responseOnly {
+		t.Error("Expected a patch written to stdout to keep the display on stdout")
+	}
+}
+
+func TestSpeculativeRun(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		response := "CREATE_FILE: notes.txt\ndraft\nEND_FILE\nRUN_COMMAND: cat notes.txt\n"
+		fmt.Fprintf(w, `{"response":%q,"done":false}`+"\n", response)
+		fmt.Fprintln(w, `{"response":"","done":true}`)
+	}))
+	defer server.Close()
+
+	defer func() { displayWriter = nil; tools.SetProgressOutput(nil); setSpeculative(false) }()
+	displayWriter = io.Discard
+	tools.SetProgressOutput(io.Discard)
+	setSpeculative(true)
+
+	repoPath := t.TempDir()
+	client := ollama.NewClient(server.URL, "test-model", 0.7, 0.9)
+	record := executeBatch(client, "take notes", "", nil, true, repoPath)
+	if len(record.ToolResults) != 2 || !strings.Contains(record.ToolResults[1].Output, "draft") {
+		t.Fatalf("Expected the command to see the created file, got %+v", record.ToolResults)
+	}
+	// Without a terminal to approve them, the changes are only reported
+	if _, err := os.Stat(filepath.Join(repoPath, "notes.txt")); !os.IsNotExist(err) {
+		t.Error("Expected the file not to be written without approval")
+	}
+	if !strings.Contains(record.Speculative, "+++ b/notes.txt\n@@ -0,0 +1,1 @@\n+draft") {
+		t.Errorf("Expected the changes in the record, got %q", record.Speculative)
+	}
+	if diffs := collectDiffs(record); len(diffs) != 1 || diffs[0] != record.Speculative {
+		t.Errorf("Expected -patch-out to get the speculative changes, got %q", diffs)
+	}
+}
+
+func TestSystemPrompt(t *testing.T) {
+	t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+	repoDir := t.TempDir()
+	systemFile := filepath.Join(repoDir, "system.txt")
+	if err := os.WriteFile(systemFile, []byte("Answer in French.\n"), 0644); err != nil {
+		t.Fatalf("Failed to write system prompt: %v", err)
+	}
+
+	fs := newFlagSet("ask")
+	opts := addCommonFlags(fs)
+	fs.Parse([]string{"-repo", repoDir, "-system-file", systemFile})
+	_, settings, err := resolveSettings(fs, opts)
+	if err != nil {
+		t.Fatalf("Failed to resolve settings: %v", err)
+	}
+	if settings.System != "Answer in French." || settings.Source("system") != "flag -system-file" {
+		t.Errorf("Expected system prompt from the file, got %q from %s", settings.System, settings.Source("system"))
+	}
+
+	fs = newFlagSet("ask")
+	opts = addCommonFlags(fs)
+	fs.Parse([]string{"-repo", repoDir, "-system", "Be brief", "-system-file", systemFile})
+	if _, _, err := resolveSettings(fs, opts); err == nil {
+		t.Error("Expected -system and -system-file together to be rejected")
+	}
+
+	var system string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var request ollama.Request
+		json.NewDecoder(r.Body).Decode(&request)
+		system = request.System
+		fmt.Fprintln(w, `{"response":"Bonjour","done":true}`)
+	}))
+	defer server.Close()
+
+	defer func() { displayWriter = nil }()
+	displayWriter = io.Discard
+
+	client := ollama.NewClient(server.URL, "test-model", 0.7, 0.9)
+	client.System = settings.System
+	record := executeBatch(client, "hello", "", nil, false, repoDir)
+	if system != "Answer in French." || record.System != system {
+		t.Errorf("Expected the system prompt in the request and record, got %q and %q", system, record.System)
+	}
+}
+
+func TestRenderTemplate(t *testing.T) {
+	t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+	repoDir := t.TempDir()
+	templateDir := filepath.Join(repoDir, ".slopshop", "templates")
+	if err := os.MkdirAll(templateDir, 0755); err != nil {
+		t.Fatalf("Failed to create template directory: %v", err)
+	}
+	text := "Explain {{.FileName}} to a {{.Var \"audience\"}}: {{.Input}}\n\n{{.File}}\n"
+	if err := os.WriteFile(filepath.Join(templateDir, "explain.tmpl"), []byte(text), 0644); err != nil {
+		t.Fatalf("Failed to write template: %v", err)
+	}
+
+	data := &templateData{
+		repoPath: repoDir,
+		vars:     varFlags{"audience": "beginner"},
+		Input:    "focus on errors",
+		FileName: "main.go",
+		File:     "package main",
+	}
+	prompt, err := renderTemplate("explain", data)
+	if err != nil {
+		t.Fatalf("Failed to render template: %v", err)
+	}
+	if prompt != "Explain main.go to a beginner: focus on errors\n\npackage main" {
+		t.Errorf("Unexpected prompt: %q", prompt)
+	}
+
+	prompt, err = renderTemplate("bug-triage", &templateData{repoPath: repoDir, Input: "crash on start"})
+	if err != nil || !strings.HasSuffix(prompt, "crash on start") {
+		t.Errorf("Expected built-in template to render, got %q (%v)", prompt, err)
+	}
+
+	if _, err := renderTemplate("missing", data); err == nil || !strings.Contains(err.Error(), "explain") {
+		t.Errorf("Expected unknown template error listing the available templates, got %v", err)
+	}
+
+	vars := varFlags{}
+	if err := vars.Set("novalue"); err == nil {
+		t.Error("Expected -var without = to be rejected")
+	}
+}
+
+func TestCheckOllama(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/tags" {
+			http.NotFound(w, r)
+			return
+		}
+		fmt.Fprintln(w, `{"models":[{"name":"qwen3:latest"},{"name":"llama3:8b"}]}`)
+	}))
+	defer server.Close()
+
+	results := checkOllama(ollama.NewClient(server.URL, "qwen3", 0.7, 0.9))
+	if len(results) != 2 || !results[0].ok || !results[1].ok {
+		t.Errorf("Expected server and model checks to pass, got %+v", results)
+	}
+
+	results = checkOllama(ollama.NewClient(server.URL, "mistral", 0.7, 0.9))
+	if len(results) != 2 || results[1].ok || !strings.Contains(results[1].fix, "ollama pull mistral") {
+		t.Errorf("Expected missing model to fail with a pull hint, got %+v", results)
+	}
+
+	server.Close()
+	results = checkOllama(ollama.NewClient(server.URL, "qwen3", 0.7, 0.9))
+	if len(results) != 1 || results[0].ok {
+		t.Errorf("Expected unreachable server to fail, got %+v", results)
+	}
+
+	if !strings.HasPrefix(versionString(), "slop-shop ") {
+		t.Errorf("Unexpected version string %q", versionString())
+	}
+}
+
+func TestBatchSession(t *testing.T) {
+	t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+
+	var requests []ollama.Request
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var request ollama.Request
+		json.NewDecoder(r.Body).Decode(&request)
+		requests = append(requests, request)
+		fmt.Fprintf(w, `{"response":"answer %d","done":true,"context":[%d]}`+"\n", len(requests), len(requests))
+	}))
+	defer server.Close()
+
+	defer func() { displayWriter, sessionName = nil, "" }()
+	displayWriter = io.Discard
+	sessionName = "build"
+
+	runBatch("summarize", "File: main.go", server.URL, "model-a", "", 0.7, 0.9, false, ".")
+	runBatch("refactor it", "File: main.go", server.URL, "model-a", "", 0.7, 0.9, false, ".")
+	runBatch("now as a patch", "File: main.go", server.URL, "model-b", "", 0.7, 0.9, false, ".")
+
+	if len(requests) != 3 {
+		t.Fatalf("Expected 3 requests, got %d", len(requests))
+	}
+	if requests[0].Context != nil || !strings.Contains(requests[0].Prompt, "File: main.go") {
+		t.Errorf("Expected the first turn to send the repository context, got %+v", requests[0])
+	}
+	if len(requests[1].Context) != 1 || requests[1].Context[0] != 1 || strings.Contains(requests[1].Prompt, "File: main.go") {
+		t.Errorf("Expected the second turn to continue from the saved state, got %+v", requests[1])
+	}
+	if requests[2].Context != nil || !strings.Contains(requests[2].Prompt, "Assistant: answer 2") {
+		t.Errorf("Expected a model change to resend the conversation as text, got %+v", requests[2])
+	}
+
+	sess, err := loadSession("build")
+	if err != nil {
+		t.Fatalf("Failed to load session: %v", err)
+	}
+	if len(sess.Turns) != 3 || sess.Model != "model-b" || len(sess.History) != 1 || sess.History[0] != 3 {
+		t.Errorf("Unexpected saved session: %+v", sess)
+	}
+
+	if _, err := loadSession("../escape"); err == nil {
+		t.Error("Expected session names with path separators to be rejected")
+	}
+}
+
+func TestConversationTitles(t *testing.T) {
+	t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+	t.Setenv("XDG_DATA_HOME", t.TempDir())
+	var models []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var request ollama.Request
+		json.NewDecoder(r.Body).Decode(&request)
+		models = append(models, request.Model)
+		answer := "The channel closes twice."
+		if strings.Contains(request.Prompt, "Write a title") {
+			answer = "<think>short</think>\n\"Fix race in streaming channel.\"\n"
+		}
+		fmt.Fprintf(w, `{"response":%q,"done":true}`+"\n", answer)
+	}))
+	defer server.Close()
+
+	defer func() { displayWriter, sessionName, historyPath, titleModel = nil, "", "", "" }()
+	displayWriter, sessionName, titleModel = io.Discard, "race", "tiny"
+	historyPath = config.HistoryPath()
+
+	runBatch("why does the stream panic", "", server.URL, "big", "", 0.7, 0.9, false, ".")
+	runBatch("fix it", "", server.URL, "big", "", 0.7, 0.9, false, ".")
+	if strings.Join(models, ",") != "big,tiny,big" {
+		t.Errorf("Expected one title request to the title model, got %v", models)
+	}
+
+	sess, err := loadSession("race")
+	if err != nil || sess.Title != "Fix race in streaming channel" {
+		t.Errorf("Expected the session to be named, got %+v (err: %v)", sess, err)
+	}
+	db, err := store.Open(historyPath)
+	if err != nil {
+		t.Fatalf("Failed to open history: %v", err)
+	}
+	defer db.Close()
+	conversations, err := db.List(10)
+	if err != nil || len(conversations) != 1 || conversations[0].Title != "Fix race in streaming channel" {
+		t.Errorf("Expected the recorded conversation to be named, got %+v (err: %v)", conversations, err)
+	}
+
+	if title := cleanTitle("Title: " + strings.Repeat("refactor the parser ", 10)); len(title) > maxTitleLength+3 || !strings.HasSuffix(title, "...") {
+		t.Errorf("Expected a long title to be shortened, got %q", title)
+	}
+}
+
+func TestRunChain(t *testing.T) {
+	var prompts []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var request ollama.Request
+		json.NewDecoder(r.Body).Decode(&request)
+		prompts = append(prompts, request.Prompt)
+		fmt.Fprintf(w, `{"response":"result %d","done":true}`+"\n", len(prompts))
+	}))
+	defer server.Close()
+
+	defer func() { displayWriter = nil }()
+	displayWriter = io.Discard
+
+	playbookPath := filepath.Join(t.TempDir(), "refactor.yaml")
+	playbookText := "steps:\n  - name: summarize\n    prompt: Summarize the repo\n  - name: propose\n    prompt: Propose a refactor\n    tools: false\n"
+	if err := os.WriteFile(playbookPath, []byte(playbookText), 0644); err != nil {
+		t.Fatalf("Failed to write playbook: %v", err)
+	}
+	steps, err := loadPlaybook(playbookPath)
+	if err != nil {
+		t.Fatalf("Failed to load playbook: %v", err)
+	}
+	if len(steps) != 2 || steps[1].Name != "propose" || steps[1].Tools == nil || *steps[1].Tools {
+		t.Fatalf("Unexpected playbook steps: %+v", steps)
+	}
+
+	settings := config.DefaultSettings()
+	settings.URL = server.URL
+	if err := runChain(steps, "File: main.go", &settings, t.TempDir()); err != nil {
+		t.Fatalf("Chain failed: %v", err)
+	}
+
+	if len(prompts) != 2 {
+		t.Fatalf("Expected 2 requests, got %d", len(prompts))
+	}
+	if strings.Contains(prompts[0], "previous steps") {
+		t.Errorf("Expected the first step to have no earlier responses, got %q", prompts[0])
+	}
+	if !strings.Contains(prompts[1], "summarize (Summarize the repo):\nresult 1") || !strings.Contains(prompts[1], "File: main.go") {
+		t.Errorf("Expected the second step to see the repository and the first response, got %q", prompts[1])
+	}
+
+	emptyPath := filepath.Join(t.TempDir(), "empty.yaml")
+	os.WriteFile(emptyPath, []byte("steps: []\n"), 0644)
+	if _, err := loadPlaybook(emptyPath); err == nil {
+		t.Error("Expected a playbook without steps to be rejected")
+	}
+}
+
+func TestBatchExitCodes(t *testing.T) {
+	defer func() { displayWriter = nil; tools.SetProgressOutput(nil); tools.SetToolPolicy(nil, nil) }()
+	displayWriter = io.Discard
+	tools.SetProgressOutput(io.Discard)
+
+	response := `{"response":"READ_FILE: missing.txt\n","done":true}`
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var request ollama.Request
+		json.NewDecoder(r.Body).Decode(&request)
+		if request.Model == "unknown" {
+			http.Error(w, `{"error":"model not found"}`, http.StatusNotFound)
+			return
+		}
+		fmt.Fprintln(w, response)
+	}))
+	defer server.Close()
+
+	run := func(url, model string, toolsEnabled bool) batchRecord {
+		return executeBatch(ollama.NewClient(url, model, 0.7, 0.9), "prompt", "", nil, toolsEnabled, t.TempDir())
+	}
+
+	if record := run(server.URL, "test-model", false); record.ExitCode != exitOK {
+		t.Errorf("Expected exit code %d without tools, got %d (%v)", exitOK, record.ExitCode, record.err)
+	}
+	if record := run(server.URL, "unknown", false); record.ExitCode != exitModel {
+		t.Errorf("Expected exit code %d for a model error, got %d (%v)", exitModel, record.ExitCode, record.err)
+	}
+	if record := run(server.URL, "test-model", true); record.ExitCode != exitToolFailed {
+		t.Errorf("Expected exit code %d for a failed tool, got %d (%v)", exitToolFailed, record.ExitCode, record.err)
+	}
+
+	tools.SetToolPolicy(nil, []string{"READ_FILE"})
+	if record := run(server.URL, "test-model", true); record.ExitCode != exitPolicyDenied || !record.ToolResults[0].Denied {
+		t.Errorf("Expected exit code %d for a blocked tool, got %d (%v)", exitPolicyDenied, record.ExitCode, record.err)
+	}
+
+	server.Close()
+	if record := run(server.URL, "test-model", false); record.ExitCode != exitConnection {
+		t.Errorf("Expected exit code %d when Ollama is unreachable, got %d (%v)", exitConnection, record.ExitCode, record.err)
+	}
+
+	if code := exitCode(fmt.Errorf("bad flag")); code != exitFailure {
+		t.Errorf("Expected exit code %d for other errors, got %d", exitFailure, code)
+	}
+}
+
+func TestParseFindings(t *testing.T) {
+	response := "Here is my review:\n```json\n[\n" +
+		`{"file":"b.go","line":3,"severity":"Warning","comment":"unchecked error"},` + "\n" +
+		`{"file":"a.go","line":10,"severity":"critical","comment":"nil dereference"}` + "\n]\n```\n"
+
+	findings, err := parseFindings(response)
+	if err != nil {
+		t.Fatalf("Failed to parse findings: %v", err)
+	}
+	if len(findings) != 2 || findings[0].File != "a.go" || findings[1].Severity != "warning" {
+		t.Errorf("Expected findings sorted by file with normalized severities, got %+v", findings)
+	}
+	if findings[0].Severity != "info" {
+		t.Errorf("Expected unknown severity to become info, got %q", findings[0].Severity)
+	}
+
+	review := githubReview(findings)
+	if review.Event != "COMMENT" || len(review.Comments) != 2 || review.Comments[1].Path != "b.go" || review.Comments[1].Line != 3 {
+		t.Errorf("Unexpected GitHub review payload: %+v", review)
+	}
+
+	if findings, err := parseFindings("Looks good: []"); err != nil || len(findings) != 0 {
+		t.Errorf("Expected an empty list of findings, got %+v (%v)", findings, err)
+	}
+	if _, err := parseFindings("The changes look fine."); err == nil {
+		t.Error("Expected a response without JSON to be rejected")
+	}
+}
+
+func TestDocumentPackage(t *testing.T) {
+	repoDir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(repoDir, "greet"), 0755); err != nil {
+		t.Fatalf("Failed to create package: %v", err)
+	}
+	src := "// Old comment.\npackage greet\n\n// Hello greets\nfunc Hello() string { return \"hi\" }\n"
+	if err := os.WriteFile(filepath.Join(repoDir, "greet", "greet.go"), []byte(src), 0644); err != nil {
+		t.Fatalf("Failed to write package: %v", err)
+	}
+
+	var context string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var request ollama.Request
+		json.NewDecoder(r.Body).Decode(&request)
+		context = request.Prompt
+		fmt.Fprintln(w, `{"response":"`+"```\\n"+`Package greet says hello.\n\nUse Hello.`+"\\n```"+`","done":true}`)
+	}))
+	defer server.Close()
+
+	index := repo.NewIndex(repoDir, nil)
+	if err := index.Update(); err != nil {
+		t.Fatalf("Failed to index: %v", err)
+	}
+	packages := selectPackages(index.Packages(), []string{"greet"})
+	if len(packages) != 1 || packages[0].DocFile != "greet/greet.go" {
+		t.Fatalf("Unexpected packages: %+v", packages)
+	}
+
+	diff, err := documentPackage(ollama.NewClient(server.URL, "test-model", 0.7, 0.9), packages[0], repoDir, false)
+	if err != nil {
+		t.Fatalf("documentPackage failed: %v", err)
+	}
+	if !strings.Contains(context, "func Hello() string") || !strings.Contains(context, "Old comment.") {
+		t.Errorf("Expected the outline and current comment as context, got %q", context)
+	}
+	if err := tools.ApplyPatch(diff, repoDir); err != nil {
+		t.Fatalf("Failed to apply documentation diff: %v\n%s", err, diff)
+	}
+
+	got, _ := os.ReadFile(filepath.Join(repoDir, "greet", "greet.go"))
+	want := "// Package greet says hello.\n//\n// Use Hello.\npackage greet\n\n// Hello greets\nfunc Hello() string { return \"hi\" }\n"
+	if string(got) != want {
+		t.Errorf("Unexpected documented file:\n%s", got)
+	}
+
+	created, err := replacePackageComment("", "greet", "// Package greet says hello.")
+	if err != nil || created != "// Package greet says hello.\npackage greet\n" {
+		t.Errorf("Unexpected doc.go: %q (%v)", created, err)
+	}
+}
+
+func TestCondenseRepository(t *testing.T) {
+	var calls int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		fmt.Fprintf(w, `{"response":"summary %d","done":true}`+"\n", calls)
+	}))
+	defer server.Close()
+
+	defer func() { displayWriter = nil }()
+	displayWriter = io.Discard
+
+	var files []repo.FileInfo
+	for i := 0; i < 5; i++ {
+		content := strings.Repeat(fmt.Sprintf("line of file %d\n", i), 20)
+		files = append(files, repo.FileInfo{Path: fmt.Sprintf("file%d.go", i), Content: content, Size: int64(len(content))})
+	}
+	client := ollama.NewClient(server.URL, "test-model", 0.7, 0.9)
+
+	context, err := condenseRepository(client, files, 1000000)
+	if err != nil || calls != 0 || !strings.Contains(context, "File: file4.go") {
+		t.Errorf("Expected a small repository to be sent whole, got %d calls (%v)", calls, err)
+	}
+
+	context, err = condenseRepository(client, files, 800)
+	if err != nil {
+		t.Fatalf("condenseRepository failed: %v", err)
+	}
+	if calls != 5 {
+		t.Errorf("Expected one summary per chunk, got %d requests", calls)
+	}
+	if !strings.Contains(context, "summary 1") || !strings.Contains(context, "summary 5") || strings.Contains(context, "line of file") {
+		t.Errorf("Expected the summaries instead of the files, got %q", context)
+	}
+}
+
+func TestServeAPI(t *testing.T) {
+	t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+
+	model := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, `{"response":"Hello ","done":false}`)
+		fmt.Fprintln(w, `{"response":"there","done":true,"context":[7]}`)
+	}))
+	defer model.Close()
+
+	settings := config.DefaultSettings()
+	settings.URL = model.URL
+	settings.Tools = false
+	srv := &server{opts: &options{repoPath: ".", emptyContext: true}, settings: &settings, token: "secret", hosts: allowedHosts("127.0.0.1", nil)}
+	api := httptest.NewServer(srv.routes())
+	defer api.Close()
+
+	// call sends a request with the token, which change may alter
+	call := func(method, path, body string, change func(*http.Request)) *http.Response {
+		t.Helper()
+		req, _ := http.NewRequest(method, api.URL+path, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer secret")
+		if method == http.MethodPost {
+			req.Header.Set("Content-Type", "application/json")
+		}
+		if change != nil {
+			change(req)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("%s %s failed: %v", method, path, err)
+		}
+		return resp
+	}
+
+	resp := call("POST", "/api/ask", `{"prompt":"hi","session":"editor"}`, nil)
+	var record batchRecord
+	json.NewDecoder(resp.Body).Decode(&record)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || record.Response != "Hello there" || record.Session != "editor" {
+		t.Errorf("Unexpected ask response %d: %+v", resp.StatusCode, record)
+	}
+
+	resp = call("POST", "/api/ask?stream=true", `{"prompt":"hi"}`, nil)
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.Header.Get("Content-Type") != "text/event-stream" ||
+		!strings.Contains(string(body), "event: chunk\ndata: {\"text\":\"Hello \"}") ||
+		!strings.Contains(string(body), "event: done") {
+		t.Errorf("Unexpected event stream: %s", body)
+	}
+
+	// Turns of the same session asked at once are all recorded
+	var wg sync.WaitGroup
+	for range 2 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			call("POST", "/api/ask", `{"prompt":"again","session":"editor"}`, nil).Body.Close()
+		}()
+	}
+	wg.Wait()
+
+	rejected := []struct {
+		name   string
+		method string
+		path   string
+		body   string
+		change func(*http.Request)
+		status int
+	}{
+		{"a missing prompt", "POST", "/api/ask", `{}`, nil, http.StatusBadRequest},
+		{"a missing token", "GET", "/api/sessions", "", func(r *http.Request) { r.Header.Del("Authorization") }, http.StatusUnauthorized},
+		{"a wrong token", "GET", "/api/sessions", "", func(r *http.Request) { r.Header.Set("Authorization", "Bearer guess") }, http.StatusUnauthorized},
+		{"a form post", "POST", "/api/ask", `{"prompt":"hi"}`, func(r *http.Request) { r.Header.Set("Content-Type", "text/plain") }, http.StatusUnsupportedMediaType},
+		{"a foreign origin", "POST", "/api/ask", `{"prompt":"hi"}`, func(r *http.Request) { r.Header.Set("Origin", "http://evil.example") }, http.StatusForbidden},
+		{"a rebound host name", "GET", "/api/sessions", "", func(r *http.Request) { r.Host = "evil.example:8080" }, http.StatusForbidden},
+		{"a task with the tools disabled", "POST", "/api/tasks", `{"prompt":"fix it"}`, nil, http.StatusForbidden},
+		{"tools the settings disable", "POST", "/api/ask", `{"prompt":"hi","tools":true}`, nil, http.StatusForbidden},
+	}
+	for _, tc := range rejected {
+		resp := call(tc.method, tc.path, tc.body, tc.change)
+		resp.Body.Close()
+		if resp.StatusCode != tc.status {
+			t.Errorf("Expected %s to be rejected with %d, got %d", tc.name, tc.status, resp.StatusCode)
+		}
+	}
+
+	resp = call("GET", "/api/sessions", "", func(r *http.Request) { r.Header.Set("Origin", "http://localhost:3000") })
+	var sessions []sessionSummary
+	json.NewDecoder(resp.Body).Decode(&sessions)
+	resp.Body.Close()
+	if len(sessions) != 1 || sessions[0].Name != "editor" || sessions[0].Turns != 3 {
+		t.Errorf("Unexpected sessions: %+v", sessions)
+	}
+
+	resp = call("GET", "/api/sessions/missing", "", nil)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("Expected a missing session to return 404, got %d", resp.StatusCode)
+	}
+}
+
+func TestServeConflictingEdit(t *testing.T) {
+	t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "notes.txt"), []byte("first\nchanged\n"), 0644)
+
+	diff, _ := json.Marshal("APPLY_DIFF:\nBEGIN_DIFF\n--- a/notes.txt\n+++ b/notes.txt\n@@ -1,2 +1,2 @@\n first\n-second\n+2nd\nEND_DIFF\n")
+	model := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `{"response":%s,"done":true}`+"\n", diff)
+	}))
+	defer model.Close()
+
+	// /dev/null passes for a terminal, where setup would install a resolver
+	// that skips the hunk when asked
+	devNull, err := os.Open(os.DevNull)
+	if err != nil {
+		t.Skip(err)
+	}
+	defer devNull.Close()
+	savedStdin := os.Stdin
+	defer func() { os.Stdin, conflictInput, displayWriter = savedStdin, savedStdin, nil }()
+	os.Stdin, displayWriter = devNull, io.Discard
+	conflictInput = strings.NewReader("s\n")
+	defer tools.SetConflictResolver(nil)
+
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+	defer ollama.SetCache("", 0)
+	fs := newFlagSet("serve")
+	opts := addCommonFlags(fs)
+	fs.Parse([]string{"-repo", dir, "-url", model.URL, "-tools", "-quiet", "-no-color"})
+	srv, err := newServer(fs, opts, "127.0.0.1:0", "secret", "")
+	if err != nil {
+		t.Fatalf("newServer failed: %v", err)
+	}
+	api := httptest.NewServer(srv.routes())
+	defer api.Close()
+
+	req, _ := http.NewRequest("POST", api.URL+"/api/ask", strings.NewReader(`{"prompt":"rename it","empty_context":true}`))
+	req.Header.Set("Authorization", "Bearer secret")
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("ask failed: %v", err)
+	}
+	var record batchRecord
+	json.NewDecoder(resp.Body).Decode(&record)
+	resp.Body.Close()
+	if len(record.ToolResults) != 1 || record.ToolResults[0].Success {
+		t.Errorf("Expected the conflicting diff to fail instead of prompting, got %+v", record.ToolResults)
+	}
+	if data, _ := os.ReadFile(filepath.Join(dir, "notes.txt")); string(data) != "first\nchanged\n" {
+		t.Errorf("Expected notes.txt to be unchanged, got %q", data)
+	}
+
+	for _, flag := range []string{"-confirm", "-speculative"} {
+		fs := newFlagSet("serve")
+		opts := addCommonFlags(fs)
+		fs.Parse([]string{flag})
+		if _, err := newServer(fs, opts, "127.0.0.1:0", "secret", ""); err == nil || !strings.Contains(err.Error(), "only applies to batch runs") {
+			t.Errorf("Expected serve to reject %s, got %v", flag, err)
+		}
+	}
+}
+
+func TestWatchRepository(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "main.go"), []byte("package main\n"), 0644)
+	os.MkdirAll(filepath.Join(dir, ".git"), 0755)
+
+	savedInterval := watchInterval
+	defer func() { watchInterval, displayWriter = savedInterval, nil }()
+	watchInterval = 10 * time.Millisecond
+	displayWriter = io.Discard
+
+	stop := make(chan struct{})
+	runs := 0
+	err := watchRepository(dir, []string{".git"}, 50*time.Millisecond, stop, func() error {
+		runs++
+		switch runs {
+		case 1:
+			go func() {
+				time.Sleep(50 * time.Millisecond)
+				// Changes in excluded directories do not cause a run
+				os.WriteFile(filepath.Join(dir, ".git", "index"), []byte("x"), 0644)
+				time.Sleep(100 * time.Millisecond)
+				for i := 0; i < 3; i++ {
+					os.WriteFile(filepath.Join(dir, "main.go"), []byte(fmt.Sprintf("package main // %d\n", i)), 0644)
+					time.Sleep(15 * time.Millisecond)
+				}
+			}()
+		case 2:
+			close(stop)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("watchRepository failed: %v", err)
+	}
+	if runs != 2 {
+		t.Errorf("Expected a burst of changes to cause one more run, got %d runs", runs)
+	}
+
+	before := map[string]fileStamp{"a": {size: 1}, "b": {size: 2}}
+	after := map[string]fileStamp{"a": {size: 3}, "c": {size: 1}}
+	if changed := changedFiles(before, after); strings.Join(changed, ",") != "a,b,c" {
+		t.Errorf("Unexpected changed files: %v", changed)
+	}
+}
+
+func TestBench(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var request ollama.Request
+		json.NewDecoder(r.Body).Decode(&request)
+		if request.Model == "missing" {
+			http.Error(w, `{"error":"model not found"}`, http.StatusNotFound)
+			return
+		}
+		fmt.Fprintln(w, `{"response":"four ","done":false}`)
+		fmt.Fprintln(w, `{"response":"words here","done":true,"eval_count":20,"eval_duration":2000000000}`)
+	}))
+	defer server.Close()
+
+	fast := benchPrompt(ollama.NewClient(server.URL, "fast", 0.7, 0.9), "count", "")
+	missing := benchPrompt(ollama.NewClient(server.URL, "missing", 0.7, 0.9), "count", "")
+	if fast.err != nil || fast.length != len("four words here") || fast.stats.ResponseTokens != 20 || fast.firstToken > fast.latency {
+		t.Errorf("Unexpected run: %+v", fast)
+	}
+	if missing.err == nil {
+		t.Error("Expected an unknown model to fail")
+	}
+
+	rows := []benchRow{
+		summarizeBench("count", "fast", []benchRun{fast, fast}),
+		summarizeBench("count", "missing", []benchRun{missing}),
+	}
+	if rows[0].runs != 2 || rows[0].failures != 0 || rows[0].tokensPerSecond != 10 || rows[0].tokens != 20 {
+		t.Errorf("Unexpected summary: %+v", rows[0])
+	}
+	if rows[1].failures != 1 || rows[1].tokens != 0 {
+		t.Errorf("Expected failed runs to be left out of the averages: %+v", rows[1])
+	}
+
+	var buf strings.Builder
+	if err := writeBenchCSV(&buf, rows); err != nil {
+		t.Fatalf("writeBenchCSV failed: %v", err)
+	}
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 3 || !strings.HasPrefix(lines[0], "prompt,model,runs,failures") || !strings.HasPrefix(lines[2], "count,missing,1,1,") {
+		t.Errorf("Unexpected CSV:\n%s", buf.String())
+	}
+}
+
+func TestPreviewSendsNothing(t *testing.T) {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		fmt.Fprintln(w, `{"response":"answer","done":true}`)
+	}))
+	defer server.Close()
+
+	defer func() { previewOnly = false }()
+	previewOnly = true
+
+	response, err := runBatch("explain", "File: main.go", server.URL, "model-a", "Be brief.", 0.7, 0.9, true, ".")
+	if err != nil || response != "" {
+		t.Errorf("Expected a preview to return nothing, got %q, %v", response, err)
+	}
+	if requests != 0 {
+		t.Errorf("Expected no request to be sent, got %d", requests)
+	}
+}
+
+func TestInitSurvey(t *testing.T) {
+	dir := t.TempDir()
+	os.MkdirAll(filepath.Join(dir, "node_modules", "left-pad"), 0755)
+	os.MkdirAll(filepath.Join(dir, "web", "dist"), 0755)
+	os.WriteFile(filepath.Join(dir, "main.go"), []byte("package main\n"), 0644)
+	os.WriteFile(filepath.Join(dir, "util.go"), []byte("package main\n"), 0644)
+	os.WriteFile(filepath.Join(dir, "web", "app.ts"), []byte("export {}\n"), 0644)
+	os.WriteFile(filepath.Join(dir, "web", "dist", "app.js"), []byte("x"), 0644)
+	os.WriteFile(filepath.Join(dir, "go.sum"), []byte("x"), 0644)
+	os.WriteFile(filepath.Join(dir, "fixtures.json"), []byte(strings.Repeat("x", largeFileSize+1)), 0644)
+	os.WriteFile(filepath.Join(dir, ".gitignore"), []byte("# build output\n/tmp/\n*.log\n!keep.log\n**/gen-*.go\n"), 0644)
+
+	survey, err := surveyRepository(dir, config.DefaultSettings().Exclude)
+	if err != nil {
+		t.Fatalf("surveyRepository failed: %v", err)
+	}
+	if strings.Join(survey.languages, ",") != "Go,TypeScript" {
+		t.Errorf("Expected Go before TypeScript, got %v", survey.languages)
+	}
+	if survey.files != 4 {
+		t.Errorf("Expected 4 files outside the excluded and ignored paths, got %d", survey.files)
+	}
+	if got := strings.Join(survey.ignore, ","); got != "tmp/,.log,fixtures.json,go.sum,web/dist/" {
+		t.Errorf("Unexpected ignore patterns: %s", got)
+	}
+
+	t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+	os.WriteFile(config.IgnorePath(dir), []byte(starterIgnore(survey)), 0644)
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	opts := addCommonFlags(fs)
+	fs.Parse([]string{"-repo", dir, "-exclude", ".git"})
+	_, settings, err := resolveSettings(fs, opts)
+	if err != nil {
+		t.Fatalf("Failed to resolve settings: %v", err)
+	}
+	if got := strings.Join(settings.Exclude, ","); got != ".git,tmp/,.log,fixtures.json,go.sum,web/dist/" {
+		t.Errorf("Expected the ignore file to add to -exclude, got %s", got)
+	}
+}
+
+func TestUsageLedger(t *testing.T) {
+	t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, `{"response":"ok","done":true,"prompt_eval_count":100,"eval_count":10,"total_duration":2000000000}`)
+	}))
+	defer server.Close()
+
+	defer ollama.SetUsageHook(nil)
+	ollama.SetUsageHook(recordUsage("ask"))
+	ollama.NewClient(server.URL, "model-a", 0.7, 0.9).Generate("one", "", false, nil)
+	ollama.NewClient(server.URL, "model-b", 0.7, 0.9).Generate("two", "", false, nil)
+	ollama.SetUsageHook(recordUsage("review"))
+	ollama.NewClient(server.URL, "model-a", 0.7, 0.9).Generate("three", "", false, nil)
+
+	entries, err := readUsage(config.UsagePath(), time.Now().Add(-time.Hour))
+	if err != nil {
+		t.Fatalf("readUsage failed: %v", err)
+	}
+	if len(entries) != 3 || entries[0].Command != "ask" || entries[0].PromptTokens != 100 || entries[0].Duration != 2*time.Second {
+		t.Fatalf("Unexpected ledger entries: %+v", entries)
+	}
+
+	byModel := summarizeUsage(entries, func(e usageEntry) string { return e.Model })
+	if len(byModel) != 2 || byModel[0].key != "model-a" || byModel[0].runs != 2 || byModel[0].responseTokens != 20 {
+		t.Errorf("Unexpected totals by model: %+v", byModel)
+	}
+	byCommand := summarizeUsage(entries, func(e usageEntry) string { return e.Command })
+	if len(byCommand) != 2 || byCommand[1].key != "review" || byCommand[1].promptTokens != 100 {
+		t.Errorf("Unexpected totals by command: %+v", byCommand)
+	}
+
+	if later, _ := readUsage(config.UsagePath(), time.Now().Add(time.Hour)); len(later) != 0 {
+		t.Errorf("Expected entries before the cutoff to be left out, got %d", len(later))
+	}
+}
+
+func TestReviewContextOfRevision(t *testing.T) {
+	repoDir := t.TempDir()
+	if _, err := gitOutput(repoDir, "init", "-q"); err != nil {
+		t.Skipf("git is not available: %v", err)
+	}
+	commit := func(message string) string {
+		gitOutput(repoDir, "add", "-A")
+		if _, err := gitOutput(repoDir, "-c", "user.name=test", "-c", "user.email=test@example.com", "commit", "-q", "-m", message); err != nil {
+			t.Fatal(err)
+		}
+		sha, _ := gitOutput(repoDir, "rev-parse", "HEAD")
+		return strings.TrimSpace(sha)
+	}
+	os.WriteFile(filepath.Join(repoDir, "main.go"), []byte("package main\n"), 0644)
+	base := commit("first")
+	os.WriteFile(filepath.Join(repoDir, "main.go"), []byte("package main\n\nfunc pushed() {}\n"), 0644)
+	head := commit("second")
+
+	// Uncommitted changes are not part of what is pushed
+	os.WriteFile(filepath.Join(repoDir, "main.go"), []byte("package main\n\nfunc pushed() {}\n\nfunc dirty() {}\n"), 0644)
+	os.WriteFile(filepath.Join(repoDir, "notes.go"), []byte("package main\n"), 0644)
+	gitOutput(repoDir, "add", "notes.go")
+
+	context, err := reviewContext(repoDir, base, head)
+	if err != nil {
+		t.Fatalf("reviewContext failed: %v", err)
+	}
+	if !strings.Contains(context, "+func pushed() {}") || strings.Contains(context, "dirty") || strings.Contains(context, "notes.go") {
+		t.Errorf("Expected only the committed change, got:\n%s", context)
+	}
+	if !strings.Contains(context, "File: main.go\n"+strings.Repeat("-", 50)+"\npackage main\n\nfunc pushed() {}\n\n") {
+		t.Errorf("Expected main.go as it is in the revision, got:\n%s", context)
+	}
+
+	// Without a revision the working tree is reviewed
+	if context, err = reviewContext(repoDir, base, ""); err != nil || !strings.Contains(context, "func dirty() {}") || !strings.Contains(context, "File: notes.go") {
+		t.Errorf("Expected the working tree changes, got %v:\n%s", err, context)
+	}
+	if _, err := reviewContext(repoDir, head, head); err == nil {
+		t.Error("Expected a revision without changes to have nothing to review")
+	}
+}
+
+func TestReviewReports(t *testing.T) {
+	findings := []reviewFinding{
+		{File: "main.go", Line: 12, Severity: "error", Comment: "nil map write,\nwill panic: 100%"},
+		{File: "docs/a,b.md", Severity: "info", Comment: "typo"},
+	}
+
+	var buf strings.Builder
+	if err := writeAnnotations(&buf, findings); err != nil {
+		t.Fatalf("writeAnnotations failed: %v", err)
+	}
+	expected := "::error file=main.go,line=12,title=slop-shop review::nil map write,%0Awill panic: 100%25\n" +
+		"::notice file=docs/a%2Cb.md,title=slop-shop review::typo\n"
+	if buf.String() != expected {
+		t.Errorf("Unexpected annotations:\n%s", buf.String())
+	}
+
+	report := sarifReport(findings)
+	results := report.Runs[0].Results
+	if report.Version != "2.1.0" || len(results) != 2 || results[0].Level != "error" || results[1].Level != "note" {
+		t.Fatalf("Unexpected SARIF report: %+v", report)
+	}
+	if region := results[0].Locations[0].PhysicalLocation.Region; region == nil || region.StartLine != 12 {
+		t.Errorf("Expected a region for the finding with a line, got %+v", region)
+	}
+	if results[1].Locations[0].PhysicalLocation.Region != nil {
+		t.Error("Expected no region for a finding without a line")
+	}
+	if rules := report.Runs[0].Tool.Driver.Rules; len(rules) != 1 || rules[0].ID != "review" || results[0].RuleID != "review" {
+		t.Errorf("Expected review findings under the review rule, got %+v", rules)
+	}
+}
+
+func TestLintReports(t *testing.T) {
+	repoPath := t.TempDir()
+	source := "package main\n\n// greet says hi\nfunc greet() {\n\tfmt.Printf(\"%d <b>\\n\", \"x\")\n}\n"
+	if err := os.WriteFile(filepath.Join(repoPath, "main.go"), []byte(source), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	findings := lintFindings([]tools.Diagnostic{
+		{File: "main.go", Line: 5, Column: 2, Message: "wrong type for %d", Source: "go"},
+		{Message: "golangci-lint: config not found", Source: "golangci-lint"},
+	})
+	if len(findings) != 2 || findings[0].File != "" || findings[0].Severity != "error" || findings[1].Severity != "warning" {
+		t.Fatalf("Unexpected lint findings: %+v", findings)
+	}
+	if location := findings[1].location(); location != "main.go:5:2" {
+		t.Errorf("Expected location main.go:5:2, got %s", location)
+	}
+
+	var buf strings.Builder
+	if err := writeAnnotations(&buf, findings[1:]); err != nil {
+		t.Fatalf("writeAnnotations failed: %v", err)
+	}
+	if expected := "::warning file=main.go,line=5,col=2,title=slop-shop lint (go)::wrong type for %25d\n"; buf.String() != expected {
+		t.Errorf("Unexpected annotations:\n%s", buf.String())
+	}
+
+	report := sarifReport(findings)
+	rules := report.Runs[0].Tool.Driver.Rules
+	if len(rules) != 2 || rules[0].ID != "lint/golangci-lint" || rules[1].ID != "lint/go" {
+		t.Errorf("Expected a rule per linter, got %+v", rules)
+	}
+	results := report.Runs[0].Results
+	if len(results[0].Locations) != 0 {
+		t.Errorf("Expected no location for a diagnostic without a file, got %+v", results[0].Locations)
+	}
+	if region := results[1].Locations[0].PhysicalLocation.Region; region == nil || region.StartLine != 5 || region.StartColumn != 2 {
+		t.Errorf("Expected line 5, column 2, got %+v", region)
+	}
+
+	buf.Reset()
+	if err := writeHTML(&buf, findings, repoPath); err != nil {
+		t.Fatalf("writeHTML failed: %v", err)
+	}
+	html := buf.String()
+	for _, expected := range []string{
+		"2 findings",
+		"(no file)",
+		`<span class="badge warning">warning</span> <span class="location">main.go:5:2</span>`,
+		`<span class="comment">// greet says hi</span>`,
+		`<span class="keyword">func</span> greet()`,
+		`<div class="marked"><span class="number-col">5</span>	fmt.Printf(<span class="string">&#34;%d &lt;b&gt;\n&#34;</span>`,
+		`<span class="number-col">6</span>}</div></pre>`,
+	} {
+		if !strings.Contains(html, expected) {
+			t.Errorf("Expected the HTML report to contain %q:\n%s", expected, html)
+		}
+	}
+	if strings.Contains(html, "<b>") {
+		t.Error("Expected code in the HTML report to be escaped")
+	}
+}
+
+func TestRecordHistory(t *testing.T) {
+	defer func() { historyPath, commandName = "", "ask" }()
+	historyPath = filepath.Join(t.TempDir(), "history.db")
+	commandName = "ask"
+
+	first := batchRecord{
+		Model:    "model-a",
+		Prompt:   "why does the config loader panic?",
+		Response: "The loader dereferences a nil map.\nAPPLY_DIFF:\n...",
+		ToolCalls: []tools.ToolCall{
+			{Name: "READ_FILE", Args: "config.go"},
+			{Name: "APPLY_DIFF", Body: "--- a/config.go\n+++ b/config.go\n"},
+		},
+		ToolResults: []tools.ToolResult{
+			{Tool: "READ_FILE", Args: "config.go", Output: "package config", Success: true},
+			{Tool: "APPLY_DIFF", Success: true, FilesChanged: []string{"config.go"}},
+		},
+	}
+	if err := recordHistory(first, "fix", "/src/app"); err != nil {
+		t.Fatalf("recordHistory failed: %v", err)
+	}
+	second := batchRecord{Model: "model-a", Prompt: "add a test for it", Response: "Done."}
+	if err := recordHistory(second, "fix", "/src/app"); err != nil {
+		t.Fatalf("recordHistory failed: %v", err)
+	}
+	if err := recordHistory(batchRecord{Model: "model-b", Prompt: "summarize", Response: "A CLI."}, "", "/src/app"); err != nil {
+		t.Fatalf("recordHistory failed: %v", err)
+	}
+
+	db, err := store.Open(historyPath)
+	if err != nil {
+		t.Fatalf("Failed to open history: %v", err)
+	}
+	defer db.Close()
+
+	conversations, err := db.List(10)
+	if err != nil || len(conversations) != 2 {
+		t.Fatalf("Expected the session to be one conversation and the single run another, got %+v (%v)", conversations, err)
+	}
+
+	fix, err := db.Get(conversations[1].ID)
+	if err != nil {
+		t.Fatalf("Get failed: %v", err)
+	}
+	if fix.Name != "fix" || len(fix.Messages) != 4 || len(fix.ToolCalls) != 2 || len(fix.Patches) != 1 || fix.Patches[0].Files[0] != "config.go" {
+		t.Errorf("Unexpected conversation: %+v", fix)
+	}
+
+	hits, err := db.Search("nil map", 10)
+	if err != nil || len(hits) != 1 || hits[0].Name != "fix" || !strings.Contains(hits[0].Snippet, "[nil] [map]") {
+		t.Errorf("Unexpected search results %+v (%v)", hits, err)
+	}
+	if _, err := db.Search(`"unbalanced`, 10); err != nil {
+		t.Errorf("Expected quotes in a query to be escaped, got %v", err)
+	}
+
+	if err := db.Delete(fix.ID); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+	if hits, _ := db.Search("nil map", 10); len(hits) != 0 {
+		t.Errorf("Expected deleted messages to leave the search index, got %+v", hits)
+	}
+	if err := db.Delete(fix.ID); err == nil {
+		t.Error("Expected deleting a missing conversation to fail")
+	}
+}
+
+func TestExportDataset(t *testing.T) {
+	defer func() { historyPath = "" }()
+	historyPath = filepath.Join(t.TempDir(), "history.db")
+
+	recordHistory(batchRecord{Model: "model-a", Prompt: "what is this?", Response: "A CLI."}, "tour", ".")
+	recordHistory(batchRecord{Model: "model-a", Prompt: "and the tests?", Response: "In main_test.go."}, "tour", ".")
+	recordHistory(batchRecord{Model: "model-a", Prompt: "unanswered", Response: " "}, "", ".")
+
+	db, err := store.Open(historyPath)
+	if err != nil {
+		t.Fatalf("Failed to open history: %v", err)
+	}
+	defer db.Close()
+	list, _ := db.List(10)
+	var conversations []*store.Conversation
+	for i := len(list) - 1; i >= 0; i-- {
+		c, _ := db.Get(list[i].ID)
+		conversations = append(conversations, c)
+	}
+
+	var buf strings.Builder
+	count, err := writeDataset(&buf, conversations, "sharegpt")
+	if err != nil || count != 1 {
+		t.Fatalf("Expected one conversation with a response, got %d (%v)", count, err)
+	}
+	var shareGPT shareGPTConversation
+	json.Unmarshal([]byte(buf.String()), &shareGPT)
+	if len(shareGPT.Conversations) != 4 || shareGPT.Conversations[0].From != "human" || shareGPT.Conversations[3].Value != "In main_test.go." {
+		t.Errorf("Unexpected ShareGPT line: %s", buf.String())
+	}
+
+	buf.Reset()
+	writeDataset(&buf, conversations, "openai")
+	if !strings.HasPrefix(buf.String(), `{"messages":[{"role":"user","content":"what is this?"},{"role":"assistant","content":"A CLI."}`) {
+		t.Errorf("Unexpected OpenAI line: %s", buf.String())
+	}
+}
+
+func TestImportAndReplay(t *testing.T) {
+	t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+	dir := t.TempDir()
+	dataset := filepath.Join(dir, "dataset.jsonl")
+	os.WriteFile(dataset, []byte(
+		`{"id":"tour","conversations":[{"from":"system","value":"Be brief."},{"from":"human","value":"what is this?"},{"from":"gpt","value":"A CLI."},{"from":"human","value":"in which language?"},{"from":"gpt","value":"Rust."}]}`+"\n"+
+			`{"messages":[{"role":"user","content":"hello"},{"role":"assistant","content":"Hi!"}]}`+"\n"), 0644)
+
+	transcripts, err := loadTranscripts(dataset)
+	if err != nil {
+		t.Fatalf("loadTranscripts failed: %v", err)
+	}
+	if len(transcripts) != 2 || transcripts[0].system != "Be brief." || len(transcripts[0].messages) != 4 || transcripts[1].messages[1].Content != "Hi!" {
+		t.Fatalf("Unexpected transcripts: %+v", transcripts)
+	}
+
+	var systems []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var request ollama.Request
+		json.NewDecoder(r.Body).Decode(&request)
+		systems = append(systems, request.System)
+		answer := map[string]string{"what is this?": "A CLI.", "in which language?": "Go.", "hello": "Hi!"}
+		for question, response := range answer {
+			if strings.HasSuffix(request.Prompt, question) {
+				fmt.Fprintf(w, `{"response":%q,"done":true,"context":[1]}`+"\n", response)
+			}
+		}
+	}))
+	defer server.Close()
+
+	db, err := store.Open(filepath.Join(dir, "history.db"))
+	if err != nil {
+		t.Fatalf("Failed to open history: %v", err)
+	}
+	defer db.Close()
+	defer func() { displayWriter, historyPath, quiet = nil, "", false }()
+
+	err = runReplay(db, []string{"-url", server.URL, "-empty-context", "-no-color", "-quiet", "-fail-on-change", dataset})
+	if err == nil || err.Error() != "1 of 3 responses changed" {
+		t.Errorf("Expected one changed response, got %v", err)
+	}
+	if len(systems) != 3 || systems[0] != "Be brief." || systems[2] != "" {
+		t.Errorf("Expected the system prompt of each transcript to be used, got %q", systems)
+	}
+
+	conversations, _ := db.List(10)
+	if len(conversations) != 2 || conversations[0].Command != "replay" {
+		t.Fatalf("Expected each replay to be recorded, got %+v", conversations)
+	}
+	replayed, _ := db.Get(conversations[1].ID)
+	if len(replayed.Messages) != 5 || replayed.Messages[4].Content != "Go." {
+		t.Errorf("Unexpected recorded replay: %+v", replayed.Messages)
+	}
+
+	if diff := compareResponses(0, "Rust.\n", " Rust."); diff != "" {
+		t.Errorf("Expected surrounding whitespace to be ignored, got %s", diff)
+	}
+}
+
+func TestPlugins(t *testing.T) {
+	configDir := t.TempDir()
+	t.Setenv("XDG_CONFIG_HOME", configDir)
+	t.Setenv("SLOP_SHOP_TEST_SECRET", "hunter2")
+	defer clear(pluginCache)
+	repoPath := t.TempDir()
+	pluginDir := filepath.Join(repoPath, ".slopshop", "plugins")
+	os.MkdirAll(pluginDir, 0755)
+	os.WriteFile(filepath.Join(pluginDir, "demo"), []byte(`#!/bin/sh
+read -r request
+case "$request" in
+*'"type":"describe"'*)
+	echo '{"name":"demo","tools":[{"name":"GREET","description":"Greet someone","args":[{"name":"who","required":true}]}],"context":[{"name":"notes"}],"commands":[{"name":"hello","summary":"Say hello"},{"name":"ask"}]}' ;;
+*'"type":"tool"'*)
+	printf '{"output":"%s"}\n' "$(printf '%s' "$request" | sed 's/"/\\"/g')" ;;
+*'"type":"context"'*)
+	echo "{\"output\":\"Deploys happen on Fridays.$SLOP_SHOP_TEST_SECRET\"}" ;;
+*'"type":"command"'*)
+	echo '{"output":"hello from a plugin","error":"exit 3"}' ;;
+esac
+`), 0755)
+	os.WriteFile(filepath.Join(pluginDir, "broken"), []byte("#!/bin/sh\necho nonsense\n"), 0755)
+	os.WriteFile(filepath.Join(pluginDir, "README"), []byte("not executable"), 0644)
+	// A user plugin takes precedence over a repository plugin of the same name
+	userDir := filepath.Join(configDir, "slop-shop", "plugins")
+	os.MkdirAll(userDir, 0755)
+	os.WriteFile(filepath.Join(userDir, "broken"), []byte("#!/bin/sh\nread -r request\necho '{\"name\":\"mine\"}'\n"), 0755)
+
+	// The repository's plugins do not run until it is trusted
+	if plugins := discoverPlugins(repoPath); len(plugins) != 1 || plugins[0].Name != "mine" {
+		t.Fatalf("Expected only the user plugin in an untrusted repository, got %+v", plugins)
+	}
+	clear(pluginCache)
+	if err := config.SetTrusted(repoPath, true); err != nil {
+		t.Fatalf("SetTrusted failed: %v", err)
+	}
+	if !config.IsTrusted(repoPath) {
+		t.Fatal("Expected the repository to be trusted")
+	}
+
+	found := discoverPlugins(repoPath)
+	if len(found) != 2 || found[0].Name != "mine" || found[1].Name != "demo" {
+		t.Fatalf("Expected the user plugin and the demo plugin to be discovered, got %+v", found)
+	}
+	plugins := found[1:]
+
+	defer tools.RegisterCustomTools(nil)
+	if err := tools.RegisterCustomTools(pluginTools(plugins)); err != nil {
+		t.Fatalf("Failed to register plugin tools: %v", err)
+	}
+	results := tools.ExecuteTools("GREET: Ada Lovelace", repoPath, nil)
+	if len(results) != 1 || !results[0].Success || !strings.Contains(results[0].Output, `"args":{"who":"Ada Lovelace"}`) {
+		t.Errorf("Expected the tool request to carry the arguments, got %+v", results)
+	}
+
+	provided, err := pluginContext(plugins, repoPath)
+	if err != nil {
+		t.Fatalf("pluginContext failed: %v", err)
+	}
+	sections := repo.SplitContext(provided)
+	if len(sections) != 1 || sections[0].Name != "plugin:demo/notes" || !strings.Contains(sections[0].Text, "Fridays") {
+		t.Errorf("Expected a context section from the provider, got %+v", sections)
+	}
+	if strings.Contains(provided, "hunter2") {
+		t.Error("Expected plugins to get the scrubbed tool environment")
+	}
+
+	saved := commands
+	defer func() { commands = saved }()
+	registerPluginCommands(plugins)
+	cmd, ok := findCommand("hello")
+	if !ok || len(commands) != len(saved)+1 {
+		t.Fatalf("Expected only the new hello command to be registered")
+	}
+	if cmd.usage != "hello" || cmd.summary != "Say hello" {
+		t.Errorf("Unexpected plugin command %+v", cmd)
+	}
+
+	var out strings.Builder
+	err = runPluginCommand(&out, plugins[0], "hello", nil)
+	if err == nil || !strings.Contains(err.Error(), "exit 3") || out.String() != "hello from a plugin\n" {
+		t.Errorf("Expected the command output and error, got %q and %v", out.String(), err)
+	}
+
+	if err := config.SetTrusted(repoPath, false); err != nil || config.IsTrusted(repoPath) {
+		t.Errorf("Expected the repository to no longer be trusted (%v)", err)
+	}
+}
+
+// staticProvider is a context provider that returns fixed text
+type staticProvider struct {
+	name, text string
+	budgets    *[]int
+}
+
+func (p staticProvider) Name() string { return p.name }
+
+func (p staticProvider) Collect(budget int) ([]repo.ContextSection, error) {
+	*p.budgets = append(*p.budgets, budget)
+	return []repo.ContextSection{{Name: p.name, Text: p.text}}, nil
+}
+
+// fillingProvider is a static provider that fills what is left of the budget
+type fillingProvider struct{ staticProvider }
+
+func (fillingProvider) fills() {}
+
+func TestContextProviders(t *testing.T) {
+	defer setContextProviders(nil, "")
+
+	// Fillers are collected last and get what the others leave, but the
+	// sections keep the configured order
+	var budgets []int
+	context, err := assembleContext([]contextProvider{
+		staticProvider{"a", "AAAA", &budgets},
+		fillingProvider{staticProvider{"b", "BB", &budgets}},
+		staticProvider{"memory", "notes", &budgets},
+		staticProvider{"c", "CCC", &budgets},
+	}, 20)
+	if err != nil {
+		t.Fatalf("assembleContext failed: %v", err)
+	}
+	if context != "AAAABBnotesCCC" {
+		t.Errorf("Unexpected context %q", context)
+	}
+	if fmt.Sprint(budgets) != "[20 16 11 8]" {
+		t.Errorf("Unexpected budgets %v", budgets)
+	}
+
+	repoDir := t.TempDir()
+	if _, err := gitOutput(repoDir, "init", "-q"); err != nil {
+		t.Skipf("git is not available: %v", err)
+	}
+	os.WriteFile(filepath.Join(repoDir, "main.go"), []byte("package main\n"), 0644)
+	gitOutput(repoDir, "add", "-A")
+	if _, err := gitOutput(repoDir, "-c", "user.name=test", "-c", "user.email=test@example.com", "commit", "-q", "-m", "first"); err != nil {
+		t.Fatal(err)
+	}
+	os.WriteFile(filepath.Join(repoDir, "main.go"), []byte("package main\n\nfunc main() {}\n"), 0644)
+	if err := repo.Remember(repoDir, "Keep main small"); err != nil {
+		t.Fatal(err)
+	}
+	settings := config.DefaultSettings()
+	opts := &options{repoPath: repoDir, issueText: "File: issue:kek/shop#7 (Size: 5 bytes)\n" + strings.Repeat("-", 50) + "\nfix!\n\n"}
+
+	// The default providers put the issues before the files and the memory
+	// after them, and leave the memory of the prompts alone
+	if err := setContextProviders(nil, ""); err != nil {
+		t.Fatal(err)
+	}
+	context, err = loadContext(opts, &settings)
+	if err != nil {
+		t.Fatalf("loadContext failed: %v", err)
+	}
+	var names []string
+	for _, section := range repo.SplitContext(context) {
+		names = append(names, section.Name)
+	}
+	if strings.Join(names, ",") != "issue:kek/shop#7,main.go,memory:.slopshop/memory.md" {
+		t.Errorf("Unexpected sections %v in:\n%s", names, context)
+	}
+	if !strings.Contains(context, "- Keep main small") || ollama.Memory() != "" {
+		t.Errorf("Expected the memory notes in the context only, got %q", ollama.Memory())
+	}
+
+	// Configured providers replace the defaults, and the flag replaces those
+	if err := setContextProviders([]string{"files"}, "diff,files"); err != nil {
+		t.Fatal(err)
+	}
+	if context, err = loadContext(opts, &settings); err != nil {
+		t.Fatalf("loadContext failed: %v", err)
+	}
+	if !strings.HasPrefix(context, "File: git:diff HEAD") || !strings.Contains(context, "+func main() {}") || strings.Contains(context, "issue:") {
+		t.Errorf("Expected the diff before the files and no issues, got:\n%s", context)
+	}
+	if strings.Contains(context, "Keep main small") {
+		t.Errorf("Expected no memory without the memory provider, got:\n%s", context)
+	}
+
+	if err := setContextProviders([]string{"files", "tickets"}, ""); err == nil || !strings.Contains(err.Error(), "diff, files, issues, memory, plugins") {
+		t.Errorf("Expected an unknown provider to be rejected, got %v", err)
+	}
+}
+
+func TestProjectMemory(t *testing.T) {
+	repoPath := t.TempDir()
+	os.WriteFile(filepath.Join(repoPath, "main.go"), []byte("package main\n"), 0644)
+	defer ollama.SetMemory("")
+
+	results := tools.ExecuteTools("REMEMBER: Use   table-driven tests", repoPath, nil)
+	if len(results) != 1 || !results[0].Success {
+		t.Fatalf("Expected REMEMBER to succeed, got %+v", results)
+	}
+	if err := repo.Remember(repoPath, "Errors are wrapped with %v"); err != nil {
+		t.Fatalf("Remember failed: %v", err)
+	}
+
+	notes, err := repo.LoadMemory(repoPath)
+	if err != nil {
+		t.Fatalf("LoadMemory failed: %v", err)
+	}
+	if !strings.HasPrefix(notes, "# Project Memory") || !strings.HasSuffix(notes, "- Use table-driven tests\n- Errors are wrapped with %v") {
+		t.Errorf("Unexpected memory file:\n%s", notes)
+	}
+	if err := repo.Remember(repoPath, "  \n"); err == nil {
+		t.Error("Expected an empty note to be rejected")
+	}
+
+	prompt := ollama.BuildPrompt("how are errors handled?", "context", false)
+	if !strings.Contains(prompt, "Project Memory (notes kept from earlier sessions):\n# Project Memory") {
+		t.Errorf("Expected the memory in the prompt, got:\n%s", prompt)
+	}
+
+	files, err := repo.ReadRepository(repoPath, nil)
+	if err != nil {
+		t.Fatalf("ReadRepository failed: %v", err)
+	}
+	if len(files) != 1 || files[0].Path != "main.go" {
+		t.Errorf("Expected the memory file to be left out of the context, got %+v", files)
+	}
+}
+
+func TestToolInstructionModes(t *testing.T) {
+	defer ollama.SetToolInstructions("always")
+	explain, act := "how are errors handled?", "fix the failing test"
+
+	prompt := ollama.BuildPrompt(explain, "Repository Contents:\nFile: a.go\n", true)
+	if !strings.Contains(prompt, "AVAILABLE TOOLS:") || strings.Count(prompt, "File: a.go") != 1 || !strings.HasSuffix(prompt, "User request: "+explain) {
+		t.Errorf("Expected the instructions once, without the context repeated, got:\n%s", prompt)
+	}
+
+	if err := ollama.SetToolInstructions("auto"); err != nil {
+		t.Fatal(err)
+	}
+	if prompt := ollama.BuildPrompt(explain, "", true); strings.Contains(prompt, "AVAILABLE TOOLS:") {
+		t.Errorf("Expected no instructions for a question, got:\n%s", prompt)
+	}
+	if prompt := ollama.BuildPrompt(act, "", true); !strings.Contains(prompt, "AVAILABLE TOOLS:") {
+		t.Errorf("Expected the instructions for a task, got:\n%s", prompt)
+	}
+	if system := ollama.BuildSystem("Be brief.", true); system != "Be brief." {
+		t.Errorf("Expected the system prompt unchanged, got %q", system)
+	}
+
+	if err := ollama.SetToolInstructions("system"); err != nil {
+		t.Fatal(err)
+	}
+	if prompt := ollama.BuildPrompt(act, "", true); strings.Contains(prompt, "AVAILABLE TOOLS:") {
+		t.Errorf("Expected no instructions in the prompt, got:\n%s", prompt)
+	}
+	if system := ollama.BuildSystem("Be brief.", true); !strings.HasPrefix(system, "Be brief.\n\nAVAILABLE TOOLS:") {
+		t.Errorf("Expected the instructions after the system prompt, got %q", system)
+	}
+	if system := ollama.BuildSystem("Be brief.", false); system != "Be brief." {
+		t.Errorf("Expected no instructions without tools, got %q", system)
+	}
+	if preview := tui.RenderPreview("m", "", act, "", true, false); !strings.Contains(preview, "Tool instructions (system)") {
+		t.Errorf("Expected the preview to count the instructions in the system prompt, got:\n%s", preview)
+	}
+
+	if err := ollama.SetToolInstructions("sometimes"); err == nil {
+		t.Error("Expected an unknown mode to be rejected")
+	}
+}
+
+func TestResponseCache(t *testing.T) {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		fmt.Fprintf(w, `{"response":"answer %d","done":true,"eval_count":5}`+"\n", requests)
+	}))
+	defer server.Close()
+
+	dir := t.TempDir()
+	defer ollama.SetCache("", 0)
+	ollama.SetCache(dir, time.Hour)
+
+	client := ollama.NewClient(server.URL, "model-a", 0.7, 0.9)
+	first, stats, err := client.GenerateWithStats("explain", "File: main.go", false, nil)
+	if err != nil || first != "answer 1" || stats.Cached {
+		t.Fatalf("Expected the first request to reach the server, got %q, %+v, %v", first, stats, err)
+	}
+
+	var chunks []string
+	second, stats, err := client.GenerateWithStats("explain", "File: main.go", false, func(chunk string) { chunks = append(chunks, chunk) })
+	if err != nil || second != "answer 1" || !stats.Cached || stats.ResponseTokens != 5 || requests != 1 {
+		t.Errorf("Expected the identical request to be answered from the cache, got %q, %+v after %d requests", second, stats, requests)
+	}
+	if strings.Join(chunks, "") != "answer 1" {
+		t.Errorf("Expected the cached response to be streamed, got %q", chunks)
+	}
+
+	client.Temperature = 0.2
+	if response, _, _ := client.GenerateWithStats("explain", "File: main.go", false, nil); response != "answer 2" {
+		t.Errorf("Expected different options to miss the cache, got %q", response)
+	}
+
+	other := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, `{"response":"another server","done":true}`)
+	}))
+	defer other.Close()
+	otherClient := ollama.NewClient(other.URL, "model-a", 0.7, 0.9)
+	if response, _, _ := otherClient.GenerateWithStats("explain", "File: main.go", false, nil); response != "another server" {
+		t.Errorf("Expected another server to miss the cache, got %q", response)
+	}
+
+	ollama.SetCache(dir, time.Nanosecond)
+	if response, _, _ := client.GenerateWithStats("explain", "File: main.go", false, nil); response != "answer 3" {
+		t.Errorf("Expected an expired entry to miss the cache, got %q", response)
+	}
+
+	ollama.SetCache("", 0)
+	if response, _, _ := client.GenerateWithStats("explain", "File: main.go", false, nil); response != "answer 4" {
+		t.Errorf("Expected a disabled cache to always ask the server, got %q", response)
+	}
+}
+
+func TestRunRepos(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var request ollama.Request
+		json.NewDecoder(r.Body).Decode(&request)
+		answer := "no services"
+		if i := strings.Index(request.Prompt, "File: "); i >= 0 {
+			answer = "saw " + strings.Fields(request.Prompt[i+6:])[0]
+		}
+		fmt.Fprintf(w, `{"response":%q,"done":true}`+"\n", answer)
+	}))
+	defer server.Close()
+
+	dir := t.TempDir()
+	for _, name := range []string{"billing", "search"} {
+		os.MkdirAll(filepath.Join(dir, name), 0755)
+		os.WriteFile(filepath.Join(dir, name, name+".go"), []byte("package "+name+"\n"), 0644)
+	}
+	repos := []string{filepath.Join(dir, "billing"), filepath.Join(dir, "missing"), filepath.Join(dir, "search")}
+
+	var out strings.Builder
+	displayWriter, quiet = &out, true
+	defer func() { displayWriter, quiet = nil, false }()
+
+	settings := config.DefaultSettings()
+	settings.URL = server.URL
+	err := runRepos("audit the logging", "", repos, &settings, 2)
+	if err == nil || err.Error() != "1 of 3 repositories failed" || exitCode(err) != exitFailure {
+		t.Errorf("Expected the missing repository to fail the run, got %v", err)
+	}
+
+	report := out.String()
+	billing := strings.Index(report, "## "+repos[0]+"\n\nsaw billing.go")
+	missing := strings.Index(report, "## "+repos[1]+"\n\nError: error reading repository")
+	search := strings.Index(report, "## "+repos[2]+"\n\nsaw search.go")
+	if billing < 0 || missing < billing || search < missing {
+		t.Errorf("Expected a section per repository in the given order, got:\n%s", report)
+	}
+}
+
+func TestEmbeddingIndex(t *testing.T) {
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+	var embedded []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var request struct {
+			Model string   `json:"model"`
+			Input []string `json:"input"`
+		}
+		json.NewDecoder(r.Body).Decode(&request)
+		var vectors [][]float32
+		for _, input := range request.Input {
+			embedded = append(embedded, strings.SplitN(input, "\n", 2)[0])
+			vectors = append(vectors, []float32{float32(strings.Count(input, "billing")), float32(strings.Count(input, "search")), 0.1})
+		}
+		json.NewEncoder(w).Encode(map[string]any{"embeddings": vectors})
+	}))
+	defer server.Close()
+
+	repoPath := t.TempDir()
+	os.WriteFile(filepath.Join(repoPath, "billing.go"), []byte("package billing\n"), 0644)
+	os.WriteFile(filepath.Join(repoPath, "search.go"), []byte("package search\n"), 0644)
+	os.WriteFile(filepath.Join(repoPath, "notes.md"), []byte("# Notes\n"), 0644)
+	settings := config.DefaultSettings()
+	settings.URL = server.URL
+	quiet = true
+	defer func() { quiet = false }()
+
+	if _, err := retrieveContext("how is billing done", 1, repoPath, &settings); err == nil || !strings.Contains(err.Error(), "run slop-shop embed first") {
+		t.Errorf("Expected retrieval without an index to fail, got %v", err)
+	}
+
+	refresh := func() refreshStats {
+		index, _, err := loadEmbeddingIndex(repoPath)
+		if err != nil {
+			t.Fatalf("loadEmbeddingIndex failed: %v", err)
+		}
+		files, _ := readIndexedFiles(repoPath, &settings)
+		stats, err := refreshEmbeddingIndex(index, files, "embedder", &settings)
+		if err != nil {
+			t.Fatalf("refreshEmbeddingIndex failed: %v", err)
+		}
+		return stats
+	}
+	if stats := refresh(); stats != (refreshStats{Embedded: 3, Chunks: 3}) {
+		t.Errorf("Expected every file to be embedded, got %+v", stats)
+	}
+
+	embedded = nil
+	os.WriteFile(filepath.Join(repoPath, "search.go"), []byte("package search\n\nfunc Search() {}\n"), 0644)
+	os.Remove(filepath.Join(repoPath, "notes.md"))
+	if stats := refresh(); stats != (refreshStats{Embedded: 1, Chunks: 1, Removed: 1, Unchanged: 1}) {
+		t.Errorf("Expected only the changed file to be embedded again, got %+v", stats)
+	}
+	if strings.Join(embedded, ",") != "search.go" {
+		t.Errorf("Expected only search.go to be sent for embedding, got %v", embedded)
+	}
+
+	embedded = nil
+	context, err := retrieveContext("how is billing done", 1, repoPath, &settings)
+	if err != nil {
+		t.Fatalf("retrieveContext failed: %v", err)
+	}
+	if !strings.Contains(context, "File: billing.go:1-1 ") || strings.Contains(context, "search.go") {
+		t.Errorf("Expected the billing chunk as the only context, got %q", context)
+	}
+	if strings.Join(embedded, ",") != "how is billing done" {
+		t.Errorf("Expected only the prompt to be embedded for an unchanged repository, got %v", embedded)
+	}
+}
+
+func TestContextWindowOverflow(t *testing.T) {
+	var generated []ollama.Request
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/api/show" {
+			fmt.Fprint(w, `{"parameters":"num_ctx 3000\nstop \"<|end|>\"","model_info":{"llama.context_length":131072}}`)
+			return
+		}
+		var request ollama.Request
+		json.NewDecoder(r.Body).Decode(&request)
+		generated = append(generated, request)
+		fmt.Fprint(w, `{"response":"ok","done":true}`+"\n")
+	}))
+	defer server.Close()
+	quiet = true
+	defer func() { quiet = false }()
+	defer ollama.SetNumCtx(0)
+
+	context := repo.CreateContext([]repo.FileInfo{{Path: "big.txt", Content: strings.Repeat("lorem ipsum ", 2000), Size: 24000}})
+	_, err := runBatch("summarize", context, server.URL, "llama", "", 0.7, 0.9, false, t.TempDir())
+	if err == nil {
+		t.Fatal("Expected the request to be refused")
+	}
+	for _, expected := range []string{"context window of 3000 tokens", "big.txt", "-retrieve N", "-outline", "-num-ctx 8192 (llama supports up to 131072 tokens)"} {
+		if !strings.Contains(err.Error(), expected) {
+			t.Errorf("Expected %q in the error, got:\n%v", expected, err)
+		}
+	}
+	if len(generated) != 0 {
+		t.Errorf("Expected nothing to be sent, got %d requests", len(generated))
+	}
+
+	ollama.SetNumCtx(8192)
+	if _, err := runBatch("summarize", context, server.URL, "llama", "", 0.7, 0.9, false, t.TempDir()); err != nil {
+		t.Fatalf("Expected the request to fit the raised window, got %v", err)
+	}
+	if len(generated) != 1 || generated[0].Options.NumCtx != 8192 {
+		t.Errorf("Expected one request with num_ctx 8192, got %+v", generated)
+	}
+}
+
+func TestGitHooks(t *testing.T) {
+	repoDir := t.TempDir()
+	if _, err := gitOutput(repoDir, "init", "-q"); err != nil {
+		t.Skipf("git is not available: %v", err)
+	}
+	dir, err := hooksDir(repoDir)
+	if err != nil {
+		t.Fatalf("hooksDir failed: %v", err)
+	}
+	os.MkdirAll(dir, 0755)
+	prePush := filepath.Join(dir, "pre-push")
+	os.WriteFile(prePush, []byte("#!/bin/sh\necho mine\n"), 0755)
+
+	// A stand-in for slop-shop that writes a message for commit, and for review
+	// saves its arguments to $ARGS and exits with $STATUS
+	binary := filepath.Join(t.TempDir(), "slop-shop")
+	os.WriteFile(binary, []byte(`#!/bin/sh
+[ "$1" = review ] && echo "$@" >"$ARGS" && exit $STATUS
+while [ $# -gt 0 ]; do
+	[ "$1" = -out ] && printf 'Add greeting\n' >"$2"
+	shift
+done
+`), 0755)
+
+	if err := installHook(prePush, hookScript("pre-push", binary, "warning"), false); err == nil {
+		t.Error("Expected an existing hook to be kept without -force")
+	}
+	if err := installHook(prePush, hookScript("pre-push", binary, "warning"), true); err != nil {
+		t.Fatalf("installHook failed: %v", err)
+	}
+	commitMsg := filepath.Join(dir, "prepare-commit-msg")
+	installHook(commitMsg, hookScript("prepare-commit-msg", binary, ""), false)
+	if hookStatus(prePush) != "installed" || hookStatus(commitMsg) != "installed" {
+		t.Errorf("Expected both hooks to be installed")
+	}
+
+	message := filepath.Join(t.TempDir(), "COMMIT_EDITMSG")
+	os.WriteFile(message, []byte("\n# Please enter the commit message\n"), 0644)
+	if output, err := exec.Command("sh", commitMsg, message, "").CombinedOutput(); err != nil {
+		t.Fatalf("prepare-commit-msg failed: %v\n%s", err, output)
+	}
+	if content, _ := os.ReadFile(message); string(content) != "Add greeting\n\n# Please enter the commit message\n" {
+		t.Errorf("Expected the generated message above the template, got %q", content)
+	}
+
+	sha, remote := strings.Repeat("1", 40), strings.Repeat("2", 40)
+	args := filepath.Join(t.TempDir(), "args")
+	for status, blocked := range map[int]bool{0: false, exitFindings: true, exitConnection: false} {
+		cmd := exec.Command("sh", prePush, "origin", "url")
+		cmd.Dir = repoDir
+		cmd.Env = append(os.Environ(), fmt.Sprintf("STATUS=%d", status), "ARGS="+args)
+		cmd.Stdin = strings.NewReader("refs/heads/main " + sha + " refs/heads/main " + remote + "\n")
+		if err := cmd.Run(); (err != nil) != blocked {
+			t.Errorf("Expected review exit code %d to block the push: %v, got %v", status, blocked, err)
+		}
+	}
+	// The commits being pushed are reviewed rather than the working tree
+	if reviewed, _ := os.ReadFile(args); !strings.Contains(string(reviewed), "-base "+remote+" -head "+sha) {
+		t.Errorf("Expected the pushed range to be reviewed, got %q", reviewed)
+	}
+	if !strings.Contains(hookScript("pre-push", binary, "warning"), "-fail-on warning") {
+		t.Error("Expected the pre-push hook to use the -fail-on severity")
+	}
+
+	restored, err := uninstallHook(prePush)
+	if err != nil || !restored {
+		t.Fatalf("Expected the previous pre-push hook to be restored, got %v, %v", restored, err)
+	}
+	if content, _ := os.ReadFile(prePush); string(content) != "#!/bin/sh\necho mine\n" {
+		t.Errorf("Unexpected restored hook %q", content)
+	}
+	if _, err := uninstallHook(prePush); err == nil {
+		t.Error("Expected a hook not installed by slop-shop to be left alone")
+	}
+	if restored, err := uninstallHook(commitMsg); err != nil || restored || hookStatus(commitMsg) != "not installed" {
+		t.Errorf("Expected prepare-commit-msg to be removed, got %v, %v", restored, err)
+	}
+}
+
+func TestAttachFiles(t *testing.T) {
+	repoPath := t.TempDir()
+	os.MkdirAll(filepath.Join(repoPath, "cmd"), 0755)
+	os.WriteFile(filepath.Join(repoPath, "main.go"), []byte("package main\n"), 0644)
+	os.WriteFile(filepath.Join(repoPath, "cmd", "run.go"), []byte("package cmd\n"), 0644)
+	os.WriteFile(filepath.Join(repoPath, "README.md"), []byte("# Example\n"), 0644)
+	os.WriteFile(filepath.Join(repoPath, "logo.png"), []byte{0x89, 'P', 'N', 'G', 0, 0}, 0644)
+	settings := config.DefaultSettings()
+
+	context, err := loadContext(&options{repoPath: repoPath, attach: "cmd/run.go, " + filepath.Join(repoPath, "main.go")}, &settings)
+	if err != nil {
+		t.Fatalf("loadContext failed: %v", err)
+	}
+	var names []string
+	for _, section := range repo.SplitContext(context) {
+		if section.Name != "" {
+			names = append(names, section.Name)
+		}
+	}
+	if strings.Join(names, ",") != filepath.Join("cmd", "run.go")+",main.go" {
+		t.Errorf("Expected only the attached files, named as in the repository, got %v", names)
+	}
+
+	for attach, expected := range map[string]string{"missing.go": "error reading missing.go", "logo.png": "not a text file"} {
+		if _, err := loadContext(&options{repoPath: repoPath, attach: attach}, &settings); err == nil || !strings.Contains(err.Error(), expected) {
+			t.Errorf("Expected %q for -attach %s, got %v", expected, attach, err)
+		}
+	}
+	if _, err := loadContext(&options{repoPath: repoPath, attach: "main.go", emptyContext: true}, &settings); err == nil {
+		t.Error("Expected -attach to be rejected with -empty-context")
+	}
+}
+
+func TestOutlineContext(t *testing.T) {
+	repoPath := t.TempDir()
+	sources := map[string]string{
+		"app.py":     "import os\n\nLIMIT = 10\n\nclass Store:\n    \"\"\"Keeps items.\n\n    def not_a_method(self):\n    \"\"\"\n\n    def add(self, item):\n        def helper():\n            pass\n        return helper\n\nasync def main():\n    pass\n",
+		"web/api.ts": "export interface Item {\n  id: number;\n}\n\nexport class Client {\n  private base: string;\n\n  async fetch(id: number): Promise<Item> {\n    if (id) {\n      return get(id)\n    }\n  }\n}\n\nexport function get(id: number) {\n  return id;\n}\n",
+		"src/lib.rs": "pub struct Parser {\n    pos: usize,\n}\n\nimpl Parser {\n    pub fn new() -> Self {\n        fn inner() {}\n        Parser { pos: 0 }\n    }\n}\n\npub fn parse(input: &str) -> Parser {\n    Parser::new()\n}\n",
+		"Main.java":  "package demo;\n\npublic class Main {\n    private int count;\n\n    public static void main(String[] args) {\n        if (args.length > 0) {\n            run(args);\n        }\n    }\n\n    private static List<String> run(String[] args) {\n        return null;\n    }\n}\n",
+		"notes.txt":  "class NotCode:\n",
+	}
+	for name, content := range sources {
+		os.MkdirAll(filepath.Dir(filepath.Join(repoPath, name)), 0755)
+		os.WriteFile(filepath.Join(repoPath, name), []byte(content), 0644)
+	}
+
+	index := repo.NewIndex(repoPath, nil)
+	if err := index.Update(); err != nil {
+		t.Fatalf("Update failed: %v", err)
+	}
+	for name, expected := range map[string]string{
+		"LIMIT": "app.py:3", "Store": "app.py:5", "Store.add": "app.py:11", "main": "Main.java:6,app.py:16",
+		"Item": "web/api.ts:1", "Client.fetch": "web/api.ts:8", "get": "web/api.ts:15",
+		"Parser": "src/lib.rs:1", "Parser.new": "src/lib.rs:6", "parse": "src/lib.rs:12",
+		"Main.main": "Main.java:6", "Main.run": "Main.java:12",
+	} {
+		definitions, _ := index.Lookup(name)
+		var found []string
+		for _, symbol := range definitions {
+			found = append(found, fmt.Sprintf("%s:%d", symbol.File, symbol.Line))
+		}
+		if strings.Join(found, ",") != expected {
+			t.Errorf("Expected %s to be defined at %s, got %v", name, expected, found)
+		}
+	}
+	for _, name := range []string{"not_a_method", "Store.helper", "helper", "inner", "Main.count", "NotCode"} {
+		if definitions, _ := index.Lookup(name); len(definitions) > 0 {
+			t.Errorf("Expected no definition of %s, got %v", name, definitions)
+		}
+	}
+	if _, references := index.Lookup("get"); len(references) != 1 || references[0].Line != 10 {
+		t.Errorf("Expected the call of get as its reference, got %v", references)
+	}
+
+	settings := config.DefaultSettings()
+	context, err := loadContext(&options{repoPath: repoPath, outline: true}, &settings)
+	if err != nil {
+		t.Fatalf("loadContext failed: %v", err)
+	}
+	sections := make(map[string]string)
+	for _, section := range repo.SplitContext(context) {
+		sections[section.Name] = section.Text
+	}
+	if text := sections["src/lib.rs"]; !strings.Contains(text, "Outline of rust") || !strings.Contains(text, "  6: pub fn new() -> Self\n") || strings.Contains(text, "pos: 0") {
+		t.Errorf("Expected an outline of lib.rs, got %q", text)
+	}
+	if text := sections["notes.txt"]; !strings.Contains(text, "class NotCode:") {
+		t.Errorf("Expected other files to be sent whole, got %q", text)
+	}
+}
+
+func TestPatchMode(t *testing.T) {
+	repoPath := t.TempDir()
+	os.WriteFile(filepath.Join(repoPath, "greet.go"), []byte("package greet\n\nconst Hello = \"hello\"\n"), 0644)
+
+	good := "--- a/greet.go\n+++ b/greet.go\n@@ -1,3 +1,3 @@\n package greet\n \n-const Hello = \"hello\"\n+const Hello = \"hi\"\n"
+	answers := []string{
+		good + "\nThis changes the greeting.\n",
+		"--- a/greet.go\n+++ b/greet.go\n@@ -1,3 +1,3 @@\n package welcome\n \n-const Hello = \"hello\"\n+const Hello = \"hi\"\n",
+		"```diff\n" + good + "```",
+	}
+	var requests []ollama.Request
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var request ollama.Request
+		json.NewDecoder(r.Body).Decode(&request)
+		requests = append(requests, request)
+		answer := "I cannot do that."
+		if len(requests) <= len(answers) {
+			answer = answers[len(requests)-1]
+		}
+		fmt.Fprintf(w, `{"response":%q,"done":true,"context":[%d]}`+"\n", answer, len(requests))
+	}))
+	defer server.Close()
+
+	patch := filepath.Join(t.TempDir(), "change.patch")
+	patchFile, quiet, historyPath = patch, true, ""
+	defer func() { patchFile, quiet = "", false }()
+
+	settings := config.DefaultSettings()
+	settings.URL = server.URL
+	if err := runPatchMode("say hi", "File: greet.go", &settings, repoPath); err != nil {
+		t.Fatalf("runPatchMode failed: %v", err)
+	}
+	if content, _ := os.ReadFile(patch); string(content) != good {
+		t.Errorf("Expected the accepted diff without the fence, got %q", content)
+	}
+	if content, _ := os.ReadFile(filepath.Join(repoPath, "greet.go")); !strings.Contains(string(content), `"hello"`) {
+		t.Error("Expected the repository to be left unchanged")
+	}
+
+	if len(requests) != 3 || !strings.HasPrefix(requests[0].System, patchSystemPrompt) {
+		t.Fatalf("Expected three requests with the patch system prompt, got %d", len(requests))
+	}
+	if !strings.Contains(requests[1].Prompt, "text outside the diff") || len(requests[1].Context) != 1 || strings.Contains(requests[1].Prompt, "File: greet.go") {
+		t.Errorf("Expected the retry to continue the conversation with the reason, got %q", requests[1].Prompt)
+	}
+	if !strings.Contains(requests[2].Prompt, "failed to apply change to greet.go") {
+		t.Errorf("Expected a diff that does not apply to be rejected, got %q", requests[2].Prompt)
+	}
+
+	err := runPatchMode("say hi", "File: greet.go", &settings, repoPath)
+	if err == nil || exitCode(err) != exitModel {
+		t.Errorf("Expected a model failure after %d rejected answers, got %v", patchAttempts, err)
+	}
+}
+
+func TestInteractiveConflictResolver(t *testing.T) {
+	var prompts []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var request ollama.Request
+		json.NewDecoder(r.Body).Decode(&request)
+		prompts = append(prompts, request.Prompt)
+		fmt.Fprintln(w, `{"response":"`+"```go\\nconst Hello = \\\"hi\\\"\\n```"+`","done":true}`)
+	}))
+	defer server.Close()
+
+	var out strings.Builder
+	displayWriter = &out
+	defer func() { displayWriter, conflictInput = nil, os.Stdin }()
+
+	settings := config.DefaultSettings()
+	settings.URL = server.URL
+	resolve := newConflictResolver(&settings)
+	conflict := tools.HunkConflict{
+		File:     "greet.go",
+		Hunk:     "@@ -3,1 +3,1 @@\n-const Hello = \"hello\"\n+const Hello = \"hi\"\n",
+		Line:     3,
+		Expected: []string{`const Hello = "hello"`},
+		Actual:   []string{`const Hello = "hey"`},
+		Intended: []string{`const Hello = "hi"`},
+	}
+
+	conflictInput = strings.NewReader("what\nr\ny\n")
+	resolution, err := resolve(conflict)
+	if err != nil || resolution.Skip || strings.Join(resolution.Lines, "\n") != `const Hello = "hi"` {
+		t.Errorf("Expected the regenerated lines, got %+v, %v", resolution, err)
+	}
+	if len(prompts) != 1 || !strings.Contains(prompts[0], "The file has these lines there now:\n\nconst Hello = \"hey\"") {
+		t.Errorf("Expected the model to see the current lines, got %q", prompts)
+	}
+	if !strings.Contains(out.String(), "A hunk does not match greet.go at line 3") {
+		t.Errorf("Expected the conflict to be shown, got:\n%s", out.String())
+	}
+
+	conflictInput = strings.NewReader("r\nn\ns\n")
+	if resolution, err := resolve(conflict); err != nil || !resolution.Skip {
+		t.Errorf("Expected a rejected proposal to return to the choices, got %+v, %v", resolution, err)
+	}
+
+	t.Setenv("VISUAL", "")
+	t.Setenv("EDITOR", "sed -i s/hey/howdy/")
+	conflictInput = strings.NewReader("e\ny\n")
+	if resolution, err := resolve(conflict); err != nil || strings.Join(resolution.Lines, "\n") != `const Hello = "howdy"` {
+		t.Errorf("Expected the edited lines, got %+v, %v", resolution, err)
+	}
+
+	conflictInput = strings.NewReader("a\n")
+	if _, err := resolve(conflict); err == nil || !strings.Contains(err.Error(), "aborted") {
+		t.Errorf("Expected abort to fail the diff, got %v", err)
+	}
+	conflictInput = strings.NewReader("")
+	if _, err := resolve(conflict); err == nil {
+		t.Error("Expected the end of input to fail the diff")
+	}
+}
+
+func TestScanProgress(t *testing.T) {
+	repoPath := t.TempDir()
+	os.MkdirAll(filepath.Join(repoPath, "internal", "store"), 0755)
+	os.WriteFile(filepath.Join(repoPath, "main.go"), []byte("package main\n"), 0644)
+	os.WriteFile(filepath.Join(repoPath, "internal", "store", "store.go"), []byte("package store\n"), 0644)
+
+	var reports []repo.ScanProgress
+	files, err := repo.ReadRepositoryProgress(repoPath, nil, func(p repo.ScanProgress) {
+		reports = append(reports, p)
+	})
+	if err != nil || len(files) != 2 {
+		t.Fatalf("Expected 2 files, got %d (%v)", len(files), err)
+	}
+	if len(reports) != 2 || reports[1].Files != 2 || reports[1].Bytes != 27 {
+		t.Errorf("Expected a report per file with running totals, got %+v", reports)
+	}
+	if got := describeScan(repo.ScanProgress{Files: 2, Bytes: 2048, Dir: filepath.Join("internal", "store")}); got != "Scanning repository: 2 files, 2.0 KB · internal/store" {
+		t.Errorf("Unexpected progress line %q", got)
+	}
+
+	// The REPL's loading screen receives the progress as status lines
+	defer func() { showProgress, scanStatus = false, nil }()
+	showProgress = true
+	var statuses []string
+	scanStatus = func(status string) { statuses = append(statuses, status) }
+	settings := config.DefaultSettings()
+	if _, err := loadContext(&options{repoPath: repoPath}, &settings); err != nil {
+		t.Fatalf("loadContext failed: %v", err)
+	}
+	if len(statuses) != 1 || !strings.HasPrefix(statuses[0], "Scanning repository: 1 files") {
+		t.Errorf("Expected the first file to be reported and the rest throttled, got %q", statuses)
+	}
+}
+
+func TestInterruptedBatch(t *testing.T) {
+	t.Setenv("XDG_DATA_HOME", t.TempDir())
+	ctx, cancel := context.WithCancel(context.Background())
+	defer func() {
+		shutdown = context.Background()
+		ollama.SetContext(context.Background())
+		tools.SetContext(context.Background())
+	}()
+	shutdown = ctx
+	ollama.SetContext(ctx)
+	tools.SetContext(ctx)
+
+	// The model sends part of its answer, then stalls until the run is interrupted
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, `{"response":"The first half"}`)
+		w.(http.Flusher).Flush()
+		time.AfterFunc(50*time.Millisecond, cancel)
+		<-r.Context().Done()
+	}))
+	defer server.Close()
+
+	defer func() { displayWriter, historyPath = nil, "" }()
+	displayWriter = io.Discard
+	historyPath = config.HistoryPath()
+
+	response, err := runBatch("explain the parser", "", server.URL, "test-model", "", 0.7, 0.9, false, ".")
+	if exitCode(err) != exitInterrupted {
+		t.Errorf("Expected exit code %d, got %d (%v)", exitInterrupted, exitCode(err), err)
+	}
+	if response != "The first half" {
+		t.Errorf("Expected the partial response, got %q", response)
+	}
+
+	db, err := store.Open(historyPath)
+	if err != nil {
+		t.Fatalf("Failed to open history: %v", err)
+	}
+	defer db.Close()
+	if conversations, err := db.List(10); err != nil || len(conversations) != 1 {
+		t.Errorf("Expected the interrupted run to be recorded, got %+v (err: %v)", conversations, err)
+	}
+
+	// Tool calls after an interruption are skipped instead of run
+	defer tools.SetProgressOutput(nil)
+	tools.SetProgressOutput(io.Discard)
+	results := tools.ExecuteTools("RUN_COMMAND: touch should-not-exist", t.TempDir(), nil)
+	if len(results) != 1 || results[0].Success || !strings.Contains(results[0].Output, "interrupted") {
+		t.Errorf("Expected the tool call to be skipped, got %+v", results)
+	}
+}
+
+func TestWaitingSpinner(t *testing.T) {
+	var buf strings.Builder
+	stop := startWaiting(&buf, "big-model", "🤖 ", true)
+	time.Sleep(250 * time.Millisecond)
+	stop()
+	stop()
+
+	output := buf.String()
+	if !strings.Contains(output, "Waiting for big-model (prompt eval…) 0s") || strings.Count(output, "\r\033[K") < 3 {
+		t.Errorf("Expected the spinner to be redrawn with the elapsed time, got %q", output)
+	}
+	if !strings.HasSuffix(output, "\r\033[K🤖 ") {
+		t.Errorf("Expected the spinner to be cleared and the prompt restored once, got %q", output)
+	}
+
+	buf.Reset()
+	startWaiting(&buf, "big-model", "🤖 ", false)()
+	if buf.Len() != 0 {
+		t.Errorf("Expected no output when disabled, got %q", buf.String())
+	}
+}
+
+func TestColorDepth(t *testing.T) {
+	tests := []struct {
+		term, colorTerm string
+		want            termenv.Profile
+	}{
+		{"", "", termenv.Ascii},
+		{"dumb", "truecolor", termenv.Ascii},
+		{"vt100", "", termenv.Ascii},
+		{"xterm-mono", "", termenv.Ascii},
+		{"linux", "", termenv.ANSI},
+		{"screen", "", termenv.ANSI},
+		{"xterm-16color", "truecolor", termenv.ANSI},
+		{"xterm-256color", "", termenv.ANSI256},
+		{"xterm-256color", "truecolor", termenv.TrueColor},
+		{"tmux", "24bit", termenv.TrueColor},
+		{"xterm-kitty", "", termenv.TrueColor},
+	}
+	for _, tt := range tests {
+		if got := styles.ColorLimit(tt.term, tt.colorTerm); got != tt.want {
+			t.Errorf("ColorLimit(%q, %q) = %v, want %v", tt.term, tt.colorTerm, got, tt.want)
+		}
+	}
+
+	renderer := lipgloss.NewRenderer(io.Discard)
+	want := map[termenv.Profile]string{
+		termenv.ANSI:      "\x1b[35m",
+		termenv.ANSI256:   "\x1b[38;5;99m",
+		termenv.TrueColor: "\x1b[38;2;",
+	}
+	for profile, prefix := range want {
+		renderer.SetColorProfile(profile)
+		if got := renderer.NewStyle().Foreground(styles.Primary).Render("x"); !strings.HasPrefix(got, prefix) {
+			t.Errorf("Expected profile %v to render %q, got %q", profile, prefix, got)
+		}
+	}
+	renderer.SetColorProfile(termenv.Ascii)
+	if got := renderer.NewStyle().Foreground(styles.Primary).Render("x"); got != "x" {
+		t.Errorf("Expected no escape sequences without colors, got %q", got)
+	}
+}
+
+func TestTranscript(t *testing.T) {
+	t.Setenv("XDG_DATA_HOME", t.TempDir())
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, `{"response":"Look at "}`)
+		fmt.Fprintln(w, `{"response":"main.go"}`)
+		fmt.Fprintln(w, `{"done":true}`)
+	}))
+	defer server.Close()
+
+	path := filepath.Join(t.TempDir(), "transcript.md")
+	defer setTranscript("")
+	if err := setTranscript(path); err != nil {
+		t.Fatalf("Failed to start the transcript: %v", err)
+	}
+	defer func() { displayWriter = nil }()
+	displayWriter = io.Discard
+	if _, err := runBatch("where is main?", "", server.URL, "test-model", "", 0.7, 0.9, false, "."); err != nil {
+		t.Fatalf("Batch run failed: %v", err)
+	}
+
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "notes.txt"), []byte("```\nfenced\n```\n"), 0644)
+	defer tools.SetProgressOutput(nil)
+	tools.SetProgressOutput(io.Discard)
+	tools.ExecuteTools("READ_FILE: notes.txt", dir, nil)
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Failed to read the transcript: %v", err)
+	}
+	transcript := string(data)
+	for _, want := range []string{"# slop-shop transcript", "## Prompt to test-model", "where is main?", "## Response\n\nLook at main.go\n", "### Tool READ_FILE notes.txt (exit 0", "````\nFile contents:\n```\nfenced\n```\n````"} {
+		if !strings.Contains(transcript, want) {
+			t.Errorf("Expected the transcript to contain %q, got:\n%s", want, transcript)
+		}
+	}
+
+	// A later run appends to the same file
+	setTranscript(path)
+	if data, _ := os.ReadFile(path); strings.Count(string(data), "# slop-shop transcript") != 2 {
+		t.Errorf("Expected the transcript to be appended to, got:\n%s", data)
+	}
+}
+
+func TestMaxContext(t *testing.T) {
+	for value, want := range map[string]int{"1000": 1000, "250t": 1000, " 0 ": 0} {
+		if got, err := parseContextSize(value); err != nil || got != want {
+			t.Errorf("parseContextSize(%q) = %d, %v; want %d", value, got, err, want)
+		}
+	}
+	for _, value := range []string{"lots", "-5", "10k"} {
+		if _, err := parseContextSize(value); err == nil {
+			t.Errorf("Expected %q to be rejected", value)
+		}
+	}
+	if err := setContextLimit(repo.ContextLimit{}, "", "largest", ""); err == nil || !strings.Contains(err.Error(), "small, recent, path") {
+		t.Errorf("Expected an unknown priority to be rejected, got %v", err)
+	}
+
+	repoPath := t.TempDir()
+	os.WriteFile(filepath.Join(repoPath, "a.go"), []byte(strings.Repeat("a", 400)), 0644)
+	os.WriteFile(filepath.Join(repoPath, "b.go"), []byte(strings.Repeat("b", 100)), 0644)
+	os.WriteFile(filepath.Join(repoPath, "c.go"), []byte(strings.Repeat("c", 100)), 0644)
+	old := time.Now().Add(-time.Hour)
+	os.Chtimes(filepath.Join(repoPath, "b.go"), old, old)
+	os.Chtimes(filepath.Join(repoPath, "c.go"), old, old)
+	settings := config.DefaultSettings()
+	defer setContextLimit(repo.ContextLimit{}, "", "", "")
+
+	tests := []struct {
+		maxContext, priority string
+		kept                 []string
+	}{
+		{"", "", []string{"a.go", "b.go", "c.go"}},
+		{"500", "", []string{"b.go", "c.go"}},
+		{"550", "recent", []string{"a.go"}},
+		{"420", "path", []string{"b.go", "c.go"}},
+		{"10", "", nil},
+	}
+	for _, tt := range tests {
+		if err := setContextLimit(repo.ContextLimit{}, tt.maxContext, tt.priority, ""); err != nil {
+			t.Fatalf("setContextLimit failed: %v", err)
+		}
+		context, err := loadContext(&options{repoPath: repoPath}, &settings)
+		if err != nil {
+			t.Fatalf("loadContext failed: %v", err)
+		}
+		var kept []string
+		for _, section := range repo.SplitContext(context) {
+			if section.Name != "" {
+				kept = append(kept, section.Name)
+			}
+		}
+		if strings.Join(kept, ",") != strings.Join(tt.kept, ",") {
+			t.Errorf("-max-context %q -context-priority %q kept %v, want %v", tt.maxContext, tt.priority, kept, tt.kept)
+		}
+		if contextLimit.MaxChars > 0 && len(context) > contextLimit.MaxChars && len(tt.kept) > 0 {
+			t.Errorf("-max-context %q produced %d characters", tt.maxContext, len(context))
+		}
+	}
+
+	// The configuration sets the limit unless a flag overrides it
+	setContextLimit(repo.ContextLimit{MaxChars: 5000, Priority: "path"}, "100t", "", "")
+	if contextLimit != (repo.ContextLimit{MaxChars: 400, Priority: "path"}) {
+		t.Errorf("Expected the flag to override the configured size, got %+v", contextLimit)
+	}
+}
+
+func TestGeneratedFiles(t *testing.T) {
+	repoPath := t.TempDir()
+	handwritten := "package main\n\n" + strings.Repeat("// The parser reads one line at a time.\n", 10)
+	files := map[string]string{
+		"main.go":      handwritten,
+		"main_copy.go": handwritten,
+		"api.pb.go":    strings.Repeat("var x = 1\n", 20),
+		"schema.go":    "// Code generated by sqlc. DO NOT EDIT.\n\npackage db\n" + strings.Repeat("func f() {}\n", 20),
+		"go.sum":       strings.Repeat("example.com/mod v1.0.0 h1:abcdef=\n", 10),
+		"app.js":       strings.Repeat("var a=1;", 600),
+		"tiny.go":      "package tiny\n",
+	}
+	for name, content := range files {
+		os.WriteFile(filepath.Join(repoPath, name), []byte(content), 0644)
+	}
+	settings := config.DefaultSettings()
+	defer setContextLimit(repo.ContextLimit{}, "", "", "")
+
+	sections := func(mode string) map[string]string {
+		t.Helper()
+		if err := setContextLimit(repo.ContextLimit{}, "", "", mode); err != nil {
+			t.Fatalf("setContextLimit failed: %v", err)
+		}
+		context, err := loadContext(&options{repoPath: repoPath}, &settings)
+		if err != nil {
+			t.Fatalf("loadContext failed: %v", err)
+		}
+		found := make(map[string]string)
+		for _, section := range repo.SplitContext(context) {
+			if section.Name != "" {
+				found[section.Name] = section.Text
+			}
+		}
+		return found
+	}
+
+	placeholders := map[string]string{
+		"api.pb.go":    "[generated code, ",
+		"schema.go":    "[generated code, ",
+		"go.sum":       "[lockfile, ",
+		"app.js":       "[minified code, ",
+		"main_copy.go": "[identical to main.go, ",
+	}
+	found := sections("")
+	for name, want := range placeholders {
+		if !strings.Contains(found[name], want) || strings.Contains(found[name], files[name][:8]) {
+			t.Errorf("Expected %s to be replaced by a placeholder starting %q, got %q", name, want, found[name])
+		}
+	}
+	for _, name := range []string{"main.go", "tiny.go"} {
+		if !strings.Contains(found[name], files[name]) {
+			t.Errorf("Expected %s to be sent whole, got %q", name, found[name])
+		}
+	}
+
+	found = sections("exclude")
+	for name := range placeholders {
+		if _, ok := found[name]; ok {
+			t.Errorf("Expected -generated exclude to leave out %s", name)
+		}
+	}
+	if len(found) != 2 {
+		t.Errorf("Expected only main.go and tiny.go with -generated exclude, got %d files", len(found))
+	}
+
+	found = sections("keep")
+	if !strings.Contains(found["go.sum"], files["go.sum"]) {
+		t.Errorf("Expected -generated keep to send go.sum whole, got %q", found["go.sum"])
+	}
+	if err := setContextLimit(repo.ContextLimit{}, "", "", "drop"); err == nil || !strings.Contains(err.Error(), "placeholder, exclude, keep") {
+		t.Errorf("Expected an unknown mode to be rejected, got %v", err)
+	}
+}
+
+func TestUpstreamErrors(t *testing.T) {
+	tests := []struct {
+		status  int
+		header  string
+		body    string
+		want    string
+		wantErr string
+	}{
+		{http.StatusNotFound, "", `{"error":"model \"tiny\" not found, try pulling it first"}`, "run `ollama pull tiny`", "*ollama.ModelNotFoundError"},
+		{http.StatusInternalServerError, "", `{"error":"model requires more system memory (12.0 GiB) than is available (4.1 GiB)"}`, "not have enough memory to run 'tiny' (model requires more system memory", "*ollama.OutOfMemoryError"},
+		{http.StatusTooManyRequests, "30", `too many requests`, "try again after 30 seconds", "*ollama.RateLimitError"},
+		{http.StatusServiceUnavailable, "", `{"error":"server busy, please try again.  maximum pending requests exceeded"}`, "server is busy", "*ollama.RateLimitError"},
+		{http.StatusBadRequest, "", `{"error":"invalid options"}`, "HTTP error 400: invalid options", "*ollama.HTTPError"},
+	}
+	for _, tt := range tests {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if tt.header != "" {
+				w.Header().Set("Retry-After", tt.header)
+			}
+			w.WriteHeader(tt.status)
+			fmt.Fprint(w, tt.body)
+		}))
+		_, err := ollama.NewClient(server.URL, "tiny", 0.7, 0.9).Generate("hi", "", false, nil)
+		server.Close()
+
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("HTTP %d: expected an error containing %q, got %v", tt.status, tt.want, err)
+		}
+		if fmt.Sprintf("%T", err) != tt.wantErr {
+			t.Errorf("HTTP %d: expected a %s, got %T", tt.status, tt.wantErr, err)
+		}
+		if exitCode(batchError(err, nil)) != exitModel {
+			t.Errorf("HTTP %d: expected exit code %d", tt.status, exitModel)
+		}
+	}
+
+	server := httptest.NewServer(http.NotFoundHandler())
+	server.Close()
+	_, err := ollama.NewClient(server.URL, "tiny", 0.7, 0.9).Generate("hi", "", false, nil)
+	if err == nil || !strings.Contains(err.Error(), "cannot connect to Ollama at "+server.URL) || !strings.Contains(err.Error(), "ollama serve") {
+		t.Errorf("Expected a refused connection to suggest starting Ollama, got %v", err)
+	}
+	if exitCode(batchError(err, nil)) != exitConnection {
+		t.Errorf("Expected exit code %d for a refused connection", exitConnection)
+	}
+}
+
+func TestDebugLog(t *testing.T) {
+	defer setDebug("", "")
+	if err := setDebug("tui,network", ""); err == nil || !strings.Contains(err.Error(), `unknown debug component "network"`) {
+		t.Errorf("Expected an unknown component to be rejected, got %v", err)
+	}
+	if err := setDebug("", "debug.sock"); err == nil {
+		t.Error("Expected -debug-socket without -debug to be rejected")
+	}
+
+	var debug debugFlag
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.Var(&debug, "debug", "")
+	if fs.Parse([]string{"-debug"}); debug != "all" {
+		t.Errorf("Expected -debug alone to enable every component, got %q", debug)
+	}
+	if fs.Parse([]string{"-debug=tui,ollama"}); debug != "tui,ollama" {
+		t.Errorf("Expected -debug=tui,ollama to select those components, got %q", debug)
+	}
+
+	// The log file lives in the state directory, not the repository
+	t.Setenv("XDG_STATE_HOME", t.TempDir())
+	if err := setDebug("ollama", ""); err != nil {
+		t.Fatalf("setDebug failed: %v", err)
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, `{"response":"hi","done":true}`)
+	}))
+	defer server.Close()
+	ollama.NewClient(server.URL, "test-model", 0.7, 0.9).Generate("hello", "", false, nil)
+	tools.RunTool(io.Discard, tools.ToolCall{Name: "LIST_DIR", Args: "."}, t.TempDir())
+	data, err := os.ReadFile(config.DebugLogPath())
+	if err != nil {
+		t.Fatalf("Failed to read the debug log: %v", err)
+	}
+	if log := string(data); !strings.Contains(log, "[ollama] POST "+server.URL+"/api/generate model=test-model") || strings.Contains(log, "[tools]") {
+		t.Errorf("Expected only ollama output in the debug log, got:\n%s", log)
+	}
+
+	// A client of the socket receives the lines written while it is connected
+	socket := filepath.Join(t.TempDir(), "debug.sock")
+	if err := setDebug("tools", socket); err != nil {
+		t.Fatalf("setDebug with a socket failed: %v", err)
+	}
+	conn, err := net.Dial("unix", socket)
+	if err != nil {
+		t.Fatalf("Failed to connect to the debug socket: %v", err)
+	}
+	defer conn.Close()
+	var received strings.Builder
+	buf := make([]byte, 4096)
+	for i := 0; i < 100 && !strings.Contains(received.String(), "[tools] LIST_DIR"); i++ {
+		tools.RunTool(io.Discard, tools.ToolCall{Name: "LIST_DIR", Args: "."}, t.TempDir())
+		conn.SetReadDeadline(time.Now().Add(20 * time.Millisecond))
+		n, _ := conn.Read(buf)
+		received.Write(buf[:n])
+	}
+	if !strings.Contains(received.String(), `[tools] LIST_DIR ".": exit 0`) {
+		t.Errorf("Expected tool output on the debug socket, got %q", received.String())
+	}
+}
+
+func TestOwnArtifactsExcluded(t *testing.T) {
+	repoPath := t.TempDir()
+	os.MkdirAll(filepath.Join(repoPath, ".slop-shop", "tmp"), 0755)
+	os.MkdirAll(filepath.Join(repoPath, "notes"), 0755)
+	os.MkdirAll(filepath.Join(repoPath, "tmp", "slop-shop-scratch-42"), 0755)
+	files := map[string]string{
+		"main.go":                        "package main\n",
+		"tmp/slop-shop-scratch-42/a.out": "build output\n",
+		"repl_debug.log":                 "[12:00:00.000] View() called\n",
+		".slop-shop/tmp/scratch.txt":     "scratch\n",
+		"chat-20260101-120000.md":        "# anything\n",
+		"notes/session.md":               "# slop-shop transcript, 2026-01-01 12:00:00\n\n## Prompt\n",
+		"notes/saved.md":                 "# Slop Shop conversation, 2026-01-01 12:00\n",
+		".git-hooks.slop-shop-backup":    "#!/bin/sh\n",
+		".main.go.slop-123456":           "package main\n",
+		"answer.md":                      "The answer\n",
+		"notes/chat-about-the-parser.md": "Keep me\n",
+	}
+	for name, content := range files {
+		os.WriteFile(filepath.Join(repoPath, name), []byte(content), 0644)
+	}
+	repo.AddArtifact(filepath.Join(repoPath, "answer.md"))
+
+	scanned, err := repo.ReadRepository(repoPath, nil)
+	if err != nil {
+		t.Fatalf("ReadRepository failed: %v", err)
+	}
+	var names []string
+	for _, file := range scanned {
+		names = append(names, filepath.ToSlash(file.Path))
+	}
+	if strings.Join(names, ",") != "main.go,notes/chat-about-the-parser.md" {
+		t.Errorf("Expected slop-shop's own files to be left out, got %v", names)
+	}
+
+	snapshot, err := snapshotFiles(repoPath, nil)
+	if err != nil {
+		t.Fatalf("snapshotFiles failed: %v", err)
+	}
+	if _, ok := snapshot["repl_debug.log"]; ok {
+		t.Error("Expected watch mode to ignore the debug log")
+	}
+}
+
+func TestApprover(t *testing.T) {
+	defer func() { approvalInput, displayWriter = os.Stdin, nil }()
+	displayWriter = io.Discard
+	call := tools.ToolCall{Name: "RUN_COMMAND", Args: "go test ./..."}
+
+	approvalInput = strings.NewReader("maybe\nt\n")
+	if approval, err := newApprover(true)(call, call.Args); err != nil || approval != tools.AllowTool {
+		t.Errorf("Expected to ask again after an unknown answer and allow the tool, got %v, %v", approval, err)
+	}
+	approvalInput = strings.NewReader("")
+	if approval, err := newApprover(true)(call, call.Args); err == nil || approval != tools.Deny {
+		t.Errorf("Expected no answer to deny the call, got %v, %v", approval, err)
+	}
+	if _, err := newApprover(false)(call, call.Args); err == nil || !strings.Contains(err.Error(), "no terminal") {
+		t.Errorf("Expected calls to be refused without a terminal, got %v", err)
+	}
+}
+
+func TestWorkspaceSnapshot(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, content string) {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("kept.txt", "same\n")
+	write("edited.txt", "one\ntwo\n")
+	write("removed.txt", "gone\n")
+
+	snapshot, err := takeSnapshot(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	write("edited.txt", "one\n2\nthree\n")
+	write("added.txt", "new\n")
+	os.Remove(filepath.Join(dir, "removed.txt"))
+	os.Chtimes(filepath.Join(dir, "kept.txt"), time.Now().Add(time.Hour), time.Now().Add(time.Hour))
+
+	changes, err := snapshot.changes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, change := range changes {
+		got = append(got, change.Status+" "+change.Path)
+	}
+	if want := []string{"added added.txt", "modified edited.txt", "removed removed.txt"}; !slices.Equal(got, want) {
+		t.Fatalf("Expected changes %v, got %v", want, got)
+	}
+	diff := workspaceDiff(changes)
+	for _, want := range []string{"--- /dev/null\n+++ b/added.txt\n", "-two\n+2\n+three\n", "--- a/removed.txt\n+++ /dev/null\n@@ -1,1 +0,0 @@\n-gone\n"} {
+		if !strings.Contains(diff, want) {
+			t.Errorf("Expected the diff to contain %q, got:\n%s", want, diff)
+		}
+	}
+
+	// Reverting from the prompt restores the snapshot
+	defer func() { workspaceInput, displayWriter = os.Stdin, nil }()
+	displayWriter = io.Discard
+	workspaceInput = strings.NewReader("what\nr\n")
+	if err := resolveWorkspace(snapshot, changes, "fix it"); err != nil {
+		t.Fatal(err)
+	}
+	if changes, _ := snapshot.changes(); len(changes) != 0 {
+		t.Errorf("Expected no changes after reverting, got %v", changes)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "added.txt")); !os.IsNotExist(err) {
+		t.Errorf("Expected the added file to be removed, got %v", err)
+	}
+
+	if got := commitSubject(strings.Repeat("x", 80) + "\nmore"); got != "slop-shop: "+strings.Repeat("x", 57)+"..." {
+		t.Errorf("Unexpected commit subject %q", got)
+	}
+}
+
+func TestWorkspaceLeavesDirtyFiles(t *testing.T) {
+	dir := t.TempDir()
+	if _, err := gitOutput(dir, "init", "-q"); err != nil {
+		t.Skipf("git is not available: %v", err)
+	}
+	gitOutput(dir, "config", "user.name", "test")
+	gitOutput(dir, "config", "user.email", "test@example.com")
+	os.WriteFile(filepath.Join(dir, "mine.txt"), []byte("one\n"), 0644)
+	os.WriteFile(filepath.Join(dir, "session.txt"), []byte("one\n"), 0644)
+	gitOutput(dir, "add", "-A")
+	gitOutput(dir, "commit", "-q", "-m", "first")
+
+	// mine.txt has the user's own uncommitted change before the session
+	os.WriteFile(filepath.Join(dir, "mine.txt"), []byte("one\nmine\n"), 0644)
+	snapshot, err := takeSnapshot(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !snapshot.dirty["mine.txt"] || snapshot.dirty["session.txt"] {
+		t.Fatalf("Expected only mine.txt to be dirty, got %v", snapshot.dirty)
+	}
+	os.WriteFile(filepath.Join(dir, "mine.txt"), []byte("one\nmine\nsession\n"), 0644)
+	os.WriteFile(filepath.Join(dir, "session.txt"), []byte("one\nsession\n"), 0644)
+	changes, err := snapshot.changes()
+	if err != nil || len(changes) != 2 {
+		t.Fatalf("Expected two changes, got %v, %v", changes, err)
+	}
+
+	defer func() { workspaceInput, displayWriter = os.Stdin, nil }()
+	displayWriter = io.Discard
+	workspaceInput = strings.NewReader("c\n")
+	if err := resolveWorkspace(snapshot, changes, "fix it"); err != nil {
+		t.Fatal(err)
+	}
+	if committed, _ := gitOutput(dir, "show", "--name-only", "--format=", "HEAD"); strings.TrimSpace(committed) != "session.txt" {
+		t.Errorf("Expected only session.txt to be committed, got %q", committed)
+	}
+	if status, _ := gitOutput(dir, "status", "--porcelain"); strings.TrimSpace(status) != "M mine.txt" {
+		t.Errorf("Expected mine.txt to be left uncommitted, got %q", status)
+	}
+
+	// With only dirty files changed, commit is refused until another choice
+	changes, _ = snapshot.changes()
+	changes = slices.DeleteFunc(changes, func(change workspaceChange) bool { return change.Path != "mine.txt" })
+	workspaceInput = strings.NewReader("s\nr\n")
+	if err := resolveWorkspace(snapshot, changes, "fix it"); err != nil {
+		t.Fatal(err)
+	}
+	if stashes, _ := gitOutput(dir, "stash", "list"); stashes != "" {
+		t.Errorf("Expected nothing to be stashed, got %q", stashes)
+	}
+	if data, _ := os.ReadFile(filepath.Join(dir, "mine.txt")); string(data) != "one\nmine\n" {
+		t.Errorf("Expected revert to restore the user's change, got %q", data)
+	}
+}
+
+func TestRevisionContext(t *testing.T) {
+	repoDir := t.TempDir()
+	if _, err := gitOutput(repoDir, "init", "-q"); err != nil {
+		t.Skipf("git is not available: %v", err)
+	}
+	commit := func(message string) {
+		gitOutput(repoDir, "add", "-A")
+		if _, err := gitOutput(repoDir, "-c", "user.name=test", "-c", "user.email=test@example.com", "commit", "-q", "-m", message); err != nil {
+			t.Fatal(err)
+		}
+	}
+	os.MkdirAll(filepath.Join(repoDir, "pkg"), 0755)
+	os.WriteFile(filepath.Join(repoDir, "pkg", "calc.go"), []byte("func Add(a, b int) int { return a - b }\n"), 0644)
+	os.WriteFile(filepath.Join(repoDir, "data.bin"), []byte{0, 1, 2}, 0644)
+	commit("first")
+	gitOutput(repoDir, "tag", "v1.2")
+	os.WriteFile(filepath.Join(repoDir, "pkg", "calc.go"), []byte("func Add(a, b int) int { return a + b }\n"), 0644)
+	os.WriteFile(filepath.Join(repoDir, "later.go"), []byte("package later\n"), 0644)
+	commit("second")
+
+	settings := config.DefaultSettings()
+	context, err := revisionContext(&options{repoPath: repoDir, rev: "v1.2"}, &settings, contextLimit)
+	if err != nil {
+		t.Fatalf("revisionContext failed: %v", err)
+	}
+	if !strings.Contains(context, "as of v1.2") || !strings.Contains(context, "return a - b") {
+		t.Errorf("Expected the files at v1.2, got:\n%s", context)
+	}
+	if strings.Contains(context, "later.go") || strings.Contains(context, "data.bin") {
+		t.Errorf("Expected only the text files of v1.2, got:\n%s", context)
+	}
+
+	// Paths are relative to -repo, also inside the git repository, and -attach picks files
+	subdir := filepath.Join(repoDir, "pkg")
+	context, err = revisionContext(&options{repoPath: subdir, rev: "HEAD~1", attach: "calc.go"}, &settings, contextLimit)
+	if err != nil || !strings.Contains(context, "File: calc.go") || !strings.Contains(context, "a - b") {
+		t.Errorf("Expected calc.go at HEAD~1, got %v:\n%s", err, context)
+	}
+	if _, err := revisionContext(&options{repoPath: repoDir, rev: "HEAD", attach: "missing.go"}, &settings, contextLimit); err == nil || !strings.Contains(err.Error(), "does not exist") {
+		t.Errorf("Expected a missing file to fail, got %v", err)
+	}
+	if _, err := revisionContext(&options{repoPath: repoDir, rev: "v9"}, &settings, contextLimit); err == nil || !strings.Contains(err.Error(), "unknown revision") {
+		t.Errorf("Expected an unknown revision to fail, got %v", err)
+	}
+}
+
+func TestBlameFiles(t *testing.T) {
+	repoDir := t.TempDir()
+	if _, err := gitOutput(repoDir, "init", "-q"); err != nil {
+		t.Skipf("git is not available: %v", err)
+	}
+	commit := func(message, date string) {
+		gitOutput(repoDir, "add", "-A")
+		cmd := exec.Command("git", "-c", "user.name=Ada", "-c", "user.email=ada@example.com", "commit", "-q", "-m", message)
+		cmd.Dir = repoDir
+		cmd.Env = append(os.Environ(), "GIT_AUTHOR_DATE="+date, "GIT_COMMITTER_DATE="+date)
+		if output, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("git commit failed: %v\n%s", err, output)
+		}
+	}
+	path := filepath.Join(repoDir, "calc.go")
+	os.WriteFile(path, []byte("package calc\n\nfunc Add(a, b int) int {\n\treturn a - b\n}\n"), 0644)
+	commit("Add calc", "2026-01-01T12:00:00Z")
+	os.WriteFile(path, []byte("package calc\n\nfunc Add(a, b int) int {\n\treturn a + b\n}\n"), 0644)
+	commit("Fix Add\n\nIt subtracted instead of adding.", "2026-02-01T12:00:00Z")
+	os.WriteFile(path, []byte("package calc\n\nfunc Add(a, b int) int {\n\treturn a + b\n}\n\n// work in progress\n"), 0644)
+
+	files, err := repo.ReadFiles(repoDir, []string{"calc.go"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	annotated, err := repo.BlameFiles(repoDir, "", files, 5)
+	if err != nil {
+		t.Fatalf("BlameFiles failed: %v", err)
+	}
+	content := annotated[0].Content
+	fix := strings.Index(content, "- line 4: ")
+	first := strings.Index(content, "- lines 1-3, 5: ")
+	if fix < 0 || first < fix || !strings.Contains(content, "2026-02-01 by Ada\n    Fix Add\n    \n    It subtracted instead of adding.") {
+		t.Errorf("Expected the fix, then the first commit, with their messages, got:\n%s", content)
+	}
+	if strings.Contains(content, "work in progress\n-") || strings.Contains(content, "Not Committed") {
+		t.Errorf("Expected uncommitted lines to be left out, got:\n%s", content)
+	}
+	if annotated[0].Size != int64(len(content)) {
+		t.Errorf("Expected the size to include the annotations, got %d", annotated[0].Size)
+	}
+
+	// One commit per file, and blaming at a revision
+	annotated, _ = repo.BlameFiles(repoDir, "HEAD~1", files, 1)
+	if content := annotated[0].Content; !strings.Contains(content, "- lines 1-5: ") || strings.Contains(content, "Fix Add") {
+		t.Errorf("Expected only the first commit at HEAD~1, got:\n%s", content)
+	}
+	untracked := []repo.FileInfo{{Path: "notes.txt", Content: "hi"}}
+	if annotated, err := repo.BlameFiles(repoDir, "", untracked, 5); err != nil || annotated[0].Content != "hi" {
+		t.Errorf("Expected untracked files to be left as they are, got %v, %v", annotated, err)
+	}
+}
+
+func TestIssueContext(t *testing.T) {
+	var requests []string
+	forge := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, r.URL.Path+" "+r.Header.Get("Authorization"))
+		switch r.URL.Path {
+		case "/api/v1/repos/kek/shop/issues/42":
+			fmt.Fprint(w, `{"title":"Crash on empty input","body":"Steps to reproduce","state":"open","html_url":"http://forge/kek/shop/issues/42","user":{"login":"ada"},"pull_request":null}`)
+		case "/api/v1/repos/kek/shop/issues/7", "/api/v3/repos/kek/shop/issues/7":
+			fmt.Fprint(w, `{"title":"Fix the crash","body":"Fixes #42","state":"closed","user":{"login":"bob"},"pull_request":{"merged":true}}`)
+		case "/api/v1/repos/kek/shop/issues/42/comments", "/api/v1/repos/kek/shop/issues/7/comments", "/api/v3/repos/kek/shop/issues/7/comments":
+			fmt.Fprint(w, `[{"body":"Seen it too","user":{"login":"cy"},"created_at":"2026-03-04T05:06:07Z"}]`)
+		case "/api/v1/repos/kek/shop/pulls/7.diff":
+			fmt.Fprint(w, "diff --git a/main.go b/main.go\n")
+		case "/api/v3/repos/kek/shop/pulls/7":
+			if r.Header.Get("Accept") != "application/vnd.github.diff" {
+				http.Error(w, "expected a diff", http.StatusBadRequest)
+				return
+			}
+			fmt.Fprint(w, "diff --git a/gh.go b/gh.go\n")
+		default:
+			http.Error(w, `{"message":"Not Found"}`, http.StatusNotFound)
+		}
+	}))
+	defer forge.Close()
+	t.Setenv("GITEA_TOKEN", "secret")
+
+	context, err := issueContext([]string{forge.URL + "/kek/shop/issues/42"}, "", false, t.TempDir())
+	if err != nil {
+		t.Fatalf("issueContext failed: %v", err)
+	}
+	for _, want := range []string{"File: issue:kek/shop#42 (Size: ", "Issue kek/shop#42: Crash on empty input (open, opened by ada)", "Steps to reproduce", "Comment by cy, 2026-03-04:\nSeen it too"} {
+		if !strings.Contains(context, want) {
+			t.Errorf("Expected the context to contain %q, got:\n%s", want, context)
+		}
+	}
+	if len(requests) == 0 || !strings.HasSuffix(requests[0], " token secret") {
+		t.Errorf("Expected the Gitea token to be sent, got %v", requests)
+	}
+
+	// Numbers in the prompt are looked up on the origin remote's forge
+	repoDir := t.TempDir()
+	if _, err := gitOutput(repoDir, "init", "-q"); err != nil {
+		t.Skipf("git is not available: %v", err)
+	}
+	gitOutput(repoDir, "remote", "add", "origin", forge.URL+"/kek/shop.git")
+	context, err = issueContext(nil, "Implement #42 like (#7) did", true, repoDir)
+	if err != nil {
+		t.Fatalf("issueContext failed: %v", err)
+	}
+	if !strings.Contains(context, "Crash on empty input") || !strings.Contains(context, "Pull request kek/shop#7: Fix the crash") || !strings.Contains(context, "Diff:\ndiff --git a/main.go") {
+		t.Errorf("Expected the issue and the pull request with its diff, got:\n%s", context)
+	}
+
+	t.Setenv(config.EnvPrefix+"FORGE", "github")
+	if context, err = issueContext([]string{"kek/shop#7"}, "", false, repoDir); err != nil || !strings.Contains(context, "diff --git a/gh.go") {
+		t.Errorf("Expected the GitHub API to be used, got %v:\n%s", err, context)
+	}
+	if _, err := issueContext([]string{"#99"}, "", false, repoDir); err == nil || !strings.Contains(err.Error(), "HTTP 404") {
+		t.Errorf("Expected a missing issue to fail, got %v", err)
+	}
+	if _, err := parseIssueRef("kek/shop42", repoDir); err == nil {
+		t.Error("Expected a reference without # to be rejected")
+	}
+
+	for remote, want := range map[string]string{
+		"git@github.com:kek/shop.git":           "https://api.github.com",
+		"ssh://git@gitea.example:2222/kek/shop": "https://gitea.example/api/v1",
+	} {
+		gitOutput(repoDir, "remote", "set-url", "origin", remote)
+		os.Unsetenv(config.EnvPrefix + "FORGE")
+		if ref, err := parseIssueRef("42", repoDir); err != nil || ref.api != want || ref.owner != "kek" || ref.repo != "shop" {
+			t.Errorf("Expected %s to use %s for kek/shop, got %+v, %v", remote, want, ref, err)
+		}
+	}
+}
+
+func TestTemplateExec(t *testing.T) {
+	configDir := t.TempDir()
+	t.Setenv("XDG_CONFIG_HOME", configDir)
+	defer tools.SetToolPolicy(nil, nil)
+	defer tools.SetCommandsEnabled(false)
+	defer func() { displayWriter = nil }()
+	displayWriter = io.Discard
+	repoDir := t.TempDir()
+	os.WriteFile(filepath.Join(repoDir, "notes.txt"), []byte("vet: x declared and not used\n"), 0644)
+	data := &templateData{repoPath: repoDir, expand: true}
+
+	if _, err := executeTemplate("prompt", `{{exec "cat notes.txt"}}`, data, nil); err == nil || !strings.Contains(err.Error(), "tools are disabled") {
+		t.Errorf("Expected exec to need tools, got %v", err)
+	}
+	tools.SetCommandsEnabled(true)
+
+	prompt, err := executeTemplate("prompt", `Explain these warnings: {{exec "cat notes.txt"}}`, data, nil)
+	if err != nil || prompt != "Explain these warnings: vet: x declared and not used" {
+		t.Errorf("Expected the command output in the prompt, got %q, %v", prompt, err)
+	}
+	prompt, err = executeTemplate("prompt", `{{exec "echo failed; exit 3"}}`, data, nil)
+	if err != nil || prompt != "failed\n(exit status 3)" {
+		t.Errorf("Expected a failing command's output and status, got %q, %v", prompt, err)
+	}
+
+	// A repository's template runs commands only once the repository is
+	// trusted, even when it replaces a built-in one
+	repoTemplates := filepath.Join(repoDir, ".slopshop", "templates")
+	os.MkdirAll(repoTemplates, 0755)
+	os.WriteFile(filepath.Join(repoTemplates, "commit-msg.tmpl"), []byte(`{{exec "touch pwned"}}`), 0644)
+	if _, err := renderTemplate("commit-msg", data); err == nil || !strings.Contains(err.Error(), "slop-shop trust") {
+		t.Errorf("Expected an untrusted repository's template to be refused exec, got %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(repoDir, "pwned")); err == nil {
+		t.Error("Expected the untrusted template's command not to run")
+	}
+	if err := config.SetTrusted(repoDir, true); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := renderTemplate("commit-msg", data); err != nil {
+		t.Errorf("Expected a trusted repository's template to run exec, got %v", err)
+	}
+
+	// The user's templates run commands, but only with -expand
+	userTemplates := filepath.Join(configDir, "slop-shop", "templates")
+	os.MkdirAll(userTemplates, 0755)
+	os.WriteFile(filepath.Join(userTemplates, "vet.tmpl"), []byte(`{{exec "cat notes.txt"}}`), 0644)
+	if prompt, err := renderTemplate("vet", data); err != nil || !strings.Contains(prompt, "declared and not used") {
+		t.Errorf("Expected the user's template to run exec, got %q, %v", prompt, err)
+	}
+	if _, err := renderTemplate("vet", &templateData{repoPath: repoDir}); err == nil || !strings.Contains(err.Error(), "-expand") {
+		t.Errorf("Expected exec to need -expand, got %v", err)
+	}
+
+	tools.SetToolPolicy(nil, []string{"RUN_COMMAND"})
+	if _, err := executeTemplate("prompt", `{{exec "cat notes.txt"}}`, data, nil); err == nil || !strings.Contains(err.Error(), "disabled by the tool policy") {
+		t.Errorf("Expected the tool policy to apply, got %v", err)
+	}
+}
+
+func TestEmptyResponseRetry(t *testing.T) {
+	defer ollama.SetEmptyRetry(ollama.EmptyRetry{})
+	var mu sync.Mutex
+	var temperatures []float64
+	emptyFor := 2
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req ollama.Request
+		json.NewDecoder(r.Body).Decode(&req)
+		mu.Lock()
+		temperatures = append(temperatures, req.Options.Temperature)
+		empty := len(temperatures) <= emptyFor
+		mu.Unlock()
+		if empty {
+			fmt.Fprintln(w, `{"response":"\n  ","done":false}`)
+		} else {
+			fmt.Fprintln(w, `{"response":"An answer.","done":false}`)
+		}
+		fmt.Fprintln(w, `{"response":"","done":true}`)
+	}))
+	defer server.Close()
+
+	client := ollama.NewClient(server.URL, "test-model", 0.5, 0.9)
+	var streamed strings.Builder
+	response, err := client.Generate("question", "", false, func(chunk string) { streamed.WriteString(chunk) })
+	if err != nil || response != "An answer." {
+		t.Fatalf("Expected the third attempt's answer, got %q, %v", response, err)
+	}
+	if streamed.String() != "An answer." {
+		t.Errorf("Expected the empty attempts not to be streamed, got %q", streamed.String())
+	}
+	if len(temperatures) != 3 || temperatures[0] != 0.5 || temperatures[2] <= temperatures[1] || temperatures[1] <= temperatures[0] {
+		t.Errorf("Expected each retry to be warmer, got %v", temperatures)
+	}
+
+	one := 1
+	if err := ollama.SetEmptyRetry(ollama.EmptyRetry{Retries: &one}); err != nil {
+		t.Fatal(err)
+	}
+	temperatures, emptyFor = nil, 10
+	_, err = client.Generate("question", "", false, nil)
+	var emptyErr *ollama.EmptyResponseError
+	if !errors.As(err, &emptyErr) || emptyErr.Attempts != 2 || len(temperatures) != 2 {
+		t.Fatalf("Expected an empty response error after 2 attempts, got %v after %d", err, len(temperatures))
+	}
+	if code := exitCode(batchError(err, nil)); code != exitModel {
+		t.Errorf("Expected exit code %d, got %d", exitModel, code)
+	}
+
+	tooMany := 11
+	if err := ollama.SetEmptyRetry(ollama.EmptyRetry{Retries: &tooMany}); err == nil {
+		t.Error("Expected too many retries to be rejected")
+	}
+}
+
+func TestExplainError(t *testing.T) {
+	repoDir := t.TempDir()
+	var source strings.Builder
+	for i := 1; i <= 60; i++ {
+		fmt.Fprintf(&source, "line %d\n", i)
+	}
+	files := []repo.FileInfo{
+		{Path: "internal/parse/parse.go", Content: source.String()},
+		{Path: "internal/parse/parse_test.go", Content: "package parse\n\nfunc TestParse(t *testing.T) {\n\tt.Fatal(\"boom\")\n}\n"},
+		{Path: "app/views.py", Content: "def index():\n    return 1 / 0\n"},
+	}
+	output := "# example/internal/parse\n" +
+		"internal/parse/parse.go:12:5: undefined: tokenize\n" +
+		repoDir + "/internal/parse/parse.go:50:2: missing return\n" +
+		"--- FAIL: TestParse (0.00s)\n    parse_test.go:4: boom\n" +
+		"  File \"" + repoDir + "/app/views.py\", line 2, in index\n" +
+		"/usr/lib/go/src/testing/testing.go:1690 +0x10b\n" +
+		"internal/parse/parse.go:12:5: undefined: tokenize\n"
+
+	locations := locateErrors(output, repoDir, files)
+	want := []errorLocation{{"internal/parse/parse.go", 12}, {"internal/parse/parse.go", 50}, {"internal/parse/parse_test.go", 4}, {"app/views.py", 2}}
+	if !slices.Equal(locations, want) {
+		t.Fatalf("Expected %v, got %v", want, locations)
+	}
+
+	context := errorContext(output, locations, files)
+	for _, wanted := range []string{"Error output:\n", "undefined: tokenize", "File: internal/parse/parse.go\n", ">12| line 12", " 27| line 27", "...\n 35| line 35", ">50| line 50", ">4| \tt.Fatal(\"boom\")", ">2|     return 1 / 0"} {
+		if !strings.Contains(context, wanted) {
+			t.Errorf("Expected the context to contain %q, got:\n%s", wanted, context)
+		}
+	}
+	if strings.Contains(context, "line 28\n") || strings.Count(context, "File: internal/parse/parse.go") != 1 {
+		t.Errorf("Expected one excerpt of parse.go without the lines far from the errors, got:\n%s", context)
+	}
+
+	saved := readPipedInput
+	defer func() { readPipedInput = saved }()
+	readPipedInput = func() (string, error) { return "", nil }
+	if err := runExplainError([]string{"-repo", repoDir}); err == nil || !strings.Contains(err.Error(), "pipe the error") {
+		t.Errorf("Expected an error without input, got %v", err)
+	}
+}
+
+func TestPresets(t *testing.T) {
+	userDir := t.TempDir()
+	repoDir := t.TempDir()
+	t.Setenv("XDG_CONFIG_HOME", userDir)
+	t.Setenv("SLOP_SHOP_PROFILE", "")
+	os.MkdirAll(filepath.Join(userDir, "slop-shop"), 0755)
+	os.WriteFile(filepath.Join(userDir, "slop-shop", "config.toml"), []byte("preset = \"creative\"\n\n[profiles.ci]\npreset = \"precise\"\n"), 0644)
+
+	resolve := func(args ...string) (*config.Settings, error) {
+		fs := flag.NewFlagSet("test", flag.ContinueOnError)
+		opts := addCommonFlags(fs)
+		fs.Parse(append([]string{"-repo", repoDir}, args...))
+		_, settings, err := resolveSettings(fs, opts)
+		return settings, err
+	}
+
+	for _, tc := range []struct {
+		args              []string
+		preset            string
+		temperature, topP float64
+	}{
+		{nil, "creative", 1.1, 0.95},
+		{[]string{"-profile", "ci"}, "precise", 0.1, 0.5},
+		{[]string{"-preset", "balanced"}, "balanced", 0.7, 0.9},
+		{[]string{"-preset", "precise", "-temp", "0.3"}, "precise", 0.3, 0.5},
+	} {
+		settings, err := resolve(tc.args...)
+		if err != nil {
+			t.Fatalf("%v: %v", tc.args, err)
+		}
+		if settings.Preset != tc.preset || settings.Temperature != tc.temperature || settings.TopP != tc.topP {
+			t.Errorf("%v: expected %s with temperature %g and top_p %g, got %s with %g and %g", tc.args, tc.preset, tc.temperature, tc.topP, settings.Preset, settings.Temperature, settings.TopP)
+		}
+	}
+
+	t.Setenv(config.EnvPrefix+"PRESET", "precise")
+	if settings, err := resolve(); err != nil || settings.Temperature != 0.1 || settings.Source("temperature") != "env SLOP_SHOP_PRESET" {
+		t.Errorf("Expected the preset from the environment, got %+v, %v", settings, err)
+	}
+	if _, err := resolve("-preset", "wild"); err == nil || !strings.Contains(err.Error(), "available: precise, balanced, creative") {
+		t.Errorf("Expected an unknown preset to be rejected, got %v", err)
+	}
+
+	os.WriteFile(filepath.Join(userDir, "slop-shop", "config.toml"), []byte("preset = \"chaotic\"\n"), 0644)
+	t.Setenv(config.EnvPrefix+"PRESET", "")
+	os.Unsetenv(config.EnvPrefix + "PRESET")
+	if _, err := resolve(); err == nil || !strings.Contains(err.Error(), "config.toml") {
+		t.Errorf("Expected the configured preset to be rejected with its file, got %v", err)
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kek/slop-shop/config"
+	"github.com/kek/slop-shop/ollama"
+	"github.com/kek/slop-shop/repo"
+	"github.com/kek/slop-shop/styles"
+)
+
+// repoResult is the outcome of the prompt for one repository of -repos
+type repoResult struct {
+	Repo     string        `json:"repo"`
+	Files    int           `json:"files"`
+	Response string        `json:"response"`
+	Error    string        `json:"error,omitempty"`
+	Stats    ollama.Stats  `json:"stats"`
+	Duration time.Duration `json:"duration"`
+	ExitCode int           `json:"exit_code"`
+
+	err error
+}
+
+// runRepos sends the same prompt with the context of each repository, running
+// up to parallel requests at a time, and writes a combined report in the order
+// the repositories were given. Tools are not run, so the repositories are only read.
+func runRepos(prompt, stdinContext string, repos []string, settings *config.Settings, parallel int) error {
+	if parallel < 1 {
+		parallel = 1
+	}
+	fmt.Fprintln(chatter(), styles.InfoStyle.Render(fmt.Sprintf("Asking %s about %d repositories, %d at a time", settings.Model, len(repos), parallel)))
+
+	results := make([]repoResult, len(repos))
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	slots := make(chan struct{}, parallel)
+	for i, path := range repos {
+		wg.Add(1)
+		go func(i int, path string) {
+			defer wg.Done()
+			slots <- struct{}{}
+			defer func() { <-slots }()
+
+			result := askRepo(prompt, stdinContext, path, settings)
+			results[i] = result
+
+			// Progress lines and history writes are serialized
+			mu.Lock()
+			defer mu.Unlock()
+			if result.err != nil {
+				fmt.Fprintln(chatter(), styles.ErrorStyle.Render(fmt.Sprintf("❌ %s: %v", path, result.err)))
+				return
+			}
+			fmt.Fprintln(chatter(), styles.SuccessStyle.Render(fmt.Sprintf("✅ %s (%d files, %s)", path, result.Files, result.Duration.Round(time.Millisecond))))
+			record := batchRecord{Prompt: prompt, Model: settings.Model, URL: settings.URL, System: settings.System, Response: result.Response, Stats: result.Stats}
+			if err := recordHistory(record, "", path); err != nil {
+				fmt.Fprintln(os.Stderr, styles.ErrorStyle.Render(fmt.Sprintf("❌ %v", err)))
+			}
+		}(i, path)
+	}
+	wg.Wait()
+
+	report := formatRepoReport(results)
+	if responseFile != "" {
+		if err := os.WriteFile(responseFile, []byte(report), 0644); err != nil {
+			return fmt.Errorf("error writing response: %v", err)
+		}
+	}
+	if outputFormat == "json" {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(results); err != nil {
+			return fmt.Errorf("error writing JSON output: %v", err)
+		}
+	} else {
+		fmt.Fprint(display(), "\n"+report)
+	}
+
+	var failed []repoResult
+	for _, result := range results {
+		if result.err != nil {
+			failed = append(failed, result)
+		}
+	}
+	if len(failed) > 0 {
+		return &exitError{failed[0].ExitCode, fmt.Errorf("%d of %d repositories failed", len(failed), len(results))}
+	}
+	return nil
+}
+
+// askRepo reads one repository and sends the prompt with its contents
+func askRepo(prompt, stdinContext, path string, settings *config.Settings) (result repoResult) {
+	result.Repo = path
+	start := time.Now()
+	defer func() {
+		result.Duration = time.Since(start)
+		if result.err != nil {
+			result.Error = result.err.Error()
+			result.ExitCode = exitCode(result.err)
+		}
+	}()
+
+	ignore, err := config.LoadIgnore(path)
+	if err != nil {
+		result.err = err
+		return result
+	}
+	files, err := repo.ReadRepository(path, append(append([]string{}, settings.Exclude...), ignore...))
+	if err != nil {
+		result.err = fmt.Errorf("error reading repository: %v", err)
+		return result
+	}
+	result.Files = len(files)
+
+	client := ollama.NewClient(settings.URL, settings.Model, settings.Temperature, settings.TopP)
+	client.System = settings.System
+	if result.err = checkContextWindow(client, prompt, stdinContext+repo.CreateContext(files), 0, false); result.err != nil {
+		return result
+	}
+	result.Response, result.Stats, err = client.GenerateWithStats(prompt, stdinContext+repo.CreateContext(files), false, nil)
+	if err != nil {
+		result.err = batchError(err, nil)
+		return result
+	}
+
+	return result
+}
+
+// formatRepoReport combines the responses into one Markdown report with a
+// section per repository
+func formatRepoReport(results []repoResult) string {
+	var buf strings.Builder
+	for _, result := range results {
+		fmt.Fprintf(&buf, "## %s\n\n", result.Repo)
+		if result.err != nil {
+			fmt.Fprintf(&buf, "Error: %s\n\n", result.Error)
+			continue
+		}
+		buf.WriteString(strings.TrimSpace(result.Response) + "\n\n")
+	}
+	return buf.String()
+}
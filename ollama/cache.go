@@ -0,0 +1,90 @@
+package ollama
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// cacheDir is the directory responses are cached in; "" disables the cache
+var cacheDir string
+
+// cacheTTL is how long a cached response is reused
+var cacheTTL time.Duration
+
+// SetCache caches responses in dir for ttl, so an identical request returns the
+// earlier response without contacting Ollama. An empty dir or a ttl of zero
+// disables the cache.
+func SetCache(dir string, ttl time.Duration) {
+	if ttl <= 0 {
+		dir = ""
+	}
+	cacheDir = dir
+	cacheTTL = ttl
+}
+
+// cacheEntry is a cached response and the final streamed message that came with it
+type cacheEntry struct {
+	Created  time.Time `json:"created"`
+	Response string    `json:"response"`
+	Final    Response  `json:"final"`
+}
+
+// cacheKey hashes everything that determines a response: the server, the
+// model, the system prompt, the conversation state, the options and the full
+// prompt
+func cacheKey(url string, request Request) string {
+	request.Stream = false
+	data, _ := json.Marshal(request)
+	sum := sha256.Sum256(append([]byte(url+"\n"), data...))
+	return hex.EncodeToString(sum[:])
+}
+
+// readCache returns the cached response for a key if it has not expired.
+// Expired entries are removed.
+func readCache(key string) (cacheEntry, bool) {
+	var entry cacheEntry
+	if cacheDir == "" {
+		return entry, false
+	}
+
+	path := filepath.Join(cacheDir, key+".json")
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return entry, false
+	}
+	if err := json.Unmarshal(data, &entry); err != nil || time.Since(entry.Created) > cacheTTL {
+		os.Remove(path)
+		return entry, false
+	}
+	return entry, true
+}
+
+// writeCache stores a response. The cache is best effort, so errors are ignored.
+func writeCache(key string, entry cacheEntry) {
+	if cacheDir == "" {
+		return
+	}
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return
+	}
+	if err := os.MkdirAll(cacheDir, 0755); err != nil {
+		return
+	}
+
+	// Write to a temporary file first so concurrent readers never see a partial entry
+	path := filepath.Join(cacheDir, key+".json")
+	tmp, err := os.CreateTemp(cacheDir, key+".*.tmp")
+	if err != nil {
+		return
+	}
+	_, err = tmp.Write(data)
+	tmp.Close()
+	if err != nil || os.Rename(tmp.Name(), path) != nil {
+		os.Remove(tmp.Name())
+	}
+}
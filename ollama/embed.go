@@ -0,0 +1,43 @@
+package ollama
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+// embedRequest is the body of a request to /api/embed
+type embedRequest struct {
+	Model string   `json:"model"`
+	Input []string `json:"input"`
+}
+
+// Embed returns an embedding vector for each input, computed by an embedding model
+func (c *Client) Embed(model string, inputs []string) ([][]float32, error) {
+	jsonData, err := json.Marshal(embedRequest{Model: model, Input: inputs})
+	if err != nil {
+		return nil, fmt.Errorf("error marshaling request: %v", err)
+	}
+
+	resp, err := http.Post(c.URL+"/api/embed", "application/json", bytes.NewBuffer(jsonData))
+	if err != nil {
+		return nil, &ConnectionError{URL: c.URL, Err: err}
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, responseError(resp, model)
+	}
+
+	var result struct {
+		Embeddings [][]float32 `json:"embeddings"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, fmt.Errorf("error decoding embeddings: %v", err)
+	}
+	if len(result.Embeddings) != len(inputs) {
+		return nil, fmt.Errorf("expected %d embeddings, got %d", len(inputs), len(result.Embeddings))
+	}
+	return result.Embeddings, nil
+}
@@ -0,0 +1,74 @@
+package ollama
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// ModelNotFoundError reports that the requested model is not installed on the server
+type ModelNotFoundError struct {
+	Model string
+}
+
+func (e *ModelNotFoundError) Error() string {
+	return fmt.Sprintf("model '%s' is not installed on the Ollama server; run `ollama pull %s`, or pick an installed one with -model (`ollama list` shows them)", e.Model, e.Model)
+}
+
+// OutOfMemoryError reports that Ollama could not load or run the model in the
+// memory it has
+type OutOfMemoryError struct {
+	Model   string
+	Message string // Ollama's explanation
+}
+
+func (e *OutOfMemoryError) Error() string {
+	return fmt.Sprintf("Ollama does not have enough memory to run '%s' (%s); try a smaller model or quantization, stop other loaded models (`ollama ps`), or lower -num-ctx", e.Model, e.Message)
+}
+
+// RateLimitError reports that the server is refusing requests until earlier
+// ones have finished
+type RateLimitError struct {
+	StatusCode int
+	RetryAfter string // Value of the Retry-After header, if any
+}
+
+func (e *RateLimitError) Error() string {
+	if e.RetryAfter != "" {
+		return fmt.Sprintf("the server is busy and rejected the request (HTTP %d); try again after %s seconds", e.StatusCode, e.RetryAfter)
+	}
+	return fmt.Sprintf("the server is busy and rejected the request (HTTP %d); wait for other requests to finish and try again", e.StatusCode)
+}
+
+// outOfMemoryMarkers are phrases Ollama and its runners use when a model does not fit in memory
+var outOfMemoryMarkers = []string{"out of memory", "requires more system memory", "insufficient memory", "unable to allocate", "cudamalloc failed"}
+
+// responseError turns a failed response into the most specific error for it:
+// a missing model, lack of memory, a busy server, or else an HTTPError with
+// Ollama's message rather than the raw body
+func responseError(resp *http.Response, model string) error {
+	body, _ := io.ReadAll(resp.Body)
+	message := strings.TrimSpace(string(body))
+	var payload struct {
+		Error string `json:"error"`
+	}
+	if json.Unmarshal(body, &payload) == nil && payload.Error != "" {
+		message = payload.Error
+	}
+
+	lower := strings.ToLower(message)
+	switch {
+	case resp.StatusCode == http.StatusNotFound && model != "" && strings.Contains(lower, "not found"):
+		return &ModelNotFoundError{Model: model}
+	case resp.StatusCode == http.StatusTooManyRequests || (resp.StatusCode == http.StatusServiceUnavailable && strings.Contains(lower, "busy")):
+		return &RateLimitError{StatusCode: resp.StatusCode, RetryAfter: resp.Header.Get("Retry-After")}
+	}
+	for _, marker := range outOfMemoryMarkers {
+		if strings.Contains(lower, marker) {
+			return &OutOfMemoryError{Model: model, Message: message}
+		}
+	}
+	return &HTTPError{StatusCode: resp.StatusCode, Body: message}
+}
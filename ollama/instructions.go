@@ -0,0 +1,60 @@
+package ollama
+
+import (
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// ToolInstructionModes lists when the tool instructions can be sent: with
+// every prompt, only with prompts that look like they need tools, or in the
+// system prompt, which Ollama evaluates once and reuses while it is unchanged
+var ToolInstructionModes = []string{"always", "auto", "system"}
+
+// toolInstructionMode is the mode set by SetToolInstructions
+var toolInstructionMode = "always"
+
+// SetToolInstructions sets when the tool instructions are sent to the model
+func SetToolInstructions(mode string) error {
+	if !slices.Contains(ToolInstructionModes, mode) {
+		return fmt.Errorf("unknown tool instructions mode %q (available: %s)", mode, strings.Join(ToolInstructionModes, ", "))
+	}
+	toolInstructionMode = mode
+	return nil
+}
+
+// toolVerbs are words of prompts that ask for something done to the
+// repository rather than explained
+var toolVerbs = regexp.MustCompile(`(?i)\b(run|execute|test|build|compile|fix|change|edit|modify|update|create|add|write|implement|refactor|rename|move|delete|remove|apply|patch|install|lint|format|generate|read|open|list|search|find|grep|check|debug|commit|migrate|replace|upgrade|bump|tools?)\b`)
+
+// NeedsTools guesses whether a prompt needs tools: whether it asks for
+// something to be done, found or checked rather than only explained
+func NeedsTools(prompt string) bool {
+	return toolVerbs.MatchString(prompt)
+}
+
+// instructionsInPrompt reports whether the tool instructions go in the prompt
+// for a question when tools are enabled
+func instructionsInPrompt(prompt string) bool {
+	switch toolInstructionMode {
+	case "auto":
+		return NeedsTools(prompt)
+	case "system":
+		return false
+	}
+	return true
+}
+
+// BuildSystem returns the system prompt sent with a request: the configured
+// one, followed by the tool instructions when they go in the system prompt
+func BuildSystem(system string, toolsEnabled bool) string {
+	if !toolsEnabled || toolInstructionMode != "system" {
+		return system
+	}
+	instructions := strings.TrimSpace(toolInstructions())
+	if system == "" {
+		return instructions
+	}
+	return system + "\n\n" + instructions
+}
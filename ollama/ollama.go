@@ -3,17 +3,28 @@ package ollama
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
+	"strconv"
 	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/kek/slop-shop/debuglog"
 )
 
 // Request represents the request structure for Ollama API
 type Request struct {
 	Model   string  `json:"model"`
 	Prompt  string  `json:"prompt"`
+	System  string  `json:"system,omitempty"`
+	Context []int   `json:"context,omitempty"` // Conversation state returned by a previous response
 	Stream  bool    `json:"stream"`
 	Options Options `json:"options,omitempty"`
 }
@@ -22,6 +33,8 @@ type Request struct {
 type Options struct {
 	Temperature float64 `json:"temperature,omitempty"`
 	TopP        float64 `json:"top_p,omitempty"`
+	NumCtx      int     `json:"num_ctx,omitempty"`
+	Seed        int     `json:"seed,omitempty"`
 }
 
 // Response represents the response from Ollama API
@@ -37,45 +50,243 @@ type Response struct {
 	PromptEvalDuration int64  `json:"prompt_eval_duration,omitempty"`
 	EvalCount          int    `json:"eval_count,omitempty"`
 	EvalDuration       int64  `json:"eval_duration,omitempty"`
+
+	cached bool // Whether the response came from the response cache
+}
+
+// ConnectionError reports that the Ollama server could not be reached
+type ConnectionError struct {
+	URL string
+	Err error
+}
+
+func (e *ConnectionError) Error() string {
+	var dnsErr *net.DNSError
+	switch {
+	case errors.Is(e.Err, syscall.ECONNREFUSED):
+		return fmt.Sprintf("cannot connect to Ollama at %s: nothing is listening there; start it with `ollama serve`, or point -url at the right server", e.URL)
+	case errors.As(e.Err, &dnsErr):
+		return fmt.Sprintf("cannot connect to Ollama at %s: unknown host %s; check -url", e.URL, dnsErr.Name)
+	case errors.Is(e.Err, io.ErrUnexpectedEOF), errors.Is(e.Err, syscall.ECONNRESET):
+		return fmt.Sprintf("lost the connection to Ollama at %s while the response was streaming; it may have restarted", e.URL)
+	}
+	return fmt.Sprintf("error sending request: %v", e.Err)
+}
+
+func (e *ConnectionError) Unwrap() error {
+	return e.Err
+}
+
+// HTTPError reports that the Ollama server rejected a request, for example
+// because the model is not installed
+type HTTPError struct {
+	StatusCode int
+	Body       string
+}
+
+func (e *HTTPError) Error() string {
+	return fmt.Sprintf("HTTP error %d: %s", e.StatusCode, e.Body)
+}
+
+// Client holds the connection settings used for requests to an Ollama server
+type Client struct {
+	URL         string
+	Model       string
+	Temperature float64
+	TopP        float64
+	System      string // System prompt sent with every request, if set
+	Seed        int    // Sampling seed, so different seeds give different answers; 0 leaves it to Ollama
+	Label       string // What the client's requests are for, shown in the request queue
+
+	// Ctx cancels the client's requests when it is done; nil means the
+	// context set with SetContext
+	Ctx context.Context
+}
+
+// requestContext cancels the requests of clients without their own context
+var requestContext = context.Background()
+
+// SetContext sets the context whose cancellation aborts the requests in flight,
+// for clients without their own context
+func SetContext(ctx context.Context) {
+	requestContext = ctx
+}
+
+// ErrInterrupted is returned, along with the response received so far, when
+// a request is cancelled while it streams
+var ErrInterrupted = errors.New("interrupted")
+
+// options returns the generation options of the client's requests
+func (c *Client) options() Options {
+	return Options{Temperature: c.Temperature, TopP: c.TopP, Seed: c.Seed}
+}
+
+// ctx returns the context that cancels the client's requests
+func (c *Client) ctx() context.Context {
+	if c.Ctx != nil {
+		return c.Ctx
+	}
+	return requestContext
+}
+
+// NewClient creates a client for the given Ollama server and model
+func NewClient(url, model string, temperature, topP float64) *Client {
+	return &Client{
+		URL:         url,
+		Model:       model,
+		Temperature: temperature,
+		TopP:        topP,
+	}
+}
+
+// Stats reports token counts and timings for a generation, as measured by Ollama
+type Stats struct {
+	PromptTokens       int           `json:"prompt_tokens"`
+	ResponseTokens     int           `json:"response_tokens"`
+	TotalDuration      time.Duration `json:"total_duration"`
+	LoadDuration       time.Duration `json:"load_duration"`
+	PromptEvalDuration time.Duration `json:"prompt_eval_duration"`
+	EvalDuration       time.Duration `json:"eval_duration"`
+	Cached             bool          `json:"cached,omitempty"` // The response came from the cache, not the model
+}
+
+// TokensPerSecond returns the generation speed, or 0 when it was not reported
+func (s Stats) TokensPerSecond() float64 {
+	if s.EvalDuration <= 0 {
+		return 0
+	}
+	return float64(s.ResponseTokens) / s.EvalDuration.Seconds()
+}
+
+// Generate sends a prompt with context using the client's settings, streaming chunks to chunkCallback
+func (c *Client) Generate(prompt, context string, toolsEnabled bool, chunkCallback func(string)) (string, error) {
+	ctx, request := c.startRequest()
+	defer request.finish()
+	response, _, err := generate(ctx, c.URL, c.Model, c.System, nil, prompt, context, c.options(), toolsEnabled, request.stream(chunkCallback))
+	return response, err
+}
+
+// GenerateWithStats works like Generate and also returns the token counts and timings of the generation
+func (c *Client) GenerateWithStats(prompt, context string, toolsEnabled bool, chunkCallback func(string)) (string, Stats, error) {
+	ctx, request := c.startRequest()
+	defer request.finish()
+	response, final, err := generate(ctx, c.URL, c.Model, c.System, nil, prompt, context, c.options(), toolsEnabled, request.stream(chunkCallback))
+	return response, final.stats(), err
+}
+
+// Continue works like GenerateWithStats but continues the conversation whose
+// state Ollama returned in history. It also returns the state after this
+// response, to be passed to the next call.
+func (c *Client) Continue(history []int, prompt, context string, toolsEnabled bool, chunkCallback func(string)) (string, Stats, []int, error) {
+	ctx, request := c.startRequest()
+	defer request.finish()
+	response, final, err := generate(ctx, c.URL, c.Model, c.System, history, prompt, context, c.options(), toolsEnabled, request.stream(chunkCallback))
+	return response, final.stats(), final.Context, err
+}
+
+// stats converts the counters of a final streamed response
+func (r Response) stats() Stats {
+	return Stats{
+		PromptTokens:       r.PromptEvalCount,
+		ResponseTokens:     r.EvalCount,
+		TotalDuration:      time.Duration(r.TotalDuration),
+		LoadDuration:       time.Duration(r.LoadDuration),
+		PromptEvalDuration: time.Duration(r.PromptEvalDuration),
+		EvalDuration:       time.Duration(r.EvalDuration),
+		Cached:             r.cached,
+	}
 }
 
 // SendToOllamaWithCallback sends the request to Ollama API with streaming support and optional callback
 func SendToOllamaWithCallback(url, model, prompt, context string, temperature, topP float64, toolsEnabled bool, chunkCallback func(string)) (string, error) {
-	// Combine context and prompt
-	fullPrompt := context + "\n\nUser Question: " + prompt
+	response, _, err := generate(requestContext, url, model, "", nil, prompt, context, Options{Temperature: temperature, TopP: topP}, toolsEnabled, chunkCallback)
+	return response, err
+}
 
-	if toolsEnabled {
-		fullPrompt = addToolInstructions(fullPrompt)
+// generateOnce streams a completion and returns the full response along with
+// the final streamed message, which carries Ollama's token counts and timings.
+// The prompt and response are recorded in the transcript if one is set.
+func generateOnce(ctx context.Context, url, model, system string, history []int, prompt, context string, options Options, toolsEnabled bool, chunkCallback func(string)) (string, Response, error) {
+	if transcript == nil {
+		return generateStream(ctx, url, model, system, history, prompt, context, options, toolsEnabled, chunkCallback)
 	}
 
+	// Record the prompt and each chunk as it arrives, so the transcript is
+	// complete up to the moment the process stops
+	fmt.Fprintf(transcript, "## Prompt to %s, %s\n\n%s\n\n## Response\n\n", model, time.Now().Format(time.DateTime), strings.TrimSpace(prompt))
+	response, final, err := generateStream(ctx, url, model, system, history, prompt, context, options, toolsEnabled, func(chunk string) {
+		io.WriteString(transcript, chunk)
+		if chunkCallback != nil {
+			chunkCallback(chunk)
+		}
+	})
+	switch {
+	case errors.Is(err, ErrInterrupted):
+		io.WriteString(transcript, "\n\n[interrupted]")
+	case err != nil:
+		fmt.Fprintf(transcript, "[error: %v]", err)
+	}
+	io.WriteString(transcript, "\n\n")
+	return response, final, err
+}
+
+// generateStream sends a request to Ollama, or answers it from the cache, and
+// passes the response to chunkCallback as it streams in
+func generateStream(ctx context.Context, url, model, system string, history []int, prompt, context string, options Options, toolsEnabled bool, chunkCallback func(string)) (string, Response, error) {
+	var final Response
+
+	fullPrompt := BuildPrompt(prompt, context, toolsEnabled)
+
 	// Prepare the request
 	request := Request{
-		Model:  model,
-		Prompt: fullPrompt,
-		Stream: true, // Enable streaming
-		Options: Options{
-			Temperature: temperature,
-			TopP:        topP,
-		},
+		Model:   model,
+		Prompt:  fullPrompt,
+		System:  BuildSystem(system, toolsEnabled),
+		Context: history,
+		Stream:  true, // Enable streaming
+		Options: options,
+	}
+	request.Options.NumCtx = numCtx
+
+	// Return an identical earlier request's response from the cache
+	key := cacheKey(url, request)
+	if entry, ok := readCache(key); ok {
+		debuglog.Logf("ollama", "%s: answered from the cache (%d bytes)", model, len(entry.Response))
+		if chunkCallback != nil && entry.Response != "" {
+			chunkCallback(entry.Response)
+		}
+		entry.Final.cached = true
+		return entry.Response, entry.Final, nil
 	}
 
 	// Convert to JSON
 	jsonData, err := json.Marshal(request)
 	if err != nil {
-		return "", fmt.Errorf("error marshaling request: %v", err)
+		return "", final, fmt.Errorf("error marshaling request: %v", err)
 	}
 
 	// Send HTTP request
-	resp, err := http.Post(url+"/api/generate", "application/json", bytes.NewBuffer(jsonData))
+	httpRequest, err := http.NewRequestWithContext(ctx, http.MethodPost, url+"/api/generate", bytes.NewBuffer(jsonData))
 	if err != nil {
-		return "", fmt.Errorf("error sending request: %v", err)
+		return "", final, fmt.Errorf("error creating request: %v", err)
+	}
+	httpRequest.Header.Set("Content-Type", "application/json")
+	debuglog.Logf("ollama", "POST %s/api/generate model=%s prompt=%d bytes context=%d tokens", url, model, len(fullPrompt), len(history))
+	start := time.Now()
+	resp, err := http.DefaultClient.Do(httpRequest)
+	if err != nil {
+		debuglog.Logf("ollama", "request failed after %s: %v", time.Since(start), err)
+		if ctx.Err() != nil {
+			return "", final, ErrInterrupted
+		}
+		return "", final, &ConnectionError{URL: url, Err: err}
 	}
 	defer resp.Body.Close()
 
 	// Check HTTP status
+	debuglog.Logf("ollama", "HTTP %d after %s", resp.StatusCode, time.Since(start))
 	if resp.StatusCode != http.StatusOK {
-		body, _ := io.ReadAll(resp.Body)
-		return "", fmt.Errorf("HTTP error %d: %s", resp.StatusCode, string(body))
+		return "", final, responseError(resp, model)
 	}
 
 	// Handle streaming response
@@ -88,7 +299,10 @@ func SendToOllamaWithCallback(url, model, prompt, context string, temperature, t
 			if err == io.EOF {
 				break
 			}
-			return "", fmt.Errorf("error reading streaming response: %v", err)
+			if ctx.Err() != nil {
+				return fullResponse.String(), final, ErrInterrupted
+			}
+			return "", final, &ConnectionError{URL: url, Err: err}
 		}
 
 		line = strings.TrimSpace(line)
@@ -114,16 +328,215 @@ func SendToOllamaWithCallback(url, model, prompt, context string, temperature, t
 
 		// Check if response is complete
 		if ollamaResp.Done {
+			final = ollamaResp
 			break
 		}
 	}
 
-	return fullResponse.String(), nil
+	debuglog.Logf("ollama", "response of %d bytes after %s, done=%t prompt_eval=%d eval=%d", fullResponse.Len(), time.Since(start), final.Done, final.PromptEvalCount, final.EvalCount)
+	if final.Done {
+		if usageHook != nil {
+			usageHook(model, final.stats())
+		}
+		// An empty response is retried rather than reused
+		if strings.TrimSpace(fullResponse.String()) != "" {
+			writeCache(key, cacheEntry{Created: time.Now(), Response: fullResponse.String(), Final: final})
+		}
+	}
+	return fullResponse.String(), final, nil
 }
 
-// addToolInstructions adds tool execution instructions to the prompt
-func addToolInstructions(prompt string) string {
-	toolInstructions := `
+// ListModels returns the names of the models installed on the Ollama server
+func (c *Client) ListModels() ([]string, error) {
+	httpClient := &http.Client{Timeout: 10 * time.Second}
+	resp, err := httpClient.Get(c.URL + "/api/tags")
+	if err != nil {
+		return nil, &ConnectionError{URL: c.URL, Err: err}
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, responseError(resp, "")
+	}
+
+	var tags struct {
+		Models []struct {
+			Name string `json:"name"`
+		} `json:"models"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&tags); err != nil {
+		return nil, fmt.Errorf("error decoding model list: %v", err)
+	}
+
+	names := make([]string, 0, len(tags.Models))
+	for _, model := range tags.Models {
+		names = append(names, model.Name)
+	}
+	return names, nil
+}
+
+// Ping checks that the Ollama server answers, without loading a model
+func (c *Client) Ping() error {
+	httpClient := &http.Client{Timeout: 5 * time.Second}
+	resp, err := httpClient.Get(c.URL + "/api/version")
+	if err != nil {
+		return &ConnectionError{URL: c.URL, Err: err}
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return responseError(resp, "")
+	}
+	return nil
+}
+
+// DefaultNumCtx is the context window Ollama gives a model whose parameters do not set num_ctx
+const DefaultNumCtx = 4096
+
+// numCtx overrides the context window of every request when it is not zero
+var numCtx int
+
+// SetNumCtx sets the context window, in tokens, requested for every
+// generation; zero leaves it to the model's parameters
+func SetNumCtx(n int) {
+	numCtx = n
+}
+
+// ContextWindow returns the context window a request to the client's model
+// gets, in tokens: the one set with SetNumCtx, else the model's num_ctx
+// parameter, else DefaultNumCtx. It also returns the longest context the model
+// supports, or 0 when Ollama does not report it.
+func (c *Client) ContextWindow() (window, limit int, err error) {
+	jsonData, err := json.Marshal(map[string]string{"model": c.Model})
+	if err != nil {
+		return 0, 0, fmt.Errorf("error marshaling request: %v", err)
+	}
+
+	httpClient := &http.Client{Timeout: 10 * time.Second}
+	resp, err := httpClient.Post(c.URL+"/api/show", "application/json", bytes.NewBuffer(jsonData))
+	if err != nil {
+		return 0, 0, &ConnectionError{URL: c.URL, Err: err}
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return 0, 0, responseError(resp, c.Model)
+	}
+
+	var show struct {
+		Parameters string         `json:"parameters"`
+		ModelInfo  map[string]any `json:"model_info"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&show); err != nil {
+		return 0, 0, fmt.Errorf("error decoding model information: %v", err)
+	}
+
+	// The trained context length is reported as <architecture>.context_length
+	for key, value := range show.ModelInfo {
+		if length, ok := value.(float64); ok && strings.HasSuffix(key, ".context_length") {
+			limit = int(length)
+		}
+	}
+
+	window = DefaultNumCtx
+	for _, line := range strings.Split(show.Parameters, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 2 && fields[0] == "num_ctx" {
+			if n, err := strconv.Atoi(fields[1]); err == nil {
+				window = n
+			}
+		}
+	}
+	if numCtx > 0 {
+		window = numCtx
+	}
+	return window, limit, nil
+}
+
+// usageHook is called with the model and counters of every completed generation
+var usageHook func(model string, stats Stats)
+
+// SetUsageHook registers a function called with the model and token counts of
+// every completed generation; nil removes it
+func SetUsageHook(hook func(model string, stats Stats)) {
+	usageHook = hook
+}
+
+// transcript receives every prompt and the response streamed for it; nil turns it off
+var transcript io.Writer
+
+// SetTranscript sets where prompts and responses are recorded as they happen;
+// nil stops recording
+func SetTranscript(w io.Writer) {
+	transcript = w
+}
+
+// Note records an event of the session, such as a change of repository, in
+// the transcript
+func Note(text string) {
+	if transcript != nil {
+		fmt.Fprintf(transcript, "## %s, %s\n\n", text, time.Now().Format(time.DateTime))
+	}
+}
+
+// customToolInstructions describes user-defined tools appended to the built-in tool list
+var customToolInstructions string
+
+// SetCustomToolInstructions sets the description of user-defined tools advertised to the model
+func SetCustomToolInstructions(instructions string) {
+	customToolInstructions = instructions
+}
+
+// BuildPrompt returns the prompt text sent for a question: the context, the
+// project memory, the question and, when tools are enabled, the tool instructions
+func BuildPrompt(prompt, context string, toolsEnabled bool) string {
+	fullPrompt := context + MemorySection() + "\n\nUser Question: " + prompt
+	if toolsEnabled && instructionsInPrompt(prompt) {
+		fullPrompt += toolInstructions() + "\n\nUser request: " + prompt
+	}
+	return fullPrompt
+}
+
+// memory holds the project memory notes remembered during the session, which
+// are included in every prompt after. The notes kept before the session go in
+// the context, by the memory context provider.
+var (
+	memoryMu sync.Mutex
+	memory   string
+)
+
+// SetMemory sets the project memory notes included in every prompt
+func SetMemory(notes string) {
+	memoryMu.Lock()
+	defer memoryMu.Unlock()
+	memory = notes
+}
+
+// Memory returns the project memory notes included in every prompt
+func Memory() string {
+	memoryMu.Lock()
+	defer memoryMu.Unlock()
+	return memory
+}
+
+// MemorySection formats the project memory notes for the prompt, or returns ""
+// if there are none
+func MemorySection() string {
+	notes := Memory()
+	if notes == "" {
+		return ""
+	}
+	return "\n\nProject Memory (notes kept from earlier sessions):\n" + notes
+}
+
+// EstimateTokens approximates the number of tokens in text at four bytes per
+// token; the real count depends on the model's tokenizer
+func EstimateTokens(text string) int {
+	return (len(text) + 3) / 4
+}
+
+// toolInstructions describes the tools and how to call them
+func toolInstructions() string {
+	return `
 
 AVAILABLE TOOLS:
 You can use the following tools by including them in your response:
@@ -160,8 +573,19 @@ You can use the following tools by including them in your response:
    Example: GENERATE_DIFF: Update README with new features
 
 7. APPLY_DIFF: Apply a unified diff to the repository
-   Format: APPLY_DIFF: <unified diff content>
-   Example: APPLY_DIFF: --- a/file.txt\n+++ b/file.txt\n@@ -1,3 +1,4 @@\n line1\n+new line\n line2\n line3
+   Format: APPLY_DIFF: followed by the diff between BEGIN_DIFF and END_DIFF (a fenced diff code block also works)
+   Example: APPLY_DIFF:
+   BEGIN_DIFF
+   --- a/file.txt
+   +++ b/file.txt
+   @@ -1,3 +1,4 @@
+    line1
+   +new line
+    line2
+    line3
+   END_DIFF
+   Use "--- /dev/null" for new files, "+++ /dev/null" for deleted files and
+   git "rename from"/"rename to" headers to move files
 
 8. CREATE_FILE: Create a new file with specified content
    Format: CREATE_FILE: <filepath>
@@ -178,24 +602,65 @@ You can use the following tools by including them in your response:
    This is a new documentation file.
    END_FILE
 
+9. SHELL: Run a command in a persistent shell session
+   Format: SHELL: <command>
+   The working directory and exported variables carry over between SHELL calls
+   Example: SHELL: cd src
+   Example: SHELL: export GOFLAGS=-mod=mod
+   Example: SHELL: go test ./...
+
+10. LINT: Run the project's linters and report file:line diagnostics
+   Format: LINT: [language]
+   Example: LINT:
+   Example: LINT: go
+
+11. FORMAT: Run the project's formatters and report the files they changed
+   Format: FORMAT: [language]
+   Example: FORMAT: go
+
+12. FIND_SYMBOL: Find where a function, type, class, method, constant or variable is defined and used (Go, Python, JavaScript, TypeScript, Rust or Java)
+   Format: FIND_SYMBOL: <name>
+   Example: FIND_SYMBOL: ReadRepository
+   Example: FIND_SYMBOL: Client.Generate
+
+13. CODE_SEARCH: Search file contents with a regular expression and get matching lines with line numbers
+   Format: CODE_SEARCH: "<regex>" [directory]
+   Example: CODE_SEARCH: "func (New|Open)[A-Z]" .
+   Example: CODE_SEARCH: "TODO" src/
+
+14. REMEMBER: Save a durable fact about the project for future sessions (a convention, gotcha or decision)
+   Format: REMEMBER: <fact>
+   Example: REMEMBER: Integration tests need a running Ollama server and are skipped in CI
+` + customToolSection() + `
 CRITICAL INSTRUCTIONS FOR TOOL USAGE:
 - You MUST use these tools to accomplish the user's request
 - Do NOT just describe what you would do - actually DO it using the tools
-- Start by examining the current state using READ_FILE, LIST_DIR, or SEARCH_FILES
+- Start by examining the current state using READ_FILE, LIST_DIR, CODE_SEARCH or FIND_SYMBOL
 - Then use GENERATE_DIFF to create the necessary changes
-- Finally use APPLY_DIFF to implement those changes
+- Finally use APPLY_DIFF to implement those changes, then LINT to check them
 - Each tool call must be on a separate line with the exact format shown above
 - Do NOT mix tool calls with other output
 - You can use multiple tools in one response, but each tool call should be on a separate line
 - After using tools, you can analyze the results and provide insights or suggestions
+- Put build outputs, downloads and other files that do not belong in the repository in $SLOP_SHOP_SCRATCH, a temporary directory that is deleted when the session ends; file tools accept paths such as $SLOP_SHOP_SCRATCH/notes.txt
+
+FINISHING:
+When the request is done, and only then, end your response with these two lines:
+FINAL_ANSWER: <summary of the outcome>
+CHANGED_FILES: <comma-separated paths you created, changed or deleted, or none>
+Do not write FINAL_ANSWER in a response that still uses tools whose results you need.
 
 WORKFLOW FOR FILE MODIFICATIONS:
 1. First, examine the current files using READ_FILE or SEARCH_FILES
 2. Use GENERATE_DIFF to create the changes needed
 3. Use APPLY_DIFF to implement those changes
-4. Verify the changes worked as expected
-
-User request: ` + prompt
+4. Verify the changes worked as expected`
+}
 
-	return prompt + toolInstructions
+// customToolSection formats the user-defined tool descriptions for the tool instructions
+func customToolSection() string {
+	if customToolInstructions == "" {
+		return ""
+	}
+	return "\n" + customToolInstructions
 }
@@ -0,0 +1,93 @@
+package ollama
+
+import (
+	"context"
+	"slices"
+	"sync"
+	"time"
+)
+
+// QueuedRequest describes a request to the server that has not finished
+type QueuedRequest struct {
+	ID        int
+	Label     string // What the request is for, from the client's Label
+	Model     string
+	Started   time.Time
+	Streaming bool // The response is arriving; false while the server queues the request or reads the prompt
+}
+
+// inFlight is a request in the queue with the function that cancels it
+type inFlight struct {
+	QueuedRequest
+	cancel context.CancelFunc
+}
+
+var (
+	queueMu sync.Mutex
+	queue   []*inFlight
+	lastID  int
+)
+
+// Requests returns the requests in flight, oldest first
+func Requests() []QueuedRequest {
+	queueMu.Lock()
+	defer queueMu.Unlock()
+	requests := make([]QueuedRequest, len(queue))
+	for i, request := range queue {
+		requests[i] = request.QueuedRequest
+	}
+	return requests
+}
+
+// CancelRequest cancels the request in flight with the given ID, which then
+// returns ErrInterrupted. It reports whether the request was still in flight.
+func CancelRequest(id int) bool {
+	queueMu.Lock()
+	defer queueMu.Unlock()
+	for _, request := range queue {
+		if request.ID == id {
+			request.cancel()
+			return true
+		}
+	}
+	return false
+}
+
+// startRequest adds a request of the client to the queue. It returns the
+// context the request is sent with, which CancelRequest cancels, and the
+// entry, whose finish removes it again.
+func (c *Client) startRequest() (context.Context, *inFlight) {
+	ctx, cancel := context.WithCancel(c.ctx())
+	label := c.Label
+	if label == "" {
+		label = "request"
+	}
+
+	queueMu.Lock()
+	defer queueMu.Unlock()
+	lastID++
+	request := &inFlight{QueuedRequest: QueuedRequest{ID: lastID, Label: label, Model: c.Model, Started: time.Now()}, cancel: cancel}
+	queue = append(queue, request)
+	return ctx, request
+}
+
+// stream returns chunkCallback marking the request as streaming when the
+// first chunk arrives
+func (r *inFlight) stream(chunkCallback func(string)) func(string) {
+	return func(chunk string) {
+		queueMu.Lock()
+		r.Streaming = true
+		queueMu.Unlock()
+		if chunkCallback != nil {
+			chunkCallback(chunk)
+		}
+	}
+}
+
+// finish removes the request from the queue
+func (r *inFlight) finish() {
+	r.cancel()
+	queueMu.Lock()
+	defer queueMu.Unlock()
+	queue = slices.DeleteFunc(queue, func(other *inFlight) bool { return other == r })
+}
@@ -0,0 +1,93 @@
+package ollama
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/kek/slop-shop/debuglog"
+)
+
+// EmptyRetry is how requests answered with an empty or whitespace-only
+// response are retried, as set in the configuration
+type EmptyRetry struct {
+	Retries         *int     `toml:"retries"`          // Requests sent again before giving up
+	TemperatureStep *float64 `toml:"temperature_step"` // Added to the temperature on each retry
+}
+
+// emptyRetries and temperatureStep are set by SetEmptyRetry
+var (
+	emptyRetries    = 2
+	temperatureStep = 0.2
+)
+
+// maxTemperature bounds the temperature retries nudge towards
+const maxTemperature = 2.0
+
+// SetEmptyRetry sets how empty responses are retried; unset fields keep
+// their defaults of 2 retries, each 0.2 warmer than the last
+func SetEmptyRetry(r EmptyRetry) error {
+	retries, step := 2, 0.2
+	if r.Retries != nil {
+		retries = *r.Retries
+	}
+	if r.TemperatureStep != nil {
+		step = *r.TemperatureStep
+	}
+	if retries < 0 || retries > 10 {
+		return fmt.Errorf("invalid number of empty response retries %d (use 0 to 10)", retries)
+	}
+	if step < 0 || step > 1 {
+		return fmt.Errorf("invalid temperature step %g (use 0 to 1)", step)
+	}
+	emptyRetries, temperatureStep = retries, step
+	return nil
+}
+
+// EmptyResponseError reports that the model answered with nothing, every
+// time it was asked
+type EmptyResponseError struct {
+	Model    string
+	Attempts int
+}
+
+func (e *EmptyResponseError) Error() string {
+	if e.Attempts == 1 {
+		return fmt.Sprintf("'%s' returned an empty response; ask again, or allow retries with -empty-retries", e.Model)
+	}
+	return fmt.Sprintf("'%s' returned an empty response %d times in a row, at rising temperatures; try rephrasing the question, a smaller context, or another model", e.Model, e.Attempts)
+}
+
+// generate streams a completion, as generateOnce does, and sends the request
+// again with a slightly higher temperature while the model answers with
+// nothing but whitespace. Leading whitespace is held back from chunkCallback
+// until text follows, so an empty attempt shows nothing.
+func generate(ctx context.Context, url, model, system string, history []int, prompt, context string, options Options, toolsEnabled bool, chunkCallback func(string)) (string, Response, error) {
+	for attempt := 0; ; attempt++ {
+		var held strings.Builder
+		started := false
+		callback := func(chunk string) {
+			if !started {
+				if strings.TrimSpace(chunk) == "" {
+					held.WriteString(chunk)
+					return
+				}
+				started = true
+				chunk = held.String() + chunk
+			}
+			if chunkCallback != nil {
+				chunkCallback(chunk)
+			}
+		}
+
+		response, final, err := generateOnce(ctx, url, model, system, history, prompt, context, options, toolsEnabled, callback)
+		if err != nil || strings.TrimSpace(response) != "" {
+			return response, final, err
+		}
+		if attempt == emptyRetries {
+			return "", final, &EmptyResponseError{Model: model, Attempts: attempt + 1}
+		}
+		options.Temperature = min(options.Temperature+temperatureStep, maxTemperature)
+		debuglog.Logf("ollama", "%s: empty response, retrying at temperature %g (%d of %d)", model, options.Temperature, attempt+1, emptyRetries)
+	}
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/kek/slop-shop/styles"
+	"github.com/kek/slop-shop/tui"
+)
+
+// paging opens batch responses taller than the terminal in the pager once
+// they have been streamed, so their start can be read; set by setPaging
+var paging bool
+
+// setPaging enables the pager for text output to a terminal, unless -no-pager
+// turned it off or the patch is written to stdout
+func setPaging(enabled bool, stdout io.Writer) {
+	paging = enabled && outputFormat == "text" && patchFile != "-" && isTerminal(stdout)
+}
+
+// pageResponse shows a response in the pager when paging is on and the
+// response, rendered as in the REPL, does not fit on the terminal
+func pageResponse(model, response string) {
+	if !paging || strings.TrimSpace(response) == "" {
+		return
+	}
+	height := terminalHeight(os.Stdout)
+	rendered := tui.RenderResponse(response, styles.WrapWidth(terminalWidth(os.Stdout)))
+	if height == 0 || strings.Count(rendered, "\n") < height {
+		return
+	}
+	if err := tui.PageResponse(model, response); err != nil {
+		fmt.Fprintln(os.Stderr, styles.WarningStyle.Render(fmt.Sprintf("⚠️  %v", err)))
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/kek/slop-shop/config"
+	"github.com/kek/slop-shop/ollama"
+	"github.com/kek/slop-shop/styles"
+	"github.com/kek/slop-shop/tools"
+	"github.com/kek/slop-shop/tui"
+)
+
+// patchSystemPrompt constrains the model to answer -mode patch with a diff only
+const patchSystemPrompt = "Answer with a single unified diff in the format of `git diff` and nothing else: no explanation, " +
+	"no Markdown fences and no tool calls. Use paths relative to the repository root with a/ and b/ prefixes, and " +
+	"--- /dev/null for new files. Every hunk needs correct line numbers and unchanged context lines that match the files exactly."
+
+// patchAttempts is how many answers -mode patch asks for before giving up
+var patchAttempts = 3
+
+// runPatchMode asks for the change described by prompt as a unified diff. An
+// answer that is not only a diff, or that does not apply cleanly to the
+// repository, is rejected and the model is asked again with the reason. The
+// accepted diff is written to stdout, or to the -patch-out file.
+func runPatchMode(prompt, context string, settings *config.Settings, repoPath string) error {
+	system := patchSystemPrompt
+	if settings.System != "" {
+		system = settings.System + "\n\n" + patchSystemPrompt
+	}
+	if previewOnly {
+		fmt.Print(tui.RenderPreview(settings.Model, system, prompt, context, false, true))
+		return nil
+	}
+
+	client := ollama.NewClient(settings.URL, settings.Model, settings.Temperature, settings.TopP)
+	client.System = system
+	if err := checkContextWindow(client, prompt, context, 0, false); err != nil {
+		return err
+	}
+
+	var history []int
+	question, questionContext := prompt, context
+	for attempt := 1; attempt <= patchAttempts; attempt++ {
+		fmt.Fprintln(chatter(), styles.InfoStyle.Render(fmt.Sprintf("Asking %s for a patch (attempt %d of %d)", settings.Model, attempt, patchAttempts)))
+		response, stats, newHistory, err := client.Continue(history, question, questionContext, false, nil)
+		if err != nil {
+			return batchError(err, nil)
+		}
+
+		diff, err := extractPatch(response)
+		var files []string
+		if err == nil {
+			files, err = tools.CheckPatch(diff, repoPath)
+		}
+		if err != nil {
+			fmt.Fprintln(chatter(), styles.WarningStyle.Render(fmt.Sprintf("⚠️  Rejected the answer: %v", err)))
+			history = newHistory
+			question = fmt.Sprintf("That answer was rejected: %v. Answer again with only the corrected unified diff.", err)
+			questionContext = ""
+			continue
+		}
+
+		fmt.Fprintln(chatter(), styles.SuccessStyle.Render(fmt.Sprintf("✅ The patch applies cleanly to %s", strings.Join(files, ", "))))
+		record := batchRecord{Prompt: prompt, Model: settings.Model, URL: settings.URL, System: system, Response: diff, Stats: stats}
+		if err := recordHistory(record, "", repoPath); err != nil {
+			fmt.Fprintln(os.Stderr, styles.ErrorStyle.Render(fmt.Sprintf("❌ %v", err)))
+		}
+
+		if patchFile != "" {
+			return writePatch(diff)
+		}
+		_, err = fmt.Fprint(os.Stdout, diff)
+		return err
+	}
+	return &exitError{exitModel, fmt.Errorf("the model did not produce a valid patch in %d attempts", patchAttempts)}
+}
+
+// extractPatch returns the diff of an answer that consists of nothing but a
+// unified diff, optionally inside one fenced code block, ending in a newline
+func extractPatch(response string) (string, error) {
+	text := strings.TrimSpace(response)
+	lines := strings.Split(text, "\n")
+	if len(lines) >= 2 && strings.HasPrefix(lines[0], "```") && strings.TrimSpace(lines[len(lines)-1]) == "```" {
+		text = strings.Join(lines[1:len(lines)-1], "\n")
+	}
+
+	if text == "" {
+		return "", fmt.Errorf("the answer is empty")
+	}
+	if !strings.HasPrefix(text, "diff --git ") && !strings.HasPrefix(text, "--- ") {
+		return "", fmt.Errorf("the answer must start with the diff, not %q", firstLine(text))
+	}
+	for _, line := range strings.Split(text, "\n") {
+		if !isDiffLine(line) {
+			return "", fmt.Errorf("the answer contains text outside the diff: %q", firstLine(line))
+		}
+	}
+	return text + "\n", nil
+}
+
+// diffLinePrefixes are the starts of the lines a unified diff with git extended headers consists of
+var diffLinePrefixes = []string{
+	" ", "+", "-", "@@", `\`, "diff --git ", "index ", "new file mode ", "deleted file mode ", "old mode ", "new mode ",
+	"similarity index ", "dissimilarity index ", "rename from ", "rename to ", "copy from ", "copy to ",
+}
+
+// isDiffLine reports whether a line can be part of a unified diff. Empty lines
+// are accepted as context lines that lost their leading space.
+func isDiffLine(line string) bool {
+	if line == "" {
+		return true
+	}
+	for _, prefix := range diffLinePrefixes {
+		if strings.HasPrefix(line, prefix) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,322 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kek/slop-shop/config"
+	"github.com/kek/slop-shop/styles"
+	"github.com/kek/slop-shop/tools"
+)
+
+// Plugins are executables in a plugins directory that talk to slop-shop over
+// stdio. Each invocation writes one JSON request line to the plugin's stdin
+// and reads one JSON object from its stdout:
+//
+//	{"type":"describe"}                                    -> pluginDescription
+//	{"type":"tool","name":"X","args":{...},"repo":"..."}   -> pluginResponse
+//	{"type":"context","name":"X","repo":"..."}             -> pluginResponse
+//	{"type":"command","name":"X","args":[...],"repo":"..."} -> pluginResponse
+//
+// Anything the plugin writes to stderr is passed through to slop-shop's stderr.
+
+// pluginTimeout bounds how long describe and context requests may take
+var pluginTimeout = 10 * time.Second
+
+// pluginRequest is the message sent to a plugin on stdin
+type pluginRequest struct {
+	Type string `json:"type"`
+	Name string `json:"name,omitempty"`
+	Args any    `json:"args,omitempty"`
+	Repo string `json:"repo,omitempty"`
+}
+
+// pluginResponse is the reply to a tool, context or command request
+type pluginResponse struct {
+	Output string `json:"output"`
+	Error  string `json:"error,omitempty"`
+}
+
+// pluginDescription is the reply to a describe request
+type pluginDescription struct {
+	Name     string             `json:"name"`
+	Tools    []pluginTool       `json:"tools"`
+	Context  []pluginProvider   `json:"context"`
+	Commands []pluginSubcommand `json:"commands"`
+}
+
+// pluginTool is a tool a plugin registers for the model
+type pluginTool struct {
+	Name        string                `json:"name"`
+	Description string                `json:"description"`
+	Args        []tools.CustomToolArg `json:"args"`
+}
+
+// pluginProvider is a context provider whose output is added to the repository context
+type pluginProvider struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+}
+
+// pluginSubcommand is a slop-shop subcommand implemented by a plugin
+type pluginSubcommand struct {
+	Name    string `json:"name"`
+	Usage   string `json:"usage"`
+	Summary string `json:"summary"`
+}
+
+// plugin is a discovered plugin executable and what it provides
+type plugin struct {
+	path string
+	pluginDescription
+}
+
+// pluginCache holds the plugins discovered for each repository path. The
+// server's requests discover them concurrently, so pluginMu guards it.
+var (
+	pluginMu    sync.Mutex
+	pluginCache = map[string][]*plugin{}
+)
+
+// discoverPlugins describes every executable in the user's plugin directory
+// and, once the user trusts the repository, in the repository's. Cloning a
+// repository therefore never runs its code by itself. Plugins that cannot be
+// described are reported and skipped, and a repository plugin with the file
+// name of a user plugin is skipped with a warning.
+func discoverPlugins(repoPath string) []*plugin {
+	if abs, err := filepath.Abs(repoPath); err == nil {
+		repoPath = abs
+	}
+	pluginMu.Lock()
+	defer pluginMu.Unlock()
+	if found, ok := pluginCache[repoPath]; ok {
+		return found
+	}
+
+	dirs := []string{config.UserPluginDir()}
+	if repoDir := config.RepoPluginDir(repoPath); config.IsTrusted(repoPath) {
+		dirs = append(dirs, repoDir)
+	} else if len(pluginExecutables(repoDir)) > 0 {
+		fmt.Fprintln(os.Stderr, styles.WarningStyle.Render(fmt.Sprintf("⚠️  Not running the plugins in %s, since the repository is not trusted; run `slop-shop trust` to allow them", repoDir)))
+	}
+
+	var found []*plugin
+	seen := make(map[string]bool)
+	for _, dir := range dirs {
+		for _, name := range pluginExecutables(dir) {
+			if seen[name] {
+				fmt.Fprintln(os.Stderr, styles.WarningStyle.Render(fmt.Sprintf("⚠️  Skipping plugin %s: a user plugin has the same name", filepath.Join(dir, name))))
+				continue
+			}
+			seen[name] = true
+
+			p := &plugin{path: filepath.Join(dir, name)}
+			if err := p.describe(repoPath); err != nil {
+				fmt.Fprintln(os.Stderr, styles.WarningStyle.Render(fmt.Sprintf("⚠️  Skipping plugin %s: %v", p.path, err)))
+				continue
+			}
+			found = append(found, p)
+		}
+	}
+
+	pluginCache[repoPath] = found
+	return found
+}
+
+// pluginExecutables returns the names of the executable files in a plugin directory
+func pluginExecutables(dir string) []string {
+	if dir == "" {
+		return nil
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil
+	}
+	var names []string
+	for _, entry := range entries {
+		if info, err := entry.Info(); err == nil && info.Mode().IsRegular() && info.Mode()&0111 != 0 {
+			names = append(names, entry.Name())
+		}
+	}
+	return names
+}
+
+// describe asks the plugin what it provides
+func (p *plugin) describe(repoPath string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), pluginTimeout)
+	defer cancel()
+
+	output, err := p.call(ctx, pluginRequest{Type: "describe"}, repoPath)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(output, &p.pluginDescription); err != nil {
+		return fmt.Errorf("invalid describe reply: %v", err)
+	}
+	if p.Name == "" {
+		p.Name = filepath.Base(p.path)
+	}
+	return nil
+}
+
+// call runs the plugin with a request on stdin and returns its stdout. It
+// sees the environment tool commands do, not slop-shop's own.
+func (p *plugin) call(ctx context.Context, request pluginRequest, repoPath string) ([]byte, error) {
+	input, err := json.Marshal(request)
+	if err != nil {
+		return nil, err
+	}
+
+	cmd := exec.CommandContext(ctx, p.path)
+	cmd.Dir = repoPath
+	cmd.Env = tools.CommandEnv()
+	cmd.Stdin = bytes.NewReader(append(input, '\n'))
+	cmd.Stderr = os.Stderr
+	output, err := cmd.Output()
+	if ctx.Err() == context.DeadlineExceeded {
+		return nil, fmt.Errorf("timed out after %s", pluginTimeout)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return output, nil
+}
+
+// request sends a tool, context or command request and returns the plugin's output
+func (p *plugin) request(ctx context.Context, request pluginRequest, repoPath string) (string, error) {
+	output, err := p.call(ctx, request, repoPath)
+	if err != nil {
+		return "", fmt.Errorf("plugin %s: %v", p.Name, err)
+	}
+
+	var response pluginResponse
+	if err := json.Unmarshal(output, &response); err != nil {
+		return "", fmt.Errorf("plugin %s: invalid reply: %v", p.Name, err)
+	}
+	if response.Error != "" {
+		return response.Output, fmt.Errorf("plugin %s: %s", p.Name, response.Error)
+	}
+	return response.Output, nil
+}
+
+// pluginTools returns the tools of the discovered plugins as custom tools
+func pluginTools(plugins []*plugin) []tools.CustomTool {
+	var defined []tools.CustomTool
+	for _, p := range plugins {
+		for _, tool := range p.Tools {
+			p, name := p, tool.Name
+			defined = append(defined, tools.CustomTool{
+				Name:        tool.Name,
+				Description: tool.Description,
+				Args:        tool.Args,
+				Run: func(args map[string]string, repoPath string) (string, error) {
+					request := pluginRequest{Type: "tool", Name: name, Args: args, Repo: repoPath}
+					output, err := p.request(context.Background(), request, repoPath)
+					if err != nil {
+						return fmt.Sprintf("Error: %v\nOutput: %s", err, output), err
+					}
+					return output, nil
+				},
+			})
+		}
+	}
+	return defined
+}
+
+// pluginContext runs the context providers of the discovered plugins and
+// formats their output as context sections
+func pluginContext(plugins []*plugin, repoPath string) (string, error) {
+	var buf strings.Builder
+	for _, p := range plugins {
+		for _, provider := range p.Context {
+			ctx, cancel := context.WithTimeout(context.Background(), pluginTimeout)
+			text, err := p.request(ctx, pluginRequest{Type: "context", Name: provider.Name, Repo: repoPath}, repoPath)
+			cancel()
+			if err != nil {
+				return "", fmt.Errorf("error running context provider %s: %v", provider.Name, err)
+			}
+
+			buf.WriteString(fmt.Sprintf("File: plugin:%s/%s (Size: %d bytes)\n", p.Name, provider.Name, len(text)))
+			buf.WriteString(strings.Repeat("-", 50) + "\n")
+			buf.WriteString(text)
+			buf.WriteString("\n\n")
+		}
+	}
+	return buf.String(), nil
+}
+
+// registerPluginCommands adds the subcommands of the discovered plugins to the
+// command list. Built-in commands cannot be replaced.
+func registerPluginCommands(plugins []*plugin) {
+	for _, p := range plugins {
+		for _, sub := range p.Commands {
+			if _, exists := findCommand(sub.Name); exists {
+				fmt.Fprintln(os.Stderr, styles.WarningStyle.Render(fmt.Sprintf("⚠️  Plugin %s: command %q already exists; ignoring it", p.Name, sub.Name)))
+				continue
+			}
+
+			usage := sub.Usage
+			if usage == "" {
+				usage = sub.Name
+			}
+			p, name := p, sub.Name
+			commands = append(commands, command{name, usage, sub.Summary, func(args []string) error {
+				return runPluginCommand(os.Stdout, p, name, args)
+			}})
+		}
+	}
+}
+
+// runPluginCommand runs a plugin subcommand and prints its output
+func runPluginCommand(w io.Writer, p *plugin, name string, args []string) error {
+	repoPath, err := os.Getwd()
+	if err != nil {
+		return err
+	}
+	if args == nil {
+		args = []string{}
+	}
+
+	output, err := p.request(context.Background(), pluginRequest{Type: "command", Name: name, Args: args, Repo: repoPath}, repoPath)
+	if output != "" {
+		fmt.Fprint(w, output)
+		if !strings.HasSuffix(output, "\n") {
+			fmt.Fprintln(w)
+		}
+	}
+	return err
+}
+
+// runTrust trusts the repository, so the plugins in its .slopshop/plugins run,
+// or with -revoke stops trusting it
+func runTrust(args []string) error {
+	fs := newFlagSet("trust")
+	repoPath := fs.String("repo", ".", "Path to repository (default: current directory)")
+	revoke := fs.Bool("revoke", false, "Stop trusting the repository, so its plugins no longer run")
+	fs.Parse(args)
+
+	if err := config.SetTrusted(*repoPath, !*revoke); err != nil {
+		return err
+	}
+	dir := config.RepoPluginDir(*repoPath)
+	if *revoke {
+		fmt.Printf("The plugins in %s will no longer run\n", dir)
+		return nil
+	}
+	names := pluginExecutables(dir)
+	if len(names) == 0 {
+		fmt.Printf("Trusted %s; it has no plugins yet\n", *repoPath)
+		return nil
+	}
+	fmt.Printf("Trusted %s; these plugins in %s will run: %s\n", *repoPath, dir, strings.Join(names, ", "))
+	return nil
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/kek/slop-shop/config"
+	"github.com/kek/slop-shop/repo"
+	"github.com/kek/slop-shop/styles"
+	"github.com/kek/slop-shop/tui"
+)
+
+// progressInterval is how often the progress of a repository scan is redrawn
+const progressInterval = 100 * time.Millisecond
+
+// showProgress enables progress reports while the repository is scanned. setup
+// turns it off for -no-progress and -quiet, and when stderr is not a terminal.
+var showProgress bool
+
+// scanStatus receives the progress of a scan as a status line, or is nil to
+// draw the progress on stderr
+var scanStatus func(string)
+
+// readRepository reads the repository like repo.ReadRepository, reporting its
+// progress when that is enabled
+func readRepository(repoPath string, exclude []string) ([]repo.FileInfo, error) {
+	if !showProgress {
+		return repo.ReadRepository(repoPath, exclude)
+	}
+
+	report := scanStatus
+	if report == nil {
+		spinner := NewSpinner(os.Stderr)
+		report = func(status string) {
+			spinner.Spin(styles.InfoStyle.Render(status))
+		}
+		defer spinner.Stop()
+	}
+
+	var last time.Time
+	return repo.ReadRepositoryProgress(repoPath, exclude, func(p repo.ScanProgress) {
+		if time.Since(last) < progressInterval {
+			return
+		}
+		last = time.Now()
+		report(describeScan(p))
+	})
+}
+
+// describeScan renders the progress of a scan as one line
+func describeScan(p repo.ScanProgress) string {
+	status := fmt.Sprintf("Scanning repository: %d files, %s", p.Files, formatSize(p.Bytes))
+	if p.Dir != "." && p.Dir != "" {
+		status += " · " + truncateText(filepath.ToSlash(p.Dir), 50)
+	}
+	return status
+}
+
+// loadChatContext loads the REPL's context behind a loading screen that shows
+// the progress of the scan
+func loadChatContext(opts *options, settings *config.Settings) (string, error) {
+	if !showProgress {
+		return loadContext(opts, settings)
+	}
+
+	var context string
+	err := tui.RunLoading("Loading "+opts.repoPath, func(status func(string)) error {
+		scanStatus = status
+		defer func() { scanStatus = nil }()
+		var err error
+		context, err = loadContext(opts, settings)
+		return err
+	})
+	return context, err
+}
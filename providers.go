@@ -0,0 +1,225 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/kek/slop-shop/config"
+	"github.com/kek/slop-shop/repo"
+)
+
+// contextProvider is a source of prompt context, such as the repository
+// files or the issues a prompt refers to. Collect returns what it has as
+// sections of at most budget characters in all, or with no limit when budget
+// is 0; sections that cannot be cut are returned whole.
+type contextProvider interface {
+	Name() string
+	Collect(budget int) ([]repo.ContextSection, error)
+}
+
+// filler is implemented by providers that cut what they collect to fit their
+// budget. They are collected after the others, so they get what is left.
+type filler interface {
+	fills()
+}
+
+// contextProviders makes the built-in providers by name for a run. A new
+// source of context only has to be added here.
+var contextProviders = map[string]func(opts *options, settings *config.Settings) contextProvider{
+	"files":   func(opts *options, settings *config.Settings) contextProvider { return filesProvider{opts, settings} },
+	"diff":    func(opts *options, settings *config.Settings) contextProvider { return diffProvider{opts.repoPath} },
+	"issues":  func(opts *options, settings *config.Settings) contextProvider { return issuesProvider{opts.issueText} },
+	"plugins": func(opts *options, settings *config.Settings) contextProvider { return pluginsProvider{opts.repoPath} },
+	"memory":  func(opts *options, settings *config.Settings) contextProvider { return memoryProvider{opts.repoPath} },
+}
+
+// defaultContextProviders is the context built when none are configured
+var defaultContextProviders = []string{"issues", "files", "plugins", "memory"}
+
+// contextProviderNames are the providers loadContext builds the context from, in order
+var contextProviderNames = defaultContextProviders
+
+// setContextProviders sets the providers from the configuration, overridden
+// by -context-providers when it is given
+func setContextProviders(configured []string, names string) error {
+	contextProviderNames = defaultContextProviders
+	if len(configured) > 0 {
+		contextProviderNames = configured
+	}
+	if names != "" {
+		contextProviderNames = config.SplitList(names)
+	}
+	for _, name := range contextProviderNames {
+		if _, ok := contextProviders[name]; !ok {
+			return fmt.Errorf("unknown context provider %q (available: %s)", name, strings.Join(providerNames(), ", "))
+		}
+	}
+	return nil
+}
+
+// providerNames returns the names of the built-in providers, sorted
+func providerNames() []string {
+	var names []string
+	for name := range contextProviders {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// assembleContext collects the sections of the providers and joins them in
+// their order
+func assembleContext(providers []contextProvider, budget int) (string, error) {
+	collected := make([][]repo.ContextSection, len(providers))
+	used := 0
+	collect := func(i int) error {
+		limit := 0
+		if budget > 0 {
+			// 1 rather than 0, which would mean no limit
+			limit = max(budget-used, 1)
+		}
+		sections, err := providers[i].Collect(limit)
+		if err != nil {
+			return err
+		}
+		for _, section := range sections {
+			used += len(section.Text)
+		}
+		collected[i] = sections
+		return nil
+	}
+	for i, provider := range providers {
+		if _, ok := provider.(filler); !ok {
+			if err := collect(i); err != nil {
+				return "", err
+			}
+		}
+	}
+	for i, provider := range providers {
+		if _, ok := provider.(filler); ok {
+			if err := collect(i); err != nil {
+				return "", err
+			}
+		}
+	}
+
+	var context strings.Builder
+	for i := range providers {
+		for _, section := range collected[i] {
+			context.WriteString(section.Text)
+		}
+	}
+	return context.String(), nil
+}
+
+// filesProvider collects the repository files: the working tree, the files
+// given with -attach, or those of -rev
+type filesProvider struct {
+	opts     *options
+	settings *config.Settings
+}
+
+func (p filesProvider) Name() string { return "files" }
+func (p filesProvider) fills()       {}
+
+func (p filesProvider) Collect(budget int) ([]repo.ContextSection, error) {
+	limit := contextLimit
+	limit.MaxChars = budget
+	text, err := filesContext(p.opts, p.settings, limit)
+	if err != nil {
+		return nil, err
+	}
+	return repo.SplitContext(text), nil
+}
+
+// diffProvider collects the uncommitted changes, cut to the budget
+type diffProvider struct {
+	repoPath string
+}
+
+func (p diffProvider) Name() string { return "diff" }
+func (p diffProvider) fills()       {}
+
+func (p diffProvider) Collect(budget int) ([]repo.ContextSection, error) {
+	diff, err := gitOutput(p.repoPath, "diff", "--relative", "HEAD")
+	if err != nil {
+		return nil, fmt.Errorf("error reading the uncommitted changes: %v", err)
+	}
+	if strings.TrimSpace(diff) == "" {
+		return nil, nil
+	}
+	header := fmt.Sprintf("File: git:diff HEAD (Size: %d bytes)\n%s\n", len(diff), strings.Repeat("-", 50))
+	const cut = "\n... (diff cut to fit the context limit)"
+	if budget > 0 && len(header)+len(diff)+2 > budget {
+		diff = diff[:max(budget-len(header)-len(cut)-2, 0)] + cut
+	}
+	return []repo.ContextSection{{Name: "git:diff HEAD", Text: header + diff + "\n\n"}}, nil
+}
+
+// issuesProvider collects the issues and pull requests ask fetched for -issue
+// and -issues. They are fetched once, so -watch does not fetch them again.
+type issuesProvider struct {
+	text string
+}
+
+func (p issuesProvider) Name() string { return "issues" }
+
+func (p issuesProvider) Collect(int) ([]repo.ContextSection, error) {
+	if p.text == "" {
+		return nil, nil
+	}
+	return repo.SplitContext(p.text), nil
+}
+
+// pluginsProvider collects the context of the plugins' context providers
+type pluginsProvider struct {
+	repoPath string
+}
+
+func (p pluginsProvider) Name() string { return "plugins" }
+
+func (p pluginsProvider) Collect(int) ([]repo.ContextSection, error) {
+	text, err := pluginContext(discoverPlugins(p.repoPath), p.repoPath)
+	if err != nil || text == "" {
+		return nil, err
+	}
+	return repo.SplitContext(text), nil
+}
+
+// memoryProvider collects the project memory notes kept before the run. Notes
+// remembered during it go in the prompts after, as ollama.SetMemory sets them.
+type memoryProvider struct {
+	repoPath string
+}
+
+func (p memoryProvider) Name() string { return "memory" }
+
+func (p memoryProvider) Collect(int) ([]repo.ContextSection, error) {
+	notes, err := repo.LoadMemory(p.repoPath)
+	if err != nil || notes == "" {
+		return nil, err
+	}
+	name := "memory:" + filepath.ToSlash(repo.MemoryFile)
+	header := fmt.Sprintf("File: %s (Size: %d bytes)\n%s\n", name, len(notes), strings.Repeat("-", 50))
+	return []repo.ContextSection{{Name: name, Text: header + notes + "\n\n"}}, nil
+}
+
+// runProviders returns the providers of contextProviderNames that apply to a
+// run: none but the issues and memory with -empty-context, and no plugins
+// with -attach or -rev
+func runProviders(opts *options, settings *config.Settings) []contextProvider {
+	var providers []contextProvider
+	for _, name := range contextProviderNames {
+		switch {
+		case opts.emptyContext && !slices.Contains([]string{"issues", "memory"}, name):
+			continue
+		case name == "plugins" && (opts.attach != "" || opts.rev != ""):
+			continue
+		}
+		providers = append(providers, contextProviders[name](opts, settings))
+	}
+	return providers
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/kek/slop-shop/ollama"
+	"github.com/kek/slop-shop/store"
+	"github.com/kek/slop-shop/styles"
+	"github.com/kek/slop-shop/tools"
+)
+
+// transcript is a conversation read from an exported dataset or the history
+type transcript struct {
+	name     string
+	system   string
+	messages []store.Message // User and assistant turns in order
+}
+
+// transcriptLine accepts both a ShareGPT and an OpenAI chat dataset line
+type transcriptLine struct {
+	ID            string          `json:"id"`
+	Conversations []shareGPTTurn  `json:"conversations"`
+	Messages      []openAIMessage `json:"messages"`
+}
+
+// readTranscripts reads the conversations of a JSONL dataset in ShareGPT or
+// OpenAI chat format, as written by history export
+func readTranscripts(r io.Reader) ([]transcript, error) {
+	var transcripts []transcript
+	decoder := json.NewDecoder(r)
+	for {
+		var line transcriptLine
+		err := decoder.Decode(&line)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("error reading conversation %d: %v", len(transcripts)+1, err)
+		}
+
+		t := transcript{name: line.ID}
+		add := func(role, content string) {
+			switch role {
+			case "system":
+				t.system = content
+			case "human", "user":
+				t.messages = append(t.messages, store.Message{Role: "user", Content: content})
+			case "gpt", "assistant":
+				t.messages = append(t.messages, store.Message{Role: "assistant", Content: content})
+			}
+		}
+		for _, turn := range line.Conversations {
+			add(turn.From, turn.Value)
+		}
+		for _, message := range line.Messages {
+			add(message.Role, message.Content)
+		}
+		if len(t.messages) == 0 {
+			return nil, fmt.Errorf("conversation %d has no messages", len(transcripts)+1)
+		}
+		transcripts = append(transcripts, t)
+	}
+	if len(transcripts) == 0 {
+		return nil, fmt.Errorf("no conversations found")
+	}
+	return transcripts, nil
+}
+
+// runImport adds the conversations of a dataset file to the history
+func runImport(db *store.Store, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: slop-shop history import FILE")
+	}
+	transcripts, err := loadTranscripts(args[0])
+	if err != nil {
+		return err
+	}
+
+	for _, t := range transcripts {
+		id, err := db.StartConversation("", "import", "", args[0])
+		if err != nil {
+			return err
+		}
+		if err := addTranscript(db, id, t); err != nil {
+			return err
+		}
+		fmt.Printf("Imported conversation %d with %d messages\n", id, len(t.messages))
+	}
+	return nil
+}
+
+// loadTranscripts reads a dataset file
+func loadTranscripts(path string) ([]transcript, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("error opening %s: %v", path, err)
+	}
+	defer file.Close()
+	transcripts, err := readTranscripts(file)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return transcripts, nil
+}
+
+// addTranscript records the system prompt and messages of a transcript
+func addTranscript(db *store.Store, id int64, t transcript) error {
+	if t.system != "" {
+		if err := db.AddMessage(id, "system", t.system); err != nil {
+			return err
+		}
+	}
+	for _, m := range t.messages {
+		if err := db.AddMessage(id, m.Role, m.Content); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// runReplay sends the user turns of recorded or exported conversations to a
+// model again, records the replay as a new conversation and shows how the
+// responses differ from the original ones
+func runReplay(db *store.Store, args []string) error {
+	fs := flag.NewFlagSet("slop-shop history replay", flag.ExitOnError)
+	opts := addCommonFlags(fs)
+	failOnChange := fs.Bool("fail-on-change", false, "Exit with an error when a response differs from the original")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		return fmt.Errorf("usage: slop-shop history replay [flags] ID|FILE")
+	}
+
+	var transcripts []transcript
+	if id, err := strconv.ParseInt(fs.Arg(0), 10, 64); err == nil {
+		c, err := db.Get(id)
+		if err != nil {
+			return err
+		}
+		t := transcript{name: fmt.Sprintf("conversation %d", id)}
+		for _, m := range c.Messages {
+			if m.Role == "system" {
+				t.system = m.Content
+			} else {
+				t.messages = append(t.messages, m)
+			}
+		}
+		transcripts = []transcript{t}
+	} else if transcripts, err = loadTranscripts(fs.Arg(0)); err != nil {
+		return err
+	}
+
+	settings, err := setup(fs, opts)
+	if err != nil {
+		return err
+	}
+	// Replays compare against what the model answers now, so never use the cache
+	ollama.SetCache("", 0)
+	context, err := loadContext(opts, settings)
+	if err != nil {
+		return err
+	}
+
+	changed, total := 0, 0
+	for i, t := range transcripts {
+		name := t.name
+		if name == "" {
+			name = fmt.Sprintf("conversation %d", i+1)
+		}
+		fmt.Fprintln(chatter(), styles.HeaderStyle.Render(fmt.Sprintf("🔁 Replaying %s with %s", name, settings.Model)))
+
+		client := ollama.NewClient(settings.URL, settings.Model, settings.Temperature, settings.TopP)
+		client.System = settings.System
+		if t.system != "" && settings.Source("system") == "default" {
+			client.System = t.system
+		}
+
+		id, err := db.StartConversation("", "replay", settings.Model, opts.repoPath)
+		if err != nil {
+			return err
+		}
+		replayed := transcript{system: client.System}
+		var history []int
+		for turn, original := range pairTurns(t.messages) {
+			fmt.Fprintf(chatter(), "  Turn %d: %s\n", turn+1, firstLine(original.prompt))
+
+			turnContext := context
+			if history != nil {
+				turnContext = ""
+			}
+			response, _, newHistory, err := client.Continue(history, original.prompt, turnContext, false, nil)
+			if err != nil {
+				return err
+			}
+			history = newHistory
+			replayed.messages = append(replayed.messages,
+				store.Message{Role: "user", Content: original.prompt},
+				store.Message{Role: "assistant", Content: response})
+
+			total++
+			if diff := compareResponses(turn, original.response, response); diff != "" {
+				changed++
+				printDiff(display(), diff)
+			} else {
+				fmt.Fprintln(chatter(), styles.SuccessStyle.Render("  ✅ Same response"))
+			}
+		}
+		if err := addTranscript(db, id, replayed); err != nil {
+			return err
+		}
+		fmt.Fprintln(chatter(), styles.InfoStyle.Render(fmt.Sprintf("Recorded the replay as conversation %d", id)))
+	}
+
+	fmt.Fprintln(display(), styles.InfoStyle.Render(fmt.Sprintf("%d of %d responses changed", changed, total)))
+	if changed > 0 && *failOnChange {
+		return fmt.Errorf("%d of %d responses changed", changed, total)
+	}
+	return nil
+}
+
+// replayTurn is a prompt and the response it originally received
+type replayTurn struct {
+	prompt   string
+	response string
+}
+
+// pairTurns pairs each user message with the assistant message after it
+func pairTurns(messages []store.Message) []replayTurn {
+	var turns []replayTurn
+	for _, m := range messages {
+		switch {
+		case m.Role == "user":
+			turns = append(turns, replayTurn{prompt: m.Content})
+		case m.Role == "assistant" && len(turns) > 0:
+			turns[len(turns)-1].response += m.Content
+		}
+	}
+	return turns
+}
+
+// compareResponses returns a diff from the original to the replayed response
+// of a turn, or "" when they match apart from surrounding whitespace
+func compareResponses(turn int, original, replayed string) string {
+	original, replayed = strings.TrimSpace(original)+"\n", strings.TrimSpace(replayed)+"\n"
+	if original == replayed {
+		return ""
+	}
+	return tools.UnifiedDiff(fmt.Sprintf("turn-%d", turn+1), original, replayed)
+}
+
+// firstLine shortens a prompt to its first line for progress messages
+func firstLine(s string) string {
+	s = strings.TrimSpace(s)
+	if i := strings.Index(s, "\n"); i >= 0 {
+		s = s[:i] + " ..."
+	}
+	if len(s) > 70 {
+		s = s[:67] + "..."
+	}
+	return s
+}
@@ -0,0 +1,62 @@
+package repo
+
+import (
+	"bytes"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// artifactNames matches the base names of files slop-shop writes into a
+// repository: the debug log of earlier versions, conversations saved from the
+// REPL, backups of replaced git hooks and files left behind by interrupted
+// atomic writes
+var artifactNames = regexp.MustCompile(`^(repl_debug\.log|chat-\d{8}-\d{6}\.md|.+\.slop-shop-backup|\..+\.slop-\d+)$`)
+
+// artifactDir is the directory slop-shop keeps its working files in
+const artifactDir = ".slop-shop"
+
+// ScratchPrefix starts the name of the temporary directory each session
+// gives its tools for files that do not belong in the repository
+const ScratchPrefix = "slop-shop-scratch-"
+
+// artifactHeaders start the files slop-shop writes, whatever they are named
+var artifactHeaders = [][]byte{
+	[]byte("# slop-shop transcript, "),
+	[]byte("# Slop Shop conversation, "),
+}
+
+// artifacts holds the absolute paths of the output files of this run
+var artifacts = map[string]bool{}
+
+// AddArtifact marks a file this run writes, such as -out or -transcript, so it
+// is never read back into the context
+func AddArtifact(path string) {
+	if abs, err := filepath.Abs(path); err == nil {
+		artifacts[abs] = true
+	}
+}
+
+// IsArtifact reports whether a file of the repository at repoPath is output of
+// slop-shop rather than part of the project. It recognizes the files by name,
+// including everything in a scratch directory,
+// by the paths given to AddArtifact and, when content is not nil, by the
+// header slop-shop writes at their start. These files are excluded whatever
+// the exclude patterns say, so one run's output does not bloat the next one's
+// prompt.
+func IsArtifact(repoPath, relPath string, content []byte) bool {
+	relPath = filepath.ToSlash(relPath)
+	if relPath == artifactDir || strings.HasPrefix(relPath, artifactDir+"/") || artifactNames.MatchString(filepath.Base(relPath)) ||
+		strings.HasPrefix(relPath, ScratchPrefix) || strings.Contains(relPath, "/"+ScratchPrefix) {
+		return true
+	}
+	if abs, err := filepath.Abs(filepath.Join(repoPath, relPath)); err == nil && artifacts[abs] {
+		return true
+	}
+	for _, header := range artifactHeaders {
+		if bytes.HasPrefix(content, header) {
+			return true
+		}
+	}
+	return false
+}
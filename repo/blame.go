@@ -0,0 +1,167 @@
+package repo
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// blameHeader matches the line git blame --porcelain writes before each line
+// of the file: the commit, the line number in the commit and in the file
+var blameHeader = regexp.MustCompile(`^([0-9a-f]{40}) \d+ (\d+)`)
+
+// uncommitted is the commit git blame gives lines that are not committed yet
+const uncommitted = "0000000000000000000000000000000000000000"
+
+// blameCommit is a commit that last changed some lines of a file
+type blameCommit struct {
+	hash    string
+	author  string
+	time    time.Time
+	summary string
+	lines   []int
+}
+
+// BlameFiles annotates each file with the regions its most recent commits
+// changed, up to commits per file, with their authors, dates and messages, so
+// the model can answer why code looks the way it does. Files are blamed at rev,
+// or in the working tree when it is empty; files git does not track are left
+// as they are.
+func BlameFiles(repoPath, rev string, files []FileInfo, commits int) ([]FileInfo, error) {
+	if commits <= 0 {
+		return files, nil
+	}
+	messages := map[string]string{}
+	annotated := make([]FileInfo, len(files))
+	for i, file := range files {
+		annotated[i] = file
+		recent, err := blame(repoPath, rev, file.Path)
+		if err != nil || len(recent) == 0 {
+			continue
+		}
+		if len(recent) > commits {
+			recent = recent[:commits]
+		}
+		if err := commitMessages(repoPath, recent, messages); err != nil {
+			return nil, err
+		}
+
+		var notes strings.Builder
+		fmt.Fprintf(&notes, "\n\nGit history of %s, most recent first:\n", file.Path)
+		for _, commit := range recent {
+			fmt.Fprintf(&notes, "- %s: %s %s by %s\n", lineRanges(commit.lines), commit.hash[:8], commit.time.Format("2006-01-02"), commit.author)
+			for _, line := range strings.Split(messages[commit.hash], "\n") {
+				fmt.Fprintf(&notes, "    %s\n", line)
+			}
+		}
+		annotated[i].Content = file.Content + strings.TrimSuffix(notes.String(), "\n")
+		annotated[i].Size = int64(len(annotated[i].Content))
+	}
+	return annotated, nil
+}
+
+// blame returns the commits that last changed the lines of a file, most
+// recent first, leaving out uncommitted lines
+func blame(repoPath, rev, path string) ([]*blameCommit, error) {
+	args := []string{"blame", "--porcelain"}
+	if rev != "" {
+		args = append(args, rev)
+	}
+	output, err := git(repoPath, nil, append(args, "--", path)...)
+	if err != nil {
+		return nil, err
+	}
+
+	commits := map[string]*blameCommit{}
+	var current *blameCommit
+	for _, line := range strings.Split(string(output), "\n") {
+		if match := blameHeader.FindStringSubmatch(line); match != nil {
+			if commits[match[1]] == nil {
+				commits[match[1]] = &blameCommit{hash: match[1]}
+			}
+			current = commits[match[1]]
+			number, _ := strconv.Atoi(match[2])
+			current.lines = append(current.lines, number)
+			continue
+		}
+		if current == nil {
+			continue
+		}
+		key, value, _ := strings.Cut(line, " ")
+		switch key {
+		case "author":
+			current.author = value
+		case "author-time":
+			seconds, _ := strconv.ParseInt(value, 10, 64)
+			current.time = time.Unix(seconds, 0)
+		case "summary":
+			current.summary = value
+		}
+	}
+
+	var recent []*blameCommit
+	for hash, commit := range commits {
+		if hash != uncommitted {
+			recent = append(recent, commit)
+		}
+	}
+	sort.Slice(recent, func(a, b int) bool {
+		if !recent[a].time.Equal(recent[b].time) {
+			return recent[a].time.After(recent[b].time)
+		}
+		return recent[a].hash < recent[b].hash
+	})
+	return recent, nil
+}
+
+// commitMessages adds the full messages of the commits that messages does not
+// have yet, reading them with one git command
+func commitMessages(repoPath string, commits []*blameCommit, messages map[string]string) error {
+	var missing []string
+	for _, commit := range commits {
+		if _, ok := messages[commit.hash]; !ok {
+			messages[commit.hash] = commit.summary
+			missing = append(missing, commit.hash)
+		}
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+
+	output, err := git(repoPath, nil, append([]string{"show", "--no-patch", "--format=%H%x1f%B%x1e"}, missing...)...)
+	if err != nil {
+		return err
+	}
+	for _, record := range strings.Split(string(output), "\x1e") {
+		hash, message, ok := strings.Cut(strings.TrimSpace(record), "\x1f")
+		if ok && strings.TrimSpace(message) != "" {
+			messages[hash] = strings.TrimSpace(message)
+		}
+	}
+	return nil
+}
+
+// lineRanges describes line numbers as ranges, e.g. "lines 3-7, 12"
+func lineRanges(lines []int) string {
+	sort.Ints(lines)
+	var ranges []string
+	for i := 0; i < len(lines); {
+		j := i
+		for j+1 < len(lines) && lines[j+1] == lines[j]+1 {
+			j++
+		}
+		if j == i {
+			ranges = append(ranges, strconv.Itoa(lines[i]))
+		} else {
+			ranges = append(ranges, fmt.Sprintf("%d-%d", lines[i], lines[j]))
+		}
+		i = j + 1
+	}
+	if len(lines) == 1 {
+		return "line " + ranges[0]
+	}
+	return "lines " + strings.Join(ranges, ", ")
+}
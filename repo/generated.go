@@ -0,0 +1,145 @@
+package repo
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// GeneratedModes lists what CondenseFiles can do with generated, vendored and
+// duplicate files: replace their content with a placeholder, leave them out
+// of the context, or keep them as they are
+var GeneratedModes = []string{"placeholder", "exclude", "keep"}
+
+// lockfiles are the dependency lockfiles of the common package managers
+var lockfiles = map[string]bool{
+	"package-lock.json":   true,
+	"npm-shrinkwrap.json": true,
+	"yarn.lock":           true,
+	"pnpm-lock.yaml":      true,
+	"go.sum":              true,
+	"Cargo.lock":          true,
+	"poetry.lock":         true,
+	"uv.lock":             true,
+	"Pipfile.lock":        true,
+	"Gemfile.lock":        true,
+	"composer.lock":       true,
+	"mix.lock":            true,
+	"flake.lock":          true,
+	"packages.lock.json":  true,
+}
+
+// generatedSuffixes end the names of files written by code generators
+var generatedSuffixes = []string{".pb.go", ".pb.gw.go", "_pb2.py", "_pb2_grpc.py", ".pb.cc", ".pb.h", "_generated.go", ".gen.go", ".g.dart", ".freezed.dart"}
+
+// minifiedSuffixes end the names of minified bundles and their source maps
+var minifiedSuffixes = []string{".min.js", ".min.css", ".min.mjs", ".bundle.js", ".js.map", ".css.map"}
+
+// vendorDirs hold copies of other projects' code
+var vendorDirs = map[string]bool{"vendor": true, "node_modules": true, "bower_components": true}
+
+// generatedMarker matches the comments code generators put near the start of
+// their output: Go's "Code generated ... DO NOT EDIT." line, @generated, and
+// the DO NOT EDIT warnings of other generators, after any comment characters
+var generatedMarker = regexp.MustCompile(`(?m)^\W*(Code generated .* DO NOT EDIT|@generated\b|DO NOT EDIT( THIS FILE|\W*$)|(?i:.*\b(auto-?generated|generated by)\b.*\bdo not (edit|modify)\b))`)
+
+// markerWindow is how much of the start of a file is searched for a marker
+const markerWindow = 2048
+
+// minifiedLineLength is the average line length from which a file of more
+// than minifiedSize bytes counts as minified
+const (
+	minifiedLineLength = 300
+	minifiedSize       = 2048
+)
+
+// minDuplicateSize is the smallest file whose copies are left out; smaller
+// ones, such as empty __init__.py files, cost less than a placeholder
+const minDuplicateSize = 256
+
+// GeneratedKind returns why a file looks generated or copied rather than
+// written by hand: "lockfile", "generated code", "minified code" or "vendored
+// code", or "" when it does not
+func GeneratedKind(relPath string, content []byte) string {
+	relPath = filepath.ToSlash(relPath)
+	name := path.Base(relPath)
+	switch {
+	case lockfiles[name]:
+		return "lockfile"
+	case hasSuffix(name, generatedSuffixes):
+		return "generated code"
+	case hasSuffix(name, minifiedSuffixes):
+		return "minified code"
+	}
+	for _, dir := range strings.Split(path.Dir(relPath), "/") {
+		if vendorDirs[dir] {
+			return "vendored code"
+		}
+	}
+
+	if generatedMarker.Match(content[:min(len(content), markerWindow)]) {
+		return "generated code"
+	}
+	if len(content) > minifiedSize && len(content)/(bytes.Count(content, []byte("\n"))+1) > minifiedLineLength {
+		return "minified code"
+	}
+	return ""
+}
+
+// hasSuffix reports whether name ends in one of suffixes
+func hasSuffix(name string, suffixes []string) bool {
+	for _, suffix := range suffixes {
+		if strings.HasSuffix(name, suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// CondenseFiles deals with the files that cost tokens without telling the
+// model much: generated, minified and vendored files, lockfiles, and copies of
+// a file earlier in the list. With mode placeholder, the default, their
+// content is replaced by a one-line note; with exclude they are left out and
+// with keep nothing changes. It returns the files and a description of each
+// file it condensed.
+func CondenseFiles(files []FileInfo, mode string) ([]FileInfo, []string, error) {
+	switch mode {
+	case "", "placeholder", "exclude", "keep":
+	default:
+		return nil, nil, fmt.Errorf("unknown mode %q for generated files (available: %s)", mode, strings.Join(GeneratedModes, ", "))
+	}
+	if mode == "keep" {
+		return files, nil, nil
+	}
+
+	var kept []FileInfo
+	var condensed []string
+	seen := make(map[[sha256.Size]byte]string)
+	for _, file := range files {
+		reason := GeneratedKind(file.Path, []byte(file.Content))
+		if reason == "" && len(file.Content) >= minDuplicateSize {
+			sum := sha256.Sum256([]byte(file.Content))
+			if first, ok := seen[sum]; ok {
+				reason = "identical to " + filepath.ToSlash(first)
+			} else {
+				seen[sum] = file.Path
+			}
+		}
+
+		placeholder := fmt.Sprintf("[%s, %d bytes, left out of the context]", reason, len(file.Content))
+		if reason == "" || len(placeholder) >= len(file.Content) {
+			kept = append(kept, file)
+			continue
+		}
+		condensed = append(condensed, fmt.Sprintf("%s (%s)", filepath.ToSlash(file.Path), reason))
+		if mode != "exclude" {
+			file.Content = placeholder
+			kept = append(kept, file)
+		}
+	}
+	return kept, condensed, nil
+}
@@ -0,0 +1,297 @@
+package repo
+
+import (
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Symbol is a declaration found in the repository
+type Symbol struct {
+	Name    string `json:"name"`    // Methods are named Receiver.Method
+	Kind    string `json:"kind"`    // func, method, type, const or var; class, struct and the like in other languages
+	Package string `json:"package"` // Go package, or the directory name for other languages
+	File    string `json:"file"`    // Slash-separated path relative to the repository
+	Line    int    `json:"line"`
+	Text    string `json:"text"` // Source line of the declaration
+}
+
+// Reference is a use of an identifier in source code
+type Reference struct {
+	File string `json:"file"`
+	Line int    `json:"line"`
+	Text string `json:"text"`
+}
+
+// indexedFile holds the symbols and identifier uses of one parsed file
+type indexedFile struct {
+	modTime    time.Time
+	size       int64
+	pkg        string
+	lang       string // Language of the file, as returned by SourceLanguage
+	doc        string // Package documentation comment
+	symbols    []Symbol
+	references map[string][]Reference
+}
+
+// Index maps identifiers in a repository to their definitions and references.
+// Go files are parsed; Python, JavaScript, TypeScript, Rust and Java files are
+// scanned line by line. References are matched by name, without type information.
+type Index struct {
+	root    string
+	exclude []string
+
+	mu    sync.Mutex
+	files map[string]*indexedFile
+}
+
+// NewIndex creates an empty index for the source files in repoPath; call Update to fill it
+func NewIndex(repoPath string, excludePatterns []string) *Index {
+	return &Index{
+		root:    repoPath,
+		exclude: excludePatterns,
+		files:   make(map[string]*indexedFile),
+	}
+}
+
+// Update brings the index in line with the files on disk, parsing only files
+// that were added or changed since the last update. Directories the go tool
+// ignores (testdata, vendor and names starting with "." or "_") are skipped.
+func (idx *Index) Update() error {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	seen := make(map[string]bool)
+	err := filepath.WalkDir(idx.root, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		relPath, err := filepath.Rel(idx.root, path)
+		if err != nil {
+			return err
+		}
+		relPath = filepath.ToSlash(relPath)
+
+		if entry.IsDir() {
+			name := entry.Name()
+			if path != idx.root && (strings.HasPrefix(name, ".") || strings.HasPrefix(name, "_") ||
+				name == "testdata" || name == "vendor" || ShouldExclude(relPath, idx.exclude)) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if SourceLanguage(relPath) == "" || ShouldExclude(relPath, idx.exclude) {
+			return nil
+		}
+
+		info, err := entry.Info()
+		if err != nil {
+			return nil
+		}
+		seen[relPath] = true
+
+		if existing, ok := idx.files[relPath]; ok && existing.modTime.Equal(info.ModTime()) && existing.size == info.Size() {
+			return nil
+		}
+
+		file, err := indexFile(path, relPath)
+		if err != nil {
+			// Files that do not parse are left out until they are fixed
+			delete(idx.files, relPath)
+			return nil
+		}
+		file.modTime = info.ModTime()
+		file.size = info.Size()
+		idx.files[relPath] = file
+		return nil
+	})
+
+	for relPath := range idx.files {
+		if !seen[relPath] {
+			delete(idx.files, relPath)
+		}
+	}
+	return err
+}
+
+// Lookup returns the definitions of name and the references to it. A name of
+// the form Type.Method matches that method; its references are all uses of the
+// method name, since they cannot be told apart without type checking.
+func (idx *Index) Lookup(name string) ([]Symbol, []Reference) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	ident := name
+	if dot := strings.LastIndex(name, "."); dot >= 0 {
+		ident = name[dot+1:]
+	}
+
+	var definitions []Symbol
+	var references []Reference
+	defined := make(map[Reference]bool)
+
+	for _, file := range idx.files {
+		for _, symbol := range file.symbols {
+			if symbol.Name == name || (ident == name && strings.HasSuffix(symbol.Name, "."+name)) {
+				definitions = append(definitions, symbol)
+				defined[Reference{File: symbol.File, Line: symbol.Line, Text: symbol.Text}] = true
+			}
+		}
+	}
+	for _, file := range idx.files {
+		for _, ref := range file.references[ident] {
+			if !defined[ref] {
+				references = append(references, ref)
+			}
+		}
+	}
+
+	sort.Slice(definitions, func(i, j int) bool {
+		if definitions[i].File != definitions[j].File {
+			return definitions[i].File < definitions[j].File
+		}
+		return definitions[i].Line < definitions[j].Line
+	})
+	sort.Slice(references, func(i, j int) bool {
+		if references[i].File != references[j].File {
+			return references[i].File < references[j].File
+		}
+		return references[i].Line < references[j].Line
+	})
+	return definitions, references
+}
+
+// indexFile reads and indexes a source file in any of the supported languages
+func indexFile(path, relPath string) (*indexedFile, error) {
+	lang := SourceLanguage(relPath)
+	if lang == "go" {
+		return parseIndexedFile(path, relPath)
+	}
+	src, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return parseSourceFile(string(src), relPath, lang), nil
+}
+
+// parseIndexedFile parses a Go file and collects its top-level declarations and identifier uses
+func parseIndexedFile(path, relPath string) (*indexedFile, error) {
+	src, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	fset := token.NewFileSet()
+	parsed, err := parser.ParseFile(fset, path, src, parser.SkipObjectResolution|parser.ParseComments)
+	if err != nil {
+		return nil, err
+	}
+
+	lines := strings.Split(string(src), "\n")
+	lineText := func(pos token.Pos) (int, string) {
+		line := fset.Position(pos).Line
+		if line < 1 || line > len(lines) {
+			return line, ""
+		}
+		return line, strings.TrimSpace(lines[line-1])
+	}
+
+	file := &indexedFile{pkg: parsed.Name.Name, lang: "go", references: make(map[string][]Reference)}
+	if parsed.Doc != nil {
+		file.doc = parsed.Doc.Text()
+	}
+	addSymbol := func(name, kind string, pos token.Pos) {
+		line, text := lineText(pos)
+		file.symbols = append(file.symbols, Symbol{
+			Name:    name,
+			Kind:    kind,
+			Package: parsed.Name.Name,
+			File:    relPath,
+			Line:    line,
+			Text:    text,
+		})
+	}
+
+	for _, decl := range parsed.Decls {
+		switch d := decl.(type) {
+		case *ast.FuncDecl:
+			if d.Recv != nil && len(d.Recv.List) > 0 {
+				addSymbol(receiverName(d.Recv.List[0].Type)+"."+d.Name.Name, "method", d.Name.Pos())
+			} else {
+				addSymbol(d.Name.Name, "func", d.Name.Pos())
+			}
+		case *ast.GenDecl:
+			for _, spec := range d.Specs {
+				switch s := spec.(type) {
+				case *ast.TypeSpec:
+					addSymbol(s.Name.Name, "type", s.Name.Pos())
+				case *ast.ValueSpec:
+					kind := "var"
+					if d.Tok == token.CONST {
+						kind = "const"
+					}
+					for _, ident := range s.Names {
+						addSymbol(ident.Name, kind, ident.Pos())
+					}
+				}
+			}
+		}
+	}
+
+	// Record each identifier once per line so repeated uses on a line are not listed twice
+	type identLine struct {
+		name string
+		line int
+	}
+	seen := make(map[identLine]bool)
+	ast.Inspect(parsed, func(node ast.Node) bool {
+		ident, ok := node.(*ast.Ident)
+		if !ok || ident.Name == "_" {
+			return true
+		}
+		line, text := lineText(ident.Pos())
+		key := identLine{ident.Name, line}
+		if seen[key] {
+			return true
+		}
+		seen[key] = true
+		file.references[ident.Name] = append(file.references[ident.Name], Reference{File: relPath, Line: line, Text: text})
+		return true
+	})
+
+	return file, nil
+}
+
+// receiverName returns the type name of a method receiver, without pointer or type parameters
+func receiverName(expr ast.Expr) string {
+	switch t := expr.(type) {
+	case *ast.StarExpr:
+		return receiverName(t.X)
+	case *ast.IndexExpr:
+		return receiverName(t.X)
+	case *ast.IndexListExpr:
+		return receiverName(t.X)
+	case *ast.Ident:
+		return t.Name
+	}
+	return ""
+}
+
+// Stats returns the number of indexed files and symbols
+func (idx *Index) Stats() (files, symbols int) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	for _, file := range idx.files {
+		symbols += len(file.symbols)
+	}
+	return len(idx.files), symbols
+}
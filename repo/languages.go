@@ -0,0 +1,207 @@
+package repo
+
+import (
+	"path"
+	"regexp"
+	"strings"
+)
+
+// Declarations in languages other than Go are found line by line with the
+// patterns below rather than with a parser. They recognize conventionally
+// formatted code: top-level declarations and the methods of classes, impl
+// blocks and the like, one declaration per line.
+
+// sourceLanguages maps file extensions to the languages the index understands
+var sourceLanguages = map[string]string{
+	".go":   "go",
+	".py":   "python",
+	".js":   "javascript",
+	".jsx":  "javascript",
+	".mjs":  "javascript",
+	".cjs":  "javascript",
+	".ts":   "typescript",
+	".tsx":  "typescript",
+	".mts":  "typescript",
+	".cts":  "typescript",
+	".rs":   "rust",
+	".java": "java",
+}
+
+// SourceLanguage returns the language of a source file the index can outline,
+// or "" for other files
+func SourceLanguage(filePath string) string {
+	if strings.HasSuffix(filePath, ".d.ts") {
+		return ""
+	}
+	return sourceLanguages[path.Ext(filePath)]
+}
+
+// declPattern recognizes one kind of declaration. The name is the last
+// non-empty submatch; member declarations only count inside a container.
+type declPattern struct {
+	kind      string
+	re        *regexp.Regexp
+	member    bool // Only matched inside a container such as a class
+	container bool // Declarations indented below it are its members
+}
+
+var (
+	pythonPatterns = []declPattern{
+		{kind: "class", re: regexp.MustCompile(`^\s*class\s+(\w+)`), container: true},
+		{kind: "func", re: regexp.MustCompile(`^\s*(?:async\s+)?def\s+(\w+)`)},
+		{kind: "var", re: regexp.MustCompile(`^([A-Za-z_]\w*)\s*(?::[^=]+)?=[^=]`)},
+	}
+
+	scriptPatterns = []declPattern{
+		{kind: "class", re: regexp.MustCompile(`^(?:export\s+)?(?:default\s+)?(?:abstract\s+)?class\s+(\w+)`), container: true},
+		{kind: "interface", re: regexp.MustCompile(`^(?:export\s+)?(?:declare\s+)?interface\s+(\w+)`)},
+		{kind: "type", re: regexp.MustCompile(`^(?:export\s+)?(?:declare\s+)?type\s+(\w+)\s*(?:<[^=]*>)?\s*=`)},
+		{kind: "enum", re: regexp.MustCompile(`^(?:export\s+)?(?:declare\s+)?(?:const\s+)?enum\s+(\w+)`)},
+		{kind: "func", re: regexp.MustCompile(`^(?:export\s+)?(?:default\s+)?(?:async\s+)?function\s*\*?\s*(\w+)`)},
+		{kind: "const", re: regexp.MustCompile(`^(?:export\s+)?(?:const|let|var)\s+(\w+)`)},
+		{kind: "method", re: regexp.MustCompile(`^\s+(?:(?:public|private|protected|static|readonly|abstract|override|async|get|set)\s+)*\*?\s*(#?\w+)\s*(?:<[^>]*>)?\s*\([^;]*$`), member: true},
+	}
+
+	rustPatterns = []declPattern{
+		{kind: "impl", re: regexp.MustCompile(`^\s*(?:unsafe\s+)?impl\b(?:\s*<[^{]*?>)?\s+(?:[\w:<>, &']+\s+for\s+)?&?(?:\w+::)*(\w+)`), container: true},
+		{kind: "trait", re: regexp.MustCompile(`^\s*(?:pub(?:\([^)]*\))?\s+)?(?:unsafe\s+)?trait\s+(\w+)`), container: true},
+		{kind: "func", re: regexp.MustCompile(`^\s*(?:pub(?:\([^)]*\))?\s+)?(?:default\s+)?(?:const\s+)?(?:async\s+)?(?:unsafe\s+)?(?:extern\s+"[^"]*"\s+)?fn\s+(\w+)`)},
+		{kind: "struct", re: regexp.MustCompile(`^\s*(?:pub(?:\([^)]*\))?\s+)?struct\s+(\w+)`)},
+		{kind: "enum", re: regexp.MustCompile(`^\s*(?:pub(?:\([^)]*\))?\s+)?enum\s+(\w+)`)},
+		{kind: "type", re: regexp.MustCompile(`^(?:pub(?:\([^)]*\))?\s+)?type\s+(\w+)`)},
+		{kind: "const", re: regexp.MustCompile(`^(?:pub(?:\([^)]*\))?\s+)?(?:const|static)\s+(?:mut\s+)?(\w+)\s*:`)},
+		{kind: "mod", re: regexp.MustCompile(`^(?:pub(?:\([^)]*\))?\s+)?mod\s+(\w+)`)},
+		{kind: "macro", re: regexp.MustCompile(`^macro_rules!\s*(\w+)`)},
+	}
+
+	javaPatterns = []declPattern{
+		{kind: "class", re: regexp.MustCompile(`^\s*(?:(?:public|protected|private|static|final|abstract|sealed|non-sealed|strictfp)\s+)*(?:class|interface|enum|record|@interface)\s+(\w+)`), container: true},
+		{kind: "method", re: regexp.MustCompile(`^\s+(?:@\w+(?:\([^)]*\))?\s+)*(?:(?:public|protected|private|static|final|abstract|synchronized|native|default|strictfp)\s+)*(?:<[^>]+>\s+)?(?:[\w.]+(?:<[^()]*>)?(?:\[\])*\s+)?(\w+)\s*\([^;]*$`), member: true},
+	}
+
+	languagePatterns = map[string][]declPattern{
+		"python":     pythonPatterns,
+		"javascript": scriptPatterns,
+		"typescript": scriptPatterns,
+		"rust":       rustPatterns,
+		"java":       javaPatterns,
+	}
+
+	// notMethods are keywords that the member patterns would mistake for method names
+	notMethods = map[string]bool{
+		"if": true, "for": true, "while": true, "switch": true, "catch": true, "return": true, "new": true,
+		"else": true, "do": true, "try": true, "throw": true, "super": true, "this": true, "synchronized": true,
+		"function": true,
+	}
+
+	// identPattern matches the identifiers recorded as references
+	identPattern = regexp.MustCompile(`[A-Za-z_$][\w$]*`)
+)
+
+// container is a declaration whose indented lines hold its members
+type container struct {
+	name        string
+	indent      int
+	childIndent int // Indentation of the members, -1 until the first one is seen
+}
+
+// parseSourceFile collects the declarations and identifier uses of a file in
+// one of the languages besides Go. Members of classes, traits and impl blocks
+// are named Container.Member, like Go methods.
+func parseSourceFile(src, relPath, lang string) *indexedFile {
+	file := &indexedFile{pkg: path.Base(path.Dir(relPath)), lang: lang, references: make(map[string][]Reference)}
+	patterns := languagePatterns[lang]
+
+	var open []*container
+	inComment := false
+	for i, raw := range strings.Split(src, "\n") {
+		line := strings.TrimRight(raw, "\r")
+		text := strings.TrimSpace(line)
+		if text == "" {
+			continue
+		}
+
+		// Skip block comments and docstrings well enough not to take their text for code
+		if inComment {
+			if strings.Contains(text, "*/") || (lang == "python" && strings.Contains(text, `"""`)) {
+				inComment = false
+			}
+			continue
+		}
+		if lang != "python" && strings.HasPrefix(text, "/*") && !strings.Contains(text, "*/") {
+			inComment = true
+			continue
+		}
+		if lang == "python" && strings.HasPrefix(text, `"""`) && strings.Count(text, `"""`) == 1 {
+			inComment = true
+			continue
+		}
+		if strings.HasPrefix(text, "//") || strings.HasPrefix(text, "*") || (lang == "python" && strings.HasPrefix(text, "#")) {
+			continue
+		}
+
+		// A line at or left of a container's indentation ends it; for braced
+		// languages the closing brace is that line
+		indent := len(line) - len(strings.TrimLeft(line, " \t"))
+		closing := false
+		for len(open) > 0 && indent <= open[len(open)-1].indent {
+			closing = indent == open[len(open)-1].indent && strings.HasPrefix(text, "}")
+			open = open[:len(open)-1]
+			if closing {
+				break
+			}
+		}
+
+		var parent *container
+		if len(open) > 0 {
+			parent = open[len(open)-1]
+			if parent.childIndent < 0 {
+				parent.childIndent = indent
+			}
+		}
+
+		// Only top-level lines and the direct members of a container are declarations
+		declaration := !closing && ((parent == nil && indent == 0) || (parent != nil && indent == parent.childIndent))
+		for _, pattern := range patterns {
+			if !declaration {
+				break
+			}
+			if pattern.member && parent == nil {
+				continue
+			}
+			match := pattern.re.FindStringSubmatch(line)
+			if match == nil {
+				continue
+			}
+			name := match[len(match)-1]
+			if pattern.member && notMethods[name] {
+				continue
+			}
+
+			kind := pattern.kind
+			if parent != nil {
+				name = parent.name + "." + name
+				if kind == "func" {
+					kind = "method"
+				}
+			}
+			if kind != "impl" {
+				file.symbols = append(file.symbols, Symbol{Name: name, Kind: kind, Package: file.pkg, File: relPath, Line: i + 1, Text: text})
+			}
+			if pattern.container {
+				open = append(open, &container{name: match[len(match)-1], indent: indent, childIndent: -1})
+			}
+			break
+		}
+
+		seen := make(map[string]bool)
+		for _, ident := range identPattern.FindAllString(line, -1) {
+			if seen[ident] {
+				continue
+			}
+			seen[ident] = true
+			file.references[ident] = append(file.references[ident], Reference{File: relPath, Line: i + 1, Text: text})
+		}
+	}
+	return file
+}
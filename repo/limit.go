@@ -0,0 +1,81 @@
+package repo
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// ContextLimit caps the size of the context CreateContext builds
+type ContextLimit struct {
+	MaxChars  int    `toml:"max_chars"` // Most characters the context may have, 0 for no limit
+	Priority  string `toml:"priority"`  // Which files are kept when it is trimmed: small, recent or path
+	Generated string `toml:"generated"` // What is done with generated, vendored and duplicate files: placeholder, exclude or keep
+}
+
+// Priorities lists the strategies LimitContext keeps files by. small keeps
+// the most files by dropping the largest, recent drops the files changed
+// longest ago, and path keeps files in the order of the repository walk.
+var Priorities = []string{"small", "recent", "path"}
+
+// contextHeader is the text CreateContext writes before the first file
+var contextHeader = CreateContext(nil)
+
+// LimitContext returns the files that fit in limit.MaxChars when passed to
+// CreateContext, in their original order, and the paths of the files dropped
+// to make them fit. Files are kept by limit.Priority, which defaults to small;
+// files changed most recently are found in repoPath.
+func LimitContext(repoPath string, files []FileInfo, limit ContextLimit) ([]FileInfo, []string, error) {
+	if limit.MaxChars <= 0 {
+		return files, nil, nil
+	}
+
+	sizes := make([]int, len(files))
+	for i, file := range files {
+		sizes[i] = len(CreateContext([]FileInfo{file})) - len(contextHeader)
+	}
+
+	order := make([]int, len(files))
+	for i := range order {
+		order[i] = i
+	}
+	switch limit.Priority {
+	case "", "small":
+		sort.SliceStable(order, func(a, b int) bool { return sizes[order[a]] < sizes[order[b]] })
+	case "recent":
+		modified := make([]int64, len(files))
+		for i, file := range files {
+			if info, err := os.Stat(filepath.Join(repoPath, file.Path)); err == nil {
+				modified[i] = info.ModTime().UnixNano()
+			}
+		}
+		sort.SliceStable(order, func(a, b int) bool { return modified[order[a]] > modified[order[b]] })
+	case "path":
+	default:
+		return nil, nil, fmt.Errorf("unknown context priority %q (available: %s)", limit.Priority, strings.Join(Priorities, ", "))
+	}
+
+	// Take files in priority order while they fit, skipping those that do not
+	// so smaller files further down can still fill the remaining space
+	keep := make([]bool, len(files))
+	used := len(contextHeader)
+	for _, i := range order {
+		if used+sizes[i] <= limit.MaxChars {
+			keep[i] = true
+			used += sizes[i]
+		}
+	}
+
+	var kept []FileInfo
+	var dropped []string
+	for i, file := range files {
+		if keep[i] {
+			kept = append(kept, file)
+		} else {
+			dropped = append(dropped, file.Path)
+		}
+	}
+	return kept, dropped, nil
+}
@@ -0,0 +1,68 @@
+package repo
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// MemoryFile is the path of the project memory notes, relative to the repository root
+var MemoryFile = filepath.Join(".slopshop", "memory.md")
+
+// memoryHeader starts a new memory file
+const memoryHeader = `# Project Memory
+
+Durable notes about this repository: conventions, gotchas and decisions.
+They are included in every prompt. Edit or remove them freely.
+
+`
+
+// LoadMemory returns the project memory notes of a repository, or "" if there are none
+func LoadMemory(repoPath string) (string, error) {
+	data, err := os.ReadFile(filepath.Join(repoPath, MemoryFile))
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("error reading project memory: %v", err)
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+// Remember appends a note to the project memory as a list item, creating the
+// file if needed. Line breaks in the note are folded into spaces.
+func Remember(repoPath, note string) error {
+	note = strings.Join(strings.Fields(note), " ")
+	if note == "" {
+		return fmt.Errorf("nothing to remember")
+	}
+
+	path := filepath.Join(repoPath, MemoryFile)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("error creating %s: %v", filepath.Dir(path), err)
+	}
+
+	existing, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("error reading project memory: %v", err)
+	}
+
+	var buf strings.Builder
+	if len(existing) == 0 {
+		buf.WriteString(memoryHeader)
+	} else if existing[len(existing)-1] != '\n' {
+		buf.WriteString("\n")
+	}
+	buf.WriteString("- " + note + "\n")
+
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("error writing project memory: %v", err)
+	}
+	defer file.Close()
+	if _, err := file.WriteString(buf.String()); err != nil {
+		return fmt.Errorf("error writing project memory: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,118 @@
+package repo
+
+import (
+	"fmt"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Package summarizes one Go package of the repository, without its tests
+type Package struct {
+	Dir     string   // Slash-separated directory relative to the repository, "." for the root
+	Name    string   // Package name
+	Files   []string // Slash-separated paths relative to the repository
+	Doc     string   // Package documentation comment, if any
+	DocFile string   // File holding the documentation comment
+	Symbols []Symbol
+}
+
+// Packages groups the indexed files into packages, ordered by directory
+func (idx *Index) Packages() []Package {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	byDir := make(map[string]*Package)
+	for relPath, file := range idx.files {
+		if file.lang != "go" || strings.HasSuffix(relPath, "_test.go") {
+			continue
+		}
+		dir := path.Dir(relPath)
+		pkg, ok := byDir[dir]
+		if !ok {
+			pkg = &Package{Dir: dir, Name: file.pkg}
+			byDir[dir] = pkg
+		}
+		pkg.Files = append(pkg.Files, relPath)
+		pkg.Symbols = append(pkg.Symbols, file.symbols...)
+		if file.doc != "" && (pkg.DocFile == "" || path.Base(relPath) == "doc.go") {
+			pkg.Doc = file.doc
+			pkg.DocFile = relPath
+		}
+	}
+
+	packages := make([]Package, 0, len(byDir))
+	for _, pkg := range byDir {
+		sort.Strings(pkg.Files)
+		sort.Slice(pkg.Symbols, func(i, j int) bool {
+			if pkg.Symbols[i].File != pkg.Symbols[j].File {
+				return pkg.Symbols[i].File < pkg.Symbols[j].File
+			}
+			return pkg.Symbols[i].Line < pkg.Symbols[j].Line
+		})
+		packages = append(packages, *pkg)
+	}
+	sort.Slice(packages, func(i, j int) bool { return packages[i].Dir < packages[j].Dir })
+	return packages
+}
+
+// Outline lists the package's files and the declaration line of each of its
+// symbols, as a compact description of its API for the model
+func (p Package) Outline() string {
+	var buf strings.Builder
+	buf.WriteString(fmt.Sprintf("Package %s (%s)\n", p.Name, p.Dir))
+	for _, file := range p.Files {
+		buf.WriteString(fmt.Sprintf("\n%s:\n", file))
+		for _, symbol := range p.Symbols {
+			if symbol.File == file {
+				buf.WriteString(fmt.Sprintf("  %s\n", strings.TrimSuffix(symbol.Text, "{")))
+			}
+		}
+	}
+	return buf.String()
+}
+
+// FileOutline returns the declaration lines of an indexed file, one per line
+// and indented by nesting, and whether the file is indexed
+func (idx *Index) FileOutline(relPath string) (string, bool) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	file, ok := idx.files[relPath]
+	if !ok {
+		return "", false
+	}
+	var buf strings.Builder
+	for _, symbol := range file.symbols {
+		indent := ""
+		if file.lang != "go" {
+			indent = strings.Repeat("  ", strings.Count(symbol.Name, "."))
+		}
+		text := strings.TrimSpace(strings.TrimSuffix(strings.TrimSuffix(symbol.Text, "{"), ":"))
+		buf.WriteString(fmt.Sprintf("%s%d: %s\n", indent, symbol.Line, text))
+	}
+	return buf.String(), true
+}
+
+// OutlineFiles replaces the contents of the source files the index understands
+// with their declaration outlines, leaving other files whole. Files without
+// declarations are kept as they are.
+func OutlineFiles(repoPath string, files []FileInfo, excludePatterns []string) ([]FileInfo, error) {
+	idx := NewIndex(repoPath, excludePatterns)
+	if err := idx.Update(); err != nil {
+		return nil, err
+	}
+
+	outlined := make([]FileInfo, len(files))
+	for i, file := range files {
+		outlined[i] = file
+		outline, ok := idx.FileOutline(filepath.ToSlash(file.Path))
+		if !ok || outline == "" {
+			continue
+		}
+		outlined[i].Content = fmt.Sprintf("Outline of %s (line: declaration):\n%s", SourceLanguage(file.Path), outline)
+		outlined[i].Size = int64(len(outlined[i].Content))
+	}
+	return outlined, nil
+}
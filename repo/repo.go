@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"regexp"
 	"strings"
 )
 
@@ -14,27 +15,45 @@ type FileInfo struct {
 	Size    int64  `json:"size"`
 }
 
+// ScanProgress describes how far a repository scan has got
+type ScanProgress struct {
+	Files int    // Files read so far
+	Bytes int64  // Bytes read so far
+	Dir   string // Directory being scanned, relative to the repository
+}
+
 // ReadRepository walks through the repository and reads all relevant files
 func ReadRepository(repoPath string, excludePatterns []string) ([]FileInfo, error) {
+	return ReadRepositoryProgress(repoPath, excludePatterns, nil)
+}
+
+// ReadRepositoryProgress is ReadRepository calling progress, unless it is nil,
+// after each file it reads
+func ReadRepositoryProgress(repoPath string, excludePatterns []string, progress func(ScanProgress)) ([]FileInfo, error) {
 	var files []FileInfo
+	var scanned ScanProgress
 
 	err := filepath.Walk(repoPath, func(path string, info os.FileInfo, err error) error {
 		if err != nil {
 			return err
 		}
 
-		// Skip directories
-		if info.IsDir() {
-			return nil
-		}
-
 		// Check if file should be excluded
 		relPath, err := filepath.Rel(repoPath, path)
 		if err != nil {
 			return err
 		}
 
-		if ShouldExclude(relPath, excludePatterns) {
+		// Skip directories, and slop-shop's own working directory entirely
+		if info.IsDir() {
+			if relPath != "." && IsArtifact(repoPath, relPath, nil) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		// The memory notes are sent separately as project memory
+		if ShouldExclude(relPath, excludePatterns) || relPath == MemoryFile || IsArtifact(repoPath, relPath, nil) {
 			return nil
 		}
 
@@ -44,9 +63,16 @@ func ReadRepository(repoPath string, excludePatterns []string) ([]FileInfo, erro
 			fmt.Printf("Warning: Could not read file %s: %v\n", path, err)
 			return nil
 		}
+		if progress != nil {
+			scanned.Files++
+			scanned.Bytes += int64(len(content))
+			scanned.Dir = filepath.Dir(relPath)
+			progress(scanned)
+		}
 
-		// Check if file is text-based (simple heuristic)
-		if IsTextFile(content) {
+		// Check if file is text-based (simple heuristic) and not a transcript
+		// or conversation written by slop-shop under another name
+		if IsTextFile(content) && !IsArtifact(repoPath, relPath, content) {
 			files = append(files, FileInfo{
 				Path:    relPath,
 				Content: string(content),
@@ -60,6 +86,34 @@ func ReadRepository(repoPath string, excludePatterns []string) ([]FileInfo, erro
 	return files, err
 }
 
+// ReadFiles reads the named files, relative to the repository unless they are
+// absolute, without walking the rest of the repository
+func ReadFiles(repoPath string, paths []string) ([]FileInfo, error) {
+	files := make([]FileInfo, 0, len(paths))
+	for _, path := range paths {
+		fullPath := path
+		if !filepath.IsAbs(path) {
+			fullPath = filepath.Join(repoPath, path)
+		}
+
+		content, err := os.ReadFile(fullPath)
+		if err != nil {
+			return nil, fmt.Errorf("error reading %s: %v", path, err)
+		}
+		if !IsTextFile(content) {
+			return nil, fmt.Errorf("%s is not a text file", path)
+		}
+
+		// Name files inside the repository as the repository walk would
+		name := filepath.Clean(path)
+		if rel, err := filepath.Rel(repoPath, fullPath); err == nil && !strings.HasPrefix(rel, "..") {
+			name = rel
+		}
+		files = append(files, FileInfo{Path: name, Content: string(content), Size: int64(len(content))})
+	}
+	return files, nil
+}
+
 // ShouldExclude checks if a file path matches any exclude pattern
 func ShouldExclude(path string, patterns []string) bool {
 	for _, pattern := range patterns {
@@ -115,3 +169,35 @@ func CreateContext(files []FileInfo) string {
 
 	return buf.String()
 }
+
+// ContextSection is a part of a context built by CreateContext
+type ContextSection struct {
+	Name string // File path, or "" for text before the first file
+	Text string
+}
+
+// contextFileHeader matches the header CreateContext writes before each file
+var contextFileHeader = regexp.MustCompile(`(?m)^File: (.+) \(Size: \d+ bytes\)\n-{50}\n`)
+
+// SplitContext splits a context into the text before the first file, such as
+// piped input or an earlier conversation, and one section per file
+func SplitContext(context string) []ContextSection {
+	var sections []ContextSection
+	matches := contextFileHeader.FindAllStringSubmatchIndex(context, -1)
+	start := len(context)
+	if len(matches) > 0 {
+		start = matches[0][0]
+	}
+	if strings.TrimSpace(context[:start]) != "" {
+		sections = append(sections, ContextSection{Text: context[:start]})
+	}
+
+	for i, match := range matches {
+		end := len(context)
+		if i+1 < len(matches) {
+			end = matches[i+1][0]
+		}
+		sections = append(sections, ContextSection{Name: context[match[2]:match[3]], Text: context[match[0]:end]})
+	}
+	return sections
+}
@@ -0,0 +1,143 @@
+package repo
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// ResolveRevision returns the full commit hash a revision such as a branch, tag
+// or abbreviated hash names in the git repository at repoPath
+func ResolveRevision(repoPath, rev string) (string, error) {
+	output, err := git(repoPath, nil, "rev-parse", "--verify", "--quiet", rev+"^{commit}")
+	if err != nil {
+		return "", fmt.Errorf("unknown revision %q in %s", rev, repoPath)
+	}
+	return strings.TrimSpace(string(output)), nil
+}
+
+// ReadRevision reads the files of the repository as they were at rev, without
+// checking it out. Like ReadRepository it skips excluded, binary and
+// slop-shop's own files; paths are relative to repoPath, which may be a
+// subdirectory of the git repository.
+func ReadRevision(repoPath, rev string, excludePatterns []string) ([]FileInfo, error) {
+	commit, err := ResolveRevision(repoPath, rev)
+	if err != nil {
+		return nil, err
+	}
+	listing, err := git(repoPath, nil, "ls-tree", "-r", "-z", commit)
+	if err != nil {
+		return nil, err
+	}
+
+	// Each entry is "<mode> <type> <hash>\t<path>"; submodules are commits and are skipped
+	var paths, objects []string
+	for _, entry := range strings.Split(strings.TrimSuffix(string(listing), "\x00"), "\x00") {
+		meta, path, ok := strings.Cut(entry, "\t")
+		fields := strings.Fields(meta)
+		if !ok || len(fields) != 3 || fields[1] != "blob" {
+			continue
+		}
+		if ShouldExclude(path, excludePatterns) || path == MemoryFile || IsArtifact(repoPath, path, nil) {
+			continue
+		}
+		paths = append(paths, path)
+		objects = append(objects, fields[2])
+	}
+
+	contents, err := catFiles(repoPath, objects)
+	if err != nil {
+		return nil, err
+	}
+	var files []FileInfo
+	for i, content := range contents {
+		if IsTextFile(content) && !IsArtifact(repoPath, paths[i], content) {
+			files = append(files, FileInfo{Path: paths[i], Content: string(content), Size: int64(len(content))})
+		}
+	}
+	return files, nil
+}
+
+// ReadRevisionFiles reads the named files, relative to repoPath, as they were at rev
+func ReadRevisionFiles(repoPath, rev string, paths []string) ([]FileInfo, error) {
+	commit, err := ResolveRevision(repoPath, rev)
+	if err != nil {
+		return nil, err
+	}
+	objects := make([]string, len(paths))
+	for i, path := range paths {
+		// "./" makes the path relative to repoPath rather than the top of the repository
+		objects[i] = commit + ":./" + strings.TrimPrefix(path, "./")
+	}
+	contents, err := catFiles(repoPath, objects)
+	if err != nil {
+		return nil, err
+	}
+
+	files := make([]FileInfo, len(paths))
+	for i, content := range contents {
+		if content == nil {
+			return nil, fmt.Errorf("%s does not exist at %s", paths[i], rev)
+		}
+		if !IsTextFile(content) {
+			return nil, fmt.Errorf("%s is not a text file", paths[i])
+		}
+		files[i] = FileInfo{Path: strings.TrimPrefix(paths[i], "./"), Content: string(content), Size: int64(len(content))}
+	}
+	return files, nil
+}
+
+// catFiles reads git objects with one git cat-file process, returning nil for
+// those that do not exist
+func catFiles(repoPath string, objects []string) ([][]byte, error) {
+	if len(objects) == 0 {
+		return nil, nil
+	}
+	output, err := git(repoPath, strings.NewReader(strings.Join(objects, "\n")+"\n"), "cat-file", "--batch")
+	if err != nil {
+		return nil, err
+	}
+
+	// Each object is "<hash> <type> <size>\n<content>\n", or "<name> missing\n"
+	reader := bufio.NewReader(bytes.NewReader(output))
+	contents := make([][]byte, len(objects))
+	for i := range objects {
+		header, err := reader.ReadString('\n')
+		if err != nil {
+			return nil, fmt.Errorf("error reading git objects: %v", err)
+		}
+		fields := strings.Fields(header)
+		if len(fields) != 3 {
+			continue
+		}
+		size, err := strconv.Atoi(fields[2])
+		if err != nil {
+			return nil, fmt.Errorf("error reading git objects: unexpected header %q", strings.TrimSpace(header))
+		}
+		contents[i] = make([]byte, size+1)
+		if _, err := io.ReadFull(reader, contents[i]); err != nil {
+			return nil, fmt.Errorf("error reading git objects: %v", err)
+		}
+		contents[i] = contents[i][:size]
+	}
+	return contents, nil
+}
+
+// git runs a git command in repoPath with stdin, if not nil, and returns its output
+func git(repoPath string, stdin io.Reader, args ...string) ([]byte, error) {
+	cmd := exec.Command("git", args...)
+	cmd.Dir = repoPath
+	cmd.Stdin = stdin
+	output, err := cmd.Output()
+	if err != nil {
+		if exitErr, ok := err.(*exec.ExitError); ok && len(exitErr.Stderr) > 0 {
+			return nil, fmt.Errorf("git %s: %s", args[0], strings.TrimSpace(string(exitErr.Stderr)))
+		}
+		return nil, fmt.Errorf("git %s: %v", args[0], err)
+	}
+	return output, nil
+}
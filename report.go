@@ -0,0 +1,166 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// annotationLevels maps review severities to GitHub Actions workflow commands
+var annotationLevels = map[string]string{"error": "error", "warning": "warning", "info": "notice"}
+
+// sarifLevels maps review severities to SARIF result levels
+var sarifLevels = map[string]string{"error": "error", "warning": "warning", "info": "note"}
+
+// writeAnnotations writes the findings as GitHub Actions workflow commands,
+// which show up as annotations on the lines of a pull request
+func writeAnnotations(w io.Writer, findings []reviewFinding) error {
+	for _, finding := range findings {
+		properties := "file=" + escapeAnnotationProperty(finding.File)
+		if finding.Line > 0 {
+			properties += fmt.Sprintf(",line=%d", finding.Line)
+			if finding.Column > 0 {
+				properties += fmt.Sprintf(",col=%d", finding.Column)
+			}
+		}
+		properties += ",title=" + escapeAnnotationProperty(findingTitle(finding))
+		if _, err := fmt.Fprintf(w, "::%s %s::%s\n", annotationLevels[finding.Severity], properties, escapeAnnotationData(finding.Comment)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// findingTitle names what reported a finding: the review or a linter
+func findingTitle(finding reviewFinding) string {
+	if finding.Source == "" {
+		return "slop-shop review"
+	}
+	return "slop-shop lint (" + finding.Source + ")"
+}
+
+// escapeAnnotationData escapes the message of a workflow command
+func escapeAnnotationData(s string) string {
+	return strings.NewReplacer("%", "%25", "\r", "%0D", "\n", "%0A").Replace(s)
+}
+
+// escapeAnnotationProperty escapes a property value of a workflow command
+func escapeAnnotationProperty(s string) string {
+	return strings.NewReplacer("%", "%25", "\r", "%0D", "\n", "%0A", ":", "%3A", ",", "%2C").Replace(s)
+}
+
+// sarifLog is the subset of a SARIF 2.1.0 log that review and lint findings use
+type sarifLog struct {
+	Schema  string     `json:"$schema"`
+	Version string     `json:"version"`
+	Runs    []sarifRun `json:"runs"`
+}
+
+type sarifRun struct {
+	Tool    sarifTool     `json:"tool"`
+	Results []sarifResult `json:"results"`
+}
+
+type sarifTool struct {
+	Driver sarifDriver `json:"driver"`
+}
+
+type sarifDriver struct {
+	Name           string      `json:"name"`
+	Version        string      `json:"version"`
+	InformationURI string      `json:"informationUri"`
+	Rules          []sarifRule `json:"rules"`
+}
+
+type sarifRule struct {
+	ID               string       `json:"id"`
+	ShortDescription sarifMessage `json:"shortDescription"`
+}
+
+type sarifResult struct {
+	RuleID    string          `json:"ruleId"`
+	Level     string          `json:"level"`
+	Message   sarifMessage    `json:"message"`
+	Locations []sarifLocation `json:"locations"`
+}
+
+type sarifMessage struct {
+	Text string `json:"text"`
+}
+
+type sarifLocation struct {
+	PhysicalLocation sarifPhysicalLocation `json:"physicalLocation"`
+}
+
+type sarifPhysicalLocation struct {
+	ArtifactLocation sarifArtifactLocation `json:"artifactLocation"`
+	Region           *sarifRegion          `json:"region,omitempty"`
+}
+
+type sarifArtifactLocation struct {
+	URI string `json:"uri"`
+}
+
+type sarifRegion struct {
+	StartLine   int `json:"startLine"`
+	StartColumn int `json:"startColumn,omitempty"`
+}
+
+// sarifRuleID is the rule a finding is reported under: "review" for the
+// model's review and "lint/<linter>" for a linter's diagnostics
+func sarifRuleID(finding reviewFinding) string {
+	if finding.Source == "" {
+		return "review"
+	}
+	return "lint/" + finding.Source
+}
+
+// sarifReport converts findings to a SARIF log for code scanning tools, with
+// a rule for the review and for each linter that reported something
+func sarifReport(findings []reviewFinding) sarifLog {
+	run := sarifRun{
+		Tool: sarifTool{Driver: sarifDriver{
+			Name:           "slop-shop",
+			Version:        version,
+			InformationURI: "https://github.com/kek/slop-shop",
+			Rules:          []sarifRule{},
+		}},
+		Results: []sarifResult{},
+	}
+	rules := map[string]bool{}
+	for _, finding := range findings {
+		if id := sarifRuleID(finding); !rules[id] {
+			rules[id] = true
+			description := "Finding of a model code review"
+			if finding.Source != "" {
+				description = "Problem reported by " + finding.Source
+			}
+			run.Tool.Driver.Rules = append(run.Tool.Driver.Rules, sarifRule{ID: id, ShortDescription: sarifMessage{Text: description}})
+		}
+	}
+	for _, finding := range findings {
+		result := sarifResult{
+			RuleID:    sarifRuleID(finding),
+			Level:     sarifLevels[finding.Severity],
+			Message:   sarifMessage{Text: finding.Comment},
+			Locations: []sarifLocation{},
+		}
+		if finding.File != "" {
+			location := sarifLocation{PhysicalLocation: sarifPhysicalLocation{ArtifactLocation: sarifArtifactLocation{URI: finding.File}}}
+			if finding.Line > 0 {
+				location.PhysicalLocation.Region = &sarifRegion{StartLine: finding.Line, StartColumn: finding.Column}
+			}
+			result.Locations = append(result.Locations, location)
+		}
+		run.Results = append(run.Results, result)
+	}
+	return sarifLog{Schema: "https://json.schemastore.org/sarif-2.1.0.json", Version: "2.1.0", Runs: []sarifRun{run}}
+}
+
+// writeSARIF writes the findings as an indented SARIF log
+func writeSARIF(w io.Writer, findings []reviewFinding) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(sarifReport(findings))
+}
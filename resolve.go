@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/charmbracelet/lipgloss"
+	"github.com/kek/slop-shop/config"
+	"github.com/kek/slop-shop/ollama"
+	"github.com/kek/slop-shop/styles"
+	"github.com/kek/slop-shop/tools"
+)
+
+// regeneratePrompt asks the model to redo a hunk against the current file content
+const regeneratePrompt = "A hunk of a unified diff for %s no longer matches the file. The hunk was:\n\n%s\n" +
+	"It expected these lines at line %d:\n\n%s\nThe file has these lines there now:\n\n%s\n" +
+	"Rewrite the current lines so they make the change the hunk intended. Answer with only the rewritten lines, " +
+	"without a diff, Markdown fences or explanation."
+
+// conflictInput is where the conflict resolver reads the user's choices
+var conflictInput io.Reader = os.Stdin
+
+// stdinIsTerminal reports whether standard input is an interactive terminal
+func stdinIsTerminal() bool {
+	info, err := os.Stdin.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// newConflictResolver returns a resolver that shows a hunk that does not apply
+// next to the current file content and asks whether to skip it, edit the lines
+// by hand, have the model regenerate them, or abort the diff
+func newConflictResolver(settings *config.Settings) tools.ConflictResolver {
+	return func(conflict tools.HunkConflict) (tools.HunkResolution, error) {
+		input := bufio.NewReader(conflictInput)
+		out := display()
+
+		fmt.Fprintln(out, styles.WarningStyle.Render(fmt.Sprintf("\n⚠️  A hunk does not match %s at line %d", conflict.File, conflict.Line)))
+		fmt.Fprintln(out, "The hunk expected:")
+		printLines(out, conflict.Expected, "- ", styles.ErrorStyle)
+		fmt.Fprintln(out, "The file has:")
+		printLines(out, conflict.Actual, "+ ", styles.SuccessStyle)
+
+		for {
+			fmt.Fprint(out, styles.PromptStyle.Render("[s]kip the hunk, [e]dit the lines, [r]egenerate with the model, [a]bort? "))
+			answer, err := input.ReadString('\n')
+			if err != nil && answer == "" {
+				return tools.HunkResolution{}, fmt.Errorf("hunk at %s:%d does not match and no choice was made", conflict.File, conflict.Line)
+			}
+
+			var lines []string
+			switch strings.ToLower(strings.TrimSpace(answer)) {
+			case "s", "skip":
+				return tools.HunkResolution{Skip: true}, nil
+			case "a", "abort":
+				return tools.HunkResolution{}, fmt.Errorf("aborted at the hunk for %s:%d", conflict.File, conflict.Line)
+			case "e", "edit":
+				fmt.Fprintln(out, "The hunk intended:")
+				printLines(out, conflict.Intended, "  ", styles.InfoStyle)
+				if lines, err = editLines(conflict.Actual); err != nil {
+					fmt.Fprintln(out, styles.ErrorStyle.Render(fmt.Sprintf("❌ %v", err)))
+					continue
+				}
+			case "r", "regenerate":
+				fmt.Fprintln(out, styles.InfoStyle.Render("Asking the model to redo the hunk..."))
+				if lines, err = regenerateHunk(settings, conflict); err != nil {
+					fmt.Fprintln(out, styles.ErrorStyle.Render(fmt.Sprintf("❌ %v", err)))
+					continue
+				}
+			default:
+				continue
+			}
+
+			fmt.Fprintln(out, "Replace the lines with:")
+			printLines(out, lines, "+ ", styles.SuccessStyle)
+			fmt.Fprint(out, styles.PromptStyle.Render("Use these lines? [y/N] "))
+			answer, _ = input.ReadString('\n')
+			if answer = strings.ToLower(strings.TrimSpace(answer)); answer == "y" || answer == "yes" {
+				return tools.HunkResolution{Lines: lines}, nil
+			}
+		}
+	}
+}
+
+// printLines writes lines with a prefix in a style
+func printLines(w io.Writer, lines []string, prefix string, style lipgloss.Style) {
+	for _, line := range lines {
+		fmt.Fprintln(w, style.Render(prefix+line))
+	}
+}
+
+// editLines opens the lines in $VISUAL or $EDITOR (default vi) and returns the edited lines
+func editLines(lines []string) ([]string, error) {
+	file, err := os.CreateTemp("", "slop-shop-hunk-*.txt")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(file.Name())
+	_, err = file.WriteString(strings.Join(lines, "\n") + "\n")
+	file.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	editor := os.Getenv("VISUAL")
+	if editor == "" {
+		editor = os.Getenv("EDITOR")
+	}
+	if editor == "" {
+		editor = "vi"
+	}
+	fields := strings.Fields(editor)
+	cmd := exec.Command(fields[0], append(fields[1:], file.Name())...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("editor %s failed: %v", editor, err)
+	}
+
+	edited, err := os.ReadFile(file.Name())
+	if err != nil {
+		return nil, err
+	}
+	return splitResponseLines(string(edited)), nil
+}
+
+// regenerateHunk asks the model to apply the intent of a hunk to the current lines
+func regenerateHunk(settings *config.Settings, conflict tools.HunkConflict) ([]string, error) {
+	client := ollama.NewClient(settings.URL, settings.Model, settings.Temperature, settings.TopP)
+	prompt := fmt.Sprintf(regeneratePrompt, conflict.File, conflict.Hunk, conflict.Line,
+		strings.Join(conflict.Expected, "\n")+"\n", strings.Join(conflict.Actual, "\n")+"\n")
+	response, err := client.Generate(prompt, "", false, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	// Tolerate a fence around the answer
+	text := strings.TrimSpace(response)
+	if lines := strings.Split(text, "\n"); len(lines) >= 2 && strings.HasPrefix(lines[0], "```") && strings.TrimSpace(lines[len(lines)-1]) == "```" {
+		text = strings.Join(lines[1:len(lines)-1], "\n")
+	}
+	if text == "" {
+		return nil, fmt.Errorf("the model returned no lines")
+	}
+	return splitResponseLines(text), nil
+}
+
+// splitResponseLines splits text into lines, dropping one trailing newline
+func splitResponseLines(text string) []string {
+	return strings.Split(strings.TrimSuffix(text, "\n"), "\n")
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/kek/slop-shop/config"
+	"github.com/kek/slop-shop/repo"
+)
+
+// revisionContext builds the context from the files of the revision set by
+// -rev, or the files -attach names as they were at it. A note before the files
+// tells the model which revision they come from, since tools still see the
+// working tree.
+func revisionContext(opts *options, settings *config.Settings, limit repo.ContextLimit) (string, error) {
+	if opts.outline {
+		return "", fmt.Errorf("-outline cannot be combined with -rev")
+	}
+	commit, err := repo.ResolveRevision(opts.repoPath, opts.rev)
+	if err != nil {
+		return "", err
+	}
+
+	var files []repo.FileInfo
+	if opts.attach != "" {
+		files, err = repo.ReadRevisionFiles(opts.repoPath, commit, config.SplitList(opts.attach))
+	} else {
+		files, err = repo.ReadRevision(opts.repoPath, commit, settings.Exclude)
+	}
+	if err != nil {
+		return "", fmt.Errorf("error reading %s: %v", opts.rev, err)
+	}
+	if opts.attach == "" {
+		if files, err = condenseFiles(files); err != nil {
+			return "", err
+		}
+	}
+	if files, err = repo.BlameFiles(opts.repoPath, commit, files, opts.blame); err != nil {
+		return "", err
+	}
+	if files, err = limitContext(opts.repoPath, files, limit); err != nil {
+		return "", err
+	}
+
+	note := fmt.Sprintf("The files below are the repository as of %s (commit %s), not the current working tree.\n\n", opts.rev, commit[:12])
+	return note + repo.CreateContext(files), nil
+}
@@ -0,0 +1,278 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/kek/slop-shop/styles"
+	"github.com/kek/slop-shop/tools"
+)
+
+// reviewPrompt asks the model to review a diff and answer with JSON findings
+const reviewPrompt = "Review the following changes. Point out bugs, risky behavior, missing error handling and missing tests. " +
+	"Only comment on lines the diff adds or changes. Answer with a JSON array and nothing else. Each element is an object with " +
+	`"file" (path as in the diff), "line" (line number in the new version of the file), "severity" ("error", "warning" or "info") ` +
+	`and "comment" (a short explanation). Answer with [] if the changes look good.`
+
+// reviewFileLimit caps the size of a changed file included in full as context
+const reviewFileLimit = 20000
+
+// reviewSeverities orders severities from most to least severe
+var reviewSeverities = map[string]int{"error": 0, "warning": 1, "info": 2}
+
+// reviewFormats are the formats -format accepts
+var reviewFormats = map[string]bool{"text": true, "json": true, "github": true, "annotations": true, "sarif": true, "html": true}
+
+// reviewFinding is one comment of a code review, or one problem reported by
+// a linter
+type reviewFinding struct {
+	File     string `json:"file"`
+	Line     int    `json:"line"`
+	Column   int    `json:"column,omitempty"`
+	Severity string `json:"severity"`
+	Comment  string `json:"comment"`
+	Source   string `json:"source,omitempty"` // Linter that reported it; empty for the review
+}
+
+// runReview sends the changes since a base revision, with the changed files as
+// context, for review and prints the findings
+func runReview(args []string) error {
+	fs := newFlagSet("review")
+	opts := addCommonFlags(fs)
+	base := fs.String("base", "HEAD", "Revision or branch to compare the working tree against, from its merge base with HEAD")
+	head := fs.String("head", "", "Review the commits up to this revision, from its merge base with -base, instead of the working tree")
+	format := fs.String("format", "text", "Findings format: text, json, github for a pull request review payload, annotations for GitHub Actions, sarif, or html for a standalone report")
+	focus := fs.String("focus", "", "Extra review instructions, e.g. \"check the SQL queries for injection\"")
+	failOn := fs.String("fail-on", "none", "Exit with code 7 when there is a finding of this severity or worse: error, warning, info or none")
+	fs.Parse(args)
+
+	if !reviewFormats[*format] {
+		return fmt.Errorf("unknown review format %q (use text, json, github, annotations, sarif or html)", *format)
+	}
+	threshold, ok := reviewSeverities[*failOn]
+	if !ok && *failOn != "none" {
+		return fmt.Errorf("unknown severity %q for -fail-on (use error, warning, info or none)", *failOn)
+	}
+	if *format != "text" && opts.output == "json" {
+		return fmt.Errorf("-format %s cannot be combined with -output json", *format)
+	}
+
+	settings, err := setup(fs, opts)
+	if err != nil {
+		return err
+	}
+	if *format != "text" {
+		// Keep stdout for the findings
+		responseOnly, paging = false, false
+		displayWriter = os.Stderr
+		tools.SetProgressOutput(displayWriter)
+	}
+
+	context, err := reviewContext(opts.repoPath, *base, *head)
+	if err != nil {
+		return err
+	}
+
+	prompt := reviewPrompt
+	if *focus != "" {
+		prompt += " Pay particular attention to the following: " + *focus
+	}
+	response, err := runBatch(prompt, context, settings.URL, settings.Model, settings.System, settings.Temperature, settings.TopP, false, opts.repoPath)
+	if err != nil {
+		return err
+	}
+	findings, err := parseFindings(response)
+	if err != nil {
+		return err
+	}
+	if err := printFindings(*format, findings, opts.repoPath); err != nil {
+		return err
+	}
+
+	if *failOn != "none" {
+		for _, finding := range findings {
+			if reviewSeverities[finding.Severity] <= threshold {
+				return &exitError{code: exitFindings, err: fmt.Errorf("the review found problems of severity %s or worse", *failOn)}
+			}
+		}
+	}
+	return nil
+}
+
+// reviewContext returns the diff since the merge base of base and HEAD, with
+// wide hunk context, followed by the current contents of the changed files.
+// With head set the diff goes up to head instead of the working tree, and the
+// files are read as they are in head, so uncommitted changes are left out.
+func reviewContext(repoPath, base, head string) (string, error) {
+	from, to := base, "HEAD"
+	if head != "" {
+		to = head
+	}
+	if mergeBase, err := gitOutput(repoPath, "merge-base", base, to); err == nil {
+		from = strings.TrimSpace(mergeBase)
+	}
+	revisions := []string{from}
+	if head != "" {
+		revisions = append(revisions, head)
+	}
+
+	diff, err := gitOutput(repoPath, append([]string{"diff", "--relative", "--unified=10"}, revisions...)...)
+	if err != nil {
+		return "", err
+	}
+	if strings.TrimSpace(diff) == "" {
+		return "", fmt.Errorf("no changes since %s to review", base)
+	}
+
+	names, err := gitOutput(repoPath, append([]string{"diff", "--relative", "--name-only", "--diff-filter=AM"}, revisions...)...)
+	if err != nil {
+		return "", err
+	}
+
+	var context strings.Builder
+	if head != "" {
+		context.WriteString(fmt.Sprintf("Changes from %s to %s:\n\n%s\n", base, head, diff))
+	} else {
+		context.WriteString(fmt.Sprintf("Changes since %s:\n\n%s\n", base, diff))
+	}
+	for _, name := range strings.Split(strings.TrimSpace(names), "\n") {
+		if name == "" {
+			continue
+		}
+		var data string
+		if head != "" {
+			// "./" makes the path relative to repoPath, as --relative does
+			data, err = gitOutput(repoPath, "show", head+":./"+name)
+		} else {
+			var raw []byte
+			raw, err = os.ReadFile(filepath.Join(repoPath, filepath.FromSlash(name)))
+			data = string(raw)
+		}
+		if err != nil || len(data) > reviewFileLimit {
+			continue
+		}
+		context.WriteString(fmt.Sprintf("\nFile: %s\n%s\n%s\n", name, strings.Repeat("-", 50), data))
+	}
+	return context.String(), nil
+}
+
+// parseFindings extracts the JSON array of findings from a review response,
+// ignoring any text or code fence around it
+func parseFindings(response string) ([]reviewFinding, error) {
+	start := strings.Index(response, "[")
+	end := strings.LastIndex(response, "]")
+	if start < 0 || end < start {
+		return nil, fmt.Errorf("the review did not contain a JSON list of findings")
+	}
+
+	var findings []reviewFinding
+	if err := json.Unmarshal([]byte(response[start:end+1]), &findings); err != nil {
+		return nil, fmt.Errorf("error parsing review findings: %v", err)
+	}
+
+	for i := range findings {
+		findings[i].Severity = strings.ToLower(strings.TrimSpace(findings[i].Severity))
+		if _, ok := reviewSeverities[findings[i].Severity]; !ok {
+			findings[i].Severity = "info"
+		}
+	}
+	sort.SliceStable(findings, func(i, j int) bool {
+		if findings[i].File != findings[j].File {
+			return findings[i].File < findings[j].File
+		}
+		return findings[i].Line < findings[j].Line
+	})
+	return findings, nil
+}
+
+// printFindings writes the findings to stdout in the given format. The HTML
+// report quotes the lines they refer to from the files in repoPath.
+func printFindings(format string, findings []reviewFinding, repoPath string) error {
+	switch format {
+	case "json":
+		if findings == nil {
+			findings = []reviewFinding{}
+		}
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(findings)
+	case "github":
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(githubReview(findings))
+	case "annotations":
+		return writeAnnotations(os.Stdout, findings)
+	case "sarif":
+		return writeSARIF(os.Stdout, findings)
+	case "html":
+		return writeHTML(os.Stdout, findings, repoPath)
+	}
+
+	fmt.Println()
+	if len(findings) == 0 {
+		fmt.Println(styles.SuccessStyle.Render("✅ No findings"))
+		return nil
+	}
+	for _, finding := range findings {
+		style := styles.InfoStyle
+		switch finding.Severity {
+		case "error":
+			style = styles.ErrorStyle
+		case "warning":
+			style = styles.WarningStyle
+		}
+		fmt.Println(style.Render(fmt.Sprintf("%s: %s: %s", finding.location(), finding.Severity, finding.Comment)))
+	}
+	return nil
+}
+
+// location formats where the finding is as file:line:column, leaving out what is unknown
+func (f reviewFinding) location() string {
+	location := f.File
+	if location == "" {
+		location = "(no file)"
+	}
+	if f.Line > 0 {
+		location += fmt.Sprintf(":%d", f.Line)
+		if f.Column > 0 {
+			location += fmt.Sprintf(":%d", f.Column)
+		}
+	}
+	return location
+}
+
+// githubReviewComment is a line comment of a GitHub pull request review
+type githubReviewComment struct {
+	Path string `json:"path"`
+	Line int    `json:"line"`
+	Side string `json:"side"`
+	Body string `json:"body"`
+}
+
+// githubReviewPayload is the body of GitHub's create-review API call
+type githubReviewPayload struct {
+	Event    string                `json:"event"`
+	Body     string                `json:"body"`
+	Comments []githubReviewComment `json:"comments"`
+}
+
+// githubReview converts findings to a pull request review that only comments
+func githubReview(findings []reviewFinding) githubReviewPayload {
+	counts := make(map[string]int)
+	payload := githubReviewPayload{Event: "COMMENT", Comments: []githubReviewComment{}}
+	for _, finding := range findings {
+		counts[finding.Severity]++
+		payload.Comments = append(payload.Comments, githubReviewComment{
+			Path: finding.File,
+			Line: finding.Line,
+			Side: "RIGHT",
+			Body: fmt.Sprintf("**%s**: %s", finding.Severity, finding.Comment),
+		})
+	}
+	payload.Body = fmt.Sprintf("slop-shop review: %d errors, %d warnings, %d notes", counts["error"], counts["warning"], counts["info"])
+	return payload
+}
@@ -0,0 +1,393 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kek/slop-shop/config"
+	"github.com/kek/slop-shop/ollama"
+	"github.com/kek/slop-shop/styles"
+	"github.com/kek/slop-shop/tools"
+)
+
+// askRequest is the body of POST /api/ask and POST /api/tasks
+type askRequest struct {
+	Prompt       string `json:"prompt"`
+	Session      string `json:"session,omitempty"`       // Continue this session, creating it if needed
+	Tools        *bool  `json:"tools,omitempty"`         // Turns the tools off, or on when the tools setting allows them
+	EmptyContext bool   `json:"empty_context,omitempty"` // Do not send the repository files
+}
+
+// sessionSummary describes a session in GET /api/sessions
+type sessionSummary struct {
+	Name    string    `json:"name"`
+	Title   string    `json:"title,omitempty"`
+	Model   string    `json:"model"`
+	Turns   int       `json:"turns"`
+	Created time.Time `json:"created"`
+	Updated time.Time `json:"updated"`
+}
+
+// tokenEnv holds the token clients of the API send, when -token is not given
+const tokenEnv = config.EnvPrefix + "API_TOKEN"
+
+// server answers API requests about one repository
+type server struct {
+	opts     *options
+	settings *config.Settings
+	token    string          // Clients send it as "Authorization: Bearer <token>"
+	hosts    map[string]bool // Host names requests may be addressed to
+
+	toolMu    sync.Mutex // Tool calls share the shell and the progress output, so they run one task at a time
+	sessionMu sync.Mutex // Sessions are loaded and their turns recorded one at a time
+}
+
+// runServe serves the HTTP API until the process is stopped
+func runServe(args []string) error {
+	fs := newFlagSet("serve")
+	opts := addCommonFlags(fs)
+	addr := fs.String("addr", "127.0.0.1:8080", "Address to listen on")
+	token := fs.String("token", os.Getenv(tokenEnv), "Token clients must send as a bearer token (default: $"+tokenEnv+", or a random one that is printed)")
+	allowHosts := fs.String("allow-hosts", "", "Comma-separated host names the API may be reached by besides localhost and the -addr host")
+	fs.Parse(args)
+
+	srv, err := newServer(fs, opts, *addr, *token, *allowHosts)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintln(chatter(), styles.TitleStyle.Render("🚀 Slop Shop API"))
+	fmt.Fprintln(chatter(), styles.InfoStyle.Render(fmt.Sprintf("Serving %s with %s on http://%s", opts.repoPath, srv.settings.Model, *addr)))
+	if *token == "" {
+		// Printed even with -quiet, since clients cannot connect without it
+		fmt.Fprintln(os.Stderr, styles.InfoStyle.Render("Token: "+srv.token))
+	}
+	return http.ListenAndServe(*addr, srv.routes())
+}
+
+// newServer sets up the tools for served requests and returns the server for
+// addr. Nobody watches the server's terminal, so it has no flags or prompts
+// that ask there.
+func newServer(fs *flag.FlagSet, opts *options, addr, token, allowHosts string) (*server, error) {
+	if opts.speculative {
+		return nil, fmt.Errorf("-speculative only applies to batch runs; nobody is asked to approve the changes of served requests")
+	}
+	if opts.confirm {
+		return nil, fmt.Errorf("-confirm only applies to batch runs; nobody is asked to approve the tool calls of served requests")
+	}
+
+	settings, err := setup(fs, opts)
+	if err != nil {
+		return nil, err
+	}
+	// Hunks that do not apply fail the diff instead of prompting on the terminal
+	tools.SetConflictResolver(nil)
+
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid -addr %q: %v", addr, err)
+	}
+	srv := &server{opts: opts, settings: settings, token: token, hosts: allowedHosts(host, config.SplitList(allowHosts))}
+	if srv.token == "" {
+		random := make([]byte, 16)
+		if _, err := rand.Read(random); err != nil {
+			return nil, fmt.Errorf("error generating a token: %v", err)
+		}
+		srv.token = hex.EncodeToString(random)
+	}
+	return srv, nil
+}
+
+// allowedHosts returns the host names the server answers to: the loopback
+// names, the host it listens on unless that is every interface, and extra
+func allowedHosts(listen string, extra []string) map[string]bool {
+	hosts := map[string]bool{"localhost": true, "127.0.0.1": true, "::1": true}
+	if ip := net.ParseIP(listen); listen != "" && (ip == nil || !ip.IsUnspecified()) {
+		hosts[strings.ToLower(listen)] = true
+	}
+	for _, host := range extra {
+		hosts[strings.ToLower(host)] = true
+	}
+	return hosts
+}
+
+// routes registers the API endpoints behind the checks of guard
+func (s *server) routes() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /api/health", s.handleHealth)
+	mux.HandleFunc("POST /api/ask", func(w http.ResponseWriter, r *http.Request) { s.handleAsk(w, r, false) })
+	mux.HandleFunc("POST /api/tasks", func(w http.ResponseWriter, r *http.Request) { s.handleAsk(w, r, true) })
+	mux.HandleFunc("GET /api/sessions", s.handleSessions)
+	mux.HandleFunc("GET /api/sessions/{name}", s.handleSession)
+	return s.guard(mux)
+}
+
+// guard rejects requests that do not come from a client of the API: those
+// addressed to another host name, as a web page does after rebinding its DNS
+// name to this address, those sent from the page of another origin, those
+// without the token, and posts of anything but JSON, which a page can send
+// without asking the server first
+func (s *server) guard(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !s.allowedHost(r.Host) {
+			writeError(w, http.StatusForbidden, fmt.Errorf("requests to host %s are not allowed; add it with -allow-hosts", r.Host))
+			return
+		}
+		if origin := r.Header.Get("Origin"); origin != "" {
+			u, err := url.Parse(origin)
+			if err != nil || !s.allowedHost(u.Host) {
+				writeError(w, http.StatusForbidden, fmt.Errorf("requests from origin %s are not allowed", origin))
+				return
+			}
+		}
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(s.token)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeError(w, http.StatusUnauthorized, fmt.Errorf("a valid token is required as Authorization: Bearer <token>"))
+			return
+		}
+		if r.Method == http.MethodPost {
+			if mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type")); err != nil || mediaType != "application/json" {
+				writeError(w, http.StatusUnsupportedMediaType, fmt.Errorf("the request body must be application/json"))
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// allowedHost reports whether a Host header, or the host of an Origin, names
+// the server
+func (s *server) allowedHost(hostport string) bool {
+	host, _, err := net.SplitHostPort(hostport)
+	if err != nil {
+		host = hostport
+	}
+	return s.hosts[strings.ToLower(strings.Trim(host, "[]"))]
+}
+
+// handleHealth reports the repository and model the server uses
+func (s *server) handleHealth(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]string{
+		"status":  "ok",
+		"version": versionString(),
+		"repo":    s.opts.repoPath,
+		"model":   s.settings.Model,
+	})
+}
+
+// handleAsk sends a prompt with the repository as context and answers with the
+// batch record. Clients that accept text/event-stream, or pass ?stream=true,
+// receive "chunk" events while the model writes and a final "done" event.
+// Tasks run the tools the model asks for, so they need the tools setting on;
+// the tools setting and policy also bound what a request can turn on.
+func (s *server) handleAsk(w http.ResponseWriter, r *http.Request, task bool) {
+	var req askRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid request body: %v", err))
+		return
+	}
+	if strings.TrimSpace(req.Prompt) == "" {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("prompt is required"))
+		return
+	}
+
+	toolsEnabled := s.settings.Tools
+	if req.Tools != nil {
+		if *req.Tools && !s.settings.Tools {
+			writeError(w, http.StatusForbidden, fmt.Errorf("tools are disabled in the server's settings"))
+			return
+		}
+		toolsEnabled = *req.Tools
+	}
+	if task && !toolsEnabled {
+		writeError(w, http.StatusForbidden, fmt.Errorf("tasks run tools, which are disabled for this request or in the server's settings"))
+		return
+	}
+
+	// Each request builds its own context, so concurrent requests share nothing
+	context := ""
+	if !req.EmptyContext {
+		var err error
+		if context, err = loadContext(s.opts, s.settings); err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+	}
+
+	var sess *session
+	var history []int
+	if req.Session != "" {
+		s.sessionMu.Lock()
+		var err error
+		sess, err = loadSession(req.Session)
+		s.sessionMu.Unlock()
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		history, context = sess.prepare(s.settings.Model, context)
+	}
+
+	send := func(event string, data any) {}
+	stream := r.URL.Query().Get("stream") == "true" || strings.Contains(r.Header.Get("Accept"), "text/event-stream")
+	if stream {
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			writeError(w, http.StatusInternalServerError, fmt.Errorf("streaming is not supported"))
+			return
+		}
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.WriteHeader(http.StatusOK)
+		send = func(event string, data any) {
+			payload, _ := json.Marshal(data)
+			fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, payload)
+			flusher.Flush()
+		}
+	}
+
+	client := ollama.NewClient(s.settings.URL, s.settings.Model, s.settings.Temperature, s.settings.TopP)
+	client.System = s.settings.System
+	record := batchRecord{
+		Prompt:    req.Prompt,
+		Model:     client.Model,
+		URL:       client.URL,
+		System:    client.System,
+		StartedAt: time.Now(),
+	}
+
+	response, stats, newHistory, err := client.Continue(history, req.Prompt, context, toolsEnabled, func(chunk string) {
+		send("chunk", map[string]string{"text": chunk})
+	})
+	record.Response, record.Stats, record.history = response, stats, newHistory
+	if err != nil {
+		record.Error = err.Error()
+	}
+
+	if toolsEnabled && err == nil {
+		s.toolMu.Lock()
+		record.ToolCalls = tools.ParseToolCalls(response)
+		record.ToolResults = tools.ExecuteCalls(record.ToolCalls, s.opts.repoPath, client)
+		tools.CloseShell()
+		s.toolMu.Unlock()
+		if len(record.ToolResults) > 0 {
+			summary := tools.SummarizeResults(record.ToolResults)
+			record.ToolSummary = &summary
+		}
+	}
+
+	record.err = batchError(err, record.ToolResults)
+	record.ExitCode = exitCode(record.err)
+	record.Duration = time.Since(record.StartedAt)
+
+	if err == nil {
+		nameConversation(&record, sess)
+	}
+	if sess != nil && err == nil {
+		record.Session = sess.Name
+		if saveErr := s.addTurn(sess, client.Model, req.Prompt, response, newHistory); saveErr != nil {
+			record.Error = saveErr.Error()
+		}
+	}
+	if err == nil {
+		if histErr := recordHistory(record, req.Session, s.opts.repoPath); histErr != nil {
+			fmt.Fprintln(os.Stderr, styles.ErrorStyle.Render(fmt.Sprintf("❌ %v", histErr)))
+		}
+	}
+
+	if stream {
+		send("done", record)
+		return
+	}
+	status := http.StatusOK
+	var connErr *ollama.ConnectionError
+	if errors.As(err, &connErr) {
+		status = http.StatusBadGateway
+	}
+	writeJSON(w, status, record)
+}
+
+// addTurn records a turn of a session. The session is loaded again first, so
+// the turns of other requests made since this one started are kept.
+func (s *server) addTurn(sess *session, model, prompt, response string, history []int) error {
+	s.sessionMu.Lock()
+	defer s.sessionMu.Unlock()
+	latest, err := loadSession(sess.Name)
+	if err != nil {
+		return err
+	}
+	if latest.Title == "" {
+		latest.Title = sess.Title
+	}
+	latest.addTurn(model, prompt, response, history)
+	return latest.save()
+}
+
+// handleSessions lists the saved sessions
+func (s *server) handleSessions(w http.ResponseWriter, r *http.Request) {
+	sessions, err := listSessions()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	summaries := make([]sessionSummary, 0, len(sessions))
+	for _, sess := range sessions {
+		summaries = append(summaries, sessionSummary{
+			Name:    sess.Name,
+			Title:   sess.Title,
+			Model:   sess.Model,
+			Turns:   len(sess.Turns),
+			Created: sess.Created,
+			Updated: sess.Updated,
+		})
+	}
+	writeJSON(w, http.StatusOK, summaries)
+}
+
+// handleSession returns one session with its turns
+func (s *server) handleSession(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	path, err := sessionPath(name)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if _, err := os.Stat(path); err != nil {
+		writeError(w, http.StatusNotFound, fmt.Errorf("session %s not found", name))
+		return
+	}
+
+	sess, err := loadSession(name)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, sess)
+}
+
+// writeJSON writes value as a JSON response
+func writeJSON(w http.ResponseWriter, status int, value any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(value)
+}
+
+// writeError writes an error as a JSON response
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
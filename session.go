@@ -0,0 +1,138 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/kek/slop-shop/config"
+)
+
+// session is a batch conversation continued across invocations with -session
+type session struct {
+	Name    string        `json:"name"`
+	Title   string        `json:"title,omitempty"` // Short description of the conversation, named after the first turn
+	Model   string        `json:"model"`
+	History []int         `json:"history,omitempty"` // Ollama conversation state after the last turn
+	Turns   []sessionTurn `json:"turns"`
+	Created time.Time     `json:"created"`
+	Updated time.Time     `json:"updated"`
+}
+
+// sessionTurn is one prompt and its response
+type sessionTurn struct {
+	Prompt   string    `json:"prompt"`
+	Response string    `json:"response"`
+	Time     time.Time `json:"time"`
+}
+
+// sessionPath returns the file a session is stored in
+func sessionPath(name string) (string, error) {
+	if name == "" || strings.ContainsAny(name, `/\`) || name == "." || name == ".." {
+		return "", fmt.Errorf("invalid session name %q", name)
+	}
+	dir := config.SessionDir()
+	if dir == "" {
+		return "", fmt.Errorf("cannot locate the session directory")
+	}
+	return filepath.Join(dir, name+".json"), nil
+}
+
+// loadSession reads a session, or starts a new one if it does not exist yet
+func loadSession(name string) (*session, error) {
+	path, err := sessionPath(name)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return &session{Name: name, Created: time.Now()}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading session %s: %v", name, err)
+	}
+
+	var s session
+	if err := json.Unmarshal(data, &s); err != nil {
+		return nil, fmt.Errorf("error parsing session %s: %v", name, err)
+	}
+	return &s, nil
+}
+
+// listSessions returns the saved sessions, most recently updated first
+func listSessions() ([]*session, error) {
+	dir := config.SessionDir()
+	if dir == "" {
+		return nil, fmt.Errorf("cannot locate the session directory")
+	}
+	matches, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+
+	sessions := make([]*session, 0, len(matches))
+	for _, match := range matches {
+		s, err := loadSession(strings.TrimSuffix(filepath.Base(match), ".json"))
+		if err != nil {
+			continue
+		}
+		sessions = append(sessions, s)
+	}
+	sort.Slice(sessions, func(i, j int) bool { return sessions[i].Updated.After(sessions[j].Updated) })
+	return sessions, nil
+}
+
+// save writes the session to its file
+func (s *session) save() error {
+	path, err := sessionPath(s.Name)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("error creating session directory: %v", err)
+	}
+
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return fmt.Errorf("error encoding session %s: %v", s.Name, err)
+	}
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		return fmt.Errorf("error writing session %s: %v", s.Name, err)
+	}
+	return nil
+}
+
+// prepare returns the Ollama conversation state and the context for the next
+// prompt. When the model is unchanged the state already holds the repository
+// context and earlier turns, so no context is resent. Otherwise the earlier
+// turns are added to the context as text, since the state is model specific.
+func (s *session) prepare(model, context string) ([]int, string) {
+	if len(s.Turns) == 0 {
+		return nil, context
+	}
+	if s.Model == model && len(s.History) > 0 {
+		return s.History, ""
+	}
+
+	var transcript strings.Builder
+	transcript.WriteString("Previous conversation:\n" + strings.Repeat("-", 50) + "\n")
+	for _, turn := range s.Turns {
+		transcript.WriteString("User: " + turn.Prompt + "\n\n")
+		transcript.WriteString("Assistant: " + turn.Response + "\n\n")
+	}
+	return nil, context + "\n\n" + transcript.String()
+}
+
+// addTurn records a prompt and its response with the conversation state after it
+func (s *session) addTurn(model, prompt, response string, history []int) {
+	now := time.Now()
+	s.Model = model
+	s.History = history
+	s.Turns = append(s.Turns, sessionTurn{Prompt: prompt, Response: response, Time: now})
+	s.Updated = now
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/kek/slop-shop/ollama"
+	"github.com/kek/slop-shop/styles"
+	"github.com/kek/slop-shop/tools"
+)
+
+// shutdown is done once the command has been interrupted
+var shutdown = context.Background()
+
+// handleInterrupts makes the first Ctrl+C or SIGTERM cancel the request in
+// flight and the running tools, so the command can save what it has and exit
+// with the terminal intact. A second one ends the process at once.
+func handleInterrupts() {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	shutdown = ctx
+	ollama.SetContext(ctx)
+	tools.SetContext(ctx)
+
+	go func() {
+		<-ctx.Done()
+		stop()
+		restoreTerminal()
+		fmt.Fprintln(os.Stderr, styles.WarningStyle.Render("\n⏹️  Interrupted; stopping. Press Ctrl+C again to quit immediately."))
+	}()
+}
+
+// wasInterrupted reports whether the command has been interrupted
+func wasInterrupted() bool {
+	return shutdown.Err() != nil
+}
+
+// keepScratch keeps the scratch directory of the tools on exit, set by -keep-scratch
+var keepScratch bool
+
+// closeScratch removes the scratch directory of the tools, or keeps it with
+// -keep-scratch, and reports what it held on stderr
+func closeScratch() {
+	report, err := tools.CloseScratch(keepScratch)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, styles.WarningStyle.Render(fmt.Sprintf("⚠️  %v", err)))
+	} else if report != "" && !quiet {
+		fmt.Fprintln(os.Stderr, styles.InfoStyle.Render("🧺 "+report))
+	}
+}
+
+// restoreTerminal resets text styling and shows the cursor, in case output was
+// cut off in the middle of a styled line
+func restoreTerminal() {
+	for _, file := range []*os.File{os.Stdout, os.Stderr} {
+		if info, err := file.Stat(); err == nil && info.Mode()&os.ModeCharDevice != 0 {
+			fmt.Fprint(file, "\x1b[0m\x1b[?25h")
+		}
+	}
+}
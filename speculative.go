@@ -0,0 +1,42 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/kek/slop-shop/styles"
+	"github.com/kek/slop-shop/tools"
+)
+
+// speculative keeps the changes tools make in memory until they are approved
+// at the end of a batch run, set by -speculative
+var speculative bool
+
+// setSpeculative turns the speculative overlay of the tools on or off
+func setSpeculative(enabled bool) {
+	speculative = enabled
+	tools.SetOverlay(enabled)
+}
+
+// settleOverlay shows the changes kept in memory during a run and writes them
+// to the repository once the user approves. Without a terminal to ask on they
+// are not written. It returns their diff and starts an empty overlay, without
+// a sandbox, for the next run.
+func settleOverlay(repoPath string) (string, error) {
+	defer tools.SetOverlay(true)
+	diff := tools.OverlayDiff(repoPath)
+	if diff == "" {
+		return "", nil
+	}
+
+	fmt.Fprintln(chatter(), styles.HeaderStyle.Render("\n🧪 Speculative changes"))
+	printDiff(display(), diff)
+	if !confirm("Write these changes to the repository?") {
+		fmt.Fprintln(chatter(), styles.WarningStyle.Render("Changes not written; -patch-out saves them as a patch"))
+		return diff, nil
+	}
+	if err := tools.FlushOverlay(); err != nil {
+		return diff, err
+	}
+	fmt.Fprintln(chatter(), styles.SuccessStyle.Render("✅ Changes written"))
+	return diff, nil
+}
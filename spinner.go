@@ -2,19 +2,28 @@ package main
 
 import (
 	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/charmbracelet/x/term"
+	"github.com/kek/slop-shop/styles"
 )
 
 // Spinner represents a simple terminal spinner
 type Spinner struct {
 	frames []string
 	index  int
+	out    io.Writer
 }
 
-// NewSpinner creates a new spinner with default frames
-func NewSpinner() *Spinner {
+// NewSpinner creates a new spinner with default frames that draws on out
+func NewSpinner(out io.Writer) *Spinner {
 	return &Spinner{
 		frames: []string{"⠋", "⠙", "⠹", "⠸", "⠼", "⠴", "⠦", "⠧", "⠇", "⠏"},
 		index:  0,
+		out:    out,
 	}
 }
 
@@ -25,12 +34,88 @@ func (s *Spinner) Next() string {
 	return frame
 }
 
-// Spin displays the spinner with a message
+// Spin displays the spinner with a message, replacing the current line
 func (s *Spinner) Spin(message string) {
-	fmt.Printf("\r%s %s", s.Next(), message)
+	fmt.Fprintf(s.out, "\r\033[K%s %s", styles.SpinnerStyle.Render(s.Next()), message)
 }
 
 // Stop clears the spinner line
 func (s *Spinner) Stop() {
-	fmt.Print("\r\033[K") // Clear the line
+	fmt.Fprint(s.out, "\r\033[K") // Clear the line
+}
+
+// isTerminal reports whether w is an interactive terminal
+func isTerminal(w io.Writer) bool {
+	file, ok := w.(*os.File)
+	if !ok {
+		return false
+	}
+	info, err := file.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// terminalWidth returns the columns of the terminal w writes to, or 0 when w
+// is not a terminal
+func terminalWidth(w io.Writer) int {
+	file, ok := w.(*os.File)
+	if !ok || !isTerminal(w) {
+		return 0
+	}
+	width, _, err := term.GetSize(file.Fd())
+	if err != nil {
+		return 0
+	}
+	return width
+}
+
+// terminalHeight returns the rows of the terminal w writes to, or 0 when w
+// is not a terminal
+func terminalHeight(w io.Writer) int {
+	file, ok := w.(*os.File)
+	if !ok || !isTerminal(w) {
+		return 0
+	}
+	_, height, err := term.GetSize(file.Fd())
+	if err != nil {
+		return 0
+	}
+	return height
+}
+
+// startWaiting animates a spinner on out with the time spent waiting for the
+// model's first token, if enabled. The returned function clears it and writes
+// prompt in its place; it may be called more than once.
+func startWaiting(out io.Writer, model, prompt string, enabled bool) func() {
+	if !enabled {
+		return func() {}
+	}
+
+	spinner := NewSpinner(out)
+	start := time.Now()
+	done := make(chan struct{})
+	finished := make(chan struct{})
+	go func() {
+		defer close(finished)
+		ticker := time.NewTicker(progressInterval)
+		defer ticker.Stop()
+		for {
+			elapsed := time.Since(start).Truncate(time.Second)
+			spinner.Spin(styles.MutedStyle.Render(fmt.Sprintf("Waiting for %s (prompt eval…) %s", model, elapsed)))
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			close(done)
+			<-finished
+			spinner.Stop()
+			fmt.Fprint(out, prompt)
+		})
+	}
 }
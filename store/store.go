@@ -0,0 +1,389 @@
+// Package store keeps a searchable history of conversations with the model in
+// a SQLite database: the prompts and responses, the tool calls they made and
+// the patches that were applied.
+package store
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	_ "modernc.org/sqlite"
+)
+
+// schema creates the tables on first use
+const schema = `
+CREATE TABLE IF NOT EXISTS conversations (
+	id      INTEGER PRIMARY KEY,
+	name    TEXT NOT NULL DEFAULT '',
+	title   TEXT NOT NULL DEFAULT '',
+	command TEXT NOT NULL,
+	model   TEXT NOT NULL,
+	repo    TEXT NOT NULL DEFAULT '',
+	created TEXT NOT NULL,
+	updated TEXT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS conversations_name ON conversations(name);
+CREATE TABLE IF NOT EXISTS messages (
+	id              INTEGER PRIMARY KEY,
+	conversation_id INTEGER NOT NULL,
+	role            TEXT NOT NULL,
+	content         TEXT NOT NULL,
+	created         TEXT NOT NULL
+);
+CREATE TABLE IF NOT EXISTS tool_calls (
+	id              INTEGER PRIMARY KEY,
+	conversation_id INTEGER NOT NULL,
+	tool            TEXT NOT NULL,
+	args            TEXT NOT NULL,
+	output          TEXT NOT NULL,
+	success         INTEGER NOT NULL,
+	created         TEXT NOT NULL
+);
+CREATE TABLE IF NOT EXISTS patches (
+	id              INTEGER PRIMARY KEY,
+	conversation_id INTEGER NOT NULL,
+	diff            TEXT NOT NULL,
+	files           TEXT NOT NULL,
+	created         TEXT NOT NULL
+);
+CREATE VIRTUAL TABLE IF NOT EXISTS messages_fts USING fts5(content, conversation_id UNINDEXED, message_id UNINDEXED);
+`
+
+// Store is an open history database
+type Store struct {
+	db *sql.DB
+}
+
+// Conversation is a recorded exchange with the model. List leaves out the
+// messages, tool calls and patches; Get fills them in.
+type Conversation struct {
+	ID      int64
+	Name    string // Session name, or "" for a single run
+	Title   string // Short description of what the conversation is about, if named
+	Command string
+	Model   string
+	Repo    string
+	Created time.Time
+	Updated time.Time
+
+	Messages  []Message
+	ToolCalls []ToolCall
+	Patches   []Patch
+}
+
+// Message is a prompt or response in a conversation
+type Message struct {
+	Role    string // "user" or "assistant"
+	Content string
+	Created time.Time
+}
+
+// ToolCall is a tool the model ran and its result
+type ToolCall struct {
+	Tool    string
+	Args    string
+	Output  string
+	Success bool
+	Created time.Time
+}
+
+// Patch is a diff applied to the repository
+type Patch struct {
+	Diff    string
+	Files   []string
+	Created time.Time
+}
+
+// Hit is a message that matched a search
+type Hit struct {
+	ConversationID int64
+	Name           string
+	Role           string
+	Snippet        string // Matching text with the terms in [brackets]
+	Created        time.Time
+}
+
+// Open opens the database at path, creating it and its directory if needed
+func Open(path string) (*Store, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, fmt.Errorf("error creating history directory: %v", err)
+	}
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		return nil, fmt.Errorf("error opening history: %v", err)
+	}
+	// Commands and the serve API write from several goroutines; one connection
+	// serializes them instead of failing with "database is locked"
+	db.SetMaxOpenConns(1)
+	if _, err := db.Exec("PRAGMA busy_timeout = 5000"); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("error opening history: %v", err)
+	}
+	if _, err := db.Exec(schema); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("error creating history tables: %v", err)
+	}
+	if err := addTitleColumn(db); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &Store{db: db}, nil
+}
+
+// addTitleColumn adds the title column to databases created before conversations had titles
+func addTitleColumn(db *sql.DB) error {
+	var count int
+	if err := db.QueryRow("SELECT COUNT(*) FROM pragma_table_info('conversations') WHERE name = 'title'").Scan(&count); err != nil {
+		return fmt.Errorf("error reading history tables: %v", err)
+	}
+	if count > 0 {
+		return nil
+	}
+	if _, err := db.Exec("ALTER TABLE conversations ADD COLUMN title TEXT NOT NULL DEFAULT ''"); err != nil {
+		return fmt.Errorf("error adding conversation titles: %v", err)
+	}
+	return nil
+}
+
+// Close closes the database
+func (s *Store) Close() error {
+	return s.db.Close()
+}
+
+// StartConversation returns the conversation to record a run in. Runs with a
+// session name continue the latest conversation of that name; other runs
+// start a new one.
+func (s *Store) StartConversation(name, command, model, repo string) (int64, error) {
+	now := formatTime(time.Now())
+	if name != "" {
+		var id int64
+		err := s.db.QueryRow("SELECT id FROM conversations WHERE name = ? ORDER BY id DESC LIMIT 1", name).Scan(&id)
+		if err == nil {
+			_, err = s.db.Exec("UPDATE conversations SET model = ?, updated = ? WHERE id = ?", model, now, id)
+			return id, err
+		}
+		if err != sql.ErrNoRows {
+			return 0, fmt.Errorf("error finding conversation %s: %v", name, err)
+		}
+	}
+
+	result, err := s.db.Exec("INSERT INTO conversations (name, command, model, repo, created, updated) VALUES (?, ?, ?, ?, ?, ?)",
+		name, command, model, repo, now, now)
+	if err != nil {
+		return 0, fmt.Errorf("error recording conversation: %v", err)
+	}
+	return result.LastInsertId()
+}
+
+// SetTitle names a conversation that has no title yet; a title is kept once set
+func (s *Store) SetTitle(conversationID int64, title string) error {
+	if _, err := s.db.Exec("UPDATE conversations SET title = ? WHERE id = ? AND title = ''", title, conversationID); err != nil {
+		return fmt.Errorf("error naming conversation: %v", err)
+	}
+	return nil
+}
+
+// AddMessage records a prompt or response and makes it searchable
+func (s *Store) AddMessage(conversationID int64, role, content string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec("INSERT INTO messages (conversation_id, role, content, created) VALUES (?, ?, ?, ?)",
+		conversationID, role, content, formatTime(time.Now()))
+	if err != nil {
+		return fmt.Errorf("error recording message: %v", err)
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec("INSERT INTO messages_fts (content, conversation_id, message_id) VALUES (?, ?, ?)", content, conversationID, id); err != nil {
+		return fmt.Errorf("error indexing message: %v", err)
+	}
+	return tx.Commit()
+}
+
+// AddToolCall records a tool call and its output
+func (s *Store) AddToolCall(conversationID int64, call ToolCall) error {
+	_, err := s.db.Exec("INSERT INTO tool_calls (conversation_id, tool, args, output, success, created) VALUES (?, ?, ?, ?, ?, ?)",
+		conversationID, call.Tool, call.Args, call.Output, call.Success, formatTime(time.Now()))
+	if err != nil {
+		return fmt.Errorf("error recording tool call: %v", err)
+	}
+	return nil
+}
+
+// AddPatch records a diff that was applied to the repository
+func (s *Store) AddPatch(conversationID int64, patch Patch) error {
+	_, err := s.db.Exec("INSERT INTO patches (conversation_id, diff, files, created) VALUES (?, ?, ?, ?)",
+		conversationID, patch.Diff, strings.Join(patch.Files, "\n"), formatTime(time.Now()))
+	if err != nil {
+		return fmt.Errorf("error recording patch: %v", err)
+	}
+	return nil
+}
+
+// List returns up to limit conversations, most recently updated first
+func (s *Store) List(limit int) ([]Conversation, error) {
+	rows, err := s.db.Query("SELECT id, name, title, command, model, repo, created, updated FROM conversations ORDER BY updated DESC, id DESC LIMIT ?", limit)
+	if err != nil {
+		return nil, fmt.Errorf("error listing conversations: %v", err)
+	}
+	defer rows.Close()
+
+	var conversations []Conversation
+	for rows.Next() {
+		var c Conversation
+		var created, updated string
+		if err := rows.Scan(&c.ID, &c.Name, &c.Title, &c.Command, &c.Model, &c.Repo, &created, &updated); err != nil {
+			return nil, err
+		}
+		c.Created, c.Updated = parseTime(created), parseTime(updated)
+		conversations = append(conversations, c)
+	}
+	return conversations, rows.Err()
+}
+
+// Get returns a conversation with its messages, tool calls and patches
+func (s *Store) Get(id int64) (*Conversation, error) {
+	c := &Conversation{ID: id}
+	var created, updated string
+	err := s.db.QueryRow("SELECT name, title, command, model, repo, created, updated FROM conversations WHERE id = ?", id).
+		Scan(&c.Name, &c.Title, &c.Command, &c.Model, &c.Repo, &created, &updated)
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("conversation %d not found", id)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading conversation %d: %v", id, err)
+	}
+	c.Created, c.Updated = parseTime(created), parseTime(updated)
+
+	rows, err := s.db.Query("SELECT role, content, created FROM messages WHERE conversation_id = ? ORDER BY id", id)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var m Message
+		if err := rows.Scan(&m.Role, &m.Content, &created); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		m.Created = parseTime(created)
+		c.Messages = append(c.Messages, m)
+	}
+	rows.Close()
+
+	rows, err = s.db.Query("SELECT tool, args, output, success, created FROM tool_calls WHERE conversation_id = ? ORDER BY id", id)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var t ToolCall
+		if err := rows.Scan(&t.Tool, &t.Args, &t.Output, &t.Success, &created); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		t.Created = parseTime(created)
+		c.ToolCalls = append(c.ToolCalls, t)
+	}
+	rows.Close()
+
+	rows, err = s.db.Query("SELECT diff, files, created FROM patches WHERE conversation_id = ? ORDER BY id", id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var p Patch
+		var files string
+		if err := rows.Scan(&p.Diff, &files, &created); err != nil {
+			return nil, err
+		}
+		p.Files = strings.Fields(files)
+		p.Created = parseTime(created)
+		c.Patches = append(c.Patches, p)
+	}
+	return c, rows.Err()
+}
+
+// Delete removes a conversation and everything recorded in it
+func (s *Store) Delete(id int64) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec("DELETE FROM conversations WHERE id = ?", id)
+	if err != nil {
+		return fmt.Errorf("error deleting conversation %d: %v", id, err)
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return fmt.Errorf("conversation %d not found", id)
+	}
+	for _, table := range []string{"messages", "tool_calls", "patches", "messages_fts"} {
+		if _, err := tx.Exec("DELETE FROM "+table+" WHERE conversation_id = ?", id); err != nil {
+			return fmt.Errorf("error deleting conversation %d: %v", id, err)
+		}
+	}
+	return tx.Commit()
+}
+
+// Search finds up to limit messages containing all words of query, best
+// matches first
+func (s *Store) Search(query string, limit int) ([]Hit, error) {
+	// Quote each word so punctuation in the query is not read as FTS syntax
+	var terms []string
+	for _, word := range strings.Fields(query) {
+		terms = append(terms, `"`+strings.ReplaceAll(word, `"`, `""`)+`"`)
+	}
+	if len(terms) == 0 {
+		return nil, fmt.Errorf("empty search")
+	}
+
+	rows, err := s.db.Query(`
+		SELECT c.id, c.name, m.role, snippet(messages_fts, 0, '[', ']', '...', 16), m.created
+		FROM messages_fts
+		JOIN messages m ON m.id = messages_fts.message_id
+		JOIN conversations c ON c.id = m.conversation_id
+		WHERE messages_fts MATCH ?
+		ORDER BY rank
+		LIMIT ?`, strings.Join(terms, " "), limit)
+	if err != nil {
+		return nil, fmt.Errorf("error searching history: %v", err)
+	}
+	defer rows.Close()
+
+	var hits []Hit
+	for rows.Next() {
+		var h Hit
+		var created string
+		if err := rows.Scan(&h.ConversationID, &h.Name, &h.Role, &h.Snippet, &created); err != nil {
+			return nil, err
+		}
+		h.Created = parseTime(created)
+		hits = append(hits, h)
+	}
+	return hits, rows.Err()
+}
+
+// timeLayout has a fixed width, so stored times sort as text
+const timeLayout = "2006-01-02T15:04:05.000000000Z"
+
+// formatTime stores times as sortable UTC text
+func formatTime(t time.Time) string {
+	return t.UTC().Format(timeLayout)
+}
+
+// parseTime reads a time stored by formatTime
+func parseTime(s string) time.Time {
+	t, _ := time.Parse(timeLayout, s)
+	return t
+}
@@ -0,0 +1,49 @@
+package styles
+
+import (
+	"os"
+	"runtime"
+	"strings"
+
+	"github.com/charmbracelet/lipgloss"
+	"github.com/muesli/termenv"
+)
+
+// ColorLimit returns the most colors a terminal supports according to its TERM
+// value, for terminals that claim more than they have, such as dumb terminals
+// with COLORTERM inherited from a parent. A colorTerm of truecolor or 24bit
+// lifts the limit of generic types like xterm and screen.
+func ColorLimit(term, colorTerm string) termenv.Profile {
+	if term == "" && runtime.GOOS == "windows" {
+		return termenv.TrueColor
+	}
+	truecolor := colorTerm == "truecolor" || colorTerm == "24bit"
+	switch {
+	case term == "" || term == "dumb" || strings.HasSuffix(term, "-mono") || strings.HasSuffix(term, "-m") ||
+		strings.HasPrefix(term, "vt1") || strings.HasPrefix(term, "vt2"):
+		return termenv.Ascii
+	case strings.HasSuffix(term, "-8color") || strings.HasSuffix(term, "-16color"):
+		return termenv.ANSI
+	case truecolor:
+		return termenv.TrueColor
+	case strings.HasSuffix(term, "-256color"):
+		return termenv.ANSI256
+	}
+	switch term {
+	case "linux", "xterm", "screen", "tmux", "ansi", "cygwin", "rxvt", "vt100":
+		return termenv.ANSI
+	}
+	return termenv.TrueColor
+}
+
+// DetectColor sets the color profile styles are rendered with: the one
+// detected for standard output, reduced to what TERM allows, and returns it
+func DetectColor() termenv.Profile {
+	profile := lipgloss.ColorProfile()
+	// Profiles are ordered from the most colors to none
+	if limit := ColorLimit(os.Getenv("TERM"), strings.ToLower(os.Getenv("COLORTERM"))); limit > profile {
+		profile = limit
+	}
+	lipgloss.SetColorProfile(profile)
+	return profile
+}
@@ -0,0 +1,59 @@
+package styles
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Rendering is how model responses are laid out, in batch output and in the
+// REPL alike
+type Rendering struct {
+	Width  string `toml:"width"`  // Columns to wrap to: "auto" for the terminal's width, "off", or a number
+	Indent int    `toml:"indent"` // Spaces before each line of a response
+}
+
+// rendering is the layout set by SetRendering
+var rendering = Rendering{Width: "auto"}
+
+// SetRendering sets how responses are laid out, after checking the settings
+func SetRendering(r Rendering) error {
+	r.Width = strings.ToLower(strings.TrimSpace(r.Width))
+	switch r.Width {
+	case "":
+		r.Width = "auto"
+	case "auto", "off":
+	default:
+		if columns, err := strconv.Atoi(r.Width); err != nil || columns < 20 {
+			return fmt.Errorf("invalid wrap width %q (use auto, off or a number of columns from 20)", r.Width)
+		}
+	}
+	if r.Indent < 0 || r.Indent > 16 {
+		return fmt.Errorf("invalid indent %d (use 0 to 16 spaces)", r.Indent)
+	}
+	rendering = r
+	return nil
+}
+
+// WrapWidth returns the columns responses are wrapped to on a terminal of the
+// given width, which is 0 when the output is not a terminal, without the
+// indent. It returns 0 when responses are not wrapped.
+func WrapWidth(terminal int) int {
+	width := terminal
+	switch rendering.Width {
+	case "off":
+		return 0
+	case "auto":
+	default:
+		width, _ = strconv.Atoi(rendering.Width)
+	}
+	if width == 0 {
+		return 0
+	}
+	return max(width-rendering.Indent, 10)
+}
+
+// Indent returns the spaces put before each line of a response
+func Indent() string {
+	return strings.Repeat(" ", rendering.Indent)
+}
@@ -1,98 +1,235 @@
 package styles
 
 import (
+	"fmt"
+	"sort"
+	"strings"
+
 	"github.com/charmbracelet/lipgloss"
+	"github.com/muesli/termenv"
 )
 
+// Theme is the color palette the styles are built from
+type Theme struct {
+	Primary    lipgloss.TerminalColor
+	Secondary  lipgloss.TerminalColor
+	Accent     lipgloss.TerminalColor
+	Success    lipgloss.TerminalColor
+	Warning    lipgloss.TerminalColor
+	Error      lipgloss.TerminalColor
+	Info       lipgloss.TerminalColor
+	Muted      lipgloss.TerminalColor
+	Text       lipgloss.TerminalColor // Model responses
+	SubtleText lipgloss.TerminalColor // Tool results
+}
+
+// color is a theme color with fallbacks for terminals with 256 and 16 colors,
+// so they get a palette chosen for them rather than the nearest match
+func color(trueColor, ansi256, ansi string) lipgloss.TerminalColor {
+	return lipgloss.CompleteColor{TrueColor: trueColor, ANSI256: ansi256, ANSI: ansi}
+}
+
+// Themes lists the built-in themes by name
+var Themes = map[string]Theme{
+	"dark": {
+		Primary:    color("#7D56F4", "99", "5"),
+		Secondary:  color("#8B5CF6", "135", "5"),
+		Accent:     color("#A855F7", "141", "13"),
+		Success:    color("#10B981", "36", "2"),
+		Warning:    color("#F59E0B", "214", "3"),
+		Error:      color("#EF4444", "203", "1"),
+		Info:       color("#3B82F6", "69", "4"),
+		Muted:      color("#6B7280", "243", "8"),
+		Text:       color("#E5E7EB", "254", "7"),
+		SubtleText: color("#D1D5DB", "252", "7"),
+	},
+	"light": {
+		Primary:    color("#5B21B6", "55", "5"),
+		Secondary:  color("#6D28D9", "56", "5"),
+		Accent:     color("#7E22CE", "91", "5"),
+		Success:    color("#047857", "29", "2"),
+		Warning:    color("#B45309", "130", "3"),
+		Error:      color("#B91C1C", "124", "1"),
+		Info:       color("#1D4ED8", "26", "4"),
+		Muted:      color("#4B5563", "240", "8"),
+		Text:       color("#111827", "234", "0"),
+		SubtleText: color("#374151", "238", "0"),
+	},
+	"mono": {
+		Primary:    lipgloss.NoColor{},
+		Secondary:  lipgloss.NoColor{},
+		Accent:     lipgloss.NoColor{},
+		Success:    lipgloss.NoColor{},
+		Warning:    lipgloss.NoColor{},
+		Error:      lipgloss.NoColor{},
+		Info:       lipgloss.NoColor{},
+		Muted:      lipgloss.NoColor{},
+		Text:       lipgloss.NoColor{},
+		SubtleText: lipgloss.NoColor{},
+	},
+}
+
+// DefaultTheme is the name of the theme used unless another is configured
+const DefaultTheme = "dark"
+
 var (
 	// Colors
-	Primary   = lipgloss.Color("#7D56F4")
-	Secondary = lipgloss.Color("#8B5CF6")
-	Accent    = lipgloss.Color("#A855F7")
-	Success   = lipgloss.Color("#10B981")
-	Warning   = lipgloss.Color("#F59E0B")
-	ErrColor  = lipgloss.Color("#EF4444")
-	Info      = lipgloss.Color("#3B82F6")
-	Muted     = lipgloss.Color("#6B7280")
+	Primary   lipgloss.TerminalColor
+	Secondary lipgloss.TerminalColor
+	Accent    lipgloss.TerminalColor
+	Success   lipgloss.TerminalColor
+	Warning   lipgloss.TerminalColor
+	ErrColor  lipgloss.TerminalColor
+	Info      lipgloss.TerminalColor
+	Muted     lipgloss.TerminalColor
 
 	// Styles
+	TitleStyle      lipgloss.Style
+	HeaderStyle     lipgloss.Style
+	PromptStyle     lipgloss.Style
+	ResponseStyle   lipgloss.Style
+	InfoStyle       lipgloss.Style
+	SuccessStyle    lipgloss.Style
+	WarningStyle    lipgloss.Style
+	ErrorStyle      lipgloss.Style
+	MutedStyle      lipgloss.Style
+	SeparatorStyle  lipgloss.Style
+	ToolStyle       lipgloss.Style
+	ToolResultStyle lipgloss.Style
+	REPLPromptStyle lipgloss.Style
+	REPLInputStyle  lipgloss.Style
+	SpinnerStyle    lipgloss.Style
+	UserStyle       lipgloss.Style
+	AssistantStyle  lipgloss.Style
+	ReferenceStyle  lipgloss.Style // Repository files named in responses
+	MatchStyle      lipgloss.Style // Search matches in the pager
+)
+
+func init() {
+	applyTheme(Themes[DefaultTheme])
+}
+
+// SetTheme switches all styles to the named built-in theme
+func SetTheme(name string) error {
+	theme, ok := Themes[name]
+	if !ok {
+		return fmt.Errorf("unknown theme %q (available: %s)", name, strings.Join(ThemeNames(), ", "))
+	}
+	applyTheme(theme)
+	return nil
+}
+
+// DisableColor renders every style as plain text, without colors or text
+// attributes such as bold, for -no-color and NO_COLOR
+func DisableColor() {
+	lipgloss.SetColorProfile(termenv.Ascii)
+}
+
+// ThemeNames returns the names of the built-in themes in alphabetical order
+func ThemeNames() []string {
+	names := make([]string, 0, len(Themes))
+	for name := range Themes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// applyTheme rebuilds the colors and styles from a theme
+func applyTheme(theme Theme) {
+	Primary = theme.Primary
+	Secondary = theme.Secondary
+	Accent = theme.Accent
+	Success = theme.Success
+	Warning = theme.Warning
+	ErrColor = theme.Error
+	Info = theme.Info
+	Muted = theme.Muted
+
 	TitleStyle = lipgloss.NewStyle().
-			Foreground(Primary).
-			Bold(true).
-			MarginLeft(2).
-			MarginBottom(1)
+		Foreground(Primary).
+		Bold(true).
+		MarginLeft(2).
+		MarginBottom(1)
 
 	HeaderStyle = lipgloss.NewStyle().
-			Foreground(Secondary).
-			Bold(true).
-			MarginBottom(1)
+		Foreground(Secondary).
+		Bold(true).
+		MarginBottom(1)
 
 	PromptStyle = lipgloss.NewStyle().
-			Foreground(Accent).
-			Bold(true).
-			MarginLeft(2)
+		Foreground(Accent).
+		Bold(true).
+		MarginLeft(2)
 
 	ResponseStyle = lipgloss.NewStyle().
-			Foreground(lipgloss.Color("#E5E7EB")).
-			MarginLeft(2).
-			MarginTop(1).
-			MarginBottom(1)
+		Foreground(theme.Text).
+		MarginLeft(2).
+		MarginTop(1).
+		MarginBottom(1)
 
 	InfoStyle = lipgloss.NewStyle().
-			Foreground(Info).
-			MarginLeft(2)
+		Foreground(Info).
+		MarginLeft(2)
 
 	SuccessStyle = lipgloss.NewStyle().
-			Foreground(Success).
-			MarginLeft(2)
+		Foreground(Success).
+		MarginLeft(2)
 
 	WarningStyle = lipgloss.NewStyle().
-			Foreground(Warning).
-			MarginLeft(2)
+		Foreground(Warning).
+		MarginLeft(2)
 
 	ErrorStyle = lipgloss.NewStyle().
-			Foreground(ErrColor).
-			MarginLeft(2)
+		Foreground(ErrColor).
+		MarginLeft(2)
 
 	MutedStyle = lipgloss.NewStyle().
-			Foreground(Muted).
-			MarginLeft(2)
+		Foreground(Muted).
+		MarginLeft(2)
 
 	SeparatorStyle = lipgloss.NewStyle().
-			Foreground(Muted).
-			MarginLeft(2).
-			MarginTop(1).
-			MarginBottom(1)
+		Foreground(Muted).
+		MarginLeft(2).
+		MarginTop(1).
+		MarginBottom(1)
 
 	ToolStyle = lipgloss.NewStyle().
-			Foreground(Accent).
-			Bold(true).
-			MarginLeft(2)
+		Foreground(Accent).
+		Bold(true).
+		MarginLeft(2)
 
 	ToolResultStyle = lipgloss.NewStyle().
-			Foreground(lipgloss.Color("#D1D5DB")).
-			MarginLeft(4).
-			MarginTop(1)
+		Foreground(theme.SubtleText).
+		MarginLeft(4).
+		MarginTop(1)
 
 	REPLPromptStyle = lipgloss.NewStyle().
-			Foreground(Primary).
-			Bold(true)
+		Foreground(Primary).
+		Bold(true)
 
 	REPLInputStyle = lipgloss.NewStyle().
-			Foreground(Accent).
-			Border(lipgloss.RoundedBorder()).
-			BorderForeground(Primary).
-			Padding(0, 1)
+		Foreground(Accent).
+		Border(lipgloss.RoundedBorder()).
+		BorderForeground(Primary).
+		Padding(0, 1)
 
 	SpinnerStyle = lipgloss.NewStyle().
-			Foreground(Accent).
-			Bold(true)
+		Foreground(Accent).
+		Bold(true)
 
 	UserStyle = lipgloss.NewStyle().
-			Foreground(lipgloss.Color("#10B981")). // Green
-			Bold(true)
+		Foreground(Success).
+		Bold(true)
 
 	AssistantStyle = lipgloss.NewStyle().
-			Foreground(lipgloss.Color("#3B82F6")). // Blue
-			Italic(true)
-)
+		Foreground(Info).
+		Italic(true)
+
+	ReferenceStyle = lipgloss.NewStyle().
+		Foreground(Accent).
+		Underline(true)
+
+	MatchStyle = lipgloss.NewStyle().
+		Reverse(true)
+}
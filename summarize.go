@@ -0,0 +1,97 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/kek/slop-shop/ollama"
+	"github.com/kek/slop-shop/repo"
+	"github.com/kek/slop-shop/styles"
+)
+
+// summaryPrompt asks for the notes the map step keeps of each part of a repository
+const summaryPrompt = "Summarize these files of a repository for someone who will write an overview of the whole project. " +
+	"For each file give its purpose, the important types and functions, what it depends on and what calls into it. " +
+	"Keep file paths and names exact. Output only the summary."
+
+// mergePrompt asks the reduce step to combine summaries that are still too large
+const mergePrompt = "Combine these summaries of parts of a repository into one shorter summary. " +
+	"Keep file paths, type and function names, and how the parts depend on each other. Output only the summary."
+
+// condenseRepository returns the repository context when it fits in limit
+// bytes. Larger repositories are summarized with map-reduce: each chunk of
+// files is summarized separately, and the summaries are merged until they fit.
+func condenseRepository(client *ollama.Client, files []repo.FileInfo, limit int) (string, error) {
+	context := repo.CreateContext(files)
+	if len(context) <= limit {
+		return context, nil
+	}
+
+	chunks := chunkFiles(files, limit)
+	summaries := make([]string, 0, len(chunks))
+	for i, chunk := range chunks {
+		fmt.Fprintln(chatter(), styles.InfoStyle.Render(fmt.Sprintf("🗜️  Summarizing part %d/%d of the repository", i+1, len(chunks))))
+		summary, err := client.Generate(summaryPrompt, chunk, false, nil)
+		if err != nil {
+			return "", fmt.Errorf("error summarizing part %d: %v", i+1, err)
+		}
+		summaries = append(summaries, strings.TrimSpace(summary))
+	}
+
+	for {
+		combined := "Summaries of the repository:\n\n" + strings.Join(summaries, "\n\n")
+		if len(combined) <= limit || len(summaries) == 1 {
+			return combined, nil
+		}
+
+		groups := groupTexts(summaries, limit)
+		if len(groups) == len(summaries) {
+			// Each summary fills a group on its own, so merging cannot shrink them further
+			return combined[:limit], nil
+		}
+		merged := make([]string, 0, len(groups))
+		for i, group := range groups {
+			fmt.Fprintln(chatter(), styles.InfoStyle.Render(fmt.Sprintf("🗜️  Merging summaries %d/%d", i+1, len(groups))))
+			summary, err := client.Generate(mergePrompt, group, false, nil)
+			if err != nil {
+				return "", fmt.Errorf("error merging summaries: %v", err)
+			}
+			merged = append(merged, strings.TrimSpace(summary))
+		}
+		summaries = merged
+	}
+}
+
+// chunkFiles splits the repository context into chunks of at most limit bytes,
+// keeping files whole where possible and cutting files that exceed limit
+func chunkFiles(files []repo.FileInfo, limit int) []string {
+	var texts []string
+	for _, file := range files {
+		text := repo.CreateContext([]repo.FileInfo{file})
+		if len(text) > limit {
+			text = text[:limit]
+		}
+		texts = append(texts, text)
+	}
+	return groupTexts(texts, limit)
+}
+
+// groupTexts joins consecutive texts into groups of at most limit bytes
+func groupTexts(texts []string, limit int) []string {
+	var groups []string
+	var current strings.Builder
+	for _, text := range texts {
+		if current.Len() > 0 && current.Len()+len(text)+2 > limit {
+			groups = append(groups, current.String())
+			current.Reset()
+		}
+		if current.Len() > 0 {
+			current.WriteString("\n\n")
+		}
+		current.WriteString(text)
+	}
+	if current.Len() > 0 {
+		groups = append(groups, current.String())
+	}
+	return groups
+}
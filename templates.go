@@ -0,0 +1,183 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/template"
+
+	"github.com/kek/slop-shop/config"
+	"github.com/kek/slop-shop/styles"
+	"github.com/kek/slop-shop/tools"
+)
+
+// templateExt is the file extension of prompt templates
+const templateExt = ".tmpl"
+
+// builtinTemplates are available without any template files; a file with the
+// same name overrides them
+var builtinTemplates = map[string]string{
+	"commit-msg": "Write a git commit message for the following staged changes. Use a short summary line in the imperative mood, " +
+		"a blank line, and a body explaining what changed and why. Output only the commit message.\n\n{{.Staged}}",
+	"release-notes": "Write release notes for the changes since {{or (.Var \"since\") \"the last release\"}}. " +
+		"Group them into features, fixes and other changes, and leave out internal refactoring.\n\n{{.Log (or (.Var \"since\") \"HEAD~20\")}}",
+	"bug-triage": "Triage this bug report. Identify the likely cause in the repository, the files involved, " +
+		"a way to reproduce it and a suggested fix.\n\n{{.Input}}",
+}
+
+// templateData is the data prompt templates are executed with. Git output is
+// only collected when a template refers to it.
+type templateData struct {
+	repoPath string
+	vars     map[string]string
+	expand   bool // -expand was given, which lets templates call exec
+
+	Input    string // Positional arguments of the command
+	FileName string // Path given with -file
+	File     string // Contents of the file given with -file
+}
+
+// Diff returns the uncommitted changes in the repository
+func (d *templateData) Diff() (string, error) {
+	return gitOutput(d.repoPath, "diff", "HEAD")
+}
+
+// Staged returns the staged changes in the repository
+func (d *templateData) Staged() (string, error) {
+	return gitOutput(d.repoPath, "diff", "--cached")
+}
+
+// Log returns the one-line log of the commits after since
+func (d *templateData) Log(since string) (string, error) {
+	return gitOutput(d.repoPath, "log", "--oneline", since+"..HEAD")
+}
+
+// Branch returns the name of the current branch
+func (d *templateData) Branch() (string, error) {
+	branch, err := gitOutput(d.repoPath, "rev-parse", "--abbrev-ref", "HEAD")
+	return strings.TrimSpace(branch), err
+}
+
+// Var returns a variable set with -var name=value, or "" when it is not set
+func (d *templateData) Var(name string) string {
+	return d.vars[name]
+}
+
+// Exec runs a shell command in the repository and returns its output, followed
+// by its exit status when it fails, as {{exec "go vet ./..."}} in a template.
+// The command is subject to the tool policy and approvals of RUN_COMMAND.
+func (d *templateData) Exec(command string) (string, error) {
+	fmt.Fprintln(chatter(), styles.InfoStyle.Render("Running for the prompt: "+command))
+	output, code, err := tools.CommandOutput(command, d.repoPath)
+	if err != nil {
+		return "", err
+	}
+	output = strings.TrimRight(output, "\n")
+	if code != 0 {
+		output += fmt.Sprintf("\n(exit status %d)", code)
+	}
+	return output, nil
+}
+
+// varFlags collects repeated -var name=value flags
+type varFlags map[string]string
+
+func (v varFlags) String() string {
+	pairs := make([]string, 0, len(v))
+	for name, value := range v {
+		pairs = append(pairs, name+"="+value)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+func (v varFlags) Set(value string) error {
+	name, val, ok := strings.Cut(value, "=")
+	if !ok || name == "" {
+		return fmt.Errorf("expected name=value, got %q", value)
+	}
+	v[name] = val
+	return nil
+}
+
+// loadTemplate finds a template by name in the template directories, falling
+// back to the built-in templates. It also reports whether the template came
+// from the repository rather than from the user or slop-shop.
+func loadTemplate(name, repoPath string) (string, bool, error) {
+	for i, dir := range config.TemplateDirs(repoPath) {
+		data, err := os.ReadFile(filepath.Join(dir, name+templateExt))
+		if err == nil {
+			// The repository's directory is searched first
+			return string(data), i == 0, nil
+		}
+		if !os.IsNotExist(err) {
+			return "", false, fmt.Errorf("error reading template %s: %v", name, err)
+		}
+	}
+	if text, ok := builtinTemplates[name]; ok {
+		return text, false, nil
+	}
+	return "", false, fmt.Errorf("unknown template %q (available: %s)", name, strings.Join(templateNames(repoPath), ", "))
+}
+
+// templateNames lists the built-in templates and those in the template directories
+func templateNames(repoPath string) []string {
+	seen := make(map[string]bool)
+	for name := range builtinTemplates {
+		seen[name] = true
+	}
+	for _, dir := range config.TemplateDirs(repoPath) {
+		matches, _ := filepath.Glob(filepath.Join(dir, "*"+templateExt))
+		for _, match := range matches {
+			seen[strings.TrimSuffix(filepath.Base(match), templateExt)] = true
+		}
+	}
+
+	names := make([]string, 0, len(seen))
+	for name := range seen {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// renderTemplate loads the named template and executes it with data. A
+// template from the repository only runs commands once the repository is
+// trusted, as its plugins do, so cloning one cannot change what a built-in
+// template runs.
+func renderTemplate(name string, data *templateData) (string, error) {
+	text, fromRepo, err := loadTemplate(name, data.repoPath)
+	if err != nil {
+		return "", err
+	}
+	var refusal error
+	switch {
+	case !data.expand:
+		refusal = fmt.Errorf("exec only runs commands with -expand")
+	case fromRepo && !config.IsTrusted(data.repoPath):
+		refusal = fmt.Errorf("templates in %s only run commands once the repository is trusted; run `slop-shop trust` to allow them", filepath.Join(data.repoPath, ".slopshop", "templates"))
+	}
+	return executeTemplate(name, text, data, refusal)
+}
+
+// executeTemplate executes the text of a template with data. Besides the
+// fields and methods of data, templates can call exec, which fails with
+// refusal instead of running anything when it is set.
+func executeTemplate(name, text string, data *templateData, refusal error) (string, error) {
+	funcs := template.FuncMap{"exec": data.Exec}
+	if refusal != nil {
+		funcs["exec"] = func(string) (string, error) { return "", refusal }
+	}
+	tmpl, err := template.New(name).Funcs(funcs).Option("missingkey=error").Parse(text)
+	if err != nil {
+		return "", fmt.Errorf("error parsing template %s: %v", name, err)
+	}
+
+	var prompt strings.Builder
+	if err := tmpl.Execute(&prompt, data); err != nil {
+		return "", fmt.Errorf("error executing template %s: %v", name, err)
+	}
+	return strings.TrimSpace(prompt.String()), nil
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/kek/slop-shop/ollama"
+)
+
+// titlePrompt asks for a short name for a conversation
+const titlePrompt = "Write a title of at most six words that says what this conversation with a coding assistant is about, " +
+	"like \"Fix race in streaming channel\". Answer with only the title, without quotes or punctuation at the end.\n\n" +
+	"User: %s\n\nAssistant: %s"
+
+// maxTitleLength caps the length of a conversation title in bytes
+const maxTitleLength = 60
+
+// titleModel is the model that names sessions and history conversations, or ""
+// to leave them unnamed. setup sets it from -title-model, defaulting to -model.
+var titleModel string
+
+// nameConversation gives the conversation of a run a title, unless it already
+// has one or is neither a session nor recorded in the history. The title is
+// set on the record and, for a session, saved with it.
+func nameConversation(record *batchRecord, sess *session) {
+	if titleModel == "" || record.Response == "" {
+		return
+	}
+	if sess != nil && sess.Title != "" {
+		record.Title = sess.Title
+		return
+	}
+	if sess == nil && historyPath == "" {
+		return
+	}
+
+	record.Title = conversationTitle(record.URL, record.Prompt, record.Response)
+	if sess != nil {
+		sess.Title = record.Title
+	}
+}
+
+// conversationTitle asks the title model for a short title of a prompt and its
+// response. When the model fails the start of the prompt is used instead.
+func conversationTitle(url, prompt, response string) string {
+	// Only the start of the exchange is needed, which keeps the call cheap
+	client := ollama.NewClient(url, titleModel, 0.2, 0.9)
+	title, err := client.Generate(fmt.Sprintf(titlePrompt, truncateText(prompt, 500), truncateText(response, 1000)), "", false, nil)
+	if err == nil {
+		if title = cleanTitle(title); title != "" {
+			return title
+		}
+	}
+	return cleanTitle(prompt)
+}
+
+// cleanTitle reduces a model's answer, or a prompt, to a one-line title
+func cleanTitle(text string) string {
+	// Reasoning models may think out loud before answering
+	if end := strings.LastIndex(text, "</think>"); end >= 0 {
+		text = text[end+len("</think>"):]
+	}
+	for _, line := range strings.Split(text, "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			text = line
+			break
+		}
+	}
+	text = strings.Join(strings.Fields(text), " ")
+	text = strings.TrimPrefix(text, "Title:")
+	text = strings.Trim(text, " \"'`*#.")
+	if len(text) > maxTitleLength {
+		text = truncateText(text, maxTitleLength)
+		if space := strings.LastIndex(text, " "); space > maxTitleLength/2 {
+			text = text[:space]
+		}
+		text = strings.TrimRight(text, " ,;:") + "..."
+	}
+	return text
+}
+
+// truncateText cuts text to at most n bytes without splitting a character
+func truncateText(text string, n int) string {
+	if len(text) <= n {
+		return text
+	}
+	return strings.ToValidUTF8(text[:n], "")
+}
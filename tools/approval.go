@@ -0,0 +1,190 @@
+package tools
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Approval is the answer to a request to run a tool call
+type Approval int
+
+const (
+	Deny         Approval = iota // Do not run the call
+	AllowOnce                    // Run the call this time only
+	AllowSession                 // Run this call, and identical ones for the rest of the session
+	AllowTool                    // Run any call of this tool for the rest of the session
+	AllowAlways                  // Run this call, and identical ones in this and later sessions
+)
+
+// ApprovalRule lets tool calls in a repository run without asking: the calls
+// of Tool on the same Subject, or on any subject when it is empty
+type ApprovalRule struct {
+	Repo       string `json:"repo"`              // Absolute path of the repository
+	Tool       string `json:"tool"`              // Tool name, e.g. RUN_COMMAND
+	Subject    string `json:"subject,omitempty"` // Command line, or the paths a file tool writes
+	Persistent bool   `json:"-"`                 // Saved for later sessions
+}
+
+func (r ApprovalRule) String() string {
+	if r.Subject == "" {
+		return r.Tool + " (any)"
+	}
+	return r.Tool + " " + r.Subject
+}
+
+// Approver is asked before a tool call that runs commands or writes files
+// runs, unless an approval rule covers it. An error counts as Deny.
+type Approver func(call ToolCall, subject string) (Approval, error)
+
+var (
+	approver      Approver
+	approvalsMu   sync.Mutex
+	sessionRules  []ApprovalRule
+	savedRules    []ApprovalRule
+	approvalsPath string // File the persistent rules are saved in, if any
+)
+
+// SetApprover sets the function asked before tool calls that run commands or
+// write files; nil runs them without asking
+func SetApprover(a Approver) {
+	approver = a
+}
+
+// LoadApprovals reads the persistent approval rules from path, which is where
+// rules approved with AllowAlways are saved. A missing file has no rules.
+func LoadApprovals(path string) error {
+	approvalsMu.Lock()
+	defer approvalsMu.Unlock()
+	approvalsPath, savedRules, sessionRules = path, nil, nil
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("error reading approvals: %v", err)
+	}
+	if err := json.Unmarshal(data, &savedRules); err != nil {
+		return fmt.Errorf("error parsing %s: %v", path, err)
+	}
+	for i := range savedRules {
+		savedRules[i].Persistent = true
+	}
+	return nil
+}
+
+// Approvals returns the approval rules in effect: the saved ones, then those
+// of this session
+func Approvals() []ApprovalRule {
+	approvalsMu.Lock()
+	defer approvalsMu.Unlock()
+	return append(slices.Clone(savedRules), sessionRules...)
+}
+
+// RevokeApproval removes an approval rule, saving the remaining persistent
+// rules if it was one of them, so matching calls are asked about again
+func RevokeApproval(rule ApprovalRule) error {
+	approvalsMu.Lock()
+	defer approvalsMu.Unlock()
+	if !rule.Persistent {
+		sessionRules = slices.DeleteFunc(sessionRules, func(r ApprovalRule) bool { return r == rule })
+		return nil
+	}
+	savedRules = slices.DeleteFunc(savedRules, func(r ApprovalRule) bool { return r == rule })
+	return saveApprovals()
+}
+
+// saveApprovals writes the persistent rules to the approvals file
+func saveApprovals() error {
+	if approvalsPath == "" {
+		return fmt.Errorf("no approvals file to save to")
+	}
+	data, err := json.MarshalIndent(savedRules, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(approvalsPath), 0755); err != nil {
+		return fmt.Errorf("error creating %s: %v", filepath.Dir(approvalsPath), err)
+	}
+	if err := writeFileAtomic(approvalsPath, append(data, '\n'), 0600); err != nil {
+		return fmt.Errorf("error saving approvals: %v", err)
+	}
+	return nil
+}
+
+// needsApproval reports whether a tool runs commands or writes files. Reading
+// tools, and GENERATE_DIFF, which only asks the model, never need approval.
+func needsApproval(name string) bool {
+	return !isReadOnly(name) && name != "GENERATE_DIFF"
+}
+
+// approvalSubject is what an approval of a call covers: the files an
+// APPLY_DIFF changes, and otherwise the arguments, such as a command line or
+// the path CREATE_FILE writes
+func approvalSubject(call ToolCall) string {
+	if call.Name != "APPLY_DIFF" {
+		return strings.TrimSpace(call.Args)
+	}
+	changes, err := parseDiff(call.Body)
+	if err != nil {
+		return ""
+	}
+	var paths []string
+	for _, change := range changes {
+		paths = append(paths, change.FilePath)
+	}
+	sort.Strings(paths)
+	return strings.Join(slices.Compact(paths), ", ")
+}
+
+// approve returns nil if call may run in repoPath: it needs no approval, a
+// rule covers it, or the approver allows it. The approver's decision is
+// remembered as a rule when it covers more than this call.
+func approve(call ToolCall, repoPath string) error {
+	if approver == nil || !needsApproval(call.Name) {
+		return nil
+	}
+	repoPath, _ = filepath.Abs(repoPath)
+	subject := approvalSubject(call)
+
+	approvalsMu.Lock()
+	for _, rule := range append(slices.Clone(savedRules), sessionRules...) {
+		if rule.Repo == repoPath && rule.Tool == call.Name && (rule.Subject == "" || rule.Subject == subject) {
+			approvalsMu.Unlock()
+			return nil
+		}
+	}
+	approvalsMu.Unlock()
+
+	decision, err := approver(call, subject)
+	if err != nil {
+		return err
+	}
+
+	approvalsMu.Lock()
+	defer approvalsMu.Unlock()
+	rule := ApprovalRule{Repo: repoPath, Tool: call.Name, Subject: subject}
+	switch decision {
+	case Deny:
+		return fmt.Errorf("%s was not approved", call.Name)
+	case AllowSession:
+		sessionRules = append(sessionRules, rule)
+	case AllowTool:
+		rule.Subject = ""
+		sessionRules = append(sessionRules, rule)
+	case AllowAlways:
+		rule.Persistent = true
+		savedRules = append(savedRules, rule)
+		if err := saveApprovals(); err != nil {
+			// The call was approved; it is only asked about again next session
+			fmt.Fprintf(progressOutput(), "⚠️  %v\n", err)
+		}
+	}
+	return nil
+}
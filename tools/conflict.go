@@ -0,0 +1,82 @@
+package tools
+
+import (
+	"fmt"
+	"strings"
+)
+
+// HunkConflict describes a hunk that does not match the file it is applied to
+type HunkConflict struct {
+	File     string   // Path as given in the diff
+	Hunk     string   // The hunk as it appears in the diff
+	Line     int      // Line the hunk was expected at, from 1
+	Expected []string // Lines the hunk expected to find there
+	Actual   []string // Lines the file has there
+	Intended []string // Lines the hunk would have written
+}
+
+// HunkResolution is the decision made for a conflicting hunk
+type HunkResolution struct {
+	Skip  bool     // Leave the file unchanged at this place
+	Lines []string // Otherwise, lines that replace the actual lines
+}
+
+// ConflictResolver decides what to do with a hunk that does not apply. An error
+// aborts the whole diff, leaving the repository unchanged.
+type ConflictResolver func(conflict HunkConflict) (HunkResolution, error)
+
+// conflictResolver is asked about hunks that fail to apply, if set
+var conflictResolver ConflictResolver
+
+// SetConflictResolver sets the function asked about hunks that do not apply
+// when a diff is applied; nil makes such hunks fail the diff
+func SetConflictResolver(resolver ConflictResolver) {
+	conflictResolver = resolver
+}
+
+// resolveHunk asks the resolver what to do with a hunk that failed to apply to
+// lines and returns the resulting lines
+func resolveHunk(resolve ConflictResolver, file string, lines []string, hunk DiffHunk) ([]string, error) {
+	conflict := HunkConflict{File: file, Hunk: formatHunk(hunk)}
+	for _, line := range hunk.Lines {
+		if line.Type != "+" {
+			conflict.Expected = append(conflict.Expected, line.Content)
+		}
+		if line.Type != "-" {
+			conflict.Intended = append(conflict.Intended, line.Content)
+		}
+	}
+
+	// The actual lines are those at the hunk's position, as many as it expected
+	start := min(max(hunk.OldStart-1, 0), len(lines))
+	if hunk.OldCount == 0 {
+		start = min(hunk.OldStart, len(lines))
+	}
+	end := min(start+len(conflict.Expected), len(lines))
+	conflict.Line = start + 1
+	conflict.Actual = append([]string{}, lines[start:end]...)
+
+	resolution, err := resolve(conflict)
+	if err != nil {
+		return nil, err
+	}
+	if resolution.Skip {
+		return lines, nil
+	}
+
+	result := make([]string, 0, len(lines)-len(conflict.Actual)+len(resolution.Lines))
+	result = append(result, lines[:start]...)
+	result = append(result, resolution.Lines...)
+	result = append(result, lines[end:]...)
+	return result, nil
+}
+
+// formatHunk writes a hunk back in unified diff form
+func formatHunk(hunk DiffHunk) string {
+	var buf strings.Builder
+	fmt.Fprintf(&buf, "@@ -%d,%d +%d,%d @@\n", hunk.OldStart, hunk.OldCount, hunk.NewStart, hunk.NewCount)
+	for _, line := range hunk.Lines {
+		buf.WriteString(line.Type + line.Content + "\n")
+	}
+	return buf.String()
+}
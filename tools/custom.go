@@ -0,0 +1,175 @@
+package tools
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"text/template"
+)
+
+// CustomTool is a user-defined tool declared in the configuration file
+type CustomTool struct {
+	Name        string          `toml:"name"`
+	Description string          `toml:"description"`
+	Args        []CustomToolArg `toml:"args"`
+	Command     string          `toml:"command"` // Shell template, e.g. "make deploy-preview BRANCH={{.branch}}"
+
+	// Run replaces the command template for tools provided by plugins. It
+	// receives the unquoted argument values and the repository path.
+	Run func(args map[string]string, repoPath string) (string, error) `toml:"-"`
+}
+
+// CustomToolArg describes a single positional argument of a custom tool
+type CustomToolArg struct {
+	Name        string `toml:"name"`
+	Description string `toml:"description"`
+	Required    bool   `toml:"required"`
+	Default     string `toml:"default"`
+}
+
+// customTools holds the registered custom tools by name
+var customTools = map[string]CustomTool{}
+
+// toolNamePattern matches valid tool directive names
+var toolNamePattern = regexp.MustCompile(`^[A-Z][A-Z0-9_]*$`)
+
+// RegisterCustomTools validates and registers user-defined tools so they are
+// recognized in LLM responses. It replaces any previously registered custom tools.
+func RegisterCustomTools(defined []CustomTool) error {
+	registered := make(map[string]CustomTool, len(defined))
+	for _, tool := range defined {
+		if err := validateCustomTool(tool); err != nil {
+			return err
+		}
+		if _, exists := registered[tool.Name]; exists {
+			return fmt.Errorf("custom tool %s is defined more than once", tool.Name)
+		}
+		registered[tool.Name] = tool
+	}
+
+	customTools = registered
+	return nil
+}
+
+// validateCustomTool checks that a custom tool has a usable name, arguments and command template
+func validateCustomTool(tool CustomTool) error {
+	if !toolNamePattern.MatchString(tool.Name) {
+		return fmt.Errorf("invalid custom tool name %q: use upper-case letters, digits and underscores", tool.Name)
+	}
+	for _, builtin := range toolNames {
+		if tool.Name == builtin {
+			return fmt.Errorf("custom tool %s conflicts with a built-in tool", tool.Name)
+		}
+	}
+	for _, arg := range tool.Args {
+		if arg.Name == "" {
+			return fmt.Errorf("custom tool %s has an argument without a name", tool.Name)
+		}
+	}
+	if tool.Run != nil {
+		return nil
+	}
+	if strings.TrimSpace(tool.Command) == "" {
+		return fmt.Errorf("custom tool %s has no command", tool.Name)
+	}
+	if _, err := template.New(tool.Name).Option("missingkey=error").Parse(tool.Command); err != nil {
+		return fmt.Errorf("custom tool %s has an invalid command template: %v", tool.Name, err)
+	}
+	return nil
+}
+
+// CustomToolInstructions describes the registered custom tools for the model
+func CustomToolInstructions() string {
+	if len(customTools) == 0 {
+		return ""
+	}
+
+	names := make([]string, 0, len(customTools))
+	for name := range customTools {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var buf strings.Builder
+	buf.WriteString("PROJECT-SPECIFIC TOOLS:\n")
+	for _, name := range names {
+		tool := customTools[name]
+		argNames := make([]string, 0, len(tool.Args))
+		for _, arg := range tool.Args {
+			argNames = append(argNames, "<"+arg.Name+">")
+		}
+
+		buf.WriteString(fmt.Sprintf("- %s: %s\n", tool.Name, tool.Description))
+		buf.WriteString(fmt.Sprintf("  Format: %s: %s\n", tool.Name, strings.Join(argNames, " ")))
+		for _, arg := range tool.Args {
+			requirement := "optional"
+			if arg.Required {
+				requirement = "required"
+			}
+			buf.WriteString(fmt.Sprintf("  %s (%s): %s\n", arg.Name, requirement, arg.Description))
+		}
+	}
+
+	return buf.String()
+}
+
+// customArgs maps the directive arguments of a custom tool to its argument names.
+// Arguments are positional and separated by whitespace; the last one takes the rest
+// of the line.
+func customArgs(tool CustomTool, args string) (map[string]string, error) {
+	values := make(map[string]string, len(tool.Args))
+	fields := strings.Fields(args)
+
+	for i, arg := range tool.Args {
+		value := arg.Default
+		if i < len(fields) {
+			value = fields[i]
+			if i == len(tool.Args)-1 {
+				value = strings.Join(fields[i:], " ")
+			}
+		}
+		if value == "" && arg.Required {
+			return nil, fmt.Errorf("missing required argument %q for %s", arg.Name, tool.Name)
+		}
+		values[arg.Name] = value
+	}
+
+	if len(tool.Args) == 0 && len(fields) > 0 {
+		return nil, fmt.Errorf("%s does not take arguments", tool.Name)
+	}
+	return values, nil
+}
+
+// renderCustomCommand fills a custom tool's command template from the directive arguments.
+// Every value is quoted for the active shell so it cannot inject extra commands.
+func renderCustomCommand(tool CustomTool, args string) (string, error) {
+	values, err := customArgs(tool, args)
+	if err != nil {
+		return "", err
+	}
+	for name, value := range values {
+		if values[name], err = quoteArg(value); err != nil {
+			return "", err
+		}
+	}
+
+	tmpl, err := template.New(tool.Name).Option("missingkey=error").Parse(tool.Command)
+	if err != nil {
+		return "", err
+	}
+
+	var command strings.Builder
+	if err := tmpl.Execute(&command, values); err != nil {
+		return "", err
+	}
+	return command.String(), nil
+}
+
+// shellQuote quotes a value for safe use as a single POSIX shell word
+func shellQuote(value string) string {
+	if value == "" {
+		return "''"
+	}
+	return "'" + strings.ReplaceAll(value, "'", `'\''`) + "'"
+}
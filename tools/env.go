@@ -0,0 +1,88 @@
+package tools
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+// EnvConfig controls which environment variables tool commands can see
+type EnvConfig struct {
+	Allow   []string `toml:"allow"`   // Extra variable names to pass through; "*" wildcards are allowed, e.g. "NPM_*"
+	Inherit bool     `toml:"inherit"` // Pass the full environment, including credentials, to every command
+}
+
+// defaultEnvAllowlist is the minimal environment commands need to locate
+// programs, use the user's locale and run common toolchains
+var defaultEnvAllowlist = []string{
+	"PATH", "HOME", "USER", "LOGNAME", "SHELL", "TERM", "LANG", "LC_*", "TZ",
+	"TMPDIR", "TMP", "TEMP", "XDG_CONFIG_HOME", "XDG_CACHE_HOME", "XDG_DATA_HOME",
+	"HTTP_PROXY", "HTTPS_PROXY", "NO_PROXY", "http_proxy", "https_proxy", "no_proxy",
+	"SSL_CERT_FILE", "SSL_CERT_DIR",
+	"GOPATH", "GOROOT", "GOCACHE", "GOMODCACHE", "GOFLAGS", "GOPROXY", "GOPRIVATE",
+	"GONOPROXY", "GONOSUMDB", "GOSUMDB", "GOTOOLCHAIN", "CGO_ENABLED",
+	// Windows needs these to start processes and find user directories
+	"SystemRoot", "SystemDrive", "WINDIR", "ComSpec", "PATHEXT", "USERPROFILE",
+	"APPDATA", "LOCALAPPDATA", "ProgramData", "ProgramFiles", "ProgramFiles(x86)",
+	"HOMEDRIVE", "HOMEPATH", "USERNAME",
+}
+
+var (
+	// envAllowlist holds the variable name patterns passed to commands
+	envAllowlist = append([]string(nil), defaultEnvAllowlist...)
+
+	// inheritEnv passes the full parent environment when set
+	inheritEnv bool
+)
+
+// SetEnvConfig sets the variables passed to commands to the defaults and
+// env.Allow, and whether the full environment is passed instead
+func SetEnvConfig(env EnvConfig) {
+	envAllowlist = append(append([]string(nil), defaultEnvAllowlist...), env.Allow...)
+	inheritEnv = env.Inherit
+}
+
+// commandEnv returns the environment for tool commands: the parent environment
+// filtered down to the allowlisted variables, unless inheritance is enabled,
+// with the temporary directory moved to the session's scratch directory
+func commandEnv() []string {
+	scratch := scratchEnv()
+	overridden := make(map[string]bool, len(scratch))
+	for _, entry := range scratch {
+		name, _, _ := strings.Cut(entry, "=")
+		overridden[name] = true
+	}
+
+	env := make([]string, 0, len(envAllowlist)+len(scratch))
+	for _, entry := range os.Environ() {
+		name, _, found := strings.Cut(entry, "=")
+		if overridden[name] {
+			continue
+		}
+		if inheritEnv || (found && name != "" && envAllowed(name)) {
+			env = append(env, entry)
+		}
+	}
+	return append(env, scratch...)
+}
+
+// CommandEnv returns the environment tool commands run with, for other
+// programs started on the model's behalf, such as plugins
+func CommandEnv() []string {
+	return commandEnv()
+}
+
+// envAllowed reports whether a variable name matches the allowlist. Names are
+// case-insensitive on Windows, as they are in its environment.
+func envAllowed(name string) bool {
+	for _, pattern := range envAllowlist {
+		if runtime.GOOS == "windows" {
+			name, pattern = strings.ToUpper(name), strings.ToUpper(pattern)
+		}
+		if matched, _ := filepath.Match(pattern, name); matched {
+			return true
+		}
+	}
+	return false
+}
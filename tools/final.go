@@ -0,0 +1,81 @@
+package tools
+
+import (
+	"strings"
+)
+
+// FinalAnswer is the outcome a model reports with a FINAL_ANSWER directive
+// once it has finished a task, so a run ends with something a program can
+// read rather than trailing prose
+type FinalAnswer struct {
+	Summary      string   `json:"summary"`
+	ChangedFiles []string `json:"changed_files,omitempty"`
+}
+
+// finalDirectives start a final answer; TASK_COMPLETE is accepted because
+// models trained on other agents use it
+var finalDirectives = []string{"FINAL_ANSWER:", "TASK_COMPLETE:"}
+
+// ParseFinalAnswer returns the last final answer in a response: the summary
+// on the FINAL_ANSWER line, continued on the lines up to a blank one, and the
+// files listed on a CHANGED_FILES line after it. Directives inside code fences
+// are ignored.
+func ParseFinalAnswer(response string) (FinalAnswer, bool) {
+	var answer FinalAnswer
+	found := false
+	inFence := false
+	inSummary := false
+
+	for _, line := range strings.Split(response, "\n") {
+		trimmed := strings.TrimSpace(line)
+		if strings.HasPrefix(trimmed, "```") {
+			inFence = !inFence
+			inSummary = false
+			continue
+		}
+		if inFence {
+			continue
+		}
+
+		if summary, ok := cutDirective(trimmed, finalDirectives...); ok {
+			answer, found, inSummary = FinalAnswer{Summary: summary}, true, true
+			continue
+		}
+		if files, ok := cutDirective(trimmed, "CHANGED_FILES:"); ok && found {
+			answer.ChangedFiles = changedFileList(files)
+			inSummary = false
+			continue
+		}
+		if inSummary {
+			if trimmed == "" {
+				inSummary = false
+				continue
+			}
+			answer.Summary = strings.TrimSpace(answer.Summary + "\n" + trimmed)
+		}
+	}
+	return answer, found
+}
+
+// cutDirective returns the text after the first of directives line starts with
+func cutDirective(line string, directives ...string) (string, bool) {
+	for _, directive := range directives {
+		if rest, ok := strings.CutPrefix(line, directive); ok {
+			return strings.TrimSpace(rest), true
+		}
+	}
+	return "", false
+}
+
+// changedFileList splits the comma-separated paths of a CHANGED_FILES line,
+// of which "none" is empty
+func changedFileList(list string) []string {
+	var files []string
+	for _, file := range strings.Split(list, ",") {
+		file = strings.Trim(strings.TrimSpace(file), "`")
+		if file != "" && !strings.EqualFold(file, "none") {
+			files = append(files, file)
+		}
+	}
+	return files
+}
@@ -0,0 +1,283 @@
+package tools
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/kek/slop-shop/debuglog"
+	"github.com/kek/slop-shop/ollama"
+)
+
+// shellBuiltins are the words a POSIX shell runs itself, without looking them up on PATH
+var shellBuiltins = map[string]bool{
+	".": true, ":": true, "[": true, "[[": true, "}": true,
+	"alias": true, "bg": true, "break": true, "cd": true, "command": true, "continue": true,
+	"declare": true, "echo": true, "eval": true, "exec": true, "exit": true, "export": true,
+	"false": true, "fg": true, "hash": true, "jobs": true, "kill": true, "let": true,
+	"local": true, "popd": true, "printf": true, "pushd": true, "pwd": true, "read": true,
+	"readonly": true, "return": true, "set": true, "shift": true, "source": true,
+	"test": true, "time": true, "trap": true, "true": true, "type": true, "ulimit": true,
+	"umask": true, "unalias": true, "unset": true, "wait": true,
+}
+
+// shellKeywords introduce or close a command rather than being one
+var shellKeywords = map[string]bool{
+	"if": true, "then": true, "else": true, "elif": true, "fi": true, "do": true, "done": true,
+	"while": true, "until": true, "esac": true, "{": true, "!": true,
+}
+
+// commandAlternatives are installed programs that often stand in for a missing one
+var commandAlternatives = map[string][]string{
+	"python":         {"python3"},
+	"pip":            {"pip3", "python3 -m pip"},
+	"docker-compose": {"docker compose"},
+	"vim":            {"vi"},
+	"ack":            {"rg", "grep -rn"},
+	"ag":             {"rg", "grep -rn"},
+}
+
+// maxSuggestions is the most similar paths a corrective message offers
+const maxSuggestions = 5
+
+// executeModelCall runs a tool call from the model's response, unless a
+// guardrail finds it cannot work, in which case the model is told why instead
+func executeModelCall(out io.Writer, index int, call ToolCall, repoPath string, client *ollama.Client) ToolResult {
+	if checkToolPolicy(call.Name) == nil {
+		if correction := checkCall(call, repoPath); correction != "" {
+			debuglog.Logf("tools", "%s %q rejected: %s", call.Name, call.Args, correction)
+			fmt.Fprintf(out, "↩️  [%d] %s not run: %s\n", index, call.Name, correction)
+			return ToolResult{Tool: call.Name, Args: call.Args, ExitCode: 1, Rejected: true,
+				Output: fmt.Sprintf("%s was not run: %s", call.Name, correction)}
+		}
+	}
+	return executeToolCall(out, index, call, repoPath, client)
+}
+
+// checkCall returns what is wrong with a call that refers to files that do
+// not exist or a program that is not installed, with a hint at how to correct
+// it, or "" when the call can run
+func checkCall(call ToolCall, repoPath string) string {
+	switch call.Name {
+	case "READ_FILE":
+		return checkPath(call.Name, strings.TrimSpace(call.Args), repoPath, "file", "SEARCH_FILES or LIST_DIR")
+	case "LIST_DIR":
+		return checkPath(call.Name, strings.TrimSpace(call.Args), repoPath, "directory", "LIST_DIR on its parent")
+	case "SEARCH_FILES", "CODE_SEARCH":
+		_, directory := parseSearchArgs(call.Args)
+		return checkPath(call.Name, directory, repoPath, "directory", "LIST_DIR")
+	case "APPLY_DIFF":
+		return checkDiff(call.Body, repoPath)
+	case "RUN_COMMAND":
+		return checkCommand(call.Args, repoPath)
+	}
+	return ""
+}
+
+// checkPath reports a path that does not exist, suggesting files of the same name
+func checkPath(tool, path, repoPath, kind, finder string) string {
+	if pathExists(resolvePath(path, repoPath)) {
+		return ""
+	}
+	message := fmt.Sprintf("the %s %s does not exist.", kind, path)
+	if similar := similarPaths(path, repoPath); len(similar) > 0 {
+		message += " Did you mean " + strings.Join(similar, ", ") + "?"
+	}
+	return message + fmt.Sprintf(" Use %s to find the right path and call %s again.", finder, tool)
+}
+
+// checkDiff reports the files a diff changes that do not exist. Diffs that do
+// not parse are left for APPLY_DIFF to report.
+func checkDiff(diff, repoPath string) string {
+	changes, err := parseDiff(diff)
+	if err != nil {
+		return ""
+	}
+	var missing []string
+	for _, change := range changes {
+		if change.IsNew {
+			continue
+		}
+		source := change.FilePath
+		if change.OldPath != "" {
+			source = change.OldPath
+		}
+		if !pathExists(resolvePath(source, repoPath)) {
+			missing = append(missing, source)
+		}
+	}
+	if len(missing) == 0 {
+		return ""
+	}
+
+	message := fmt.Sprintf("the diff changes %s, which does not exist.", strings.Join(missing, ", "))
+	if len(missing) > 1 {
+		message = fmt.Sprintf("the diff changes %s, which do not exist.", strings.Join(missing, ", "))
+	}
+	for _, path := range missing {
+		if similar := similarPaths(path, repoPath); len(similar) > 0 {
+			message += fmt.Sprintf(" Instead of %s, did you mean %s?", path, strings.Join(similar, ", "))
+		}
+	}
+	return message + " Read the file you want to change first, or use CREATE_FILE for a new file."
+}
+
+// checkCommand reports the programs a command runs that are neither shell
+// builtins nor found on PATH, and a path it starts with that is not in the
+// repository. Only POSIX shell commands are checked, and anything built at run
+// time, such as "$EDITOR", is trusted.
+func checkCommand(command, repoPath string) string {
+	if !isPOSIXShell() || strings.Contains(command, "<<") {
+		return ""
+	}
+
+	var missing []string
+	for i, segment := range commandSegments(command) {
+		program := segmentProgram(segment)
+		if program == "" || shellBuiltins[program] || strings.ContainsAny(program, "$`*?<>\\\"'") {
+			continue
+		}
+		if program == "for" || program == "case" || program == "select" || program == "function" {
+			// Their lists and patterns are not commands; the rest is not checked
+			break
+		}
+		if strings.Contains(program, "/") {
+			// Earlier segments may build the program or change the directory
+			if i == 0 && !pathExists(resolvePath(program, repoPath)) {
+				missing = append(missing, program)
+			}
+		} else if _, err := exec.LookPath(program); err != nil && !slices.Contains(missing, program) {
+			missing = append(missing, program)
+		}
+	}
+	if len(missing) == 0 {
+		return ""
+	}
+
+	var message strings.Builder
+	for _, program := range missing {
+		if strings.Contains(program, "/") {
+			fmt.Fprintf(&message, "%s does not exist in the repository. ", program)
+			continue
+		}
+		fmt.Fprintf(&message, "%s is not installed or not on PATH. ", program)
+		for _, alternative := range commandAlternatives[program] {
+			if _, err := exec.LookPath(strings.Fields(alternative)[0]); err == nil {
+				fmt.Fprintf(&message, "Use %s instead. ", alternative)
+				break
+			}
+		}
+	}
+	message.WriteString("Run the command with programs that are available.")
+	return message.String()
+}
+
+// commandSegments splits a shell command into the simple commands it runs:
+// at unquoted ;, &, |, parentheses and newlines, but not at the & of a
+// redirection such as 2>&1
+func commandSegments(command string) []string {
+	var segments []string
+	var current strings.Builder
+	var quote rune
+	escaped := false
+	runes := []rune(command)
+	for i, r := range runes {
+		switch {
+		case escaped:
+			escaped = false
+		case r == '\\' && quote != '\'':
+			escaped = true
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			}
+		case r == '\'' || r == '"':
+			quote = r
+		case r == '&' && ((i > 0 && (runes[i-1] == '>' || runes[i-1] == '<')) || (i+1 < len(runes) && runes[i+1] == '>')):
+		case strings.ContainsRune(";&|()\n", r):
+			segments = append(segments, current.String())
+			current.Reset()
+			continue
+		}
+		current.WriteRune(r)
+	}
+	return append(segments, current.String())
+}
+
+// segmentProgram returns the program a simple command runs: its first word
+// after any variable assignments and keywords such as "then"
+func segmentProgram(segment string) string {
+	for _, word := range strings.Fields(segment) {
+		if shellKeywords[word] {
+			continue
+		}
+		if name, _, ok := strings.Cut(word, "="); ok && name != "" && !strings.ContainsAny(name, "/-.") {
+			continue
+		}
+		return word
+	}
+	return ""
+}
+
+// pathExists reports whether path exists as the tools see it, including the
+// changes held in the speculative overlay
+func pathExists(path string) bool {
+	if file, ok := overlay.lookup(path); ok {
+		return file.exists
+	}
+	if len(overlay.under(path)) > 0 {
+		return true
+	}
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+// similarPaths returns the repository files and directories with the same
+// name as path, ignoring case, closest to it first
+func similarPaths(path, repoPath string) []string {
+	name := strings.ToLower(filepath.Base(filepath.FromSlash(path)))
+	if name == "." || name == string(filepath.Separator) {
+		return nil
+	}
+
+	var found []string
+	filepath.WalkDir(repoPath, func(current string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		if entry.IsDir() && current != repoPath && (strings.HasPrefix(entry.Name(), ".") || entry.Name() == "node_modules") {
+			return filepath.SkipDir
+		}
+		if strings.ToLower(entry.Name()) == name {
+			if rel, err := filepath.Rel(repoPath, current); err == nil {
+				found = append(found, filepath.ToSlash(rel))
+			}
+		}
+		return nil
+	})
+
+	// Paths sharing more leading directories with the one asked for come first
+	sort.SliceStable(found, func(a, b int) bool {
+		return sharedPrefix(found[a], path) > sharedPrefix(found[b], path)
+	})
+	if len(found) > maxSuggestions {
+		found = found[:maxSuggestions]
+	}
+	return found
+}
+
+// sharedPrefix counts the leading path elements a and b have in common
+func sharedPrefix(a, b string) int {
+	partsA, partsB := strings.Split(a, "/"), strings.Split(filepath.ToSlash(b), "/")
+	n := 0
+	for n < len(partsA) && n < len(partsB) && partsA[n] == partsB[n] {
+		n++
+	}
+	return n
+}
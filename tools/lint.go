@@ -0,0 +1,218 @@
+package tools
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Diagnostic is a single problem reported by a linter or formatter
+type Diagnostic struct {
+	File    string `json:"file"`
+	Line    int    `json:"line,omitempty"`
+	Column  int    `json:"column,omitempty"`
+	Message string `json:"message"`
+	Source  string `json:"source"` // Command that reported the problem
+}
+
+// String formats the diagnostic as file:line:column: message
+func (d Diagnostic) String() string {
+	if d.File == "" {
+		return fmt.Sprintf("%s [%s]", d.Message, d.Source)
+	}
+	location := d.File
+	if d.Line > 0 {
+		location += ":" + strconv.Itoa(d.Line)
+		if d.Column > 0 {
+			location += ":" + strconv.Itoa(d.Column)
+		}
+	}
+	return fmt.Sprintf("%s: %s [%s]", location, d.Message, d.Source)
+}
+
+// LintCommands lists the linter and formatter commands for a language
+type LintCommands struct {
+	Markers []string `toml:"markers"` // Files whose presence in the repository root selects this language
+	Lint    []string `toml:"lint"`
+	Format  []string `toml:"format"` // Formatters should rewrite files in place and print the files they changed
+}
+
+// lintCommands holds the commands per language, keyed by language name
+var lintCommands = map[string]LintCommands{
+	"go": {
+		Markers: []string{"go.mod"},
+		Lint:    []string{"go vet ./...", "golangci-lint run ./..."},
+		Format:  []string{"gofmt -l -w ."},
+	},
+	"python": {
+		Markers: []string{"pyproject.toml", "setup.py", "requirements.txt"},
+		Lint:    []string{"ruff check --output-format concise ."},
+		Format:  []string{"ruff format ."},
+	},
+	"javascript": {
+		Markers: []string{"package.json"},
+		Lint:    []string{"npx --no-install eslint --format unix ."},
+		Format:  []string{"npx --no-install prettier --list-different --write ."},
+	},
+}
+
+// SetLintCommands overrides or adds linter and formatter commands per language
+func SetLintCommands(commands map[string]LintCommands) {
+	for language, cmds := range commands {
+		existing := lintCommands[language]
+		if len(cmds.Markers) > 0 {
+			existing.Markers = cmds.Markers
+		}
+		if cmds.Lint != nil {
+			existing.Lint = cmds.Lint
+		}
+		if cmds.Format != nil {
+			existing.Format = cmds.Format
+		}
+		lintCommands[language] = existing
+	}
+}
+
+// diagnosticPattern matches "file:line[:column]: message" lines, optionally prefixed by "vet: "
+var diagnosticPattern = regexp.MustCompile(`^(?:vet: )?([^\s:][^:]*):(\d+)(?::(\d+))?:\s*(.+)$`)
+
+// parseDiagnostics extracts file:line:message entries from tool output. Lines
+// that name an existing file on their own (as formatters print) are reported
+// as reformatted files.
+func parseDiagnostics(output, source, repoPath string) []Diagnostic {
+	var diagnostics []Diagnostic
+	for _, line := range strings.Split(output, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		if match := diagnosticPattern.FindStringSubmatch(line); match != nil {
+			lineNum, _ := strconv.Atoi(match[2])
+			column, _ := strconv.Atoi(match[3])
+			diagnostics = append(diagnostics, Diagnostic{
+				File:    filepath.Clean(match[1]),
+				Line:    lineNum,
+				Column:  column,
+				Message: match[4],
+				Source:  source,
+			})
+			continue
+		}
+
+		if info, err := os.Stat(resolvePath(line, repoPath)); err == nil && !info.IsDir() {
+			diagnostics = append(diagnostics, Diagnostic{
+				File:    filepath.Clean(line),
+				Message: "reformatted",
+				Source:  source,
+			})
+		}
+	}
+	return diagnostics
+}
+
+// detectLanguages returns the configured languages whose marker files exist in repoPath
+func detectLanguages(repoPath string) []string {
+	var languages []string
+	for language, cmds := range lintCommands {
+		for _, marker := range cmds.Markers {
+			if _, err := os.Stat(filepath.Join(repoPath, marker)); err == nil {
+				languages = append(languages, language)
+				break
+			}
+		}
+	}
+	sort.Strings(languages)
+	return languages
+}
+
+// runLintTool runs the lint or format commands for the requested languages (or
+// the detected ones when args is empty) and collects their diagnostics
+func runLintTool(format bool, args, repoPath string) (string, []Diagnostic, error) {
+	languages := strings.Fields(args)
+	if len(languages) == 0 {
+		languages = detectLanguages(repoPath)
+	}
+	if len(languages) == 0 {
+		err := fmt.Errorf("no configured language detected in repository")
+		return "Error: " + err.Error(), nil, err
+	}
+
+	var report strings.Builder
+	var diagnostics []Diagnostic
+	ran, failures := 0, 0
+
+	for _, language := range languages {
+		cmds, ok := lintCommands[language]
+		if !ok {
+			err := fmt.Errorf("no lint configuration for language %q", language)
+			return "Error: " + err.Error(), nil, err
+		}
+
+		commands := cmds.Lint
+		if format {
+			commands = cmds.Format
+		}
+
+		for _, command := range commands {
+			fields := strings.Fields(command)
+			if len(fields) == 0 {
+				continue
+			}
+			if _, err := exec.LookPath(fields[0]); err != nil {
+				report.WriteString(fmt.Sprintf("Skipped %s: %s is not installed\n", command, fields[0]))
+				continue
+			}
+
+			cmd := shellCommand(command)
+			cmd.Dir = repoPath
+			output, runErr := runStreaming(cmd)
+			ran++
+
+			found := parseDiagnostics(output, fields[0], repoPath)
+			diagnostics = append(diagnostics, found...)
+
+			if runErr != nil && len(found) == 0 {
+				// The command failed without reporting anything we could parse
+				report.WriteString(fmt.Sprintf("%s failed: %v\n", command, runErr))
+				diagnostics = append(diagnostics, Diagnostic{Message: strings.TrimSpace(output), Source: fields[0]})
+				failures++
+			}
+		}
+	}
+
+	if ran == 0 {
+		err := fmt.Errorf("none of the configured commands are installed")
+		report.WriteString("Error: " + err.Error() + "\n")
+		return report.String(), nil, err
+	}
+
+	if len(diagnostics) == 0 {
+		if format {
+			report.WriteString("All files are formatted\n")
+		} else {
+			report.WriteString("No problems found\n")
+		}
+		return report.String(), nil, nil
+	}
+
+	if format {
+		report.WriteString(fmt.Sprintf("Formatting changes (%d):\n", len(diagnostics)))
+	} else {
+		report.WriteString(fmt.Sprintf("Diagnostics (%d):\n", len(diagnostics)))
+	}
+	for _, diagnostic := range diagnostics {
+		report.WriteString(diagnostic.String() + "\n")
+	}
+
+	// Reformatting is a successful outcome; lint problems are reported as a failure
+	if format && failures == 0 {
+		return report.String(), diagnostics, nil
+	}
+	return report.String(), diagnostics, fmt.Errorf("%d problems found", len(diagnostics))
+}
@@ -0,0 +1,134 @@
+package tools
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/kek/slop-shop/styles"
+)
+
+// ToolStats counts the runs of a single tool
+type ToolStats struct {
+	Tool      string        `json:"tool"`
+	Runs      int           `json:"runs"`
+	Succeeded int           `json:"succeeded"`
+	Failed    int           `json:"failed"`
+	Duration  time.Duration `json:"duration"`
+}
+
+// Summary aggregates the tool results of a run
+type Summary struct {
+	Tools         []ToolStats   `json:"tools"`
+	Runs          int           `json:"runs"`
+	Succeeded     int           `json:"succeeded"`
+	Failed        int           `json:"failed"`
+	Duration      time.Duration `json:"duration"` // Total time spent running tools
+	FilesModified []string      `json:"files_modified,omitempty"`
+	LinesAdded    int           `json:"lines_added"`
+	LinesRemoved  int           `json:"lines_removed"`
+}
+
+// recordChanges fills in the files and line counts changed by a successful
+// APPLY_DIFF or CREATE_FILE call
+func recordChanges(result *ToolResult, call ToolCall) {
+	if !result.Success {
+		return
+	}
+
+	switch call.Name {
+	case "APPLY_DIFF":
+		changes, err := parseDiff(call.Body)
+		if err != nil {
+			return
+		}
+		for _, change := range changes {
+			if change.OldPath != "" && change.IsRename {
+				result.FilesChanged = append(result.FilesChanged, change.OldPath)
+			}
+			result.FilesChanged = append(result.FilesChanged, change.FilePath)
+			for _, hunk := range change.Hunks {
+				for _, line := range hunk.Lines {
+					switch line.Type {
+					case "+":
+						result.LinesAdded++
+					case "-":
+						result.LinesRemoved++
+					}
+				}
+			}
+		}
+	case "CREATE_FILE":
+		result.FilesChanged = []string{call.Args}
+		result.LinesAdded = strings.Count(call.Body, "\n")
+		if call.Body != "" && !strings.HasSuffix(call.Body, "\n") {
+			result.LinesAdded++
+		}
+	}
+}
+
+// SummarizeResults counts tool runs, outcomes, time spent and files changed
+func SummarizeResults(results []ToolResult) Summary {
+	var summary Summary
+	stats := make(map[string]*ToolStats)
+	files := make(map[string]bool)
+
+	for _, result := range results {
+		s, ok := stats[result.Tool]
+		if !ok {
+			s = &ToolStats{Tool: result.Tool}
+			stats[result.Tool] = s
+		}
+
+		s.Runs++
+		s.Duration += result.Duration
+		summary.Runs++
+		summary.Duration += result.Duration
+		if result.Success {
+			s.Succeeded++
+			summary.Succeeded++
+		} else {
+			s.Failed++
+			summary.Failed++
+		}
+
+		for _, file := range result.FilesChanged {
+			if !files[file] {
+				files[file] = true
+				summary.FilesModified = append(summary.FilesModified, file)
+			}
+		}
+		summary.LinesAdded += result.LinesAdded
+		summary.LinesRemoved += result.LinesRemoved
+	}
+
+	for _, s := range stats {
+		summary.Tools = append(summary.Tools, *s)
+	}
+	sort.Slice(summary.Tools, func(i, j int) bool {
+		return summary.Tools[i].Tool < summary.Tools[j].Tool
+	})
+	sort.Strings(summary.FilesModified)
+
+	return summary
+}
+
+// String renders the summary as a table
+func (s Summary) String() string {
+	var buf strings.Builder
+	buf.WriteString(styles.HeaderStyle.Render("📊 Tool Summary") + "\n")
+	buf.WriteString(fmt.Sprintf("%-16s %5s %5s %5s %10s\n", "TOOL", "RUNS", "OK", "FAIL", "TIME"))
+	for _, tool := range s.Tools {
+		buf.WriteString(fmt.Sprintf("%-16s %5d %5d %5d %10s\n", tool.Tool, tool.Runs, tool.Succeeded, tool.Failed, tool.Duration.Round(time.Millisecond)))
+	}
+	buf.WriteString(fmt.Sprintf("%-16s %5d %5d %5d %10s\n", "TOTAL", s.Runs, s.Succeeded, s.Failed, s.Duration.Round(time.Millisecond)))
+
+	if len(s.FilesModified) > 0 {
+		buf.WriteString(fmt.Sprintf("\nFiles modified (%d): +%d -%d lines\n", len(s.FilesModified), s.LinesAdded, s.LinesRemoved))
+		for _, file := range s.FilesModified {
+			buf.WriteString("  " + file + "\n")
+		}
+	}
+	return buf.String()
+}
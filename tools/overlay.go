@@ -0,0 +1,383 @@
+package tools
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kek/slop-shop/repo"
+)
+
+// overlayState holds the changes of APPLY_DIFF and CREATE_FILE in memory
+// instead of writing them to the repository. READ_FILE, LIST_DIR and
+// SEARCH_FILES see the changed files; commands and code searches run in a
+// sandbox, a copy of the repository with the changes applied. Text files that
+// commands change in the sandbox become changes of the overlay too.
+type overlayState struct {
+	mu      sync.Mutex
+	files   map[string]*patchFile // Changed files by resolved path
+	order   []string              // Paths in the order they were first changed
+	sandbox string                // Copy of the repository, once a command ran
+	root    string                // Repository the sandbox was copied from
+	synced  map[string]patchFile  // State of each changed file in the sandbox
+	stamps  map[string]fileStamp  // Files in the sandbox after it was last brought up to date
+}
+
+// fileStamp tells whether a file in the sandbox changed without reading it
+type fileStamp struct {
+	size    int64
+	modTime time.Time
+	mode    fs.FileMode
+}
+
+// overlay is the speculative overlay, or nil when changes are written to disk
+var overlay *overlayState
+
+// SetOverlay turns the speculative overlay on or off. Either way the changes
+// held so far are dropped and the sandbox is removed.
+func SetOverlay(enabled bool) {
+	if overlay != nil && overlay.sandbox != "" {
+		os.RemoveAll(overlay.sandbox)
+	}
+	overlay = nil
+	if enabled {
+		overlay = &overlayState{files: make(map[string]*patchFile), synced: make(map[string]patchFile)}
+	}
+}
+
+// overlayKey is the absolute path the overlay keeps a file under
+func overlayKey(path string) string {
+	if abs, err := filepath.Abs(path); err == nil {
+		return abs
+	}
+	return filepath.Clean(path)
+}
+
+// lookup returns the state of path in the overlay, if the overlay changed it
+func (o *overlayState) lookup(path string) (patchFile, bool) {
+	if o == nil {
+		return patchFile{}, false
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	file, ok := o.files[overlayKey(path)]
+	if !ok {
+		return patchFile{}, false
+	}
+	return *file, true
+}
+
+// store records the new state of path
+func (o *overlayState) store(path string, file patchFile) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	path = overlayKey(path)
+	if _, ok := o.files[path]; !ok {
+		o.order = append(o.order, path)
+	}
+	o.files[path] = &file
+}
+
+// keep records the files a patch state changed
+func (o *overlayState) keep(state *patchState) {
+	for _, path := range state.order {
+		if file := *state.files[path]; file != state.original[path] {
+			o.store(path, file)
+		}
+	}
+}
+
+// readFile reads path as the tools see it: from the overlay when it changed
+// the file, otherwise from disk
+func (o *overlayState) readFile(path string) ([]byte, error) {
+	if file, ok := o.lookup(path); ok {
+		if !file.exists {
+			return nil, &fs.PathError{Op: "open", Path: path, Err: fs.ErrNotExist}
+		}
+		return []byte(file.content), nil
+	}
+	return os.ReadFile(path)
+}
+
+// under returns the changed files below dir, sorted
+func (o *overlayState) under(dir string) []string {
+	if o == nil {
+		return nil
+	}
+	dir = overlayKey(dir)
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	var paths []string
+	for _, path := range o.order {
+		if rel, err := filepath.Rel(dir, path); err == nil && filepath.IsLocal(rel) {
+			paths = append(paths, path)
+		}
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+// workDir returns the directory commands run in: the repository itself
+// without an overlay, otherwise the sandbox, brought up to date with the
+// changes in the overlay
+func (o *overlayState) workDir(repoPath string) (string, error) {
+	if o == nil {
+		return repoPath, nil
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	root, err := filepath.Abs(repoPath)
+	if err != nil {
+		return "", err
+	}
+	if o.sandbox != "" && o.root != root {
+		os.RemoveAll(o.sandbox)
+		o.sandbox, o.synced = "", make(map[string]patchFile)
+	}
+	if o.sandbox == "" {
+		dir, err := os.MkdirTemp("", "slop-shop-sandbox-*")
+		if err != nil {
+			return "", fmt.Errorf("failed to create the sandbox: %v", err)
+		}
+		if err := copyTree(root, dir); err != nil {
+			os.RemoveAll(dir)
+			return "", fmt.Errorf("failed to copy the repository to the sandbox: %v", err)
+		}
+		o.sandbox, o.root = dir, root
+	}
+
+	for _, path := range o.order {
+		file := *o.files[path]
+		if synced, ok := o.synced[path]; ok && synced == file {
+			continue
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil || !filepath.IsLocal(rel) {
+			continue
+		}
+		if err := writePatchFile(filepath.Join(o.sandbox, rel), &file); err != nil {
+			return "", fmt.Errorf("failed to update the sandbox: %v", err)
+		}
+		o.synced[path] = file
+	}
+	if o.stamps, err = stampTree(o.sandbox); err != nil {
+		return "", fmt.Errorf("failed to read the sandbox: %v", err)
+	}
+	return o.sandbox, nil
+}
+
+// settle brings the overlay up to date with the files a command changed in
+// the sandbox. Text files are kept as changes; binary files and files the
+// repository excludes, such as build outputs, are discarded. It returns a
+// note of both for the model, or "" when the command changed nothing.
+func (o *overlayState) settle() string {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.sandbox == "" {
+		return ""
+	}
+	after, err := stampTree(o.sandbox)
+	if err != nil {
+		return fmt.Sprintf("Files the command changed in the sandbox could not be read, so they were discarded: %v", err)
+	}
+
+	var changed []string
+	for rel, stamp := range after {
+		if before, ok := o.stamps[rel]; !ok || before != stamp {
+			changed = append(changed, rel)
+		}
+	}
+	for rel := range o.stamps {
+		if _, ok := after[rel]; !ok {
+			changed = append(changed, rel)
+		}
+	}
+	sort.Strings(changed)
+
+	var kept, discarded []string
+	for _, rel := range changed {
+		name := filepath.ToSlash(rel)
+		file := patchFile{perm: 0644}
+		if stamp, ok := after[rel]; ok {
+			data, err := os.ReadFile(filepath.Join(o.sandbox, rel))
+			if err != nil || !repo.IsTextFile(data) {
+				discarded = append(discarded, name)
+				continue
+			}
+			file = patchFile{exists: true, content: string(data), perm: stamp.mode.Perm()}
+		}
+		if repo.ShouldExclude(name, excludePatterns) {
+			discarded = append(discarded, name)
+			continue
+		}
+
+		path := filepath.Join(o.root, rel)
+		current, ok := o.files[path]
+		if !ok {
+			onDisk, err := newPatchState().file(path)
+			if err != nil {
+				discarded = append(discarded, name)
+				continue
+			}
+			current = onDisk
+		}
+		if *current == file {
+			continue
+		}
+		if _, ok := o.files[path]; !ok {
+			o.order = append(o.order, path)
+		}
+		o.files[path] = &file
+		o.synced[path] = file
+		kept = append(kept, name)
+	}
+	o.stamps = after
+
+	var note []string
+	if len(kept) > 0 {
+		note = append(note, "Kept the changes the command made to "+strings.Join(kept, ", ")+" with the other speculative changes.")
+	}
+	if len(discarded) > 0 {
+		note = append(note, "Discarded the changes the command made to "+strings.Join(discarded, ", ")+", which are binary or excluded files.")
+	}
+	return strings.Join(note, " ")
+}
+
+// stampTree returns the stamps of the regular files below dir by relative
+// path, leaving out .git
+func stampTree(dir string) (map[string]fileStamp, error) {
+	stamps := make(map[string]fileStamp)
+	err := filepath.WalkDir(dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if entry.IsDir() && entry.Name() == ".git" {
+			return filepath.SkipDir
+		}
+		if !entry.Type().IsRegular() {
+			return nil
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		stamps[rel] = fileStamp{size: info.Size(), modTime: info.ModTime(), mode: info.Mode()}
+		return nil
+	})
+	return stamps, err
+}
+
+// copyTree copies the files, directories and symbolic links below src to dst,
+// leaving out .git, which commands in the sandbox have no business changing
+func copyTree(src, dst string) error {
+	return filepath.WalkDir(src, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if entry.IsDir() && entry.Name() == ".git" {
+			return filepath.SkipDir
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+
+		switch {
+		case entry.IsDir():
+			return os.MkdirAll(target, info.Mode().Perm()|0700)
+		case entry.Type()&fs.ModeSymlink != 0:
+			link, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			return os.Symlink(link, target)
+		case entry.Type().IsRegular():
+			return copyFile(path, target, info.Mode().Perm())
+		}
+		return nil
+	})
+}
+
+// copyFile copies one regular file
+func copyFile(src, dst string, perm os.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// OverlayDiff returns the changes held in the overlay as a unified diff
+// against the files on disk, with paths relative to repoPath
+func OverlayDiff(repoPath string) string {
+	if overlay == nil {
+		return ""
+	}
+	repoPath = overlayKey(repoPath)
+	var diff strings.Builder
+	for _, path := range overlay.under(repoPath) {
+		file, _ := overlay.lookup(path)
+		old, _ := os.ReadFile(path)
+		rel, _ := filepath.Rel(repoPath, path)
+		rel = filepath.ToSlash(rel)
+		newText := ""
+		if file.exists {
+			newText = file.content
+		}
+		change := UnifiedDiff(rel, string(old), newText)
+		if !file.exists {
+			change = strings.Replace(change, "+++ b/"+rel+"\n", "+++ /dev/null\n", 1)
+		}
+		diff.WriteString(change)
+	}
+	return diff.String()
+}
+
+// FlushOverlay writes the changes held in the overlay to disk, all or
+// nothing, and empties the overlay
+func FlushOverlay() error {
+	if overlay == nil {
+		return nil
+	}
+	state := newPatchState()
+	overlay.mu.Lock()
+	order := append([]string(nil), overlay.order...)
+	overlay.mu.Unlock()
+	for _, path := range order {
+		file, err := state.file(path)
+		if err != nil {
+			return err
+		}
+		*file, _ = overlay.lookup(path)
+	}
+	if err := state.commit(); err != nil {
+		return fmt.Errorf("failed to write the changes, repository left unchanged: %v", err)
+	}
+	SetOverlay(true)
+	return nil
+}
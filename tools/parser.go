@@ -0,0 +1,248 @@
+package tools
+
+import (
+	"strings"
+)
+
+// ToolCall represents a single tool directive found in an LLM response
+type ToolCall struct {
+	Name string `json:"name"`           // Tool name, e.g. "READ_FILE"
+	Args string `json:"args,omitempty"` // Text following the directive on the same line
+	Body string `json:"body,omitempty"` // Block content for directives that take one (CREATE_FILE, APPLY_DIFF)
+	Line int    `json:"line"`           // 1-based line number of the directive in the response
+}
+
+// toolNames lists the directives recognized in LLM responses
+var toolNames = []string{
+	"RUN_COMMAND",
+	"SHELL",
+	"READ_FILE",
+	"LIST_DIR",
+	"TEST_COMMAND",
+	"SEARCH_FILES",
+	"CODE_SEARCH",
+	"FIND_SYMBOL",
+	"LINT",
+	"FORMAT",
+	"GENERATE_DIFF",
+	"APPLY_DIFF",
+	"CREATE_FILE",
+	"REMEMBER",
+}
+
+// ParseToolCalls scans a response line by line and extracts the tool calls in order.
+// Directives that take a block (CREATE_FILE, APPLY_DIFF) consume the lines of their
+// block, so text inside a created file or a diff is never mistaken for another tool.
+func ParseToolCalls(response string) []ToolCall {
+	var calls []ToolCall
+	lines := strings.Split(response, "\n")
+
+	for i := 0; i < len(lines); i++ {
+		line := strings.TrimSpace(lines[i])
+		name, args, ok := parseDirective(line)
+		if !ok {
+			continue
+		}
+
+		call := ToolCall{Name: name, Args: args, Line: i + 1}
+
+		switch name {
+		case "CREATE_FILE":
+			call.Body, i = collectFileBlock(lines, i)
+		case "APPLY_DIFF":
+			if args == "" || isDiffBlockStart(args) {
+				// The diff follows the directive as a fenced or BEGIN_DIFF/END_DIFF block
+				call.Body, i = collectDiffBlock(lines, i, args)
+			} else {
+				// Single-line form with escaped newlines
+				call.Body = strings.ReplaceAll(args, "\\n", "\n")
+			}
+			call.Args = ""
+		}
+
+		calls = append(calls, call)
+	}
+
+	return calls
+}
+
+// ExtractDiffs returns the unified diffs in a response: the bodies of APPLY_DIFF
+// directives and any ```diff or ```patch fenced blocks outside of them.
+func ExtractDiffs(response string) []string {
+	var diffs []string
+	lines := strings.Split(response, "\n")
+
+	for i := 0; i < len(lines); i++ {
+		line := strings.TrimSpace(lines[i])
+		if name, args, ok := parseDirective(line); ok && name == "APPLY_DIFF" {
+			var diff string
+			if args == "" || isDiffBlockStart(args) {
+				diff, i = collectDiffBlock(lines, i, args)
+			} else {
+				diff = strings.ReplaceAll(args, "\\n", "\n")
+			}
+			if strings.TrimSpace(diff) != "" {
+				diffs = append(diffs, diff)
+			}
+			continue
+		}
+		if line == "```diff" || line == "```patch" {
+			diff, end := collectDiffBlock(lines, i, line)
+			if strings.TrimSpace(diff) != "" {
+				diffs = append(diffs, diff)
+			}
+			i = end
+		}
+	}
+
+	return diffs
+}
+
+// parseDirective splits a "NAME: args" line into its tool name and arguments
+func parseDirective(line string) (name, args string, ok bool) {
+	for _, toolName := range toolNames {
+		if strings.HasPrefix(line, toolName+":") {
+			return toolName, strings.TrimSpace(strings.TrimPrefix(line, toolName+":")), true
+		}
+	}
+	if colon := strings.Index(line, ":"); colon > 0 {
+		if _, ok := customTools[line[:colon]]; ok {
+			return line[:colon], strings.TrimSpace(line[colon+1:]), true
+		}
+	}
+	return "", "", false
+}
+
+// collectFileBlock gathers the content following a CREATE_FILE directive at index start
+// up to the END_FILE marker (or the end of the response). A code fence wrapping the
+// whole content is removed. It returns the content and the index of the last line consumed.
+func collectFileBlock(lines []string, start int) (string, int) {
+	end := len(lines)
+	for i := start + 1; i < len(lines); i++ {
+		if strings.TrimSpace(lines[i]) == "END_FILE" {
+			end = i
+			break
+		}
+	}
+
+	content := lines[start+1 : end]
+	if len(content) >= 2 && strings.HasPrefix(strings.TrimSpace(content[0]), "```") &&
+		strings.TrimSpace(content[len(content)-1]) == "```" {
+		content = content[1 : len(content)-1]
+	}
+
+	last := end
+	if last >= len(lines) {
+		last = len(lines) - 1
+	}
+	return strings.Join(content, "\n"), last
+}
+
+// parseSearchArgs splits SEARCH_FILES arguments into a pattern and directory.
+// The pattern may be double-quoted to include spaces; the directory defaults to ".".
+func parseSearchArgs(args string) (pattern, directory string) {
+	args = strings.TrimSpace(args)
+	if strings.HasPrefix(args, "\"") {
+		if end := strings.Index(args[1:], "\""); end >= 0 {
+			pattern = args[1 : end+1]
+			directory = strings.TrimSpace(args[end+2:])
+		} else {
+			pattern = strings.TrimPrefix(args, "\"")
+		}
+	} else {
+		parts := strings.SplitN(args, " ", 2)
+		pattern = parts[0]
+		if len(parts) == 2 {
+			directory = strings.TrimSpace(parts[1])
+		}
+	}
+
+	if directory == "" {
+		directory = "."
+	}
+	return pattern, directory
+}
+
+// isDiffBlockStart reports whether line opens a multi-line diff block
+func isDiffBlockStart(line string) bool {
+	return line == "BEGIN_DIFF" || strings.HasPrefix(line, "```")
+}
+
+// collectDiffBlock gathers the diff that follows an APPLY_DIFF directive at index start.
+// opener is any block marker found on the directive line itself. The block is either
+// fenced with ``` or delimited by BEGIN_DIFF/END_DIFF; a bare diff runs until the first
+// blank line that is not followed by more diff content. It returns the diff and the
+// index of the last line consumed.
+func collectDiffBlock(lines []string, start int, opener string) (string, int) {
+	i := start + 1
+
+	// Find the opening marker if it wasn't on the directive line
+	if opener == "" {
+		for i < len(lines) && strings.TrimSpace(lines[i]) == "" {
+			i++
+		}
+		if i < len(lines) && isDiffBlockStart(strings.TrimSpace(lines[i])) {
+			opener = strings.TrimSpace(lines[i])
+			i++
+		}
+	}
+
+	closer := ""
+	switch {
+	case opener == "BEGIN_DIFF":
+		closer = "END_DIFF"
+	case strings.HasPrefix(opener, "```"):
+		closer = "```"
+	}
+
+	var diffLines []string
+	for ; i < len(lines); i++ {
+		trimmed := strings.TrimSpace(lines[i])
+		if closer != "" && trimmed == closer {
+			return dedentDiff(diffLines), i
+		}
+		if closer == "" && trimmed == "" && !continuesDiff(lines, i+1) {
+			return dedentDiff(diffLines), i
+		}
+		diffLines = append(diffLines, lines[i])
+	}
+
+	return dedentDiff(diffLines), len(lines) - 1
+}
+
+// dedentDiff strips indentation shared by a whole diff block, as models often
+// indent the block to match the surrounding text
+func dedentDiff(lines []string) string {
+	indent := ""
+	for _, line := range lines {
+		trimmed := strings.TrimLeft(line, " \t")
+		if trimmed == "" {
+			continue
+		}
+		if strings.HasPrefix(trimmed, "---") || strings.HasPrefix(trimmed, "diff --git") {
+			indent = line[:len(line)-len(trimmed)]
+		}
+		break
+	}
+
+	if indent != "" {
+		for i, line := range lines {
+			lines[i] = strings.TrimPrefix(line, indent)
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// continuesDiff reports whether the line at index i still looks like part of a diff
+func continuesDiff(lines []string, i int) bool {
+	if i >= len(lines) {
+		return false
+	}
+	line := lines[i]
+	for _, prefix := range []string{" ", "+", "-", "@@", "diff --git", "\\"} {
+		if strings.HasPrefix(line, prefix) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,139 @@
+package tools
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// patchFile is the state of one file while a diff is being applied
+type patchFile struct {
+	exists  bool
+	content string
+	perm    os.FileMode
+}
+
+// patchState tracks the files touched by a diff in memory so the whole diff can
+// be validated before anything is written, and written back all-or-nothing
+type patchState struct {
+	files    map[string]*patchFile // Planned state by resolved path
+	original map[string]patchFile  // State on disk before the diff
+	order    []string              // Paths in the order they were first touched
+	base     *overlayState         // Overlay read before the disk, if the diff goes into one
+}
+
+// newPatchState creates an empty patch state
+func newPatchState() *patchState {
+	return &patchState{
+		files:    make(map[string]*patchFile),
+		original: make(map[string]patchFile),
+	}
+}
+
+// file returns the planned state of path, reading it from the overlay or
+// from disk on first use
+func (s *patchState) file(path string) (*patchFile, error) {
+	if file, ok := s.files[path]; ok {
+		return file, nil
+	}
+
+	file := &patchFile{perm: 0644}
+	info, err := os.Stat(path)
+	changed, inOverlay := s.base.lookup(path)
+	switch {
+	case inOverlay:
+		*file = changed
+	case err == nil:
+		if info.IsDir() {
+			return nil, fmt.Errorf("%s is a directory", path)
+		}
+		content, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read file: %v", err)
+		}
+		file.exists = true
+		file.content = string(content)
+		file.perm = info.Mode().Perm()
+	case !os.IsNotExist(err):
+		return nil, fmt.Errorf("failed to read file: %v", err)
+	}
+
+	s.files[path] = file
+	s.original[path] = *file
+	s.order = append(s.order, path)
+	return file, nil
+}
+
+// commit writes every changed file. Each file is written to a temporary file
+// and renamed into place; if any step fails, files already written are restored.
+func (s *patchState) commit() error {
+	var written []string
+	for _, path := range s.order {
+		file, original := s.files[path], s.original[path]
+		if *file == original {
+			continue
+		}
+
+		if err := writePatchFile(path, file); err != nil {
+			if rollbackErr := s.rollback(written); rollbackErr != nil {
+				return fmt.Errorf("%v (rollback failed: %v)", err, rollbackErr)
+			}
+			return err
+		}
+		written = append(written, path)
+	}
+	return nil
+}
+
+// rollback restores the original state of the given paths
+func (s *patchState) rollback(paths []string) error {
+	var firstErr error
+	for i := len(paths) - 1; i >= 0; i-- {
+		original := s.original[paths[i]]
+		if err := writePatchFile(paths[i], &original); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// writePatchFile makes path match file, removing it if the file should not exist
+func writePatchFile(path string, file *patchFile) error {
+	if !file.exists {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to delete %s: %v", path, err)
+		}
+		return nil
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("failed to create directory: %v", err)
+	}
+	return writeFileAtomic(path, []byte(file.content), file.perm)
+}
+
+// writeFileAtomic writes data to a temporary file next to path and renames it
+// into place, so readers never see a partially written file
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".slop-*")
+	if err != nil {
+		return fmt.Errorf("failed to write %s: %v", path, err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write %s: %v", path, err)
+	}
+	if err := tmp.Chmod(perm); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to set file mode on %s: %v", path, err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write %s: %v", path, err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("failed to replace %s: %v", path, err)
+	}
+	return nil
+}
@@ -0,0 +1,119 @@
+package tools
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// toolContext stops running commands and skips the remaining tool calls when it is done
+var toolContext = context.Background()
+
+// SetContext sets the context whose cancellation kills the commands tools are
+// running and makes the remaining tool calls fail without running
+func SetContext(ctx context.Context) {
+	toolContext = ctx
+}
+
+// killDelay is how long a killed command's output is waited for, in case a
+// process it started keeps the output open
+const killDelay = time.Second
+
+// toolCommand is exec.Command for a process that is killed when the tool context is cancelled
+func toolCommand(name string, args ...string) *exec.Cmd {
+	cmd := exec.CommandContext(toolContext, name, args...)
+	cmd.WaitDelay = killDelay
+	return cmd
+}
+
+// commandShell is the shell used to run commands; empty selects the platform default
+var commandShell string
+
+// SetShell sets the shell used to run commands: sh, bash, zsh, cmd, powershell or pwsh.
+// An empty name selects the platform default.
+func SetShell(shell string) error {
+	switch shell {
+	case "", "sh", "bash", "zsh", "cmd", "powershell", "pwsh":
+		commandShell = shell
+		return nil
+	default:
+		return fmt.Errorf("unsupported shell %q (use sh, bash, zsh, cmd, powershell or pwsh)", shell)
+	}
+}
+
+// activeShell returns the configured shell or the default for the current platform
+func activeShell() string {
+	if commandShell != "" {
+		return commandShell
+	}
+	if runtime.GOOS == "windows" {
+		for _, candidate := range []string{"pwsh", "powershell"} {
+			if _, err := exec.LookPath(candidate); err == nil {
+				return candidate
+			}
+		}
+		return "cmd"
+	}
+	return "sh"
+}
+
+// isPOSIXShell reports whether the active shell understands POSIX sh syntax
+func isPOSIXShell() bool {
+	switch activeShell() {
+	case "cmd", "powershell", "pwsh":
+		return false
+	}
+	return true
+}
+
+// shellCommand builds a command that runs command through the active shell
+// with the scrubbed tool environment
+func shellCommand(command string) *exec.Cmd {
+	var cmd *exec.Cmd
+	switch shell := activeShell(); shell {
+	case "cmd":
+		cmd = toolCommand("cmd", "/C", command)
+		// /S makes cmd strip only the outer quotes and run the rest unchanged
+		setCommandLine(cmd, `cmd /S /C "`+command+`"`)
+	case "powershell", "pwsh":
+		cmd = toolCommand(shell, "-NoProfile", "-NonInteractive", "-Command", command)
+	default:
+		cmd = toolCommand(shell, "-c", command)
+	}
+	cmd.Env = commandEnv()
+	return cmd
+}
+
+// quoteArg quotes a value as a single argument for the active shell. cmd
+// expands %VAR% and, with delayed expansion, !VAR! even inside quotes, and a
+// line break ends its command; no quoting stops that, so such values are
+// rejected rather than passed on.
+func quoteArg(value string) (string, error) {
+	switch activeShell() {
+	case "cmd":
+		if strings.ContainsAny(value, "%!\r\n") {
+			return "", fmt.Errorf("%q cannot be passed to cmd safely, since it expands %% and ! and ends commands at line breaks; use powershell for such arguments", value)
+		}
+		return `"` + strings.ReplaceAll(value, `"`, `""`) + `"`, nil
+	case "powershell", "pwsh":
+		return "'" + strings.ReplaceAll(value, "'", "''") + "'", nil
+	default:
+		return shellQuote(value), nil
+	}
+}
+
+// resolvePath turns a path from a tool argument into a path on disk. The model
+// writes paths with forward slashes, so they are converted to the platform
+// separator; relative paths are resolved against the repository, and a
+// leading $SLOP_SHOP_SCRATCH against the scratch directory.
+func resolvePath(path, repoPath string) string {
+	path = filepath.FromSlash(expandScratch(path))
+	if filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(repoPath, path)
+}
@@ -0,0 +1,9 @@
+//go:build !windows
+
+package tools
+
+import "os/exec"
+
+// setCommandLine does nothing outside Windows, where programs get their
+// arguments as a list rather than one command line
+func setCommandLine(cmd *exec.Cmd, line string) {}
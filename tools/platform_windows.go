@@ -0,0 +1,13 @@
+package tools
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+// setCommandLine makes a command start with line as its command line, as is.
+// Go escapes arguments for programs that parse them like the C runtime, which
+// cmd does not, so its quotes would reach the command doubled.
+func setCommandLine(cmd *exec.Cmd, line string) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{CmdLine: line}
+}
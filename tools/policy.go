@@ -0,0 +1,105 @@
+package tools
+
+import (
+	"fmt"
+	"sort"
+)
+
+var (
+	// allowedTools restricts the tools that may run when non-empty
+	allowedTools map[string]bool
+
+	// deniedTools lists tools that never run
+	deniedTools map[string]bool
+
+	// commandsEnabled lets CommandOutput run commands, as -tools does
+	commandsEnabled bool
+)
+
+// SetToolPolicy limits the tools that may run. When allow is non-empty only
+// the listed tools run; tools in deny never run.
+func SetToolPolicy(allow, deny []string) {
+	allowedTools = toolSet(allow)
+	deniedTools = toolSet(deny)
+}
+
+// SetCommandsEnabled sets whether CommandOutput may run commands for a prompt,
+// which it only does when tools are enabled
+func SetCommandsEnabled(enabled bool) {
+	commandsEnabled = enabled
+}
+
+// toolSet builds a lookup set from tool names
+func toolSet(names []string) map[string]bool {
+	if len(names) == 0 {
+		return nil
+	}
+	set := make(map[string]bool, len(names))
+	for _, name := range names {
+		set[name] = true
+	}
+	return set
+}
+
+// checkToolPolicy returns an error if the tool policy does not permit name
+func checkToolPolicy(name string) error {
+	if deniedTools[name] || (allowedTools != nil && !allowedTools[name]) {
+		return fmt.Errorf("%s is disabled by the tool policy", name)
+	}
+	return nil
+}
+
+// toolDescriptions gives a one-line description of each built-in tool
+var toolDescriptions = map[string]string{
+	"RUN_COMMAND":   "Execute a shell command",
+	"SHELL":         "Run a command in a persistent shell session",
+	"READ_FILE":     "Read the contents of a file",
+	"LIST_DIR":      "List the contents of a directory",
+	"TEST_COMMAND":  "Test if a command works",
+	"SEARCH_FILES":  "List files containing a text pattern",
+	"CODE_SEARCH":   "Search file contents with a regular expression",
+	"FIND_SYMBOL":   "Find the definition and uses of a symbol",
+	"LINT":          "Run the project's linters",
+	"FORMAT":        "Run the project's formatters",
+	"GENERATE_DIFF": "Generate a unified diff with the model",
+	"APPLY_DIFF":    "Apply a unified diff to the repository",
+	"CREATE_FILE":   "Create a file with the given content",
+	"REMEMBER":      "Save a fact about the project to its memory notes",
+}
+
+// ToolInfo describes a tool available to the model
+type ToolInfo struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	Custom      bool   `json:"custom"`    // Declared in a configuration file
+	ReadOnly    bool   `json:"read_only"` // Never modifies the repository
+	Allowed     bool   `json:"allowed"`   // Permitted by the tool policy
+}
+
+// ListTools returns the built-in tools followed by the registered custom tools
+func ListTools() []ToolInfo {
+	var infos []ToolInfo
+	for _, name := range toolNames {
+		infos = append(infos, ToolInfo{
+			Name:        name,
+			Description: toolDescriptions[name],
+			ReadOnly:    isReadOnly(name),
+			Allowed:     checkToolPolicy(name) == nil,
+		})
+	}
+
+	custom := make([]string, 0, len(customTools))
+	for name := range customTools {
+		custom = append(custom, name)
+	}
+	sort.Strings(custom)
+	for _, name := range custom {
+		infos = append(infos, ToolInfo{
+			Name:        name,
+			Description: customTools[name].Description,
+			Custom:      true,
+			Allowed:     checkToolPolicy(name) == nil,
+		})
+	}
+	return infos
+}
@@ -0,0 +1,125 @@
+package tools
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+
+	"github.com/kek/slop-shop/debuglog"
+	"github.com/kek/slop-shop/repo"
+)
+
+// ScratchEnv is the variable that gives tool commands the session's scratch
+// directory. File tools accept paths that start with it, such as
+// $SLOP_SHOP_SCRATCH/build.log.
+const ScratchEnv = "SLOP_SHOP_SCRATCH"
+
+// scratch is the session's scratch directory, a temporary workspace for build
+// outputs, downloads and other files that do not belong in the repository.
+// It is created the first time a tool needs it.
+var scratch struct {
+	mu  sync.Mutex
+	dir string
+}
+
+// scratchDir returns the scratch directory, creating it on first use
+func scratchDir() (string, error) {
+	scratch.mu.Lock()
+	defer scratch.mu.Unlock()
+	if scratch.dir != "" {
+		return scratch.dir, nil
+	}
+	dir, err := os.MkdirTemp("", repo.ScratchPrefix+"*")
+	if err != nil {
+		return "", fmt.Errorf("failed to create the scratch directory: %v", err)
+	}
+	debuglog.Logf("tools", "scratch directory %s", dir)
+	scratch.dir = dir
+	return dir, nil
+}
+
+// scratchEnv returns the variables that point commands at the scratch
+// directory: ScratchEnv and the temporary directory variables, so temporary
+// files end up there too
+func scratchEnv() []string {
+	dir, err := scratchDir()
+	if err != nil {
+		debuglog.Logf("tools", "%v", err)
+		return nil
+	}
+	env := []string{ScratchEnv + "=" + dir, "TMPDIR=" + dir}
+	if runtime.GOOS == "windows" {
+		env = append(env, "TMP="+dir, "TEMP="+dir)
+	}
+	return env
+}
+
+// expandScratch replaces a leading $SLOP_SHOP_SCRATCH in a tool's path
+// argument with the scratch directory
+func expandScratch(path string) string {
+	for _, prefix := range []string{"$" + ScratchEnv, "${" + ScratchEnv + "}"} {
+		rest, ok := strings.CutPrefix(path, prefix)
+		if !ok || (rest != "" && rest[0] != '/' && rest[0] != '\\') {
+			continue
+		}
+		if dir, err := scratchDir(); err == nil {
+			return dir + rest
+		}
+	}
+	return path
+}
+
+// inScratch reports whether path is in the scratch directory
+func inScratch(path string) bool {
+	scratch.mu.Lock()
+	dir := scratch.dir
+	scratch.mu.Unlock()
+	if dir == "" {
+		return false
+	}
+	rel, err := filepath.Rel(dir, path)
+	return err == nil && filepath.IsLocal(rel)
+}
+
+// CloseScratch removes the scratch directory, unless keep is set, and
+// describes what it held; it returns "" when there was none or it was empty
+func CloseScratch(keep bool) (string, error) {
+	scratch.mu.Lock()
+	defer scratch.mu.Unlock()
+	if scratch.dir == "" {
+		return "", nil
+	}
+	dir := scratch.dir
+
+	files, size := 0, int64(0)
+	filepath.WalkDir(dir, func(path string, entry fs.DirEntry, err error) error {
+		if err == nil && !entry.IsDir() {
+			files++
+			if info, err := entry.Info(); err == nil {
+				size += info.Size()
+			}
+		}
+		return nil
+	})
+	if files == 0 && !keep {
+		scratch.dir = ""
+		return "", os.RemoveAll(dir)
+	}
+	held := fmt.Sprintf("%d files, %d bytes", files, size)
+	if files == 1 {
+		held = fmt.Sprintf("1 file, %d bytes", size)
+	}
+
+	if keep {
+		return fmt.Sprintf("Scratch directory kept at %s (%s)", dir, held), nil
+	}
+	scratch.dir = ""
+	if err := os.RemoveAll(dir); err != nil {
+		return "", fmt.Errorf("failed to remove the scratch directory %s: %v", dir, err)
+	}
+	return fmt.Sprintf("Removed the scratch directory %s (%s)", dir, held), nil
+}
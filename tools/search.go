@@ -0,0 +1,180 @@
+package tools
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// maxSearchMatches caps how many matching lines CODE_SEARCH reports
+const maxSearchMatches = 200
+
+// SearchMatch is a single line matching a CODE_SEARCH pattern
+type SearchMatch struct {
+	File string `json:"file"`
+	Line int    `json:"line"`
+	Text string `json:"text"`
+}
+
+// lookupRipgrep finds the rg executable; searches fall back to the built-in walker when it is missing
+var lookupRipgrep = func() (string, error) {
+	return exec.LookPath("rg")
+}
+
+// codeSearch finds lines matching a regular expression, using ripgrep when available
+func codeSearch(pattern, directory, repoPath string) (string, error) {
+	if pattern == "" {
+		err := fmt.Errorf("no search pattern given")
+		return "Error: " + err.Error(), err
+	}
+
+	var matches []SearchMatch
+	var err error
+	engine := "built-in search"
+	if rg, lookErr := lookupRipgrep(); lookErr == nil {
+		engine = "ripgrep"
+		matches, err = ripgrepSearch(rg, pattern, directory, repoPath)
+	} else {
+		matches, err = walkSearch(pattern, directory, repoPath)
+	}
+	if err != nil {
+		return fmt.Sprintf("Error searching code: %v", err), err
+	}
+
+	var buf strings.Builder
+	buf.WriteString(fmt.Sprintf("Matches for %q in %s (%d, %s):\n", pattern, directory, len(matches), engine))
+	for i, match := range matches {
+		if i == maxSearchMatches {
+			buf.WriteString(fmt.Sprintf("... and %d more\n", len(matches)-maxSearchMatches))
+			break
+		}
+		buf.WriteString(fmt.Sprintf("%s:%d: %s\n", match.File, match.Line, match.Text))
+	}
+	return buf.String(), nil
+}
+
+// ripgrepSearch runs rg with JSON output and parses the matches
+func ripgrepSearch(rg, pattern, directory, repoPath string) ([]SearchMatch, error) {
+	cmd := toolCommand(rg, "--json", "--regexp", pattern, "--", filepath.FromSlash(directory))
+	cmd.Dir = repoPath
+	cmd.Env = commandEnv()
+
+	output, err := cmd.Output()
+	if err != nil {
+		// rg exits with status 1 when nothing matched
+		var exitErr *exec.ExitError
+		if !errors.As(err, &exitErr) || exitErr.ExitCode() != 1 {
+			if exitErr != nil && len(exitErr.Stderr) > 0 {
+				return nil, fmt.Errorf("rg failed: %s", strings.TrimSpace(string(exitErr.Stderr)))
+			}
+			return nil, fmt.Errorf("rg failed: %v", err)
+		}
+	}
+	return parseRipgrepJSON(string(output))
+}
+
+// ripgrepMessage is the part of an rg --json message needed to read matches
+type ripgrepMessage struct {
+	Type string `json:"type"`
+	Data struct {
+		Path struct {
+			Text string `json:"text"`
+		} `json:"path"`
+		Lines struct {
+			Text string `json:"text"`
+		} `json:"lines"`
+		LineNumber int `json:"line_number"`
+	} `json:"data"`
+}
+
+// parseRipgrepJSON extracts the matches from rg --json output
+func parseRipgrepJSON(output string) ([]SearchMatch, error) {
+	var matches []SearchMatch
+	scanner := bufio.NewScanner(strings.NewReader(output))
+	scanner.Buffer(make([]byte, 0, 64*1024), 10*1024*1024)
+	for scanner.Scan() {
+		var message ripgrepMessage
+		if err := json.Unmarshal(scanner.Bytes(), &message); err != nil {
+			return nil, fmt.Errorf("error parsing rg output: %v", err)
+		}
+		if message.Type != "match" {
+			continue
+		}
+		matches = append(matches, SearchMatch{
+			File: filepath.ToSlash(filepath.Clean(message.Data.Path.Text)),
+			Line: message.Data.LineNumber,
+			Text: strings.TrimRight(message.Data.Lines.Text, "\r\n"),
+		})
+	}
+	return matches, scanner.Err()
+}
+
+// walkSearch is the built-in fallback for CODE_SEARCH. Like rg it skips hidden
+// directories and binary files, but it does not read .gitignore.
+func walkSearch(pattern, directory, repoPath string) ([]SearchMatch, error) {
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("invalid pattern: %v", err)
+	}
+
+	root := resolvePath(directory, repoPath)
+	var matches []SearchMatch
+	err = filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			if path != root && strings.HasPrefix(info.Name(), ".") {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		content, err := os.ReadFile(path)
+		if err != nil || !isTextFile(content) {
+			return nil
+		}
+
+		relPath, _ := filepath.Rel(repoPath, path)
+		for i, line := range strings.Split(string(content), "\n") {
+			if re.MatchString(line) {
+				matches = append(matches, SearchMatch{
+					File: filepath.ToSlash(relPath),
+					Line: i + 1,
+					Text: strings.TrimRight(line, "\r"),
+				})
+			}
+		}
+		return nil
+	})
+	return matches, err
+}
+
+// ripgrepFiles lists the files containing a fixed string using rg
+func ripgrepFiles(rg, pattern, directory, repoPath string) ([]string, error) {
+	cmd := toolCommand(rg, "--files-with-matches", "--fixed-strings", "--regexp", pattern, "--", filepath.FromSlash(directory))
+	cmd.Dir = repoPath
+	cmd.Env = commandEnv()
+
+	output, err := cmd.Output()
+	if err != nil {
+		var exitErr *exec.ExitError
+		if !errors.As(err, &exitErr) || exitErr.ExitCode() != 1 {
+			return nil, fmt.Errorf("rg failed: %v", err)
+		}
+	}
+
+	var files []string
+	for _, line := range strings.Split(strings.TrimSpace(string(output)), "\n") {
+		if line != "" {
+			files = append(files, filepath.ToSlash(filepath.Clean(line)))
+		}
+	}
+	return files, nil
+}
@@ -0,0 +1,173 @@
+package tools
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// shellSession is a long-lived shell process shared by SHELL tool calls, so
+// working directory changes and exported variables carry over between calls
+type shellSession struct {
+	cmd    *exec.Cmd
+	stdin  io.WriteCloser
+	output *bufio.Reader
+	marker string
+	dir    string
+}
+
+var (
+	shellMu sync.Mutex
+	shell   *shellSession
+)
+
+// startShell starts a new shell process in dir with stderr merged into stdout
+func startShell(dir string) (*shellSession, error) {
+	cmd := toolCommand(activeShell())
+	cmd.Dir = dir
+	cmd.Env = commandEnv()
+
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	cmd.Stderr = cmd.Stdout
+
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+
+	token := make([]byte, 8)
+	if _, err := rand.Read(token); err != nil {
+		return nil, err
+	}
+
+	session := &shellSession{
+		cmd:    cmd,
+		stdin:  stdin,
+		output: bufio.NewReader(stdout),
+		marker: "__SLOP_SHELL_DONE_" + hex.EncodeToString(token) + "__",
+		dir:    dir,
+	}
+
+	// Send stderr through stdout for the whole session
+	if _, err := io.WriteString(stdin, "exec 2>&1\n"); err != nil {
+		session.close()
+		return nil, err
+	}
+
+	return session, nil
+}
+
+// run executes command in the session and returns its output and exit status.
+// Output is passed to the command output handler line by line as it arrives.
+func (s *shellSession) run(command string) (string, int, error) {
+	// Commands read from /dev/null so they cannot consume the session's input
+	script := fmt.Sprintf("{\n%s\n} </dev/null\nprintf '%s %%d\\n' $?\n", command, s.marker)
+	if _, err := io.WriteString(s.stdin, script); err != nil {
+		return "", -1, fmt.Errorf("shell session is no longer running: %v", err)
+	}
+
+	var output strings.Builder
+	for {
+		line, err := s.output.ReadString('\n')
+		if idx := strings.Index(line, s.marker); idx >= 0 {
+			if idx > 0 {
+				output.WriteString(line[:idx])
+				if commandOutputHandler != nil {
+					commandOutputHandler(line[:idx])
+				}
+			}
+			status, convErr := strconv.Atoi(strings.TrimSpace(line[idx+len(s.marker):]))
+			if convErr != nil {
+				return output.String(), -1, fmt.Errorf("could not read exit status: %v", convErr)
+			}
+			return output.String(), status, nil
+		}
+
+		output.WriteString(line)
+		if line != "" && commandOutputHandler != nil {
+			commandOutputHandler(strings.TrimRight(line, "\r\n"))
+		}
+		if err != nil {
+			return output.String(), -1, fmt.Errorf("shell session ended: %v", err)
+		}
+	}
+}
+
+// close terminates the shell process
+func (s *shellSession) close() {
+	s.stdin.Close()
+	s.cmd.Wait()
+}
+
+// runInShell runs command in the persistent shell session for repoPath, starting
+// one if needed. A session that has exited (e.g. after "exit") is replaced on the next call.
+func runInShell(command, repoPath string) (string, error) {
+	shellMu.Lock()
+	defer shellMu.Unlock()
+
+	if !isPOSIXShell() {
+		err := fmt.Errorf("the SHELL tool requires a POSIX shell (current shell: %s); use RUN_COMMAND instead", activeShell())
+		return "Error: " + err.Error(), err
+	}
+
+	if shell != nil && shell.dir != repoPath {
+		shell.close()
+		shell = nil
+	}
+	if shell == nil {
+		session, err := startShell(repoPath)
+		if err != nil {
+			return fmt.Sprintf("Error starting shell: %v", err), err
+		}
+		shell = session
+	}
+
+	output, status, err := shell.run(command)
+	if err != nil {
+		shell.close()
+		shell = nil
+		return fmt.Sprintf("Error in shell session: %v\nOutput: %s", err, output), err
+	}
+
+	if status != 0 {
+		return fmt.Sprintf("Command exited with status %d:\n%s", status, output), &shellExitError{status: status}
+	}
+	return fmt.Sprintf("Command executed successfully:\n%s", output), nil
+}
+
+// CloseShell terminates the persistent shell session, if one is running
+func CloseShell() {
+	shellMu.Lock()
+	defer shellMu.Unlock()
+
+	if shell != nil {
+		shell.close()
+		shell = nil
+	}
+}
+
+// shellExitError reports a non-zero exit status from a command run in the shell session
+type shellExitError struct {
+	status int
+}
+
+func (e *shellExitError) Error() string {
+	return fmt.Sprintf("exit status %d", e.status)
+}
+
+// ExitCode returns the command's exit status
+func (e *shellExitError) ExitCode() int {
+	return e.status
+}
@@ -0,0 +1,82 @@
+package tools
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/kek/slop-shop/repo"
+)
+
+// maxSymbolReferences caps how many references FIND_SYMBOL lists
+const maxSymbolReferences = 50
+
+var (
+	symbolIndexMu sync.Mutex
+	symbolIndexes = map[string]*repo.Index{}
+
+	// excludePatterns are the repository exclude patterns, also applied to the symbol index
+	excludePatterns []string
+)
+
+// SetExcludePatterns sets the exclude patterns used when indexing the repository
+func SetExcludePatterns(patterns []string) {
+	symbolIndexMu.Lock()
+	defer symbolIndexMu.Unlock()
+
+	excludePatterns = patterns
+	symbolIndexes = map[string]*repo.Index{}
+}
+
+// symbolIndex returns the up-to-date symbol index for repoPath, building it on first use
+func symbolIndex(repoPath string) (*repo.Index, error) {
+	symbolIndexMu.Lock()
+	index, ok := symbolIndexes[repoPath]
+	if !ok {
+		index = repo.NewIndex(repoPath, excludePatterns)
+		symbolIndexes[repoPath] = index
+	}
+	symbolIndexMu.Unlock()
+
+	if err := index.Update(); err != nil {
+		return nil, err
+	}
+	return index, nil
+}
+
+// findSymbol lists the definitions of a Go identifier and the places it is used
+func findSymbol(name, repoPath string) (string, error) {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		err := fmt.Errorf("no symbol name given")
+		return "Error: " + err.Error(), err
+	}
+
+	index, err := symbolIndex(repoPath)
+	if err != nil {
+		return fmt.Sprintf("Error indexing repository: %v", err), err
+	}
+
+	definitions, references := index.Lookup(name)
+	if len(definitions) == 0 && len(references) == 0 {
+		err := fmt.Errorf("symbol %s not found", name)
+		return "Error: " + err.Error(), err
+	}
+
+	var buf strings.Builder
+	buf.WriteString(fmt.Sprintf("Definitions of %s (%d):\n", name, len(definitions)))
+	for _, symbol := range definitions {
+		buf.WriteString(fmt.Sprintf("%s:%d: [%s %s.%s] %s\n", symbol.File, symbol.Line, symbol.Kind, symbol.Package, symbol.Name, symbol.Text))
+	}
+
+	buf.WriteString(fmt.Sprintf("\nReferences (%d):\n", len(references)))
+	for i, ref := range references {
+		if i == maxSymbolReferences {
+			buf.WriteString(fmt.Sprintf("... and %d more\n", len(references)-maxSymbolReferences))
+			break
+		}
+		buf.WriteString(fmt.Sprintf("%s:%d: %s\n", ref.File, ref.Line, ref.Text))
+	}
+
+	return buf.String(), nil
+}
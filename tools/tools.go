@@ -1,21 +1,36 @@
 package tools
 
 import (
+	"bufio"
+	"bytes"
+	"errors"
 	"fmt"
+	"io"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 
+	"github.com/kek/slop-shop/debuglog"
 	"github.com/kek/slop-shop/ollama"
+	"github.com/kek/slop-shop/repo"
 	"github.com/kek/slop-shop/styles"
 )
 
 // DiffChange represents a single file change from a diff
 type DiffChange struct {
-	FilePath string
-	Hunks    []DiffHunk
+	FilePath  string // Path of the file after the change (or of the deleted file)
+	OldPath   string // Path of the file before the change, when it differs from FilePath
+	IsNew     bool
+	IsDeleted bool
+	IsRename  bool
+	IsCopy    bool
+	NewMode   os.FileMode // Permission bits to set after the change, 0 if unchanged
+	Hunks     []DiffHunk
 }
 
 // DiffHunk represents a section of changes in a file
@@ -34,180 +49,422 @@ type DiffLine struct {
 	LineNum int
 }
 
-// ExecuteTools executes tools found in the LLM response
-func ExecuteTools(response, repoPath string) string {
-	fmt.Println(styles.HeaderStyle.Render("\n🔧 Tool Execution"))
-	fmt.Println(styles.SeparatorStyle.Render("================================================"))
+// ToolResult describes the outcome of a single tool call
+type ToolResult struct {
+	Tool      string        `json:"tool"`
+	Args      string        `json:"args,omitempty"`
+	ExitCode  int           `json:"exit_code"` // Process exit status for commands; 0 or 1 for other tools
+	Success   bool          `json:"success"`
+	Duration  time.Duration `json:"duration"`
+	Output    string        `json:"output"`
+	Shortened bool          `json:"shortened,omitempty"` // Output exceeded the tool's limit and was truncated or summarized
+	Denied    bool          `json:"denied,omitempty"`    // The tool policy blocked the call
+	Rejected  bool          `json:"rejected,omitempty"`  // A guardrail found the call could not work and told the model why
+
+	Diagnostics []Diagnostic `json:"diagnostics,omitempty"` // Problems reported by LINT and FORMAT
+
+	FilesChanged []string `json:"files_changed,omitempty"` // Files written by APPLY_DIFF or CREATE_FILE
+	LinesAdded   int      `json:"lines_added,omitempty"`
+	LinesRemoved int      `json:"lines_removed,omitempty"`
+}
 
-	var results strings.Builder
-	results.WriteString("Tool Execution Results:\n")
-	results.WriteString("=====================\n\n")
+// progressWriter receives the progress messages printed while tools run; nil means os.Stdout
+var progressWriter io.Writer
+
+// SetProgressOutput sets where progress messages and streamed command output are
+// written. A nil writer restores the default of standard output.
+func SetProgressOutput(w io.Writer) {
+	progressWriter = w
+}
+
+// progressOutput returns the writer for progress messages, looking up os.Stdout
+// on each call so redirections of stdout are respected
+func progressOutput() io.Writer {
+	if progressWriter != nil {
+		return progressWriter
+	}
+	return os.Stdout
+}
 
-	lines := strings.Split(response, "\n")
-	toolCount := 0
+// ExecuteTools executes tools found in the LLM response and returns one result per tool call.
+// The client is used by tools that call back into the model, such as GENERATE_DIFF.
+func ExecuteTools(response, repoPath string, client *ollama.Client) []ToolResult {
+	return ExecuteCalls(ParseToolCalls(response), repoPath, client)
+}
 
-	for _, line := range lines {
-		line = strings.TrimSpace(line)
-		if line == "" {
+// ExecuteCalls executes tool calls parsed from an LLM response and returns one
+// result per call, in the same order
+func ExecuteCalls(calls []ToolCall, repoPath string, client *ollama.Client) []ToolResult {
+	fmt.Fprintln(progressOutput(), styles.HeaderStyle.Render("\n🔧 Tool Execution"))
+	fmt.Fprintln(progressOutput(), styles.SeparatorStyle.Render("================================================"))
+
+	results := make([]ToolResult, len(calls))
+	for start := 0; start < len(calls); {
+		if !isReadOnly(calls[start].Name) {
+			results[start] = executeModelCall(progressOutput(), start+1, calls[start], repoPath, client)
+			transcribe(results[start])
+			start++
 			continue
 		}
 
-		// Execute RUN_COMMAND
-		if strings.HasPrefix(line, "RUN_COMMAND:") {
-			toolCount++
-			command := strings.TrimSpace(strings.TrimPrefix(line, "RUN_COMMAND:"))
-			fmt.Printf(styles.ToolStyle.Render("🔧 [%d] RUN_COMMAND detected: %s\n"), toolCount, command)
-			fmt.Print(styles.InfoStyle.Render("   📍 Working directory: " + repoPath + "\n"))
-			fmt.Print(styles.InfoStyle.Render("   ⏳ Executing...\n"))
+		// Run consecutive read-only calls together; anything that may modify the
+		// repository acts as a barrier so later reads see its effects
+		end := start
+		for end < len(calls) && isReadOnly(calls[end].Name) {
+			end++
+		}
+		executeParallel(calls[start:end], start, results, repoPath, client)
+		transcribe(results[start:end]...)
+		start = end
+	}
 
-			result := executeCommand(command, repoPath)
+	if len(calls) == 0 {
+		fmt.Fprintln(progressOutput(), styles.InfoStyle.Render("ℹ️  No tools detected in LLM response"))
+	} else {
+		fmt.Fprintf(progressOutput(), styles.SuccessStyle.Render("🎯 Total tools executed: %d\n"), len(calls))
+	}
 
-			fmt.Print(styles.SuccessStyle.Render("   ✅ Completed\n"))
-			results.WriteString(fmt.Sprintf("RUN_COMMAND: %s\n", command))
-			results.WriteString(result)
-			results.WriteString("\n")
-		}
+	fmt.Fprintln(progressOutput(), styles.SeparatorStyle.Render("================================================"))
 
-		// Execute READ_FILE
-		if strings.HasPrefix(line, "READ_FILE:") {
-			toolCount++
-			filePath := strings.TrimSpace(strings.TrimPrefix(line, "READ_FILE:"))
-			fmt.Printf(styles.ToolStyle.Render("📖 [%d] READ_FILE detected: %s\n"), toolCount, filePath)
-			fmt.Print(styles.InfoStyle.Render("   📍 Repository: " + repoPath + "\n"))
-			fmt.Print(styles.InfoStyle.Render("   ⏳ Reading...\n"))
+	return results
+}
 
-			result := readFileContent(filePath, repoPath)
+// RunTool runs a single tool call on behalf of the user, subject to the same
+// tool policy as the model's calls, and writes its progress to out
+func RunTool(out io.Writer, call ToolCall, repoPath string) ToolResult {
+	result := executeToolCall(out, 1, call, repoPath, nil)
+	transcribe(result)
+	return result
+}
 
-			fmt.Print(styles.SuccessStyle.Render("   ✅ Completed\n"))
-			results.WriteString(fmt.Sprintf("READ_FILE: %s\n", filePath))
-			results.WriteString(result)
-			results.WriteString("\n")
-		}
+// CommandOutput runs a shell command for a prompt being built, subject to the
+// tool policy and approvals of RUN_COMMAND, and returns its combined output,
+// cut to the RUN_COMMAND output limit, and its exit code. A command that runs
+// and fails is not an error, since its output is usually what is wanted.
+// Nothing runs while tools are disabled.
+func CommandOutput(command, repoPath string) (string, int, error) {
+	if !commandsEnabled {
+		return "", 0, fmt.Errorf("cannot run %q for the prompt while tools are disabled (use -tools)", command)
+	}
+	call := ToolCall{Name: "RUN_COMMAND", Args: command}
+	if err := checkToolPolicy(call.Name); err != nil {
+		return "", 0, err
+	}
+	if err := approve(call, repoPath); err != nil {
+		return "", 0, err
+	}
 
-		// Execute LIST_DIR
-		if strings.HasPrefix(line, "LIST_DIR:") {
-			toolCount++
-			dir := strings.TrimSpace(strings.TrimPrefix(line, "LIST_DIR:"))
-			fmt.Printf("📁 [%d] LIST_DIR detected: %s\n", toolCount, dir)
-			fmt.Printf("   📍 Repository: %s\n", repoPath)
-			fmt.Printf("   ⏳ Scanning...\n")
+	debuglog.Logf("tools", "prompt command %q", command)
+	cmd := shellCommand(command)
+	cmd.Dir = repoPath
+	output, err := cmd.CombinedOutput()
+	var exitErr *exec.ExitError
+	if err != nil && !errors.As(err, &exitErr) {
+		return "", 0, fmt.Errorf("error running %q: %v", command, err)
+	}
+	limited, _ := limitOutput(call.Name, command, string(output), nil)
+	return limited, exitCode(err), nil
+}
 
-			result := listDirectory(dir, repoPath)
+// readOnlyTools are the built-in tools that never modify the repository and may run concurrently
+var readOnlyTools = map[string]bool{
+	"READ_FILE":    true,
+	"LIST_DIR":     true,
+	"SEARCH_FILES": true,
+	"CODE_SEARCH":  true,
+	"FIND_SYMBOL":  true,
+}
 
-			fmt.Printf("   ✅ Completed\n")
-			results.WriteString(fmt.Sprintf("LIST_DIR: %s\n", dir))
-			results.WriteString(result)
-			results.WriteString("\n")
-		}
+// isReadOnly reports whether a tool can safely run alongside other read-only tools
+func isReadOnly(name string) bool {
+	return readOnlyTools[name]
+}
 
-		// Execute TEST_COMMAND
-		if strings.HasPrefix(line, "TEST_COMMAND:") {
-			toolCount++
-			command := strings.TrimSpace(strings.TrimPrefix(line, "TEST_COMMAND:"))
-			fmt.Printf("🧪 [%d] TEST_COMMAND detected: %s\n", toolCount, command)
-			fmt.Printf("   📍 Working directory: %s\n", repoPath)
-			fmt.Printf("   ⏳ Testing...\n")
+// toolWorkers is the maximum number of read-only tool calls run at the same time
+var toolWorkers = 4
 
-			result := testCommand(command, repoPath)
+// SetToolWorkers sets how many read-only tool calls may run concurrently; values below 1 run them one at a time
+func SetToolWorkers(workers int) {
+	if workers < 1 {
+		workers = 1
+	}
+	toolWorkers = workers
+}
 
-			fmt.Printf("   ✅ Completed\n")
-			results.WriteString(fmt.Sprintf("TEST_COMMAND: %s\n", command))
-			results.WriteString(result)
-			results.WriteString("\n")
-		}
+// executeParallel runs calls with a pool of workers and stores each result at
+// results[offset+i]. Progress output is buffered per call and printed in call
+// order once all calls have finished.
+func executeParallel(calls []ToolCall, offset int, results []ToolResult, repoPath string, client *ollama.Client) {
+	outputs := make([]bytes.Buffer, len(calls))
+	jobs := make(chan int)
+
+	var wg sync.WaitGroup
+	for w := 0; w < toolWorkers && w < len(calls); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				results[offset+i] = executeModelCall(&outputs[i], offset+i+1, calls[i], repoPath, client)
+			}
+		}()
+	}
 
-		// Execute SEARCH_FILES
-		if strings.HasPrefix(line, "SEARCH_FILES:") {
-			toolCount++
-			parts := strings.SplitN(strings.TrimPrefix(line, "SEARCH_FILES:"), " ", 2)
-			if len(parts) == 2 {
-				pattern := strings.TrimSpace(parts[0])
-				directory := strings.TrimSpace(parts[1])
-				fmt.Printf("🔍 [%d] SEARCH_FILES detected: pattern='%s' in '%s'\n", toolCount, pattern, directory)
-				fmt.Printf("   📍 Repository: %s\n", repoPath)
-				fmt.Printf("   ⏳ Searching...\n")
+	for i := range calls {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
 
-				result := searchFiles(pattern, directory, repoPath)
+	for i := range outputs {
+		progressOutput().Write(outputs[i].Bytes())
+	}
+}
 
-				fmt.Printf("   ✅ Completed\n")
-				results.WriteString(fmt.Sprintf("SEARCH_FILES: %s in %s\n", pattern, directory))
-				results.WriteString(result)
-				results.WriteString("\n")
-			}
+// FormatResults renders tool results as text suitable for feeding back to the model
+func FormatResults(results []ToolResult) string {
+	var buf strings.Builder
+	buf.WriteString("Tool Execution Results:\n")
+	buf.WriteString("=====================\n\n")
+
+	for _, result := range results {
+		switch {
+		case result.Tool == "APPLY_DIFF":
+			buf.WriteString("APPLY_DIFF: Applied\n")
+		case result.Args != "":
+			buf.WriteString(fmt.Sprintf("%s: %s\n", result.Tool, result.Args))
+		default:
+			buf.WriteString(result.Tool + ":\n")
 		}
+		buf.WriteString(result.Output)
+		buf.WriteString("\n\n")
+	}
 
-		// Execute GENERATE_DIFF
-		if strings.HasPrefix(line, "GENERATE_DIFF:") {
-			toolCount++
-			description := strings.TrimSpace(strings.TrimPrefix(line, "GENERATE_DIFF:"))
-			fmt.Printf("📝 [%d] GENERATE_DIFF detected: %s\n", toolCount, description)
-			fmt.Printf("   📍 Repository: %s\n", repoPath)
-			fmt.Printf("   ⏳ Generating diff...\n")
+	return buf.String()
+}
 
-			result := generateDiff(description, repoPath)
+// executeToolCall runs a single parsed tool call, writing progress to out, and returns its result
+func executeToolCall(out io.Writer, index int, call ToolCall, repoPath string, client *ollama.Client) ToolResult {
+	result := ToolResult{Tool: call.Name, Args: call.Args}
+	start := time.Now()
 
-			fmt.Printf("   ✅ Completed\n")
-			results.WriteString(fmt.Sprintf("GENERATE_DIFF: %s\n", description))
-			results.WriteString(result)
-			results.WriteString("\n")
-		}
+	var output string
+	var err error
 
-		// Execute APPLY_DIFF
-		if strings.HasPrefix(line, "APPLY_DIFF:") {
-			toolCount++
-			diffContent := strings.TrimSpace(strings.TrimPrefix(line, "APPLY_DIFF:"))
-			fmt.Printf("🔧 [%d] APPLY_DIFF detected\n", toolCount)
-			fmt.Printf("   📍 Repository: %s\n", repoPath)
-			fmt.Printf("   ⏳ Applying diff...\n")
+	if toolContext.Err() != nil {
+		fmt.Fprintf(out, "⏹️  [%d] %s skipped: interrupted\n", index, call.Name)
+		result.Output = "Error: interrupted before the tool ran"
+		result.ExitCode = 1
+		return result
+	}
 
-			result := applyDiffTool(diffContent, repoPath)
+	if policyErr := checkToolPolicy(call.Name); policyErr != nil {
+		debuglog.Logf("tools", "%s %q blocked: %v", call.Name, call.Args, policyErr)
+		fmt.Fprintf(out, "🚫 [%d] %s blocked: %v\n", index, call.Name, policyErr)
+		result.Output = "Error: " + policyErr.Error()
+		result.ExitCode = exitCode(policyErr)
+		result.Denied = true
+		return result
+	}
+
+	if approvalErr := approve(call, repoPath); approvalErr != nil {
+		debuglog.Logf("tools", "%s %q not approved: %v", call.Name, call.Args, approvalErr)
+		fmt.Fprintf(out, "🚫 [%d] %s not run: %v\n", index, call.Name, approvalErr)
+		result.Output = "Error: " + approvalErr.Error()
+		result.ExitCode = 1
+		result.Denied = true
+		return result
+	}
 
-			fmt.Printf("   ✅ Completed\n")
-			results.WriteString("APPLY_DIFF: Applied\n")
-			results.WriteString(result)
-			results.WriteString("\n")
+	// With the speculative overlay on, commands run in its sandbox
+	dir := repoPath
+	if runsInSandbox(call.Name) {
+		var dirErr error
+		if dir, dirErr = overlay.workDir(repoPath); dirErr != nil {
+			fmt.Fprintf(out, "❌ [%d] %s not run: %v\n", index, call.Name, dirErr)
+			result.Output = "Error: " + dirErr.Error()
+			result.ExitCode = 1
+			return result
 		}
+	}
 
-		// Execute CREATE_FILE
-		if strings.HasPrefix(line, "CREATE_FILE:") {
-			toolCount++
-			filePath := strings.TrimSpace(strings.TrimPrefix(line, "CREATE_FILE:"))
-			fmt.Printf("📝 [%d] CREATE_FILE detected: %s\n", toolCount, filePath)
-			fmt.Printf("   📍 Repository: %s\n", repoPath)
-			fmt.Printf("   ⏳ Creating file...\n")
+	switch call.Name {
+	case "RUN_COMMAND":
+		fmt.Fprintf(out, styles.ToolStyle.Render("🔧 [%d] RUN_COMMAND detected: %s\n"), index, call.Args)
+		fmt.Fprint(out, styles.InfoStyle.Render("   📍 Working directory: "+dir+"\n"))
+		fmt.Fprint(out, styles.InfoStyle.Render("   ⏳ Executing...\n"))
+		output, err = executeCommand(call.Args, dir)
+
+	case "READ_FILE":
+		fmt.Fprintf(out, styles.ToolStyle.Render("📖 [%d] READ_FILE detected: %s\n"), index, call.Args)
+		fmt.Fprint(out, styles.InfoStyle.Render("   📍 Repository: "+repoPath+"\n"))
+		fmt.Fprint(out, styles.InfoStyle.Render("   ⏳ Reading...\n"))
+		output, err = readFileContent(call.Args, repoPath)
+
+	case "LIST_DIR":
+		fmt.Fprintf(out, "📁 [%d] LIST_DIR detected: %s\n", index, call.Args)
+		fmt.Fprintf(out, "   📍 Repository: %s\n", repoPath)
+		fmt.Fprintf(out, "   ⏳ Scanning...\n")
+		output, err = listDirectory(call.Args, repoPath)
+
+	case "SHELL":
+		fmt.Fprintf(out, styles.ToolStyle.Render("🐚 [%d] SHELL detected: %s\n"), index, call.Args)
+		fmt.Fprint(out, styles.InfoStyle.Render("   ⏳ Running in persistent shell...\n"))
+		output, err = runInShell(call.Args, dir)
+
+	case "TEST_COMMAND":
+		fmt.Fprintf(out, "🧪 [%d] TEST_COMMAND detected: %s\n", index, call.Args)
+		fmt.Fprintf(out, "   📍 Working directory: %s\n", dir)
+		fmt.Fprintf(out, "   ⏳ Testing...\n")
+		output, err = testCommand(call.Args, dir)
+
+	case "SEARCH_FILES":
+		pattern, directory := parseSearchArgs(call.Args)
+		fmt.Fprintf(out, "🔍 [%d] SEARCH_FILES detected: pattern='%s' in '%s'\n", index, pattern, directory)
+		fmt.Fprintf(out, "   📍 Repository: %s\n", repoPath)
+		fmt.Fprintf(out, "   ⏳ Searching...\n")
+		result.Args = fmt.Sprintf("%s in %s", pattern, directory)
+		if pattern == "" {
+			err = fmt.Errorf("SEARCH_FILES requires a pattern")
+			output = "Error: " + err.Error()
+		} else {
+			output, err = searchFiles(pattern, directory, repoPath)
+		}
 
-			// Collect content until END_FILE
-			var contentLines []string
-			for i := toolCount; i < len(lines); i++ {
-				if strings.TrimSpace(lines[i]) == "END_FILE" {
-					break
-				}
-				contentLines = append(contentLines, lines[i])
+	case "CODE_SEARCH":
+		pattern, directory := parseSearchArgs(call.Args)
+		result.Args = fmt.Sprintf("%s in %s", pattern, directory)
+		fmt.Fprintf(out, styles.ToolStyle.Render("🔎 [%d] CODE_SEARCH detected: pattern='%s' in '%s'\n"), index, pattern, directory)
+		fmt.Fprint(out, styles.InfoStyle.Render("   📍 Repository: "+dir+"\n"))
+		fmt.Fprint(out, styles.InfoStyle.Render("   ⏳ Searching...\n"))
+		output, err = codeSearch(pattern, directory, dir)
+
+	case "FIND_SYMBOL":
+		fmt.Fprintf(out, styles.ToolStyle.Render("🧭 [%d] FIND_SYMBOL detected: %s\n"), index, call.Args)
+		fmt.Fprint(out, styles.InfoStyle.Render("   📍 Repository: "+dir+"\n"))
+		fmt.Fprint(out, styles.InfoStyle.Render("   ⏳ Looking up symbol...\n"))
+		output, err = findSymbol(call.Args, dir)
+
+	case "LINT", "FORMAT":
+		fmt.Fprintf(out, styles.ToolStyle.Render("🧹 [%d] %s detected: %s\n"), index, call.Name, call.Args)
+		fmt.Fprint(out, styles.InfoStyle.Render("   📍 Working directory: "+dir+"\n"))
+		fmt.Fprint(out, styles.InfoStyle.Render("   ⏳ Checking...\n"))
+		output, result.Diagnostics, err = runLintTool(call.Name == "FORMAT", call.Args, dir)
+
+	case "GENERATE_DIFF":
+		fmt.Fprintf(out, "📝 [%d] GENERATE_DIFF detected: %s\n", index, call.Args)
+		fmt.Fprintf(out, "   📍 Repository: %s\n", repoPath)
+		fmt.Fprintf(out, "   ⏳ Generating diff...\n")
+		output, err = generateDiff(call.Args, client)
+
+	case "APPLY_DIFF":
+		fmt.Fprintf(out, "🔧 [%d] APPLY_DIFF detected\n", index)
+		fmt.Fprintf(out, "   📍 Repository: %s\n", repoPath)
+		fmt.Fprintf(out, "   ⏳ Applying diff...\n")
+		output, err = applyDiffTool(call.Body, repoPath)
+
+	case "CREATE_FILE":
+		fmt.Fprintf(out, "📝 [%d] CREATE_FILE detected: %s\n", index, call.Args)
+		fmt.Fprintf(out, "   📍 Repository: %s\n", repoPath)
+		fmt.Fprintf(out, "   ⏳ Creating file...\n")
+		output, err = createFile(call.Args, call.Body, repoPath)
+
+	case "REMEMBER":
+		fmt.Fprintf(out, "🧠 [%d] REMEMBER detected: %s\n", index, call.Args)
+		output, err = rememberNote(call.Args, repoPath)
+
+	default:
+		tool, ok := customTools[call.Name]
+		if !ok {
+			err = fmt.Errorf("unknown tool %s", call.Name)
+			output = "Error: " + err.Error()
+			break
+		}
+
+		if tool.Run != nil {
+			values, argsErr := customArgs(tool, call.Args)
+			if argsErr != nil {
+				err = argsErr
+				output = fmt.Sprintf("Error preparing %s: %v", call.Name, argsErr)
+				break
 			}
-			content := strings.Join(contentLines, "\n")
+			fmt.Fprintf(out, styles.ToolStyle.Render("🧩 [%d] %s detected: %s\n"), index, call.Name, call.Args)
+			fmt.Fprint(out, styles.InfoStyle.Render("   ⏳ Running plugin tool...\n"))
+			output, err = tool.Run(values, dir)
+			break
+		}
 
-			result := createFile(filePath, content, repoPath)
+		command, renderErr := renderCustomCommand(tool, call.Args)
+		if renderErr != nil {
+			err = renderErr
+			output = fmt.Sprintf("Error preparing %s: %v", call.Name, renderErr)
+			break
+		}
 
-			fmt.Printf("   ✅ Completed\n")
-			results.WriteString(fmt.Sprintf("CREATE_FILE: %s\n", filePath))
-			results.WriteString(result)
-			results.WriteString("\n")
+		fmt.Fprintf(out, styles.ToolStyle.Render("🧩 [%d] %s detected: %s\n"), index, call.Name, call.Args)
+		fmt.Fprint(out, styles.InfoStyle.Render("   📍 Working directory: "+dir+"\n"))
+		fmt.Fprint(out, styles.InfoStyle.Render("   ⏳ Running: "+command+"\n"))
+		output, err = executeCommand(command, dir)
+	}
+
+	if limited, shortened := limitOutput(call.Name, result.Args, output, client); shortened {
+		fmt.Fprintf(out, "   ✂️  Output shortened from %d to %d bytes\n", len(output), len(limited))
+		output = limited
+		result.Shortened = true
+	}
+
+	// Files the command changed in the sandbox join the speculative changes
+	if runsInSandbox(call.Name) && overlay != nil {
+		if note := overlay.settle(); note != "" {
+			fmt.Fprintf(out, "   🗂️  %s\n", note)
+			output = strings.TrimRight(output, "\n") + "\n" + note
 		}
 	}
 
-	if toolCount == 0 {
-		fmt.Println(styles.InfoStyle.Render("ℹ️  No tools detected in LLM response"))
+	result.Duration = time.Since(start)
+	result.Output = output
+	result.Success = err == nil
+	result.ExitCode = exitCode(err)
+	recordChanges(&result, call)
+	debuglog.Logf("tools", "%s %q: exit %d after %s, %d bytes of output, error: %v", call.Name, call.Args, result.ExitCode, result.Duration, len(output), err)
+
+	if result.Success {
+		fmt.Fprintf(out, "   ✅ Completed\n")
 	} else {
-		fmt.Printf(styles.SuccessStyle.Render("🎯 Total tools executed: %d\n"), toolCount)
+		fmt.Fprintf(out, "   ❌ Failed\n")
 	}
+	return result
+}
 
-	fmt.Println(styles.SeparatorStyle.Render("================================================"))
+// runsInSandbox reports whether a tool runs in the sandbox of the speculative
+// overlay rather than reading through it: commands, code searches and custom
+// tools do
+func runsInSandbox(name string) bool {
+	switch name {
+	case "READ_FILE", "LIST_DIR", "SEARCH_FILES", "GENERATE_DIFF", "APPLY_DIFF", "CREATE_FILE", "REMEMBER":
+		return false
+	}
+	return true
+}
 
-	return results.String()
+// exitCode maps a tool error to an exit status
+func exitCode(err error) int {
+	if err == nil {
+		return 0
+	}
+	var coded interface{ ExitCode() int }
+	if errors.As(err, &coded) {
+		return coded.ExitCode()
+	}
+	return 1
 }
 
-// generateDiff generates a unified diff based on a description
-func generateDiff(description, repoPath string) string {
+// generateDiff generates a unified diff based on a description using the configured model
+func generateDiff(description string, client *ollama.Client) (string, error) {
+	if client == nil {
+		err := fmt.Errorf("no model configured for diff generation")
+		return fmt.Sprintf("Error generating diff: %v", err), err
+	}
+
 	// Use the LLM to generate an actual diff
 	diffPrompt := fmt.Sprintf("Based on this description: '%s', generate a unified diff that implements the requested changes. "+
 		"Only output the unified diff format, no explanations. The diff should be in the format:\n"+
@@ -220,114 +477,208 @@ func generateDiff(description, repoPath string) string {
 		"Description: %s", description, description)
 
 	// Send to Ollama to generate the diff
-	fmt.Printf("   🤖 Generating diff with LLM...\n")
+	fmt.Fprintf(progressOutput(), "   🤖 Generating diff with %s...\n", client.Model)
 	var response strings.Builder
-	_, err := ollama.SendToOllamaWithCallback("http://localhost:11434", "qwen3-coder", diffPrompt, "", 0.3, 0.8, true, func(chunk string) {
+	diffClient := *client
+	diffClient.Label = "GENERATE_DIFF"
+	_, err := diffClient.Generate(diffPrompt, "", false, func(chunk string) {
 		response.WriteString(chunk)
 	})
 	if err != nil {
-		return fmt.Sprintf("Error generating diff: %v", err)
+		return fmt.Sprintf("Error generating diff: %v", err), err
 	}
 
 	// Check if the response contains a valid diff format
 	if strings.Contains(response.String(), "--- a/") && strings.Contains(response.String(), "+++ b/") {
-		return fmt.Sprintf("Generated diff:\n\n%s", response.String())
+		return fmt.Sprintf("Generated diff:\n\n%s", response.String()), nil
 	} else {
 		return fmt.Sprintf("LLM response (may not be valid diff format):\n\n%s\n\nNote: This may not be a valid unified diff. "+
-			"You can copy the content above and use APPLY_DIFF if it looks correct.", response.String())
+			"You can copy the content above and use APPLY_DIFF if it looks correct.", response.String()), nil
 	}
 }
 
 // applyDiffTool applies a unified diff using the existing diff logic
-func applyDiffTool(diffContent, repoPath string) string {
+func applyDiffTool(diffContent, repoPath string) (string, error) {
 	if err := applyDiff(diffContent, repoPath); err != nil {
-		return fmt.Sprintf("Error applying diff: %v", err)
+		return fmt.Sprintf("Error applying diff: %v", err), err
 	}
-	return "Diff applied successfully to the repository"
+	if overlay != nil {
+		return "Diff applied successfully; the changes are kept in memory until they are approved", nil
+	}
+	return "Diff applied successfully to the repository", nil
 }
 
 // executeCommand executes a shell command
-func executeCommand(command, repoPath string) string {
-	cmd := exec.Command("sh", "-c", command)
+func executeCommand(command, repoPath string) (string, error) {
+	cmd := shellCommand(command)
 	cmd.Dir = repoPath
 
-	output, err := cmd.CombinedOutput()
+	output, err := runStreaming(cmd)
 	if err != nil {
-		return fmt.Sprintf("Error executing command: %v\nOutput: %s", err, string(output))
+		return fmt.Sprintf("Error executing command: %v\nOutput: %s", err, output), err
 	}
 
-	return fmt.Sprintf("Command executed successfully:\n%s", string(output))
+	return fmt.Sprintf("Command executed successfully:\n%s", output), nil
 }
 
-// readFileContent reads the contents of a file
-func readFileContent(filePath, repoPath string) string {
-	fullPath := filePath
-	if !strings.HasPrefix(filePath, "/") {
-		fullPath = filepath.Join(repoPath, filePath)
+// commandOutputHandler receives each line of command output as it is produced
+var commandOutputHandler = func(line string) {
+	fmt.Fprintln(progressOutput(), styles.MutedStyle.Render("   │ "+line))
+}
+
+// SetCommandOutputHandler sets the function that receives live command output line by line
+func SetCommandOutputHandler(handler func(line string)) {
+	commandOutputHandler = handler
+}
+
+// runStreaming runs cmd, passing stdout and stderr to the command output handler
+// line by line as they are produced, and returns the full combined output
+func runStreaming(cmd *exec.Cmd) (string, error) {
+	reader, writer := io.Pipe()
+	cmd.Stdout = writer
+	cmd.Stderr = writer
+
+	var output strings.Builder
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		buffered := bufio.NewReader(reader)
+		for {
+			line, err := buffered.ReadString('\n')
+			output.WriteString(line)
+			if line != "" && commandOutputHandler != nil {
+				commandOutputHandler(strings.TrimRight(line, "\r\n"))
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	if err := cmd.Start(); err != nil {
+		writer.Close()
+		<-done
+		return "", err
 	}
 
-	content, err := os.ReadFile(fullPath)
+	err := cmd.Wait()
+	writer.Close()
+	<-done
+
+	return output.String(), err
+}
+
+// readFileContent reads the contents of a file
+func readFileContent(filePath, repoPath string) (string, error) {
+	fullPath := resolvePath(filePath, repoPath)
+
+	content, err := overlay.readFile(fullPath)
 	if err != nil {
-		return fmt.Sprintf("Error reading file: %v", err)
+		return fmt.Sprintf("Error reading file: %v", err), err
 	}
 
-	return fmt.Sprintf("File contents:\n%s", string(content))
+	return fmt.Sprintf("File contents:\n%s", string(content)), nil
 }
 
 // listDirectory lists the contents of a directory
-func listDirectory(dir, repoPath string) string {
-	fullPath := dir
-	if !strings.HasPrefix(dir, "/") {
-		fullPath = filepath.Join(repoPath, dir)
-	}
+func listDirectory(dir, repoPath string) (string, error) {
+	fullPath := resolvePath(dir, repoPath)
 
 	entries, err := os.ReadDir(fullPath)
-	if err != nil {
-		return fmt.Sprintf("Error reading directory: %v", err)
+	changed := overlay.under(fullPath)
+	if err != nil && len(changed) == 0 {
+		return fmt.Sprintf("Error reading directory: %v", err), err
 	}
 
-	var result strings.Builder
-	result.WriteString("Directory contents:\n")
+	type listed struct {
+		dir  bool
+		size int64
+	}
+	listing := make(map[string]listed)
 	for _, entry := range entries {
 		info, err := entry.Info()
 		if err != nil {
 			continue
 		}
+		listing[entry.Name()] = listed{info.IsDir(), info.Size()}
+	}
+	// Files changed in the overlay replace those on disk
+	for _, path := range changed {
+		rel, _ := filepath.Rel(overlayKey(fullPath), path)
+		name, _, nested := strings.Cut(filepath.ToSlash(rel), "/")
+		file, _ := overlay.lookup(path)
+		switch {
+		case !file.exists && !nested:
+			delete(listing, name)
+		case !file.exists:
+			// A file deleted further down leaves its directory listed
+		case nested:
+			if _, ok := listing[name]; !ok {
+				listing[name] = listed{dir: true}
+			}
+		default:
+			listing[name] = listed{size: int64(len(file.content))}
+		}
+	}
+	names := make([]string, 0, len(listing))
+	for name := range listing {
+		names = append(names, name)
+	}
+	sort.Strings(names)
 
+	var result strings.Builder
+	result.WriteString("Directory contents:\n")
+	for _, name := range names {
 		fileType := "f"
-		if info.IsDir() {
+		if listing[name].dir {
 			fileType = "d"
 		}
-
-		result.WriteString(fmt.Sprintf("%s %8d %s\n", fileType, info.Size(), entry.Name()))
+		result.WriteString(fmt.Sprintf("%s %8d %s\n", fileType, listing[name].size, name))
 	}
 
-	return result.String()
+	return result.String(), nil
 }
 
 // testCommand tests if a command works
-func testCommand(command, repoPath string) string {
-	cmd := exec.Command("sh", "-c", command)
+func testCommand(command, repoPath string) (string, error) {
+	cmd := shellCommand(command)
 	cmd.Dir = repoPath
 
-	output, err := cmd.CombinedOutput()
+	output, err := runStreaming(cmd)
 	if err != nil {
-		return fmt.Sprintf("Command failed: %v\nOutput: %s", err, string(output))
+		return fmt.Sprintf("Command failed: %v\nOutput: %s", err, output), err
 	}
 
-	return fmt.Sprintf("Command works successfully:\n%s", string(output))
+	return fmt.Sprintf("Command works successfully:\n%s", output), nil
 }
 
 // searchFiles searches for text patterns in files
-func searchFiles(pattern, directory, repoPath string) string {
-	fullPath := directory
-	if !strings.HasPrefix(directory, "/") {
-		fullPath = filepath.Join(repoPath, directory)
-	}
-
+func searchFiles(pattern, directory, repoPath string) (string, error) {
 	var results strings.Builder
 	results.WriteString("Search results:\n")
 
+	fullPath := resolvePath(directory, repoPath)
+	changed := overlay.under(fullPath)
+
+	// Delegate to ripgrep when it is installed, falling back to the walker if
+	// it fails. Files changed in the overlay are only seen by the walker.
+	if rg, err := lookupRipgrep(); err == nil && len(changed) == 0 {
+		if files, err := ripgrepFiles(rg, pattern, directory, repoPath); err == nil {
+			for _, file := range files {
+				results.WriteString(fmt.Sprintf("Found in: %s\n", file))
+			}
+			return results.String(), nil
+		}
+	}
+
+	seen := make(map[string]bool)
+	found := func(path string, content []byte) {
+		if isTextFile(content) && strings.Contains(string(content), pattern) {
+			relPath, _ := filepath.Rel(repoPath, path)
+			results.WriteString(fmt.Sprintf("Found in: %s\n", filepath.ToSlash(relPath)))
+		}
+	}
+
 	err := filepath.Walk(fullPath, func(path string, info os.FileInfo, err error) error {
 		if err != nil {
 			return err
@@ -337,50 +688,66 @@ func searchFiles(pattern, directory, repoPath string) string {
 			return nil
 		}
 
-		// Skip binary files
-		content, err := os.ReadFile(path)
+		seen[overlayKey(path)] = true
+		content, err := overlay.readFile(path)
 		if err != nil {
 			return nil
 		}
-		if !isTextFile(content) {
-			return nil
-		}
-
-		// Simple text search
-		if strings.Contains(string(content), pattern) {
-			relPath, _ := filepath.Rel(repoPath, path)
-			results.WriteString(fmt.Sprintf("Found in: %s\n", relPath))
-		}
-
+		found(path, content)
 		return nil
 	})
+	if err != nil && len(changed) > 0 && os.IsNotExist(err) {
+		err = nil
+	}
+
+	// Files created in the overlay are not on disk for the walk
+	for _, path := range changed {
+		if file, _ := overlay.lookup(path); file.exists && !seen[path] {
+			rel, _ := filepath.Rel(overlayKey(fullPath), path)
+			found(filepath.Join(fullPath, rel), []byte(file.content))
+		}
+	}
 
 	if err != nil {
-		return fmt.Sprintf("Error searching files: %v", err)
+		return fmt.Sprintf("Error searching files: %v", err), err
 	}
 
-	return results.String()
+	return results.String(), nil
 }
 
 // createFile creates a new file with the specified content
-func createFile(filePath, content, repoPath string) string {
-	fullPath := filePath
-	if !strings.HasPrefix(filePath, "/") {
-		fullPath = filepath.Join(repoPath, filePath)
+func createFile(filePath, content, repoPath string) (string, error) {
+	fullPath := resolvePath(filePath, repoPath)
+	if overlay != nil && !inScratch(fullPath) {
+		overlay.store(fullPath, patchFile{exists: true, content: content, perm: 0644})
+		return fmt.Sprintf("File created in memory until the changes are approved: %s", filePath), nil
 	}
 
 	// Ensure the directory exists
 	dir := filepath.Dir(fullPath)
 	if err := os.MkdirAll(dir, 0755); err != nil {
-		return fmt.Sprintf("Error creating directory: %v", err)
+		return fmt.Sprintf("Error creating directory: %v", err), err
 	}
 
 	// Create the file with content
 	if err := os.WriteFile(fullPath, []byte(content), 0644); err != nil {
-		return fmt.Sprintf("Error creating file: %v", err)
+		return fmt.Sprintf("Error creating file: %v", err), err
 	}
 
-	return fmt.Sprintf("File created successfully: %s", filePath)
+	return fmt.Sprintf("File created successfully: %s", filePath), nil
+}
+
+// rememberNote adds a fact to the project memory and includes it in the following prompts
+func rememberNote(note, repoPath string) (string, error) {
+	if err := repo.Remember(repoPath, note); err != nil {
+		return fmt.Sprintf("Error saving note: %v", err), err
+	}
+	notes, err := repo.LoadMemory(repoPath)
+	if err != nil {
+		return fmt.Sprintf("Error reloading notes: %v", err), err
+	}
+	ollama.SetMemory(notes)
+	return fmt.Sprintf("Saved to %s", repo.MemoryFile), nil
 }
 
 // applyDiff applies a unified diff to the repository
@@ -391,60 +758,125 @@ func applyDiff(diffOutput, repoPath string) error {
 		return fmt.Errorf("failed to parse diff: %v", err)
 	}
 
-	// Apply each change
+	// Validate every change against the current files before writing anything
+	state := newPatchState()
+	state.base = overlay
+	messages := make([]string, 0, len(changes))
 	for _, change := range changes {
-		if err := applyFileChange(change, repoPath); err != nil {
+		message, err := applyFileChange(change, repoPath, state, patchFuzz, conflictResolver)
+		if err != nil {
 			return fmt.Errorf("failed to apply change to %s: %v", change.FilePath, err)
 		}
+		messages = append(messages, message)
 	}
 
+	if overlay != nil {
+		overlay.keep(state)
+	} else if err := state.commit(); err != nil {
+		return fmt.Errorf("failed to write changes, repository left unchanged: %v", err)
+	}
+
+	for _, message := range messages {
+		fmt.Fprintln(progressOutput(), message)
+	}
 	return nil
 }
 
-// parseDiff parses a unified diff output
+// parseDiff parses a unified diff output, including git extended headers for
+// new, deleted, renamed and copied files and mode changes
 func parseDiff(diffOutput string) ([]DiffChange, error) {
 	var changes []DiffChange
 	lines := strings.Split(diffOutput, "\n")
 
 	var currentChange *DiffChange
 	var currentHunk *DiffHunk
+	sawOldHeader := false
+
+	flush := func() {
+		if currentChange == nil {
+			return
+		}
+		if currentHunk != nil {
+			currentChange.Hunks = append(currentChange.Hunks, finishHunk(*currentHunk))
+		}
+		if currentChange.OldPath == currentChange.FilePath {
+			currentChange.OldPath = ""
+		}
+		changes = append(changes, *currentChange)
+		currentChange = nil
+		currentHunk = nil
+		sawOldHeader = false
+	}
 
-	for _, line := range lines {
-		line = strings.TrimSpace(line)
+	for i, rawLine := range lines {
+		rawLine = strings.TrimRight(rawLine, "\r")
+		line := strings.TrimSpace(rawLine)
 
-		// Skip empty lines
-		if line == "" {
+		// Skip empty lines outside of hunks; inside a hunk they are blank context lines
+		if line == "" && currentHunk == nil {
 			continue
 		}
 
-		// File header
-		if strings.HasPrefix(line, "--- a/") {
-			if currentChange != nil {
-				if currentHunk != nil {
-					currentChange.Hunks = append(currentChange.Hunks, *currentHunk)
-				}
-				changes = append(changes, *currentChange)
+		// Git file header: diff --git a/old b/new
+		if strings.HasPrefix(line, "diff --git ") {
+			flush()
+			oldPath, newPath := parseGitHeaderPaths(strings.TrimPrefix(line, "diff --git "))
+			currentChange = &DiffChange{FilePath: newPath, OldPath: oldPath}
+			continue
+		}
+
+		// Git extended headers
+		if currentChange != nil && currentHunk == nil && !sawOldHeader {
+			if handled, err := parseExtendedHeader(line, currentChange); err != nil {
+				return nil, err
+			} else if handled {
+				continue
 			}
+		}
 
-			filePath := strings.TrimPrefix(line, "--- a/")
-			currentChange = &DiffChange{FilePath: filePath}
-			currentHunk = nil
+		// File header; a removed line starting with "-- " is only a header when "+++ " follows
+		if strings.HasPrefix(line, "--- ") && i+1 < len(lines) && strings.HasPrefix(strings.TrimSpace(lines[i+1]), "+++ ") {
+			if currentChange == nil || sawOldHeader || currentHunk != nil {
+				flush()
+				currentChange = &DiffChange{}
+			}
+			sawOldHeader = true
+
+			oldPath := parseHeaderPath(strings.TrimPrefix(line, "--- "), "a/")
+			if oldPath == "/dev/null" {
+				currentChange.IsNew = true
+			} else {
+				currentChange.OldPath = oldPath
+				if currentChange.FilePath == "" {
+					currentChange.FilePath = oldPath
+				}
+			}
 			continue
 		}
 
-		if strings.HasPrefix(line, "+++ b/") {
+		if strings.HasPrefix(line, "+++ ") && sawOldHeader && currentHunk == nil {
+			filePath := parseHeaderPath(strings.TrimPrefix(line, "+++ "), "b/")
+			if filePath == "/dev/null" {
+				currentChange.IsDeleted = true
+				continue
+			}
+
 			// Verify file path matches
-			filePath := strings.TrimPrefix(line, "+++ b/")
-			if currentChange != nil && currentChange.FilePath != filePath {
-				return nil, fmt.Errorf("mismatched file paths in diff: %s vs %s", currentChange.FilePath, filePath)
+			if currentChange.OldPath != "" && currentChange.OldPath != filePath &&
+				!currentChange.IsRename && !currentChange.IsCopy {
+				return nil, fmt.Errorf("mismatched file paths in diff: %s vs %s", currentChange.OldPath, filePath)
 			}
+			currentChange.FilePath = filePath
 			continue
 		}
 
 		// Hunk header
 		if strings.HasPrefix(line, "@@") {
-			if currentHunk != nil && currentChange != nil {
-				currentChange.Hunks = append(currentChange.Hunks, *currentHunk)
+			if currentChange == nil {
+				return nil, fmt.Errorf("hunk without file header: %s", line)
+			}
+			if currentHunk != nil {
+				currentChange.Hunks = append(currentChange.Hunks, finishHunk(*currentHunk))
 			}
 
 			// Parse hunk header: @@ -oldStart,oldCount +newStart,newCount @@
@@ -468,17 +900,22 @@ func parseDiff(diffOutput string) ([]DiffChange, error) {
 			continue
 		}
 
-		// Content lines
+		// "\ No newline at end of file" markers carry no content
+		if strings.HasPrefix(rawLine, "\\") {
+			continue
+		}
+
+		// Content lines keep their indentation so they can be matched against the file
 		if currentHunk != nil {
 			lineType := " "
-			content := line
+			content := strings.TrimPrefix(rawLine, " ")
 
-			if strings.HasPrefix(line, "+") {
+			if strings.HasPrefix(rawLine, "+") {
 				lineType = "+"
-				content = strings.TrimPrefix(line, "+")
-			} else if strings.HasPrefix(line, "-") {
+				content = strings.TrimPrefix(rawLine, "+")
+			} else if strings.HasPrefix(rawLine, "-") {
 				lineType = "-"
-				content = strings.TrimPrefix(line, "-")
+				content = strings.TrimPrefix(rawLine, "-")
 			}
 
 			currentHunk.Lines = append(currentHunk.Lines, DiffLine{
@@ -489,14 +926,97 @@ func parseDiff(diffOutput string) ([]DiffChange, error) {
 	}
 
 	// Add the last change and hunk
-	if currentChange != nil {
-		if currentHunk != nil {
-			currentChange.Hunks = append(currentChange.Hunks, *currentHunk)
+	flush()
+
+	return changes, nil
+}
+
+// parseExtendedHeader applies a git extended header line to change, reporting whether it was one
+func parseExtendedHeader(line string, change *DiffChange) (bool, error) {
+	switch {
+	case strings.HasPrefix(line, "new file mode "):
+		change.IsNew = true
+		mode, err := parseMode(strings.TrimPrefix(line, "new file mode "))
+		if err != nil {
+			return true, err
 		}
-		changes = append(changes, *currentChange)
+		change.NewMode = mode
+	case strings.HasPrefix(line, "deleted file mode "):
+		change.IsDeleted = true
+	case strings.HasPrefix(line, "new mode "):
+		mode, err := parseMode(strings.TrimPrefix(line, "new mode "))
+		if err != nil {
+			return true, err
+		}
+		change.NewMode = mode
+	case strings.HasPrefix(line, "rename from "):
+		change.IsRename = true
+		change.OldPath = strings.TrimPrefix(line, "rename from ")
+	case strings.HasPrefix(line, "rename to "):
+		change.IsRename = true
+		change.FilePath = strings.TrimPrefix(line, "rename to ")
+	case strings.HasPrefix(line, "copy from "):
+		change.IsCopy = true
+		change.OldPath = strings.TrimPrefix(line, "copy from ")
+	case strings.HasPrefix(line, "copy to "):
+		change.IsCopy = true
+		change.FilePath = strings.TrimPrefix(line, "copy to ")
+	case strings.HasPrefix(line, "old mode "),
+		strings.HasPrefix(line, "similarity index "),
+		strings.HasPrefix(line, "dissimilarity index "),
+		strings.HasPrefix(line, "index "),
+		strings.HasPrefix(line, "Binary files "):
+		// Informational only
+	default:
+		return false, nil
 	}
+	return true, nil
+}
 
-	return changes, nil
+// parseGitHeaderPaths splits the "a/old b/new" part of a diff --git header
+func parseGitHeaderPaths(paths string) (oldPath, newPath string) {
+	// Paths may contain spaces, so split on the " b/" separator rather than on whitespace
+	if idx := strings.Index(paths, " b/"); idx >= 0 {
+		return strings.TrimPrefix(paths[:idx], "a/"), paths[idx+len(" b/"):]
+	}
+	parts := strings.Fields(paths)
+	if len(parts) == 2 {
+		return strings.TrimPrefix(parts[0], "a/"), strings.TrimPrefix(parts[1], "b/")
+	}
+	return "", ""
+}
+
+// parseHeaderPath extracts the path from a ---/+++ header, dropping the a/ or b/ prefix and any timestamp
+func parseHeaderPath(header, prefix string) string {
+	if idx := strings.Index(header, "\t"); idx >= 0 {
+		header = header[:idx]
+	}
+	header = strings.TrimSpace(header)
+	if header == "/dev/null" {
+		return header
+	}
+	return strings.TrimPrefix(header, prefix)
+}
+
+// parseMode parses an octal git file mode such as 100755 into permission bits
+func parseMode(mode string) (os.FileMode, error) {
+	value, err := strconv.ParseUint(strings.TrimSpace(mode), 8, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid file mode %q: %v", mode, err)
+	}
+	return os.FileMode(value) & os.ModePerm, nil
+}
+
+// finishHunk drops trailing blank context lines picked up from the gap between hunks or files
+func finishHunk(hunk DiffHunk) DiffHunk {
+	for len(hunk.Lines) > 0 {
+		last := hunk.Lines[len(hunk.Lines)-1]
+		if last.Type != " " || strings.TrimSpace(last.Content) != "" {
+			break
+		}
+		hunk.Lines = hunk.Lines[:len(hunk.Lines)-1]
+	}
+	return hunk
 }
 
 // parseRange parses a range like "10,5" into start and count
@@ -513,65 +1033,199 @@ func parseRange(rangeStr string) (start, count int) {
 	return start, count
 }
 
-// applyFileChange applies changes to a single file
-func applyFileChange(change DiffChange, repoPath string) error {
-	filePath := filepath.Join(repoPath, change.FilePath)
+// applyFileChange applies a single file change to the in-memory patch state
+// and returns a description of the change
+func applyFileChange(change DiffChange, repoPath string, state *patchState, fuzz int, resolve ConflictResolver) (string, error) {
+	filePath := resolvePath(change.FilePath, repoPath)
+	sourcePath := filePath
+	if change.OldPath != "" {
+		sourcePath = resolvePath(change.OldPath, repoPath)
+	}
 
-	// Read current file content
-	content, err := os.ReadFile(filePath)
+	source, err := state.file(sourcePath)
 	if err != nil {
-		return fmt.Errorf("failed to read file: %v", err)
+		return "", err
+	}
+	target, err := state.file(filePath)
+	if err != nil {
+		return "", err
 	}
 
-	lines := strings.Split(string(content), "\n")
+	// Read current file content; new files start out empty
+	var lines []string
+	if change.IsNew {
+		if target.exists {
+			return "", fmt.Errorf("file already exists")
+		}
+	} else {
+		if !source.exists {
+			return "", fmt.Errorf("failed to read file: %s does not exist", change.FilePath)
+		}
+		lines = strings.Split(source.content, "\n")
+	}
 
 	// Apply changes in reverse order to maintain line numbers
 	for i := len(change.Hunks) - 1; i >= 0; i-- {
-		hunk := change.Hunks[i]
-		lines = applyHunk(lines, hunk)
+		applied, err := applyHunk(lines, change.Hunks[i], fuzz)
+		if err != nil && resolve != nil {
+			applied, err = resolveHunk(resolve, change.FilePath, lines, change.Hunks[i])
+		}
+		if err != nil {
+			return "", err
+		}
+		lines = applied
+	}
+
+	// Deleted files only need their hunks to match before being removed
+	if change.IsDeleted {
+		*source = patchFile{}
+		return fmt.Sprintf("Deleted: %s", change.FilePath), nil
 	}
 
-	// Write modified content back to file
 	newContent := strings.Join(lines, "\n")
-	if !strings.HasSuffix(newContent, "\n") {
+	if newContent != "" && !strings.HasSuffix(newContent, "\n") {
 		newContent += "\n"
 	}
 
-	if err := os.WriteFile(filePath, []byte(newContent), 0644); err != nil {
-		return fmt.Errorf("failed to write file: %v", err)
+	perm := source.perm
+	if !source.exists {
+		perm = 0644
+	}
+	if change.NewMode != 0 {
+		perm = change.NewMode
 	}
 
-	fmt.Printf("Applied changes to: %s\n", change.FilePath)
-	return nil
+	*target = patchFile{exists: true, content: newContent, perm: perm}
+
+	switch {
+	case change.IsRename && sourcePath != filePath:
+		*source = patchFile{}
+		return fmt.Sprintf("Renamed: %s -> %s", change.OldPath, change.FilePath), nil
+	case change.IsCopy:
+		return fmt.Sprintf("Copied: %s -> %s", change.OldPath, change.FilePath), nil
+	case change.IsNew:
+		return fmt.Sprintf("Created: %s", change.FilePath), nil
+	default:
+		return fmt.Sprintf("Applied changes to: %s", change.FilePath), nil
+	}
 }
 
-// applyHunk applies a single hunk to the file lines
-func applyHunk(lines []string, hunk DiffHunk) []string {
-	// Convert to 0-based indexing
-	start := hunk.OldStart - 1
+// patchFuzz is the number of leading/trailing context lines a hunk may ignore when it is located
+var patchFuzz = 2
 
-	// Remove old lines
-	if hunk.OldCount > 0 {
-		end := start + hunk.OldCount
-		if end > len(lines) {
-			end = len(lines)
-		}
-		lines = append(lines[:start], lines[end:]...)
+// SetPatchFuzz sets how many context lines may be ignored when locating a hunk
+func SetPatchFuzz(fuzz int) {
+	if fuzz < 0 {
+		fuzz = 0
 	}
+	patchFuzz = fuzz
+}
 
-	// Insert new lines
-	newLines := make([]string, 0, len(hunk.Lines))
+// applyHunk locates a hunk by its context and removed lines and applies it.
+// The hunk's line numbers are only used as a starting point for the search;
+// the nearest position where the old lines match is used. If no exact match
+// exists, up to fuzz leading and trailing context lines are ignored. Removed
+// lines must always match the file, and a hunk that cannot be located is
+// rejected rather than applied at the wrong place.
+func applyHunk(lines []string, hunk DiffHunk, fuzz int) ([]string, error) {
+	var oldLines, newLines []string
 	for _, line := range hunk.Lines {
-		if line.Type == "+" || line.Type == " " {
+		switch line.Type {
+		case " ":
+			oldLines = append(oldLines, line.Content)
+			newLines = append(newLines, line.Content)
+		case "-":
+			oldLines = append(oldLines, line.Content)
+		case "+":
 			newLines = append(newLines, line.Content)
 		}
 	}
 
-	if len(newLines) > 0 {
-		lines = append(lines[:start], append(newLines, lines[start:]...)...)
+	leading, trailing := contextBounds(hunk.Lines)
+
+	// Convert to 0-based indexing; a hunk that removes nothing inserts after OldStart
+	expected := hunk.OldStart - 1
+	if hunk.OldCount == 0 {
+		expected = hunk.OldStart
+	}
+
+	for f := 0; f <= fuzz; f++ {
+		dropLeading := min(f, leading)
+		dropTrailing := min(f, trailing)
+		if f > 0 && dropLeading < f && dropTrailing < f {
+			// No more context left to ignore
+			break
+		}
+
+		old := oldLines[dropLeading : len(oldLines)-dropTrailing]
+		replacement := newLines[dropLeading : len(newLines)-dropTrailing]
+
+		pos := findHunk(lines, old, expected+dropLeading)
+		if pos < 0 {
+			continue
+		}
+
+		result := make([]string, 0, len(lines)-len(old)+len(replacement))
+		result = append(result, lines[:pos]...)
+		result = append(result, replacement...)
+		result = append(result, lines[pos+len(old):]...)
+		return result, nil
+	}
+
+	return nil, fmt.Errorf("hunk @@ -%d,%d +%d,%d @@ does not match file content",
+		hunk.OldStart, hunk.OldCount, hunk.NewStart, hunk.NewCount)
+}
+
+// contextBounds counts the context lines at the start and end of a hunk
+func contextBounds(lines []DiffLine) (leading, trailing int) {
+	for leading < len(lines) && lines[leading].Type == " " {
+		leading++
+	}
+	if leading == len(lines) {
+		// A hunk made only of context has nothing to anchor on either side
+		return 0, 0
 	}
+	for trailing < len(lines) && lines[len(lines)-1-trailing].Type == " " {
+		trailing++
+	}
+	return leading, trailing
+}
 
-	return lines
+// findHunk returns the position nearest to expected at which old matches lines, or -1
+func findHunk(lines, old []string, expected int) int {
+	if expected < 0 {
+		expected = 0
+	}
+	if expected > len(lines) {
+		expected = len(lines)
+	}
+
+	for offset := 0; ; offset++ {
+		after := expected + offset
+		before := expected - offset
+		if after+len(old) > len(lines) && before < 0 {
+			return -1
+		}
+		if after+len(old) <= len(lines) && matchLines(lines[after:], old) {
+			return after
+		}
+		if offset > 0 && before >= 0 && matchLines(lines[before:], old) {
+			return before
+		}
+	}
+}
+
+// matchLines reports whether lines starts with old, ignoring trailing whitespace
+func matchLines(lines, old []string) bool {
+	if len(old) > len(lines) {
+		return false
+	}
+	for i, want := range old {
+		if strings.TrimRight(lines[i], " \t\r") != strings.TrimRight(want, " \t\r") {
+			return false
+		}
+	}
+	return true
 }
 
 func isTextFile(content []byte) bool {
@@ -0,0 +1,1519 @@
+package tools
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"unicode/utf8"
+
+	"github.com/kek/slop-shop/ollama"
+	"github.com/kek/slop-shop/repo"
+)
+
+func TestApplyHunkWithOffset(t *testing.T) {
+	lines := []string{"package main", "", "import \"fmt\"", "", "func main() {", "\tfmt.Println(\"hi\")", "}"}
+
+	// The hunk claims to start at line 3, but the context actually begins at line 5
+	hunk := DiffHunk{
+		OldStart: 3,
+		OldCount: 3,
+		NewStart: 3,
+		NewCount: 3,
+		Lines: []DiffLine{
+			{Type: " ", Content: "func main() {"},
+			{Type: "-", Content: "\tfmt.Println(\"hi\")"},
+			{Type: "+", Content: "\tfmt.Println(\"hello\")"},
+			{Type: " ", Content: "}"},
+		},
+	}
+
+	result, err := applyHunk(lines, hunk, 0)
+	if err != nil {
+		t.Fatalf("Expected hunk to apply, got error: %v", err)
+	}
+
+	if result[5] != "\tfmt.Println(\"hello\")" {
+		t.Errorf("Expected line 6 to be replaced, got %q", result[5])
+	}
+	if len(result) != len(lines) {
+		t.Errorf("Expected %d lines, got %d", len(lines), len(result))
+	}
+}
+
+func TestApplyHunkWithFuzz(t *testing.T) {
+	lines := []string{"one", "two", "three", "four", "five"}
+
+	// The leading context line is wrong, so the hunk only applies with fuzz
+	hunk := DiffHunk{
+		OldStart: 2,
+		OldCount: 3,
+		NewStart: 2,
+		NewCount: 3,
+		Lines: []DiffLine{
+			{Type: " ", Content: "TWO"},
+			{Type: "-", Content: "three"},
+			{Type: "+", Content: "3"},
+			{Type: " ", Content: "four"},
+		},
+	}
+
+	if _, err := applyHunk(lines, hunk, 0); err == nil {
+		t.Error("Expected hunk with mismatched context to be rejected without fuzz")
+	}
+
+	result, err := applyHunk(lines, hunk, 1)
+	if err != nil {
+		t.Fatalf("Expected hunk to apply with fuzz 1, got error: %v", err)
+	}
+
+	expected := []string{"one", "two", "3", "four", "five"}
+	if strings.Join(result, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("Expected %q, got %q", expected, result)
+	}
+}
+
+func TestApplyHunkRejectsMismatchedRemovals(t *testing.T) {
+	lines := []string{"alpha", "beta", "gamma"}
+
+	hunk := DiffHunk{
+		OldStart: 2,
+		OldCount: 1,
+		NewStart: 2,
+		NewCount: 1,
+		Lines: []DiffLine{
+			{Type: "-", Content: "delta"},
+			{Type: "+", Content: "epsilon"},
+		},
+	}
+
+	if _, err := applyHunk(lines, hunk, 3); err == nil {
+		t.Error("Expected hunk removing a non-existent line to be rejected")
+	}
+}
+
+func TestApplyDiffLeavesFileUntouchedOnMismatch(t *testing.T) {
+	tempDir := t.TempDir()
+	original := "line1\nline2\nline3\n"
+	filePath := filepath.Join(tempDir, "file.txt")
+	if err := os.WriteFile(filePath, []byte(original), 0644); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+
+	diff := "--- a/file.txt\n+++ b/file.txt\n@@ -1,2 +1,2 @@\n line1\n-something else\n+line2 changed\n"
+	if err := applyDiff(diff, tempDir); err == nil {
+		t.Error("Expected applyDiff to fail for a non-matching hunk")
+	}
+
+	content, err := os.ReadFile(filePath)
+	if err != nil {
+		t.Fatalf("Failed to read file: %v", err)
+	}
+	if string(content) != original {
+		t.Errorf("Expected file to be unchanged, got %q", string(content))
+	}
+}
+
+func TestApplyDiffPreservesIndentation(t *testing.T) {
+	tempDir := t.TempDir()
+	filePath := filepath.Join(tempDir, "main.go")
+	original := "func main() {\n\tx := 1\n\treturn\n}\n"
+	if err := os.WriteFile(filePath, []byte(original), 0644); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+
+	diff := "--- a/main.go\n+++ b/main.go\n@@ -1,4 +1,4 @@\n func main() {\n-\tx := 1\n+\tx := 2\n \treturn\n }\n"
+	if err := applyDiff(diff, tempDir); err != nil {
+		t.Fatalf("Expected diff to apply, got error: %v", err)
+	}
+
+	content, err := os.ReadFile(filePath)
+	if err != nil {
+		t.Fatalf("Failed to read file: %v", err)
+	}
+
+	expected := "func main() {\n\tx := 2\n\treturn\n}\n"
+	if string(content) != expected {
+		t.Errorf("Expected %q, got %q", expected, string(content))
+	}
+}
+
+func TestParseDiffExtendedHeaders(t *testing.T) {
+	diff := `diff --git a/old.txt b/new.txt
+similarity index 90%
+rename from old.txt
+rename to new.txt
+--- a/old.txt
++++ b/new.txt
+@@ -1,2 +1,2 @@
+ keep
+-drop
++add
+diff --git a/script.sh b/script.sh
+old mode 100644
+new mode 100755
+diff --git a/created.txt b/created.txt
+new file mode 100644
+--- /dev/null
++++ b/created.txt
+@@ -0,0 +1,2 @@
++hello
++world
+--- a/gone.txt
++++ /dev/null
+@@ -1 +0,0 @@
+-bye
+`
+
+	changes, err := parseDiff(diff)
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if len(changes) != 4 {
+		t.Fatalf("Expected 4 changes, got %d", len(changes))
+	}
+
+	rename := changes[0]
+	if !rename.IsRename || rename.OldPath != "old.txt" || rename.FilePath != "new.txt" {
+		t.Errorf("Expected rename old.txt -> new.txt, got %+v", rename)
+	}
+
+	mode := changes[1]
+	if mode.FilePath != "script.sh" || mode.NewMode != 0755 || len(mode.Hunks) != 0 {
+		t.Errorf("Expected mode change on script.sh, got %+v", mode)
+	}
+
+	created := changes[2]
+	if !created.IsNew || created.FilePath != "created.txt" {
+		t.Errorf("Expected new file created.txt, got %+v", created)
+	}
+
+	deleted := changes[3]
+	if !deleted.IsDeleted || deleted.FilePath != "gone.txt" {
+		t.Errorf("Expected deletion of gone.txt, got %+v", deleted)
+	}
+}
+
+func TestApplyDiffCreatesDeletesAndRenames(t *testing.T) {
+	tempDir := t.TempDir()
+	files := map[string]string{
+		"old.txt":   "keep\ndrop\n",
+		"gone.txt":  "bye\n",
+		"script.sh": "echo hi\n",
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(tempDir, name), []byte(content), 0644); err != nil {
+			t.Fatalf("Failed to write %s: %v", name, err)
+		}
+	}
+
+	diff := `diff --git a/old.txt b/moved/new.txt
+rename from old.txt
+rename to moved/new.txt
+--- a/old.txt
++++ b/moved/new.txt
+@@ -1,2 +1,2 @@
+ keep
+-drop
++add
+diff --git a/script.sh b/script.sh
+old mode 100644
+new mode 100755
+diff --git a/created.txt b/created.txt
+new file mode 100644
+--- /dev/null
++++ b/created.txt
+@@ -0,0 +1,2 @@
++hello
++world
+--- a/gone.txt
++++ /dev/null
+@@ -1 +0,0 @@
+-bye
+`
+
+	if err := applyDiff(diff, tempDir); err != nil {
+		t.Fatalf("Expected diff to apply, got error: %v", err)
+	}
+
+	if _, err := os.Stat(filepath.Join(tempDir, "old.txt")); !os.IsNotExist(err) {
+		t.Error("Expected old.txt to be removed by the rename")
+	}
+	if content, _ := os.ReadFile(filepath.Join(tempDir, "moved/new.txt")); string(content) != "keep\nadd\n" {
+		t.Errorf("Expected renamed file content %q, got %q", "keep\nadd\n", string(content))
+	}
+	if content, _ := os.ReadFile(filepath.Join(tempDir, "created.txt")); string(content) != "hello\nworld\n" {
+		t.Errorf("Expected created file content %q, got %q", "hello\nworld\n", string(content))
+	}
+	if _, err := os.Stat(filepath.Join(tempDir, "gone.txt")); !os.IsNotExist(err) {
+		t.Error("Expected gone.txt to be deleted")
+	}
+	if info, err := os.Stat(filepath.Join(tempDir, "script.sh")); err != nil || info.Mode().Perm() != 0755 {
+		t.Errorf("Expected script.sh to be executable, got %v (err: %v)", info.Mode().Perm(), err)
+	}
+}
+
+func TestExecuteToolsMultiLineApplyDiff(t *testing.T) {
+	testCases := []struct {
+		name     string
+		response string
+	}{
+		{
+			name:     "BEGIN_DIFF block",
+			response: "Applying the change:\n\nAPPLY_DIFF:\nBEGIN_DIFF\n--- a/notes.txt\n+++ b/notes.txt\n@@ -1,2 +1,2 @@\n first\n-second\n+2nd\nEND_DIFF\n\nDone.",
+		},
+		{
+			name:     "fenced block",
+			response: "APPLY_DIFF:\n```diff\n--- a/notes.txt\n+++ b/notes.txt\n@@ -1,2 +1,2 @@\n first\n-second\n+2nd\n```\n",
+		},
+		{
+			name:     "indented block",
+			response: "   APPLY_DIFF:\n   BEGIN_DIFF\n   --- a/notes.txt\n   +++ b/notes.txt\n   @@ -1,2 +1,2 @@\n    first\n   -second\n   +2nd\n   END_DIFF\n",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			tempDir := t.TempDir()
+			filePath := filepath.Join(tempDir, "notes.txt")
+			if err := os.WriteFile(filePath, []byte("first\nsecond\n"), 0644); err != nil {
+				t.Fatalf("Failed to write file: %v", err)
+			}
+
+			ExecuteTools(tc.response, tempDir, nil)
+
+			content, err := os.ReadFile(filePath)
+			if err != nil {
+				t.Fatalf("Failed to read file: %v", err)
+			}
+			if string(content) != "first\n2nd\n" {
+				t.Errorf("Expected %q, got %q", "first\n2nd\n", string(content))
+			}
+		})
+	}
+}
+
+func TestParseToolCallsCreateFileUsesDirectivePosition(t *testing.T) {
+	// Several lines precede the directive, so content must not start at the tool count
+	response := `I'll start by looking around.
+
+LIST_DIR: .
+Now I'll create the file.
+
+CREATE_FILE: docs/notes.md
+# Notes
+
+READ_FILE: this line is file content, not a tool call
+END_FILE
+
+That's all.`
+
+	calls := ParseToolCalls(response)
+	if len(calls) != 2 {
+		t.Fatalf("Expected 2 tool calls, got %d: %+v", len(calls), calls)
+	}
+
+	if calls[0].Name != "LIST_DIR" || calls[0].Args != "." {
+		t.Errorf("Expected LIST_DIR ., got %+v", calls[0])
+	}
+
+	create := calls[1]
+	if create.Name != "CREATE_FILE" || create.Args != "docs/notes.md" {
+		t.Errorf("Expected CREATE_FILE docs/notes.md, got %+v", create)
+	}
+
+	expected := "# Notes\n\nREAD_FILE: this line is file content, not a tool call"
+	if create.Body != expected {
+		t.Errorf("Expected body %q, got %q", expected, create.Body)
+	}
+	if create.Line != 6 {
+		t.Errorf("Expected directive on line 6, got %d", create.Line)
+	}
+}
+
+func TestParseToolCallsStripsCodeFence(t *testing.T) {
+	response := "CREATE_FILE: main.go\n```go\npackage main\n```\nEND_FILE"
+
+	calls := ParseToolCalls(response)
+	if len(calls) != 1 {
+		t.Fatalf("Expected 1 tool call, got %d", len(calls))
+	}
+	if calls[0].Body != "package main" {
+		t.Errorf("Expected fenced content to be unwrapped, got %q", calls[0].Body)
+	}
+}
+
+func TestExecuteToolsCreateFileContent(t *testing.T) {
+	tempDir := t.TempDir()
+	response := "Some preamble\nmore preamble\n\nCREATE_FILE: hello.txt\nHello, world!\nSecond line\nEND_FILE\n"
+
+	ExecuteTools(response, tempDir, nil)
+
+	content, err := os.ReadFile(filepath.Join(tempDir, "hello.txt"))
+	if err != nil {
+		t.Fatalf("Expected file to be created: %v", err)
+	}
+	if string(content) != "Hello, world!\nSecond line" {
+		t.Errorf("Expected %q, got %q", "Hello, world!\nSecond line", string(content))
+	}
+}
+
+func TestParseSearchArgs(t *testing.T) {
+	testCases := []struct {
+		args      string
+		pattern   string
+		directory string
+	}{
+		{`"func main" .`, "func main", "."},
+		{`"import" src/`, "import", "src/"},
+		{`TODO tools`, "TODO", "tools"},
+		{`TODO`, "TODO", "."},
+	}
+
+	for _, tc := range testCases {
+		pattern, directory := parseSearchArgs(tc.args)
+		if pattern != tc.pattern || directory != tc.directory {
+			t.Errorf("parseSearchArgs(%q) = (%q, %q), expected (%q, %q)", tc.args, pattern, directory, tc.pattern, tc.directory)
+		}
+	}
+}
+
+func TestExecuteCommandStreamsOutput(t *testing.T) {
+	original := commandOutputHandler
+	defer SetCommandOutputHandler(original)
+
+	var streamed []string
+	SetCommandOutputHandler(func(line string) {
+		streamed = append(streamed, line)
+	})
+
+	result, err := executeCommand("echo first; echo second 1>&2; printf third", t.TempDir())
+	if err != nil {
+		t.Fatalf("Expected command to succeed, got: %v", err)
+	}
+
+	expected := []string{"first", "second", "third"}
+	if strings.Join(streamed, ",") != strings.Join(expected, ",") {
+		t.Errorf("Expected streamed lines %q, got %q", expected, streamed)
+	}
+
+	if !strings.Contains(result, "first\nsecond\nthird") {
+		t.Errorf("Expected full output in result, got %q", result)
+	}
+}
+
+func TestExecuteToolsReturnsStructuredResults(t *testing.T) {
+	tempDir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(tempDir, "present.txt"), []byte("content"), 0644); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+
+	response := "RUN_COMMAND: exit 3\nREAD_FILE: present.txt\nREAD_FILE: missing.txt"
+	results := ExecuteTools(response, tempDir, nil)
+
+	if len(results) != 3 {
+		t.Fatalf("Expected 3 results, got %d", len(results))
+	}
+
+	command := results[0]
+	if command.Tool != "RUN_COMMAND" || command.Args != "exit 3" {
+		t.Errorf("Expected RUN_COMMAND exit 3, got %+v", command)
+	}
+	if command.Success || command.ExitCode != 3 {
+		t.Errorf("Expected failed command with exit code 3, got success=%t exit=%d", command.Success, command.ExitCode)
+	}
+
+	if !results[1].Success || results[1].ExitCode != 0 || !strings.Contains(results[1].Output, "content") {
+		t.Errorf("Expected successful read with file content, got %+v", results[1])
+	}
+
+	if results[2].Success || results[2].ExitCode == 0 {
+		t.Errorf("Expected reading a missing file to fail, got %+v", results[2])
+	}
+
+	formatted := FormatResults(results)
+	if !strings.Contains(formatted, "Tool Execution Results") || !strings.Contains(formatted, "READ_FILE: present.txt") {
+		t.Errorf("Expected formatted results to list tool calls, got %q", formatted)
+	}
+}
+
+func TestGenerateDiffUsesConfiguredClient(t *testing.T) {
+	var requestedModel string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var request ollama.Request
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			t.Errorf("Failed to decode request: %v", err)
+		}
+		requestedModel = request.Model
+		fmt.Fprintln(w, `{"response":"--- a/x\n+++ b/x\n","done":true}`)
+	}))
+	defer server.Close()
+
+	client := ollama.NewClient(server.URL, "custom-model", 0.2, 0.5)
+	results := ExecuteTools("GENERATE_DIFF: rename a variable", t.TempDir(), client)
+
+	if len(results) != 1 || !results[0].Success {
+		t.Fatalf("Expected successful GENERATE_DIFF, got %+v", results)
+	}
+	if requestedModel != "custom-model" {
+		t.Errorf("Expected diff to be generated with custom-model, got %q", requestedModel)
+	}
+	if !strings.Contains(results[0].Output, "Generated diff") {
+		t.Errorf("Expected generated diff in output, got %q", results[0].Output)
+	}
+}
+
+func TestCustomToolExecution(t *testing.T) {
+	defer RegisterCustomTools(nil)
+
+	err := RegisterCustomTools([]CustomTool{{
+		Name:        "GREET",
+		Description: "Write a greeting to a file",
+		Args: []CustomToolArg{
+			{Name: "file", Required: true},
+			{Name: "name", Default: "world"},
+		},
+		Command: "echo hello {{.name}} > {{.file}}",
+	}})
+	if err != nil {
+		t.Fatalf("Expected custom tool to register, got: %v", err)
+	}
+
+	if !strings.Contains(CustomToolInstructions(), "GREET: <file> <name>") {
+		t.Errorf("Expected instructions to describe GREET, got %q", CustomToolInstructions())
+	}
+
+	tempDir := t.TempDir()
+	results := ExecuteTools("GREET: out.txt Ada; touch pwned", tempDir, nil)
+	if len(results) != 1 || !results[0].Success {
+		t.Fatalf("Expected GREET to succeed, got %+v", results)
+	}
+
+	content, err := os.ReadFile(filepath.Join(tempDir, "out.txt"))
+	if err != nil {
+		t.Fatalf("Expected output file: %v", err)
+	}
+	if string(content) != "hello Ada; touch pwned\n" {
+		t.Errorf("Expected arguments to be passed literally, got %q", string(content))
+	}
+	if _, err := os.Stat(filepath.Join(tempDir, "pwned")); !os.IsNotExist(err) {
+		t.Error("Expected shell metacharacters in arguments to be quoted")
+	}
+
+	results = ExecuteTools("GREET:", tempDir, nil)
+	if len(results) != 1 || results[0].Success {
+		t.Errorf("Expected GREET without its required argument to fail, got %+v", results)
+	}
+}
+
+func TestRegisterCustomToolsValidation(t *testing.T) {
+	defer RegisterCustomTools(nil)
+
+	invalid := []CustomTool{
+		{Name: "lower_case", Command: "true"},
+		{Name: "READ_FILE", Command: "true"},
+		{Name: "NO_COMMAND"},
+		{Name: "BAD_TEMPLATE", Command: "echo {{.x"},
+	}
+	for _, tool := range invalid {
+		if err := RegisterCustomTools([]CustomTool{tool}); err == nil {
+			t.Errorf("Expected %s to be rejected", tool.Name)
+		}
+	}
+}
+
+func TestShellSessionPersistsState(t *testing.T) {
+	defer CloseShell()
+
+	tempDir := t.TempDir()
+	if err := os.Mkdir(filepath.Join(tempDir, "sub"), 0755); err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+
+	response := "SHELL: cd sub\nSHELL: export GREETING=hi\nSHELL: echo $GREETING from $(basename $(pwd))\nSHELL: false"
+	results := ExecuteTools(response, tempDir, nil)
+	if len(results) != 4 {
+		t.Fatalf("Expected 4 results, got %d", len(results))
+	}
+
+	if !strings.Contains(results[2].Output, "hi from sub") {
+		t.Errorf("Expected directory and environment to persist, got %q", results[2].Output)
+	}
+	if results[3].Success || results[3].ExitCode != 1 {
+		t.Errorf("Expected false to fail with exit code 1, got %+v", results[3])
+	}
+
+	// A session that exits is restarted on the next call
+	results = ExecuteTools("SHELL: exit 0\nSHELL: echo restarted", tempDir, nil)
+	if len(results) != 2 || !strings.Contains(results[1].Output, "restarted") {
+		t.Errorf("Expected shell to restart after exit, got %+v", results)
+	}
+}
+
+func TestParseDiagnostics(t *testing.T) {
+	tempDir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(tempDir, "main.go"), []byte("package main\n"), 0644); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+
+	output := "# example.com/demo\nvet: ./main.go:12:3: unreachable code\nutil.go:4: missing return\nmain.go\n"
+	diagnostics := parseDiagnostics(output, "go", tempDir)
+
+	if len(diagnostics) != 3 {
+		t.Fatalf("Expected 3 diagnostics, got %d: %+v", len(diagnostics), diagnostics)
+	}
+
+	first := diagnostics[0]
+	if first.File != "main.go" || first.Line != 12 || first.Column != 3 || first.Message != "unreachable code" {
+		t.Errorf("Unexpected first diagnostic: %+v", first)
+	}
+	if diagnostics[1].File != "util.go" || diagnostics[1].Line != 4 || diagnostics[1].Column != 0 {
+		t.Errorf("Unexpected second diagnostic: %+v", diagnostics[1])
+	}
+	if diagnostics[2].File != "main.go" || diagnostics[2].Message != "reformatted" {
+		t.Errorf("Expected bare file name to be reported as reformatted, got %+v", diagnostics[2])
+	}
+}
+
+func TestLintToolReportsDiagnostics(t *testing.T) {
+	original := lintCommands["go"]
+	defer func() { lintCommands["go"] = original }()
+	SetLintCommands(map[string]LintCommands{
+		"go": {Lint: []string{"go vet ./..."}, Format: []string{"gofmt -l -w ."}},
+	})
+
+	tempDir := t.TempDir()
+	files := map[string]string{
+		"go.mod":  "module example.com/demo\n\ngo 1.21\n",
+		"main.go": "package main\n\nimport \"fmt\"\n\nfunc main() {\n\tfmt.Printf(\"%d\\n\", \"text\")\n}\n",
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(tempDir, name), []byte(content), 0644); err != nil {
+			t.Fatalf("Failed to write %s: %v", name, err)
+		}
+	}
+
+	results := ExecuteTools("LINT:", tempDir, nil)
+	if len(results) != 1 {
+		t.Fatalf("Expected 1 result, got %d", len(results))
+	}
+
+	lint := results[0]
+	if lint.Success {
+		t.Error("Expected LINT to fail when vet reports problems")
+	}
+	if len(lint.Diagnostics) == 0 || lint.Diagnostics[0].File != "main.go" || lint.Diagnostics[0].Line != 6 {
+		t.Errorf("Expected a diagnostic for main.go:6, got %+v", lint.Diagnostics)
+	}
+
+	// FORMAT rewrites the badly formatted file and reports it
+	if err := os.WriteFile(filepath.Join(tempDir, "main.go"), []byte("package main\nfunc main()  {}\n"), 0644); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+	results = ExecuteTools("FORMAT: go", tempDir, nil)
+	if len(results) != 1 || !results[0].Success || len(results[0].Diagnostics) != 1 {
+		t.Fatalf("Expected FORMAT to report one reformatted file, got %+v", results)
+	}
+}
+
+func TestShellSelection(t *testing.T) {
+	defer SetShell("")
+
+	if err := SetShell("fish"); err == nil {
+		t.Error("Expected unsupported shell to be rejected")
+	}
+
+	testCases := []struct {
+		shell   string
+		args    []string
+		quoted  string
+		isPOSIX bool
+	}{
+		{"sh", []string{"sh", "-c", "echo hi"}, `'it'\''s'`, true},
+		{"cmd", []string{"cmd", "/C", "echo hi"}, `"it's"`, false},
+		{"pwsh", []string{"pwsh", "-NoProfile", "-NonInteractive", "-Command", "echo hi"}, `'it''s'`, false},
+	}
+
+	for _, tc := range testCases {
+		if err := SetShell(tc.shell); err != nil {
+			t.Fatalf("Expected %s to be accepted, got: %v", tc.shell, err)
+		}
+
+		cmd := shellCommand("echo hi")
+		if strings.Join(cmd.Args, " ") != strings.Join(tc.args, " ") {
+			t.Errorf("%s: expected args %q, got %q", tc.shell, tc.args, cmd.Args)
+		}
+		if quoted, _ := quoteArg("it's"); quoted != tc.quoted {
+			t.Errorf("%s: expected quoted %s, got %s", tc.shell, tc.quoted, quoted)
+		}
+		if isPOSIXShell() != tc.isPOSIX {
+			t.Errorf("%s: expected isPOSIXShell %t", tc.shell, tc.isPOSIX)
+		}
+	}
+
+	// cmd expands variables inside quotes, so values it would expand are refused
+	SetShell("cmd")
+	for _, value := range []string{"%PATH%", "!TOKEN!", "a\r\ndel *"} {
+		if quoted, err := quoteArg(value); err == nil {
+			t.Errorf("Expected %q to be refused for cmd, got %s", value, quoted)
+		}
+	}
+	if quoted, err := quoteArg(`x" & calc & "`); err != nil || quoted != `"x"" & calc & """` {
+		t.Errorf("Expected quotes to be doubled for cmd, got %s, %v", quoted, err)
+	}
+	grep := CustomTool{Name: "GREP", Command: "findstr {{.pattern}}", Args: []CustomToolArg{{Name: "pattern"}}}
+	if _, err := renderCustomCommand(grep, "%USERPROFILE%"); err == nil {
+		t.Error("Expected a custom tool argument cmd would expand to be refused")
+	}
+	SetShell("sh")
+	if command, err := renderCustomCommand(grep, "%USERPROFILE%"); err != nil || command != "findstr '%USERPROFILE%'" {
+		t.Errorf("Expected the argument to be quoted for sh, got %q, %v", command, err)
+	}
+}
+
+func TestReadFileAcceptsForwardSlashPaths(t *testing.T) {
+	tempDir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(tempDir, "nested", "dir"), 0755); err != nil {
+		t.Fatalf("Failed to create directories: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(tempDir, "nested", "dir", "file.txt"), []byte("found"), 0644); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+
+	output, err := readFileContent("nested/dir/file.txt", tempDir)
+	if err != nil || !strings.Contains(output, "found") {
+		t.Errorf("Expected file to be read, got %q (err: %v)", output, err)
+	}
+}
+
+func TestExecuteToolsRunsReadOnlyCallsInOrder(t *testing.T) {
+	tempDir := t.TempDir()
+	for i := 1; i <= 6; i++ {
+		name := fmt.Sprintf("file%d.txt", i)
+		if err := os.WriteFile(filepath.Join(tempDir, name), []byte(fmt.Sprintf("content %d", i)), 0644); err != nil {
+			t.Fatalf("Failed to write file: %v", err)
+		}
+	}
+
+	var response strings.Builder
+	for i := 1; i <= 3; i++ {
+		response.WriteString(fmt.Sprintf("READ_FILE: file%d.txt\n", i))
+	}
+	response.WriteString("CREATE_FILE: file7.txt\ncontent 7\nEND_FILE\n")
+	response.WriteString("READ_FILE: file7.txt\nLIST_DIR: .\n")
+
+	defer SetToolWorkers(4)
+	SetToolWorkers(3)
+
+	results := ExecuteTools(response.String(), tempDir, nil)
+	if len(results) != 6 {
+		t.Fatalf("Expected 6 results, got %d", len(results))
+	}
+
+	for i := 0; i < 3; i++ {
+		if !strings.Contains(results[i].Output, fmt.Sprintf("content %d", i+1)) {
+			t.Errorf("Result %d out of order: %q", i, results[i].Output)
+		}
+	}
+	if results[3].Tool != "CREATE_FILE" || !results[3].Success {
+		t.Errorf("Expected CREATE_FILE to succeed, got %+v", results[3])
+	}
+	// Reads after a write must see the written file
+	if !results[4].Success || !strings.Contains(results[4].Output, "content 7") {
+		t.Errorf("Expected read after CREATE_FILE to see the new file, got %q", results[4].Output)
+	}
+	if results[5].Tool != "LIST_DIR" || !strings.Contains(results[5].Output, "file7.txt") {
+		t.Errorf("Expected LIST_DIR result last, got %+v", results[5])
+	}
+}
+
+func TestLimitOutput(t *testing.T) {
+	saved := outputLimits
+	defer func() { outputLimits = saved }()
+
+	outputLimits = OutputLimits{MaxBytes: 100, Tools: map[string]int{"READ_FILE": -1}}
+
+	var lines []string
+	for i := 0; i < 50; i++ {
+		lines = append(lines, fmt.Sprintf("line %02d", i))
+	}
+	output := strings.Join(lines, "\n")
+
+	limited, shortened := limitOutput("RUN_COMMAND", "make", output, nil)
+	if !shortened {
+		t.Fatal("Expected output over the limit to be shortened")
+	}
+	if !strings.HasPrefix(limited, "line 00\n") || !strings.HasSuffix(limited, "line 49") {
+		t.Errorf("Expected head and tail to be kept on line boundaries, got %q", limited)
+	}
+	if !strings.Contains(limited, "bytes omitted") {
+		t.Errorf("Expected truncation note, got %q", limited)
+	}
+
+	if _, shortened := limitOutput("READ_FILE", "big.txt", output, nil); shortened {
+		t.Error("Expected per-tool limit of -1 to disable truncation")
+	}
+	if _, shortened := limitOutput("RUN_COMMAND", "make", "short", nil); shortened {
+		t.Error("Expected short output to be left alone")
+	}
+
+	// Cuts inside a rune drop its bytes instead of splitting it
+	for _, limit := range []int{30, 31, 32, 33} {
+		truncated := truncateOutput(strings.Repeat("é€𝄞", 20), limit)
+		if !utf8.ValidString(truncated) || !strings.HasPrefix(truncated, "é€𝄞") || !strings.HasSuffix(truncated, "é€𝄞") {
+			t.Errorf("Expected whole runes at a limit of %d, got %q", limit, truncated)
+		}
+	}
+
+	// Each setup replaces the limits of the one before
+	SetOutputLimits(OutputLimits{MaxBytes: 50, Tools: map[string]int{"LINT": 10}, Summarize: true})
+	SetOutputLimits(OutputLimits{})
+	if outputLimit("LINT") != defaultMaxOutput || outputLimits.Summarize {
+		t.Errorf("Expected the earlier limits to be replaced, got %+v", outputLimits)
+	}
+}
+
+func TestLimitOutputSummarizes(t *testing.T) {
+	saved := outputLimits
+	defer func() { outputLimits = saved }()
+	outputLimits = OutputLimits{MaxBytes: 200, Summarize: true}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, `{"response":"3 tests failed in parser_test.go","done":true}`)
+	}))
+	defer server.Close()
+
+	client := ollama.NewClient(server.URL, "summarizer", 0.1, 0.9)
+	limited, shortened := limitOutput("TEST_COMMAND", "go test", strings.Repeat("FAIL\n", 100), client)
+	if !shortened || !strings.Contains(limited, "3 tests failed in parser_test.go") {
+		t.Errorf("Expected summarized output, got %q", limited)
+	}
+	if !strings.Contains(limited, "summarized by summarizer") {
+		t.Errorf("Expected summary note, got %q", limited)
+	}
+}
+
+func TestCommandEnvironmentIsScrubbed(t *testing.T) {
+	savedAllow, savedInherit := envAllowlist, inheritEnv
+	defer func() { envAllowlist, inheritEnv = savedAllow, savedInherit }()
+
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+	t.Setenv("SLOP_EXTRA_VALUE", "extra")
+
+	output, err := executeCommand("env", t.TempDir())
+	if err != nil {
+		t.Fatalf("Expected env to run, got: %v", err)
+	}
+	if strings.Contains(output, "AWS_SECRET_ACCESS_KEY") || strings.Contains(output, "SLOP_EXTRA_VALUE") {
+		t.Errorf("Expected unlisted variables to be removed, got:\n%s", output)
+	}
+	if !strings.Contains(output, "PATH=") {
+		t.Errorf("Expected PATH to be passed through, got:\n%s", output)
+	}
+
+	SetEnvConfig(EnvConfig{Allow: []string{"SLOP_*"}})
+	output, _ = executeCommand("env", t.TempDir())
+	if !strings.Contains(output, "SLOP_EXTRA_VALUE=extra") || strings.Contains(output, "AWS_SECRET_ACCESS_KEY") {
+		t.Errorf("Expected only allowlisted extra variable, got:\n%s", output)
+	}
+
+	SetEnvConfig(EnvConfig{Inherit: true})
+	output, _ = executeCommand("env", t.TempDir())
+	if !strings.Contains(output, "AWS_SECRET_ACCESS_KEY=secret") {
+		t.Errorf("Expected full environment when inheriting, got:\n%s", output)
+	}
+
+	// A new configuration replaces the last one instead of adding to it
+	SetEnvConfig(EnvConfig{})
+	output, _ = executeCommand("env", t.TempDir())
+	if strings.Contains(output, "AWS_SECRET_ACCESS_KEY") || strings.Contains(output, "SLOP_EXTRA_VALUE") {
+		t.Errorf("Expected the earlier configuration to be replaced, got:\n%s", output)
+	}
+}
+
+func TestApplyDiffIsAllOrNothing(t *testing.T) {
+	tempDir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(tempDir, "first.txt"), []byte("one\ntwo\nthree\n"), 0644); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(tempDir, "second.txt"), []byte("alpha\nbeta\n"), 0644); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+
+	diff := `--- a/first.txt
++++ b/first.txt
+@@ -1,3 +1,3 @@
+ one
+-two
++TWO
+ three
+--- a/second.txt
++++ b/second.txt
+@@ -1,2 +1,2 @@
+ alpha
+-gamma
++delta
+`
+	if err := applyDiff(diff, tempDir); err == nil {
+		t.Fatal("Expected diff with a mismatched hunk to fail")
+	}
+
+	content, _ := os.ReadFile(filepath.Join(tempDir, "first.txt"))
+	if string(content) != "one\ntwo\nthree\n" {
+		t.Errorf("Expected first.txt to be untouched after a later file failed, got %q", content)
+	}
+}
+
+func TestApplyDiffChainsSectionsForSameFile(t *testing.T) {
+	tempDir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(tempDir, "file.txt"), []byte("a\nb\nc\n"), 0644); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+
+	diff := `--- a/file.txt
++++ b/file.txt
+@@ -1,3 +1,3 @@
+-a
++A
+ b
+ c
+--- a/file.txt
++++ b/file.txt
+@@ -1,3 +1,3 @@
+ A
+ b
+-c
++C
+`
+	if err := applyDiff(diff, tempDir); err != nil {
+		t.Fatalf("Expected diff to apply, got: %v", err)
+	}
+	content, _ := os.ReadFile(filepath.Join(tempDir, "file.txt"))
+	if string(content) != "A\nb\nC\n" {
+		t.Errorf("Expected both sections applied, got %q", content)
+	}
+}
+
+func TestPatchStateRollsBackOnWriteFailure(t *testing.T) {
+	tempDir := t.TempDir()
+	good := filepath.Join(tempDir, "good.txt")
+	if err := os.WriteFile(good, []byte("original\n"), 0644); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+	// A regular file where a directory is needed makes the second write fail
+	if err := os.WriteFile(filepath.Join(tempDir, "blocker"), []byte("x"), 0644); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+
+	state := newPatchState()
+	file, err := state.file(good)
+	if err != nil {
+		t.Fatalf("Failed to load file: %v", err)
+	}
+	file.content = "changed\n"
+
+	blocked := filepath.Join(tempDir, "blocker", "new.txt")
+	state.files[blocked] = &patchFile{exists: true, content: "new\n", perm: 0644}
+	state.original[blocked] = patchFile{}
+	state.order = append(state.order, blocked)
+
+	if err := state.commit(); err == nil {
+		t.Fatal("Expected commit to fail")
+	}
+	content, _ := os.ReadFile(good)
+	if string(content) != "original\n" {
+		t.Errorf("Expected good.txt to be restored, got %q", content)
+	}
+
+	entries, _ := os.ReadDir(tempDir)
+	if len(entries) != 2 {
+		t.Errorf("Expected no temporary files to be left behind, got %d entries", len(entries))
+	}
+}
+
+func TestFindSymbol(t *testing.T) {
+	tempDir := t.TempDir()
+	files := map[string]string{
+		"go.mod": "module example.com/demo\n",
+		"store/store.go": `package store
+
+// Store keeps values
+type Store struct{}
+
+// Get returns a value
+func (s *Store) Get(key string) string { return key }
+
+func New() *Store { return &Store{} }
+`,
+		"main.go": `package main
+
+import "example.com/demo/store"
+
+func main() {
+	s := store.New()
+	_ = s.Get("a")
+}
+`,
+		"testdata/ignored.go": "package ignored\n\nfunc New() {}\n",
+	}
+	for name, content := range files {
+		path := filepath.Join(tempDir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatalf("Failed to create directory: %v", err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatalf("Failed to write file: %v", err)
+		}
+	}
+
+	output, err := findSymbol("Store.Get", tempDir)
+	if err != nil {
+		t.Fatalf("Expected symbol to be found, got: %v", err)
+	}
+	if !strings.Contains(output, "store/store.go:7: [method store.Store.Get]") {
+		t.Errorf("Expected method definition, got:\n%s", output)
+	}
+	if !strings.Contains(output, `main.go:7: _ = s.Get("a")`) {
+		t.Errorf("Expected reference from main.go, got:\n%s", output)
+	}
+
+	output, _ = findSymbol("New", tempDir)
+	if strings.Contains(output, "testdata") {
+		t.Errorf("Expected testdata to be skipped, got:\n%s", output)
+	}
+
+	// The index picks up files changed after it was built
+	if err := os.WriteFile(filepath.Join(tempDir, "extra.go"), []byte("package main\n\nfunc Extra() {}\n"), 0644); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+	if output, err := findSymbol("Extra", tempDir); err != nil || !strings.Contains(output, "extra.go:3") {
+		t.Errorf("Expected new file to be indexed, got %q (err: %v)", output, err)
+	}
+
+	if _, err := findSymbol("Missing", tempDir); err == nil {
+		t.Error("Expected unknown symbol to fail")
+	}
+}
+
+func TestSummarizeResults(t *testing.T) {
+	tempDir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(tempDir, "file.txt"), []byte("one\ntwo\n"), 0644); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+
+	response := `READ_FILE: file.txt
+READ_FILE: missing.txt
+APPLY_DIFF:
+BEGIN_DIFF
+--- a/file.txt
++++ b/file.txt
+@@ -1,2 +1,3 @@
+-one
++ONE
++one and a half
+ two
+END_DIFF
+CREATE_FILE: notes/new.txt
+first
+second
+END_FILE
+`
+	summary := SummarizeResults(ExecuteTools(response, tempDir, nil))
+
+	if summary.Runs != 4 || summary.Succeeded != 3 || summary.Failed != 1 {
+		t.Errorf("Expected 4 runs with 3 successes, got %+v", summary)
+	}
+	if len(summary.Tools) != 3 || summary.Tools[2].Tool != "READ_FILE" || summary.Tools[2].Runs != 2 || summary.Tools[2].Failed != 1 {
+		t.Errorf("Expected per-tool counts sorted by name, got %+v", summary.Tools)
+	}
+	if strings.Join(summary.FilesModified, ",") != "file.txt,notes/new.txt" {
+		t.Errorf("Expected modified files, got %v", summary.FilesModified)
+	}
+	if summary.LinesAdded != 4 || summary.LinesRemoved != 1 {
+		t.Errorf("Expected +4 -1 lines, got +%d -%d", summary.LinesAdded, summary.LinesRemoved)
+	}
+
+	table := summary.String()
+	if !strings.Contains(table, "TOTAL") || !strings.Contains(table, "Files modified (2): +4 -1 lines") {
+		t.Errorf("Unexpected summary table:\n%s", table)
+	}
+}
+
+func TestCodeSearch(t *testing.T) {
+	tempDir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(tempDir, ".git"), 0755); err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+	files := map[string]string{
+		"main.go":   "package main\n\nfunc NewServer() {}\nfunc OpenDB() {}\n",
+		"README.md": "NewServer starts the server\n",
+		".git/HEAD": "NewServer\n",
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(tempDir, name), []byte(content), 0644); err != nil {
+			t.Fatalf("Failed to write file: %v", err)
+		}
+	}
+
+	saved := lookupRipgrep
+	defer func() { lookupRipgrep = saved }()
+
+	lookupRipgrep = func() (string, error) { return "", fmt.Errorf("not installed") }
+	output, err := codeSearch("func (New|Open)[A-Z]", ".", tempDir)
+	if err != nil {
+		t.Fatalf("Expected built-in search to succeed, got: %v", err)
+	}
+	if !strings.Contains(output, "main.go:3: func NewServer() {}") || !strings.Contains(output, "main.go:4: func OpenDB() {}") {
+		t.Errorf("Expected matching lines, got:\n%s", output)
+	}
+	if strings.Contains(output, ".git") || !strings.Contains(output, "built-in search") {
+		t.Errorf("Expected hidden directories to be skipped by the built-in search, got:\n%s", output)
+	}
+
+	if _, err := codeSearch("(", ".", tempDir); err == nil {
+		t.Error("Expected invalid pattern to fail")
+	}
+}
+
+func TestCodeSearchUsesRipgrep(t *testing.T) {
+	tempDir := t.TempDir()
+	fakeRg := filepath.Join(tempDir, "rg")
+	script := `#!/bin/sh
+cat <<'JSON'
+{"type":"begin","data":{"path":{"text":"./pkg/a.go"}}}
+{"type":"match","data":{"path":{"text":"./pkg/a.go"},"lines":{"text":"func Alpha() {}\n"},"line_number":7,"absolute_offset":0,"submatches":[]}}
+{"type":"end","data":{"path":{"text":"./pkg/a.go"}}}
+{"type":"summary","data":{}}
+JSON
+`
+	if err := os.WriteFile(fakeRg, []byte(script), 0755); err != nil {
+		t.Fatalf("Failed to write fake rg: %v", err)
+	}
+
+	saved := lookupRipgrep
+	defer func() { lookupRipgrep = saved }()
+	lookupRipgrep = func() (string, error) { return fakeRg, nil }
+
+	output, err := codeSearch("Alpha", ".", tempDir)
+	if err != nil {
+		t.Fatalf("Expected ripgrep search to succeed, got: %v", err)
+	}
+	if !strings.Contains(output, "pkg/a.go:7: func Alpha() {}") || !strings.Contains(output, "ripgrep") {
+		t.Errorf("Expected parsed ripgrep match, got:\n%s", output)
+	}
+}
+
+func TestToolPolicy(t *testing.T) {
+	defer SetToolPolicy(nil, nil)
+	tempDir := t.TempDir()
+
+	SetToolPolicy(nil, []string{"RUN_COMMAND"})
+	results := ExecuteTools("RUN_COMMAND: echo hi\nLIST_DIR: .\n", tempDir, nil)
+	if results[0].Success || !strings.Contains(results[0].Output, "disabled by the tool policy") {
+		t.Errorf("Expected denied tool to be blocked, got %+v", results[0])
+	}
+	if !results[1].Success {
+		t.Errorf("Expected other tools to run, got %+v", results[1])
+	}
+
+	SetToolPolicy([]string{"READ_FILE"}, nil)
+	results = ExecuteTools("LIST_DIR: .\n", tempDir, nil)
+	if results[0].Success {
+		t.Errorf("Expected tool outside the allow list to be blocked, got %+v", results[0])
+	}
+}
+
+func TestExtractDiffs(t *testing.T) {
+	response := "Here is the fix:\n" +
+		"APPLY_DIFF:\n" +
+		"```diff\n" +
+		"--- a/a.txt\n" +
+		"+++ b/a.txt\n" +
+		"@@ -1 +1 @@\n" +
+		"-old\n" +
+		"+new\n" +
+		"```\n" +
+		"And a suggestion:\n" +
+		"```diff\n" +
+		"--- a/b.txt\n" +
+		"+++ b/b.txt\n" +
+		"@@ -1 +1 @@\n" +
+		"-x\n" +
+		"+y\n" +
+		"```\n" +
+		"```go\n" +
+		"func main() {}\n" +
+		"```\n"
+
+	diffs := ExtractDiffs(response)
+	if len(diffs) != 2 {
+		t.Fatalf("Expected 2 diffs, got %d: %q", len(diffs), diffs)
+	}
+	if !strings.HasPrefix(diffs[0], "--- a/a.txt") || !strings.HasSuffix(diffs[0], "+new") {
+		t.Errorf("Unexpected APPLY_DIFF body: %q", diffs[0])
+	}
+	if !strings.HasPrefix(diffs[1], "--- a/b.txt") || !strings.HasSuffix(diffs[1], "+y") {
+		t.Errorf("Unexpected fenced diff: %q", diffs[1])
+	}
+}
+
+func TestUnifiedDiffRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	var oldLines []string
+	for i := 1; i <= 30; i++ {
+		oldLines = append(oldLines, fmt.Sprintf("line %d", i))
+	}
+	oldText := strings.Join(oldLines, "\n") + "\n"
+	newText := strings.Replace(oldText, "line 2\n", "line two\n", 1)
+	newText = strings.Replace(newText, "line 20\n", "line 20\ninserted\n", 1)
+	newText = strings.Replace(newText, "line 30\n", "", 1)
+
+	if err := os.WriteFile(filepath.Join(dir, "file.txt"), []byte(oldText), 0644); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+
+	diff := UnifiedDiff("file.txt", oldText, newText)
+	if strings.Count(diff, "@@ -") != 3 {
+		t.Errorf("Expected 3 hunks, got:\n%s", diff)
+	}
+	if err := ApplyPatch(diff, dir); err != nil {
+		t.Fatalf("Failed to apply generated diff: %v\n%s", err, diff)
+	}
+	got, _ := os.ReadFile(filepath.Join(dir, "file.txt"))
+	if string(got) != newText {
+		t.Errorf("Applied diff produced:\n%s\nwant:\n%s", got, newText)
+	}
+
+	created := UnifiedDiff("new.txt", "", "hello\n")
+	if !strings.HasPrefix(created, "--- /dev/null\n+++ b/new.txt\n@@ -0,0 +1,1 @@\n+hello\n") {
+		t.Errorf("Unexpected diff for a new file:\n%s", created)
+	}
+	if err := ApplyPatch(created, dir); err != nil {
+		t.Fatalf("Failed to create file from diff: %v", err)
+	}
+	if UnifiedDiff("same.txt", "a\n", "a\n") != "" {
+		t.Error("Expected no diff for equal text")
+	}
+}
+
+func TestConflictResolver(t *testing.T) {
+	defer SetConflictResolver(nil)
+	tempDir := t.TempDir()
+	path := filepath.Join(tempDir, "greet.go")
+	original := "package greet\n\nconst Hello = \"hey\"\n\nconst Bye = \"bye\"\n"
+	diff := "--- a/greet.go\n+++ b/greet.go\n@@ -1,3 +1,3 @@\n package greet\n \n-const Hello = \"hello\"\n+const Hello = \"hi\"\n@@ -5,1 +5,1 @@\n-const Bye = \"bye\"\n+const Bye = \"ciao\"\n"
+
+	var conflicts []HunkConflict
+	for _, tc := range []struct {
+		resolution HunkResolution
+		expected   string
+	}{
+		{HunkResolution{Skip: true}, "package greet\n\nconst Hello = \"hey\"\n\nconst Bye = \"ciao\"\n"},
+		{HunkResolution{Lines: []string{"package greet", "", "const Hello = \"hi there\""}}, "package greet\n\nconst Hello = \"hi there\"\n\nconst Bye = \"ciao\"\n"},
+	} {
+		os.WriteFile(path, []byte(original), 0644)
+		SetConflictResolver(func(conflict HunkConflict) (HunkResolution, error) {
+			conflicts = append(conflicts, conflict)
+			return tc.resolution, nil
+		})
+		if err := ApplyPatch(diff, tempDir); err != nil {
+			t.Fatalf("ApplyPatch failed: %v", err)
+		}
+		if content, _ := os.ReadFile(path); string(content) != tc.expected {
+			t.Errorf("Expected %q, got %q", tc.expected, content)
+		}
+	}
+
+	conflict := conflicts[0]
+	if len(conflicts) != 2 || conflict.File != "greet.go" || conflict.Line != 1 || conflict.Actual[2] != `const Hello = "hey"` ||
+		conflict.Expected[2] != `const Hello = "hello"` || conflict.Intended[2] != `const Hello = "hi"` || !strings.HasPrefix(conflict.Hunk, "@@ -1,3 +1,3 @@\n package greet\n") {
+		t.Errorf("Unexpected conflict %+v", conflict)
+	}
+
+	os.WriteFile(path, []byte(original), 0644)
+	SetConflictResolver(func(HunkConflict) (HunkResolution, error) { return HunkResolution{}, fmt.Errorf("aborted") })
+	if err := ApplyPatch(diff, tempDir); err == nil || !strings.Contains(err.Error(), "aborted") {
+		t.Errorf("Expected the resolver error to abort the diff, got %v", err)
+	}
+	if content, _ := os.ReadFile(path); string(content) != original {
+		t.Error("Expected an aborted diff to leave the file unchanged")
+	}
+	if _, err := CheckPatch(diff, tempDir); err == nil {
+		t.Error("Expected CheckPatch to ignore the resolver")
+	}
+}
+
+func TestApprovalMemory(t *testing.T) {
+	defer SetApprover(nil)
+	defer SetProgressOutput(nil)
+	SetProgressOutput(io.Discard)
+	approvals := filepath.Join(t.TempDir(), "approvals.json")
+	if err := LoadApprovals(approvals); err != nil {
+		t.Fatalf("LoadApprovals failed: %v", err)
+	}
+	repoPath := t.TempDir()
+
+	var asked []string
+	answers := []Approval{AllowSession, Deny, AllowAlways, AllowTool}
+	SetApprover(func(call ToolCall, subject string) (Approval, error) {
+		asked = append(asked, call.Name+" "+subject)
+		answer := answers[0]
+		answers = answers[1:]
+		return answer, nil
+	})
+	run := func(call ToolCall) ToolResult {
+		return RunTool(io.Discard, call, repoPath)
+	}
+
+	// Approved for the session: identical commands are not asked about again
+	if result := run(ToolCall{Name: "RUN_COMMAND", Args: "echo hi"}); !result.Success {
+		t.Fatalf("Expected the approved command to run, got %+v", result)
+	}
+	run(ToolCall{Name: "RUN_COMMAND", Args: " echo hi"})
+	if result := run(ToolCall{Name: "RUN_COMMAND", Args: "echo bye"}); result.Success || !result.Denied {
+		t.Errorf("Expected the declined command to be blocked, got %+v", result)
+	}
+
+	// Approved always, for the path it writes
+	run(ToolCall{Name: "CREATE_FILE", Args: "notes.txt", Body: "one\n"})
+	run(ToolCall{Name: "CREATE_FILE", Args: "notes.txt", Body: "two\n"})
+	if content, _ := os.ReadFile(filepath.Join(repoPath, "notes.txt")); string(content) != "two\n" {
+		t.Errorf("Expected the approved path to be written twice, got %q", content)
+	}
+
+	// Reads never ask, and a tool approved as a whole covers every call of it
+	run(ToolCall{Name: "READ_FILE", Args: "notes.txt"})
+	run(ToolCall{Name: "APPLY_DIFF", Body: "--- a/notes.txt\n+++ b/notes.txt\n@@ -1 +1 @@\n-two\n+three\n"})
+	run(ToolCall{Name: "APPLY_DIFF", Body: "--- a/notes.txt\n+++ b/notes.txt\n@@ -1 +1 @@\n-three\n+four\n"})
+	expected := []string{"RUN_COMMAND echo hi", "RUN_COMMAND echo bye", "CREATE_FILE notes.txt", "APPLY_DIFF notes.txt"}
+	if strings.Join(asked, "|") != strings.Join(expected, "|") {
+		t.Errorf("Expected to be asked about %q, got %q", expected, asked)
+	}
+
+	rules := Approvals()
+	if len(rules) != 3 || !rules[0].Persistent || rules[0].String() != "CREATE_FILE notes.txt" || rules[2].String() != "APPLY_DIFF (any)" {
+		t.Fatalf("Unexpected rules %+v", rules)
+	}
+
+	// Only the persistent rule survives into the next session, until it is revoked
+	if err := LoadApprovals(approvals); err != nil {
+		t.Fatalf("LoadApprovals failed: %v", err)
+	}
+	if rules := Approvals(); len(rules) != 1 || rules[0].Tool != "CREATE_FILE" {
+		t.Fatalf("Expected the saved rule to be loaded, got %+v", rules)
+	}
+	if err := RevokeApproval(Approvals()[0]); err != nil {
+		t.Fatalf("RevokeApproval failed: %v", err)
+	}
+	LoadApprovals(approvals)
+	if rules := Approvals(); len(rules) != 0 {
+		t.Errorf("Expected the revoked rule to be gone, got %+v", rules)
+	}
+}
+
+func TestParseFinalAnswer(t *testing.T) {
+	response := "Example of the format:\n```\nFINAL_ANSWER: not this one\n```\nI fixed the parser.\n\nFINAL_ANSWER: Fixed the off-by-one\nin the line parser.\n\nCHANGED_FILES: `tools/parser.go`, tools/parser_test.go\n"
+	answer, ok := ParseFinalAnswer(response)
+	if !ok {
+		t.Fatal("Expected a final answer")
+	}
+	if answer.Summary != "Fixed the off-by-one\nin the line parser." {
+		t.Errorf("Unexpected summary %q", answer.Summary)
+	}
+	if len(answer.ChangedFiles) != 2 || answer.ChangedFiles[0] != "tools/parser.go" || answer.ChangedFiles[1] != "tools/parser_test.go" {
+		t.Errorf("Unexpected changed files %q", answer.ChangedFiles)
+	}
+
+	answer, ok = ParseFinalAnswer("TASK_COMPLETE: Nothing to do\nCHANGED_FILES: none")
+	if !ok || answer.Summary != "Nothing to do" || answer.ChangedFiles != nil {
+		t.Errorf("Unexpected answer %+v", answer)
+	}
+	if _, ok := ParseFinalAnswer("CHANGED_FILES: main.go\nStill working on it."); ok {
+		t.Error("Expected no final answer without the directive")
+	}
+}
+
+func TestOverlay(t *testing.T) {
+	defer SetOverlay(false)
+	defer SetProgressOutput(nil)
+	SetProgressOutput(io.Discard)
+	repoPath := t.TempDir()
+	os.WriteFile(filepath.Join(repoPath, "main.go"), []byte("package main\n\nvar greeting = \"hi\"\n"), 0644)
+	os.WriteFile(filepath.Join(repoPath, "old.txt"), []byte("obsolete\n"), 0644)
+	SetOverlay(true)
+	run := func(call ToolCall) ToolResult {
+		return RunTool(io.Discard, call, repoPath)
+	}
+
+	diff := "--- a/main.go\n+++ b/main.go\n@@ -1,3 +1,3 @@\n package main\n \n-var greeting = \"hi\"\n+var greeting = \"hello\"\n"
+	if result := run(ToolCall{Name: "APPLY_DIFF", Body: diff}); !result.Success {
+		t.Fatalf("Expected the diff to apply to the overlay, got %+v", result)
+	}
+	run(ToolCall{Name: "CREATE_FILE", Args: "pkg/util.go", Body: "package pkg // hello\n"})
+	run(ToolCall{Name: "APPLY_DIFF", Body: "--- a/old.txt\n+++ /dev/null\n@@ -1 +0,0 @@\n-obsolete\n"})
+
+	// Nothing is written, but the tools see the changes
+	if data, _ := os.ReadFile(filepath.Join(repoPath, "main.go")); !strings.Contains(string(data), `"hi"`) {
+		t.Errorf("Expected the file on disk to be unchanged, got %q", data)
+	}
+	if _, err := os.Stat(filepath.Join(repoPath, "pkg")); !os.IsNotExist(err) {
+		t.Error("Expected the created file to stay in memory")
+	}
+	if result := run(ToolCall{Name: "READ_FILE", Args: "main.go"}); !strings.Contains(result.Output, `"hello"`) {
+		t.Errorf("Expected READ_FILE to see the overlay, got %q", result.Output)
+	}
+	if result := run(ToolCall{Name: "READ_FILE", Args: "old.txt"}); result.Success {
+		t.Errorf("Expected the deleted file to be gone for READ_FILE, got %q", result.Output)
+	}
+	listing := run(ToolCall{Name: "LIST_DIR", Args: "."}).Output
+	if !strings.Contains(listing, "d        0 pkg\n") || strings.Contains(listing, "old.txt") {
+		t.Errorf("Expected LIST_DIR to see the overlay, got %q", listing)
+	}
+	if result := run(ToolCall{Name: "SEARCH_FILES", Args: "hello"}); !strings.Contains(result.Output, "Found in: main.go") || !strings.Contains(result.Output, "Found in: pkg/util.go") {
+		t.Errorf("Expected SEARCH_FILES to see the overlay, got %q", result.Output)
+	}
+
+	// Commands run in a sandbox with the changes and without .git, and the text
+	// files they write join the changes instead of the repository
+	os.MkdirAll(filepath.Join(repoPath, ".git"), 0755)
+	os.WriteFile(filepath.Join(repoPath, ".git", "HEAD"), []byte("ref: refs/heads/main\n"), 0644)
+	result := run(ToolCall{Name: "RUN_COMMAND", Args: "test ! -e .git && cat pkg/util.go && echo 'package gen' > gen.go && printf 'a\\000b' > app.bin"})
+	if !result.Success || !strings.Contains(result.Output, "package pkg // hello") {
+		t.Errorf("Expected the command to see the overlay, got %+v", result)
+	}
+	if !strings.Contains(result.Output, "Kept the changes the command made to gen.go") || !strings.Contains(result.Output, "Discarded the changes the command made to app.bin") {
+		t.Errorf("Expected the command's changes to be reported, got %q", result.Output)
+	}
+	if _, err := os.Stat(filepath.Join(repoPath, "gen.go")); !os.IsNotExist(err) {
+		t.Error("Expected the command to leave the repository alone")
+	}
+	if result := run(ToolCall{Name: "READ_FILE", Args: "gen.go"}); !strings.Contains(result.Output, "package gen") {
+		t.Errorf("Expected READ_FILE to see the file the command wrote, got %q", result.Output)
+	}
+	if result := run(ToolCall{Name: "RUN_COMMAND", Args: "cat gen.go"}); strings.Contains(result.Output, "Kept") || strings.Contains(result.Output, "Discarded") {
+		t.Errorf("Expected a command that changes nothing to report nothing, got %q", result.Output)
+	}
+
+	patch := OverlayDiff(repoPath)
+	if strings.Contains(patch, "app.bin") {
+		t.Errorf("Expected the binary file to be left out of the overlay diff, got:\n%s", patch)
+	}
+	for _, want := range []string{"+var greeting = \"hello\"", "--- /dev/null\n+++ b/pkg/util.go", "--- a/old.txt\n+++ /dev/null", "--- /dev/null\n+++ b/gen.go"} {
+		if !strings.Contains(patch, want) {
+			t.Errorf("Expected %q in the overlay diff, got:\n%s", want, patch)
+		}
+	}
+
+	if err := FlushOverlay(); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := os.ReadFile(filepath.Join(repoPath, "main.go")); !strings.Contains(string(data), `"hello"`) {
+		t.Errorf("Expected the changes on disk after flushing, got %q", data)
+	}
+	if _, err := os.Stat(filepath.Join(repoPath, "old.txt")); !os.IsNotExist(err) {
+		t.Error("Expected the deleted file to be removed after flushing")
+	}
+	if OverlayDiff(repoPath) != "" {
+		t.Error("Expected an empty overlay after flushing")
+	}
+}
+
+func TestGuardrails(t *testing.T) {
+	defer SetProgressOutput(nil)
+	SetProgressOutput(io.Discard)
+	repoPath := t.TempDir()
+	os.MkdirAll(filepath.Join(repoPath, "internal", "parse"), 0755)
+	os.WriteFile(filepath.Join(repoPath, "internal", "parse", "parser.go"), []byte("package parse\n"), 0644)
+	os.WriteFile(filepath.Join(repoPath, "build.sh"), []byte("#!/bin/sh\necho built\n"), 0755)
+
+	tests := []struct {
+		call ToolCall
+		want string // Part of the corrective message, "" when the call runs
+	}{
+		{ToolCall{Name: "READ_FILE", Args: "parser.go"}, "the file parser.go does not exist. Did you mean internal/parse/parser.go?"},
+		{ToolCall{Name: "READ_FILE", Args: "internal/parse/parser.go"}, ""},
+		{ToolCall{Name: "LIST_DIR", Args: "src"}, "the directory src does not exist"},
+		{ToolCall{Name: "SEARCH_FILES", Args: "Parse lib"}, "the directory lib does not exist"},
+		{ToolCall{Name: "APPLY_DIFF", Body: "--- a/parser.go\n+++ b/parser.go\n@@ -1 +1 @@\n-package parse\n+package parser\n"}, "Instead of parser.go, did you mean internal/parse/parser.go?"},
+		{ToolCall{Name: "APPLY_DIFF", Body: "--- /dev/null\n+++ b/notes.txt\n@@ -0,0 +1 @@\n+hi\n"}, ""},
+		{ToolCall{Name: "RUN_COMMAND", Args: "no-such-tool-xyz --version 2>&1 | head -1"}, "no-such-tool-xyz is not installed or not on PATH"},
+		{ToolCall{Name: "RUN_COMMAND", Args: "./missing.sh"}, "./missing.sh does not exist in the repository"},
+		{ToolCall{Name: "RUN_COMMAND", Args: "FOO=1 ./build.sh && echo 'a | no-such-tool-xyz' ; cd internal && ./other.sh"}, ""},
+		{ToolCall{Name: "RUN_COMMAND", Args: "if true; then $EDITOR x; fi"}, ""},
+		{ToolCall{Name: "RUN_COMMAND", Args: "go build -o bin/x ./cmd && ./bin/x"}, ""},
+		{ToolCall{Name: "RUN_COMMAND", Args: "make && ./a.out"}, ""},
+		{ToolCall{Name: "RUN_COMMAND", Args: "./missing.sh && ./a.out"}, "./missing.sh does not exist"},
+		{ToolCall{Name: "RUN_COMMAND", Args: "{ ! no-such-tool-xyz; }"}, "no-such-tool-xyz is not installed"},
+	}
+	for _, tt := range tests {
+		result := ExecuteTools(formatCall(tt.call), repoPath, nil)
+		if len(result) != 1 {
+			t.Fatalf("Expected one result for %+v, got %+v", tt.call, result)
+		}
+		if tt.want == "" {
+			if result[0].Rejected {
+				t.Errorf("Expected %s %q to run, got %q", tt.call.Name, tt.call.Args, result[0].Output)
+			}
+			continue
+		}
+		if !result[0].Rejected || result[0].Success || !strings.Contains(result[0].Output, tt.want) {
+			t.Errorf("Expected %s %q to be rejected with %q, got %+v", tt.call.Name, tt.call.Args, tt.want, result[0])
+		}
+	}
+
+	// Only calls from the model are checked; the user's own calls run as given
+	if result := RunTool(io.Discard, ToolCall{Name: "READ_FILE", Args: "parser.go"}, repoPath); result.Rejected || !strings.Contains(result.Output, "Error reading file") {
+		t.Errorf("Expected RunTool to skip the guardrails, got %+v", result)
+	}
+}
+
+// formatCall writes a tool call the way the model does
+func formatCall(call ToolCall) string {
+	if call.Name == "APPLY_DIFF" {
+		return "APPLY_DIFF:\n```diff\n" + call.Body + "```\n"
+	}
+	return call.Name + ": " + call.Args + "\n"
+}
+
+func TestScratch(t *testing.T) {
+	defer SetOverlay(false)
+	repoPath := t.TempDir()
+	run := func(call ToolCall) ToolResult {
+		return RunTool(io.Discard, call, repoPath)
+	}
+
+	result := run(ToolCall{Name: "RUN_COMMAND", Args: `echo built > "$SLOP_SHOP_SCRATCH/app.log" && echo "tmp=$TMPDIR"`})
+	dir, _ := scratchDir()
+	if !result.Success || !strings.Contains(result.Output, "tmp="+dir) || !strings.HasPrefix(filepath.Base(dir), repo.ScratchPrefix) {
+		t.Fatalf("Expected commands to get the scratch directory %s as TMPDIR, got %+v", dir, result)
+	}
+	if result := run(ToolCall{Name: "READ_FILE", Args: "$SLOP_SHOP_SCRATCH/app.log"}); !strings.Contains(result.Output, "built") {
+		t.Errorf("Expected READ_FILE to read from the scratch directory, got %q", result.Output)
+	}
+
+	// Files created in the scratch directory are written at once, even with the overlay
+	SetOverlay(true)
+	run(ToolCall{Name: "CREATE_FILE", Args: "$SLOP_SHOP_SCRATCH/notes/todo.txt", Body: "later\n"})
+	if data, err := os.ReadFile(filepath.Join(dir, "notes", "todo.txt")); err != nil || string(data) != "later\n" {
+		t.Errorf("Expected the file in the scratch directory, got %q (%v)", data, err)
+	}
+	if entries, _ := os.ReadDir(repoPath); len(entries) != 0 {
+		t.Errorf("Expected nothing written to the repository, got %v", entries)
+	}
+
+	report, err := CloseScratch(false)
+	if err != nil || report != fmt.Sprintf("Removed the scratch directory %s (2 files, 12 bytes)", dir) {
+		t.Errorf("Unexpected report %q (%v)", report, err)
+	}
+	if _, err := os.Stat(dir); !os.IsNotExist(err) {
+		t.Error("Expected the scratch directory to be removed")
+	}
+	if report, _ := CloseScratch(false); report != "" {
+		t.Errorf("Expected nothing to report without a scratch directory, got %q", report)
+	}
+}
@@ -0,0 +1,23 @@
+package tools
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCmdRunsQuotedArguments(t *testing.T) {
+	defer SetShell("")
+	SetShell("cmd")
+
+	quoted, err := quoteArg("fish & chips")
+	if err != nil {
+		t.Fatalf("Expected the argument to be quoted, got: %v", err)
+	}
+	output, err := executeCommand("echo "+quoted+" & echo done", t.TempDir())
+	if err != nil {
+		t.Fatalf("Expected the command to run, got: %v\n%s", err, output)
+	}
+	if !strings.Contains(output, `"fish & chips"`) || !strings.Contains(output, "done") {
+		t.Errorf("Expected the quoted & to be echoed and the unquoted one to run the next command, got:\n%s", output)
+	}
+}
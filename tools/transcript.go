@@ -0,0 +1,39 @@
+package tools
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// transcript receives the result of every tool call; nil turns it off
+var transcript io.Writer
+
+// SetTranscript sets where tool results are recorded as each call finishes;
+// nil stops recording
+func SetTranscript(w io.Writer) {
+	transcript = w
+}
+
+// transcribe records tool results in the transcript as Markdown
+func transcribe(results ...ToolResult) {
+	if transcript == nil {
+		return
+	}
+	for _, result := range results {
+		status := fmt.Sprintf("exit %d", result.ExitCode)
+		if result.Denied {
+			status = "denied"
+		} else if result.Rejected {
+			status = "rejected"
+		}
+		// A fence longer than any backtick run in the output keeps it intact
+		fence := "```"
+		for strings.Contains(result.Output, fence) {
+			fence += "`"
+		}
+		fmt.Fprintf(transcript, "### Tool %s %s (%s, %s)\n\n%s\n%s\n%s\n\n",
+			result.Tool, result.Args, status, result.Duration.Round(time.Millisecond), fence, strings.TrimRight(result.Output, "\n"), fence)
+	}
+}
@@ -0,0 +1,118 @@
+package tools
+
+import (
+	"fmt"
+	"maps"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/kek/slop-shop/ollama"
+)
+
+// OutputLimits controls how much tool output is fed back to the model
+type OutputLimits struct {
+	MaxBytes  int            `toml:"max_bytes"` // Default limit for every tool, 0 for 32000 and -1 for no limit
+	Tools     map[string]int `toml:"tools"`     // Per-tool limits keyed by tool name, e.g. READ_FILE = 60000
+	Summarize bool           `toml:"summarize"` // Ask the model to summarize oversized output instead of truncating it
+}
+
+// summaryInputLimit caps how much oversized output is sent to the model for summarization
+const summaryInputLimit = 200000
+
+// defaultMaxOutput is the limit of every tool when none is configured
+const defaultMaxOutput = 32000
+
+// outputLimits holds the active output limits
+var outputLimits = OutputLimits{MaxBytes: defaultMaxOutput}
+
+// SetOutputLimits replaces the active output limits, using the default limit
+// when MaxBytes is 0
+func SetOutputLimits(limits OutputLimits) {
+	if limits.MaxBytes == 0 {
+		limits.MaxBytes = defaultMaxOutput
+	}
+	limits.Tools = maps.Clone(limits.Tools)
+	outputLimits = limits
+}
+
+// outputLimit returns the byte limit for a tool's output, or 0 when it is unlimited
+func outputLimit(tool string) int {
+	limit := outputLimits.MaxBytes
+	if toolLimit, ok := outputLimits.Tools[tool]; ok {
+		limit = toolLimit
+	}
+	if limit < 0 {
+		return 0
+	}
+	return limit
+}
+
+// limitOutput shortens output that exceeds the tool's limit, summarizing it with
+// the model when enabled and falling back to truncation otherwise. It reports
+// whether the output was shortened.
+func limitOutput(tool, args, output string, client *ollama.Client) (string, bool) {
+	limit := outputLimit(tool)
+	if limit == 0 || len(output) <= limit {
+		return output, false
+	}
+
+	if outputLimits.Summarize && client != nil {
+		summary, err := summarizeOutput(tool, args, output, client)
+		if err == nil && summary != "" && len(summary) <= limit {
+			return fmt.Sprintf("[Output of %d bytes summarized by %s]\n%s", len(output), client.Model, summary), true
+		}
+	}
+
+	return truncateOutput(output, limit), true
+}
+
+// truncateOutput keeps the beginning and end of output within limit bytes and
+// replaces the middle with a note. Cuts are moved to line boundaries when one
+// is nearby so the model does not see half lines.
+func truncateOutput(output string, limit int) string {
+	headSize := limit * 2 / 3
+	tailSize := limit - headSize
+
+	head := output[:headSize]
+	if idx := strings.LastIndex(head, "\n"); idx > headSize/2 {
+		head = head[:idx+1]
+	}
+	// Drop a rune cut in half, whose start is at most 3 bytes back
+	start := len(head) - 1
+	for start > 0 && len(head)-start < utf8.UTFMax && !utf8.RuneStart(head[start]) {
+		start--
+	}
+	if start >= 0 && !utf8.FullRuneInString(head[start:]) {
+		head = head[:start]
+	}
+
+	tail := output[len(output)-tailSize:]
+	if idx := strings.Index(tail, "\n"); idx >= 0 && idx < tailSize/2 {
+		tail = tail[idx+1:]
+	}
+	for i := 1; i < utf8.UTFMax && len(tail) > 0 && !utf8.RuneStart(tail[0]); i++ {
+		tail = tail[1:]
+	}
+
+	omitted := len(output) - len(head) - len(tail)
+	return fmt.Sprintf("%s\n... [%d bytes omitted; output exceeded the %d byte limit] ...\n%s", head, omitted, limit, tail)
+}
+
+// summarizeOutput asks the model for a condensed version of a tool's output
+func summarizeOutput(tool, args, output string, client *ollama.Client) (string, error) {
+	if len(output) > summaryInputLimit {
+		output = truncateOutput(output, summaryInputLimit)
+	}
+
+	prompt := fmt.Sprintf("Summarize the output of the tool call %s %s so it can be used to continue a coding task. "+
+		"Keep file paths, line numbers, error messages, failing test names and any values that look important. "+
+		"Only output the summary.", tool, args)
+
+	summarizer := *client
+	summarizer.Label = "summarize " + tool
+	summary, err := summarizer.Generate(prompt, output, false, nil)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(summary), nil
+}
@@ -0,0 +1,173 @@
+package tools
+
+import (
+	"fmt"
+	"strings"
+)
+
+// diffContext is the number of unchanged lines shown around each change
+const diffContext = 3
+
+// maxDiffCells bounds the size of the line comparison table; larger inputs are
+// diffed as one hunk that replaces the whole file
+const maxDiffCells = 4000000
+
+// diffOp is one line of an edit script
+type diffOp struct {
+	kind byte // ' ', '-' or '+'
+	text string
+}
+
+// UnifiedDiff returns a unified diff that turns oldText into newText for the
+// file at path, or "" when they are equal. An empty oldText creates the file.
+func UnifiedDiff(path, oldText, newText string) string {
+	if oldText == newText {
+		return ""
+	}
+
+	oldLines, newLines := splitLines(oldText), splitLines(newText)
+	ops := editScript(oldLines, newLines)
+
+	var buf strings.Builder
+	if oldText == "" {
+		buf.WriteString("--- /dev/null\n")
+	} else {
+		buf.WriteString(fmt.Sprintf("--- a/%s\n", path))
+	}
+	buf.WriteString(fmt.Sprintf("+++ b/%s\n", path))
+
+	// Line numbers in the old and new file before each operation
+	oldAt := make([]int, len(ops)+1)
+	newAt := make([]int, len(ops)+1)
+	oldAt[0], newAt[0] = 1, 1
+	for i, op := range ops {
+		oldAt[i+1], newAt[i+1] = oldAt[i], newAt[i]
+		if op.kind != '+' {
+			oldAt[i+1]++
+		}
+		if op.kind != '-' {
+			newAt[i+1]++
+		}
+	}
+
+	// Group changes that are close enough to share context into hunks
+	for i := 0; i < len(ops); i++ {
+		if ops[i].kind == ' ' {
+			continue
+		}
+		last := i
+		for j := i + 1; j < len(ops) && j-last <= 2*diffContext; j++ {
+			if ops[j].kind != ' ' {
+				last = j
+			}
+		}
+		start := max(i-diffContext, 0)
+		end := min(last+1+diffContext, len(ops))
+
+		oldCount := oldAt[end] - oldAt[start]
+		newCount := newAt[end] - newAt[start]
+		oldStart, newStart := oldAt[start], newAt[start]
+		if oldCount == 0 {
+			oldStart--
+		}
+		if newCount == 0 {
+			newStart--
+		}
+		buf.WriteString(fmt.Sprintf("@@ -%d,%d +%d,%d @@\n", oldStart, oldCount, newStart, newCount))
+		for _, op := range ops[start:end] {
+			buf.WriteString(string(op.kind) + op.text + "\n")
+		}
+		i = end - 1
+	}
+	return buf.String()
+}
+
+// ApplyPatch applies a unified diff to the repository, writing nothing unless
+// every change applies
+func ApplyPatch(diff, repoPath string) error {
+	return applyDiff(diff, repoPath)
+}
+
+// CheckPatch reports whether a unified diff parses and applies cleanly, without
+// fuzz, to the repository. The changes are made to in-memory copies of the
+// files, so nothing is written. It returns the paths the diff changes.
+func CheckPatch(diff, repoPath string) ([]string, error) {
+	changes, err := parseDiff(diff)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse diff: %v", err)
+	}
+	if len(changes) == 0 {
+		return nil, fmt.Errorf("the diff changes no files")
+	}
+
+	state := newPatchState()
+	paths := make([]string, 0, len(changes))
+	for _, change := range changes {
+		if _, err := applyFileChange(change, repoPath, state, 0, nil); err != nil {
+			return nil, fmt.Errorf("failed to apply change to %s: %v", change.FilePath, err)
+		}
+		paths = append(paths, change.FilePath)
+	}
+	return paths, nil
+}
+
+// splitLines splits text into lines without their line endings
+func splitLines(text string) []string {
+	if text == "" {
+		return nil
+	}
+	return strings.Split(strings.TrimSuffix(text, "\n"), "\n")
+}
+
+// editScript returns the line operations that turn a into b, based on their
+// longest common subsequence
+func editScript(a, b []string) []diffOp {
+	var ops []diffOp
+	if len(a)*len(b) > maxDiffCells {
+		for _, line := range a {
+			ops = append(ops, diffOp{'-', line})
+		}
+		for _, line := range b {
+			ops = append(ops, diffOp{'+', line})
+		}
+		return ops
+	}
+
+	// lcs[i][j] is the length of the longest common subsequence of a[i:] and b[j:]
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else {
+				lcs[i][j] = max(lcs[i+1][j], lcs[i][j+1])
+			}
+		}
+	}
+
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		switch {
+		case a[i] == b[j]:
+			ops = append(ops, diffOp{' ', a[i]})
+			i++
+			j++
+		case lcs[i+1][j] >= lcs[i][j+1]:
+			ops = append(ops, diffOp{'-', a[i]})
+			i++
+		default:
+			ops = append(ops, diffOp{'+', b[j]})
+			j++
+		}
+	}
+	for ; i < len(a); i++ {
+		ops = append(ops, diffOp{'-', a[i]})
+	}
+	for ; j < len(b); j++ {
+		ops = append(ops, diffOp{'+', b[j]})
+	}
+	return ops
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/kek/slop-shop/ollama"
+	"github.com/kek/slop-shop/tools"
+)
+
+// setTranscript starts recording prompts, responses and tool results to path,
+// appending to what is already there. Each write goes straight to the file so a
+// crash loses nothing written before it. An empty path records nothing.
+func setTranscript(path string) error {
+	if path == "" {
+		ollama.SetTranscript(nil)
+		tools.SetTranscript(nil)
+		return nil
+	}
+
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("error opening transcript: %v", err)
+	}
+	fmt.Fprintf(f, "# slop-shop transcript, %s\n\n", time.Now().Format(time.DateTime))
+	ollama.SetTranscript(f)
+	tools.SetTranscript(f)
+	return nil
+}
@@ -0,0 +1,67 @@
+package tui
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/kek/slop-shop/styles"
+	"github.com/kek/slop-shop/tools"
+)
+
+// openApprovals shows the /approvals panel with the approval rules in effect
+func (m *REPLModel) openApprovals() {
+	m.approvals = tools.Approvals()
+	m.approvalCursor = 0
+	m.approvalsStatus = ""
+	m.showApprovals = true
+}
+
+// approvalsKey handles a key while the /approvals panel is open
+func (m *REPLModel) approvalsKey(key string) {
+	switch key {
+	case "up":
+		m.approvalCursor = max(m.approvalCursor-1, 0)
+	case "down":
+		m.approvalCursor = max(min(m.approvalCursor+1, len(m.approvals)-1), 0)
+	case "d", "delete", "backspace":
+		if m.approvalCursor >= len(m.approvals) {
+			return
+		}
+		rule := m.approvals[m.approvalCursor]
+		if err := tools.RevokeApproval(rule); err != nil {
+			m.approvalsStatus = "Could not revoke: " + err.Error()
+			return
+		}
+		m.approvals = tools.Approvals()
+		m.approvalCursor = max(min(m.approvalCursor, len(m.approvals)-1), 0)
+		m.approvalsStatus = "Revoked " + rule.String()
+	case "esc", "enter":
+		m.showApprovals = false
+	}
+}
+
+// renderApprovals draws the /approvals panel
+func (m *REPLModel) renderApprovals() string {
+	var s strings.Builder
+	s.WriteString(fmt.Sprintf("Approved tool calls: %d\n", len(m.approvals)))
+	if len(m.approvals) == 0 {
+		s.WriteString("None yet. With -confirm, calls approved for the session or always are listed here.\n")
+	}
+	for i, rule := range m.approvals {
+		scope := "session"
+		if rule.Persistent {
+			scope = "always "
+		}
+		line := fmt.Sprintf("%s  %s  %s", scope, rule, styles.MutedStyle.Render(rule.Repo))
+		if i == m.approvalCursor {
+			s.WriteString(styles.PromptStyle.Render("> ") + line + "\n")
+		} else {
+			s.WriteString("  " + line + "\n")
+		}
+	}
+	s.WriteString(styles.MutedStyle.Render("↑/↓ move · d revoke · Esc close") + "\n")
+	if m.approvalsStatus != "" {
+		s.WriteString(m.approvalsStatus + "\n")
+	}
+	return s.String()
+}
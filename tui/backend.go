@@ -0,0 +1,100 @@
+package tui
+
+import (
+	"fmt"
+	"time"
+
+	tea "github.com/charmbracelet/bubbletea"
+	"github.com/kek/slop-shop/ollama"
+	"github.com/kek/slop-shop/styles"
+)
+
+// firstRetry and maxRetry bound the wait between checks whether an Ollama
+// server that went away is back, which doubles after each failed check
+const (
+	firstRetry = time.Second
+	maxRetry   = 30 * time.Second
+)
+
+// streamEnd is sent by a chat request once its response is complete
+type streamEnd struct {
+	input      string       // The question asked
+	attachment *pastedLog   // The log sent with it, kept for asking again
+	meta       *messageMeta // What produced the response, unless it failed
+	err        error
+}
+
+// probeMsg carries the outcome of a check whether the server is back
+type probeMsg struct {
+	err error
+}
+
+// goOffline shows that the server cannot be reached and starts checking for
+// it to come back. The question that failed is asked again then.
+func (m *REPLModel) goOffline(input string, err error) {
+	if !m.offline {
+		m.offline = true
+		m.offlineSince = time.Now()
+		m.retryDelay = firstRetry
+	}
+	m.offlineErr = err.Error()
+	m.retryAt = time.Now().Add(m.retryDelay)
+	if input != "" {
+		m.pendingInput = input
+	}
+}
+
+// probeBackend returns the command checking whether the server is back,
+// when it is offline and the next check is due
+func (m *REPLModel) probeBackend() tea.Cmd {
+	if !m.offline || m.probing || time.Now().Before(m.retryAt) {
+		return nil
+	}
+	m.probing = true
+	client := ollama.NewClient(m.ollamaURL, m.model, m.temperature, m.topP)
+	return func() tea.Msg {
+		return probeMsg{err: client.Ping()}
+	}
+}
+
+// backendProbed handles the outcome of a check: once the server answers,
+// the question that failed is asked again, with the repository context, as
+// the restarted server remembers nothing of the session
+func (m *REPLModel) backendProbed(msg probeMsg) tea.Cmd {
+	m.probing = false
+	if msg.err != nil {
+		m.offlineErr = msg.err.Error()
+		m.retryDelay = min(m.retryDelay*2, maxRetry)
+		m.retryAt = time.Now().Add(m.retryDelay)
+		return nil
+	}
+
+	m.offline = false
+	input := m.pendingInput
+	m.pendingInput = ""
+	if input == "" || m.processing {
+		m.conversationHistory = append(m.conversationHistory, "System: Ollama is back")
+		return nil
+	}
+	m.conversationHistory = append(m.conversationHistory, "System: Ollama is back; asking again: "+input)
+	m.processing = true
+	return func() tea.Msg {
+		return ollamaRequestMsg{input: input}
+	}
+}
+
+// offlineBanner is the line shown while the server cannot be reached, or ""
+func (m *REPLModel) offlineBanner() string {
+	if !m.offline {
+		return ""
+	}
+	next := "checking now"
+	if wait := time.Until(m.retryAt); !m.probing && wait > 0 {
+		next = fmt.Sprintf("next check in %s", wait.Round(time.Second))
+	}
+	banner := fmt.Sprintf("⚠️  Backend offline since %s, %s: %s", m.offlineSince.Format("15:04:05"), next, m.offlineErr)
+	if m.pendingInput != "" {
+		banner += "\n   Your question is sent again once it is back"
+	}
+	return styles.WarningStyle.Render(banner) + "\n\n"
+}
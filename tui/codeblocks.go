@@ -0,0 +1,203 @@
+package tui
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/kek/slop-shop/styles"
+	"github.com/kek/slop-shop/tools"
+)
+
+// codeBlock is a fenced code block of a response
+type codeBlock struct {
+	info string // Fence info string, such as a language or a file name
+	code string
+}
+
+// pathLike matches a relative file path such as cmd/main.go
+var pathLike = regexp.MustCompile(`^[\w.-]+(/[\w.-]+)*\.\w+$`)
+
+// extractCodeBlocks returns the fenced code blocks of a response in order
+func extractCodeBlocks(response string) []codeBlock {
+	var blocks []codeBlock
+	var current *codeBlock
+	var fence string
+	var lines []string
+	for _, line := range strings.Split(response, "\n") {
+		trimmed := strings.TrimSpace(line)
+		if current == nil {
+			if strings.HasPrefix(trimmed, "```") || strings.HasPrefix(trimmed, "~~~") {
+				fence = trimmed[:3]
+				current = &codeBlock{info: strings.TrimSpace(strings.TrimLeft(trimmed, fence[:1]))}
+				lines = nil
+			}
+			continue
+		}
+		if strings.HasPrefix(trimmed, fence) && strings.Trim(trimmed, fence[:1]) == "" {
+			current.code = strings.Join(lines, "\n") + "\n"
+			blocks = append(blocks, *current)
+			current = nil
+			continue
+		}
+		lines = append(lines, line)
+	}
+	return blocks
+}
+
+// suggestedPath guesses where a block belongs from its fence info string, as
+// in ```go cmd/main.go or ```title="main.go", or from a first-line comment
+// naming the file
+func (b codeBlock) suggestedPath() string {
+	for _, field := range strings.Fields(b.info) {
+		field = strings.Trim(field, `"'`)
+		if _, value, ok := strings.Cut(field, "="); ok {
+			field = strings.Trim(value, `"'`)
+		}
+		if _, value, ok := strings.Cut(field, ":"); ok {
+			field = value
+		}
+		if pathLike.MatchString(field) {
+			return field
+		}
+	}
+
+	first, _, _ := strings.Cut(b.code, "\n")
+	first = strings.TrimSpace(first)
+	for _, marker := range []string{"//", "#", "--", "/*", "<!--", ";"} {
+		if rest, ok := strings.CutPrefix(first, marker); ok {
+			rest = strings.TrimSpace(strings.TrimSuffix(strings.TrimSuffix(rest, "-->"), "*/"))
+			for _, label := range []string{"File:", "file:", "Filename:", "filename:", "Path:", "path:"} {
+				rest = strings.TrimSpace(strings.TrimPrefix(rest, label))
+			}
+			if pathLike.MatchString(rest) {
+				return rest
+			}
+		}
+	}
+	return ""
+}
+
+// openCodeBlocks lists the code blocks of the last response
+func (m *REPLModel) openCodeBlocks() {
+	m.blocks = nil
+	for i := len(m.conversationHistory) - 1; i >= 0; i-- {
+		entry := m.conversationHistory[i]
+		if strings.HasPrefix(entry, "User: ") {
+			break
+		}
+		if !strings.HasPrefix(entry, "System: ") {
+			m.blocks = extractCodeBlocks(entry)
+			break
+		}
+	}
+	if len(m.blocks) == 0 {
+		m.conversationHistory = append(m.conversationHistory, "System: The last response has no code blocks")
+		return
+	}
+	m.blockCursor = 0
+	m.blockPath = ""
+	m.editingPath = false
+	m.confirmOverwrite = false
+	m.blockStatus = ""
+}
+
+// blocksKey handles a key while the code blocks are listed
+func (m *REPLModel) blocksKey(key string) {
+	switch {
+	case m.confirmOverwrite:
+		m.confirmOverwrite = false
+		if key == "y" || key == "Y" {
+			m.saveBlock()
+		} else {
+			m.blockStatus = "Not saved"
+		}
+	case m.editingPath:
+		switch key {
+		case "enter":
+			if strings.TrimSpace(m.blockPath) == "" {
+				return
+			}
+			if _, err := os.Stat(filepath.Join(repoPath, m.blockPath)); err == nil {
+				m.confirmOverwrite = true
+				return
+			}
+			m.saveBlock()
+		case "esc":
+			m.editingPath = false
+		case "backspace":
+			if len(m.blockPath) > 0 {
+				m.blockPath = m.blockPath[:len(m.blockPath)-1]
+			}
+		case "space":
+			m.blockPath += " "
+		default:
+			if len(key) == 1 && key[0] >= 32 && key[0] <= 126 {
+				m.blockPath += key
+			}
+		}
+	default:
+		switch key {
+		case "up":
+			m.blockCursor = max(m.blockCursor-1, 0)
+		case "down":
+			m.blockCursor = min(m.blockCursor+1, len(m.blocks)-1)
+		case "enter":
+			m.blockPath = m.blocks[m.blockCursor].suggestedPath()
+			m.editingPath = true
+			m.blockStatus = ""
+		case "esc":
+			m.blocks = nil
+		}
+	}
+}
+
+// saveBlock writes the selected block through the CREATE_FILE tool, so the
+// tool policy applies as it does to the model's writes
+func (m *REPLModel) saveBlock() {
+	m.editingPath = false
+	result := tools.RunTool(io.Discard, tools.ToolCall{Name: "CREATE_FILE", Args: m.blockPath, Body: m.blocks[m.blockCursor].code}, repoPath)
+	if !result.Success {
+		m.blockStatus = "Not saved: " + strings.TrimPrefix(result.Output, "Error: ")
+		return
+	}
+	m.blockStatus = "Saved " + m.blockPath
+}
+
+// renderCodeBlocks lists the code blocks, or asks where to save the selected one
+func (m *REPLModel) renderCodeBlocks() string {
+	var s strings.Builder
+	s.WriteString("Code blocks in the last response:\n")
+	for i, block := range m.blocks {
+		label := block.info
+		if label == "" {
+			label = "text"
+		}
+		line := fmt.Sprintf("%d. %s · %d lines", i+1, label, strings.Count(block.code, "\n"))
+		if first, _, _ := strings.Cut(strings.TrimSpace(block.code), "\n"); first != "" {
+			line += " · " + truncateLine(first, 40)
+		}
+		if i == m.blockCursor {
+			s.WriteString(styles.PromptStyle.Render("> "+line) + "\n")
+		} else {
+			s.WriteString("  " + line + "\n")
+		}
+	}
+
+	switch {
+	case m.confirmOverwrite:
+		s.WriteString(styles.WarningStyle.Render(m.blockPath+" exists. Overwrite it? (y/n)") + "\n")
+	case m.editingPath:
+		s.WriteString("Save to: " + m.blockPath + "█\n")
+		s.WriteString(styles.MutedStyle.Render("Enter save · Esc back") + "\n")
+	default:
+		s.WriteString(styles.MutedStyle.Render("↑/↓ move · Enter choose where to save · Esc close") + "\n")
+	}
+	if m.blockStatus != "" {
+		s.WriteString(m.blockStatus + "\n")
+	}
+	return s.String()
+}
@@ -0,0 +1,161 @@
+package tui
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	tea "github.com/charmbracelet/bubbletea"
+	"github.com/charmbracelet/x/ansi"
+)
+
+// driverTick is how often a Driver advances the REPL while it waits
+const driverTick = 10 * time.Millisecond
+
+// Driver runs the REPL without a terminal, so tests and other programs can
+// script a session: type and press keys, read the rendered frames and wait
+// for what they expect. The REPL's animation timer is replaced by ticks the
+// driver sends while it waits, so nothing happens between calls.
+type Driver struct {
+	m *REPLModel
+
+	mu       sync.Mutex
+	messages []tea.Msg // Messages from commands that finished, not yet handled
+	quit     bool
+}
+
+// NewDriver starts a REPL with the same settings as StartChat
+func NewDriver(url, model, system, context string, temperature, topP float64, toolsEnabled bool) *Driver {
+	d := &Driver{m: newREPLModel(url, model, system, context, temperature, topP, toolsEnabled, false)}
+	d.m.streamCommandOutput()
+	d.run(d.m.Init())
+	return d
+}
+
+// driverKeys maps the names Press accepts to their keys
+var driverKeys = map[string]tea.KeyType{
+	"enter": tea.KeyEnter, "esc": tea.KeyEsc, "tab": tea.KeyTab, "backspace": tea.KeyBackspace,
+	"delete": tea.KeyDelete, "space": tea.KeySpace, "up": tea.KeyUp, "down": tea.KeyDown,
+	"left": tea.KeyLeft, "right": tea.KeyRight, "pgup": tea.KeyPgUp, "pgdown": tea.KeyPgDown,
+	"ctrl+c": tea.KeyCtrlC, "f1": tea.KeyF1, "f2": tea.KeyF2, "f3": tea.KeyF3, "f4": tea.KeyF4,
+	"f5": tea.KeyF5, "f6": tea.KeyF6, "f7": tea.KeyF7, "f8": tea.KeyF8, "f9": tea.KeyF9, "f10": tea.KeyF10,
+}
+
+// Press sends named keys, such as "enter", "up", "esc", "ctrl+c" or "f1"
+func (d *Driver) Press(keys ...string) error {
+	for _, key := range keys {
+		keyType, ok := driverKeys[key]
+		if !ok {
+			return fmt.Errorf("unknown key %q", key)
+		}
+		d.Send(tea.KeyMsg{Type: keyType})
+	}
+	return nil
+}
+
+// Type sends the characters of text as key presses
+func (d *Driver) Type(text string) {
+	for _, r := range text {
+		d.Send(tea.KeyMsg{Type: tea.KeyRunes, Runes: []rune{r}})
+	}
+}
+
+// Ask types a question and presses Enter
+func (d *Driver) Ask(question string) {
+	d.Type(question)
+	d.Press("enter")
+}
+
+// Resize reports a terminal of the given size, as Bubble Tea does on start
+// and when the window changes
+func (d *Driver) Resize(width, height int) {
+	d.Send(tea.WindowSizeMsg{Width: width, Height: height})
+}
+
+// Send hands a message to the REPL and runs the commands it returns
+func (d *Driver) Send(msg tea.Msg) {
+	_, cmd := d.m.Update(msg)
+	d.run(cmd)
+}
+
+// run starts a command in the background, as Bubble Tea does, and keeps
+// the message it returns for the next step. Batches are split up, and the
+// REPL's own ticks are dropped in favour of the driver's.
+func (d *Driver) run(cmd tea.Cmd) {
+	if cmd == nil {
+		return
+	}
+	go func() {
+		msg := cmd()
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		switch msg := msg.(type) {
+		case tickMsg, nil:
+		case tea.QuitMsg:
+			d.quit = true
+		default:
+			d.messages = append(d.messages, msg)
+		}
+	}()
+}
+
+// step handles the messages of finished commands, then sends a tick
+func (d *Driver) step() {
+	d.mu.Lock()
+	messages := d.messages
+	d.messages = nil
+	d.mu.Unlock()
+	for _, msg := range messages {
+		if batch, ok := msg.(tea.BatchMsg); ok {
+			for _, cmd := range batch {
+				d.run(cmd)
+			}
+			continue
+		}
+		d.Send(msg)
+	}
+	d.Send(tickMsg(time.Now()))
+}
+
+// Frame returns the screen the REPL shows now, without colors and styling
+func (d *Driver) Frame() string {
+	return ansi.Strip(d.m.View())
+}
+
+// Quit reports whether the REPL has ended
+func (d *Driver) Quit() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.quit
+}
+
+// WaitFor advances the REPL until the frame satisfies done, returning an
+// error with the last frame when it does not within timeout
+func (d *Driver) WaitFor(done func(frame string) bool, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		d.step()
+		if frame := d.Frame(); done(frame) {
+			return nil
+		} else if time.Now().After(deadline) {
+			return fmt.Errorf("condition not met after %s; the screen shows:\n%s", timeout, frame)
+		}
+		time.Sleep(driverTick)
+	}
+}
+
+// WaitForText waits until the frame contains text
+func (d *Driver) WaitForText(text string, timeout time.Duration) error {
+	return d.WaitFor(func(frame string) bool { return strings.Contains(frame, text) }, timeout)
+}
+
+// WaitIdle advances the REPL until no question is being answered and no
+// check whether an offline server is back is running
+func (d *Driver) WaitIdle(timeout time.Duration) error {
+	return d.WaitFor(func(string) bool {
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		return !d.m.processing && !d.m.probing && len(d.messages) == 0
+	}, timeout)
+}
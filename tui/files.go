@@ -0,0 +1,132 @@
+package tui
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/kek/slop-shop/config"
+	"github.com/kek/slop-shop/repo"
+	"github.com/kek/slop-shop/styles"
+)
+
+// filesPanelRows is how many files the /files panel lists at a time
+const filesPanelRows = 15
+
+// contextFile is a file of the context listed in the /files panel
+type contextFile struct {
+	repo.ContextSection
+	excluded bool
+}
+
+// openFiles shows the /files panel, splitting the context into its files the
+// first time
+func (m *REPLModel) openFiles() {
+	if m.files == nil {
+		m.files = []contextFile{}
+		for _, section := range repo.SplitContext(m.context) {
+			m.files = append(m.files, contextFile{ContextSection: section})
+		}
+	}
+	m.filesCursor = m.firstFile()
+	m.showFiles = true
+}
+
+// firstFile returns the index of the first listed file; text before the first
+// file, such as piped input, is always sent and not listed
+func (m *REPLModel) firstFile() int {
+	if len(m.files) > 0 && m.files[0].Name == "" {
+		return 1
+	}
+	return 0
+}
+
+// filesKey handles a key while the /files panel is open
+func (m *REPLModel) filesKey(key string) {
+	switch key {
+	case "up":
+		m.filesCursor = max(m.filesCursor-1, m.firstFile())
+	case "down":
+		m.filesCursor = min(m.filesCursor+1, len(m.files)-1)
+	case " ", "space":
+		if m.filesCursor < len(m.files) && m.files[m.filesCursor].Name != "" {
+			m.files[m.filesCursor].excluded = !m.files[m.filesCursor].excluded
+			m.rebuildContext()
+		}
+	case "s":
+		m.filesStatus = m.saveExclusions()
+	case "esc", "enter":
+		m.showFiles = false
+		m.filesStatus = ""
+	}
+}
+
+// rebuildContext sends only the files that are not excluded
+func (m *REPLModel) rebuildContext() {
+	var buf strings.Builder
+	for _, file := range m.files {
+		if !file.excluded {
+			buf.WriteString(file.Text)
+		}
+	}
+	m.context = buf.String()
+}
+
+// saveExclusions adds the excluded files to the repository's ignore file and
+// describes the outcome
+func (m *REPLModel) saveExclusions() string {
+	var paths []string
+	for _, file := range m.files {
+		if file.excluded {
+			paths = append(paths, file.Name)
+		}
+	}
+	if len(paths) == 0 {
+		return "No files are excluded"
+	}
+	added, err := config.AddIgnorePatterns(repoPath, paths)
+	if err != nil {
+		return "Could not save: " + err.Error()
+	}
+	return fmt.Sprintf("Added %d files to %s", added, config.IgnoreFileName)
+}
+
+// renderFiles draws the /files panel around the cursor
+func (m *REPLModel) renderFiles() string {
+	var s strings.Builder
+	listed, excluded := 0, 0
+	for _, file := range m.files {
+		if file.Name != "" {
+			listed++
+			if file.excluded {
+				excluded++
+			}
+		}
+	}
+	s.WriteString(fmt.Sprintf("Context files: %d of %d sent (%d characters)\n", listed-excluded, listed, len(m.context)))
+	if listed == 0 {
+		s.WriteString("No repository files in the context.\n")
+	}
+
+	start := max(min(m.filesCursor-filesPanelRows/2, len(m.files)-filesPanelRows), m.firstFile())
+	end := min(start+filesPanelRows, len(m.files))
+	for i := start; i < end; i++ {
+		file := m.files[i]
+		box := "[x]"
+		if file.excluded {
+			box = "[ ]"
+		}
+		line := fmt.Sprintf("%s %s (%d bytes)", box, file.Name, len(file.Text))
+		if i == m.filesCursor {
+			s.WriteString(styles.PromptStyle.Render("> "+line) + "\n")
+		} else if file.excluded {
+			s.WriteString(styles.MutedStyle.Render("  "+line) + "\n")
+		} else {
+			s.WriteString("  " + line + "\n")
+		}
+	}
+	s.WriteString(styles.MutedStyle.Render("↑/↓ move · Space include/exclude · s save exclusions to "+config.IgnoreFileName+" · Esc close") + "\n")
+	if m.filesStatus != "" {
+		s.WriteString(m.filesStatus + "\n")
+	}
+	return s.String()
+}
@@ -0,0 +1,93 @@
+package tui
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	tea "github.com/charmbracelet/bubbletea"
+	"github.com/kek/slop-shop/styles"
+)
+
+// loadingModel is a screen with a spinner and a status line, shown while the
+// REPL's context is loaded
+type loadingModel struct {
+	title       string
+	status      string
+	frame       int
+	done        bool
+	interrupted bool
+}
+
+type loadingStatusMsg string
+type loadingDoneMsg struct{}
+
+// RunLoading shows a loading screen until work returns and returns its error.
+// Work reports its progress through status, which replaces the status line.
+func RunLoading(title string, work func(status func(string)) error) error {
+	m := &loadingModel{title: title}
+	p := tea.NewProgram(m, tea.WithOutput(os.Stderr))
+
+	var workErr error
+	finished := make(chan struct{})
+	go func() {
+		defer close(finished)
+		workErr = work(func(status string) {
+			p.Send(loadingStatusMsg(status))
+		})
+		p.Send(loadingDoneMsg{})
+	}()
+
+	if _, err := p.Run(); err != nil {
+		return fmt.Errorf("error showing the loading screen: %v", err)
+	}
+	if m.interrupted {
+		return fmt.Errorf("loading interrupted")
+	}
+	<-finished
+	return workErr
+}
+
+// Init starts the spinner
+func (m *loadingModel) Init() tea.Cmd {
+	return loadingTick()
+}
+
+func loadingTick() tea.Cmd {
+	return tea.Tick(time.Millisecond*100, func(t time.Time) tea.Msg {
+		return tickMsg(t)
+	})
+}
+
+// Update follows the status of the work and quits when it is done
+func (m *loadingModel) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
+	switch msg := msg.(type) {
+	case tea.KeyMsg:
+		if msg.String() == "ctrl+c" {
+			m.interrupted = true
+			m.done = true
+			return m, tea.Quit
+		}
+	case loadingStatusMsg:
+		m.status = string(msg)
+	case loadingDoneMsg:
+		m.done = true
+		return m, tea.Quit
+	case tickMsg:
+		m.frame = (m.frame + 1) % len(spinnerChars)
+		return m, loadingTick()
+	}
+	return m, nil
+}
+
+// View shows the spinner, title and status, and nothing once loading is done
+func (m *loadingModel) View() string {
+	if m.done {
+		return ""
+	}
+	view := styles.SpinnerStyle.Render(spinnerChars[m.frame]) + " " + styles.TitleStyle.Render(m.title) + "\n"
+	if m.status != "" {
+		view += styles.MutedStyle.Render("  "+m.status) + "\n"
+	}
+	return view
+}
@@ -0,0 +1,255 @@
+package tui
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	tea "github.com/charmbracelet/bubbletea"
+	"github.com/charmbracelet/x/ansi"
+	"github.com/charmbracelet/x/term"
+	"github.com/kek/slop-shop/styles"
+)
+
+// pagerModel shows a long response a screen at a time, like less, with
+// searching
+type pagerModel struct {
+	title    string
+	response string
+	lines    []string // Response rendered at the current width
+	plain    []string // The same lines without styling, which are searched
+	width    int
+	height   int
+	top      int // First line shown
+
+	searching bool   // The search pattern is being typed
+	input     string // Pattern typed so far
+	pattern   string // Pattern last searched for
+	matches   []int  // Lines containing the pattern
+	current   int    // Index in matches of the match shown last
+	message   string // Shown in the status line until the next key
+}
+
+// RenderResponse renders a model response as the REPL shows it: wrapped to
+// width, with the repository files it names highlighted
+func RenderResponse(response string, width int) string {
+	return renderExchange(response, width)
+}
+
+// PageResponse shows a response in a full-screen pager until it is closed
+// with q. Keys are read from the terminal even when stdin is redirected.
+func PageResponse(title, response string) error {
+	m := &pagerModel{title: title, response: response}
+	options := []tea.ProgramOption{tea.WithAltScreen()}
+	if !term.IsTerminal(os.Stdin.Fd()) {
+		options = append(options, tea.WithInputTTY())
+	}
+	if _, err := tea.NewProgram(m, options...).Run(); err != nil {
+		return fmt.Errorf("error showing the pager: %v", err)
+	}
+	return nil
+}
+
+// Init does nothing; the pager waits for the size of the terminal
+func (m *pagerModel) Init() tea.Cmd {
+	return nil
+}
+
+// layout renders the response for the terminal's width
+func (m *pagerModel) layout(width, height int) {
+	m.width, m.height = width, height
+	rendered := strings.TrimRight(RenderResponse(m.response, styles.WrapWidth(width)), "\n")
+	m.lines = strings.Split(rendered, "\n")
+	m.plain = make([]string, len(m.lines))
+	for i, line := range m.lines {
+		m.plain[i] = ansi.Strip(line)
+	}
+	if m.pattern != "" {
+		m.find(m.pattern)
+	}
+	m.scroll(0)
+}
+
+// page is the number of response lines that fit above the status line
+func (m *pagerModel) page() int {
+	return max(m.height-1, 1)
+}
+
+// scroll moves the view by delta lines, keeping it within the response
+func (m *pagerModel) scroll(delta int) {
+	m.top = max(min(m.top+delta, len(m.lines)-m.page()), 0)
+}
+
+// find collects the lines containing pattern, ignoring case
+func (m *pagerModel) find(pattern string) {
+	m.pattern = pattern
+	m.matches = nil
+	m.current = -1
+	lower := strings.ToLower(pattern)
+	for i, line := range m.plain {
+		if strings.Contains(strings.ToLower(line), lower) {
+			m.matches = append(m.matches, i)
+		}
+	}
+}
+
+// jump shows the next match after the current one, or the previous one when
+// backwards is set
+func (m *pagerModel) jump(backwards bool) {
+	if m.pattern == "" {
+		m.message = "No previous search"
+		return
+	}
+	if len(m.matches) == 0 {
+		m.message = "Pattern not found: " + m.pattern
+		return
+	}
+	next := m.current + 1
+	if backwards {
+		next = m.current - 1
+	}
+	if m.current < 0 {
+		// The first search starts from the line at the top of the screen
+		next = len(m.matches)
+		for i, line := range m.matches {
+			if line >= m.top {
+				next = i
+				break
+			}
+		}
+		if backwards {
+			next--
+		}
+	}
+	if next < 0 || next >= len(m.matches) {
+		m.message = "No more matches"
+		return
+	}
+	m.current = next
+	m.top = m.matches[next]
+	m.scroll(0)
+	m.message = fmt.Sprintf("Match %d of %d", next+1, len(m.matches))
+}
+
+// Update scrolls and searches on the keys less uses for them
+func (m *pagerModel) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
+	switch msg := msg.(type) {
+	case tea.WindowSizeMsg:
+		m.layout(msg.Width, msg.Height)
+	case tea.KeyMsg:
+		if m.searching {
+			return m, m.typeSearch(msg)
+		}
+		m.message = ""
+		switch msg.String() {
+		case "q", "esc", "ctrl+c":
+			return m, tea.Quit
+		case "down", "j", "enter":
+			m.scroll(1)
+		case "up", "k":
+			m.scroll(-1)
+		case "pgdown", " ", "f", "ctrl+f":
+			m.scroll(m.page())
+		case "pgup", "b", "ctrl+b":
+			m.scroll(-m.page())
+		case "d", "ctrl+d":
+			m.scroll(m.page() / 2)
+		case "u", "ctrl+u":
+			m.scroll(-m.page() / 2)
+		case "g", "home":
+			m.top = 0
+		case "G", "end":
+			m.scroll(len(m.lines))
+		case "/":
+			m.searching, m.input = true, ""
+		case "n":
+			m.jump(false)
+		case "N":
+			m.jump(true)
+		}
+	}
+	return m, nil
+}
+
+// typeSearch edits the search pattern and searches for it on enter
+func (m *pagerModel) typeSearch(msg tea.KeyMsg) tea.Cmd {
+	switch msg.Type {
+	case tea.KeyCtrlC:
+		return tea.Quit
+	case tea.KeyEsc:
+		m.searching = false
+	case tea.KeyEnter:
+		m.searching = false
+		if m.input != "" {
+			m.find(m.input)
+		}
+		m.current = -1
+		m.jump(false)
+	case tea.KeyBackspace:
+		if m.input == "" {
+			m.searching = false
+		} else {
+			runes := []rune(m.input)
+			m.input = string(runes[:len(runes)-1])
+		}
+	case tea.KeyRunes, tea.KeySpace:
+		m.input += string(msg.Runes)
+	}
+	return nil
+}
+
+// View shows a screen of the response and a status line with the position,
+// the search being typed or the outcome of the last key
+func (m *pagerModel) View() string {
+	if m.height == 0 {
+		return ""
+	}
+
+	var s strings.Builder
+	end := min(m.top+m.page(), len(m.lines))
+	for i := m.top; i < end; i++ {
+		line := m.lines[i]
+		if m.pattern != "" && strings.Contains(strings.ToLower(m.plain[i]), strings.ToLower(m.pattern)) {
+			line = highlightMatches(m.plain[i], m.pattern)
+		}
+		s.WriteString(ansi.Truncate(line, m.width, "") + "\n")
+	}
+	for i := end - m.top; i < m.page(); i++ {
+		s.WriteString(styles.MutedStyle.Render("~") + "\n")
+	}
+
+	var status string
+	switch {
+	case m.searching:
+		status = "/" + m.input
+	case m.message != "":
+		status = styles.MutedStyle.Render(m.message)
+	default:
+		position := "all"
+		if len(m.lines) > m.page() {
+			position = fmt.Sprintf("%d%%", end*100/len(m.lines))
+		}
+		status = styles.MutedStyle.Render(fmt.Sprintf("%s · lines %d-%d of %d (%s) · / search · q quit", m.title, m.top+1, end, len(m.lines), position))
+	}
+	s.WriteString(ansi.Truncate(status, m.width, ""))
+	return s.String()
+}
+
+// highlightMatches marks every case-insensitive occurrence of pattern in line
+func highlightMatches(line, pattern string) string {
+	lower, find := strings.ToLower(line), strings.ToLower(pattern)
+	if len(lower) != len(line) {
+		// Changing case changed the byte offsets, so only the line is marked
+		return styles.MatchStyle.Render(line)
+	}
+	var s strings.Builder
+	for {
+		i := strings.Index(lower, find)
+		if i < 0 {
+			s.WriteString(line)
+			return s.String()
+		}
+		s.WriteString(line[:i] + styles.MatchStyle.Render(line[i:i+len(find)]))
+		line, lower = line[i+len(find):], lower[i+len(find):]
+	}
+}
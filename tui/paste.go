@@ -0,0 +1,186 @@
+package tui
+
+import (
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+
+	tea "github.com/charmbracelet/bubbletea"
+	"github.com/charmbracelet/x/ansi"
+	"github.com/kek/slop-shop/styles"
+)
+
+// attachmentPrefix marks a conversation entry holding a pasted log
+const attachmentPrefix = "Attachment: "
+
+// maxPasteBytes is the most of a pasted log sent with a question. A larger
+// paste keeps its first quarter and last three quarters, where logs usually
+// say what started and what finally failed.
+const maxPasteBytes = 12000
+
+// clipboardCommands are the commands tried in order to read the clipboard as
+// text on macOS, Wayland, X11 and Windows
+var clipboardCommands = [][]string{
+	{"pbpaste"},
+	{"wl-paste", "--no-newline", "--type", "text/plain"},
+	{"xclip", "-selection", "clipboard", "-out"},
+	{"xsel", "--clipboard", "--output"},
+	{"powershell.exe", "-NoProfile", "-Command", "Get-Clipboard -Raw"},
+}
+
+// readClipboard returns the text on the clipboard, from the first clipboard
+// command that is installed and works
+var readClipboard = func() (string, error) {
+	var lastErr error
+	for _, command := range clipboardCommands {
+		if _, err := exec.LookPath(command[0]); err != nil {
+			continue
+		}
+		out, err := exec.Command(command[0], command[1:]...).Output()
+		if err != nil {
+			lastErr = fmt.Errorf("%s: %v", command[0], err)
+			continue
+		}
+		return string(out), nil
+	}
+	if lastErr != nil {
+		return "", lastErr
+	}
+	return "", errors.New("no clipboard command found; install xclip, xsel or wl-clipboard")
+}
+
+// pastedLog is a log read from the clipboard, sent with the next question
+type pastedLog struct {
+	text    string
+	lines   int // Lines of the paste before it was cut
+	bytes   int
+	omitted int // Lines left out of the middle, when the paste was too large
+}
+
+// pasteMsg carries what /paste-log read from the clipboard
+type pasteMsg struct {
+	text string
+	err  error
+}
+
+// pasteLog handles /paste-log: it reads the clipboard in the background,
+// or with "drop" removes the log waiting for the next question
+func (m *REPLModel) pasteLog(args string) tea.Cmd {
+	switch strings.TrimSpace(args) {
+	case "":
+		return func() tea.Msg {
+			text, err := readClipboard()
+			return pasteMsg{text: text, err: err}
+		}
+	case "drop":
+		if m.attachment == nil {
+			m.conversationHistory = append(m.conversationHistory, "System: No pasted log is waiting")
+		} else {
+			m.attachment = nil
+			m.conversationHistory = append(m.conversationHistory, "System: Pasted log dropped")
+		}
+	default:
+		m.conversationHistory = append(m.conversationHistory, "System: /paste-log reads the clipboard; /paste-log drop removes the pasted log")
+	}
+	return nil
+}
+
+// pasted keeps the log read from the clipboard for the next question
+func (m *REPLModel) pasted(msg pasteMsg) {
+	if msg.err != nil {
+		m.conversationHistory = append(m.conversationHistory, "System: Could not read the clipboard: "+msg.err.Error())
+		return
+	}
+	log := newPastedLog(msg.text)
+	if log == nil {
+		m.conversationHistory = append(m.conversationHistory, "System: The clipboard holds no text")
+		return
+	}
+	m.attachment = log
+	if log.omitted > 0 {
+		m.conversationHistory = append(m.conversationHistory, fmt.Sprintf("System: The pasted log is %s; %d lines from its middle are left out", pasteSize(log.bytes), log.omitted))
+	}
+}
+
+// newPastedLog cleans up pasted text, without terminal colors or carriage
+// returns, and cuts it to maxPasteBytes. It returns nil for blank text.
+func newPastedLog(text string) *pastedLog {
+	text = strings.ReplaceAll(ansi.Strip(text), "\r\n", "\n")
+	text = strings.Trim(text, "\n")
+	if strings.TrimSpace(text) == "" {
+		return nil
+	}
+	lines := strings.Split(text, "\n")
+	log := &pastedLog{text: text, lines: len(lines), bytes: len(text)}
+	if len(text) <= maxPasteBytes {
+		return log
+	}
+
+	// Whole lines from the start up to a quarter of the budget, then from
+	// the end for the rest
+	head, size := 0, 0
+	for head < len(lines) && size+len(lines[head])+1 <= maxPasteBytes/4 {
+		size += len(lines[head]) + 1
+		head++
+	}
+	tail := len(lines)
+	for tail > head && size+len(lines[tail-1])+1 <= maxPasteBytes {
+		size += len(lines[tail-1]) + 1
+		tail--
+	}
+	log.omitted = tail - head
+	log.text = strings.Join(lines[:head], "\n") + fmt.Sprintf("\n[... %d lines omitted ...]\n", log.omitted) + strings.Join(lines[tail:], "\n")
+	return log
+}
+
+// pasteSize formats a size in bytes for the summary of a pasted log
+func pasteSize(bytes int) string {
+	if bytes < 1024 {
+		return fmt.Sprintf("%d bytes", bytes)
+	}
+	return fmt.Sprintf("%.1f KB", float64(bytes)/1024)
+}
+
+// summary describes the log in one line
+func (log *pastedLog) summary() string {
+	summary := fmt.Sprintf("Pasted log · %d lines · %s", log.lines, pasteSize(log.bytes))
+	if log.omitted > 0 {
+		summary += fmt.Sprintf(" · %d lines left out", log.omitted)
+	}
+	return summary
+}
+
+// prompt returns the question with the log appended
+func (log *pastedLog) prompt(question string) string {
+	return question + "\n\nPasted log:\n```\n" + log.text + "\n```"
+}
+
+// entry returns the conversation entry showing the log under the question
+func (log *pastedLog) entry() string {
+	return attachmentPrefix + log.summary() + "\n" + log.text
+}
+
+// renderAttachment renders a pasted log in the conversation: its summary
+// line, followed by the log itself when attachments are expanded
+func renderAttachment(entry string, expanded bool) string {
+	summary, text, _ := strings.Cut(strings.TrimPrefix(entry, attachmentPrefix), "\n")
+	if !expanded {
+		return styles.MutedStyle.Render("📎 "+summary+" · F9 expands") + "\n"
+	}
+	var s strings.Builder
+	s.WriteString(styles.MutedStyle.Render("📎 "+summary+" · F9 collapses") + "\n")
+	for _, line := range strings.Split(text, "\n") {
+		s.WriteString(styles.MutedStyle.Render("  │ "+line) + "\n")
+	}
+	return s.String()
+}
+
+// attachmentLine is shown above the prompt while a pasted log waits for the
+// next question, or ""
+func (m *REPLModel) attachmentLine() string {
+	if m.attachment == nil {
+		return ""
+	}
+	return styles.InfoStyle.Render("📎 "+m.attachment.summary()+" goes with your next question · /paste-log drop removes it") + "\n"
+}
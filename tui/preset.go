@@ -0,0 +1,46 @@
+package tui
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/kek/slop-shop/config"
+	"github.com/kek/slop-shop/styles"
+)
+
+// choosePreset handles /preset: with a name it switches the options of the
+// following questions, without one it lists the presets
+func (m *REPLModel) choosePreset(name string) {
+	if name = strings.TrimSpace(name); name == "" {
+		var s strings.Builder
+		s.WriteString("System: Presets:")
+		active := config.MatchPreset(m.temperature, m.topP)
+		for _, preset := range config.Presets {
+			marker := " "
+			if preset.Name == active {
+				marker = "*"
+			}
+			s.WriteString(fmt.Sprintf("\n %s %-9s temperature %g, top_p %g: %s", marker, preset.Name, preset.Temperature, preset.TopP, preset.Description))
+		}
+		m.conversationHistory = append(m.conversationHistory, s.String())
+		return
+	}
+
+	preset, err := config.FindPreset(name)
+	if err != nil {
+		m.conversationHistory = append(m.conversationHistory, "System: "+err.Error())
+		return
+	}
+	m.temperature, m.topP = preset.Temperature, preset.TopP
+	m.conversationHistory = append(m.conversationHistory, fmt.Sprintf("System: Preset %s: temperature %g, top_p %g", preset.Name, preset.Temperature, preset.TopP))
+}
+
+// statusBar is the line under the title showing the model and the options
+// questions are asked with
+func (m *REPLModel) statusBar() string {
+	status := fmt.Sprintf("Model: %s │ Preset: %s (temperature %g, top_p %g)", m.model, config.MatchPreset(m.temperature, m.topP), m.temperature, m.topP)
+	if m.toolsEnabled {
+		status += " │ Tools: on"
+	}
+	return styles.MutedStyle.Render(status) + "\n\n"
+}
@@ -0,0 +1,96 @@
+package tui
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/kek/slop-shop/ollama"
+	"github.com/kek/slop-shop/repo"
+)
+
+// previewFiles is how many of the largest files a preview lists by name
+const previewFiles = 10
+
+// RenderPreview describes what a request would send to the model, with an
+// estimated token count for each part. With full set, it is followed by the
+// system prompt and the complete prompt text.
+func RenderPreview(model, system, prompt, context string, toolsEnabled, full bool) string {
+	withoutTools := ollama.BuildPrompt(prompt, context, false)
+	fullPrompt := ollama.BuildPrompt(prompt, context, toolsEnabled)
+	fullSystem := ollama.BuildSystem(system, toolsEnabled)
+
+	var other string
+	var files []repo.ContextSection
+	for _, section := range repo.SplitContext(context) {
+		if section.Name == "" {
+			other += section.Text
+		} else {
+			files = append(files, section)
+		}
+	}
+	// The heading of the repository files counts with the files
+	if i := strings.Index(other, "Repository Contents:\n"); i >= 0 {
+		other = other[:i]
+	}
+	filesText := context[len(other):]
+
+	total := ollama.EstimateTokens(fullSystem) + ollama.EstimateTokens(fullPrompt)
+	var buf strings.Builder
+	fmt.Fprintf(&buf, "Request preview for %s: about %d tokens (%d bytes)\n\n", model, total, len(fullSystem)+len(fullPrompt))
+
+	row := func(name string, text string) {
+		fmt.Fprintf(&buf, "  %-32s %8d tokens\n", name, ollama.EstimateTokens(text))
+	}
+	if system != "" {
+		row("System prompt", system)
+	}
+	if other != "" {
+		row("Piped input and conversation", other)
+	}
+	if len(files) > 0 {
+		row(fmt.Sprintf("Repository files (%d)", len(files)), filesText)
+
+		sort.SliceStable(files, func(i, j int) bool { return len(files[i].Text) > len(files[j].Text) })
+		for i, file := range files {
+			if i == previewFiles {
+				fmt.Fprintf(&buf, "    ... %d more files\n", len(files)-previewFiles)
+				break
+			}
+			fmt.Fprintf(&buf, "    %-30s %8d tokens\n", shortenPath(file.Name, 30), ollama.EstimateTokens(file.Text))
+		}
+	}
+	if memory := ollama.MemorySection(); memory != "" {
+		row("Project memory", memory)
+	}
+	row("Question", withoutTools[len(context)+len(ollama.MemorySection()):])
+	switch {
+	case len(fullSystem) > len(system):
+		row("Tool instructions (system)", fullSystem[len(system):])
+	case len(fullPrompt) > len(withoutTools):
+		row("Tool instructions", fullPrompt[len(withoutTools):])
+	case toolsEnabled:
+		buf.WriteString("  Tool instructions left out: the question does not look like it needs tools\n")
+	}
+	buf.WriteString("\nToken counts are estimates at four bytes per token.\n")
+
+	if full {
+		if fullSystem != "" {
+			buf.WriteString("\n=== System prompt ===\n")
+			buf.WriteString(fullSystem)
+			buf.WriteString("\n")
+		}
+		buf.WriteString("\n=== Prompt ===\n")
+		buf.WriteString(fullPrompt)
+		buf.WriteString("\n")
+	}
+	return buf.String()
+}
+
+// shortenPath keeps the end of a path that is longer than width
+func shortenPath(path string, width int) string {
+	if len(path) <= width {
+		return path
+	}
+	return "..." + path[len(path)-width+3:]
+}
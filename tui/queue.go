@@ -0,0 +1,90 @@
+package tui
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/kek/slop-shop/ollama"
+	"github.com/kek/slop-shop/styles"
+)
+
+// openQueue shows the /queue panel with the requests in flight
+func (m *REPLModel) openQueue() {
+	m.queueCursor = 0
+	m.queueStatus = ""
+	m.showQueue = true
+}
+
+// queueKey handles a key while the /queue panel is open. The list is read
+// again on every key, since requests finish while it is shown.
+func (m *REPLModel) queueKey(key string) {
+	requests := ollama.Requests()
+	switch key {
+	case "up":
+		m.queueCursor = max(m.queueCursor-1, 0)
+	case "down":
+		m.queueCursor = max(min(m.queueCursor+1, len(requests)-1), 0)
+	case "x", "d", "delete", "backspace":
+		if m.queueCursor >= len(requests) {
+			return
+		}
+		request := requests[m.queueCursor]
+		if ollama.CancelRequest(request.ID) {
+			m.queueStatus = fmt.Sprintf("Cancelled #%d %s", request.ID, request.Label)
+		} else {
+			m.queueStatus = fmt.Sprintf("#%d %s had already finished", request.ID, request.Label)
+		}
+	case "esc", "enter":
+		m.showQueue = false
+	}
+}
+
+// describeRequest renders a request in flight as one line
+func describeRequest(request ollama.QueuedRequest) string {
+	state := "waiting"
+	if request.Streaming {
+		state = "streaming"
+	}
+	return fmt.Sprintf("#%d %s  %s, %s  %s", request.ID, request.Label, state, time.Since(request.Started).Round(time.Second), styles.MutedStyle.Render(request.Model))
+}
+
+// renderQueue draws the /queue panel
+func (m *REPLModel) renderQueue() string {
+	requests := ollama.Requests()
+	m.queueCursor = max(min(m.queueCursor, len(requests)-1), 0)
+
+	var s strings.Builder
+	s.WriteString(fmt.Sprintf("Requests in flight: %d\n", len(requests)))
+	if len(requests) == 0 {
+		s.WriteString("None. Questions, /variants and the model calls tools make are listed here while they run.\n")
+	}
+	for i, request := range requests {
+		if i == m.queueCursor {
+			s.WriteString(styles.PromptStyle.Render("> ") + describeRequest(request) + "\n")
+		} else {
+			s.WriteString("  " + describeRequest(request) + "\n")
+		}
+	}
+	s.WriteString(styles.MutedStyle.Render("↑/↓ move · x cancel · Esc close") + "\n")
+	if m.queueStatus != "" {
+		s.WriteString(m.queueStatus + "\n")
+	}
+	return s.String()
+}
+
+// queueIndicator is the line above the prompt while more than one request is
+// in flight, or "" otherwise
+func queueIndicator() string {
+	requests := ollama.Requests()
+	if len(requests) < 2 {
+		return ""
+	}
+	waiting := 0
+	for _, request := range requests {
+		if !request.Streaming {
+			waiting++
+		}
+	}
+	return styles.InfoStyle.Render(fmt.Sprintf("⏳ %d requests in flight, %d waiting · /queue to view or cancel them", len(requests), waiting)) + "\n"
+}
@@ -0,0 +1,138 @@
+package tui
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/charmbracelet/lipgloss"
+	"github.com/charmbracelet/x/ansi"
+	"github.com/kek/slop-shop/styles"
+	"github.com/muesli/termenv"
+)
+
+// discussedFile is a repository file named in the responses of the session
+type discussedFile struct {
+	Path      string
+	Responses int // How many responses named it
+}
+
+// repoFile returns the path of the repository file a path found in a
+// response names, if it names one
+func repoFile(candidate string) (string, bool) {
+	path := filepath.Clean(strings.TrimPrefix(strings.TrimRight(candidate, "."), "./"))
+	if !filepath.IsLocal(path) {
+		return "", false
+	}
+	info, err := os.Stat(filepath.Join(repoPath, path))
+	if err != nil || !info.Mode().IsRegular() {
+		return "", false
+	}
+	return filepath.ToSlash(path), true
+}
+
+// referencedPaths returns the repository files a response names, each once,
+// in the order they are first named
+func referencedPaths(response string) []string {
+	var paths []string
+	seen := make(map[string]bool)
+	for _, candidate := range pathPattern.FindAllString(response, -1) {
+		if path, ok := repoFile(candidate); ok && !seen[path] {
+			seen[path] = true
+			paths = append(paths, path)
+		}
+	}
+	return paths
+}
+
+// renderReferences renders a line of a response, highlighting the repository
+// files in paths. Terminals with colors get the files as hyperlinks too, which
+// open them on a click where the terminal supports it.
+func renderReferences(line string, paths map[string]bool) string {
+	if len(paths) == 0 {
+		return styles.AssistantStyle.Render(line)
+	}
+	var s strings.Builder
+	last := 0
+	for _, match := range pathPattern.FindAllStringIndex(line, -1) {
+		path, ok := repoFile(line[match[0]:match[1]])
+		if !ok || !paths[path] {
+			continue
+		}
+		if match[0] > last {
+			s.WriteString(styles.AssistantStyle.Render(line[last:match[0]]))
+		}
+		s.WriteString(linkReference(line[match[0]:match[1]], path))
+		last = match[1]
+	}
+	if last == 0 {
+		return styles.AssistantStyle.Render(line)
+	}
+	if last < len(line) {
+		s.WriteString(styles.AssistantStyle.Render(line[last:]))
+	}
+	return s.String()
+}
+
+// linkReference renders the text naming a repository file, with an OSC 8
+// hyperlink to the file unless colors are off
+func linkReference(text, path string) string {
+	rendered := styles.ReferenceStyle.Render(text)
+	if lipgloss.ColorProfile() == termenv.Ascii {
+		return rendered
+	}
+	abs, err := filepath.Abs(filepath.Join(repoPath, path))
+	if err != nil {
+		return rendered
+	}
+	link := url.URL{Scheme: "file", Path: filepath.ToSlash(abs)}
+	return ansi.SetHyperlink(link.String()) + rendered + ansi.ResetHyperlink()
+}
+
+// noteReferences adds the repository files a response names to the files
+// discussed in the session
+func (m *REPLModel) noteReferences(response string) {
+	if m.discussed == nil {
+		m.discussed = make(map[string]int)
+	}
+	for _, path := range referencedPaths(response) {
+		if m.discussed[path] == 0 {
+			m.discussedOrder = append(m.discussedOrder, path)
+		}
+		m.discussed[path]++
+	}
+}
+
+// discussedFiles lists the files discussed in the session, in the order they
+// were first named
+func (m *REPLModel) discussedFiles() []discussedFile {
+	files := make([]discussedFile, len(m.discussedOrder))
+	for i, path := range m.discussedOrder {
+		files[i] = discussedFile{Path: path, Responses: m.discussed[path]}
+	}
+	return files
+}
+
+// describeDiscussed handles /discussed, listing the files discussed so far
+func (m *REPLModel) describeDiscussed() string {
+	files := m.discussedFiles()
+	if len(files) == 0 {
+		return "No repository files were named in a response yet"
+	}
+	var s strings.Builder
+	s.WriteString("Files discussed:")
+	for _, file := range files {
+		s.WriteString(fmt.Sprintf("\n  %s (%s)", file.Path, plural(file.Responses, "response")))
+	}
+	return s.String()
+}
+
+// plural formats a count with a noun, adding an s unless the count is one
+func plural(n int, noun string) string {
+	if n == 1 {
+		return "1 " + noun
+	}
+	return fmt.Sprintf("%d %ss", n, noun)
+}
@@ -0,0 +1,118 @@
+package tui
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/kek/slop-shop/ollama"
+	"github.com/kek/slop-shop/styles"
+)
+
+// shownExchanges is how many entries of the conversation the view shows
+const shownExchanges = 6
+
+// segmentKey identifies a rendered conversation entry: the same text at the
+// same width renders the same, so only the streaming tail is rendered again
+type segmentKey struct {
+	text     string
+	width    int
+	expanded bool // Pasted logs are shown in full
+}
+
+// renderConversation renders the recent conversation from the segments
+// cached by earlier views. Entries that scrolled out of view or changed are
+// dropped from the cache.
+func (m *REPLModel) renderConversation() string {
+	start := max(len(m.conversationHistory)-shownExchanges, 0)
+	width := m.wrapWidth()
+	segments := make(map[segmentKey]string, shownExchanges)
+
+	var s strings.Builder
+	for _, exchange := range m.conversationHistory[start:] {
+		key := segmentKey{exchange, width, m.expandAttachments}
+		segment, ok := m.segments[key]
+		if !ok && strings.HasPrefix(exchange, attachmentPrefix) {
+			segment = renderAttachment(exchange, m.expandAttachments)
+		} else if !ok {
+			segment = renderExchange(exchange, width)
+		}
+		segments[key] = segment
+		s.WriteString(segment)
+		if meta, ok := m.meta[exchange]; ok && !m.hideMeta {
+			s.WriteString(styles.MutedStyle.Render(meta.String()) + "\n")
+		}
+	}
+	m.segments = segments
+	return s.String()
+}
+
+// renderExchange styles one entry of the conversation, wrapping assistant
+// responses to width and highlighting the repository files they name
+func renderExchange(exchange string, width int) string {
+	if strings.HasPrefix(exchange, "User: ") {
+		return styles.UserStyle.Render(exchange) + "\n"
+	}
+	if strings.HasPrefix(exchange, "System: ") {
+		return exchange + "\n"
+	}
+
+	// This is an assistant response (no prefix)
+	response := exchange
+
+	// Don't wrap JSON responses - they should stay intact
+	if strings.Contains(response, "{") && strings.Contains(response, "}") {
+		return styles.AssistantStyle.Render(response) + "\n"
+	}
+
+	// Some models send escaped newlines instead of real ones
+	if !strings.Contains(response, "\n") {
+		response = strings.ReplaceAll(response, "\\n", "\n")
+	}
+	// Blank lines separate paragraphs and belong to code, so they are kept
+	response = strings.Trim(response, "\n")
+	paths := make(map[string]bool)
+	for _, path := range referencedPaths(response) {
+		paths[path] = true
+	}
+	var s strings.Builder
+	for _, line := range strings.Split(wrapText(response, width), "\n") {
+		if strings.TrimSpace(line) == "" {
+			s.WriteString("\n")
+		} else {
+			s.WriteString(styles.Indent() + renderReferences(line, paths) + "\n")
+		}
+	}
+	return s.String()
+}
+
+// messageMeta is what produced an assistant response, shown under it so
+// responses of different models and settings can be told apart
+type messageMeta struct {
+	Model    string
+	Duration time.Duration
+	Stats    ollama.Stats
+}
+
+func (meta messageMeta) String() string {
+	line := fmt.Sprintf("%s · %s", meta.Model, meta.Duration.Round(100*time.Millisecond))
+	if meta.Stats.Cached {
+		return line + " · cached"
+	}
+	if meta.Stats.PromptTokens > 0 || meta.Stats.ResponseTokens > 0 {
+		line += fmt.Sprintf(" · %d prompt + %d response tokens", meta.Stats.PromptTokens, meta.Stats.ResponseTokens)
+	}
+	return line
+}
+
+// recordMeta keeps the metadata of a response, dropping that of responses
+// no longer in the conversation
+func (m *REPLModel) recordMeta(response string, meta messageMeta) {
+	kept := map[string]messageMeta{response: meta}
+	for _, exchange := range m.conversationHistory {
+		if old, ok := m.meta[exchange]; ok && exchange != response {
+			kept[exchange] = old
+		}
+	}
+	m.meta = kept
+}
@@ -1,14 +1,25 @@
 package tui
 
 import (
+	"encoding/json"
 	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
 	"path/filepath"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
 	tea "github.com/charmbracelet/bubbletea"
+	"github.com/charmbracelet/lipgloss"
+	"github.com/charmbracelet/x/ansi"
+	"github.com/kek/slop-shop/ollama"
 	"github.com/kek/slop-shop/repo"
+	"github.com/kek/slop-shop/styles"
+	"github.com/kek/slop-shop/tools"
+	"github.com/muesli/termenv"
 )
 
 func TestREPLModelInit(t *testing.T) {
@@ -1224,3 +1235,1013 @@ func formatBytes(bytes int64) string {
 
 	return fmt.Sprintf("%.1f %s", float64(bytes)/float64(div), units[exp])
 }
+
+func TestREPLModelPreview(t *testing.T) {
+	context := repo.CreateContext([]repo.FileInfo{
+		{Path: "main.go", Content: strings.Repeat("x", 400), Size: 400},
+		{Path: "go.mod", Content: "module example\n", Size: 15},
+	})
+	m := &REPLModel{
+		input:        "/preview where is main?",
+		model:        "test-model",
+		system:       "Be brief.",
+		context:      "Standard input:\nlog line\n\n" + context,
+		toolsEnabled: true,
+		history:      make([]string, 0),
+		historyIndex: -1,
+	}
+
+	if cmd := m.submitInput(); cmd != nil {
+		t.Error("/preview should not send a request")
+	}
+	if m.processing || m.input != "" {
+		t.Errorf("Expected /preview to leave the REPL idle, processing=%v input=%q", m.processing, m.input)
+	}
+
+	view := m.View()
+	for _, expected := range []string{"Request preview for test-model", "System prompt", "Piped input and conversation", "Repository files (2)", "main.go", "Question", "Tool instructions"} {
+		if !strings.Contains(view, expected) {
+			t.Errorf("Expected preview to contain %q, got:\n%s", expected, view)
+		}
+	}
+	if strings.Contains(view, strings.Repeat("x", 400)) {
+		t.Error("Expected the REPL preview to leave out the full prompt")
+	}
+
+	m.Update(tea.KeyMsg{Type: tea.KeyEsc})
+	if m.preview != "" {
+		t.Error("Expected Esc to hide the preview")
+	}
+}
+
+func TestREPLModelRemember(t *testing.T) {
+	defer SetRepoPath(".")
+	defer ollama.SetMemory("")
+	SetRepoPath(t.TempDir())
+
+	m := &REPLModel{input: "/remember The CLI has no global state", history: make([]string, 0), historyIndex: -1}
+	if cmd := m.submitInput(); cmd != nil {
+		t.Error("/remember should not send a request")
+	}
+	if len(m.conversationHistory) != 1 || !strings.Contains(m.conversationHistory[0], "Remembered in") {
+		t.Errorf("Expected a confirmation, got %q", m.conversationHistory)
+	}
+	if !strings.Contains(ollama.MemorySection(), "- The CLI has no global state") {
+		t.Errorf("Expected the note in the next prompts, got %q", ollama.MemorySection())
+	}
+
+	m.input = "/remember"
+	m.submitInput()
+	if !strings.Contains(m.conversationHistory[1], "nothing to remember") {
+		t.Errorf("Expected an empty note to be rejected, got %q", m.conversationHistory[1])
+	}
+}
+
+func TestREPLModelSplitView(t *testing.T) {
+	dir := t.TempDir()
+	defer SetRepoPath(".")
+	SetRepoPath(dir)
+	if err := os.MkdirAll(filepath.Join(dir, "cmd"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "cmd", "main.go"), []byte("package main\n\nfunc main() {}\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	m := &REPLModel{history: make([]string, 0), historyIndex: -1, width: 120, height: 30}
+	m.Update(tea.KeyMsg{Type: tea.KeyF6})
+	if !m.splitView {
+		t.Fatal("F6 should turn on the split view")
+	}
+
+	// A finished response that mentions a file shows it in the pane
+	m.conversationHistory = []string{"User: where is main?", "It is in `cmd/main.go`, see also missing.go."}
+	m.responseComplete = true
+	m.Update(tickMsg(time.Now()))
+	if m.paneTitle != "cmd/main.go" || !strings.Contains(m.View(), "func main() {}") {
+		t.Errorf("Expected cmd/main.go in the side pane, got %q\n%s", m.paneTitle, m.View())
+	}
+
+	// A proposed diff takes precedence over mentioned files
+	m.followResponse("Change cmd/main.go:\n```diff\n--- a/cmd/main.go\n+++ b/cmd/main.go\n-func main() {}\n+func main() { run() }\n```\n")
+	if m.paneTitle != "Diff" || !strings.Contains(m.paneContent, "+func main() { run() }") {
+		t.Errorf("Expected the diff in the side pane, got %q: %q", m.paneTitle, m.paneContent)
+	}
+
+	// Tab moves focus to the pane, where the arrows scroll instead of the history
+	m.history = []string{"where is main?"}
+	m.historyIndex = 1
+	m.Update(tea.KeyMsg{Type: tea.KeyTab})
+	if !m.paneFocus {
+		t.Error("Tab should focus the side pane")
+	}
+	m.Update(tea.KeyMsg{Type: tea.KeyUp})
+	if m.input != "" || m.historyIndex != 1 {
+		t.Error("Up should not navigate the history while the pane has focus")
+	}
+
+	m.input = "/open ../outside.go"
+	m.submitInput()
+	if !strings.Contains(m.conversationHistory[len(m.conversationHistory)-1], "outside the repository") {
+		t.Errorf("Expected /open to refuse paths outside the repository, got %q", m.conversationHistory)
+	}
+	m.input = "/open cmd/main.go"
+	if cmd := m.submitInput(); cmd != nil || m.paneTitle != "cmd/main.go" {
+		t.Errorf("Expected /open to show the file without a request, got %q", m.paneTitle)
+	}
+}
+
+func TestWrapText(t *testing.T) {
+	prose := strings.Repeat("word ", 30)
+	code := "    if x {" + strings.Repeat(" ", 80) + "return   x }"
+	fenced := "fmt.Println(\"" + strings.Repeat("a b ", 30) + "\")"
+	text := prose + "\n\n" + code + "\n```go\n" + fenced + "\n```\n" + prose
+
+	lines := strings.Split(wrapText(text, 40), "\n")
+	for _, line := range lines {
+		if ansi.StringWidth(line) > 40 && line != code && line != fenced {
+			t.Errorf("Line wider than 40 columns: %q", line)
+		}
+	}
+	wrapped := wrapText(text, 40)
+	if !strings.Contains(wrapped, "\n"+code+"\n") || !strings.Contains(wrapped, "\n"+fenced+"\n") {
+		t.Errorf("Expected code to be left untouched, got:\n%s", wrapped)
+	}
+	if !strings.Contains(wrapped, "\n\n") {
+		t.Error("Expected the blank line between paragraphs to be kept")
+	}
+
+	// Escape sequences take no room, so styled text wraps like plain text
+	styled := strings.Repeat("\x1b[1mbold\x1b[0m ", 10)
+	if got := wrapText(styled, 50); strings.Count(got, "\n") != 0 {
+		t.Errorf("Expected 50 visible columns to fit on one line, got %q", got)
+	}
+}
+
+func TestREPLModelViewKeepsBlankLines(t *testing.T) {
+	testCases := []struct {
+		name     string
+		response string
+		expected string
+	}{
+		{
+			name:     "Paragraphs",
+			response: "First paragraph.\n\nSecond paragraph.\n",
+			expected: "First paragraph.\n\nSecond paragraph.\n",
+		},
+		{
+			name:     "Code block",
+			response: "Try this:\n\n```go\nx := 1\n\nreturn x\n```",
+			expected: "```go\nx := 1\n\nreturn x\n```\n",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			m := &REPLModel{conversationHistory: []string{"User: test question", tc.response}}
+			if view := ansi.Strip(m.View()); !strings.Contains(view, tc.expected) {
+				t.Errorf("Expected %q in the view, got:\n%s", tc.expected, view)
+			}
+		})
+	}
+}
+
+func TestREPLModelCancelAndSave(t *testing.T) {
+	dir := t.TempDir()
+	defer SetSaveDir("")
+	SetSaveDir(dir)
+
+	cancelled := false
+	m := &REPLModel{
+		processing:          true,
+		cancel:              func() { cancelled = true },
+		conversationHistory: []string{"User: explain the parser", "It reads tokens"},
+	}
+	m.Update(tea.KeyMsg{Type: tea.KeyCtrlC})
+	if !cancelled || m.quitting {
+		t.Fatal("Ctrl+C should cancel the request in flight without quitting")
+	}
+
+	m.processing = false
+	m.Update(tea.KeyMsg{Type: tea.KeyCtrlC})
+	if !m.confirmSave || !strings.Contains(m.View(), "Save this conversation") {
+		t.Fatal("Ctrl+C should offer to save the conversation before quitting")
+	}
+	_, cmd := m.Update(tea.KeyMsg{Type: tea.KeyRunes, Runes: []rune{'y'}})
+	if cmd == nil || !m.quitting {
+		t.Fatal("Answering the offer should quit")
+	}
+
+	saved, err := os.ReadFile(m.savedTo)
+	if err != nil || !strings.Contains(string(saved), "## User\n\nexplain the parser") || !strings.Contains(string(saved), "## Assistant\n\nIt reads tokens") {
+		t.Errorf("Expected the conversation in %s, got %q (err: %v)", m.savedTo, saved, err)
+	}
+	if !strings.Contains(m.View(), "Conversation saved to "+m.savedTo) {
+		t.Errorf("Expected the file to be reported on quitting, got %q", m.View())
+	}
+}
+
+func TestREPLModelFilesPanel(t *testing.T) {
+	dir := t.TempDir()
+	defer SetRepoPath(".")
+	SetRepoPath(dir)
+
+	context := repo.CreateContext([]repo.FileInfo{
+		{Path: "main.go", Content: "package main", Size: 12},
+		{Path: "testdata/big.json", Content: "{}", Size: 2},
+	})
+	m := &REPLModel{context: context, input: "/files", history: make([]string, 0), historyIndex: -1}
+	if cmd := m.submitInput(); cmd != nil || !m.showFiles {
+		t.Fatal("/files should open the panel without a request")
+	}
+	if view := m.View(); !strings.Contains(view, "2 of 2 sent") || !strings.Contains(view, "> [x] main.go") {
+		t.Errorf("Expected both files listed with the cursor on the first, got:\n%s", view)
+	}
+
+	// Keys go to the panel, not the input
+	m.Update(tea.KeyMsg{Type: tea.KeyDown})
+	m.Update(tea.KeyMsg{Type: tea.KeySpace})
+	if m.input != "" || strings.Contains(m.context, "testdata/big.json") || !strings.Contains(m.context, "package main") {
+		t.Errorf("Expected testdata/big.json to be left out of the context, got %q", m.context)
+	}
+
+	m.Update(tea.KeyMsg{Type: tea.KeyRunes, Runes: []rune{'s'}})
+	ignore, err := os.ReadFile(filepath.Join(dir, ".slopshopignore"))
+	if err != nil || string(ignore) != "testdata/big.json\n" || !strings.Contains(m.View(), "Added 1 files") {
+		t.Errorf("Expected the exclusion to be saved, got %q (err: %v)", ignore, err)
+	}
+
+	m.Update(tea.KeyMsg{Type: tea.KeySpace})
+	if !strings.Contains(m.context, "testdata/big.json") {
+		t.Error("Expected Space to include the file again")
+	}
+	m.Update(tea.KeyMsg{Type: tea.KeyEsc})
+	if m.showFiles {
+		t.Error("Esc should close the panel")
+	}
+}
+
+func TestREPLModelVariants(t *testing.T) {
+	var mu sync.Mutex
+	seeds := make(map[int]bool)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var request ollama.Request
+		json.NewDecoder(r.Body).Decode(&request)
+		mu.Lock()
+		seeds[request.Options.Seed] = true
+		mu.Unlock()
+		fmt.Fprintf(w, `{"response":"answer with seed %d","done":true}`+"\n", request.Options.Seed)
+	}))
+	defer server.Close()
+
+	m := &REPLModel{
+		ollamaURL:           server.URL,
+		model:               "test-model",
+		conversationHistory: []string{"User: name the parser", "first answer", "System: noted"},
+		history:             make([]string, 0),
+		historyIndex:        -1,
+	}
+	m.input = "/variants 3"
+	cmd := m.submitInput()
+	if cmd == nil || !m.processing {
+		t.Fatal("/variants should send requests")
+	}
+	m.Update(cmd())
+	if len(m.variants) != 3 || len(seeds) != 3 || seeds[0] {
+		t.Fatalf("Expected 3 variants with distinct seeds, got %q (seeds %v)", m.variants, seeds)
+	}
+	if view := m.View(); !strings.Contains(view, "Variants of: name the parser") || !strings.Contains(view, m.variants[0]) {
+		t.Errorf("Expected the first variant to be shown, got:\n%s", view)
+	}
+
+	m.Update(tea.KeyMsg{Type: tea.KeyRight})
+	chosen := m.variants[1]
+	m.Update(tea.KeyMsg{Type: tea.KeyEnter})
+	if len(m.variants) != 0 || strings.Join(m.conversationHistory, "|") != "User: name the parser|"+chosen+"|System: noted" {
+		t.Errorf("Expected the chosen variant to replace the answer, got %q", m.conversationHistory)
+	}
+
+	m.input = "/variants 12"
+	if cmd := m.submitInput(); cmd != nil || !strings.Contains(m.conversationHistory[len(m.conversationHistory)-1], "from 1 to 9") {
+		t.Errorf("Expected an out-of-range count to be rejected, got %q", m.conversationHistory)
+	}
+}
+
+func TestREPLModelSaveCodeBlock(t *testing.T) {
+	dir := t.TempDir()
+	defer SetRepoPath(".")
+	SetRepoPath(dir)
+	defer tools.SetToolPolicy(nil, nil)
+
+	response := "Add a helper:\n\n```go\n// File: util/strings.go\npackage util\n```\n\nand a script:\n\n```sh scripts/run.sh\necho hi\n```\n"
+	blocks := extractCodeBlocks(response)
+	if len(blocks) != 2 || blocks[0].suggestedPath() != "util/strings.go" || blocks[1].suggestedPath() != "scripts/run.sh" {
+		t.Fatalf("Expected two blocks with paths from the comment and the info string, got %+v", blocks)
+	}
+	if path := (codeBlock{info: "python", code: "print(1)\n"}).suggestedPath(); path != "" {
+		t.Errorf("Expected no path for a block that names none, got %q", path)
+	}
+
+	m := &REPLModel{conversationHistory: []string{"User: add a helper", response}}
+	m.Update(tea.KeyMsg{Type: tea.KeyF7})
+	if !strings.Contains(m.View(), "> 1. go · 2 lines") {
+		t.Fatalf("Expected the blocks to be listed, got:\n%s", m.View())
+	}
+	m.Update(tea.KeyMsg{Type: tea.KeyEnter})
+	if !strings.Contains(m.View(), "Save to: util/strings.go█") {
+		t.Fatalf("Expected the path to be pre-filled, got:\n%s", m.View())
+	}
+	m.Update(tea.KeyMsg{Type: tea.KeyEnter})
+	if data, err := os.ReadFile(filepath.Join(dir, "util", "strings.go")); err != nil || string(data) != "// File: util/strings.go\npackage util\n" {
+		t.Errorf("Expected the block to be saved, got %q (err: %v)", data, err)
+	}
+
+	// Saving again asks before overwriting, and the tool policy still applies
+	m.Update(tea.KeyMsg{Type: tea.KeyEnter})
+	m.Update(tea.KeyMsg{Type: tea.KeyEnter})
+	if !m.confirmOverwrite {
+		t.Fatal("Expected to be asked before overwriting the file")
+	}
+	tools.SetToolPolicy(nil, []string{"CREATE_FILE"})
+	m.Update(tea.KeyMsg{Type: tea.KeyRunes, Runes: []rune{'y'}})
+	if !strings.Contains(m.blockStatus, "Not saved") {
+		t.Errorf("Expected the tool policy to block the write, got %q", m.blockStatus)
+	}
+	m.Update(tea.KeyMsg{Type: tea.KeyEsc})
+	if len(m.blocks) != 0 {
+		t.Error("Esc should close the list")
+	}
+}
+
+func TestREPLModelApprovalsPanel(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "approvals.json")
+	os.WriteFile(path, []byte(`[{"repo":"/src/app","tool":"RUN_COMMAND","subject":"go test ./..."},{"repo":"/src/app","tool":"CREATE_FILE","subject":"notes.txt"}]`), 0644)
+	if err := tools.LoadApprovals(path); err != nil {
+		t.Fatalf("LoadApprovals failed: %v", err)
+	}
+
+	m := &REPLModel{input: "/approvals", history: make([]string, 0), historyIndex: -1}
+	if cmd := m.submitInput(); cmd != nil || !m.showApprovals {
+		t.Fatal("/approvals should open the panel without a request")
+	}
+	if view := m.View(); !strings.Contains(view, "Approved tool calls: 2") || !strings.Contains(view, "always   RUN_COMMAND go test ./...") {
+		t.Errorf("Expected the saved rules to be listed, got:\n%s", view)
+	}
+
+	m.Update(tea.KeyMsg{Type: tea.KeyDown})
+	m.Update(tea.KeyMsg{Type: tea.KeyRunes, Runes: []rune{'d'}})
+	if m.input != "" || len(m.approvals) != 1 || !strings.Contains(m.View(), "Revoked CREATE_FILE notes.txt") {
+		t.Errorf("Expected d to revoke the selected rule, got %+v", m.approvals)
+	}
+	if data, _ := os.ReadFile(path); strings.Contains(string(data), "notes.txt") || !strings.Contains(string(data), "go test") {
+		t.Errorf("Expected the revocation to be saved, got %s", data)
+	}
+
+	m.Update(tea.KeyMsg{Type: tea.KeyEsc})
+	if m.showApprovals {
+		t.Error("Esc should close the panel")
+	}
+}
+
+func TestREPLModelQueuePanel(t *testing.T) {
+	// The server streams one chunk for prompts mentioning "stream", then holds
+	// every request open until it is cancelled
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var request ollama.Request
+		json.NewDecoder(r.Body).Decode(&request)
+		if strings.Contains(request.Prompt, "stream") {
+			fmt.Fprintln(w, `{"response":"partial","done":false}`)
+			w.(http.Flusher).Flush()
+		}
+		<-r.Context().Done()
+	}))
+	defer server.Close()
+
+	errs := make(chan error, 2)
+	for _, label := range []string{"first stream", "second"} {
+		go func() {
+			client := ollama.NewClient(server.URL, "test-model", 0.7, 0.9)
+			client.Label = label
+			_, err := client.Generate(label, "", false, nil)
+			errs <- err
+		}()
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		requests := ollama.Requests()
+		if len(requests) == 2 && (requests[0].Streaming || requests[1].Streaming) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected two requests in flight, one streaming, got %+v", requests)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	m := &REPLModel{input: "/queue", history: make([]string, 0), historyIndex: -1}
+	if cmd := m.submitInput(); cmd != nil || !m.showQueue {
+		t.Fatal("/queue should open the panel without a request")
+	}
+	view := m.View()
+	for _, want := range []string{"2 requests in flight, 1 waiting", "Requests in flight: 2", "first stream  streaming", "second  waiting"} {
+		if !strings.Contains(view, want) {
+			t.Errorf("Expected the view to contain %q, got:\n%s", want, view)
+		}
+	}
+
+	// Cancelling one request leaves the other running
+	requests := ollama.Requests()
+	for i, request := range requests {
+		if request.Label == "second" {
+			m.queueCursor = i
+		}
+	}
+	m.Update(tea.KeyMsg{Type: tea.KeyRunes, Runes: []rune{'x'}})
+	if err := <-errs; err != ollama.ErrInterrupted {
+		t.Errorf("Expected the cancelled request to be interrupted, got %v", err)
+	}
+	if remaining := ollama.Requests(); len(remaining) != 1 || remaining[0].Label != "first stream" {
+		t.Errorf("Expected only the first request to remain, got %+v", remaining)
+	}
+	if view := m.View(); !strings.Contains(view, "Cancelled #") || strings.Contains(view, "requests in flight,") {
+		t.Errorf("Expected the cancellation to be reported and the indicator hidden, got:\n%s", view)
+	}
+
+	ollama.CancelRequest(ollama.Requests()[0].ID)
+	<-errs
+	m.Update(tea.KeyMsg{Type: tea.KeyEsc})
+	if m.showQueue || len(ollama.Requests()) != 0 {
+		t.Error("Esc should close the panel once every request has finished")
+	}
+}
+
+func TestREPLModelViewCachesSegments(t *testing.T) {
+	m := &REPLModel{conversationHistory: []string{"User: first", "A long answer that is wrapped once.", "User: second", "Streaming"}}
+	first := m.View()
+	if len(m.segments) != 4 {
+		t.Fatalf("Expected 4 cached segments, got %d", len(m.segments))
+	}
+	cached := m.segments[segmentKey{text: "A long answer that is wrapped once.", width: 80}]
+	if cached == "" {
+		t.Fatal("Expected the finished answer to be cached")
+	}
+
+	// Only the streaming tail changes, and the view matches a fresh render
+	m.conversationHistory[3] += " more text"
+	view := m.View()
+	if len(m.segments) != 4 || m.segments[segmentKey{text: "A long answer that is wrapped once.", width: 80}] != cached {
+		t.Errorf("Expected the earlier segments to be reused, got %d segments", len(m.segments))
+	}
+	fresh := &REPLModel{conversationHistory: m.conversationHistory}
+	if view != fresh.View() || view == first {
+		t.Errorf("Expected the cached view to match a fresh render, got:\n%s", view)
+	}
+
+	// A new width renders everything again
+	m.width = 40
+	m.View()
+	if _, ok := m.segments[segmentKey{text: "A long answer that is wrapped once.", width: 80}]; ok || len(m.segments) != 4 {
+		t.Errorf("Expected the segments to be rendered again for the new width, got %v", m.segments)
+	}
+}
+
+func TestREPLModelStreamsEveryChunk(t *testing.T) {
+	// Far more chunks than the channel buffers, sent as fast as possible
+	var want strings.Builder
+	for i := range 500 {
+		want.WriteString(fmt.Sprintf("chunk %d ", i))
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for i := range 500 {
+			fmt.Fprintf(w, `{"response":"chunk %d ","done":false}`+"\n", i)
+		}
+		fmt.Fprintln(w, `{"response":"","done":true}`)
+	}))
+	defer server.Close()
+
+	m := &REPLModel{ollamaURL: server.URL, model: "test-model", processing: true, streamChannel: make(chan string, 100), streamDone: make(chan streamEnd, 1)}
+	m.Update(ollamaRequestMsg{input: "stream"})
+
+	ticks := 0
+	deadline := time.Now().Add(5 * time.Second)
+	for m.processing {
+		if time.Now().After(deadline) {
+			t.Fatalf("Response not finished after %d ticks", ticks)
+		}
+		m.Update(tickMsg(time.Now()))
+		ticks++
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if got := m.conversationHistory[len(m.conversationHistory)-1]; got != want.String() {
+		t.Errorf("Streamed text differs from the response: got %d bytes, want %d", len(got), want.Len())
+	}
+	if ticks > 100 {
+		t.Errorf("Expected the chunks to be drained in a few ticks, took %d", ticks)
+	}
+}
+
+func TestREPLModelResponseMeta(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, `{"response":"An answer.","done":false}`)
+		fmt.Fprintln(w, `{"response":"","done":true,"prompt_eval_count":120,"eval_count":45}`)
+	}))
+	defer server.Close()
+
+	m := &REPLModel{ollamaURL: server.URL, model: "model-a", processing: true, streamChannel: make(chan string, 100), streamDone: make(chan streamEnd, 1)}
+	m.Update(ollamaRequestMsg{input: "question"})
+	deadline := time.Now().Add(5 * time.Second)
+	for m.processing {
+		if time.Now().After(deadline) {
+			t.Fatal("Response not finished")
+		}
+		m.Update(tickMsg(time.Now()))
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	meta, ok := m.meta["An answer."]
+	if !ok || meta.Model != "model-a" || meta.Stats.PromptTokens != 120 || meta.Stats.ResponseTokens != 45 {
+		t.Fatalf("Expected the response's metadata to be recorded, got %+v", m.meta)
+	}
+	if view := ansi.Strip(m.View()); !strings.Contains(view, "model-a · ") || !strings.Contains(view, "120 prompt + 45 response tokens") {
+		t.Errorf("Expected the metadata line under the response, got:\n%s", view)
+	}
+
+	m.Update(tea.KeyMsg{Type: tea.KeyF8})
+	if view := ansi.Strip(m.View()); strings.Contains(view, "model-a · ") {
+		t.Errorf("Expected F8 to hide the metadata, got:\n%s", view)
+	}
+
+	// Metadata of responses that left the conversation is dropped
+	m.conversationHistory = []string{"User: other", "Another answer."}
+	m.recordMeta("Another answer.", messageMeta{Model: "model-b"})
+	if _, ok := m.meta["An answer."]; ok || len(m.meta) != 1 {
+		t.Errorf("Expected only the current response's metadata, got %+v", m.meta)
+	}
+}
+
+func TestWrapWriter(t *testing.T) {
+	prose := strings.TrimSpace(strings.Repeat("streamed words ", 12))
+	code := "    if x {" + strings.Repeat(" ", 60) + "return x }"
+	fenced := "fmt.Println(\"" + strings.Repeat("a b ", 20) + "\")"
+	text := "  " + prose + "\n\n" + code + "\n```go\n" + fenced + "\n```\n" + prose
+
+	// The text comes out the same however it is split into chunks
+	var whole, chunked strings.Builder
+	w := NewWrapWriter(&whole, 30, "> ")
+	w.Write([]byte(text))
+	w.Flush()
+	w = NewWrapWriter(&chunked, 30, "> ")
+	for i := 0; i < len(text); i += 3 {
+		w.Write([]byte(text[i:min(i+3, len(text))]))
+	}
+	w.Flush()
+	if whole.String() != chunked.String() {
+		t.Fatalf("Chunked output differs:\n%s\n---\n%s", whole.String(), chunked.String())
+	}
+
+	out := whole.String()
+	for _, line := range strings.Split(out, "\n") {
+		if line == "" {
+			continue
+		}
+		if !strings.HasPrefix(line, "> ") {
+			t.Errorf("Expected every line to be indented, got %q", line)
+		}
+		if ansi.StringWidth(line) > 32 && line != "> "+code && line != "> "+fenced {
+			t.Errorf("Line wider than 30 columns after the indent: %q", line)
+		}
+	}
+	if !strings.Contains(out, "\n> "+code+"\n") || !strings.Contains(out, "\n> "+fenced+"\n") {
+		t.Errorf("Expected code to be left untouched, got:\n%s", out)
+	}
+	if !strings.HasPrefix(out, ">   streamed words") || !strings.Contains(out, "\n\n") {
+		t.Errorf("Expected the leading spaces and the blank line to be kept, got:\n%s", out)
+	}
+	if got := strings.Join(strings.Fields(strings.ReplaceAll(out, "> ", "")), " "); got != strings.Join(strings.Fields(text), " ") {
+		t.Errorf("Expected the same words, got %q", got)
+	}
+
+	// The REPL wraps and indents responses with the same settings
+	defer styles.SetRendering(styles.Rendering{})
+	if err := styles.SetRendering(styles.Rendering{Width: "10"}); err == nil {
+		t.Error("Expected a width under 20 columns to be rejected")
+	}
+	if err := styles.SetRendering(styles.Rendering{Width: "30", Indent: 2}); err != nil {
+		t.Fatal(err)
+	}
+	m := &REPLModel{conversationHistory: []string{"User: question", prose}}
+	view := ansi.Strip(m.View())
+	if !strings.Contains(view, "\n  streamed words") {
+		t.Errorf("Expected the response to be indented, got:\n%s", view)
+	}
+	for _, line := range strings.Split(view, "\n") {
+		if strings.HasPrefix(line, "  streamed") && ansi.StringWidth(line) > 30 {
+			t.Errorf("Line wider than 30 columns: %q", line)
+		}
+	}
+}
+
+func TestREPLModelReconnects(t *testing.T) {
+	// While down, the server drops every connection as a restarting one does
+	var mu sync.Mutex
+	down := true
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if down {
+			conn, _, _ := w.(http.Hijacker).Hijack()
+			conn.Close()
+			return
+		}
+		if r.URL.Path == "/api/version" {
+			fmt.Fprintln(w, `{"version":"0.9.0"}`)
+			return
+		}
+		fmt.Fprintln(w, `{"response":"Back again.","done":false}`)
+		fmt.Fprintln(w, `{"response":"","done":true}`)
+	}))
+	defer server.Close()
+
+	m := &REPLModel{ollamaURL: server.URL, model: "test-model", streamChannel: make(chan string, 100), streamDone: make(chan streamEnd, 1)}
+	finish := func() {
+		deadline := time.Now().Add(5 * time.Second)
+		for m.processing {
+			if time.Now().After(deadline) {
+				t.Fatal("Response not finished")
+			}
+			m.Update(tickMsg(time.Now()))
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	m.processing = true
+	m.Update(ollamaRequestMsg{input: "question"})
+	finish()
+	if !m.offline || m.pendingInput != "question" {
+		t.Fatalf("Expected the REPL to go offline with the question pending, got offline=%t pending=%q", m.offline, m.pendingInput)
+	}
+	if view := ansi.Strip(m.View()); !strings.Contains(view, "Backend offline since") {
+		t.Errorf("Expected the offline banner, got:\n%s", view)
+	}
+
+	// A failed check backs off
+	m.retryAt = time.Now()
+	probe := m.probeBackend()
+	if probe == nil {
+		t.Fatal("Expected a check once it is due")
+	}
+	if m.probeBackend() != nil {
+		t.Error("Expected one check at a time")
+	}
+	m.Update(probe())
+	if !m.offline || m.retryDelay != 2*firstRetry {
+		t.Errorf("Expected the wait to double after a failed check, got %s", m.retryDelay)
+	}
+
+	// Once the server is back, the question is asked again
+	mu.Lock()
+	down = false
+	mu.Unlock()
+	m.retryAt = time.Now()
+	_, cmd := m.Update(m.probeBackend()())
+	if m.offline || cmd == nil {
+		t.Fatal("Expected the REPL to come back online and ask again")
+	}
+	m.Update(cmd())
+	finish()
+	if got := m.conversationHistory[len(m.conversationHistory)-1]; got != "Back again." {
+		t.Errorf("Expected the question to be answered, got %q", got)
+	}
+	if view := ansi.Strip(m.View()); strings.Contains(view, "Backend offline") {
+		t.Errorf("Expected the banner to be gone, got:\n%s", view)
+	}
+}
+
+func TestDriver(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Prompt string `json:"prompt"`
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+		answer := "No question."
+		if strings.Contains(req.Prompt, "capital of France") {
+			answer = "Paris, of course."
+		}
+		fmt.Fprintf(w, `{"response":%q,"done":false}`+"\n", answer)
+		fmt.Fprintln(w, `{"response":"","done":true,"prompt_eval_count":10,"eval_count":4}`)
+	}))
+	defer server.Close()
+
+	d := NewDriver(server.URL, "test-model", "", "repo context", 0.7, 0.9, false)
+	d.Resize(100, 40)
+	d.Ask("What is the capital of France?")
+	if err := d.WaitForText("Paris, of course.", 5*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.WaitIdle(5 * time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if frame := d.Frame(); !strings.Contains(frame, "What is the capital of France?") {
+		t.Errorf("Expected the question on screen, got:\n%s", frame)
+	}
+
+	if err := d.Press("f1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.WaitForText("F1", time.Second); err != nil {
+		t.Error(err)
+	}
+	if err := d.Press("hyper+q"); err == nil {
+		t.Error("Expected an unknown key to be an error")
+	}
+
+	d.Press("ctrl+c")
+	if err := d.WaitFor(func(string) bool { return d.Quit() }, time.Second); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestREPLModelPasteLog(t *testing.T) {
+	var mu sync.Mutex
+	var prompts []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Prompt string `json:"prompt"`
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+		mu.Lock()
+		prompts = append(prompts, req.Prompt)
+		mu.Unlock()
+		fmt.Fprintln(w, `{"response":"The nil map is written on line 12.","done":false}`)
+		fmt.Fprintln(w, `{"response":"","done":true}`)
+	}))
+	defer server.Close()
+
+	saved := readClipboard
+	defer func() { readClipboard = saved }()
+	readClipboard = func() (string, error) {
+		return "\x1b[31mpanic: assignment to entry in nil map\x1b[0m\r\ngoroutine 1 [running]:\r\nmain.main()\r\n\tmain.go:12 +0x1d\r\n", nil
+	}
+
+	d := NewDriver(server.URL, "test-model", "", "", 0.7, 0.9, false)
+	d.Ask("/paste-log")
+	if err := d.WaitForText("📎 Pasted log · 4 lines", time.Second); err != nil {
+		t.Fatal(err)
+	}
+	d.Ask("Why does it panic?")
+	if err := d.WaitForText("The nil map is written on line 12.", 5*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	mu.Lock()
+	prompt := prompts[0]
+	mu.Unlock()
+	if !strings.Contains(prompt, "Why does it panic?\n\nPasted log:\n```\npanic: assignment to entry in nil map\ngoroutine 1 [running]:") {
+		t.Errorf("Expected the log without colors after the question, got:\n%s", prompt)
+	}
+
+	frame := d.Frame()
+	if !strings.Contains(frame, "F9 expands") || strings.Contains(frame, "goroutine 1") || strings.Contains(frame, "goes with your next question") {
+		t.Errorf("Expected the log collapsed and no longer waiting, got:\n%s", frame)
+	}
+	d.Press("f9")
+	if err := d.WaitForText("│ goroutine 1 [running]:", time.Second); err != nil {
+		t.Error(err)
+	}
+
+	// A large paste keeps its start and end
+	var big strings.Builder
+	for i := range 2000 {
+		fmt.Fprintf(&big, "log line %d\n", i)
+	}
+	log := newPastedLog(big.String())
+	if log.omitted == 0 || len(log.text) > maxPasteBytes+100 || !strings.HasPrefix(log.text, "log line 0\n") || !strings.HasSuffix(log.text, "log line 1999") {
+		t.Errorf("Expected the middle of the paste to be left out, got %d bytes, %d lines omitted", len(log.text), log.omitted)
+	}
+	if !strings.Contains(log.text, fmt.Sprintf("[... %d lines omitted ...]", log.omitted)) {
+		t.Error("Expected a notice where lines were left out")
+	}
+
+	readClipboard = func() (string, error) { return "  \n", nil }
+	d.Ask("/paste-log")
+	if err := d.WaitForText("The clipboard holds no text", time.Second); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestREPLModelPreset(t *testing.T) {
+	d := NewDriver("http://localhost:0", "test-model", "", "", 0.7, 0.9, false)
+	if frame := d.Frame(); !strings.Contains(frame, "Model: test-model │ Preset: balanced (temperature 0.7, top_p 0.9)") {
+		t.Errorf("Expected the balanced preset in the status bar, got:\n%s", frame)
+	}
+	d.Ask("/preset precise")
+	if err := d.WaitForText("Preset: precise (temperature 0.1, top_p 0.5)", time.Second); err != nil {
+		t.Error(err)
+	}
+	d.Ask("/preset")
+	if err := d.WaitForText("* precise   temperature 0.1, top_p 0.5", time.Second); err != nil {
+		t.Error(err)
+	}
+	d.Ask("/preset wild")
+	if err := d.WaitForText(`unknown preset "wild"`, time.Second); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestREPLModelRunCommand(t *testing.T) {
+	dir := t.TempDir()
+	defer SetRepoPath(repoPath)
+	defer tools.SetCommandOutputHandler(nil)
+	SetRepoPath(dir)
+
+	d := NewDriver("http://localhost:0", "test-model", "", "", 0.7, 0.9, false)
+	d.Resize(100, 40)
+	d.Ask("/run echo step $((1+1)); while [ ! -e done ]; do sleep 0.02; done; echo step $((2+2))")
+
+	// The first line shows while the command still waits for the file
+	if err := d.WaitForText("step 2", 5*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if frame := d.Frame(); strings.Contains(frame, "step 4") || strings.Contains(frame, "Done") {
+		t.Errorf("Expected the command to be still running, got:\n%s", frame)
+	}
+	d.Ask("/run true")
+	if err := d.WaitForText("A command is already running", time.Second); err != nil {
+		t.Error(err)
+	}
+
+	os.WriteFile(filepath.Join(dir, "done"), nil, 0644)
+	if err := d.WaitForText("✅ Done", 5*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if entry := d.m.conversationHistory[0]; !strings.HasPrefix(entry, "System: $ echo step") || !strings.HasSuffix(entry, "\nstep 2\nstep 4\n✅ Done") {
+		t.Errorf("Expected the output in the command's entry, got %q", entry)
+	}
+
+	d.Ask("/run exit 3")
+	if err := d.WaitForText("❌ Exit code 3", 5*time.Second); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestREPLModelSwitchRepo(t *testing.T) {
+	first, second := t.TempDir(), t.TempDir()
+	defer SetContextLoader(nil)
+	defer SetRepoPath(repoPath)
+	var transcript strings.Builder
+	ollama.SetTranscript(&transcript)
+	defer ollama.SetTranscript(nil)
+
+	SetRepoPath(first)
+	SetContextLoader(func(path string) (string, error) {
+		if path != second {
+			return "", fmt.Errorf("unexpected repository %s", path)
+		}
+		return repo.CreateContext([]repo.FileInfo{{Path: "b.go", Content: "package b", Size: 9}}), nil
+	})
+	d := NewDriver("http://localhost:0", "test-model", "", repo.CreateContext([]repo.FileInfo{{Path: "a.go", Content: "package a", Size: 9}}), 0.7, 0.9, false)
+
+	d.Ask("/repo add " + second)
+	if err := d.WaitForText("Added repository "+second+" to the context: 1 files as "+filepath.Base(second)+"/...", time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(d.m.context, "File: a.go (Size: 9 bytes)") || !strings.Contains(d.m.context, "File: "+filepath.Base(second)+"/b.go (Size: 9 bytes)") {
+		t.Errorf("Expected both repositories in the context, got:\n%s", d.m.context)
+	}
+	d.Ask("/repo")
+	if err := d.WaitForText("Active repository: "+first+"; also in the context: "+second, time.Second); err != nil {
+		t.Error(err)
+	}
+
+	d.Ask("/repo " + second)
+	if err := d.WaitForText("Switched to repository "+second+": 1 files", time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(d.m.context, "a.go") || repoPath != second {
+		t.Errorf("Expected the context and repository to be replaced, got %s:\n%s", repoPath, d.m.context)
+	}
+	if !strings.Contains(transcript.String(), "## Switched to repository "+second) {
+		t.Errorf("Expected the switch in the transcript, got:\n%s", transcript.String())
+	}
+
+	d.Ask("/repo " + filepath.Join(second, "missing"))
+	if err := d.WaitForText("Cannot open the repository", time.Second); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestREPLModelFileReferences(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "parser.go"), []byte("package parser"), 0644)
+	defer SetRepoPath(repoPath)
+	SetRepoPath(dir)
+	defer SetSaveDir("")
+	SetSaveDir(t.TempDir())
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, `{"response":"The tokens are read in parser.go, not in lexer.go.","done":false}`)
+		fmt.Fprintln(w, `{"response":"","done":true}`)
+	}))
+	defer server.Close()
+
+	d := NewDriver(server.URL, "test-model", "", "repo context", 0.7, 0.9, false)
+	d.Ask("/discussed")
+	if err := d.WaitForText("No repository files were named in a response yet", time.Second); err != nil {
+		t.Error(err)
+	}
+	for range 2 {
+		d.Ask("Where are tokens read?")
+		if err := d.WaitIdle(5 * time.Second); err != nil {
+			t.Fatal(err)
+		}
+	}
+	d.Ask("/discussed")
+	if err := d.WaitForText("parser.go (2 responses)", time.Second); err != nil {
+		t.Error(err)
+	}
+	if strings.Contains(d.Frame(), "lexer.go (") {
+		t.Error("Expected only files of the repository to be discussed")
+	}
+
+	// With colors the file is a link to it, the missing one is not
+	profile := lipgloss.ColorProfile()
+	defer lipgloss.SetColorProfile(profile)
+	lipgloss.SetColorProfile(termenv.ANSI)
+	rendered := renderExchange("The tokens are read in parser.go, not in lexer.go.", 80)
+	if !strings.Contains(rendered, ansi.SetHyperlink("file://"+filepath.ToSlash(filepath.Join(dir, "parser.go")))) || strings.Count(rendered, ansi.ResetHyperlink()) != 1 {
+		t.Errorf("Expected a hyperlink to parser.go only, got %q", rendered)
+	}
+	if ansi.Strip(rendered) != styles.Indent()+"The tokens are read in parser.go, not in lexer.go.\n" {
+		t.Errorf("Expected the links to leave the text alone, got %q", ansi.Strip(rendered))
+	}
+
+	d.Press("ctrl+c")
+	d.Type("y")
+	saved, err := os.ReadFile(d.m.savedTo)
+	if err != nil || !strings.HasSuffix(string(saved), "## Files discussed\n\n- `parser.go` (2 responses)\n") {
+		t.Errorf("Expected the files discussed at the end of the saved conversation, got %q (err: %v)", saved, err)
+	}
+}
+
+func TestPager(t *testing.T) {
+	var lines []string
+	for i := 1; i <= 50; i++ {
+		lines = append(lines, fmt.Sprintf("Line %d of the analysis", i))
+	}
+	lines[29] = "The Parser drops the last token"
+	lines[39] = "Another parser bug"
+	m := &pagerModel{title: "test-model", response: strings.Join(lines, "\n")}
+	m.Update(tea.WindowSizeMsg{Width: 80, Height: 11})
+	key := func(keys ...string) {
+		for _, k := range keys {
+			switch k {
+			case "enter":
+				m.Update(tea.KeyMsg{Type: tea.KeyEnter})
+			case "pgdown":
+				m.Update(tea.KeyMsg{Type: tea.KeyPgDown})
+			default:
+				m.Update(tea.KeyMsg{Type: tea.KeyRunes, Runes: []rune(k)})
+			}
+		}
+	}
+
+	view := ansi.Strip(m.View())
+	if !strings.HasPrefix(view, "Line 1 of the analysis\n") || strings.Contains(view, "Line 11 ") || !strings.Contains(view, "lines 1-10 of 50 (20%)") {
+		t.Errorf("Expected the first 10 lines and the position, got:\n%s", view)
+	}
+
+	key("pgdown", "j")
+	if m.top != 11 {
+		t.Errorf("Expected a page and a line down to start at line 12, got %d", m.top+1)
+	}
+
+	// Searching ignores case and moves between the matches
+	key("/", "p", "a", "r", "s", "e", "r", "enter")
+	if m.top != 29 || !strings.Contains(ansi.Strip(m.View()), "Match 1 of 2") {
+		t.Errorf("Expected the first match at the top, got line %d:\n%s", m.top+1, ansi.Strip(m.View()))
+	}
+	key("n")
+	if m.top != 39 {
+		t.Errorf("Expected n to show the second match, got line %d", m.top+1)
+	}
+	key("n")
+	if !strings.Contains(ansi.Strip(m.View()), "No more matches") || m.top != 39 {
+		t.Errorf("Expected no more matches after the last one, got:\n%s", ansi.Strip(m.View()))
+	}
+	key("N")
+	if m.top != 29 {
+		t.Errorf("Expected N to go back to the first match, got line %d", m.top+1)
+	}
+	key("/", "z", "z", "z", "enter")
+	if !strings.Contains(ansi.Strip(m.View()), "Pattern not found: zzz") {
+		t.Errorf("Expected a missing pattern to be reported, got:\n%s", ansi.Strip(m.View()))
+	}
+
+	// The end of the response stays at the bottom of the screen
+	key("G")
+	if m.top != 40 || !strings.Contains(ansi.Strip(m.View()), "lines 41-50 of 50 (100%)") {
+		t.Errorf("Expected G to show the last page, got line %d", m.top+1)
+	}
+	if _, cmd := m.Update(tea.KeyMsg{Type: tea.KeyRunes, Runes: []rune("q")}); cmd == nil {
+		t.Error("Expected q to close the pager")
+	}
+}
@@ -0,0 +1,139 @@
+package tui
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	tea "github.com/charmbracelet/bubbletea"
+	"github.com/kek/slop-shop/ollama"
+	"github.com/kek/slop-shop/repo"
+)
+
+// ContextLoader reads the context of the repository at path, the way the
+// context of the first one was read
+type ContextLoader func(path string) (string, error)
+
+// loadRepoContext reads the repositories /repo switches to or adds
+var loadRepoContext ContextLoader
+
+// SetContextLoader sets how /repo reads a repository; without one /repo is
+// not available
+func SetContextLoader(load ContextLoader) {
+	loadRepoContext = load
+}
+
+// repoLoadedMsg carries the context of a repository read for /repo
+type repoLoadedMsg struct {
+	path    string
+	add     bool // Merged into the context rather than replacing it
+	context string
+	err     error
+}
+
+// switchRepo handles /repo: "/repo PATH" makes another repository the
+// active one, "/repo add PATH" adds its files to the context, and "/repo"
+// lists the repositories in the context. The repository is read in the
+// background.
+func (m *REPLModel) switchRepo(args string) tea.Cmd {
+	args = strings.TrimSpace(args)
+	if args == "" {
+		m.conversationHistory = append(m.conversationHistory, "System: "+m.describeRepos())
+		return nil
+	}
+	if loadRepoContext == nil {
+		m.conversationHistory = append(m.conversationHistory, "System: /repo is not available in this session")
+		return nil
+	}
+
+	add := false
+	if rest, ok := strings.CutPrefix(args, "add "); ok {
+		add, args = true, strings.TrimSpace(rest)
+	}
+	path, err := filepath.Abs(args)
+	if err == nil {
+		var info os.FileInfo
+		if info, err = os.Stat(path); err == nil && !info.IsDir() {
+			err = fmt.Errorf("%s is not a directory", args)
+		}
+	}
+	if err != nil {
+		m.conversationHistory = append(m.conversationHistory, "System: Cannot open the repository: "+err.Error())
+		return nil
+	}
+
+	m.conversationHistory = append(m.conversationHistory, "System: Reading "+path+"...")
+	return func() tea.Msg {
+		context, err := loadRepoContext(path)
+		return repoLoadedMsg{path: path, add: add, context: context, err: err}
+	}
+}
+
+// repoLoaded puts the context of a repository read for /repo in place and
+// records the switch in the transcript
+func (m *REPLModel) repoLoaded(msg repoLoadedMsg) {
+	if msg.err != nil {
+		m.conversationHistory = append(m.conversationHistory, "System: Could not read "+msg.path+": "+msg.err.Error())
+		return
+	}
+	files := 0
+	for _, section := range repo.SplitContext(msg.context) {
+		if section.Name != "" {
+			files++
+		}
+	}
+	m.files = nil
+
+	if msg.add {
+		// The added repository's files are told apart by its name
+		name := filepath.Base(msg.path)
+		m.context += prefixContext(msg.context, name)
+		if len(m.repos) == 0 {
+			active, _ := filepath.Abs(repoPath)
+			m.repos = []string{active}
+		}
+		m.repos = append(m.repos, msg.path)
+		note := fmt.Sprintf("Added repository %s to the context: %d files as %s/..., %d characters in all", msg.path, files, name, len(m.context))
+		m.conversationHistory = append(m.conversationHistory, "System: "+note)
+		ollama.Note(note)
+		return
+	}
+
+	m.context = msg.context
+	m.repos = []string{msg.path}
+	SetRepoPath(msg.path)
+	// The new context has the repository's own memory; the notes remembered
+	// in the last one are left behind
+	ollama.SetMemory("")
+	note := fmt.Sprintf("Switched to repository %s: %d files, %d characters", msg.path, files, len(m.context))
+	m.conversationHistory = append(m.conversationHistory, "System: "+note)
+	ollama.Note(note)
+}
+
+// describeRepos lists the repositories in the context
+func (m *REPLModel) describeRepos() string {
+	repos := m.repos
+	if len(repos) == 0 {
+		path, _ := filepath.Abs(repoPath)
+		repos = []string{path}
+	}
+	description := "Active repository: " + repos[0]
+	if len(repos) > 1 {
+		description += "; also in the context: " + strings.Join(repos[1:], ", ")
+	}
+	return description + ". /repo PATH switches to another one, /repo add PATH adds its files"
+}
+
+// prefixContext puts prefix before the path of every file in a context, so
+// files of several repositories can be told apart
+func prefixContext(context, prefix string) string {
+	var s strings.Builder
+	for _, section := range repo.SplitContext(context) {
+		if section.Name == "" {
+			continue
+		}
+		s.WriteString(strings.Replace(section.Text, "File: "+section.Name, "File: "+prefix+"/"+section.Name, 1))
+	}
+	return s.String()
+}
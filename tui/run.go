@@ -0,0 +1,86 @@
+package tui
+
+import (
+	"fmt"
+	"io"
+	"strings"
+
+	tea "github.com/charmbracelet/bubbletea"
+	"github.com/kek/slop-shop/tools"
+)
+
+// commandDoneMsg carries the result of a command run with /run
+type commandDoneMsg struct {
+	result tools.ToolResult
+}
+
+// streamCommandOutput sends the lines of tool commands to the REPL as they are
+// written, for the next tick to add to the conversation
+func (m *REPLModel) streamCommandOutput() {
+	lines := m.commandOutput
+	tools.SetCommandOutputHandler(func(line string) {
+		lines <- line
+	})
+}
+
+// runCommand handles /run: it runs a shell command in the repository as the
+// RUN_COMMAND tool does, under the tool policy and approvals, and shows its
+// output in the conversation while it runs
+func (m *REPLModel) runCommand(command string) tea.Cmd {
+	command = strings.TrimSpace(command)
+	switch {
+	case command == "":
+		m.conversationHistory = append(m.conversationHistory, "System: /run runs a shell command in the repository, e.g. /run go test ./...")
+		return nil
+	case m.commandEntry != "":
+		m.conversationHistory = append(m.conversationHistory, "System: A command is already running")
+		return nil
+	}
+
+	m.commandEntry = "System: $ " + command
+	m.conversationHistory = append(m.conversationHistory, m.commandEntry)
+	return func() tea.Msg {
+		return commandDoneMsg{tools.RunTool(io.Discard, tools.ToolCall{Name: "RUN_COMMAND", Args: command}, repoPath)}
+	}
+}
+
+// appendCommandOutput adds the lines the running command wrote since the last
+// tick to its entry, or to a new one when the entry was cleared meanwhile
+func (m *REPLModel) appendCommandOutput() {
+	for {
+		select {
+		case line := <-m.commandOutput:
+			m.extendCommandEntry(line)
+		default:
+			return
+		}
+	}
+}
+
+// extendCommandEntry adds a line to the entry of the running command
+func (m *REPLModel) extendCommandEntry(line string) {
+	for i := len(m.conversationHistory) - 1; i >= 0; i-- {
+		if m.conversationHistory[i] == m.commandEntry {
+			m.commandEntry += "\n" + line
+			m.conversationHistory[i] = m.commandEntry
+			return
+		}
+	}
+	m.commandEntry = "System: " + line
+	m.conversationHistory = append(m.conversationHistory, m.commandEntry)
+}
+
+// commandDone shows how the command run with /run ended. Every line was
+// written before the command returned, so none arrive after this.
+func (m *REPLModel) commandDone(msg commandDoneMsg) {
+	m.appendCommandOutput()
+	switch {
+	case msg.result.Success:
+		m.extendCommandEntry("✅ Done")
+	case msg.result.Denied:
+		m.extendCommandEntry("🚫 " + strings.TrimPrefix(msg.result.Output, "Error: "))
+	default:
+		m.extendCommandEntry(fmt.Sprintf("❌ Exit code %d", msg.result.ExitCode))
+	}
+	m.commandEntry = ""
+}
@@ -0,0 +1,55 @@
+package tui
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// saveDir is where conversations are saved when the REPL quits, or "" to quit
+// without offering to save
+var saveDir string
+
+// SetSaveDir sets the directory the REPL offers to save conversations to on quitting
+func SetSaveDir(dir string) {
+	saveDir = dir
+}
+
+// saveConversation writes a conversation to a new Markdown file in the save
+// directory, ending with the files discussed in the session, and returns its
+// path
+func saveConversation(conversation []string, discussed []discussedFile) (string, error) {
+	if err := os.MkdirAll(saveDir, 0755); err != nil {
+		return "", err
+	}
+
+	var buf strings.Builder
+	buf.WriteString(fmt.Sprintf("# Slop Shop conversation, %s\n", time.Now().Format("2006-01-02 15:04")))
+	for _, entry := range conversation {
+		switch {
+		case strings.HasPrefix(entry, "User: "):
+			buf.WriteString("\n## User\n\n" + strings.TrimPrefix(entry, "User: ") + "\n")
+		case strings.HasPrefix(entry, attachmentPrefix):
+			summary, log, _ := strings.Cut(strings.TrimPrefix(entry, attachmentPrefix), "\n")
+			buf.WriteString("\n<details><summary>" + summary + "</summary>\n\n```\n" + log + "\n```\n\n</details>\n")
+		case strings.HasPrefix(entry, "System: "):
+			buf.WriteString("\n> " + strings.TrimPrefix(entry, "System: ") + "\n")
+		default:
+			buf.WriteString("\n## Assistant\n\n" + strings.TrimSpace(entry) + "\n")
+		}
+	}
+	if len(discussed) > 0 {
+		buf.WriteString("\n## Files discussed\n\n")
+		for _, file := range discussed {
+			buf.WriteString(fmt.Sprintf("- `%s` (%s)\n", file.Path, plural(file.Responses, "response")))
+		}
+	}
+
+	path := filepath.Join(saveDir, "chat-"+time.Now().Format("20060102-150405")+".md")
+	if err := os.WriteFile(path, []byte(buf.String()), 0644); err != nil {
+		return "", fmt.Errorf("error writing %s: %v", path, err)
+	}
+	return path, nil
+}
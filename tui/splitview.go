@@ -0,0 +1,147 @@
+package tui
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/charmbracelet/lipgloss"
+	"github.com/charmbracelet/x/ansi"
+	"github.com/kek/slop-shop/styles"
+)
+
+// defaultWidth and defaultHeight are used until the terminal reports its size
+const (
+	defaultWidth  = 160
+	defaultHeight = 40
+)
+
+// pathPattern matches what may be a file path mentioned in a response
+var pathPattern = regexp.MustCompile(`[\w./-]+\.\w+`)
+
+// openPane shows a repository file in the side pane
+func (m *REPLModel) openPane(path string) error {
+	path = filepath.Clean(strings.TrimPrefix(path, "./"))
+	if !filepath.IsLocal(path) {
+		return fmt.Errorf("%s is outside the repository", path)
+	}
+	data, err := os.ReadFile(filepath.Join(repoPath, path))
+	if err != nil {
+		return err
+	}
+	m.paneTitle = filepath.ToSlash(path)
+	m.paneContent = string(data)
+	m.paneScroll = 0
+	return nil
+}
+
+// followResponse points the side pane at what a response discusses: the diff
+// it proposes if it has one, otherwise the last repository file it mentions
+func (m *REPLModel) followResponse(response string) {
+	if diff := extractDiff(response); diff != "" {
+		m.paneTitle = "Diff"
+		m.paneContent = diff
+		m.paneScroll = 0
+		return
+	}
+	if path := referencedPath(response); path != "" {
+		m.openPane(path)
+	}
+}
+
+// extractDiff returns the first diff in a response, fenced or bare, or ""
+func extractDiff(response string) string {
+	if start := strings.Index(response, "```diff\n"); start >= 0 {
+		body := response[start+len("```diff\n"):]
+		if end := strings.Index(body, "```"); end >= 0 {
+			body = body[:end]
+		}
+		return body
+	}
+
+	lines := strings.Split(response, "\n")
+	for i, line := range lines {
+		if strings.HasPrefix(line, "diff --git ") || (strings.HasPrefix(line, "--- ") && i+1 < len(lines) && strings.HasPrefix(lines[i+1], "+++ ")) {
+			return strings.Join(lines[i:], "\n")
+		}
+	}
+	return ""
+}
+
+// referencedPath returns the last path in a response that names a file of the
+// repository, or ""
+func referencedPath(response string) string {
+	candidates := pathPattern.FindAllString(response, -1)
+	for i := len(candidates) - 1; i >= 0; i-- {
+		if path, ok := repoFile(candidates[i]); ok {
+			return path
+		}
+	}
+	return ""
+}
+
+// scrollPane moves the side pane by lines, keeping it within its content
+func (m *REPLModel) scrollPane(lines int) {
+	last := max(strings.Count(m.paneContent, "\n")-m.paneHeight()+1, 0)
+	m.paneScroll = min(max(m.paneScroll+lines, 0), last)
+}
+
+// paneHeight is how many lines of content the side pane shows
+func (m *REPLModel) paneHeight() int {
+	height := m.height
+	if height == 0 {
+		height = defaultHeight
+	}
+	// Leave room for the pane's border and title and the input line
+	return max(height-5, 5)
+}
+
+// renderSplit places the conversation on the left and the side pane on the right
+func (m *REPLModel) renderSplit(conversation string) string {
+	width := m.width
+	if width == 0 {
+		width = defaultWidth
+	}
+	leftWidth := width / 2
+	paneWidth := width - leftWidth - 3 // Border and gap
+
+	var pane strings.Builder
+	title := m.paneTitle
+	if title == "" {
+		title = "No file yet: /open <path>, or mention one"
+	}
+	pane.WriteString(styles.HeaderStyle.Render(truncateLine(title, paneWidth)) + "\n")
+	if m.paneContent != "" {
+		lines := strings.Split(strings.TrimRight(m.paneContent, "\n"), "\n")
+		start := min(m.paneScroll, len(lines))
+		end := min(start+m.paneHeight(), len(lines))
+		for _, line := range lines[start:end] {
+			line = truncateLine(strings.ReplaceAll(line, "\t", "    "), paneWidth)
+			switch {
+			case m.paneTitle != "Diff":
+				pane.WriteString(line)
+			case strings.HasPrefix(line, "+") && !strings.HasPrefix(line, "+++"):
+				pane.WriteString(styles.SuccessStyle.Render(line))
+			case strings.HasPrefix(line, "-") && !strings.HasPrefix(line, "---"):
+				pane.WriteString(styles.ErrorStyle.Render(line))
+			default:
+				pane.WriteString(styles.MutedStyle.Render(line))
+			}
+			pane.WriteString("\n")
+		}
+	}
+
+	border := lipgloss.NewStyle().Border(lipgloss.RoundedBorder()).Width(paneWidth).BorderForeground(lipgloss.Color("240"))
+	if m.paneFocus {
+		border = border.BorderForeground(lipgloss.Color("39"))
+	}
+	left := lipgloss.NewStyle().Width(leftWidth).Render(conversation)
+	return lipgloss.JoinHorizontal(lipgloss.Top, left, " ", border.Render(strings.TrimRight(pane.String(), "\n"))) + "\n"
+}
+
+// truncateLine cuts a line to at most width visible columns
+func truncateLine(line string, width int) string {
+	return ansi.Truncate(line, width, "…")
+}
@@ -1,15 +1,21 @@
 package tui
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"math"
 	
-	"os"
 	"strings"
 	"time"
 
 	tea "github.com/charmbracelet/bubbletea"
+	"github.com/charmbracelet/x/ansi"
+	"github.com/kek/slop-shop/debuglog"
 	"github.com/kek/slop-shop/ollama"
+	"github.com/kek/slop-shop/repo"
 	"github.com/kek/slop-shop/styles"
+	"github.com/kek/slop-shop/tools"
 )
 
 // REPLModel represents the Bubble Tea model for the REPL
@@ -20,6 +26,7 @@ type REPLModel struct {
 	context             string
 	ollamaURL           string
 	model               string
+	system              string // System prompt sent with every request
 	temperature         float64
 	topP                float64
 	toolsEnabled        bool
@@ -28,12 +35,62 @@ type REPLModel struct {
 	showHelp            bool
 	showHistory         bool
 	showContext         bool
+	preview             string // Output of /preview, shown until Esc
 	quitting            bool
 	processing          bool
 	spinnerFrame        int
 	responseBuffer      strings.Builder
 	responseComplete    bool
-	streamChannel       chan string // Channel for streaming response chunks
+	streamChannel       chan string    // Channel for streaming response chunks
+	streamDone          chan streamEnd // Receives once the streamed response is complete
+	width               int            // Terminal size, zero until reported
+	height              int
+	splitView           bool   // Show the side pane beside the conversation
+	paneFocus           bool   // Arrow keys scroll the side pane instead of the history
+	paneTitle           string // File or "Diff" shown in the side pane
+	paneContent         string
+	paneScroll          int
+	cancel              context.CancelFunc // Cancels the request in flight
+	confirmSave         bool               // Asking whether to save the conversation before quitting
+	savedTo             string             // File the conversation was saved to on quitting
+	showFiles           bool               // Show the /files panel
+	files               []contextFile      // The context split into files, once /files was opened
+	filesCursor         int
+	filesStatus         string   // Outcome of saving exclusions, shown in the panel
+	variants            []string // Completions from /variants waiting for a choice
+	variantMeta         []messageMeta
+	variantsPrompt      string
+	variantCursor       int
+	blocks              []codeBlock // Code blocks of the last response listed with F7
+	blockCursor         int
+	blockPath           string // Path the selected block is saved to, while it is edited
+	editingPath         bool
+	confirmOverwrite    bool
+	blockStatus         string
+	showApprovals       bool                 // Show the /approvals panel
+	approvals           []tools.ApprovalRule // Rules listed in the /approvals panel
+	approvalCursor      int
+	approvalsStatus     string
+	showQueue           bool // Show the /queue panel
+	queueCursor         int
+	queueStatus         string
+	segments            map[segmentKey]string  // Rendered conversation entries, reused by the next View
+	meta                map[string]messageMeta // What produced each assistant response, by its text
+	hideMeta            bool                   // Hide the metadata line under responses
+	offline             bool                   // The server could not be reached and is checked until it is back
+	offlineSince        time.Time
+	offlineErr          string
+	retryAt             time.Time     // When the server is checked next
+	retryDelay          time.Duration // Wait after the next failed check
+	probing             bool
+	pendingInput        string         // Question asked again once the server is back
+	attachment          *pastedLog     // Log from /paste-log sent with the next question
+	expandAttachments   bool           // Show pasted logs in the conversation instead of their summary
+	repos               []string       // Repositories in the context, the active one first, once /repo changed them
+	discussed           map[string]int // Responses naming each repository file, for /discussed and the saved conversation
+	discussedOrder      []string       // Files discussed, in the order they were first named
+	commandOutput       chan string    // Lines of tool commands, added to the conversation on the next tick
+	commandEntry        string         // Conversation entry of the command /run is running
 }
 
 // REPLMsg represents messages for the REPL
@@ -59,15 +116,13 @@ type ollamaStreamMsg struct {
 }
 type ollamaDoneMsg struct{}
 
-// StartChat starts an interactive chat session with the repository context
-func StartChat(url, model, context string, temperature, topP float64, toolsEnabled, debugEnabled bool) {
-	logToFile("Starting REPL...")
-
-	// Create the REPL model
-	m := &REPLModel{
+// newREPLModel returns the REPL in its initial state
+func newREPLModel(url, model, system, context string, temperature, topP float64, toolsEnabled, debugEnabled bool) *REPLModel {
+	return &REPLModel{
 		context:             context,
 		ollamaURL:           url,
 		model:               model,
+		system:              system,
 		temperature:         temperature,
 		topP:                topP,
 		toolsEnabled:        toolsEnabled,
@@ -80,32 +135,41 @@ func StartChat(url, model, context string, temperature, topP float64, toolsEnabl
 		responseBuffer:      strings.Builder{},
 		responseComplete:    false,
 		streamChannel:       make(chan string, 100), // Buffer for streaming chunks
+		streamDone:          make(chan streamEnd, 1),
+		commandOutput:       make(chan string, 100),
 	}
+}
+
+// StartChat starts an interactive chat session with the repository context
+func StartChat(url, model, system, context string, temperature, topP float64, toolsEnabled, debugEnabled bool) {
+	logDebug("Starting REPL...")
+	m := newREPLModel(url, model, system, context, temperature, topP, toolsEnabled, debugEnabled)
+	m.streamCommandOutput()
 
-	logToFile("Model created, starting Bubble Tea program...")
+	logDebug("Model created, starting Bubble Tea program...")
 
 	// Create and run the Bubble Tea program
-	logToFile("About to create program...")
+	logDebug("About to create program...")
 	p := tea.NewProgram(m) // Removed tea.WithAltScreen() to fix display issues
-	logToFile("Program created, running...")
+	logDebug("Program created, running...")
 
 	// Add panic recovery
 	defer func() {
 		if r := recover(); r != nil {
-			logToFile(fmt.Sprintf("Panic recovered: %v", r))
+			logDebug(fmt.Sprintf("Panic recovered: %v", r))
 		}
 	}()
 
-	logToFile("About to call p.Run()...")
+	logDebug("About to call p.Run()...")
 	if _, err := p.Run(); err != nil {
-		logToFile(fmt.Sprintf("Error running REPL: %v", err))
+		logDebug(fmt.Sprintf("Error running REPL: %v", err))
 	}
-	logToFile("REPL finished.")
+	logDebug("REPL finished.")
 }
 
 // Init initializes the REPL model
 func (m *REPLModel) Init() tea.Cmd {
-	logToFile("Init() called")
+	logDebug("Init() called")
 	return tea.Tick(time.Millisecond*100, func(t time.Time) tea.Msg {
 		return tickMsg(t)
 	})
@@ -113,61 +177,133 @@ func (m *REPLModel) Init() tea.Cmd {
 
 // Update handles messages and updates the model
 func (m *REPLModel) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
-	logToFile(fmt.Sprintf("Update() called with message type: %T", msg))
+	logDebug(fmt.Sprintf("Update() called with message type: %T", msg))
 	switch msg := msg.(type) {
+	case tea.WindowSizeMsg:
+		m.width, m.height = msg.Width, msg.Height
 	case tea.KeyMsg:
 		key := msg.String()
-		logToFile(fmt.Sprintf("Key pressed: '%s' (type: %T)", key, msg))
+		logDebug(fmt.Sprintf("Key pressed: '%s' (type: %T)", key, msg))
+
+		if m.confirmSave {
+			// Anything but y quits without saving
+			if key == "y" || key == "Y" {
+				path, err := saveConversation(m.conversationHistory, m.discussedFiles())
+				if err != nil {
+					m.conversationHistory = append(m.conversationHistory, "System: Could not save the conversation: "+err.Error())
+					m.confirmSave = false
+					return m, nil
+				}
+				m.savedTo = path
+			}
+			m.quitting = true
+			return m, tea.Quit
+		}
+
+		if len(m.blocks) > 0 && key != "ctrl+c" {
+			m.blocksKey(key)
+			return m, nil
+		}
+		if len(m.variants) > 0 && key != "ctrl+c" {
+			m.variantsKey(key)
+			return m, nil
+		}
+		if m.showFiles && key != "ctrl+c" {
+			m.filesKey(key)
+			return m, nil
+		}
+		if m.showApprovals && key != "ctrl+c" {
+			m.approvalsKey(key)
+			return m, nil
+		}
+		if m.showQueue && key != "ctrl+c" {
+			m.queueKey(key)
+			return m, nil
+		}
 
 		switch key {
 		case "ctrl+c":
-			logToFile("Ctrl+C detected, quitting...")
-			m.quitting = true
-			return m, tea.Quit
+			if m.processing && m.cancel != nil {
+				logDebug("Ctrl+C detected, cancelling the request...")
+				m.cancel()
+				return m, nil
+			}
+			logDebug("Ctrl+C detected, quitting...")
+			return m, m.quit()
 		case "enter":
 			if m.input != "" {
-				logToFile(fmt.Sprintf("Enter pressed with input: '%s'", m.input))
+				logDebug(fmt.Sprintf("Enter pressed with input: '%s'", m.input))
 				return m, m.submitInput()
 			}
 		case "up":
-			logToFile("Up arrow pressed")
+			logDebug("Up arrow pressed")
+			if m.paneFocus {
+				m.scrollPane(-1)
+				return m, nil
+			}
 			return m, m.navigateHistory(-1)
 		case "down":
-			logToFile("Down arrow pressed")
+			logDebug("Down arrow pressed")
+			if m.paneFocus {
+				m.scrollPane(1)
+				return m, nil
+			}
 			return m, m.navigateHistory(1)
+		case "pgup":
+			m.scrollPane(-m.paneHeight())
+		case "pgdown":
+			m.scrollPane(m.paneHeight())
+		case "tab":
+			if m.splitView {
+				m.paneFocus = !m.paneFocus
+			}
 		case "f1":
-			logToFile("F1 pressed, toggling help")
+			logDebug("F1 pressed, toggling help")
 			m.showHelp = !m.showHelp
 		case "f2":
-			logToFile("F2 pressed, toggling history")
+			logDebug("F2 pressed, toggling history")
 			m.showHistory = !m.showHistory
 		case "f3":
-			logToFile("F3 pressed, toggling context")
+			logDebug("F3 pressed, toggling context")
 			m.showContext = !m.showContext
 		case "f4":
-			logToFile("F4 pressed, clearing conversation")
+			logDebug("F4 pressed, clearing conversation")
 			m.conversationHistory = nil
 		case "f5":
-			logToFile("F5 pressed, clearing context")
+			logDebug("F5 pressed, clearing context")
 			m.context = ""
+			m.files = nil
 			m.conversationHistory = append(m.conversationHistory, "System: Local context cleared. Note: Ollama internal context persists - restart Ollama for complete reset.")
+		case "f6":
+			logDebug("F6 pressed, toggling split view")
+			m.splitView = !m.splitView
+			m.paneFocus = false
+		case "f7":
+			logDebug("F7 pressed, listing code blocks")
+			m.openCodeBlocks()
+		case "f8":
+			logDebug("F8 pressed, toggling response metadata")
+			m.hideMeta = !m.hideMeta
+		case "f9":
+			logDebug("F9 pressed, toggling pasted logs")
+			m.expandAttachments = !m.expandAttachments
 		case "f10":
-			logToFile("F10 pressed, quitting...")
-			m.quitting = true
-			return m, tea.Quit
+			logDebug("F10 pressed, quitting...")
+			return m, m.quit()
 		case "esc":
-			logToFile("Escape pressed, hiding panels")
+			logDebug("Escape pressed, hiding panels")
 			m.showHelp = false
 			m.showHistory = false
 			m.showContext = false
+			m.preview = ""
 		case "backspace":
 			if len(m.input) > 0 {
 				m.input = m.input[:len(m.input)-1]
-				logToFile("Backspace pressed, input length now: " + fmt.Sprint(len(m.input)))
+				logDebug("Backspace pressed, input length now: " + fmt.Sprint(len(m.input)))
 			}
 		case "space":
 			m.input += " "
-			logToFile("Space pressed, input length now: " + fmt.Sprint(len(m.input)))
+			logDebug("Space pressed, input length now: " + fmt.Sprint(len(m.input)))
 		default:
 			// Handle regular character input (including space)
 			if len(key) == 1 {
@@ -175,12 +311,12 @@ func (m *REPLModel) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 				r := rune(key[0])
 				if r >= 32 && r <= 126 {
 					m.input += key
-					logToFile(fmt.Sprintf("Character '%s' added, input length now: %d", key, len(m.input)))
+					logDebug(fmt.Sprintf("Character '%s' added, input length now: %d", key, len(m.input)))
 				} else {
-					logToFile(fmt.Sprintf("Non-printable character ignored: '%s' (rune: %d)", key, r))
+					logDebug(fmt.Sprintf("Non-printable character ignored: '%s' (rune: %d)", key, r))
 				}
 			} else {
-				logToFile(fmt.Sprintf("Multi-character key ignored: '%s'", key))
+				logDebug(fmt.Sprintf("Multi-character key ignored: '%s'", key))
 			}
 		}
 	case ollamaResponseMsg:
@@ -199,6 +335,14 @@ func (m *REPLModel) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 			}
 		}
 		m.input = ""
+	case variantsMsg:
+		m.showVariants(msg)
+	case pasteMsg:
+		m.pasted(msg)
+	case repoLoadedMsg:
+		m.repoLoaded(msg)
+	case commandDoneMsg:
+		m.commandDone(msg)
 	case inputSubmittedMsg:
 		// Input was submitted, add to conversation history
 		m.conversationHistory = append(m.conversationHistory, fmt.Sprintf("User: %s", msg.input))
@@ -207,8 +351,15 @@ func (m *REPLModel) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 		// Actually call Ollama and keep processing true until response arrives
 		input := msg.input
 
-		// Add user input to conversation history immediately
+		// Add user input to conversation history immediately, with the
+		// pasted log waiting for it
 		m.conversationHistory = append(m.conversationHistory, fmt.Sprintf("User: %s", input))
+		prompt, attachment := input, m.attachment
+		if attachment != nil {
+			prompt = attachment.prompt(input)
+			m.conversationHistory = append(m.conversationHistory, attachment.entry())
+			m.attachment = nil
+		}
 		if len(m.conversationHistory) > 20 {
 			m.conversationHistory = m.conversationHistory[len(m.conversationHistory)-20:]
 		}
@@ -220,30 +371,40 @@ func (m *REPLModel) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 		// The spinner will keep spinning until we get a real response
 
 		// Call Ollama in a goroutine and stream response chunks in real-time
+		ctx, cancel := context.WithCancel(context.Background())
+		m.cancel = cancel
 		go func() {
+			defer cancel()
+
 			// Clear the response buffer for new response
 			m.responseBuffer.Reset()
 
 			// Stream response chunks to the buffer and send updates to main thread
-			_, err := ollama.SendToOllamaWithCallback(m.ollamaURL, m.model, input, m.context, m.temperature, m.topP, m.toolsEnabled, func(chunk string) {
-				// Send chunk to main thread for real-time display via channel
-				select {
-				case m.streamChannel <- chunk:
-					// Chunk sent successfully
-				default:
-					// Channel buffer full, skip this chunk
-				}
-			})
-
-			if err != nil {
-				logToFile(fmt.Sprintf("Ollama error: %v", err))
-				// Add error to conversation history
-				m.conversationHistory[len(m.conversationHistory)-1] += fmt.Sprintf("Error: %v", err)
+			client := ollama.NewClient(m.ollamaURL, m.model, m.temperature, m.topP)
+			client.System = m.system
+			client.Ctx = ctx
+			client.Label = "chat"
+			// Chunks wait for the next tick rather than being dropped when the
+			// buffer is full; the error goes the same way to stay after them
+			send := func(chunk string) {
+				m.streamChannel <- chunk
+			}
+			started := time.Now()
+			_, stats, err := client.GenerateWithStats(prompt, m.context, m.toolsEnabled, send)
+
+			if errors.Is(err, ollama.ErrInterrupted) {
+				send("\n[cancelled]")
+			} else if err != nil {
+				logDebug(fmt.Sprintf("Ollama error: %v", err))
+				send(fmt.Sprintf("❌ Error: %v", err))
 			}
 
-			// Stop processing and spinner
-			m.processing = false
-			m.responseComplete = true
+			// The next tick stops processing and the spinner
+			end := streamEnd{input: input, attachment: attachment, err: err}
+			if err == nil {
+				end.meta = &messageMeta{Model: client.Model, Duration: time.Since(started), Stats: stats}
+			}
+			m.streamDone <- end
 		}()
 
 		return m, nil
@@ -256,49 +417,52 @@ func (m *REPLModel) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 		// Keeping this for potential future use but not processing chunks here to avoid duplication
 		if m.processing {
 			// Log that we received a direct stream message (for debugging)
-			logToFile(fmt.Sprintf("Received direct stream message (not used): '%s'", msg.chunk))
+			logDebug(fmt.Sprintf("Received direct stream message (not used): '%s'", msg.chunk))
 			// Don't append here to avoid duplicate processing
 		}
 	case tickMsg:
+		// Show every chunk that arrived since the last tick, including those
+		// sent just before the request finished, and the output of /run
+		m.drainStream()
+		m.appendCommandOutput()
+
 		// Update spinner frame
 		if m.processing {
 			m.spinnerFrame = (m.spinnerFrame + 1) % 10 // Fixed: use 10 for all spinner characters
-			logToFile(fmt.Sprintf("Tick: processing=true, spinnerFrame=%d", m.spinnerFrame))
-
-			// Check for streaming chunks while processing
-			select {
-			case chunk := <-m.streamChannel:
-				// Got a chunk, append it to the current response
-				logToFile(fmt.Sprintf("Received chunk: '%s'", chunk))
-
-				// Ensure we have a valid conversation history index
+			logDebug(fmt.Sprintf("Tick: processing=true, spinnerFrame=%d", m.spinnerFrame))
+		} else {
+			logDebug(fmt.Sprintf("Tick: processing=false, spinnerFrame=%d", m.spinnerFrame))
+			if m.responseComplete {
+				// Show the file or diff the finished response talks about
+				m.responseComplete = false
 				if len(m.conversationHistory) > 0 {
-					// For JSON responses, don't break them up - just append
-					m.conversationHistory[len(m.conversationHistory)-1] += chunk
-				} else {
-					// Fallback: create a new response entry if conversation history is empty
-					logToFile("Warning: conversation history empty, creating new response entry")
-					m.conversationHistory = append(m.conversationHistory, chunk)
+					m.followResponse(m.conversationHistory[len(m.conversationHistory)-1])
 				}
-			default:
-				// No chunk available, continue
 			}
-		} else {
-			logToFile(fmt.Sprintf("Tick: processing=false, spinnerFrame=%d", m.spinnerFrame))
 		}
-		// Return a new tick command to keep the animation going
-		return m, tea.Tick(time.Millisecond*100, func(t time.Time) tea.Msg {
+		// Return a new tick command to keep the animation going, and check
+		// whether an offline server is back when that is due
+		tick := tea.Tick(time.Millisecond*100, func(t time.Time) tea.Msg {
 			return tickMsg(t)
 		})
+		if probe := m.probeBackend(); probe != nil {
+			return m, tea.Batch(tick, probe)
+		}
+		return m, tick
+	case probeMsg:
+		return m, m.backendProbed(msg)
 	}
 	return m, nil
 }
 
 // View renders the REPL interface
 func (m *REPLModel) View() string {
-	logToFile("View() called")
+	logDebug("View() called")
 
 	if m.quitting {
+		if m.savedTo != "" {
+			return "Conversation saved to " + m.savedTo + "\nGoodbye! 👋\n"
+		}
 		return "Goodbye! 👋\n"
 	}
 
@@ -307,7 +471,9 @@ func (m *REPLModel) View() string {
 	// Title
 	s.WriteString("🚀 Slop Shop - AI-Powered Code Analysis\n")
 	s.WriteString("Repository context loaded. Type your questions about the codebase.\n")
-	s.WriteString("Use ↑/↓ arrows to navigate command history, F1-F4 for shortcuts, Ctrl+C to quit.\n\n")
+	s.WriteString("Use ↑/↓ arrows to navigate command history, F1-F4 for shortcuts, Ctrl+C to quit.\n")
+	s.WriteString(m.statusBar())
+	s.WriteString(m.offlineBanner())
 
 	// Show help if requested
 	if m.showHelp {
@@ -317,13 +483,30 @@ func (m *REPLModel) View() string {
 		s.WriteString("  F3       - Toggle repository context info\n")
 		s.WriteString("  F4       - Clear conversation history\n")
 		s.WriteString("  F5       - Clear local context (Ollama internal context persists)\n")
+		s.WriteString("  F6       - Toggle the split view with the file or diff under discussion\n")
+		s.WriteString("  Tab      - Switch focus between the conversation and the side pane\n")
+		s.WriteString("  F7       - Save a code block from the last response to a file\n")
+		s.WriteString("  F8       - Toggle the model, duration and tokens shown under responses\n")
+		s.WriteString("  F9       - Expand or collapse pasted logs in the conversation\n")
 		s.WriteString("  F10      - Exit the REPL\n")
+		s.WriteString("  /preview [question] - Show what a question would send, with token counts\n")
+		s.WriteString("  /remember <fact>    - Save a fact to the project memory for future prompts\n")
+		s.WriteString("  /open <path>        - Show a repository file in the side pane\n")
+		s.WriteString("  /files              - Choose which files are sent as context\n")
+		s.WriteString("  /variants [n]       - Ask for n answers to the last question and pick one\n")
+		s.WriteString("  /approvals          - Review and revoke remembered tool approvals\n")
+		s.WriteString("  /queue              - List the requests in flight and cancel one\n")
+		s.WriteString("  /paste-log [drop]   - Send the log on the clipboard with the next question\n")
+		s.WriteString("  /repo [add] <path>  - Switch to another repository, or add its files to the context\n")
+		s.WriteString("  /preset [name]      - List the presets, or ask with precise, balanced or creative options\n")
+		s.WriteString("  /discussed          - List the repository files named in responses so far\n")
+		s.WriteString("  /run <command>      - Run a shell command in the repository and show its output as it runs\n")
 		if m.debugEnabled {
 			s.WriteString("  Debug logging: ENABLED\n")
 		}
 		s.WriteString("  ↑/↓      - Navigate command history\n")
 		s.WriteString("  Esc      - Hide all panels\n")
-		s.WriteString("  Ctrl+C   - Force quit\n")
+		s.WriteString("  Ctrl+C   - Cancel the request in flight, or quit\n")
 		s.WriteString("\n")
 	}
 
@@ -355,87 +538,69 @@ func (m *REPLModel) View() string {
 		s.WriteString("\n")
 	}
 
+	if len(m.blocks) > 0 {
+		s.WriteString(m.renderCodeBlocks())
+		s.WriteString("\n")
+	}
+
+	if len(m.variants) > 0 {
+		s.WriteString(m.renderVariants())
+		s.WriteString("\n")
+	}
+
+	if m.showFiles {
+		s.WriteString(m.renderFiles())
+		s.WriteString("\n")
+	}
+
+	if m.showApprovals {
+		s.WriteString(m.renderApprovals())
+		s.WriteString("\n")
+	}
+
+	if m.showQueue {
+		s.WriteString(m.renderQueue())
+		s.WriteString("\n")
+	}
+
+	// Show the request preview if requested
+	if m.preview != "" {
+		s.WriteString(m.preview)
+		s.WriteString("\n")
+	}
+
 	// Conversation history
 	if len(m.conversationHistory) > 0 {
 		s.WriteString("Recent conversation:\n")
-		start := 0
-		if len(m.conversationHistory) > 6 {
-			start = len(m.conversationHistory) - 6
-		}
-		for _, exchange := range m.conversationHistory[start:] {
-			if strings.HasPrefix(exchange, "User: ") {
-				s.WriteString(styles.UserStyle.Render(exchange) + "\n")
-			} else if !strings.HasPrefix(exchange, "User: ") && !strings.HasPrefix(exchange, "System: ") {
-				// This is an assistant response (no prefix)
-				response := exchange
-
-				// Don't wrap JSON responses - they should stay intact
-				if strings.Contains(response, "{") && strings.Contains(response, "}") {
-					// This looks like JSON, don't wrap it
-					s.WriteString(styles.AssistantStyle.Render(response) + "\n")
-				} else {
-					// Process markdown responses to preserve line breaks
-					// First try splitting by actual newline characters
-					lines := strings.Split(response, "\n")
-					if len(lines) == 1 {
-						// No actual newlines, try literal \n characters
-						lines := strings.Split(response, "\\n")
-						if len(lines) == 1 {
-							// No line breaks at all, handle as before
-							if len(response) > 80 {
-								wrapped := wrapText(response, 80)
-								s.WriteString(styles.AssistantStyle.Render(wrapped) + "\n")
-							} else {
-								s.WriteString(styles.AssistantStyle.Render(response) + "\n")
-							}
-						} else {
-							// Found literal \n characters, render each line
-							for _, line := range lines {
-								if strings.TrimSpace(line) != "" {
-									// Apply word wrapping to each line
-									if len(line) > 80 {
-										wrapped := wrapText(line, 80)
-										s.WriteString(styles.AssistantStyle.Render(wrapped) + "\n")
-									} else {
-										s.WriteString(styles.AssistantStyle.Render(line) + "\n")
-									}
-								}
-							}
-						}
-					} else {
-						// Found actual newlines, render each line
-						for _, line := range lines {
-							if strings.TrimSpace(line) != "" {
-								// Apply word wrapping to each line
-								if len(line) > 80 {
-									wrapped := wrapText(line, 80)
-									s.WriteString(styles.AssistantStyle.Render(wrapped) + "\n")
-								} else {
-									s.WriteString(styles.AssistantStyle.Render(line) + "\n")
-								}
-							}
-						}
-					}
-				}
-			} else {
-				s.WriteString(exchange + "\n")
-			}
-		}
+		s.WriteString(m.renderConversation())
 		s.WriteString("\n")
 	}
 
+	if m.splitView {
+		conversation := s.String()
+		s.Reset()
+		s.WriteString(m.renderSplit(conversation))
+	}
+
+	if m.confirmSave {
+		s.WriteString(styles.WarningStyle.Render("Save this conversation before quitting? (y/n)"))
+		return s.String()
+	}
+
+	s.WriteString(queueIndicator())
+	s.WriteString(m.attachmentLine())
+
 	// Input prompt
 	if m.processing {
 		// Show rotating spinner when processing
-		spinnerChars := []string{"⠋", "⠙", "⠹", "⠸", "⠼", "⠴", "⠦", "⠧", "⠇", "⠏"}
 		spinnerChar := spinnerChars[m.spinnerFrame%len(spinnerChars)]
 		s.WriteString(spinnerChar)
 		s.WriteString(" ")
-		logToFile(fmt.Sprintf("View: processing=true, spinnerFrame=%d, spinnerChar='%s'", m.spinnerFrame, spinnerChar))
+		logDebug(fmt.Sprintf("View: processing=true, spinnerFrame=%d, spinnerChar='%s'", m.spinnerFrame, spinnerChar))
 	} else {
 		// Show robot emoji when idle
 		s.WriteString("🤖 ")
-		logToFile(fmt.Sprintf("View: processing=false, input='%s'", m.input))
+		logDebug(fmt.Sprintf("View: processing=false, input='%s'", m.input))
 	}
 	s.WriteString(m.input)
 	s.WriteString("█")
@@ -443,6 +608,67 @@ func (m *REPLModel) View() string {
 	return s.String()
 }
 
+// wrapWidth is the width assistant responses are wrapped to: the terminal,
+// or its left half in the split view, and 80 columns until the size is known,
+// narrowed by the -wrap and -indent settings
+func (m *REPLModel) wrapWidth() int {
+	columns := 80
+	if m.width > 0 && m.splitView {
+		columns = max(m.width/2-1, 20)
+	} else if m.width > 0 {
+		columns = max(m.width-1, 20)
+	}
+	width := styles.WrapWidth(columns)
+	if width == 0 {
+		// Not wrapped: longer than any line
+		return math.MaxInt
+	}
+	return min(width, columns)
+}
+
+// drainStream appends every chunk waiting in the stream channel to the
+// response being streamed, so a fast model's output is not held back to one
+// chunk per tick, and stops processing once the response is complete
+func (m *REPLModel) drainStream() {
+	select {
+	case end := <-m.streamDone:
+		// Every chunk was sent before the response completed
+		m.appendChunks()
+		if end.meta != nil && len(m.conversationHistory) > 0 {
+			m.recordMeta(m.conversationHistory[len(m.conversationHistory)-1], *end.meta)
+			m.noteReferences(m.conversationHistory[len(m.conversationHistory)-1])
+		}
+		var connErr *ollama.ConnectionError
+		if errors.As(end.err, &connErr) {
+			m.goOffline(end.input, end.err)
+			if m.attachment == nil {
+				m.attachment = end.attachment
+			}
+		}
+		m.processing = false
+		m.responseComplete = true
+	default:
+		m.appendChunks()
+	}
+}
+
+// appendChunks appends the chunks waiting in the stream channel
+func (m *REPLModel) appendChunks() {
+	for {
+		select {
+		case chunk := <-m.streamChannel:
+			if len(m.conversationHistory) > 0 {
+				m.conversationHistory[len(m.conversationHistory)-1] += chunk
+			} else {
+				logDebug("Warning: conversation history empty, creating new response entry")
+				m.conversationHistory = append(m.conversationHistory, chunk)
+			}
+		default:
+			return
+		}
+	}
+}
+
 // submitInput processes the current input
 func (m *REPLModel) submitInput() tea.Cmd {
 	input := strings.TrimSpace(m.input)
@@ -456,6 +682,87 @@ func (m *REPLModel) submitInput() tea.Cmd {
 	}
 	m.historyIndex = len(m.history)
 
+	if input == "/preview" || strings.HasPrefix(input, "/preview ") {
+		question := strings.TrimSpace(strings.TrimPrefix(input, "/preview"))
+		m.input = ""
+		m.preview = RenderPreview(m.model, m.system, question, m.context, m.toolsEnabled, false)
+		return nil
+	}
+
+	if input == "/remember" || strings.HasPrefix(input, "/remember ") {
+		m.input = ""
+		m.conversationHistory = append(m.conversationHistory, "System: "+remember(strings.TrimPrefix(input, "/remember")))
+		return nil
+	}
+
+	if input == "/variants" || strings.HasPrefix(input, "/variants ") {
+		m.input = ""
+		return m.requestVariants(strings.TrimPrefix(input, "/variants"))
+	}
+
+	if input == "/paste-log" || strings.HasPrefix(input, "/paste-log ") {
+		m.input = ""
+		return m.pasteLog(strings.TrimPrefix(input, "/paste-log"))
+	}
+
+	if input == "/preset" || strings.HasPrefix(input, "/preset ") {
+		m.input = ""
+		m.choosePreset(strings.TrimPrefix(input, "/preset"))
+		return nil
+	}
+
+	if input == "/repo" || strings.HasPrefix(input, "/repo ") {
+		m.input = ""
+		return m.switchRepo(strings.TrimPrefix(input, "/repo"))
+	}
+
+	if input == "/run" || strings.HasPrefix(input, "/run ") {
+		m.input = ""
+		return m.runCommand(strings.TrimPrefix(input, "/run"))
+	}
+
+	if input == "/discussed" {
+		m.input = ""
+		m.conversationHistory = append(m.conversationHistory, "System: "+m.describeDiscussed())
+		return nil
+	}
+
+	if input == "/files" {
+		m.input = ""
+		m.openFiles()
+		return nil
+	}
+
+	if input == "/approvals" {
+		m.input = ""
+		m.openApprovals()
+		return nil
+	}
+
+	if input == "/queue" {
+		m.input = ""
+		m.openQueue()
+		return nil
+	}
+
+	if input == "/open" || strings.HasPrefix(input, "/open ") {
+		m.input = ""
+		if err := m.openPane(strings.TrimSpace(strings.TrimPrefix(input, "/open"))); err != nil {
+			m.conversationHistory = append(m.conversationHistory, "System: Could not open: "+err.Error())
+			return nil
+		}
+		m.splitView = true
+		return nil
+	}
+
+	// Questions wait while the server is offline rather than failing again
+	if m.offline {
+		m.input = ""
+		m.pendingInput = input
+		m.conversationHistory = append(m.conversationHistory, "System: Ollama is offline; the question is sent once it is back")
+		return nil
+	}
+
 	// Clear input immediately and set processing state
 	m.input = ""
 	m.processing = true
@@ -466,6 +773,16 @@ func (m *REPLModel) submitInput() tea.Cmd {
 	}
 }
 
+// quit ends the REPL, first offering to save a conversation that has started
+func (m *REPLModel) quit() tea.Cmd {
+	if saveDir != "" && len(m.conversationHistory) > 0 {
+		m.confirmSave = true
+		return nil
+	}
+	m.quitting = true
+	return tea.Quit
+}
+
 // navigateHistory moves through command history
 func (m *REPLModel) navigateHistory(direction int) tea.Cmd {
 	return func() tea.Msg {
@@ -507,61 +824,54 @@ func (m *REPLModel) toggleContext() tea.Cmd {
 	}
 }
 
-// Global debug flag
-var globalDebugEnabled bool
+// spinnerChars are the frames of the spinner shown while waiting
+var spinnerChars = []string{"⠋", "⠙", "⠹", "⠸", "⠼", "⠴", "⠦", "⠧", "⠇", "⠏"}
 
-// SetGlobalDebug sets the global debug flag
-func SetGlobalDebug(enabled bool) {
-	globalDebugEnabled = enabled
+// repoPath is the repository whose project memory /remember adds to
+var repoPath = "."
+
+// SetRepoPath sets the repository whose project memory /remember adds to
+func SetRepoPath(path string) {
+	repoPath = path
 }
 
-// logToFile writes debug information to a log file only if debug is enabled
-func logToFile(message string) {
-	if !globalDebugEnabled {
-		return
+// remember saves a note to the project memory and describes the outcome
+func remember(note string) string {
+	if err := repo.Remember(repoPath, note); err != nil {
+		return "Could not remember: " + err.Error()
 	}
-
-	f, err := os.OpenFile("repl_debug.log", os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	notes, err := repo.LoadMemory(repoPath)
 	if err != nil {
-		return
+		return "Could not reload memory: " + err.Error()
 	}
-	defer f.Close()
+	ollama.SetMemory(notes)
+	return "Remembered in " + repo.MemoryFile
+}
 
-	timestamp := time.Now().Format("15:04:05.000")
-	logMessage := fmt.Sprintf("[%s] %s\n", timestamp, message)
-	f.WriteString(logMessage)
+// logDebug writes debug output for the REPL if it is enabled for the tui component
+func logDebug(message string) {
+	debuglog.Logf("tui", "%s", message)
 }
 
-// wrapText wraps text to a specified width, breaking at word boundaries
+// wrapText wraps prose to width visible columns, breaking at word boundaries.
+// ANSI escape sequences take no width and wide characters take two. Fenced
+// code blocks and indented lines are left as they are, as are blank lines and
+// the spacing within a line.
 func wrapText(text string, width int) string {
-	if len(text) <= width {
-		return text
-	}
-
-	var result strings.Builder
-	words := strings.Fields(text)
-	currentLine := ""
-
-	for _, word := range words {
-		if len(currentLine)+len(word)+1 <= width {
-			if currentLine != "" {
-				currentLine += " " + word
-			} else {
-				currentLine = word
-			}
-		} else {
-			if currentLine != "" {
-				result.WriteString(currentLine + "\n")
-			}
-			currentLine = word
+	lines := strings.Split(text, "\n")
+	inFence := false
+	for i, line := range lines {
+		trimmed := strings.TrimSpace(ansi.Strip(line))
+		if strings.HasPrefix(trimmed, "```") || strings.HasPrefix(trimmed, "~~~") {
+			inFence = !inFence
+			continue
 		}
+		if inFence || strings.HasPrefix(line, "    ") || strings.HasPrefix(line, "\t") || ansi.StringWidth(line) <= width {
+			continue
+		}
+		lines[i] = ansi.Wrap(line, width, "")
 	}
-
-	if currentLine != "" {
-		result.WriteString(currentLine)
-	}
-
-	return result.String()
+	return strings.Join(lines, "\n")
 }
 
 // buildREPLPrompt builds a prompt that includes conversation history
@@ -0,0 +1,164 @@
+package tui
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	tea "github.com/charmbracelet/bubbletea"
+	"github.com/kek/slop-shop/ollama"
+	"github.com/kek/slop-shop/styles"
+)
+
+// defaultVariants and maxVariants are how many completions /variants asks for
+// without a count and at most, so each can be picked with a digit
+const (
+	defaultVariants = 3
+	maxVariants     = 9
+)
+
+// variantsMsg carries the completions requested by /variants
+type variantsMsg struct {
+	prompt    string
+	responses []string
+	meta      []messageMeta
+	errs      []error
+}
+
+// lastPrompt returns the most recent question asked in the conversation, or ""
+func (m *REPLModel) lastPrompt() string {
+	for i := len(m.conversationHistory) - 1; i >= 0; i-- {
+		if prompt, ok := strings.CutPrefix(m.conversationHistory[i], "User: "); ok {
+			return prompt
+		}
+	}
+	return ""
+}
+
+// requestVariants asks for n completions of the last question at once, each
+// with its own seed
+func (m *REPLModel) requestVariants(args string) tea.Cmd {
+	n := defaultVariants
+	if args = strings.TrimSpace(args); args != "" {
+		var err error
+		if n, err = strconv.Atoi(args); err != nil || n < 1 || n > maxVariants {
+			m.conversationHistory = append(m.conversationHistory, fmt.Sprintf("System: /variants takes a count from 1 to %d", maxVariants))
+			return nil
+		}
+	}
+	prompt := m.lastPrompt()
+	if prompt == "" {
+		m.conversationHistory = append(m.conversationHistory, "System: Ask a question before requesting variants of the answer")
+		return nil
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	m.cancel = cancel
+	m.processing = true
+	url, model, system, temperature, topP, repoContext, toolsEnabled := m.ollamaURL, m.model, m.system, m.temperature, m.topP, m.context, m.toolsEnabled
+	return func() tea.Msg {
+		defer cancel()
+		msg := variantsMsg{prompt: prompt, responses: make([]string, n), meta: make([]messageMeta, n), errs: make([]error, n)}
+		var wg sync.WaitGroup
+		for i := range n {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				client := ollama.NewClient(url, model, temperature, topP)
+				client.System = system
+				client.Seed = rand.Intn(1<<31-1) + 1
+				client.Ctx = ctx
+				client.Label = fmt.Sprintf("variant %d/%d", i+1, n)
+				started := time.Now()
+				var stats ollama.Stats
+				msg.responses[i], stats, msg.errs[i] = client.GenerateWithStats(prompt, repoContext, toolsEnabled, nil)
+				msg.meta[i] = messageMeta{Model: model, Duration: time.Since(started), Stats: stats}
+			}()
+		}
+		wg.Wait()
+		return msg
+	}
+}
+
+// showVariants presents the completions that arrived for selection
+func (m *REPLModel) showVariants(msg variantsMsg) {
+	m.processing = false
+	m.variants = nil
+	m.variantMeta = nil
+	var failed []string
+	for i, response := range msg.responses {
+		if msg.errs[i] != nil {
+			failed = append(failed, msg.errs[i].Error())
+			continue
+		}
+		m.variants = append(m.variants, response)
+		m.variantMeta = append(m.variantMeta, msg.meta[i])
+	}
+	if len(failed) > 0 {
+		m.conversationHistory = append(m.conversationHistory, fmt.Sprintf("System: %d of %d variants failed: %s", len(failed), len(msg.responses), failed[0]))
+	}
+	m.variantsPrompt = msg.prompt
+	m.variantCursor = 0
+}
+
+// variantsKey handles a key while variants are shown
+func (m *REPLModel) variantsKey(key string) {
+	switch key {
+	case "left", "up":
+		m.variantCursor = max(m.variantCursor-1, 0)
+	case "right", "down", "tab":
+		m.variantCursor = min(m.variantCursor+1, len(m.variants)-1)
+	case "enter":
+		m.chooseVariant(m.variantCursor)
+	case "esc":
+		m.variants = nil
+	default:
+		if n, err := strconv.Atoi(key); err == nil && n >= 1 && n <= len(m.variants) {
+			m.chooseVariant(n - 1)
+		}
+	}
+}
+
+// chooseVariant puts a variant in the conversation as the answer to its
+// question, replacing the answer given before
+func (m *REPLModel) chooseVariant(i int) {
+	chosen := m.variants[i]
+	m.variants = nil
+	defer m.recordMeta(chosen, m.variantMeta[i])
+	m.noteReferences(chosen)
+	for j := len(m.conversationHistory) - 1; j >= 0; j-- {
+		if m.conversationHistory[j] != "User: "+m.variantsPrompt {
+			continue
+		}
+		if j+1 < len(m.conversationHistory) && !strings.HasPrefix(m.conversationHistory[j+1], "User: ") && !strings.HasPrefix(m.conversationHistory[j+1], "System: ") {
+			m.conversationHistory[j+1] = chosen
+		} else {
+			m.conversationHistory = append(m.conversationHistory[:j+1], append([]string{chosen}, m.conversationHistory[j+1:]...)...)
+		}
+		return
+	}
+	m.conversationHistory = append(m.conversationHistory, "User: "+m.variantsPrompt, chosen)
+}
+
+// renderVariants shows the selected variant with a tab for each
+func (m *REPLModel) renderVariants() string {
+	var s strings.Builder
+	s.WriteString(fmt.Sprintf("Variants of: %s\n", m.variantsPrompt))
+	for i := range m.variants {
+		tab := fmt.Sprintf(" %d ", i+1)
+		if i == m.variantCursor {
+			s.WriteString(styles.PromptStyle.Render("[" + tab + "]"))
+		} else {
+			s.WriteString(styles.MutedStyle.Render(" " + tab + " "))
+		}
+	}
+	s.WriteString("\n\n")
+	s.WriteString(styles.AssistantStyle.Render(wrapText(strings.TrimSpace(m.variants[m.variantCursor]), m.wrapWidth())))
+	s.WriteString("\n\n")
+	s.WriteString(styles.MutedStyle.Render("←/→ switch · Enter or 1-9 use this answer · Esc discard") + "\n")
+	return s.String()
+}
@@ -0,0 +1,141 @@
+package tui
+
+import (
+	"io"
+	"strings"
+
+	"github.com/charmbracelet/x/ansi"
+)
+
+// WrapWriter wraps streamed text as wrapText wraps a whole response: prose is
+// broken at word boundaries as the words arrive, while fenced code blocks,
+// indented lines and blank lines pass through. Every line but a blank one
+// starts with indent.
+type WrapWriter struct {
+	out    io.Writer
+	width  int
+	indent string
+
+	line     strings.Builder // The current line up to its first word, until it is known whether it is prose
+	decided  bool            // The kind of the current line is known and its start was written
+	verbatim bool            // The current line is code and is not wrapped
+	inFence  bool
+	column   int             // Visible columns written on the current line, without the indent
+	spaces   strings.Builder // Spaces after the last word written
+	word     strings.Builder // The word being received
+}
+
+// NewWrapWriter returns a writer wrapping text to width columns after indent
+// and writing it to out; a width of 0 only indents it
+func NewWrapWriter(out io.Writer, width int, indent string) *WrapWriter {
+	return &WrapWriter{out: out, width: width, indent: indent}
+}
+
+// Write wraps p and writes the words in it that are complete
+func (w *WrapWriter) Write(p []byte) (int, error) {
+	var buf strings.Builder
+	for _, r := range string(p) {
+		w.put(&buf, r)
+	}
+	if _, err := io.WriteString(w.out, buf.String()); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Flush writes the word still being received
+func (w *WrapWriter) Flush() error {
+	var buf strings.Builder
+	w.decide(&buf)
+	w.flushWord(&buf)
+	_, err := io.WriteString(w.out, buf.String())
+	return err
+}
+
+// put adds one rune of the stream to buf
+func (w *WrapWriter) put(buf *strings.Builder, r rune) {
+	if r == '\n' {
+		w.decide(buf)
+		w.flushWord(buf)
+		buf.WriteByte('\n')
+		w.line.Reset()
+		w.spaces.Reset()
+		w.decided, w.verbatim, w.column = false, false, 0
+		return
+	}
+
+	if !w.decided {
+		w.line.WriteRune(r)
+		// The line's kind is known from its leading whitespace and first word
+		text := w.line.String()
+		trimmed := strings.TrimLeft(text, " \t")
+		if strings.HasPrefix(text, "    ") || strings.HasPrefix(text, "\t") || (trimmed != "" && (r == ' ' || r == '\t')) {
+			w.decide(buf)
+		}
+		return
+	}
+
+	switch {
+	case w.verbatim:
+		buf.WriteRune(r)
+	case r == ' ' || r == '\t':
+		w.flushWord(buf)
+		w.spaces.WriteRune(r)
+	default:
+		w.word.WriteRune(r)
+	}
+}
+
+// decide settles whether the current line is code or prose, once its
+// beginning has arrived, and writes that beginning
+func (w *WrapWriter) decide(buf *strings.Builder) {
+	if w.decided {
+		return
+	}
+	w.decided = true
+	text := w.line.String()
+	w.line.Reset()
+	if text == "" {
+		return
+	}
+
+	trimmed := strings.TrimSpace(text)
+	fence := strings.HasPrefix(trimmed, "```") || strings.HasPrefix(trimmed, "~~~")
+	if fence || w.inFence || strings.HasPrefix(text, "    ") || strings.HasPrefix(text, "\t") {
+		if fence {
+			w.inFence = !w.inFence
+		}
+		w.verbatim = true
+		buf.WriteString(w.indent + text)
+		return
+	}
+
+	// Prose: the spacing before the first word is kept, and the rest goes
+	// through the wrapping as it would have
+	lead := text[:len(text)-len(strings.TrimLeft(text, " \t"))]
+	buf.WriteString(w.indent + lead)
+	w.column = ansi.StringWidth(lead)
+	for _, r := range text[len(lead):] {
+		w.put(buf, r)
+	}
+}
+
+// flushWord writes the word received, after the spaces before it or, when it
+// does not fit, on a new line
+func (w *WrapWriter) flushWord(buf *strings.Builder) {
+	if w.word.Len() == 0 {
+		return
+	}
+	word := w.word.String()
+	width := ansi.StringWidth(word)
+	spaces := w.spaces.String()
+	if w.width > 0 && w.column > 0 && w.column+len(spaces)+width > w.width {
+		buf.WriteString("\n" + w.indent)
+		w.column = 0
+		spaces = ""
+	}
+	buf.WriteString(spaces + word)
+	w.column += len(spaces) + width
+	w.spaces.Reset()
+	w.word.Reset()
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/kek/slop-shop/config"
+	"github.com/kek/slop-shop/ollama"
+)
+
+// usageEntry is one generation recorded in the usage ledger
+type usageEntry struct {
+	Time           time.Time     `json:"time"`
+	Command        string        `json:"command"`
+	Model          string        `json:"model"`
+	PromptTokens   int           `json:"prompt_tokens"`
+	ResponseTokens int           `json:"response_tokens"`
+	Duration       time.Duration `json:"duration"`
+}
+
+// usageTotal sums the ledger entries that share a key
+type usageTotal struct {
+	key            string
+	runs           int
+	promptTokens   int
+	responseTokens int
+	duration       time.Duration
+}
+
+// usageMu serializes appends to the ledger, which the serve command makes
+// from several requests at once
+var usageMu sync.Mutex
+
+// recordUsage returns a hook for ollama.SetUsageHook that appends each
+// generation of command to the ledger. The ledger is best effort: a run never
+// fails because its usage could not be written.
+func recordUsage(command string) func(string, ollama.Stats) {
+	return func(model string, stats ollama.Stats) {
+		path := config.UsagePath()
+		if path == "" {
+			return
+		}
+		data, err := json.Marshal(usageEntry{
+			Time:           time.Now(),
+			Command:        command,
+			Model:          model,
+			PromptTokens:   stats.PromptTokens,
+			ResponseTokens: stats.ResponseTokens,
+			Duration:       stats.TotalDuration,
+		})
+		if err != nil {
+			return
+		}
+
+		usageMu.Lock()
+		defer usageMu.Unlock()
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return
+		}
+		file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		if err != nil {
+			return
+		}
+		defer file.Close()
+		file.Write(append(data, '\n'))
+	}
+}
+
+// readUsage reads the ledger entries recorded since the given time; a missing
+// ledger has no entries
+func readUsage(path string, since time.Time) ([]usageEntry, error) {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading usage ledger: %v", err)
+	}
+	defer file.Close()
+
+	var entries []usageEntry
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var entry usageEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			continue // Skip lines cut off by an interrupted write
+		}
+		if !entry.Time.Before(since) {
+			entries = append(entries, entry)
+		}
+	}
+	return entries, scanner.Err()
+}
+
+// summarizeUsage totals the entries by key, sorted by key
+func summarizeUsage(entries []usageEntry, key func(usageEntry) string) []usageTotal {
+	totals := map[string]*usageTotal{}
+	for _, entry := range entries {
+		k := key(entry)
+		total, ok := totals[k]
+		if !ok {
+			total = &usageTotal{key: k}
+			totals[k] = total
+		}
+		total.runs++
+		total.promptTokens += entry.PromptTokens
+		total.responseTokens += entry.ResponseTokens
+		total.duration += entry.Duration
+	}
+
+	result := make([]usageTotal, 0, len(totals))
+	for _, total := range totals {
+		result = append(result, *total)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].key < result[j].key })
+	return result
+}
+
+// runUsage prints the token usage recorded in the ledger by day, model and command
+func runUsage(args []string) error {
+	fs := newFlagSet("usage")
+	days := fs.Int("days", 30, "Days of usage to include (0 for all)")
+	fs.Parse(args)
+
+	since := time.Time{}
+	if *days > 0 {
+		now := time.Now()
+		since = time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location()).AddDate(0, 0, 1-*days)
+	}
+
+	path := config.UsagePath()
+	entries, err := readUsage(path, since)
+	if err != nil {
+		return err
+	}
+	if len(entries) == 0 {
+		fmt.Printf("No usage recorded in %s\n", path)
+		return nil
+	}
+
+	printUsageTable(os.Stdout, "DAY", summarizeUsage(entries, func(e usageEntry) string { return e.Time.Local().Format("2006-01-02") }))
+	printUsageTable(os.Stdout, "MODEL", summarizeUsage(entries, func(e usageEntry) string { return e.Model }))
+	printUsageTable(os.Stdout, "COMMAND", summarizeUsage(entries, func(e usageEntry) string { return e.Command }))
+	printUsageTable(os.Stdout, "TOTAL", summarizeUsage(entries, func(e usageEntry) string { return "all" }))
+	return nil
+}
+
+// printUsageTable prints one table of totals followed by a blank line
+func printUsageTable(w io.Writer, heading string, totals []usageTotal) {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(tw, "%s\tRUNS\tPROMPT TOKENS\tRESPONSE TOKENS\tTOTAL TOKENS\tMODEL TIME\n", heading)
+	for _, total := range totals {
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%d\t%d\t%s\n", total.key, total.runs, total.promptTokens, total.responseTokens,
+			total.promptTokens+total.responseTokens, total.duration.Round(time.Second))
+	}
+	tw.Flush()
+	fmt.Fprintln(w)
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"fmt"
+	"runtime"
+	"runtime/debug"
+)
+
+// version is the release version, set at build time with
+// -ldflags "-X main.version=v1.2.3"
+var version = "dev"
+
+// versionString describes the build: the version, the VCS revision and time
+// embedded by the go tool, and the Go version and platform
+func versionString() string {
+	text := "slop-shop " + version
+	revision, modified, buildTime := "", false, ""
+
+	if info, ok := debug.ReadBuildInfo(); ok {
+		if version == "dev" && info.Main.Version != "" && info.Main.Version != "(devel)" {
+			text = "slop-shop " + info.Main.Version
+		}
+		for _, setting := range info.Settings {
+			switch setting.Key {
+			case "vcs.revision":
+				revision = setting.Value
+			case "vcs.modified":
+				modified = setting.Value == "true"
+			case "vcs.time":
+				buildTime = setting.Value
+			}
+		}
+	}
+
+	if revision != "" {
+		if len(revision) > 12 {
+			revision = revision[:12]
+		}
+		if modified {
+			revision += "-dirty"
+		}
+		text += fmt.Sprintf(" (%s", revision)
+		if buildTime != "" {
+			text += ", " + buildTime
+		}
+		text += ")"
+	}
+	return text + fmt.Sprintf(" %s %s/%s", runtime.Version(), runtime.GOOS, runtime.GOARCH)
+}
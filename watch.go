@@ -0,0 +1,136 @@
+package main
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/kek/slop-shop/repo"
+	"github.com/kek/slop-shop/styles"
+)
+
+// watchInterval is how often watch mode looks for changed files
+var watchInterval = 500 * time.Millisecond
+
+// fileStamp identifies one version of a file
+type fileStamp struct {
+	modTime time.Time
+	size    int64
+}
+
+// snapshotFiles records the modification time and size of every file in
+// repoPath that is not excluded
+func snapshotFiles(repoPath string, exclude []string) (map[string]fileStamp, error) {
+	files := map[string]fileStamp{}
+	err := filepath.WalkDir(repoPath, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		relPath, err := filepath.Rel(repoPath, path)
+		if err != nil {
+			return err
+		}
+		if relPath != "." && (repo.ShouldExclude(relPath, exclude) || repo.IsArtifact(repoPath, relPath, nil)) {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if d.IsDir() {
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			// The file was removed while walking
+			return nil
+		}
+		files[relPath] = fileStamp{modTime: info.ModTime(), size: info.Size()}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error scanning %s: %v", repoPath, err)
+	}
+	return files, nil
+}
+
+// changedFiles lists the files added, modified or removed between two snapshots
+func changedFiles(before, after map[string]fileStamp) []string {
+	var changed []string
+	for path, stamp := range after {
+		if old, ok := before[path]; !ok || old != stamp {
+			changed = append(changed, path)
+		}
+	}
+	for path := range before {
+		if _, ok := after[path]; !ok {
+			changed = append(changed, path)
+		}
+	}
+	sort.Strings(changed)
+	return changed
+}
+
+// watchRepository calls run, then calls it again whenever files in repoPath
+// change. A run starts once no file has changed for debounce, so a burst of
+// saves causes one run. Failed runs are reported and watching continues until
+// stop is closed.
+func watchRepository(repoPath string, exclude []string, debounce time.Duration, stop <-chan struct{}, run func() error) error {
+	for {
+		if err := run(); err != nil {
+			fmt.Fprintln(os.Stderr, styles.ErrorStyle.Render(fmt.Sprintf("❌ %v", err)))
+		}
+
+		// Files written by the run itself, such as -out, are part of the new baseline
+		baseline, err := snapshotFiles(repoPath, exclude)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(chatter(), styles.InfoStyle.Render("👀 Watching for changes (Ctrl+C to stop)..."))
+
+		var changed []string
+		lastChange := time.Time{}
+		for {
+			select {
+			case <-stop:
+				return nil
+			case <-time.After(watchInterval):
+			}
+
+			current, err := snapshotFiles(repoPath, exclude)
+			if err != nil {
+				return err
+			}
+			if diff := changedFiles(baseline, current); len(diff) > 0 {
+				changed = append(changed, diff...)
+				baseline = current
+				lastChange = time.Now()
+				continue
+			}
+			if len(changed) > 0 && time.Since(lastChange) >= debounce {
+				break
+			}
+		}
+
+		fmt.Fprintln(chatter(), styles.InfoStyle.Render(fmt.Sprintf("🔁 %s changed, running again", describeChanges(changed))))
+	}
+}
+
+// describeChanges names the changed files for the rerun banner
+func describeChanges(changed []string) string {
+	seen := map[string]bool{}
+	var unique []string
+	for _, path := range changed {
+		if !seen[path] {
+			seen[path] = true
+			unique = append(unique, path)
+		}
+	}
+	if len(unique) == 1 {
+		return unique[0]
+	}
+	return fmt.Sprintf("%d files", len(unique))
+}
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/kek/slop-shop/repo"
+	"github.com/kek/slop-shop/styles"
+	"github.com/kek/slop-shop/tools"
+)
+
+// maxSnapshotFile is the largest file whose content a workspace snapshot keeps;
+// larger files are compared by size and modification time only
+const maxSnapshotFile = 1 << 20
+
+var (
+	// workspaceExclude holds the exclude patterns of the files a workspace snapshot skips
+	workspaceExclude []string
+
+	// workspaceInput is where the end-of-session prompt reads the user's choice
+	workspaceInput io.Reader = os.Stdin
+)
+
+// snapshotEntry is one file of a workspace snapshot
+type snapshotEntry struct {
+	stamp   fileStamp
+	mode    fs.FileMode
+	content []byte // nil for files larger than maxSnapshotFile
+}
+
+// workspaceSnapshot is the state of the repository's files at some moment
+type workspaceSnapshot struct {
+	repoPath string
+	files    map[string]snapshotEntry
+	dirty    map[string]bool // Files with uncommitted changes when the snapshot was taken
+}
+
+// workspaceChange is a file that differs from a snapshot
+type workspaceChange struct {
+	Path   string
+	Status string // "added", "modified" or "removed"
+	Diff   string // Unified diff, empty for binary and large files
+}
+
+// takeSnapshot records the content of every file in repoPath that is not
+// excluded, so the changes a tools session makes can be shown and undone
+func takeSnapshot(repoPath string) (*workspaceSnapshot, error) {
+	stamps, err := snapshotFiles(repoPath, workspaceExclude)
+	if err != nil {
+		return nil, err
+	}
+	snapshot := &workspaceSnapshot{repoPath: repoPath, files: map[string]snapshotEntry{}, dirty: dirtyFiles(repoPath)}
+	for path, stamp := range stamps {
+		entry := snapshotEntry{stamp: stamp}
+		if info, err := os.Stat(filepath.Join(repoPath, path)); err == nil {
+			entry.mode = info.Mode().Perm()
+		}
+		if stamp.size <= maxSnapshotFile {
+			if entry.content, err = os.ReadFile(filepath.Join(repoPath, path)); err != nil {
+				// The file was removed while reading
+				continue
+			}
+		}
+		snapshot.files[path] = entry
+	}
+	return snapshot, nil
+}
+
+// dirtyFiles returns the files below repoPath that git reports as changed
+// since the last commit or as untracked, or none outside a git repository
+func dirtyFiles(repoPath string) map[string]bool {
+	dirty := map[string]bool{}
+	changed, err := gitOutput(repoPath, "diff", "--name-only", "-z", "--relative", "HEAD")
+	if err != nil {
+		return dirty
+	}
+	untracked, _ := gitOutput(repoPath, "ls-files", "--others", "--exclude-standard", "-z")
+	for _, path := range strings.Split(changed+untracked, "\x00") {
+		if path != "" {
+			dirty[filepath.FromSlash(path)] = true
+		}
+	}
+	return dirty
+}
+
+// changes compares the files on disk with the snapshot and returns those
+// added, modified or removed since, sorted by path
+func (s *workspaceSnapshot) changes() ([]workspaceChange, error) {
+	stamps, err := snapshotFiles(s.repoPath, workspaceExclude)
+	if err != nil {
+		return nil, err
+	}
+	before := map[string]fileStamp{}
+	for path, entry := range s.files {
+		before[path] = entry.stamp
+	}
+
+	var changes []workspaceChange
+	for _, path := range changedFiles(before, stamps) {
+		old, existed := s.files[path]
+		current, err := os.ReadFile(filepath.Join(s.repoPath, path))
+		exists := err == nil
+		switch {
+		case !existed && !exists:
+			continue
+		case existed && exists && old.content != nil && string(old.content) == string(current):
+			// Touched but not changed
+			continue
+		}
+
+		change := workspaceChange{Path: path, Status: "modified"}
+		if !existed {
+			change.Status = "added"
+		} else if !exists {
+			change.Status = "removed"
+		}
+		if (existed && old.content == nil) || !repo.IsTextFile(old.content) || !repo.IsTextFile(current) {
+			changes = append(changes, change)
+			continue
+		}
+		change.Diff = tools.UnifiedDiff(filepath.ToSlash(path), string(old.content), string(current))
+		if change.Status == "removed" {
+			change.Diff = strings.Replace(change.Diff, "+++ b/"+filepath.ToSlash(path), "+++ /dev/null", 1)
+		}
+		changes = append(changes, change)
+	}
+	return changes, nil
+}
+
+// revert puts the files back as they were in the snapshot: it restores the
+// changed and removed files and deletes the added ones. Large files cannot be
+// restored and are reported.
+func (s *workspaceSnapshot) revert(changes []workspaceChange) error {
+	var failed []string
+	for _, change := range changes {
+		path := filepath.Join(s.repoPath, change.Path)
+		if change.Status == "added" {
+			if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+				failed = append(failed, fmt.Sprintf("%s: %v", change.Path, err))
+			}
+			continue
+		}
+		entry := s.files[change.Path]
+		if entry.content == nil && entry.stamp.size > 0 {
+			failed = append(failed, fmt.Sprintf("%s: too large to have been saved", change.Path))
+			continue
+		}
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			failed = append(failed, fmt.Sprintf("%s: %v", change.Path, err))
+			continue
+		}
+		if err := os.WriteFile(path, entry.content, entry.mode); err != nil {
+			failed = append(failed, fmt.Sprintf("%s: %v", change.Path, err))
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("could not revert %s", strings.Join(failed, "; "))
+	}
+	return nil
+}
+
+// workspaceDiff joins the diffs of the changes into one patch, naming the
+// binary and large files it cannot show
+func workspaceDiff(changes []workspaceChange) string {
+	var diff strings.Builder
+	for _, change := range changes {
+		if change.Diff == "" {
+			fmt.Fprintf(&diff, "Binary or large file %s %s\n", change.Path, change.Status)
+			continue
+		}
+		diff.WriteString(change.Diff)
+	}
+	return diff.String()
+}
+
+// reviewWorkspace shows everything a tools session changed on disk since
+// snapshot, including changes made by commands, and on a terminal offers to
+// commit, stash or revert them. It returns the consolidated diff.
+func reviewWorkspace(snapshot *workspaceSnapshot, prompt string) (string, error) {
+	changes, err := snapshot.changes()
+	if err != nil || len(changes) == 0 {
+		return "", err
+	}
+	diff := workspaceDiff(changes)
+	fmt.Fprintln(chatter(), styles.TitleStyle.Render(fmt.Sprintf("\n📂 Changes in the workspace this session (%d files)", len(changes))))
+	printDiff(chatter(), diff)
+
+	if !stdinIsTerminal() || outputFormat != "text" {
+		return diff, nil
+	}
+	return diff, resolveWorkspace(snapshot, changes, prompt)
+}
+
+// resolveWorkspace asks what to do with the changes of a session and does it.
+// Commit and stash leave out the files that had uncommitted changes before the
+// session, since they would take the user's own changes along; revert puts
+// those back as they were before the session.
+func resolveWorkspace(snapshot *workspaceSnapshot, changes []workspaceChange, prompt string) error {
+	var paths, dirty []string
+	for _, change := range changes {
+		if snapshot.dirty[change.Path] {
+			dirty = append(dirty, change.Path)
+		} else {
+			paths = append(paths, change.Path)
+		}
+	}
+	sort.Strings(paths)
+	sort.Strings(dirty)
+	if len(dirty) > 0 {
+		fmt.Fprintln(chatter(), styles.WarningStyle.Render(fmt.Sprintf("⚠️  %s had uncommitted changes before the session; commit and stash leave them out", strings.Join(dirty, ", "))))
+	}
+
+	input := bufio.NewReader(workspaceInput)
+	for {
+		fmt.Fprint(display(), styles.PromptStyle.Render("[c]ommit, [s]tash, [r]evert or [k]eep the changes? "))
+		answer, err := input.ReadString('\n')
+		if err != nil && answer == "" {
+			return nil
+		}
+
+		choice := strings.ToLower(strings.TrimSpace(answer))
+		if len(paths) == 0 && (choice == "c" || choice == "commit" || choice == "s" || choice == "stash") {
+			fmt.Fprintln(chatter(), styles.WarningStyle.Render("Every changed file had uncommitted changes before the session; revert or keep them"))
+			continue
+		}
+		switch choice {
+		case "c", "commit":
+			if err := commitWorkspace(snapshot.repoPath, paths, prompt); err != nil {
+				return err
+			}
+			fmt.Fprintln(chatter(), styles.SuccessStyle.Render("✅ Changes committed"))
+			return nil
+		case "s", "stash":
+			if _, err := gitOutput(snapshot.repoPath, append([]string{"stash", "push", "--include-untracked", "-m", commitSubject(prompt), "--"}, paths...)...); err != nil {
+				return err
+			}
+			fmt.Fprintln(chatter(), styles.SuccessStyle.Render("✅ Changes stashed; `git stash pop` brings them back"))
+			return nil
+		case "r", "revert":
+			if err := snapshot.revert(changes); err != nil {
+				return err
+			}
+			fmt.Fprintln(chatter(), styles.SuccessStyle.Render("✅ Changes reverted"))
+			return nil
+		case "", "k", "keep":
+			return nil
+		}
+	}
+}
+
+// commitWorkspace commits the changed paths, including removed files, with a
+// message naming the prompt that made them
+func commitWorkspace(repoPath string, paths []string, prompt string) error {
+	if _, err := gitOutput(repoPath, append([]string{"add", "-A", "--"}, paths...)...); err != nil {
+		return err
+	}
+	cmd := exec.Command("git", append([]string{"commit", "-F", "-", "--"}, paths...)...)
+	cmd.Dir = repoPath
+	cmd.Stdin = strings.NewReader(commitSubject(prompt) + "\n\nPrompt:\n\n" + prompt + "\n")
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("git commit: %s", strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+// commitSubject is the subject line for a commit or stash of a session's changes
+func commitSubject(prompt string) string {
+	subject, _, _ := strings.Cut(strings.TrimSpace(prompt), "\n")
+	if runes := []rune(subject); len(runes) > 60 {
+		subject = strings.TrimSpace(string(runes[:57])) + "..."
+	}
+	return "slop-shop: " + subject
+}